@@ -7,14 +7,18 @@ import (
 	"fmt"
 	"log/slog"
 	"net/netip"
-	"path"
+	"os"
+	"time"
 
-	"github.com/bepass-org/warp-plus/iputils"
+	"github.com/bepass-org/warp-plus/masque"
 	"github.com/bepass-org/warp-plus/psiphon"
 	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wireguard/conn"
+	"github.com/bepass-org/warp-plus/wireguard/device"
 	"github.com/bepass-org/warp-plus/wireguard/tun"
 	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
 	"github.com/bepass-org/warp-plus/wiresocks"
+	"golang.org/x/net/proxy"
 )
 
 const singleMTU = 1330
@@ -31,8 +35,205 @@ type WarpOptions struct {
 	CacheDir        string
 	Tun             bool
 	FwMark          uint32
+	RouteTable      uint32
+	BypassCIDRs     []netip.Prefix
+	SplitDNSDomains []string
+	Sidecar         bool
+	Listeners       []Listener
+	Outbounds       *wiresocks.Outbounds
+	Routes          []wiresocks.RouteRule
 	WireguardConfig string
 	Reserved        string
+	TrustedNetworks *TrustedNetworkOptions
+	DNSOnly         *DNSOnlyOptions
+	DirectDomains   []string
+	Conns           *wiresocks.ConnTracker
+	Health          *Health
+	Telemetry       *Telemetry
+	Events          *Events
+	Hooks           *Hooks
+	LowMemory       bool
+	// TCPTuning tunes the TCP of the userspace stack, see ParseTCPTuning.
+	// Low memory caps its buffers.
+	TCPTuning netstack.TCPTuning
+	// UDPNAT maps the flows of UDP associations to the tunnel, with default
+	// limits if nil.
+	UDPNAT *wiresocks.UDPNAT
+	// V4 and V6 select the address families a random endpoint is picked
+	// from when Endpoint is empty.
+	V4 bool
+	V6 bool
+	// CaptivePortal holds the tunnel back while the network is behind a
+	// captive portal, letting portal traffic bypass it until logged in.
+	CaptivePortal bool
+	// SocksTLS serves the proxy over TLS, if set
+	SocksTLS *TLSOptions
+	// RemoteResolve resolves sniffed domains inside the tunnel even when
+	// clients connect to a locally resolved IP
+	RemoteResolve bool
+	// SniffPorts are the ports connections to literal IPs are sniffed on
+	// for the SNI/Host, wiresocks.DefaultSniffPorts if empty
+	SniffPorts []uint16
+	// STUNPolicy is how the proxies handle STUN and TURN, allowed if empty
+	STUNPolicy wiresocks.STUNPolicy
+	// ExtraBinds are served the socks proxy on next to Bind, as parsed by
+	// wiresocks.ParseBind, with unix sockets made with SocketMode
+	ExtraBinds []string
+	SocketMode os.FileMode
+	// SourceACL lets connections in to the inbounds by their source, if set
+	SourceACL *wiresocks.SourceACL
+	// Shadowsocks adds a shadowsocks inbound, if set
+	Shadowsocks *ShadowsocksOptions
+	// VLESS adds a VLESS inbound, if set
+	VLESS *VLESSOptions
+	// Chain sends proxied connections through a user controlled server
+	// after the tunnel, if set
+	Chain *wiresocks.ChainHop
+	// Tor routes onion services and selected domains through tor, if set
+	Tor *TorOptions
+	// ReorderDepth holds back up to this many out of order packets per
+	// peer on receive, zero disables resequencing
+	ReorderDepth int
+	// Shaping pads and paces the packets sent through the tunnel after this
+	// device shaping profile, empty sends them unshaped
+	Shaping string
+	// Decoy sends a few dummy packets through the tunnel when it has been
+	// idle for about this long, zero sends none
+	Decoy time.Duration
+	// InitFragments splits handshake initiations over up to this many
+	// datagrams and InitJunk wraps them after up to this many random bytes,
+	// for a relay restoring them, zero sends them plain
+	InitFragments int
+	InitJunk      int
+	// InitMimic makes the first datagram of handshake initiations look like
+	// another protocol, for a relay or a warp-plus peer stripping it, empty
+	// sends them plain
+	InitMimic string
+	// RecoverStale handshakes with peers still sending on sessions the
+	// tunnel dropped, as after a restart, instead of waiting for them to
+	// notice
+	RecoverStale bool
+	// PresharedMAC keys the macs of handshakes by the preshared keys of
+	// the peers of WireguardConfig too, which have to run warp-plus with it
+	// as well, so that probes get no answer
+	PresharedMAC bool
+	// KnockKey is a base64 key the peers of WireguardConfig share to knock
+	// with before handshakes, which they drop unanswered otherwise, empty
+	// for none
+	KnockKey string
+	// FEC adds forward error correction at this DATA:PARITY ratio to what
+	// is sent to the peers of WireguardConfig, which have to run warp-plus
+	// with the same ratio, see conn.ParseFEC. Empty for none.
+	FEC string
+	// AuthorizePeers is a webhook or radius server asked about peers
+	// WireguardConfig doesn't list, which are added if it allows them, see
+	// ParsePeerAuthorizer. Empty only answers the listed peers.
+	AuthorizePeers string
+	// ResolveDoH resolves the host name endpoints of WireguardConfig over
+	// DoH to 1.1.1.1, reached at its own addresses, instead of plain dns
+	// to DnsAddr, where dns is tampered with
+	ResolveDoH bool
+	// ForwardPings answers the pings WireguardConfig peers send through
+	// the userspace stack to other hosts by pinging them from this host
+	ForwardPings bool
+	// Identities keeps the warp identities, directories in CacheDir if nil.
+	// Listeners keep theirs in their own cache dirs.
+	Identities warp.IdentityStore
+	// MTU overrides the tunnel mtu and is remembered for the current
+	// network, zero uses the default or the remembered value.
+	MTU int
+	// ScanRanges are scanned by rescans when Scan is nil, empty scans the
+	// warp prefixes
+	ScanRanges []netip.Prefix
+	// Masque sends the traffic to the warp endpoints through the
+	// connect-udp proxy at this URI template, if set
+	Masque string
+	// Fallback brings the tunnel up over the first of these transports
+	// that works instead, see ParseFallback
+	Fallback []string
+	// Race connects in every enabled way at once at startup instead of one
+	// after the other, see raceWarp
+	Race bool
+	// Audit records identity and endpoint changes, if set
+	Audit *Audit
+	// Scores keeps the endpoints scored by the latest scan, if set
+	Scores *EndpointScores
+	// Standby keeps a second tunnel up to another endpoint in plain warp
+	// proxy mode, failing over to it when the first one degrades
+	Standby bool
+	// Keepalive is the persistent keepalive interval of warp peers, zero
+	// keeps defaultKeepalive
+	Keepalive time.Duration
+	// AdaptiveKeepalive stretches the keepalive interval to just below the
+	// nat timeout of the network in proxy mode, see adaptKeepalive
+	AdaptiveKeepalive bool
+	// Power tunes the tunnel for the power source, if set
+	Power *Power
+	// Bridges brings the tunnel up through the first of these community
+	// bridges that works instead, if set
+	Bridges *Bridges
+
+	// identityPrefix is prepended to the names of the identities the
+	// tunnel is brought up with, so that a failback can bring one up next
+	// to the tunnel in use, see failback
+	identityPrefix string
+	// failover is set by runWarp while a standby tunnel is kept
+	failover *wiresocks.Failover
+	// listener is set by startListeners for the tunnels of listeners, the
+	// routes of which were checked along with those of the main tunnel
+	listener bool
+}
+
+// tunAddress returns the IPv4 address warp assigned to the interface.
+func tunAddress(addrs []netip.Addr) netip.Addr {
+	for _, addr := range addrs {
+		if addr.Is4() {
+			return addr
+		}
+	}
+	return netip.MustParseAddr("172.16.0.2")
+}
+
+// identities returns the store of the warp identities, the files in the
+// cache directory unless the options give another.
+func (opts WarpOptions) identities() warp.IdentityStore {
+	if opts.Identities != nil {
+		return opts.Identities
+	}
+	return warp.FileStore{Dir: opts.CacheDir}
+}
+
+// mtu returns the tunnel mtu, honoring an override from the options.
+func (opts WarpOptions) mtu() int {
+	if opts.MTU > 0 {
+		return opts.MTU
+	}
+	if opts.Masque != "" {
+		return masque.MTU
+	}
+	return singleMTU
+}
+
+// outboundTag names the tunnel opts brings up in routing rules.
+func (opts WarpOptions) outboundTag() string {
+	switch {
+	case opts.WireguardConfig != "":
+		return "wireguard"
+	case opts.Psiphon != nil:
+		return "psiphon:" + opts.Psiphon.Country
+	case opts.Gool:
+		return "gool"
+	}
+	return "warp"
+}
+
+// interfaceDNS returns the servers set on the tun interface for all
+// queries, none when split DNS leaves them to the physical interface.
+func (opts WarpOptions) interfaceDNS() []netip.Addr {
+	if len(opts.SplitDNSDomains) > 0 {
+		return nil
+	}
+	return []netip.Addr{opts.DnsAddr}
 }
 
 type PsiphonOptions struct {
@@ -40,14 +241,51 @@ type PsiphonOptions struct {
 }
 
 func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
-	if opts.WireguardConfig != "" {
-		if err := runWireguard(ctx, l, opts); err != nil {
+	netstack.TCP = opts.TCPTuning
+
+	restoreDNSJournal(l, opts.CacheDir)
+
+	if opts.Sidecar {
+		if err := checkSidecar(l); err != nil {
 			return err
 		}
+		opts.Tun = true
+	}
 
+	if opts.TrustedNetworks != nil {
+		go watchTrustedNetworks(ctx, l, opts)
 		return nil
 	}
 
+	if opts.DNSOnly != nil {
+		l.Info("running in dns-only mode")
+		return runDNSOnly(ctx, l, *opts.DNSOnly, opts.identities())
+	}
+
+	if opts.CaptivePortal {
+		if err := waitCaptivePortal(ctx, l, opts.Bind, opts.Tun); err != nil {
+			return err
+		}
+	}
+
+	if !opts.listener {
+		if err := checkRoutes(opts); err != nil {
+			return err
+		}
+	}
+
+	if len(opts.Listeners) > 0 {
+		if err := startListeners(ctx, l, opts); err != nil {
+			return err
+		}
+	}
+
+	if opts.WireguardConfig != "" {
+		err := runWireguard(ctx, l, opts)
+		opts.Telemetry.recordConnect(opts.outboundTag(), err)
+		return err
+	}
+
 	if opts.Psiphon != nil && opts.Gool {
 		return errors.New("can't use psiphon and gool at the same time")
 	}
@@ -60,12 +298,42 @@ func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 		return errors.New("can't use psiphon and tun at the same time")
 	}
 
+	network := networkFingerprint(ctx)
+	blocklist := loadEndpointBlocklist(l, opts.CacheDir)
+	profiles := loadNetworkProfiles(l, opts.CacheDir)
+
+	// Apply what we learned the last time we were on this network
+	if profile, ok := profiles.get(network); ok && network != "" {
+		if opts.Endpoint == "" && profile.Endpoint != "" && !blocklist.blocked(network, profile.Endpoint) {
+			l.Info("using remembered endpoint for this network", "endpoint", profile.Endpoint)
+			opts.Endpoint = profile.Endpoint
+		}
+		if opts.MTU == 0 && profile.MTU != 0 {
+			l.Info("using remembered mtu for this network", "mtu", profile.MTU)
+			opts.MTU = profile.MTU
+		}
+		if opts.AdaptiveKeepalive && profile.Keepalive != 0 {
+			l.Info("using remembered keepalive interval for this network", "interval", profile.Keepalive)
+			opts.Keepalive = profile.Keepalive
+		}
+	}
+
+	// If the endpoint is not set, choose a random warp endpoint
+	if opts.Endpoint == "" {
+		addrPort, err := randomEndpoint(blocklist, network, opts.V4, opts.V6)
+		if err != nil {
+			return err
+		}
+		opts.Endpoint = addrPort.String()
+	}
+
 	// Decide Working Scenario
 	endpoints := []string{opts.Endpoint, opts.Endpoint}
 
-	if opts.Scan != nil {
+	// Racing scans alongside connecting to the endpoint
+	if opts.Scan != nil && !opts.racing() {
 		// make primary identity
-		ident, err := warp.LoadOrCreateIdentity(l, path.Join(opts.CacheDir, "primary"), opts.License)
+		ident, err := loadIdentity(l, opts, "primary")
 		if err != nil {
 			l.Error("couldn't load primary warp identity")
 			return err
@@ -76,6 +344,7 @@ func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 
 		// Reading the public key from the 'Peer' section
 		opts.Scan.PublicKey = ident.Config.Peers[0].PublicKey
+		opts.Scan.Scored = opts.Scores.record
 
 		res, err := wiresocks.RunScan(ctx, l, *opts.Scan)
 		if err != nil {
@@ -83,6 +352,7 @@ func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 		}
 
 		l.Debug("scan results", "endpoints", res)
+		opts.Telemetry.recordScan(res)
 
 		endpoints = make([]string, len(res))
 		for i := 0; i < len(res); i++ {
@@ -92,22 +362,76 @@ func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 	l.Info("using warp endpoints", "endpoints", endpoints)
 
 	var warpErr error
+	if opts.racing() {
+		l.Info("racing warp connections")
+		endpoints[0], warpErr = raceWarp(ctx, l, opts)
+		opts.Telemetry.recordConnect(opts.outboundTag(), warpErr)
+	} else if len(opts.Fallback) > 0 {
+		opts, warpErr = runFallback(ctx, l, opts, endpoints, network, profiles)
+	} else if opts.Bridges != nil {
+		// Reaching the endpoints through a bridge says nothing about
+		// reaching them directly, so nothing is remembered for the network
+		return runBridges(ctx, l, opts, endpoints)
+	} else {
+		warpErr = runMode(ctx, l, opts, endpoints)
+	}
+
+	// Remember endpoints that time out on this network, handshakes never
+	// completing is the usual symptom of an endpoint being filtered.
+	used := endpoints[:1]
+	if opts.Gool {
+		used = endpoints[:2]
+	}
+	for _, endpoint := range used {
+		switch {
+		case warpErr == nil:
+			blocklist.recordSuccess(network, endpoint)
+		case errors.Is(warpErr, context.DeadlineExceeded):
+			blocklist.recordFailure(network, endpoint)
+		}
+	}
+	if err := blocklist.save(); err != nil {
+		l.Warn("failed to save endpoint blocklist", "error", err)
+	}
+
+	if warpErr == nil && network != "" {
+		profiles.update(network, func(p *networkProfile) {
+			if p.Endpoint != endpoints[0] {
+				opts.Audit.Record(actorAuto, "endpoint_changed", "network", network, "from", p.Endpoint, "to", endpoints[0])
+			}
+			p.Endpoint = endpoints[0]
+			if opts.MTU != 0 {
+				p.MTU = opts.MTU
+			}
+		})
+		if err := profiles.save(); err != nil {
+			l.Warn("failed to save network profiles", "error", err)
+		}
+	}
+
+	return warpErr
+}
+
+// runMode brings the tunnel up in the mode selected by opts.
+func runMode(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoints []string) error {
+	var err error
 	switch {
 	case opts.Psiphon != nil:
 		l.Info("running in Psiphon (cfon) mode")
 		// run primary warp on a random tcp port and run psiphon on bind address
-		warpErr = runWarpWithPsiphon(ctx, l, opts, endpoints[0])
+		err = runWarpWithPsiphon(ctx, l, opts, endpoints[0])
 	case opts.Gool:
 		l.Info("running in warp-in-warp (gool) mode")
 		// run warp in warp
-		warpErr = runWarpInWarp(ctx, l, opts, endpoints)
+		err = runWarpInWarp(ctx, l, opts, endpoints)
 	default:
 		l.Info("running in normal warp mode")
 		// just run primary warp on bindAddress
-		warpErr = runWarp(ctx, l, opts, endpoints[0])
+		err = runWarp(ctx, l, opts, endpoints[0])
 	}
 
-	return warpErr
+	opts.Telemetry.recordConnect(opts.outboundTag(), err)
+	return err
 }
 
 func runWireguard(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
@@ -117,19 +441,58 @@ func runWireguard(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 	}
 
 	// Set up MTU
-	conf.Interface.MTU = singleMTU
+	conf.Interface.MTU = opts.mtu()
+	if opts.ReorderDepth > 0 {
+		conf.Interface.ReorderDepth = opts.ReorderDepth
+	}
+	if opts.Shaping != "" {
+		conf.Interface.Shaping = opts.Shaping
+	}
+	if opts.Decoy > 0 {
+		conf.Interface.DecoyInterval = int(opts.Decoy.Seconds())
+	}
+	if opts.InitFragments > 0 || opts.InitJunk > 0 {
+		conf.Interface.InitFragments = opts.InitFragments
+		conf.Interface.InitJunk = opts.InitJunk
+	}
+	if opts.InitMimic != "" {
+		conf.Interface.InitMimic = opts.InitMimic
+	}
+	if opts.RecoverStale {
+		conf.Interface.UnknownIndexRecovery = true
+	}
+	if opts.PresharedMAC {
+		conf.Interface.PresharedMAC1 = true
+	}
+	if opts.KnockKey != "" {
+		if conf.Interface.KnockKey, err = wiresocks.EncodeBase64ToHex(opts.KnockKey); err != nil {
+			return fmt.Errorf("invalid knock key: %w", err)
+		}
+	}
+	if opts.FEC != "" {
+		if _, _, err := conn.ParseFEC(opts.FEC); err != nil {
+			return err
+		}
+		conf.Interface.FEC = opts.FEC
+	}
+	var authorizer device.PeerAuthorizer
+	if opts.AuthorizePeers != "" {
+		if authorizer, err = ParsePeerAuthorizer(opts.AuthorizePeers); err != nil {
+			return err
+		}
+	}
 	// Set up DNS Address
 	conf.Interface.DNS = []netip.Addr{opts.DnsAddr}
 
 	// Enable trick and keepalive on all peers in config
+	resolver := newEndpointResolver(l, opts)
 	for i, peer := range conf.Peers {
 		peer.Trick = true
-		peer.KeepAlive = 5
+		peer.KeepAlive = opts.keepalive()
 
-		// Try resolving if the endpoint is a domain
-		addr, err := iputils.ParseResolveAddressPort(peer.Endpoint, false, opts.DnsAddr.String())
-		if err == nil {
-			peer.Endpoint = addr.String()
+		// Resolve the endpoint if it is a domain
+		if err := resolver.add(ctx, &peer); err != nil {
+			return err
 		}
 
 		conf.Peers[i] = peer
@@ -141,21 +504,33 @@ func runWireguard(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 		var tunDev tun.Device
 		for _, t := range []string{"t1", "t2"} {
 			// Create a new tun interface
-			tunDev, werr = newNormalTun([]netip.Addr{opts.DnsAddr})
+			tunDev, werr = newNormalTun(l, opts.interfaceDNS(), tunAddress(conf.Interface.Addresses))
 			if werr != nil {
 				continue
 			}
 
-			werr = establishWireguard(l, conf, tunDev, true, opts.FwMark, t)
+			var dev *device.Device
+			dev, werr = establishWireguard(ctx, l, conf, tunDev, opts.newBind(l), true, opts.FwMark, t, opts.Health, opts.Telemetry)
 			if werr != nil {
+				resolver.rotate(conf)
 				continue
 			}
+			dev.SetPeerAuthorizer(authorizer)
+			resolver.watch(ctx, dev)
 			break
 		}
 		if werr != nil {
 			return werr
 		}
 
+		if err := routeTun(ctx, l, opts); err != nil {
+			return err
+		}
+
+		if err := takeoverDNS(ctx, l, opts.CacheDir, []netip.Addr{opts.DnsAddr}, opts.SplitDNSDomains); err != nil {
+			return err
+		}
+
 		l.Info("serving tun", "interface", "warp0")
 		return nil
 	}
@@ -170,11 +545,18 @@ func runWireguard(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 		if err != nil {
 			continue
 		}
+		if opts.ForwardPings {
+			tnet.ForwardPings()
+		}
 
-		werr = establishWireguard(l, conf, tunDev, false, opts.FwMark, t)
+		var dev *device.Device
+		dev, werr = establishWireguard(ctx, l, conf, tunDev, opts.newBind(l), false, opts.FwMark, t, opts.Health, opts.Telemetry)
 		if werr != nil {
+			resolver.rotate(conf)
 			continue
 		}
+		dev.SetPeerAuthorizer(authorizer)
+		resolver.watch(ctx, dev)
 
 		// Test wireguard connectivity
 		werr = usermodeTunTest(ctx, l, tnet)
@@ -188,28 +570,23 @@ func runWireguard(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 	}
 
 	// Run a proxy on the userspace stack
-	_, err = wiresocks.StartProxy(ctx, l, tnet, opts.Bind)
-	if err != nil {
-		return err
-	}
-
-	l.Info("serving proxy", "address", opts.Bind)
-
-	return nil
+	return startInbounds(ctx, l, tnet, opts)
 }
 
-func runWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint string) error {
-	// make primary identity
-	ident, err := warp.LoadOrCreateIdentity(l, path.Join(opts.CacheDir, "primary"), opts.License)
-	if err != nil {
-		l.Error("couldn't load primary warp identity")
-		return err
-	}
-
+// warpConfig returns the wireguard config of a warp identity connecting to
+// endpoint.
+func warpConfig(ident *warp.Identity, opts WarpOptions, endpoint string) (wiresocks.Configuration, error) {
 	conf := generateWireguardConfig(ident)
 
 	// Set up MTU
-	conf.Interface.MTU = singleMTU
+	conf.Interface.MTU = opts.mtu()
+	conf.Interface.ReorderDepth = opts.ReorderDepth
+	conf.Interface.Shaping = opts.Shaping
+	conf.Interface.DecoyInterval = int(opts.Decoy.Seconds())
+	conf.Interface.InitFragments = opts.InitFragments
+	conf.Interface.InitJunk = opts.InitJunk
+	conf.Interface.InitMimic = opts.InitMimic
+	conf.Interface.UnknownIndexRecovery = opts.RecoverStale
 	// Set up DNS Address
 	conf.Interface.DNS = []netip.Addr{opts.DnsAddr}
 
@@ -217,18 +594,65 @@ func runWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint str
 	for i, peer := range conf.Peers {
 		peer.Endpoint = endpoint
 		peer.Trick = true
-		peer.KeepAlive = 5
+		peer.KeepAlive = opts.keepalive()
 
 		if opts.Reserved != "" {
 			r, err := wiresocks.ParseReserved(opts.Reserved)
 			if err != nil {
-				return err
+				return wiresocks.Configuration{}, err
 			}
 			peer.Reserved = r
 		}
 
 		conf.Peers[i] = peer
 	}
+	return conf, nil
+}
+
+// connectUserspace establishes wireguard on a userspace stack and tests
+// its connectivity.
+func connectUserspace(ctx context.Context, l *slog.Logger, conf *wiresocks.Configuration, opts WarpOptions) (*netstack.Net, *device.Device, error) {
+	var werr error
+	var tnet *netstack.Net
+	var tunDev tun.Device
+	var dev *device.Device
+	for _, t := range []string{"t1", "t2"} {
+		// Create userspace tun network stack
+		tunDev, tnet, werr = netstack.CreateNetTUN(conf.Interface.Addresses, conf.Interface.DNS, conf.Interface.MTU)
+		if werr != nil {
+			continue
+		}
+
+		dev, werr = establishWireguard(ctx, l, conf, tunDev, opts.newBind(l), false, opts.FwMark, t, opts.Health, opts.Telemetry)
+		if werr != nil {
+			continue
+		}
+
+		// Test wireguard connectivity
+		werr = usermodeTunTest(ctx, l, tnet)
+		if werr != nil {
+			continue
+		}
+		break
+	}
+	if werr != nil {
+		return nil, nil, werr
+	}
+	return tnet, dev, nil
+}
+
+func runWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint string) error {
+	// make primary identity
+	ident, err := loadIdentity(l, opts, "primary")
+	if err != nil {
+		l.Error("couldn't load primary warp identity")
+		return err
+	}
+
+	conf, err := warpConfig(ident, opts, endpoint)
+	if err != nil {
+		return err
+	}
 
 	if opts.Tun {
 		// Establish wireguard tunnel on tun interface
@@ -236,13 +660,13 @@ func runWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint str
 		var tunDev tun.Device
 		for _, t := range []string{"t1", "t2"} {
 			// Create a new tun interface
-			tunDev, werr = newNormalTun([]netip.Addr{opts.DnsAddr})
+			tunDev, werr = newNormalTun(l, opts.interfaceDNS(), tunAddress(conf.Interface.Addresses))
 			if werr != nil {
 				continue
 			}
 
 			// Create userspace tun network stack
-			werr = establishWireguard(l, &conf, tunDev, true, opts.FwMark, t)
+			_, werr = establishWireguard(ctx, l, &conf, tunDev, opts.newBind(l), true, opts.FwMark, t, opts.Health, opts.Telemetry)
 			if werr != nil {
 				continue
 			}
@@ -251,49 +675,40 @@ func runWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint str
 		if werr != nil {
 			return werr
 		}
-		l.Info("serving tun", "interface", "warp0")
-		return nil
-	}
 
-	// Establish wireguard on userspace stack
-	var werr error
-	var tnet *netstack.Net
-	var tunDev tun.Device
-	for _, t := range []string{"t1", "t2"} {
-		tunDev, tnet, werr = netstack.CreateNetTUN(conf.Interface.Addresses, conf.Interface.DNS, conf.Interface.MTU)
-		if werr != nil {
-			continue
+		if err := routeTun(ctx, l, opts); err != nil {
+			return err
 		}
 
-		werr = establishWireguard(l, &conf, tunDev, false, opts.FwMark, t)
-		if werr != nil {
-			continue
+		if err := takeoverDNS(ctx, l, opts.CacheDir, []netip.Addr{opts.DnsAddr}, opts.SplitDNSDomains); err != nil {
+			return err
 		}
 
-		// Test wireguard connectivity
-		werr = usermodeTunTest(ctx, l, tnet)
-		if werr != nil {
-			continue
-		}
-		break
-	}
-	if werr != nil {
-		return werr
+		l.Info("serving tun", "interface", "warp0")
+		return nil
 	}
 
-	// Run a proxy on the userspace stack
-	_, err = wiresocks.StartProxy(ctx, l, tnet, opts.Bind)
+	// Establish wireguard on userspace stack
+	tnet, dev, err := connectUserspace(ctx, l, &conf, opts)
 	if err != nil {
 		return err
 	}
 
-	l.Info("serving proxy", "address", opts.Bind)
-	return nil
+	if opts.Standby {
+		opts.failover = startStandby(ctx, l, opts, endpoint, tnet, dev)
+	}
+
+	if opts.AdaptiveKeepalive && opts.Keepalive == 0 {
+		go adaptKeepalive(ctx, l, opts, dev, conf.Peers[0].PublicKey)
+	}
+
+	// Run a proxy on the userspace stack
+	return startInbounds(ctx, l, tnet, opts)
 }
 
 func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoints []string) error {
 	// make primary identity
-	ident1, err := warp.LoadOrCreateIdentity(l, path.Join(opts.CacheDir, "primary"), opts.License)
+	ident1, err := loadIdentity(l, opts, "primary")
 	if err != nil {
 		l.Error("couldn't load primary warp identity")
 		return err
@@ -302,7 +717,14 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 	conf := generateWireguardConfig(ident1)
 
 	// Set up MTU
-	conf.Interface.MTU = singleMTU
+	conf.Interface.MTU = opts.mtu()
+	conf.Interface.ReorderDepth = opts.ReorderDepth
+	conf.Interface.Shaping = opts.Shaping
+	conf.Interface.DecoyInterval = int(opts.Decoy.Seconds())
+	conf.Interface.InitFragments = opts.InitFragments
+	conf.Interface.InitJunk = opts.InitJunk
+	conf.Interface.InitMimic = opts.InitMimic
+	conf.Interface.UnknownIndexRecovery = opts.RecoverStale
 	// Set up DNS Address
 	conf.Interface.DNS = []netip.Addr{opts.DnsAddr}
 
@@ -310,7 +732,7 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 	for i, peer := range conf.Peers {
 		peer.Endpoint = endpoints[0]
 		peer.Trick = true
-		peer.KeepAlive = 5
+		peer.KeepAlive = opts.keepalive()
 
 		if opts.Reserved != "" {
 			r, err := wiresocks.ParseReserved(opts.Reserved)
@@ -334,7 +756,7 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 			continue
 		}
 
-		werr = establishWireguard(l.With("gool", "outer"), &conf, tunDev, opts.Tun, opts.FwMark, t)
+		_, werr = establishWireguard(ctx, l.With("gool", "outer"), &conf, tunDev, opts.newBind(l), opts.Tun, opts.FwMark, t, opts.Health, opts.Telemetry)
 		if werr != nil {
 			continue
 		}
@@ -351,13 +773,13 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 	}
 
 	// Create a UDP port forward between localhost and the remote endpoint
-	addr, err := wiresocks.NewVtunUDPForwarder(ctx, netip.MustParseAddrPort("127.0.0.1:0"), endpoints[0], tnet1, singleMTU)
+	addr, err := wiresocks.NewVtunUDPForwarder(ctx, netip.MustParseAddrPort("127.0.0.1:0"), endpoints[0], tnet1, opts.mtu())
 	if err != nil {
 		return err
 	}
 
 	// make secondary
-	ident2, err := warp.LoadOrCreateIdentity(l, path.Join(opts.CacheDir, "secondary"), opts.License)
+	ident2, err := loadIdentity(l, opts, "secondary")
 	if err != nil {
 		l.Error("couldn't load secondary warp identity")
 		return err
@@ -367,6 +789,8 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 
 	// Set up MTU
 	conf.Interface.MTU = doubleMTU
+	conf.Interface.ReorderDepth = opts.ReorderDepth
+	conf.Interface.UnknownIndexRecovery = opts.RecoverStale
 	// Set up DNS Address
 	conf.Interface.DNS = []netip.Addr{opts.DnsAddr}
 
@@ -388,16 +812,25 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 
 	if opts.Tun {
 		// Create a new tun interface
-		tunDev, err := newNormalTun([]netip.Addr{opts.DnsAddr})
+		tunDev, err := newNormalTun(l, opts.interfaceDNS(), tunAddress(conf.Interface.Addresses))
 		if err != nil {
 			return err
 		}
 
 		// Establish wireguard tunnel on tun interface but don't bind
 		// wireguard sockets to default interface and don't apply fwmark.
-		if err := establishWireguard(l.With("gool", "inner"), &conf, tunDev, false, opts.FwMark, "t0"); err != nil {
+		if _, err := establishWireguard(ctx, l.With("gool", "inner"), &conf, tunDev, conn.NewDefaultBind(), false, opts.FwMark, "t0", opts.Health, opts.Telemetry); err != nil {
 			return err
 		}
+
+		if err := routeTun(ctx, l, opts); err != nil {
+			return err
+		}
+
+		if err := takeoverDNS(ctx, l, opts.CacheDir, []netip.Addr{opts.DnsAddr}, opts.SplitDNSDomains); err != nil {
+			return err
+		}
+
 		l.Info("serving tun", "interface", "warp0")
 		return nil
 	}
@@ -409,7 +842,7 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 	}
 
 	// Establish wireguard on userspace stack
-	if err := establishWireguard(l.With("gool", "inner"), &conf, tunDev, false, opts.FwMark, "t0"); err != nil {
+	if _, err := establishWireguard(ctx, l.With("gool", "inner"), &conf, tunDev, conn.NewDefaultBind(), false, opts.FwMark, "t0", opts.Health, opts.Telemetry); err != nil {
 		return err
 	}
 
@@ -418,72 +851,26 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 		return err
 	}
 
-	_, err = wiresocks.StartProxy(ctx, l, tnet2, opts.Bind)
-	if err != nil {
-		return err
-	}
-
-	l.Info("serving proxy", "address", opts.Bind)
-	return nil
+	return startInbounds(ctx, l, tnet2, opts)
 }
 
 func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint string) error {
 	// make primary identity
-	ident, err := warp.LoadOrCreateIdentity(l, path.Join(opts.CacheDir, "primary"), opts.License)
+	ident, err := loadIdentity(l, opts, "primary")
 	if err != nil {
 		l.Error("couldn't load primary warp identity")
 		return err
 	}
 
-	conf := generateWireguardConfig(ident)
-
-	// Set up MTU
-	conf.Interface.MTU = singleMTU
-	// Set up DNS Address
-	conf.Interface.DNS = []netip.Addr{opts.DnsAddr}
-
-	// Enable trick and keepalive on all peers in config
-	for i, peer := range conf.Peers {
-		peer.Endpoint = endpoint
-		peer.Trick = true
-		peer.KeepAlive = 5
-
-		if opts.Reserved != "" {
-			r, err := wiresocks.ParseReserved(opts.Reserved)
-			if err != nil {
-				return err
-			}
-			peer.Reserved = r
-		}
-
-		conf.Peers[i] = peer
+	conf, err := warpConfig(ident, opts, endpoint)
+	if err != nil {
+		return err
 	}
 
 	// Establish wireguard on userspace stack
-	var werr error
-	var tnet *netstack.Net
-	var tunDev tun.Device
-	for _, t := range []string{"t1", "t2"} {
-		// Create userspace tun network stack
-		tunDev, tnet, werr = netstack.CreateNetTUN(conf.Interface.Addresses, conf.Interface.DNS, conf.Interface.MTU)
-		if werr != nil {
-			continue
-		}
-
-		werr = establishWireguard(l, &conf, tunDev, false, opts.FwMark, t)
-		if werr != nil {
-			continue
-		}
-
-		// Test wireguard connectivity
-		werr = usermodeTunTest(ctx, l, tnet)
-		if werr != nil {
-			continue
-		}
-		break
-	}
-	if werr != nil {
-		return werr
+	tnet, _, err := connectUserspace(ctx, l, &conf, opts)
+	if err != nil {
+		return err
 	}
 
 	// Run a proxy on the userspace stack
@@ -498,6 +885,18 @@ func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, opts WarpOptions, e
 		return fmt.Errorf("unable to run psiphon %w", err)
 	}
 
+	if opts.Outbounds != nil {
+		d, err := proxy.SOCKS5("tcp", opts.Bind.String(), nil, proxy.Direct)
+		if err != nil {
+			return err
+		}
+		unregister, err := opts.Outbounds.Register(opts.outboundTag(), d.(proxy.ContextDialer).DialContext)
+		if err != nil {
+			return err
+		}
+		context.AfterFunc(ctx, unregister)
+	}
+
 	l.Info("serving proxy", "address", opts.Bind)
 	return nil
 }
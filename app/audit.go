@@ -0,0 +1,114 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+)
+
+// Audit actors
+const (
+	// ActorCLI made the change on the command line
+	ActorCLI = "cli"
+	// actorAPI is a control api client
+	actorAPI = "api"
+	// actorAuto is warp-plus itself, like registering a missing identity
+	actorAuto = "auto"
+)
+
+// Audit appends configuration and identity changes to a file, one json
+// object per line. The file is only ever appended to, so that it can be
+// made append-only with chattr +a. A nil Audit records nothing.
+type Audit struct {
+	l  *slog.Logger
+	mu sync.Mutex
+	f  *os.File
+}
+
+type auditEntry struct {
+	Time    time.Time      `json:"time"`
+	Actor   string         `json:"actor"`
+	Action  string         `json:"action"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// OpenAudit opens the audit log at path, creating it if needed.
+func OpenAudit(l *slog.Logger, path string) (*Audit, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &Audit{l: l.With("subsystem", "audit"), f: f}, nil
+}
+
+// Record appends an action by actor, cli, api or auto, with details given
+// as alternating keys and values like slog attributes.
+func (a *Audit) Record(actor, action string, details ...any) {
+	if a == nil {
+		return
+	}
+
+	e := auditEntry{Time: time.Now().UTC(), Actor: actor, Action: action}
+	for i := 0; i+1 < len(details); i += 2 {
+		if e.Details == nil {
+			e.Details = make(map[string]any)
+		}
+		v := details[i+1]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		e.Details[fmt.Sprint(details[i])] = v
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		a.l.Warn("failed to encode audit entry", "action", action, "error", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := a.f.Write(append(b, '\n')); err != nil {
+		a.l.Warn("failed to write audit log", "error", err)
+	}
+}
+
+// loadIdentity loads the identity named name like
+// warp.LoadOrCreateIdentity, auditing registrations and license changes.
+// An identity left on a free account because the license is bound to too
+// many devices is reported as an error and an EventLicenseRefused.
+func loadIdentity(l *slog.Logger, opts WarpOptions, name string) (*warp.Identity, error) {
+	name = opts.identityPrefix + name
+	store := opts.identities()
+	prev, prevErr := warp.LoadIdentity(store, name)
+	ident, err := warp.LoadOrCreateIdentity(l, store, name, opts.License)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.License != "" && ident.Account.License != opts.License {
+		l.Error("warp+ license was not applied, running on a free account: the license is bound to too many devices, remove a stale one with 'warp-plus devices remove'",
+			"identity", name, "limit", warp.MaxDevices)
+		opts.Events.emit(Event{Type: EventLicenseRefused, Identity: name})
+	}
+
+	if opts.Audit == nil {
+		return ident, nil
+	}
+	switch {
+	case prevErr != nil || prev.ID != ident.ID:
+		opts.Audit.Record(actorAuto, "identity_registered", "identity", name, "device_id", ident.ID, "account_type", ident.Account.AccountType)
+	case prev.Account.License != ident.Account.License:
+		opts.Audit.Record(actorAuto, "license_changed", "identity", name, "account_type", ident.Account.AccountType)
+	}
+	return ident, nil
+}
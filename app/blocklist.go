@@ -0,0 +1,135 @@
+package app
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+)
+
+const (
+	blocklistFile = "endpoint-blocklist.json"
+	// blocklistThreshold is the number of consecutive handshake failures
+	// after which an endpoint is avoided on a network.
+	blocklistThreshold = 3
+	// blocklistTTL is how long a blocked endpoint is avoided after its last
+	// failure, networks change their filtering over time.
+	blocklistTTL = 24 * time.Hour
+	// randomEndpointTries bounds how many random endpoints are drawn while
+	// looking for one that isn't blocked.
+	randomEndpointTries = 16
+)
+
+type endpointFailure struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+}
+
+// endpointBlocklist remembers endpoints that repeatedly failed to complete a
+// handshake, per network fingerprint, across restarts.
+type endpointBlocklist struct {
+	mu       sync.Mutex
+	path     string
+	Networks map[string]map[string]*endpointFailure `json:"networks"`
+}
+
+func loadEndpointBlocklist(l *slog.Logger, cacheDir string) *endpointBlocklist {
+	b := &endpointBlocklist{
+		path:     filepath.Join(cacheDir, blocklistFile),
+		Networks: make(map[string]map[string]*endpointFailure),
+	}
+
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		return b
+	}
+	if err := json.Unmarshal(data, b); err != nil {
+		l.Warn("ignoring corrupt endpoint blocklist", "path", b.path, "error", err)
+		b.Networks = make(map[string]map[string]*endpointFailure)
+	}
+	return b
+}
+
+func (b *endpointBlocklist) blocked(network, endpoint string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	f, ok := b.Networks[network][endpoint]
+	return ok && f.Failures >= blocklistThreshold && time.Since(f.LastFailure) < blocklistTTL
+}
+
+func (b *endpointBlocklist) recordFailure(network, endpoint string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	endpoints, ok := b.Networks[network]
+	if !ok {
+		endpoints = make(map[string]*endpointFailure)
+		b.Networks[network] = endpoints
+	}
+	f, ok := endpoints[endpoint]
+	if !ok {
+		f = &endpointFailure{}
+		endpoints[endpoint] = f
+	}
+	f.Failures++
+	f.LastFailure = time.Now()
+}
+
+func (b *endpointBlocklist) recordSuccess(network, endpoint string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.Networks[network], endpoint)
+	if len(b.Networks[network]) == 0 {
+		delete(b.Networks, network)
+	}
+}
+
+func (b *endpointBlocklist) save() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Drop expired entries so the file doesn't grow forever
+	for network, endpoints := range b.Networks {
+		for endpoint, f := range endpoints {
+			if time.Since(f.LastFailure) >= blocklistTTL {
+				delete(endpoints, endpoint)
+			}
+		}
+		if len(endpoints) == 0 {
+			delete(b.Networks, network)
+		}
+	}
+
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(b.path), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(b.path, data, 0o644)
+}
+
+// randomEndpoint picks a random warp endpoint that isn't blocked on the
+// current network, falling back to a blocked one if nothing else turns up.
+func randomEndpoint(b *endpointBlocklist, network string, v4, v6 bool) (netip.AddrPort, error) {
+	var addrPort netip.AddrPort
+	var err error
+	for i := 0; i < randomEndpointTries; i++ {
+		addrPort, err = warp.RandomWarpEndpoint(v4, v6)
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		if !b.blocked(network, addrPort.String()) {
+			break
+		}
+	}
+	return addrPort, nil
+}
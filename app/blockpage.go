@@ -0,0 +1,112 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/doh"
+	"github.com/bepass-org/warp-plus/i18n"
+	"github.com/bepass-org/warp-plus/upgrade"
+)
+
+const maxBlockedEntries = 100
+
+type blockedEntry struct {
+	doh.Verdict
+	Time time.Time
+}
+
+// blockLog keeps the most recent resolver block verdicts.
+type blockLog struct {
+	mu      sync.Mutex
+	entries []blockedEntry
+}
+
+func (b *blockLog) add(v doh.Verdict) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.entries = append(b.entries, blockedEntry{Verdict: v, Time: time.Now()})
+	if len(b.entries) > maxBlockedEntries {
+		b.entries = b.entries[len(b.entries)-maxBlockedEntries:]
+	}
+}
+
+// lookup returns the recent entries, newest first, optionally limited to a
+// single domain.
+func (b *blockLog) lookup(domain string) []blockedEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var res []blockedEntry
+	for i := len(b.entries) - 1; i >= 0; i-- {
+		if domain == "" || b.entries[i].Domain == domain {
+			res = append(res, b.entries[i])
+		}
+	}
+	return res
+}
+
+var blockPageTemplate = template.Must(template.New("blockpage").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang.Tag}}" dir="{{.Lang.Dir}}">
+<head><meta charset="utf-8"><title>{{.Lang.T "Blocked by DNS policy"}}</title></head>
+<body>
+<h1>{{.Lang.T "Blocked by DNS policy"}}</h1>
+<p>{{.Lang.T "The following domains were filtered by the upstream resolver. Contact your Zero Trust administrator if you believe a domain was blocked by mistake."}}</p>
+{{if .Entries}}<table>
+<tr><th>{{.Lang.T "Time"}}</th><th>{{.Lang.T "Domain"}}</th><th>{{.Lang.T "Reason"}}</th></tr>
+{{range .Entries}}<tr><td>{{.Time.Format "15:04:05"}}</td><td>{{.Domain}}</td><td>{{.Reason}}</td></tr>
+{{end}}</table>{{else}}<p>{{.Lang.T "No domains have been blocked."}}</p>{{end}}
+</body>
+</html>
+`))
+
+// blockPageData is what blockPageTemplate renders.
+type blockPageData struct {
+	Lang    *i18n.Language
+	Entries []blockedEntry
+}
+
+// serveBlockPage serves a local page explaining recent block verdicts until
+// ctx is done.
+func serveBlockPage(ctx context.Context, l *slog.Logger, bind netip.AddrPort, log *blockLog) error {
+	ln, err := upgrade.Listen("tcp", bind.String())
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			data := blockPageData{
+				Lang:    i18n.FromAcceptLanguage(r.Header.Get("Accept-Language")),
+				Entries: log.lookup(r.URL.Query().Get("domain")),
+			}
+			if err := blockPageTemplate.Execute(w, data); err != nil {
+				l.Debug("failed to render block page", "error", err)
+			}
+		}),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			l.Error("block page server stopped", "error", err)
+		}
+	}()
+
+	l.Info("serving block page", "address", bind)
+	return nil
+}
@@ -0,0 +1,362 @@
+package app
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/masque"
+	"github.com/bepass-org/warp-plus/update"
+	"github.com/bepass-org/warp-plus/warp"
+)
+
+const (
+	// bridgesDir holds the last verified copy of every bridge list url,
+	// used when fetching it fails
+	bridgesDir = "bridges"
+	// bridgeHealthFile keeps how often each bridge came up
+	bridgeHealthFile = "bridge-health.json"
+	// bridgeListMaxSize bounds a bridge list and its signature
+	bridgeListMaxSize = 1 << 20
+	// bridgeFetchTimeout bounds fetching a bridge list with its signature
+	bridgeFetchTimeout = 30 * time.Second
+	// bridgeCheckInterval is how often the masque bridges are probed
+	bridgeCheckInterval = 15 * time.Minute
+	// bridgeProbeTimeout bounds setting up a flow through a masque bridge
+	bridgeProbeTimeout = 10 * time.Second
+	// signatureSuffix is appended to the url of a bridge list for the url
+	// of its minisign signature
+	signatureSuffix = ".minisig"
+)
+
+// BridgeList is a list of community bridges, published with a minisign
+// signature of the operator.
+type BridgeList struct {
+	// Serial must grow with every list, so that a source can't be rolled
+	// back to an older one
+	Serial uint64 `json:"serial"`
+	// Expires refuses the list after this time, if set
+	Expires time.Time `json:"expires,omitempty"`
+	Bridges []Bridge  `json:"bridges"`
+}
+
+// Bridge is a remote end of a custom transport run by someone else, see
+// 'warp-plus relay'. Exactly one of Masque and Relay is set.
+type Bridge struct {
+	// Masque is the connect-udp URI template of a masque bridge
+	Masque string `json:"masque,omitempty"`
+	// Relay is the address of an initiation relay, with the framing it
+	// expects
+	Relay         string `json:"relay,omitempty"`
+	InitFragments int    `json:"init_fragments,omitempty"`
+	InitJunk      int    `json:"init_junk,omitempty"`
+	InitMimic     string `json:"init_mimic,omitempty"`
+}
+
+func (b Bridge) String() string {
+	if b.Masque != "" {
+		return b.Masque
+	}
+	return b.Relay
+}
+
+func (b Bridge) validate() error {
+	switch {
+	case (b.Masque == "") == (b.Relay == ""):
+		return errors.New("bridge must have exactly one of masque and relay")
+	case b.Masque != "":
+		_, err := masque.Expand(b.Masque, netip.AddrPortFrom(netip.IPv4Unspecified(), 0))
+		return err
+	default:
+		_, _, err := net.SplitHostPort(b.Relay)
+		return err
+	}
+}
+
+// withBridge returns opts and endpoints bringing the tunnel up through b.
+func (opts WarpOptions) withBridge(b Bridge, endpoints []string) (WarpOptions, []string) {
+	if b.Masque != "" {
+		opts.Masque = b.Masque
+		return opts, endpoints
+	}
+	opts.Endpoint = b.Relay
+	opts.InitFragments, opts.InitJunk, opts.InitMimic = b.InitFragments, b.InitJunk, b.InitMimic
+	return opts, []string{b.Relay, b.Relay}
+}
+
+// Bridges are the bridges the tunnel is brought up through, in the order
+// of how well they did.
+type Bridges struct {
+	mu      sync.Mutex
+	bridges []Bridge
+	health  map[string]transportRecord
+	path    string
+}
+
+// LoadBridges reads the bridges embedded in the binary and those listed by
+// sources, files or http(s) urls of lists signed with key. Urls are fetched
+// through front, if set, sending the real host only inside the encrypted
+// request. A list that can't be fetched or fails verification is replaced
+// by the last verified copy cached in cacheDir.
+func LoadBridges(ctx context.Context, l *slog.Logger, cacheDir string, embedded []byte, sources []string, front string, key update.PublicKey) (*Bridges, error) {
+	l = l.With("subsystem", "bridges")
+
+	var bridges []Bridge
+	if len(bytes.TrimSpace(embedded)) > 0 {
+		var list BridgeList
+		if err := json.Unmarshal(embedded, &list); err != nil {
+			return nil, fmt.Errorf("invalid embedded bridges: %w", err)
+		}
+		bridges = append(bridges, list.Bridges...)
+	}
+
+	for _, source := range sources {
+		list, err := loadBridgeList(ctx, l, cacheDir, source, front, key)
+		if err != nil {
+			l.Warn("skipping bridge list", "source", source, "error", err)
+			continue
+		}
+		l.Debug("loaded bridge list", "source", source, "serial", list.Serial, "bridges", len(list.Bridges))
+		bridges = append(bridges, list.Bridges...)
+	}
+
+	b := &Bridges{health: make(map[string]transportRecord), path: filepath.Join(cacheDir, bridgeHealthFile)}
+	for _, bridge := range bridges {
+		if err := bridge.validate(); err != nil {
+			l.Warn("skipping invalid bridge", "bridge", bridge, "error", err)
+			continue
+		}
+		if !slices.ContainsFunc(b.bridges, func(o Bridge) bool { return o.String() == bridge.String() }) {
+			b.bridges = append(b.bridges, bridge)
+		}
+	}
+	if len(b.bridges) == 0 {
+		return nil, errors.New("no bridges could be loaded")
+	}
+
+	if data, err := os.ReadFile(b.path); err == nil {
+		if err := json.Unmarshal(data, &b.health); err != nil {
+			l.Warn("ignoring corrupt bridge health", "error", err)
+		}
+	}
+	l.Info("loaded bridges", "count", len(b.bridges))
+	return b, nil
+}
+
+func loadBridgeList(ctx context.Context, l *slog.Logger, cacheDir, source, front string, key update.PublicKey) (BridgeList, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return BridgeList{}, err
+		}
+		sig, err := os.ReadFile(source + signatureSuffix)
+		if err != nil {
+			return BridgeList{}, err
+		}
+		return verifyBridgeList(data, sig, key)
+	}
+
+	sum := sha256.Sum256([]byte(source))
+	cached := filepath.Join(cacheDir, bridgesDir, hex.EncodeToString(sum[:8]))
+	cachedList, cerr := func() (BridgeList, error) {
+		data, err := os.ReadFile(cached)
+		if err != nil {
+			return BridgeList{}, err
+		}
+		sig, err := os.ReadFile(cached + signatureSuffix)
+		if err != nil {
+			return BridgeList{}, err
+		}
+		return verifyBridgeList(data, sig, key)
+	}()
+
+	data, sig, err := fetchBridgeList(ctx, source, front)
+	if err == nil {
+		var list BridgeList
+		if list, err = verifyBridgeList(data, sig, key); err == nil {
+			if cerr == nil && list.Serial < cachedList.Serial {
+				l.Warn("refusing a bridge list older than the cached one", "source", source, "serial", list.Serial, "cached", cachedList.Serial)
+				return cachedList, nil
+			}
+			if err := os.MkdirAll(filepath.Dir(cached), 0o755); err == nil {
+				if err := errors.Join(os.WriteFile(cached, data, 0o644), os.WriteFile(cached+signatureSuffix, sig, 0o644)); err != nil {
+					l.Debug("failed to cache bridge list", "source", source, "error", err)
+				}
+			}
+			return list, nil
+		}
+	}
+
+	if cerr != nil {
+		return BridgeList{}, err
+	}
+	l.Info("failed to fetch bridge list, using the cached copy", "source", source, "error", err)
+	return cachedList, nil
+}
+
+func fetchBridgeList(ctx context.Context, url, front string) (data, sig []byte, err error) {
+	ctx, cancel := context.WithTimeout(ctx, bridgeFetchTimeout)
+	defer cancel()
+
+	if data, err = fetchFronted(ctx, url, front); err != nil {
+		return nil, nil, err
+	}
+	if sig, err = fetchFronted(ctx, url+signatureSuffix, front); err != nil {
+		return nil, nil, err
+	}
+	return data, sig, nil
+}
+
+// fetchFronted gets url, connecting to front instead of its host if set.
+func fetchFronted(ctx context.Context, url, front string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if front != "" {
+		req.Host = req.URL.Host
+		req.URL.Host = front
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, bridgeListMaxSize))
+}
+
+func verifyBridgeList(data, sig []byte, key update.PublicKey) (BridgeList, error) {
+	var list BridgeList
+	if err := key.Verify(data, sig); err != nil {
+		return list, err
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return list, fmt.Errorf("invalid bridge list: %w", err)
+	}
+	if !list.Expires.IsZero() && time.Now().After(list.Expires) {
+		return list, errors.New("bridge list has expired")
+	}
+	return list, nil
+}
+
+// ordered returns the bridges, those that came up most often first.
+func (b *Bridges) ordered() []Bridge {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ordered := slices.Clone(b.bridges)
+	slices.SortStableFunc(ordered, func(x, y Bridge) int {
+		return cmp.Compare(b.health[y.String()].score(), b.health[x.String()].score())
+	})
+	return ordered
+}
+
+// record counts an attempt to use bridge and saves the health of all
+// bridges.
+func (b *Bridges) record(l *slog.Logger, bridge Bridge, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r := b.health[bridge.String()]
+	r.record(ok)
+	b.health[bridge.String()] = r
+
+	data, err := json.Marshal(b.health)
+	if err == nil {
+		err = os.WriteFile(b.path, data, 0o600)
+	}
+	if err != nil {
+		l.Warn("failed to save bridge health", "error", err)
+	}
+}
+
+// check probes the masque bridges by setting up a flow to a warp endpoint
+// through each. Relays can only be told apart by bringing the tunnel up.
+func (b *Bridges) check(ctx context.Context, l *slog.Logger) {
+	for _, bridge := range b.ordered() {
+		if bridge.Masque == "" {
+			continue
+		}
+		target, err := warp.RandomWarpEndpoint(true, false)
+		if err != nil {
+			return
+		}
+
+		pctx, cancel := context.WithTimeout(ctx, bridgeProbeTimeout)
+		c, err := masque.Dial(pctx, bridge.Masque, target)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			c.Close()
+		}
+		l.Debug("probed bridge", "bridge", bridge, "error", err)
+		b.record(l, bridge, err == nil)
+	}
+}
+
+// watch probes the bridges every bridgeCheckInterval until ctx is done.
+func (b *Bridges) watch(ctx context.Context, l *slog.Logger) {
+	l = l.With("subsystem", "bridges")
+	ticker := time.NewTicker(bridgeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.check(ctx, l)
+		}
+	}
+}
+
+// runBridges brings the tunnel up through the first bridge that works,
+// trying those that came up most often first.
+func runBridges(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoints []string) error {
+	bl := l.With("subsystem", "bridges")
+
+	err := errors.New("no bridges")
+	for _, bridge := range opts.Bridges.ordered() {
+		bopts, bendpoints := opts.withBridge(bridge, endpoints)
+
+		// A failed attempt takes down what it brought up before trying
+		// the next bridge
+		bctx, cancel := context.WithCancel(ctx)
+		err = runMode(bctx, l, bopts, bendpoints)
+		if ctx.Err() != nil {
+			cancel()
+			return err
+		}
+		opts.Bridges.record(bl, bridge, err == nil)
+		if err == nil {
+			context.AfterFunc(ctx, cancel)
+			bl.Info("bridge came up", "bridge", bridge)
+			return nil
+		}
+		cancel()
+		bl.Warn("bridge failed", "bridge", bridge, "error", err)
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+package app
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// lanPrefixes are kept off the tunnel in tun mode so printers, NAS boxes and
+// other devices on the local network stay reachable.
+var lanPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+}
+
+// bypassPrefixes returns the LAN ranges followed by the user's own, with
+// duplicates dropped.
+func bypassPrefixes(extra []netip.Prefix) []netip.Prefix {
+	seen := make(map[netip.Prefix]bool)
+	var prefixes []netip.Prefix
+	for _, prefix := range slices.Concat(lanPrefixes, extra) {
+		prefix = prefix.Masked()
+		if seen[prefix] {
+			continue
+		}
+		seen[prefix] = true
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
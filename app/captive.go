@@ -0,0 +1,143 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/mixed"
+)
+
+const (
+	captiveProbeURL      = "http://cp.cloudflare.com/generate_204"
+	captiveProbeTimeout  = 5 * time.Second
+	captiveCheckInterval = 5 * time.Second
+)
+
+// detectCaptivePortal requests a URL that always answers 204 No Content. Any
+// other answer means the network intercepted the request, in which case the
+// redirect target, if any, is returned as the portal location.
+func detectCaptivePortal(ctx context.Context) (bool, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, captiveProbeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, captiveProbeURL, nil)
+	if err != nil {
+		return false, "", err
+	}
+
+	client := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return false, "", nil
+	}
+	return true, resp.Header.Get("Location"), nil
+}
+
+// waitCaptivePortal blocks while the network sits behind a captive portal.
+// In proxy mode a plain proxy is served on bind meanwhile, so the portal can
+// be reached outside the tunnel to log in. It is torn down, along with every
+// connection made through it, once internet access is confirmed.
+func waitCaptivePortal(ctx context.Context, l *slog.Logger, bind netip.AddrPort, tun bool) error {
+	l = l.With("subsystem", "captive-portal")
+
+	captive, portal, err := detectCaptivePortal(ctx)
+	if err != nil {
+		// The probe may simply be filtered, let the tunnel try anyway
+		l.Debug("captive portal probe failed", "error", err)
+		return nil
+	}
+	if !captive {
+		return nil
+	}
+
+	l.Warn("captive portal detected, allowing traffic outside the tunnel until logged in", "portal", portal)
+
+	if !tun {
+		stop, err := startBypassProxy(ctx, l, bind)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	t := time.NewTicker(captiveCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+
+		if captive, _, err := detectCaptivePortal(ctx); err == nil && !captive {
+			l.Info("internet access confirmed, resuming full tunneling")
+			return nil
+		}
+	}
+}
+
+// startBypassProxy serves a direct proxy on bind. The returned function stops
+// it and closes the connections it made.
+func startBypassProxy(ctx context.Context, l *slog.Logger, bind netip.AddrPort) (func(), error) {
+	ln, err := net.Listen("tcp", bind.String())
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mu    sync.Mutex
+		conns = make(map[net.Conn]struct{})
+	)
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+		return conn, nil
+	}
+
+	proxyCtx, cancel := context.WithCancel(ctx)
+	p := mixed.NewProxy(
+		mixed.WithListener(ln),
+		mixed.WithLogger(l),
+		mixed.WithContext(proxyCtx),
+		mixed.WithUserDialFunc(dial),
+	)
+
+	done := make(chan struct{})
+	go func() {
+		_ = p.ListenAndServe()
+		close(done)
+	}()
+
+	return func() {
+		cancel()
+		_ = ln.Close()
+		<-done
+
+		mu.Lock()
+		defer mu.Unlock()
+		for conn := range conns {
+			_ = conn.Close()
+		}
+	}, nil
+}
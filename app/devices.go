@@ -0,0 +1,139 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/bepass-org/warp-plus/control"
+	"github.com/bepass-org/warp-plus/warp"
+)
+
+// identityNames are the names of the warp identities, the secondary one
+// only being used by gool and standby, and the failback ones by a failback
+// of the fallback chain.
+var identityNames = []string{"primary", "secondary", failbackPrefix + "primary", failbackPrefix + "secondary"}
+
+// Devices manages the devices bound to the warp+ license through the
+// identities of the instance.
+type Devices struct {
+	l       *slog.Logger
+	store   warp.IdentityStore
+	license string
+}
+
+func NewDevices(l *slog.Logger, opts WarpOptions) *Devices {
+	return &Devices{l: l, store: opts.identities(), license: opts.License}
+}
+
+// identities loads the identities that have been created so far.
+func (d *Devices) identities() ([]warp.Identity, error) {
+	var idents []warp.Identity
+	for _, name := range identityNames {
+		ident, err := warp.LoadIdentity(d.store, name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		idents = append(idents, ident)
+	}
+	return idents, nil
+}
+
+// bound returns an identity bound to the license, through which the other
+// devices on it are managed, along with the IDs of all identities.
+func (d *Devices) bound() (warp.Identity, []string, error) {
+	if d.license == "" {
+		return warp.Identity{}, nil, errors.New("no license is set, set one with --key")
+	}
+
+	idents, err := d.identities()
+	if err != nil {
+		return warp.Identity{}, nil, err
+	}
+
+	var ids []string
+	for _, ident := range idents {
+		ids = append(ids, ident.ID)
+	}
+	for _, ident := range idents {
+		if ident.Account.License == d.license {
+			return ident, ids, nil
+		}
+	}
+	return warp.Identity{}, nil, errors.New("this instance isn't bound to the license, remove a device from another one bound to it")
+}
+
+// Devices lists the devices bound to the license.
+func (d *Devices) Devices() ([]control.Device, error) {
+	ident, ids, err := d.bound()
+	if err != nil {
+		return nil, err
+	}
+
+	bound, err := warp.GetBoundDevices(ident.Token, ident.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+
+	devices := make([]control.Device, 0, len(bound))
+	for _, dev := range bound {
+		devices = append(devices, control.Device{
+			ID:      dev.ID,
+			Name:    dev.Name,
+			Type:    dev.Type,
+			Model:   dev.Model,
+			Created: dev.Created,
+			Active:  dev.Active,
+			Current: slices.Contains(ids, dev.ID),
+		})
+	}
+	return devices, nil
+}
+
+// RemoveDevice unbinds a device other than this instance from the license.
+func (d *Devices) RemoveDevice(id string) error {
+	ident, ids, err := d.bound()
+	if err != nil {
+		return err
+	}
+	if slices.Contains(ids, id) {
+		return errors.New("can't remove a device of this instance")
+	}
+
+	d.l.Info("removing device from license", "device", id)
+	if err := warp.RemoveBoundDevice(ident.Token, ident.ID, id); err != nil {
+		return fmt.Errorf("failed to remove device: %w", err)
+	}
+	return nil
+}
+
+// BindDevice binds the identities of this instance to the license. The
+// tunnel keeps running, the account change applies to it as is.
+func (d *Devices) BindDevice() error {
+	if d.license == "" {
+		return errors.New("no license is set, set one with --key")
+	}
+
+	bound := 0
+	for _, name := range identityNames {
+		err := warp.BindIdentity(d.l, d.store, name, d.license)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			continue
+		case errors.Is(err, warp.ErrTooManyDevices):
+			return fmt.Errorf("%w (at most %d), remove a stale one first", err, warp.MaxDevices)
+		case err != nil:
+			return fmt.Errorf("failed to bind device: %w", err)
+		}
+		bound++
+	}
+	if bound == 0 {
+		return errors.New("no identity has been created yet")
+	}
+	return nil
+}
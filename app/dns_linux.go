@@ -0,0 +1,145 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const resolvConf = "/etc/resolv.conf"
+
+// resolvConfCheckInterval is how often a taken over resolv.conf is checked
+// for being rewritten by a DHCP client or NetworkManager.
+const resolvConfCheckInterval = 10 * time.Second
+
+// takeoverDNS points the system resolver at dns while ctx is live, or only
+// for domains when given. With systemd-resolved the servers are set on the
+// tun link, as its default route or routing domains, which it drops by
+// itself with the link. Otherwise resolv.conf is replaced, and replaced
+// again whenever a lease renewal rewrites it; split DNS isn't possible
+// then. Either way the change is journaled first so a crash can be
+// recovered from.
+func takeoverDNS(ctx context.Context, l *slog.Logger, cacheDir string, dns []netip.Addr, domains []string) error {
+	j := startDNSTakeover(ctx, l, cacheDir)
+
+	if _, err := exec.LookPath("resolvectl"); err == nil {
+		if err := j.record(dnsChange{Kind: "resolved", Target: tunName}); err != nil {
+			return fmt.Errorf("failed to journal dns change: %w", err)
+		}
+		args := []string{"dns", tunName}
+		for _, addr := range dns {
+			args = append(args, addr.String())
+		}
+		routing := []string{"domain", tunName, "~."}
+		if len(domains) > 0 {
+			routing = routing[:2]
+			for _, domain := range domains {
+				routing = append(routing, "~"+strings.Trim(domain, "."))
+			}
+		}
+		err := exec.Command("resolvectl", args...).Run()
+		if err == nil {
+			err = exec.Command("resolvectl", routing...).Run()
+		}
+		if err == nil && len(domains) > 0 {
+			err = exec.Command("resolvectl", "default-route", tunName, "false").Run()
+		}
+		if err == nil {
+			l.Info("dns set through systemd-resolved", "interface", tunName)
+			return nil
+		}
+		l.Debug("systemd-resolved unavailable, falling back to resolv.conf", "error", err)
+		j.restore(l)
+	}
+
+	if len(domains) > 0 {
+		return errors.New("split dns requires systemd-resolved")
+	}
+
+	var content strings.Builder
+	content.WriteString("# generated by warp-plus, restored on exit\n")
+	for _, addr := range dns {
+		fmt.Fprintf(&content, "nameserver %s\n", addr)
+	}
+	ours := content.String()
+
+	if err := replaceResolvConf(j, ours); err != nil {
+		return err
+	}
+	l.Info("dns set through resolv.conf")
+
+	go func() {
+		ticker := time.NewTicker(resolvConfCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-j.done:
+				return
+			case <-ticker.C:
+				if current, err := os.ReadFile(resolvConf); err == nil && string(current) == ours {
+					continue
+				}
+				l.Info("resolv.conf was rewritten, taking it over again")
+				if err := replaceResolvConf(j, ours); err != nil {
+					l.Warn("failed to take over resolv.conf", "error", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// replaceResolvConf journals the current resolv.conf, a symlink as
+// "link:" and its target or a file as "file:" and its content, then writes
+// content in its place.
+func replaceResolvConf(j *dnsJournal, content string) error {
+	var previous string
+	if target, err := os.Readlink(resolvConf); err == nil {
+		previous = "link:" + target
+	} else if data, err := os.ReadFile(resolvConf); err == nil {
+		previous = "file:" + string(data)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := j.record(dnsChange{Kind: "resolv.conf", Target: resolvConf, Previous: previous}); err != nil {
+		return fmt.Errorf("failed to journal dns change: %w", err)
+	}
+
+	tmp := resolvConf + ".warp-plus"
+	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, resolvConf)
+}
+
+func revertDNSChange(c dnsChange) error {
+	switch c.Kind {
+	case "resolved":
+		// The link is gone after a crash and resolved forgot it already
+		if _, err := os.Stat("/sys/class/net/" + c.Target); err != nil {
+			return nil
+		}
+		return exec.Command("resolvectl", "revert", c.Target).Run()
+	case "resolv.conf":
+		if target, ok := strings.CutPrefix(c.Previous, "link:"); ok {
+			tmp := c.Target + ".warp-plus"
+			os.Remove(tmp)
+			if err := os.Symlink(target, tmp); err != nil {
+				return err
+			}
+			return os.Rename(tmp, c.Target)
+		}
+		if content, ok := strings.CutPrefix(c.Previous, "file:"); ok {
+			return os.WriteFile(c.Target, []byte(content), 0o644)
+		}
+		return os.Remove(c.Target)
+	}
+	return fmt.Errorf("unknown dns change %q", c.Kind)
+}
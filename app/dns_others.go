@@ -0,0 +1,116 @@
+//go:build !windows && !linux
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// resolverDir holds per-domain resolver configurations on macOS.
+const resolverDir = "/etc/resolver"
+
+// takeoverDNS sets dns as the servers of every enabled network service
+// while ctx is live. Manually set servers take precedence over the ones
+// handed out by DHCP, so lease renewals don't undo it. With domains only
+// those are sent to dns, through resolver files, and the services keep
+// their servers. The previous settings are journaled first so a crash can
+// be recovered from.
+func takeoverDNS(ctx context.Context, l *slog.Logger, cacheDir string, dns []netip.Addr, domains []string) error {
+	if len(domains) > 0 {
+		return splitDNS(ctx, l, cacheDir, dns, domains)
+	}
+
+	out, err := exec.Command("networksetup", "-listallnetworkservices").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list network services: %w", err)
+	}
+
+	servers := make([]string, 0, len(dns))
+	for _, addr := range dns {
+		servers = append(servers, addr.String())
+	}
+
+	j := startDNSTakeover(ctx, l, cacheDir)
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	// The first line is a note about disabled services, which start with *
+	for _, service := range lines[min(1, len(lines)):] {
+		if service == "" || strings.HasPrefix(service, "*") {
+			continue
+		}
+
+		current, err := exec.Command("networksetup", "-getdnsservers", service).Output()
+		if err != nil {
+			continue
+		}
+		previous := "Empty"
+		if fields := strings.Fields(string(current)); len(fields) > 0 {
+			if _, err := netip.ParseAddr(fields[0]); err == nil {
+				previous = strings.Join(fields, " ")
+			}
+		}
+
+		if err := j.record(dnsChange{Kind: "networksetup", Target: service, Previous: previous}); err != nil {
+			return fmt.Errorf("failed to journal dns change: %w", err)
+		}
+		args := append([]string{"-setdnsservers", service}, servers...)
+		if err := exec.Command("networksetup", args...).Run(); err != nil {
+			l.Warn("failed to set dns", "service", service, "error", err)
+		}
+	}
+
+	return nil
+}
+
+func splitDNS(ctx context.Context, l *slog.Logger, cacheDir string, dns []netip.Addr, domains []string) error {
+	var content strings.Builder
+	content.WriteString("# generated by warp-plus, removed on exit\n")
+	for _, addr := range dns {
+		fmt.Fprintf(&content, "nameserver %s\n", addr)
+	}
+
+	if err := os.MkdirAll(resolverDir, 0o755); err != nil {
+		return err
+	}
+
+	j := startDNSTakeover(ctx, l, cacheDir)
+	for _, domain := range domains {
+		path := filepath.Join(resolverDir, strings.Trim(domain, "."))
+		previous := ""
+		if data, err := os.ReadFile(path); err == nil {
+			previous = "file:" + string(data)
+		}
+		if err := j.record(dnsChange{Kind: "resolver", Target: path, Previous: previous}); err != nil {
+			return fmt.Errorf("failed to journal dns change: %w", err)
+		}
+		if err := os.WriteFile(path, []byte(content.String()), 0o644); err != nil {
+			return err
+		}
+	}
+	l.Info("split dns set through resolver files", "domains", domains)
+
+	return nil
+}
+
+func revertDNSChange(c dnsChange) error {
+	switch c.Kind {
+	case "networksetup":
+		args := append([]string{"-setdnsservers", c.Target}, strings.Fields(c.Previous)...)
+		return exec.Command("networksetup", args...).Run()
+	case "resolver":
+		if content, ok := strings.CutPrefix(c.Previous, "file:"); ok {
+			return os.WriteFile(c.Target, []byte(content), 0o644)
+		}
+		if err := os.Remove(c.Target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown dns change %q", c.Kind)
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+// nrptKey holds the local Name Resolution Policy Table rules.
+const nrptKey = `SYSTEM\CurrentControlSet\Services\Dnscache\Parameters\DnsPolicyConfig`
+
+// takeoverDNS adds a Name Resolution Policy Table rule sending domains to
+// dns while ctx is live, leaving all other queries on the physical
+// interface. Without domains there is nothing to do: newNormalTun sets the
+// servers on the tun interface, and they disappear together with it. The
+// rule is journaled first so a crash can be recovered from.
+func takeoverDNS(ctx context.Context, l *slog.Logger, cacheDir string, dns []netip.Addr, domains []string) error {
+	if len(domains) == 0 {
+		return nil
+	}
+
+	guid, err := windows.GenerateGUID()
+	if err != nil {
+		return err
+	}
+	name := guid.String()
+
+	j := startDNSTakeover(ctx, l, cacheDir)
+	if err := j.record(dnsChange{Kind: "nrpt", Target: name}); err != nil {
+		return fmt.Errorf("failed to journal dns change: %w", err)
+	}
+	if err := addNRPTRule(name, dns, domains); err != nil {
+		j.restore(l)
+		return fmt.Errorf("failed to add nrpt rule: %w", err)
+	}
+	flushDNS()
+	l.Info("split dns set through nrpt", "domains", domains)
+
+	return nil
+}
+
+func addNRPTRule(name string, dns []netip.Addr, domains []string) error {
+	key, _, err := registry.CreateKey(registry.LOCAL_MACHINE, nrptKey+`\`+name, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+
+	// A leading dot matches the domain and all of its subdomains
+	names := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		names = append(names, "."+strings.Trim(domain, "."))
+	}
+	servers := make([]string, 0, len(dns))
+	for _, addr := range dns {
+		servers = append(servers, addr.String())
+	}
+
+	if err := key.SetStringsValue("Name", names); err != nil {
+		return err
+	}
+	if err := key.SetStringValue("GenericDNSServers", strings.Join(servers, ";")); err != nil {
+		return err
+	}
+	// 0x8 marks the rule as setting generic DNS servers
+	if err := key.SetDWordValue("ConfigOptions", 0x8); err != nil {
+		return err
+	}
+	if err := key.SetDWordValue("Version", 2); err != nil {
+		return err
+	}
+	if err := key.SetStringValue("IPSECCARestriction", ""); err != nil {
+		return err
+	}
+	return key.SetStringValue("Comment", "warp-plus")
+}
+
+// flushDNS drops cached answers so the policy change applies right away.
+func flushDNS() {
+	exec.Command("ipconfig", "/flushdns").Run()
+}
+
+func revertDNSChange(c dnsChange) error {
+	if c.Kind != "nrpt" {
+		return fmt.Errorf("unknown dns change %q", c.Kind)
+	}
+	err := registry.DeleteKey(registry.LOCAL_MACHINE, nrptKey+`\`+c.Target)
+	if err != nil && !errors.Is(err, registry.ErrNotExist) {
+		return err
+	}
+	flushDNS()
+	return nil
+}
@@ -0,0 +1,182 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const dnsJournalFile = "dns-journal.json"
+
+var errDNSTakeoverEnded = errors.New("dns takeover ended")
+
+// dnsChange records a resolver setting overwritten by the tunnel together
+// with what it was before, so it can be put back.
+type dnsChange struct {
+	// Kind selects how the change is reverted, see revertDNSChange
+	Kind string `json:"kind"`
+	// Target is the file, link or network service that was changed
+	Target string `json:"target"`
+	// Previous is the prior setting in the form Kind expects
+	Previous string `json:"previous,omitempty"`
+}
+
+// dnsJournal persists resolver changes before they are made, so settings
+// left behind by a crash can be restored on the next start.
+type dnsJournal struct {
+	mu      sync.Mutex
+	path    string
+	Changes []dnsChange `json:"changes"`
+	// done is closed once the takeover ends, by ctx being done or a new
+	// one starting, when the journal is restored for good
+	done chan struct{}
+}
+
+// dnsTakeovers holds the journals of the takeovers in progress by path. A
+// takeover ending and the next one starting are serialized through it, so
+// a restore still running can't undo the settings of the next takeover or
+// remove its journal.
+var dnsTakeovers = struct {
+	sync.Mutex
+	active map[string]*dnsJournal
+}{active: make(map[string]*dnsJournal)}
+
+func newDNSJournal(cacheDir string) *dnsJournal {
+	return &dnsJournal{path: filepath.Join(cacheDir, dnsJournalFile), done: make(chan struct{})}
+}
+
+// startDNSTakeover returns the journal of a new takeover of the resolver
+// settings journaled in cacheDir, restoring those of the previous one
+// first if it is still in progress. The journal is restored once ctx is
+// done.
+func startDNSTakeover(ctx context.Context, l *slog.Logger, cacheDir string) *dnsJournal {
+	j := newDNSJournal(cacheDir)
+
+	dnsTakeovers.Lock()
+	if prev := dnsTakeovers.active[j.path]; prev != nil {
+		close(prev.done)
+		prev.restore(l)
+	}
+	dnsTakeovers.active[j.path] = j
+	dnsTakeovers.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			j.end(l)
+		case <-j.done:
+		}
+	}()
+	return j
+}
+
+// end restores the journal of a takeover, unless the next takeover did
+// already.
+func (j *dnsJournal) end(l *slog.Logger) {
+	dnsTakeovers.Lock()
+	defer dnsTakeovers.Unlock()
+
+	if dnsTakeovers.active[j.path] != j {
+		return
+	}
+	delete(dnsTakeovers.active, j.path)
+	close(j.done)
+	j.restore(l)
+}
+
+// record adds or replaces the change for c's kind and target and writes the
+// journal out, unless its takeover ended.
+func (j *dnsJournal) record(c dnsChange) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	select {
+	case <-j.done:
+		return errDNSTakeoverEnded
+	default:
+	}
+
+	for i := range j.Changes {
+		if j.Changes[i].Kind == c.Kind && j.Changes[i].Target == c.Target {
+			j.Changes[i] = c
+			return j.save()
+		}
+	}
+	j.Changes = append(j.Changes, c)
+	return j.save()
+}
+
+func (j *dnsJournal) save() error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o700); err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// restore reverts the journaled changes newest first and removes the
+// journal. Changes that fail to revert are kept for the next attempt.
+func (j *dnsJournal) restore(l *slog.Logger) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var failed []dnsChange
+	for i := len(j.Changes) - 1; i >= 0; i-- {
+		c := j.Changes[i]
+		if err := revertDNSChange(c); err != nil {
+			l.Warn("failed to restore dns setting", "kind", c.Kind, "target", c.Target, "error", err)
+			failed = append([]dnsChange{c}, failed...)
+			continue
+		}
+		l.Debug("restored dns setting", "kind", c.Kind, "target", c.Target)
+	}
+
+	j.Changes = failed
+	if len(failed) > 0 {
+		if err := j.save(); err != nil {
+			l.Warn("failed to save dns journal", "error", err)
+		}
+		return
+	}
+	if err := os.Remove(j.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		l.Warn("failed to remove dns journal", "error", err)
+	}
+}
+
+// restoreDNSJournal reverts resolver changes left behind by a previous run
+// that did not shut down cleanly. The journal of a takeover in progress is
+// left to it.
+func restoreDNSJournal(l *slog.Logger, cacheDir string) {
+	j := newDNSJournal(cacheDir)
+
+	dnsTakeovers.Lock()
+	defer dnsTakeovers.Unlock()
+	if dnsTakeovers.active[j.path] != nil {
+		return
+	}
+
+	data, err := os.ReadFile(j.path)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, j); err != nil {
+		l.Warn("ignoring corrupt dns journal", "path", j.path, "error", err)
+		return
+	}
+	if len(j.Changes) > 0 {
+		l.Info("restoring dns settings from an unclean shutdown")
+	}
+	j.restore(l)
+}
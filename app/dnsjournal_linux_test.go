@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// takeOver journals the resolv.conf at target and writes content there,
+// like replaceResolvConf.
+func takeOver(t *testing.T, j *dnsJournal, target, content string) {
+	t.Helper()
+	previous, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.record(dnsChange{Kind: "resolv.conf", Target: target, Previous: "file:" + string(previous)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(target, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readString(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestDNSJournalRestore(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	targets := []string{filepath.Join(dir, "a.conf"), filepath.Join(dir, "b.conf")}
+	for _, target := range targets {
+		if err := os.WriteFile(target, []byte("original"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A run that crashed after taking both over, the second one twice
+	j := newDNSJournal(dir)
+	takeOver(t, j, targets[0], "ours")
+	takeOver(t, j, targets[1], "ours")
+	if err := j.record(dnsChange{Kind: "resolv.conf", Target: targets[1], Previous: "file:original"}); err != nil {
+		t.Fatal(err)
+	}
+
+	restoreDNSJournal(l, dir)
+	for _, target := range targets {
+		if got := readString(t, target); got != "original" {
+			t.Fatalf("%s: got %q, want it restored", target, got)
+		}
+	}
+	if _, err := os.Stat(j.path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("journal left behind: %v", err)
+	}
+
+	// Changes that fail to revert are kept for the next start
+	j = newDNSJournal(dir)
+	if err := j.record(dnsChange{Kind: "unknown", Target: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	restoreDNSJournal(l, dir)
+	var kept dnsJournal
+	if err := json.Unmarshal([]byte(readString(t, j.path)), &kept); err != nil || len(kept.Changes) != 1 {
+		t.Fatalf("got %v, %v, want the failed change kept", kept.Changes, err)
+	}
+}
+
+func TestDNSTakeoverSerialized(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	target := filepath.Join(dir, "resolv.conf")
+	if err := os.WriteFile(target, []byte("original"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	defer cancel1()
+	j1 := startDNSTakeover(ctx1, l, dir)
+	takeOver(t, j1, target, "first")
+
+	// Not left behind by a crash, so not restored
+	restoreDNSJournal(l, dir)
+	if got := readString(t, target); got != "first" {
+		t.Fatalf("got %q, want the takeover in progress kept", got)
+	}
+
+	// The next takeover starts from the original settings
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	j2 := startDNSTakeover(ctx2, l, dir)
+	if got := readString(t, target); got != "original" {
+		t.Fatalf("got %q, want the first takeover restored", got)
+	}
+	if err := j1.record(dnsChange{Kind: "resolv.conf", Target: target}); !errors.Is(err, errDNSTakeoverEnded) {
+		t.Fatalf("got %v recording on an ended takeover", err)
+	}
+	takeOver(t, j2, target, "second")
+
+	// The first one ending late leaves the second one alone
+	cancel1()
+	time.Sleep(10 * time.Millisecond)
+	if got := readString(t, target); got != "second" {
+		t.Fatalf("got %q, want the second takeover kept", got)
+	}
+	if _, err := os.Stat(j2.path); err != nil {
+		t.Fatalf("journal of the second takeover: %v", err)
+	}
+
+	cancel2()
+	deadline := time.Now().Add(5 * time.Second)
+	for readString(t, target) != "original" {
+		if time.Now().After(deadline) {
+			t.Fatal("second takeover not restored")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+
+	"github.com/bepass-org/warp-plus/doh"
+	"github.com/bepass-org/warp-plus/warp"
+)
+
+// DNSOnlyOptions configures a mode where no tunnel is established and only
+// a local forwarding resolver to Cloudflare's encrypted DNS is run.
+type DNSOnlyOptions struct {
+	Bind     netip.AddrPort
+	Filter   string
+	Protocol doh.Protocol
+	// Gateway is a Zero Trust DNS location ID. When set, queries are sent to
+	// the account-specific Gateway DoH endpoint instead of 1.1.1.1. Unless
+	// Filter is set, it defaults to the location of the Zero Trust account
+	// the primary identity is enrolled in, if any.
+	Gateway string
+	// BlockPage, if valid, is the address of a local page explaining
+	// which domains Gateway policies blocked and why.
+	BlockPage netip.AddrPort
+	// Bootstrap, if set, replaces the addresses the upstream is reached
+	// at, for networks blocking the published ones.
+	Bootstrap []netip.Addr
+}
+
+// enrolledGateway returns the DNS location of the Zero Trust account the
+// primary identity in store is enrolled in, empty if it isn't enrolled in
+// one.
+func enrolledGateway(store warp.IdentityStore) string {
+	ident, err := warp.LoadIdentity(store, identityNames[0])
+	if err != nil || ident.Policy == nil {
+		return ""
+	}
+	return ident.Policy.GatewayUniqueID
+}
+
+func runDNSOnly(ctx context.Context, l *slog.Logger, opts DNSOnlyOptions, identities warp.IdentityStore) error {
+	l = l.With("subsystem", "dns-only")
+
+	// Without a location or filter given, an identity enrolled in a Zero
+	// Trust account resolves through the Gateway of that account
+	if opts.Gateway == "" && (opts.Filter == "" || opts.Filter == doh.FilterNone) {
+		if id := enrolledGateway(identities); id != "" {
+			l.Info("resolving through the gateway of the enrolled zero trust account", "location", id)
+			opts.Gateway = id
+		}
+	}
+
+	var (
+		upstream doh.Upstream
+		err      error
+	)
+	if opts.Gateway != "" {
+		// Gateway locations only expose DoH
+		upstream, err = doh.GatewayUpstream(opts.Gateway)
+		opts.Protocol = doh.ProtocolDoH
+	} else {
+		upstream, err = doh.CloudflareUpstream(opts.Filter)
+	}
+	if err != nil {
+		return err
+	}
+	if len(opts.Bootstrap) > 0 {
+		upstream.Bootstrap = opts.Bootstrap
+	}
+
+	blocked := &blockLog{}
+	serverOpts := []doh.Option{
+		doh.WithBind(opts.Bind),
+		doh.WithLogger(l),
+		doh.WithBlockHandler(func(v doh.Verdict) {
+			l.Info("domain blocked by resolver", "domain", v.Domain, "reason", v.Reason)
+			blocked.add(v)
+		}),
+	}
+
+	if opts.BlockPage.IsValid() {
+		if err := serveBlockPage(ctx, l, opts.BlockPage, blocked); err != nil {
+			return err
+		}
+	}
+
+	client := doh.NewClient(upstream, opts.Protocol, nil)
+	server := doh.NewServer(client, serverOpts...)
+	if err := server.ListenAndServe(ctx); err != nil {
+		return err
+	}
+	context.AfterFunc(ctx, client.CloseIdleConnections)
+
+	l.Info("serving dns", "address", opts.Bind, "upstream", upstream.ServerName, "protocol", opts.Protocol)
+	return nil
+}
@@ -0,0 +1,31 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/bepass-org/warp-plus/warp"
+)
+
+func TestEnrolledGateway(t *testing.T) {
+	store := warp.FileStore{Dir: t.TempDir()}
+	if id := enrolledGateway(store); id != "" {
+		t.Fatalf("got %q without an identity", id)
+	}
+
+	ident := warp.Identity{Config: warp.IdentityConfig{Peers: []warp.IdentityConfigPeer{{PublicKey: "key"}}}}
+	if err := store.Save("primary", ident); err != nil {
+		t.Fatal(err)
+	}
+	if id := enrolledGateway(store); id != "" {
+		t.Fatalf("got %q for a consumer identity", id)
+	}
+
+	ident.Account.AccountType = "team"
+	ident.Policy = &warp.IdentityPolicy{GatewayUniqueID: "abc123"}
+	if err := store.Save("primary", ident); err != nil {
+		t.Fatal(err)
+	}
+	if id := enrolledGateway(store); id != "abc123" {
+		t.Fatalf("got %q, want abc123", id)
+	}
+}
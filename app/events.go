@@ -0,0 +1,97 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	// EventUp is sent when a tunnel comes up
+	EventUp = "up"
+	// EventDown is sent when the last tunnel goes down
+	EventDown = "down"
+	// EventStalled is sent when handshakes stop completing, see
+	// Health.Healthy
+	EventStalled = "stalled"
+	// EventRecovered is sent when handshakes complete again after a stall
+	EventRecovered = "recovered"
+	// EventQuotaLow is sent when the warp+ data left drops below
+	// quotaLowThreshold
+	EventQuotaLow = "quota_low"
+	// EventPower is sent when the tunnel is tuned for another power source
+	EventPower = "power"
+	// EventStaleSession is sent when a peer sends on a session the tunnel
+	// doesn't know, as it still holds one from before a restart
+	EventStaleSession = "stale_session"
+	// EventRekey is sent when peers put new session keys in use
+	EventRekey = "rekey"
+	// EventLicenseRefused is sent when an identity is left on a free
+	// account as the warp+ license is bound to too many devices
+	EventLicenseRefused = "license_refused"
+)
+
+// Event is a change in the state of the tunnel.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Mode string    `json:"mode,omitempty"`
+	// Endpoints lists the tunnel peers, for up events
+	Endpoints []string `json:"endpoints,omitempty"`
+	// QuotaRemaining is the warp+ data left in bytes, for quota events
+	QuotaRemaining int64 `json:"quota_remaining,omitempty"`
+	// Power is the power source, ac or battery, for power events
+	Power string `json:"power,omitempty"`
+	// Packets is how many packets came in on unknown sessions since the
+	// last event, for stale session events
+	Packets uint64 `json:"packets,omitempty"`
+	// Rotations is how many session keys were put in use since the last
+	// event, for rekey events
+	Rotations uint64 `json:"rotations,omitempty"`
+	// Identity is the identity the license wasn't bound to, for license
+	// refused events
+	Identity string `json:"identity,omitempty"`
+}
+
+// Events passes tunnel state changes on to subscribers. A nil Events drops
+// them.
+type Events struct {
+	mu       sync.Mutex
+	next     int
+	handlers map[int]func(Event)
+}
+
+func NewEvents() *Events {
+	return &Events{handlers: make(map[int]func(Event))}
+}
+
+// Subscribe calls h with every later event, one at a time and in order,
+// until unsubscribe is called. h must not block for long.
+func (e *Events) Subscribe(h func(Event)) (unsubscribe func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	id := e.next
+	e.next++
+	e.handlers[id] = h
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		delete(e.handlers, id)
+	}
+}
+
+func (e *Events) emit(ev Event) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ev.Time = time.Now()
+	for _, h := range e.handlers {
+		h(ev)
+	}
+}
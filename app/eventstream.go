@@ -0,0 +1,151 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// eventBacklog is how many events are queued for a slow reader before
+	// further ones are dropped
+	eventBacklog = 64
+	// eventWriteTimeout bounds writing an event to a socket client
+	eventWriteTimeout = 5 * time.Second
+)
+
+// ServeEvents streams events as newline delimited JSON to path until ctx is
+// done. If path is a named pipe, events are written to it while it has a
+// reader. Otherwise a unix socket is created at path and every client
+// connected to it gets the events from then on.
+func ServeEvents(ctx context.Context, l *slog.Logger, path string, events *Events) error {
+	if isNamedPipe(path) {
+		go writeNamedPipe(ctx, l, path, events)
+		l.Info("streaming events to named pipe", "path", path)
+		return nil
+	}
+
+	// Replace the socket left behind by a previous run, but nothing else
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and is not a socket or named pipe", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					l.Error("event socket stopped", "error", err)
+				}
+				return
+			}
+			go streamEvents(ctx, conn, events)
+		}
+	}()
+
+	l.Info("serving events", "path", path)
+	return nil
+}
+
+// subscribeLines returns the events encoded as lines, dropping them while
+// the reader lags more than eventBacklog behind.
+func subscribeLines(events *Events) (lines <-chan []byte, unsubscribe func()) {
+	c := make(chan []byte, eventBacklog)
+	unsubscribe = events.Subscribe(func(ev Event) {
+		line, err := json.Marshal(ev)
+		if err != nil {
+			return
+		}
+		select {
+		case c <- append(line, '\n'):
+		default:
+		}
+	})
+	return c, unsubscribe
+}
+
+// streamEvents writes events to a socket client until it disconnects or ctx
+// is done.
+func streamEvents(ctx context.Context, conn net.Conn, events *Events) {
+	defer conn.Close()
+
+	lines, unsubscribe := subscribeLines(events)
+	defer unsubscribe()
+
+	// Clients only read, so anything read means they are gone
+	gone := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-gone:
+			return
+		case line := <-lines:
+			_ = conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			if _, err := conn.Write(line); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeNamedPipe writes events to the named pipe at path until ctx is done.
+// Events arriving while no one reads the pipe are dropped.
+func writeNamedPipe(ctx context.Context, l *slog.Logger, path string, events *Events) {
+	lines, unsubscribe := subscribeLines(events)
+	defer unsubscribe()
+
+	var pipe *os.File
+	defer func() {
+		if pipe != nil {
+			pipe.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case line := <-lines:
+			if pipe == nil {
+				var err error
+				if pipe, err = openNamedPipe(path); err != nil {
+					l.Debug("no reader on event pipe, dropping event", "error", err)
+					continue
+				}
+			}
+			if _, err := pipe.Write(line); err != nil {
+				// The reader went away, reopen on the next event
+				pipe.Close()
+				pipe = nil
+			}
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package app
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// isNamedPipe reports whether path is a fifo.
+func isNamedPipe(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode()&fs.ModeNamedPipe != 0
+}
+
+// openNamedPipe opens the fifo for writing, which fails with ENXIO rather
+// than blocking while it has no reader.
+func openNamedPipe(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+}
@@ -0,0 +1,18 @@
+package app
+
+import (
+	"os"
+	"strings"
+)
+
+// isNamedPipe reports whether path names a pipe in the pipe namespace,
+// such as \\.\pipe\warp-plus.
+func isNamedPipe(path string) bool {
+	return strings.HasPrefix(strings.ToLower(path), `\\.\pipe\`)
+}
+
+// openNamedPipe connects to the pipe, which fails unless its reader created
+// it.
+func openNamedPipe(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY, 0)
+}
@@ -0,0 +1,370 @@
+package app
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/warp-plus/upgrade"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+const (
+	// transportMasque is plain warp through the masque proxy, the other
+	// transports of the fallback chain are modes as parsed by parseMode
+	transportMasque = "masque"
+	// maxTransportHistory bounds the attempts remembered per transport,
+	// so that the order follows changes to the network
+	maxTransportHistory = 10
+	// failbackPrefix names the identities a failback brings a transport up
+	// with, while the one in use keeps its own
+	failbackPrefix = "failback_"
+	// failbackInterval is how often the transports before the one in use
+	// in the fallback chain are tried again
+	failbackInterval = 5 * time.Minute
+	// failbackDrain is how long connections through the transport failed
+	// back from get to finish before it is taken down
+	failbackDrain = 10 * time.Minute
+	// releaseTimeout is how long psiphon gets to release the proxy address
+	// once taken down
+	releaseTimeout = 10 * time.Second
+)
+
+// transportRecord counts how often a transport of the fallback chain came
+// up on a network.
+type transportRecord struct {
+	Successes int `json:"successes"`
+	Failures  int `json:"failures"`
+}
+
+func (r *transportRecord) record(ok bool) {
+	if ok {
+		r.Successes++
+	} else {
+		r.Failures++
+	}
+	if r.Successes+r.Failures > maxTransportHistory {
+		r.Successes, r.Failures = r.Successes/2, r.Failures/2
+	}
+}
+
+// score estimates the chance of the transport coming up, starting out even
+// for transports never tried.
+func (r transportRecord) score() float64 {
+	return float64(r.Successes+1) / float64(r.Successes+r.Failures+2)
+}
+
+// ParseFallback parses a fallback chain, a comma separated list of warp,
+// gool, masque or psiphon:CC with CC a psiphon country code.
+func ParseFallback(s string) ([]string, error) {
+	var chain []string
+	for _, transport := range strings.Split(s, ",") {
+		transport = strings.TrimSpace(transport)
+		if transport != transportMasque {
+			if _, _, err := parseMode(transport); err != nil {
+				return nil, err
+			}
+		}
+		if slices.Contains(chain, transport) {
+			return nil, fmt.Errorf("%s is in the fallback chain twice", transport)
+		}
+		chain = append(chain, transport)
+	}
+	return chain, nil
+}
+
+// orderTransports sorts the fallback chain by how well each transport did
+// on the network before, keeping the given order between equals.
+func orderTransports(chain []string, history map[string]transportRecord) []string {
+	ordered := slices.Clone(chain)
+	slices.SortStableFunc(ordered, func(a, b string) int {
+		return cmp.Compare(history[b].score(), history[a].score())
+	})
+	return ordered
+}
+
+// withTransport returns opts bringing the tunnel up over transport.
+func (opts WarpOptions) withTransport(transport string) (WarpOptions, error) {
+	proxy := opts.Masque
+	opts.Gool, opts.Psiphon, opts.Masque = false, nil, ""
+
+	if transport == transportMasque {
+		if proxy == "" {
+			return opts, errors.New("masque transport needs a masque proxy")
+		}
+		opts.Masque = proxy
+		return opts, nil
+	}
+
+	gool, psiphonOpts, err := parseMode(transport)
+	if err != nil {
+		return opts, err
+	}
+	if psiphonOpts != nil && opts.Tun {
+		return opts, errors.New("can't use psiphon and tun at the same time")
+	}
+	opts.Gool, opts.Psiphon = gool, psiphonOpts
+	return opts, nil
+}
+
+// runFallback brings the tunnel up over the first transport of the
+// fallback chain that works, trying those that worked on the network before
+// first. It returns the options of the transport that came up.
+func runFallback(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoints []string, network string, profiles *networkProfiles) (WarpOptions, error) {
+	profile, _ := profiles.get(network)
+	chain := orderTransports(opts.Fallback, profile.Transports)
+	l.Info("trying transports", "order", chain)
+
+	var err error
+	for _, transport := range chain {
+		topts, terr := opts.withTransport(transport)
+		if terr != nil {
+			return opts, terr
+		}
+
+		// A failed attempt takes down what it brought up before trying
+		// the next transport
+		tctx, cancel := context.WithCancel(ctx)
+		err = runMode(tctx, l, topts, endpoints)
+		if ctx.Err() != nil {
+			cancel()
+			return opts, err
+		}
+		if network != "" {
+			profiles.update(network, func(p *networkProfile) {
+				if p.Transports == nil {
+					p.Transports = make(map[string]transportRecord)
+				}
+				r := p.Transports[transport]
+				r.record(err == nil)
+				p.Transports[transport] = r
+			})
+		}
+		if err == nil {
+			l.Info("transport came up", "transport", transport)
+			if canFailback(opts) {
+				go failback(ctx, l, opts, endpoints, network, profiles, transport, cancel)
+			} else {
+				context.AfterFunc(ctx, cancel)
+			}
+			return topts, nil
+		}
+		cancel()
+		l.Warn("transport failed", "transport", transport, "error", err)
+	}
+
+	if network != "" {
+		if err := profiles.save(); err != nil {
+			l.Warn("failed to save network profiles", "error", err)
+		}
+	}
+	return opts, err
+}
+
+// canFailback reports whether failback can move the tunnel back to earlier
+// transports of the fallback chain. Tun mode can't have two tunnels up at
+// once, and windows can't share listeners between them.
+func canFailback(opts WarpOptions) bool {
+	return len(opts.Fallback) > 1 && !opts.Tun && runtime.GOOS != "windows"
+}
+
+// failbackTransports returns the transports before current in the fallback
+// chain, leaving out psiphon, which serves a listener of its own that
+// can't be taken over.
+func failbackTransports(chain []string, current string) []string {
+	var earlier []string
+	for _, transport := range chain {
+		if transport == current {
+			break
+		}
+		if _, psiphonOpts, _ := parseMode(transport); psiphonOpts == nil {
+			earlier = append(earlier, transport)
+		}
+	}
+	return earlier
+}
+
+// failback tries the transports before current in the fallback chain again
+// every failbackInterval, in the order given, and moves to the first that
+// comes up, with stop taking current down. The transport comes up with the
+// other set of identities next to the one in use and takes its listeners
+// over, so new connections go through it first while those already open
+// drain through the old one.
+func failback(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoints []string, network string, profiles *networkProfiles, current string, stop context.CancelFunc) {
+	l = l.With("subsystem", "failback")
+	defer func() { context.AfterFunc(ctx, stop) }()
+
+	ticker := time.NewTicker(failbackInterval)
+	defer ticker.Stop()
+	for {
+		earlier := failbackTransports(opts.Fallback, current)
+		if len(earlier) == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// The transport in use keeps its identities
+		nopts := opts
+		nopts.identityPrefix = failbackPrefix
+		if opts.identityPrefix != "" {
+			nopts.identityPrefix = ""
+		}
+		for _, transport := range earlier {
+			next, err := failbackTo(ctx, l, nopts, endpoints, current, transport, stop)
+			if errors.Is(err, errTransportDown) {
+				// Nothing is up anymore, so the chain starts over
+				l.Warn("failed to fail back after taking the transport down", "from", current, "to", transport, "error", err)
+				if _, err := runFallback(ctx, l, opts, endpoints, network, profiles); err != nil {
+					l.Error("no transport came back up", "error", err)
+				}
+				return
+			}
+			if err != nil {
+				l.Debug("transport still failing", "transport", transport, "error", err)
+				continue
+			}
+
+			l.Info("failed back", "from", current, "to", transport)
+			opts, current, stop = nopts, transport, next
+			if network != "" {
+				profiles.update(network, func(p *networkProfile) {
+					if p.Transports == nil {
+						p.Transports = make(map[string]transportRecord)
+					}
+					r := p.Transports[transport]
+					r.record(true)
+					p.Transports[transport] = r
+				})
+				if err := profiles.save(); err != nil {
+					l.Warn("failed to save network profiles", "error", err)
+				}
+			}
+			break
+		}
+	}
+}
+
+// errTransportDown is returned by failbackTo when it took the transport
+// in use down but failed to bring the other one up.
+var errTransportDown = errors.New("transport in use was taken down")
+
+// failbackTo brings transport up to replace from, which stop takes down,
+// returning the function taking it down in turn. From is taken down once
+// the connections through it are closed, or right away when it is psiphon,
+// whose listener can't be taken over.
+func failbackTo(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoints []string, from, transport string, stop context.CancelFunc) (context.CancelFunc, error) {
+	topts, err := opts.withTransport(transport)
+	if err != nil {
+		return nil, err
+	}
+	if _, psiphonOpts, _ := parseMode(from); psiphonOpts != nil {
+		return replacePsiphon(ctx, l, topts, endpoints, stop)
+	}
+
+	done, err := upgrade.Share()
+	if err != nil {
+		return nil, err
+	}
+	tctx, cancel := context.WithCancel(ctx)
+	if err := runMode(tctx, l, topts, endpoints); err != nil {
+		cancel()
+		done(false)
+		return nil, err
+	}
+	done(true)
+	go drainTransport(ctx, opts.Conns, stop)
+	return cancel, nil
+}
+
+// replacePsiphon tries the transport topts brings up on a spare address,
+// and once it works takes psiphon down with stop and brings the transport
+// up on the proxy address.
+func replacePsiphon(ctx context.Context, l *slog.Logger, topts WarpOptions, endpoints []string, stop context.CancelFunc) (context.CancelFunc, error) {
+	probe := topts
+	probe.Bind = netip.MustParseAddrPort("127.0.0.1:0")
+	probe.ExtraBinds, probe.Shadowsocks, probe.VLESS = nil, nil, nil
+	probe.Outbounds, probe.Standby = nil, false
+	pctx, pcancel := context.WithCancel(ctx)
+	err := runMode(pctx, l, probe, endpoints)
+	pcancel()
+	if err != nil {
+		return nil, err
+	}
+
+	stop()
+	if err := waitReleased(ctx, topts.Bind); err != nil {
+		return nil, fmt.Errorf("%w: %w", errTransportDown, err)
+	}
+	tctx, cancel := context.WithCancel(ctx)
+	if err := runMode(tctx, l, topts, endpoints); err != nil {
+		cancel()
+		return nil, fmt.Errorf("%w: %w", errTransportDown, err)
+	}
+	return cancel, nil
+}
+
+// waitReleased waits up to releaseTimeout for nothing to listen on bind.
+func waitReleased(ctx context.Context, bind netip.AddrPort) error {
+	ctx, cancel := context.WithTimeout(ctx, releaseTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		ln, err := net.Listen("tcp", bind.String())
+		if err == nil {
+			return ln.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+// drainTransport takes a transport down with stop once the connections open
+// now are closed, or after failbackDrain.
+func drainTransport(ctx context.Context, conns *wiresocks.ConnTracker, stop context.CancelFunc) {
+	defer stop()
+	if conns == nil {
+		return
+	}
+
+	open := make(map[uint64]bool)
+	for _, flow := range conns.Flows() {
+		open[flow.ID] = true
+	}
+
+	deadline := time.After(failbackDrain)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		draining := false
+		for _, flow := range conns.Flows() {
+			draining = draining || open[flow.ID]
+		}
+		if !draining {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			return
+		case <-ticker.C:
+		}
+	}
+}
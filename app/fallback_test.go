@@ -0,0 +1,84 @@
+package app
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseFallback(t *testing.T) {
+	chain, err := ParseFallback("warp, masque,gool,psiphon:us")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"warp", "masque", "gool", "psiphon:us"}; !slices.Equal(chain, want) {
+		t.Fatalf("got %v, want %v", chain, want)
+	}
+
+	for _, s := range []string{"", "warp,warp", "tor", "psiphon:XX"} {
+		if _, err := ParseFallback(s); err == nil {
+			t.Errorf("parsed invalid chain %q", s)
+		}
+	}
+}
+
+func TestOrderTransports(t *testing.T) {
+	chain := []string{"warp", "masque", "gool", "psiphon:US"}
+	if got := orderTransports(chain, nil); !slices.Equal(got, chain) {
+		t.Fatalf("reordered %v without history", got)
+	}
+
+	// Warp is filtered on the network while psiphon gets through, and
+	// masque was never tried
+	history := make(map[string]transportRecord)
+	for i := 0; i < 3; i++ {
+		r := history["warp"]
+		r.record(false)
+		history["warp"] = r
+		r = history["psiphon:US"]
+		r.record(true)
+		history["psiphon:US"] = r
+	}
+	r := history["gool"]
+	r.record(false)
+	history["gool"] = r
+
+	want := []string{"psiphon:US", "masque", "gool", "warp"}
+	if got := orderTransports(chain, history); !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if !slices.Equal(chain, []string{"warp", "masque", "gool", "psiphon:US"}) {
+		t.Fatal("chain modified in place")
+	}
+}
+
+func TestTransportRecordForgets(t *testing.T) {
+	var r transportRecord
+	for i := 0; i < 50; i++ {
+		r.record(false)
+	}
+	if n := r.Successes + r.Failures; n > maxTransportHistory {
+		t.Fatalf("remembered %d attempts, want at most %d", n, maxTransportHistory)
+	}
+
+	// A network that stopped filtering the transport is trusted again
+	// after a few attempts
+	for i := 0; i < maxTransportHistory; i++ {
+		r.record(true)
+	}
+	if r.score() <= 0.5 {
+		t.Fatalf("score %v after recent successes", r.score())
+	}
+}
+
+func TestFailbackTransports(t *testing.T) {
+	chain := []string{"warp", "psiphon:US", "masque", "gool", "psiphon:DE"}
+	for current, want := range map[string][]string{
+		"warp":       nil,
+		"masque":     {"warp"},
+		"psiphon:DE": {"warp", "masque", "gool"},
+	} {
+		if got := failbackTransports(chain, current); !slices.Equal(got, want) {
+			t.Errorf("from %s: got %v, want %v", current, got, want)
+		}
+	}
+}
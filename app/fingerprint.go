@@ -0,0 +1,76 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// networkFingerprint returns an opaque identifier for the network the host
+// is currently attached to, derived from the gateway MAC address, the DHCP
+// server and the public address prefix. It returns an empty string if none
+// of them can be determined.
+func networkFingerprint(ctx context.Context) string {
+	var parts []string
+
+	if mac, err := defaultGatewayMAC(); err == nil && mac != "" {
+		parts = append(parts, "gateway="+mac)
+	}
+	if server, err := dhcpServer(); err == nil {
+		parts = append(parts, "dhcp="+server.String())
+	}
+	if prefix, err := publicPrefix(ctx); err == nil {
+		parts = append(parts, "prefix="+prefix.String())
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(parts, ",")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// publicPrefix asks cloudflare for the address we appear from outside and
+// returns its /24 (or /48 for IPv6), which stays stable across the address
+// churn of most ISPs.
+func publicPrefix(ctx context.Context) (netip.Prefix, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, connTestEndpoint, nil)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "ip=")
+		if !ok {
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if addr.Is4() {
+			return addr.Prefix(24)
+		}
+		return addr.Prefix(48)
+	}
+	if err := scanner.Err(); err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.Prefix{}, errors.New("public address not found in trace")
+}
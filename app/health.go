@@ -0,0 +1,254 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/control"
+	"github.com/bepass-org/warp-plus/wireguard/device"
+)
+
+// maxHandshakeAge is how old the last handshake may get before the tunnel
+// counts as wedged. Sessions are rekeyed every RekeyAfterTime while
+// keepalives flow and their keys expire after RejectAfterTime.
+const maxHandshakeAge = device.RejectAfterTime
+
+// Health tracks the wireguard devices of the running tunnel so its state
+// can be reported to health checks. A nil Health tracks nothing.
+type Health struct {
+	mu   sync.Mutex
+	devs map[*device.Device]struct{}
+}
+
+func NewHealth() *Health {
+	return &Health{devs: make(map[*device.Device]struct{})}
+}
+
+// track adds dev until ctx is done.
+func (h *Health) track(ctx context.Context, dev *device.Device) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	h.devs[dev] = struct{}{}
+	h.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		h.mu.Lock()
+		delete(h.devs, dev)
+		h.mu.Unlock()
+	}()
+}
+
+// Status reports whether a tunnel is up and the age of its last handshake.
+// With several devices stacked, as in gool mode, the stalest one counts.
+func (h *Health) Status() (up bool, handshakeAge time.Duration) {
+	if h == nil {
+		return false, 0
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for dev := range h.devs {
+		up = true
+		handshakeAge = max(handshakeAge, now.Sub(lastHandshake(dev)))
+	}
+	return up, handshakeAge
+}
+
+// Healthy reports false once a tunnel is up but its last handshake is too
+// old, meaning it stopped passing traffic and won't recover by itself. Only
+// peers with a persistent keepalive count, as the others don't handshake
+// while idle, such as --wgconf peers without PersistentKeepalive.
+func (h *Health) Healthy() bool {
+	now := time.Now()
+	for _, dev := range h.devices() {
+		if latest, ok := keptAliveHandshake(dev); ok && now.Sub(latest) > maxHandshakeAge {
+			return false
+		}
+	}
+	return true
+}
+
+// Tunnels returns the stats of every peer of the tracked devices.
+func (h *Health) Tunnels() []control.TunnelStats {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var stats []control.TunnelStats
+	for dev := range h.devs {
+		stats = append(stats, peerStats(dev)...)
+	}
+	// Keep the order stable across calls, devices are kept in a map
+	slices.SortFunc(stats, func(a, b control.TunnelStats) int {
+		return strings.Compare(a.Endpoint, b.Endpoint)
+	})
+	return stats
+}
+
+// unknownIndexPackets returns how many packets the tracked devices got for
+// sessions they don't know.
+func (h *Health) unknownIndexPackets() uint64 {
+	var n uint64
+	for _, dev := range h.devices() {
+		n += dev.UnknownIndexPackets()
+	}
+	return n
+}
+
+// keypairRotations returns how many times the peers of the tracked devices
+// put new session keys in use.
+func (h *Health) keypairRotations() uint64 {
+	var n uint64
+	for _, peer := range h.Tunnels() {
+		n += peer.KeypairRotations
+	}
+	return n
+}
+
+// devices returns the tracked devices.
+func (h *Health) devices() []*device.Device {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	devs := make([]*device.Device, 0, len(h.devs))
+	for dev := range h.devs {
+		devs = append(devs, dev)
+	}
+	return devs
+}
+
+// lastHandshake returns the most recent handshake of any of dev's peers.
+func lastHandshake(dev *device.Device) time.Time {
+	var latest time.Time
+	for _, peer := range peerStats(dev) {
+		if peer.LastHandshake.After(latest) {
+			latest = peer.LastHandshake
+		}
+	}
+	return latest
+}
+
+// keptAliveHandshake returns the most recent handshake of dev's peers with
+// a persistent keepalive, and false if it has none.
+func keptAliveHandshake(dev *device.Device) (time.Time, bool) {
+	get, err := dev.IpcGet()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var latest, handshake time.Time
+	var keptAlive, found bool
+	var secs int64
+	peerDone := func() {
+		if keptAlive {
+			found = true
+			if handshake.After(latest) {
+				latest = handshake
+			}
+		}
+		handshake, keptAlive, secs = time.Time{}, false, 0
+	}
+	scanner := bufio.NewScanner(strings.NewReader(get))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "public_key":
+			peerDone()
+		case "persistent_keepalive_interval":
+			keptAlive = value != "0"
+		case "last_handshake_time_sec":
+			secs, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			nsecs, _ := strconv.ParseInt(value, 10, 64)
+			if secs != 0 {
+				handshake = time.Unix(secs, nsecs)
+			}
+		}
+	}
+	peerDone()
+	return latest, found
+}
+
+// peerStats reads the stats of dev's peers from its uapi configuration.
+func peerStats(dev *device.Device) []control.TunnelStats {
+	get, err := dev.IpcGet()
+	if err != nil {
+		return nil
+	}
+
+	var stats []control.TunnelStats
+	var secs int64
+	scanner := bufio.NewScanner(strings.NewReader(get))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		if key == "public_key" {
+			stats = append(stats, control.TunnelStats{})
+			continue
+		}
+		if len(stats) == 0 {
+			// Interface settings come before the first peer
+			continue
+		}
+
+		peer := &stats[len(stats)-1]
+		switch key {
+		case "endpoint":
+			peer.Endpoint = value
+		case "rx_bytes":
+			peer.RxBytes, _ = strconv.ParseUint(value, 10, 64)
+		case "tx_bytes":
+			peer.TxBytes, _ = strconv.ParseUint(value, 10, 64)
+		case "rtt_ms":
+			peer.RTTMillis, _ = strconv.ParseInt(value, 10, 64)
+		case "handshake_count":
+			peer.Handshakes, _ = strconv.ParseUint(value, 10, 64)
+		case "handshake_p50_ms":
+			peer.HandshakeP50Millis, _ = strconv.ParseInt(value, 10, 64)
+		case "handshake_p95_ms":
+			peer.HandshakeP95Millis, _ = strconv.ParseInt(value, 10, 64)
+		case "handshake_p99_ms":
+			peer.HandshakeP99Millis, _ = strconv.ParseInt(value, 10, 64)
+		case "keypair_created_sec":
+			created, _ := strconv.ParseInt(value, 10, 64)
+			peer.KeypairCreated = time.Unix(created, 0)
+		case "keypair_sent":
+			peer.KeypairSent, _ = strconv.ParseUint(value, 10, 64)
+		case "keypair_received":
+			peer.KeypairReceived, _ = strconv.ParseUint(value, 10, 64)
+		case "keypair_rotations":
+			peer.KeypairRotations, _ = strconv.ParseUint(value, 10, 64)
+		case "last_handshake_time_sec":
+			secs, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			nsecs, _ := strconv.ParseInt(value, 10, 64)
+			if secs != 0 {
+				peer.LastHandshake = time.Unix(secs, nsecs)
+			}
+		}
+	}
+	return stats
+}
@@ -0,0 +1,42 @@
+package app
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/wireguard/conn/bindtest"
+	"github.com/bepass-org/warp-plus/wireguard/device"
+	"github.com/bepass-org/warp-plus/wireguard/tun/tuntest"
+)
+
+func TestHealthKeepalive(t *testing.T) {
+	dev := device.NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], device.NewLogger(device.LogLevelSilent, ""))
+	defer dev.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewHealth()
+	h.track(ctx, dev)
+
+	var priv, pub device.NoisePrivateKey
+	priv[0], pub[0] = 1, 2
+	set := func(keepalive string) {
+		t.Helper()
+		if err := dev.IpcSet("private_key=" + hex.EncodeToString(priv[:]) + "\npublic_key=" + hex.EncodeToString(pub[:]) + "\npersistent_keepalive_interval=" + keepalive + "\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An idle peer without keepalive never handshakes, which is fine
+	set("0")
+	if !h.Healthy() {
+		t.Fatal("unhealthy without keepalive")
+	}
+
+	// One with keepalive handshakes every two minutes even while idle
+	set("25")
+	if h.Healthy() {
+		t.Fatal("healthy with keepalive and no handshake")
+	}
+}
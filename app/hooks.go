@@ -0,0 +1,94 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// hookTimeout bounds a single hook command.
+const hookTimeout = time.Minute
+
+// Hooks are shell commands run as the tunnel comes and goes, like the
+// PreUp, PostUp, PreDown and PostDown hooks of wg-quick. Like there, %i is
+// replaced with the interface name. The commands also get the tunnel
+// described in the environment:
+//
+//	WARPPLUS_INTERFACE  tun interface name, empty in proxy mode
+//	WARPPLUS_BIND       proxy address, empty in tun mode
+//	WARPPLUS_MODE       warp, gool, psiphon:CC or wireguard
+//	WARPPLUS_ENDPOINT   space separated peer endpoints, once they are known
+//	WARPPLUS_DNS        dns server used through the tunnel
+type Hooks struct {
+	PreUp    []string
+	PostUp   []string
+	PreDown  []string
+	PostDown []string
+}
+
+// Hook names
+const (
+	hookPreUp    = "pre-up"
+	hookPostUp   = "post-up"
+	hookPreDown  = "pre-down"
+	hookPostDown = "post-down"
+)
+
+// run runs the commands of a hook in order, stopping at the first failure.
+func (h *Hooks) run(l *slog.Logger, hook string, opts WarpOptions, endpoints []string) error {
+	if h == nil {
+		return nil
+	}
+
+	cmds := map[string][]string{
+		hookPreUp:    h.PreUp,
+		hookPostUp:   h.PostUp,
+		hookPreDown:  h.PreDown,
+		hookPostDown: h.PostDown,
+	}[hook]
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	iface, bind := "", opts.Bind.String()
+	if opts.Tun || opts.Sidecar {
+		iface, bind = "warp0", ""
+	}
+	env := append(os.Environ(),
+		"WARPPLUS_INTERFACE="+iface,
+		"WARPPLUS_BIND="+bind,
+		"WARPPLUS_MODE="+opts.outboundTag(),
+		"WARPPLUS_ENDPOINT="+strings.Join(endpoints, " "),
+		"WARPPLUS_DNS="+opts.DnsAddr.String(),
+	)
+
+	for _, c := range cmds {
+		c = strings.ReplaceAll(c, "%i", iface)
+		l.Info("running hook", "hook", hook, "command", c)
+
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		cmd := shellCommand(ctx, c)
+		cmd.Env = env
+		out, err := cmd.CombinedOutput()
+		cancel()
+		if len(out) > 0 {
+			l.Info("hook output", "hook", hook, "output", strings.TrimSpace(string(out)))
+		}
+		if err != nil {
+			return fmt.Errorf("%s hook %q failed: %w", hook, c, err)
+		}
+	}
+	return nil
+}
+
+func shellCommand(ctx context.Context, c string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", c)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", "-c", c)
+}
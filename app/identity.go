@@ -0,0 +1,122 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+)
+
+// renewCooldown is the least time between checks for revoked identities,
+// so that a tunnel failing for other reasons doesn't keep registering new
+// ones.
+const renewCooldown = 10 * time.Minute
+
+// revokeAttempts is how many times in a row, revokeRetryDelay apart, the
+// api must refuse the credentials of an identity for it to be taken as
+// revoked, so that a glitch of the api doesn't cost a working identity and
+// the license seat it holds.
+var (
+	revokeAttempts   = 3
+	revokeRetryDelay = 5 * time.Second
+)
+
+// revokedBackupSuffix is appended to the name of a revoked identity, with
+// the time, to keep it aside in the store rather than remove it.
+const revokedBackupSuffix = ".revoked-"
+
+// isRevoked reports whether the api refuses the credentials of ident on
+// every one of revokeAttempts attempts. Any other answer, or error, ends
+// the check.
+func isRevoked(l *slog.Logger, name string, ident warp.Identity) bool {
+	for attempt := 1; ; attempt++ {
+		_, err := warp.GetSourceDevice(ident.Token, ident.ID)
+		switch {
+		case err == nil:
+			return false
+		case !errors.Is(err, warp.ErrRevoked):
+			l.Debug("failed to check identity", "identity", name, "error", err)
+			return false
+		case attempt == revokeAttempts:
+			return true
+		}
+		l.Debug("api refused identity, checking again", "identity", name, "attempt", attempt)
+		time.Sleep(revokeRetryDelay)
+	}
+}
+
+// revokedIdentities returns the names of the identities in store whose
+// credentials the api refuses.
+func revokedIdentities(l *slog.Logger, store warp.IdentityStore) []string {
+	var revoked []string
+	for _, name := range identityNames {
+		ident, err := warp.LoadIdentity(store, name)
+		if err != nil {
+			continue
+		}
+		if isRevoked(l, name, ident) {
+			revoked = append(revoked, name)
+		}
+	}
+	return revoked
+}
+
+// renewIdentities moves the identities the api refuses aside in the store,
+// so that bringing the tunnel up registers new ones, applying the license
+// again if there is one, while the old ones can still be restored by hand.
+// It reports whether any were moved. s.mu must be held.
+func (s *Supervisor) renewIdentities(opts WarpOptions) bool {
+	if opts.WireguardConfig != "" || time.Since(s.renewChecked) < renewCooldown {
+		return false
+	}
+	s.renewChecked = time.Now()
+
+	store := opts.identities()
+	revoked := revokedIdentities(s.l, store)
+	for _, name := range revoked {
+		backup := name + revokedBackupSuffix + time.Now().UTC().Format("20060102T150405")
+		s.l.Warn("identity was revoked, registering a new one", "identity", name, "backup", backup)
+		opts.Audit.Record(actorAuto, "identity_revoked", "identity", name, "backup", backup)
+		if err := warp.MoveIdentity(store, name, backup); err != nil {
+			s.l.Error("failed to move revoked identity aside", "identity", name, "error", err)
+			return false
+		}
+	}
+	return len(revoked) > 0
+}
+
+// watchIdentities brings the tunnel back up with new identities when it
+// stalls because the old ones were revoked, until ctx is done. The server
+// doesn't answer handshakes of a revoked identity, so a stall is the only
+// sign of it on the data path.
+func (s *Supervisor) watchIdentities(ctx context.Context) {
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+
+	healthy := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		nowHealthy := s.health.Healthy()
+		if nowHealthy == healthy {
+			continue
+		}
+		healthy = nowHealthy
+		if healthy || !s.mu.TryLock() {
+			continue
+		}
+
+		if s.renewIdentities(s.opts) {
+			if err := s.restart(s.opts); err != nil {
+				s.l.Warn("failed to bring the tunnel back up with a new identity, it is used from the next start", "error", err)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,109 @@
+package app
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/warp/warptest"
+)
+
+func TestRenewIdentities(t *testing.T) {
+	api := warptest.NewServer()
+	t.Cleanup(api.Close)
+	t.Cleanup(api.Use())
+	delay := revokeRetryDelay
+	revokeRetryDelay = 0
+	t.Cleanup(func() { revokeRetryDelay = delay })
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name    string
+		revoked bool
+		// status answers the first fail checks
+		status, fail int
+		renewed      bool
+	}{
+		{name: "valid"},
+		{name: "forbidden", status: http.StatusForbidden, fail: revokeAttempts},
+		{name: "unauthorized once", status: http.StatusUnauthorized, fail: 1},
+		{name: "unauthorized but the last time", status: http.StatusUnauthorized, fail: revokeAttempts - 1},
+		{name: "unauthorized every time", status: http.StatusUnauthorized, fail: revokeAttempts, renewed: true},
+		{name: "revoked", revoked: true, renewed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := warp.FileStore{Dir: t.TempDir()}
+			ident, err := warp.LoadOrCreateIdentity(l, store, "primary", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.revoked {
+				api.Revoke(ident.ID)
+			}
+			api.Fail(tt.status, tt.fail)
+			t.Cleanup(func() { api.Fail(0, 0) })
+
+			s := NewSupervisor(l, WarpOptions{Identities: store})
+			if got := s.renewIdentities(s.opts); got != tt.renewed {
+				t.Fatalf("renewed %v, want %v", got, tt.renewed)
+			}
+
+			_, err = store.Load("primary")
+			if tt.renewed != os.IsNotExist(err) {
+				t.Fatalf("got %v loading the identity after renewing %v", err, tt.renewed)
+			}
+			entries, err := os.ReadDir(store.Dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var backups []string
+			for _, e := range entries {
+				if strings.HasPrefix(e.Name(), "primary"+revokedBackupSuffix) {
+					backups = append(backups, e.Name())
+				}
+			}
+			if tt.renewed != (len(backups) == 1) {
+				t.Fatalf("got backups %v after renewing %v", backups, tt.renewed)
+			}
+			if tt.renewed {
+				backup, err := store.Load(backups[0])
+				if err != nil || backup.ID != ident.ID || backup.PrivateKey != ident.PrivateKey {
+					t.Fatalf("backup %v does not hold the revoked identity: %v", backups[0], err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadIdentityLicenseRefused(t *testing.T) {
+	api := warptest.NewServer()
+	t.Cleanup(api.Close)
+	t.Cleanup(api.Use())
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	license := api.AddLicense()
+	opts := WarpOptions{Identities: warp.FileStore{Dir: t.TempDir()}, License: license, Events: NewEvents()}
+	var refused []string
+	opts.Events.Subscribe(func(ev Event) {
+		if ev.Type == EventLicenseRefused {
+			refused = append(refused, ev.Identity)
+		}
+	})
+
+	for i := 0; i < warp.MaxDevices; i++ {
+		if _, err := warp.CreateIdentity(l, license); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := loadIdentity(l, opts, "primary"); err != nil {
+		t.Fatal(err)
+	}
+	if len(refused) != 1 || refused[0] != "primary" {
+		t.Fatalf("got license refused events for %v, want primary", refused)
+	}
+}
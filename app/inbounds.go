@@ -0,0 +1,178 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+const chainCheckInterval = 30 * time.Second
+
+// ShadowsocksOptions adds a shadowsocks AEAD inbound next to the socks proxy.
+type ShadowsocksOptions struct {
+	Bind     netip.AddrPort
+	Method   string
+	Password string
+}
+
+// VLESSOptions adds a VLESS inbound next to the socks proxy.
+type VLESSOptions struct {
+	Bind netip.AddrPort
+	IDs  []string
+	// TLS serves the inbound over TLS, if set
+	TLS *TLSOptions
+}
+
+// startInbounds serves the socks proxy, and any extra inbounds, on tnet.
+func startInbounds(ctx context.Context, l *slog.Logger, tnet *netstack.Net, opts WarpOptions) error {
+	if opts.Outbounds != nil {
+		dial := tnet.DialContext
+		if opts.failover != nil {
+			dial = opts.failover.DialContext
+		}
+		unregister, err := opts.Outbounds.Register(opts.outboundTag(), dial)
+		if err != nil {
+			return err
+		}
+		context.AfterFunc(ctx, unregister)
+	}
+
+	proxyOpts := proxyOptions(opts)
+
+	socksOpts := proxyOpts
+	if opts.SocksTLS != nil {
+		opt, err := tlsOption(l, opts.CacheDir, *opts.SocksTLS)
+		if err != nil {
+			return err
+		}
+		socksOpts = append(proxyOptions(opts), opt)
+	}
+	if len(opts.ExtraBinds) > 0 {
+		socksOpts = append(socksOpts, wiresocks.WithExtraBinds(opts.ExtraBinds, opts.SocketMode))
+	}
+	if _, err := wiresocks.StartProxy(ctx, l, tnet, opts.Bind, socksOpts...); err != nil {
+		return err
+	}
+	l.Info("serving proxy", "address", opts.Bind)
+	for _, bind := range opts.ExtraBinds {
+		l.Info("serving proxy", "address", bind)
+	}
+
+	if ss := opts.Shadowsocks; ss != nil {
+		if _, err := wiresocks.StartShadowsocks(ctx, l, tnet, ss.Bind, ss.Method, ss.Password, proxyOpts...); err != nil {
+			return fmt.Errorf("failed to start shadowsocks: %w", err)
+		}
+		l.Info("serving shadowsocks", "address", ss.Bind, "method", ss.Method)
+	}
+
+	if v := opts.VLESS; v != nil {
+		vlessOpts := proxyOpts
+		if v.TLS != nil {
+			opt, err := tlsOption(l, opts.CacheDir, *v.TLS)
+			if err != nil {
+				return err
+			}
+			vlessOpts = append(proxyOptions(opts), opt)
+		}
+		if _, err := wiresocks.StartVLESS(ctx, l, tnet, v.Bind, v.IDs, vlessOpts...); err != nil {
+			return fmt.Errorf("failed to start vless: %w", err)
+		}
+		l.Info("serving vless", "address", v.Bind, "tls", v.TLS != nil)
+	}
+
+	if opts.Chain != nil {
+		l.Info("chaining connections through", "hop", opts.Chain)
+		if !opts.Chain.CarriesUDP() {
+			l.Warn("the chain hop can't carry udp, which leaves the tunnel directly", "hop", opts.Chain)
+		}
+		go wiresocks.MonitorChain(ctx, l, tnet, opts.Chain, chainCheckInterval)
+	}
+
+	return nil
+}
+
+// proxyOptions returns the options shared by every user facing proxy.
+func proxyOptions(opts WarpOptions) []wiresocks.ProxyOption {
+	options := []wiresocks.ProxyOption{
+		wiresocks.WithDirectDomains(opts.DirectDomains),
+		wiresocks.WithConnTracker(opts.Conns),
+		wiresocks.WithBufferSize(relayBufferSize(opts)),
+	}
+
+	if opts.RemoteResolve {
+		options = append(options, wiresocks.WithRemoteResolve())
+	}
+
+	if len(opts.SniffPorts) > 0 {
+		options = append(options, wiresocks.WithSniffPorts(opts.SniffPorts))
+	}
+
+	if opts.UDPNAT != nil {
+		options = append(options, wiresocks.WithUDPNAT(opts.UDPNAT))
+	}
+
+	if opts.STUNPolicy != "" {
+		options = append(options, wiresocks.WithSTUNPolicy(opts.STUNPolicy))
+	}
+
+	if opts.SourceACL != nil {
+		options = append(options, wiresocks.WithSourceACL(opts.SourceACL))
+	}
+
+	if opts.Chain != nil {
+		options = append(options, wiresocks.WithChain(opts.Chain))
+	}
+
+	if opts.Tor != nil {
+		options = append(options, wiresocks.WithTor(opts.Tor.SOCKS, opts.Tor.Domains))
+	}
+
+	if len(opts.Routes) > 0 {
+		options = append(options, wiresocks.WithRoutes(opts.Routes, opts.Outbounds))
+	}
+
+	if opts.failover != nil {
+		options = append(options, wiresocks.WithFailover(opts.failover))
+	}
+
+	if opts.Telemetry != nil {
+		options = append(options, wiresocks.WithPanicHook(opts.Telemetry.RecordPanic))
+	}
+
+	return options
+}
+
+// checkRoutes rejects routing rules naming an outbound that neither the main
+// tunnel nor a listener brings up, or that more than one of them does, and
+// any in psiphon mode, whose proxy is psiphon's own.
+func checkRoutes(opts WarpOptions) error {
+	if len(opts.Routes) > 0 && opts.Psiphon != nil {
+		return errors.New("routes don't apply in psiphon mode, use a psiphon listener and route to it instead")
+	}
+
+	tags := map[string]int{
+		wiresocks.OutboundDirect: 1,
+		wiresocks.OutboundBlock:  1,
+		opts.outboundTag():       1,
+	}
+	for _, listener := range opts.Listeners {
+		tags[listener.outboundTag()]++
+	}
+
+	for _, r := range opts.Routes {
+		switch tags[r.Outbound] {
+		case 0:
+			return fmt.Errorf("route %s: no outbound %q", r, r.Outbound)
+		case 1:
+		default:
+			return fmt.Errorf("route %s: outbound %q is brought up by more than one tunnel", r, r.Outbound)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package app
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+func TestCheckRoutes(t *testing.T) {
+	route := func(s string) []wiresocks.RouteRule {
+		r, err := wiresocks.ParseRouteRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []wiresocks.RouteRule{r}
+	}
+	listeners := func(modes ...string) []Listener {
+		var ls []Listener
+		for _, mode := range modes {
+			l, err := ParseListener("127.0.0.1:9000=" + mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ls = append(ls, l)
+		}
+		return ls
+	}
+
+	tests := []struct {
+		name    string
+		opts    WarpOptions
+		wantErr string
+	}{
+		{name: "main tunnel", opts: WarpOptions{Routes: route("example.com=warp")}},
+		{name: "builtin", opts: WarpOptions{Routes: route("example.com=block")}},
+		{name: "listener", opts: WarpOptions{Routes: route("example.de=psiphon:DE"), Listeners: listeners("psiphon:DE")}},
+		{name: "missing", opts: WarpOptions{Routes: route("example.com=gool")}, wantErr: "no outbound"},
+		{name: "duplicate listeners", opts: WarpOptions{Routes: route("example.com=gool"), Listeners: listeners("gool", "gool")}, wantErr: "more than one tunnel"},
+		{name: "listener like the main tunnel", opts: WarpOptions{Routes: route("example.com=warp"), Listeners: listeners("warp")}, wantErr: "more than one tunnel"},
+		{name: "duplicates not routed to", opts: WarpOptions{Routes: route("example.com=direct"), Listeners: listeners("warp")}},
+		{name: "psiphon mode", opts: WarpOptions{Routes: route("example.com=direct"), Psiphon: &PsiphonOptions{Country: "DE"}}, wantErr: "psiphon mode"},
+		{name: "psiphon mode without routes", opts: WarpOptions{Psiphon: &PsiphonOptions{Country: "DE"}}},
+	}
+	for _, tt := range tests {
+		err := checkRoutes(tt.opts)
+		if (err == nil) != (tt.wantErr == "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: got %v, want error %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
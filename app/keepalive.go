@@ -0,0 +1,170 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/device"
+	"github.com/pion/stun"
+)
+
+const (
+	// defaultKeepalive is the persistent keepalive interval of warp peers
+	defaultKeepalive = 5 * time.Second
+	// stunServer tells a probe socket the address it is mapped to
+	stunServer  = "stun.cloudflare.com:3478"
+	stunTimeout = 3 * time.Second
+	// minAdaptiveKeepalive and maxAdaptiveKeepalive bound the search for
+	// the nat timeout, which stops once it is known within
+	// keepaliveSearchPrecision
+	minAdaptiveKeepalive     = 10 * time.Second
+	maxAdaptiveKeepalive     = 120 * time.Second
+	keepaliveSearchPrecision = 5 * time.Second
+	// keepaliveMargin is the share of the nat timeout used as interval,
+	// leaving room for timer slack
+	keepaliveMargin = 0.9
+)
+
+// keepalive returns the persistent keepalive interval of warp peers in
+// seconds.
+func (opts WarpOptions) keepalive() int {
+	if opts.Keepalive == 0 {
+		return int(defaultKeepalive.Seconds())
+	}
+	return int(opts.Keepalive.Seconds())
+}
+
+// adaptKeepalive measures how long the nat of the network keeps an idle udp
+// mapping and stretches the keepalive interval of peer on dev to just below
+// that, remembering it for the network. It takes a few minutes, during
+// which the current interval stays.
+func adaptKeepalive(ctx context.Context, l *slog.Logger, opts WarpOptions, dev *device.Device, peer string) {
+	l = l.With("subsystem", "keepalive")
+	network := networkFingerprint(ctx)
+
+	l.Info("measuring the nat timeout")
+	timeout, err := natTimeout(ctx, l)
+	if err != nil {
+		if ctx.Err() == nil {
+			l.Warn("failed to measure the nat timeout", "error", err)
+		}
+		return
+	}
+	interval := max(time.Duration(float64(timeout)*keepaliveMargin).Truncate(time.Second), defaultKeepalive)
+
+	request := fmt.Sprintf("public_key=%s\nupdate_only=true\npersistent_keepalive_interval=%d\n", peer, int(interval.Seconds()))
+	if err := dev.IpcSet(request); err != nil {
+		l.Warn("failed to set keepalive interval", "error", err)
+		return
+	}
+	l.Info("settled on keepalive interval", "nat_timeout", timeout, "interval", interval)
+
+	if network == "" {
+		return
+	}
+	profiles := loadNetworkProfiles(l, opts.CacheDir)
+	profiles.update(network, func(p *networkProfile) {
+		p.Keepalive = interval
+	})
+	if err := profiles.save(); err != nil {
+		l.Warn("failed to save network profiles", "error", err)
+	}
+}
+
+// natTimeout binary searches the longest time an idle udp mapping is kept,
+// between minAdaptiveKeepalive and maxAdaptiveKeepalive.
+func natTimeout(ctx context.Context, l *slog.Logger) (time.Duration, error) {
+	lo, hi := minAdaptiveKeepalive, maxAdaptiveKeepalive
+	kept, err := mappingKept(ctx, hi)
+	if err != nil || kept {
+		return hi, err
+	}
+
+	for hi-lo > keepaliveSearchPrecision {
+		mid := (lo + hi) / 2
+		kept, err := mappingKept(ctx, mid)
+		if err != nil {
+			return 0, err
+		}
+		l.Debug("probed nat mapping", "idle", mid, "kept", kept)
+		if kept {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// mappingKept reports whether a udp socket is still mapped to the same
+// public address after being idle for idle.
+func mappingKept(ctx context.Context, idle time.Duration) (bool, error) {
+	server, err := net.ResolveUDPAddr("udp", stunServer)
+	if err != nil {
+		return false, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	before, err := stunMappedAddress(conn, server)
+	if err != nil {
+		return false, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-time.After(idle):
+	}
+
+	after, err := stunMappedAddress(conn, server)
+	if err != nil {
+		return false, err
+	}
+	return before.String() == after.String(), nil
+}
+
+// stunMappedAddress asks server for the public address conn is mapped to.
+func stunMappedAddress(conn *net.UDPConn, server *net.UDPAddr) (net.Addr, error) {
+	req, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(req.Raw, server); err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(stunTimeout)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, err
+		}
+		if !from.IP.Equal(server.IP) || !stun.IsMessage(buf[:n]) {
+			continue
+		}
+
+		resp := &stun.Message{Raw: buf[:n]}
+		if err := resp.Decode(); err != nil {
+			return nil, err
+		}
+		if resp.TransactionID != req.TransactionID {
+			continue
+		}
+		var mapped stun.XORMappedAddress
+		if err := mapped.GetFrom(resp); err != nil {
+			return nil, errors.New("stun response carries no mapped address")
+		}
+		return &net.UDPAddr{IP: mapped.IP, Port: mapped.Port}, nil
+	}
+}
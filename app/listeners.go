@@ -0,0 +1,120 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/bepass-org/warp-plus/psiphon"
+)
+
+// Listener is an extra proxy served from the same process, through a tunnel
+// of its own.
+type Listener struct {
+	Bind netip.AddrPort
+	// Gool and Psiphon select the tunnel like the options of the same name,
+	// plain warp when neither is set
+	Gool    bool
+	Psiphon *PsiphonOptions
+}
+
+// ParseListener parses a listener given as ADDR=MODE, where MODE is warp,
+// gool or psiphon:CC with CC a psiphon country code.
+func ParseListener(s string) (Listener, error) {
+	addr, mode, ok := strings.Cut(s, "=")
+	if !ok {
+		return Listener{}, fmt.Errorf("invalid listener %q: want ADDR=MODE", s)
+	}
+
+	bind, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return Listener{}, fmt.Errorf("invalid listener address: %w", err)
+	}
+
+	gool, psiphonOpts, err := parseMode(mode)
+	if err != nil {
+		return Listener{}, err
+	}
+	return Listener{Bind: bind, Gool: gool, Psiphon: psiphonOpts}, nil
+}
+
+// parseMode parses a tunnel mode, warp, gool or psiphon:CC with CC a
+// psiphon country code, into the options selecting it.
+func parseMode(mode string) (gool bool, psiphonOpts *PsiphonOptions, err error) {
+	switch mode, country, _ := strings.Cut(mode, ":"); mode {
+	case "warp":
+	case "gool":
+		gool = true
+	case "psiphon":
+		country = strings.ToUpper(country)
+		if !slices.Contains(psiphon.Countries, country) {
+			return false, nil, fmt.Errorf("invalid psiphon country %q", country)
+		}
+		psiphonOpts = &PsiphonOptions{Country: country}
+	default:
+		return false, nil, fmt.Errorf("invalid mode %q: want warp, gool or psiphon:CC", mode)
+	}
+	return gool, psiphonOpts, nil
+}
+
+func (l Listener) String() string {
+	return l.Bind.String() + "=" + l.outboundTag()
+}
+
+// outboundTag names the tunnel the listener brings up in routing rules.
+func (l Listener) outboundTag() string {
+	return WarpOptions{Gool: l.Gool, Psiphon: l.Psiphon}.outboundTag()
+}
+
+// startListeners brings up each of opts.Listeners in the background. Every
+// listener registers its own identities under the cache directory, since
+// two tunnels can't share a wireguard key.
+func startListeners(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
+	psiphons := 0
+	if opts.Psiphon != nil {
+		psiphons++
+	}
+	for _, listener := range opts.Listeners {
+		if listener.Psiphon != nil {
+			psiphons++
+		}
+	}
+	// psiphon keeps process wide state
+	if psiphons > 1 {
+		return errors.New("only one listener can use psiphon")
+	}
+
+	for _, listener := range opts.Listeners {
+		lopts := opts
+		lopts.Listeners = nil
+		lopts.Bind = listener.Bind
+		lopts.ExtraBinds = nil
+		lopts.Gool = listener.Gool
+		lopts.Psiphon = listener.Psiphon
+		lopts.Fallback = nil
+		lopts.Bridges = nil
+		lopts.CacheDir = filepath.Join(opts.CacheDir, "listeners", strings.NewReplacer(":", "_", "[", "", "]", "").Replace(listener.Bind.String()))
+		lopts.Identities = nil
+		lopts.WireguardConfig = ""
+		lopts.Tun = false
+		lopts.Sidecar = false
+		lopts.Shadowsocks = nil
+		lopts.VLESS = nil
+		lopts.TrustedNetworks = nil
+		lopts.listener = true
+
+		ll := l.With("listener", listener.Bind)
+		go func() {
+			defer opts.Telemetry.Recover()
+			if err := RunWarp(ctx, ll, lopts); err != nil {
+				ll.Error("listener failed", "error", err)
+			}
+		}()
+	}
+	return nil
+}
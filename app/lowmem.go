@@ -0,0 +1,48 @@
+package app
+
+import (
+	"os"
+	"runtime/debug"
+
+	"github.com/bepass-org/warp-plus/wireguard/device"
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+)
+
+// Low memory profile, sized for 64-128MB routers.
+const (
+	lowMemoryQueueSize     = 128
+	lowMemoryTCPBuffer     = 256 * 1024
+	lowMemoryRelayBuffer   = 32 * 1024
+	lowMemoryScanQueueSize = 4
+	lowMemoryLimit         = 48 << 20
+)
+
+// ApplyLowMemoryProfile shrinks queues, buffers and the Go heap target. It
+// sets globals, so it has to run once, before any device or network stack
+// is created.
+func ApplyLowMemoryProfile(opts *WarpOptions) {
+	device.QueueStagedSize = min(device.QueueStagedSize, lowMemoryQueueSize)
+	device.QueueOutboundSize = lowMemoryQueueSize
+	device.QueueInboundSize = lowMemoryQueueSize
+	device.QueueHandshakeSize = lowMemoryQueueSize
+
+	netstack.TCPMaxBufferSize = lowMemoryTCPBuffer
+
+	if opts.Scan != nil {
+		opts.Scan.QueueSize = lowMemoryScanQueueSize
+	}
+
+	// A soft limit makes the GC work harder instead of letting the heap
+	// grow to twice the live size. One set with GOMEMLIMIT is kept.
+	if os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(lowMemoryLimit)
+	}
+}
+
+// relayBufferSize returns the proxy relay buffer size, zero for the default.
+func relayBufferSize(opts WarpOptions) int {
+	if opts.LowMemory {
+		return lowMemoryRelayBuffer
+	}
+	return 0
+}
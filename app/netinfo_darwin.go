@@ -0,0 +1,90 @@
+package app
+
+import (
+	"errors"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// defaultRoute returns the gateway and interface of the default route.
+func defaultRoute() (netip.Addr, string, error) {
+	out, err := exec.Command("route", "-n", "get", "default").Output()
+	if err != nil {
+		return netip.Addr{}, "", err
+	}
+	var gw netip.Addr
+	var iface string
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "gateway":
+			if gw, err = netip.ParseAddr(strings.TrimSpace(value)); err != nil {
+				return netip.Addr{}, "", err
+			}
+		case "interface":
+			iface = strings.TrimSpace(value)
+		}
+	}
+	if !gw.IsValid() || iface == "" {
+		return netip.Addr{}, "", errors.New("default gateway not found")
+	}
+	return gw, iface, nil
+}
+
+func currentSSID() (string, error) {
+	_, iface, err := defaultRoute()
+	if err != nil {
+		return "", err
+	}
+	out, err := exec.Command("networksetup", "-getairportnetwork", iface).Output()
+	if err != nil {
+		return "", err
+	}
+	_, ssid, ok := strings.Cut(string(out), ": ")
+	if !ok {
+		return "", errors.New("not connected to a wireless network")
+	}
+	return strings.TrimSpace(ssid), nil
+}
+
+func defaultGateway() (netip.Addr, error) {
+	gw, _, err := defaultRoute()
+	return gw, err
+}
+
+func defaultGatewayMAC() (string, error) {
+	gw, err := defaultGateway()
+	if err != nil {
+		return "", err
+	}
+
+	out, err := exec.Command("arp", "-n", gw.String()).Output()
+	if err != nil {
+		return "", err
+	}
+	// ? (192.168.1.1) at aa:b:cc:d:ee:ff on en0 ifscope [ethernet], with
+	// the leading zeros of octets left out
+	fields := strings.Fields(string(out))
+	for i, f := range fields {
+		if f == "at" && i+1 < len(fields) {
+			return normalizeMAC(fields[i+1]), nil
+		}
+	}
+	return "", errors.New("gateway not present in arp table")
+}
+
+func dhcpServer() (netip.Addr, error) {
+	_, iface, err := defaultRoute()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	out, err := exec.Command("ipconfig", "getoption", iface, "server_identifier").Output()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return netip.ParseAddr(strings.TrimSpace(string(out)))
+}
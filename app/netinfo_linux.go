@@ -0,0 +1,132 @@
+package app
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func currentSSID() (string, error) {
+	if out, err := exec.Command("iwgetid", "-r").Output(); err == nil {
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	out, err := exec.Command("nmcli", "-t", "-f", "active,ssid", "dev", "wifi").Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if ssid, ok := strings.CutPrefix(line, "yes:"); ok {
+			return ssid, nil
+		}
+	}
+	return "", errors.New("not connected to a wireless network")
+}
+
+// defaultGateway reads the IPv4 default gateway from /proc/net/route.
+func defaultGateway() (netip.Addr, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], binary.BigEndian.Uint32(raw))
+		return netip.AddrFrom4(b), nil
+	}
+	return netip.Addr{}, errors.New("default gateway not found")
+}
+
+func defaultGatewayMAC() (string, error) {
+	gw, err := defaultGateway()
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] != gw.String() {
+			continue
+		}
+		return strings.ToLower(fields[3]), nil
+	}
+	return "", errors.New("gateway not present in arp table")
+}
+
+// dhcpServer returns the address of the DHCP server that handed out the
+// current lease, asking NetworkManager first and falling back to the lease
+// files of systemd-networkd and dhclient.
+func dhcpServer() (netip.Addr, error) {
+	if out, err := exec.Command("nmcli", "-t", "-f", "DHCP4.OPTION", "dev", "show").Output(); err == nil {
+		// DHCP4.OPTION[3]:dhcp_server_identifier = 192.168.1.1
+		for _, line := range strings.Split(string(out), "\n") {
+			_, option, ok := strings.Cut(line, ":")
+			if !ok {
+				continue
+			}
+			if value, ok := strings.CutPrefix(option, "dhcp_server_identifier = "); ok {
+				return netip.ParseAddr(strings.TrimSpace(value))
+			}
+		}
+	}
+
+	leases, _ := filepath.Glob("/run/systemd/netif/leases/*")
+	for _, lease := range leases {
+		data, err := os.ReadFile(lease)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if value, ok := strings.CutPrefix(line, "SERVER_ADDRESS="); ok {
+				return netip.ParseAddr(strings.TrimSpace(value))
+			}
+		}
+	}
+
+	leases, _ = filepath.Glob("/var/lib/dhcp/*.leases")
+	var server netip.Addr
+	for _, lease := range leases {
+		data, err := os.ReadFile(lease)
+		if err != nil {
+			continue
+		}
+		// the newest lease is the last one in the file
+		for _, line := range strings.Split(string(data), "\n") {
+			value, ok := strings.CutPrefix(strings.TrimSpace(line), "option dhcp-server-identifier ")
+			if !ok {
+				continue
+			}
+			if addr, err := netip.ParseAddr(strings.TrimSuffix(value, ";")); err == nil {
+				server = addr
+			}
+		}
+	}
+	if server.IsValid() {
+		return server, nil
+	}
+	return netip.Addr{}, errors.New("dhcp server not found")
+}
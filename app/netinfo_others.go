@@ -0,0 +1,27 @@
+//go:build !linux && !windows && !darwin
+
+package app
+
+import (
+	"errors"
+	"net/netip"
+	"runtime"
+)
+
+var errNetInfoUnsupported = errors.New("network detection is not supported on " + runtime.GOOS)
+
+func currentSSID() (string, error) {
+	return "", errNetInfoUnsupported
+}
+
+func defaultGateway() (netip.Addr, error) {
+	return netip.Addr{}, errNetInfoUnsupported
+}
+
+func defaultGatewayMAC() (string, error) {
+	return "", errNetInfoUnsupported
+}
+
+func dhcpServer() (netip.Addr, error) {
+	return netip.Addr{}, errNetInfoUnsupported
+}
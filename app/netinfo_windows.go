@@ -0,0 +1,82 @@
+package app
+
+import (
+	"errors"
+	"net/netip"
+	"os/exec"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+func currentSSID() (string, error) {
+	out, err := exec.Command("netsh", "wlan", "show", "interfaces").Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(key) != "SSID" {
+			continue
+		}
+		return strings.TrimSpace(value), nil
+	}
+	return "", errors.New("not connected to a wireless network")
+}
+
+func defaultGateway() (netip.Addr, error) {
+	interfaces, err := winipcfg.GetAdaptersAddresses(family4, winipcfg.GAAFlagIncludeGateways)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	for _, ifaceM := range interfaces {
+		if ifaceM.OperStatus != winipcfg.IfOperStatusUp || ifaceM.FriendlyName() == "warp0" {
+			continue
+		}
+		for gw := ifaceM.FirstGatewayAddress; gw != nil; gw = gw.Next {
+			if addr, ok := netip.AddrFromSlice(gw.Address.IP()); ok {
+				return addr.Unmap(), nil
+			}
+		}
+	}
+	return netip.Addr{}, errors.New("default gateway not found")
+}
+
+func defaultGatewayMAC() (string, error) {
+	gw, err := defaultGateway()
+	if err != nil {
+		return "", err
+	}
+
+	out, err := exec.Command("arp", "-a", gw.String()).Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != gw.String() {
+			continue
+		}
+		return strings.ToLower(strings.ReplaceAll(fields[1], "-", ":")), nil
+	}
+	return "", errors.New("gateway not present in arp table")
+}
+
+func dhcpServer() (netip.Addr, error) {
+	interfaces, err := winipcfg.GetAdaptersAddresses(family4, winipcfg.GAAFlagIncludeGateways)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	for _, ifaceM := range interfaces {
+		if ifaceM.OperStatus != winipcfg.IfOperStatusUp || ifaceM.FriendlyName() == "warp0" || ifaceM.FirstGatewayAddress == nil {
+			continue
+		}
+		if ifaceM.DHCPv4Server.Sockaddr == nil {
+			continue
+		}
+		if addr, ok := netip.AddrFromSlice(ifaceM.DHCPv4Server.IP()); ok {
+			return addr.Unmap(), nil
+		}
+	}
+	return netip.Addr{}, errors.New("dhcp server not found")
+}
@@ -0,0 +1,89 @@
+package app
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const networkProfilesFile = "network-profiles.json"
+
+// networkProfile holds the settings learned for a single network.
+type networkProfile struct {
+	// Endpoint is the last endpoint that connected successfully
+	Endpoint string `json:"endpoint,omitempty"`
+	// MTU overrides the tunnel mtu, zero keeps the default
+	MTU int `json:"mtu,omitempty"`
+	// Keepalive is the keepalive interval settled on by adaptKeepalive
+	Keepalive time.Duration `json:"keepalive,omitempty"`
+	// Transports counts how often each transport of the fallback chain
+	// came up
+	Transports map[string]transportRecord `json:"transports,omitempty"`
+	LastSeen   time.Time                  `json:"last_seen"`
+}
+
+// networkProfiles persists per-network preferences keyed by network
+// fingerprint so they can be applied automatically on reconnect.
+type networkProfiles struct {
+	mu       sync.Mutex
+	path     string
+	Networks map[string]*networkProfile `json:"networks"`
+}
+
+func loadNetworkProfiles(l *slog.Logger, cacheDir string) *networkProfiles {
+	p := &networkProfiles{
+		path:     filepath.Join(cacheDir, networkProfilesFile),
+		Networks: make(map[string]*networkProfile),
+	}
+
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return p
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		l.Warn("ignoring corrupt network profiles", "path", p.path, "error", err)
+		p.Networks = make(map[string]*networkProfile)
+	}
+	return p
+}
+
+func (p *networkProfiles) get(network string) (networkProfile, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	profile, ok := p.Networks[network]
+	if !ok {
+		return networkProfile{}, false
+	}
+	return *profile, true
+}
+
+func (p *networkProfiles) update(network string, f func(*networkProfile)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	profile, ok := p.Networks[network]
+	if !ok {
+		profile = &networkProfile{}
+		p.Networks[network] = profile
+	}
+	f(profile)
+	profile.LastSeen = time.Now()
+}
+
+func (p *networkProfiles) save() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(p.path, data, 0o644)
+}
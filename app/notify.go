@@ -0,0 +1,52 @@
+package app
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/bepass-org/warp-plus/i18n"
+)
+
+// notifyTimeout bounds showing a single notification.
+const notifyTimeout = 10 * time.Second
+
+// NotifyEvents shows a desktop notification for each event. It fails when
+// not running in a desktop session that can show them.
+func NotifyEvents(l *slog.Logger, events *Events) error {
+	if err := checkDesktopSession(); err != nil {
+		return err
+	}
+
+	events.Subscribe(func(ev Event) {
+		title, body := notification(ev)
+		if title == "" {
+			return
+		}
+		go func() {
+			if err := notify(title, body); err != nil {
+				l.Debug("failed to show notification", "error", err)
+			}
+		}()
+	})
+	return nil
+}
+
+// notification returns the text shown for ev, none for events not worth
+// interrupting the user for.
+func notification(ev Event) (title, body string) {
+	switch ev.Type {
+	case EventUp:
+		return i18n.T("Connected"), i18n.T("The tunnel is up in %s mode.", ev.Mode)
+	case EventDown:
+		return i18n.T("Disconnected"), i18n.T("The tunnel is down.")
+	case EventStalled:
+		return i18n.T("Connection stalled"), i18n.T("Handshakes stopped completing, traffic is not getting through.")
+	case EventRecovered:
+		return i18n.T("Connection recovered"), i18n.T("Handshakes are completing again.")
+	case EventQuotaLow:
+		return i18n.T("WARP+ data running low"), i18n.T("%.2f GiB of WARP+ data left.", float64(ev.QuotaRemaining)/(1<<30))
+	case EventLicenseRefused:
+		return i18n.T("WARP+ license not applied"), i18n.T("The license is bound to too many devices, running on a free account. Remove a stale one with warp-plus devices remove.")
+	}
+	return "", ""
+}
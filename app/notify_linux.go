@@ -0,0 +1,27 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+)
+
+func checkDesktopSession() error {
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return errors.New("no desktop session bus, notifications need to run as the logged in user")
+	}
+	if _, err := exec.LookPath("notify-send"); err != nil {
+		return errors.New("notify-send not found")
+	}
+	return nil
+}
+
+// notify shows a notification through the freedesktop notification
+// service on the session bus.
+func notify(title, body string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	return exec.CommandContext(ctx, "notify-send", "--app-name=warp-plus", title, body).Run()
+}
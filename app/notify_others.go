@@ -0,0 +1,32 @@
+//go:build !windows && !linux
+
+package app
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// notifyScript shows a notification with the text passed in the
+// environment, which spares quoting it.
+const notifyScript = `display notification (system attribute "NOTIFICATION_BODY") with title (system attribute "NOTIFICATION_TITLE")`
+
+func checkDesktopSession() error {
+	if runtime.GOOS != "darwin" {
+		return errors.New("notifications are not supported on " + runtime.GOOS)
+	}
+	return nil
+}
+
+// notify shows a notification in the notification center.
+func notify(title, body string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "osascript", "-e", notifyScript)
+	cmd.Env = append(os.Environ(), "NOTIFICATION_TITLE="+title, "NOTIFICATION_BODY="+body)
+	return cmd.Run()
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// powershellAppID is the app user model id of PowerShell, toasts from ids
+// without a start menu shortcut are dropped.
+const powershellAppID = `{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe`
+
+// toastScript shows a toast with the text passed in the environment, which
+// spares quoting it.
+const toastScript = `
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$t = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$x = $t.GetElementsByTagName('text')
+$x.Item(0).AppendChild($t.CreateTextNode($env:NOTIFICATION_TITLE)) > $null
+$x.Item(1).AppendChild($t.CreateTextNode($env:NOTIFICATION_BODY)) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($env:NOTIFICATION_APP_ID).Show([Windows.UI.Notifications.ToastNotification]::new($t))
+`
+
+func checkDesktopSession() error {
+	var session uint32
+	if err := windows.ProcessIdToSessionId(windows.GetCurrentProcessId(), &session); err != nil {
+		return err
+	}
+	// Services run in session 0, which has no desktop
+	if session == 0 {
+		return errors.New("not running in a user session, notifications need to run as the logged in user")
+	}
+	return nil
+}
+
+// notify shows a toast notification.
+func notify(title, body string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", toastScript)
+	cmd.Env = append(os.Environ(),
+		"NOTIFICATION_TITLE="+title,
+		"NOTIFICATION_BODY="+body,
+		"NOTIFICATION_APP_ID="+powershellAppID,
+	)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	return cmd.Run()
+}
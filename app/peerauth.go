@@ -0,0 +1,312 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/device"
+)
+
+// ParsePeerAuthorizer returns the authorizer of unknown wireguard peers at
+// uri, either a webhook or a radius server:
+//
+//	http(s)://...                 POSTed the key and endpoint of the peer, see webhookAuthorizer
+//	radius://SECRET@HOST[:PORT]   sent an Access-Request, see radiusAuthorizer
+func ParsePeerAuthorizer(uri string) (device.PeerAuthorizer, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return webhookAuthorizer(u.String()), nil
+	case "radius":
+		secret, _ := u.User.Password()
+		if secret == "" {
+			secret = u.User.Username()
+		}
+		if secret == "" || u.Hostname() == "" {
+			return nil, errors.New("radius authorizer needs radius://SECRET@HOST[:PORT]")
+		}
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "1812")
+		}
+		return radiusAuthorizer(addr, secret), nil
+	default:
+		return nil, fmt.Errorf("unsupported peer authorizer %q", u.Scheme)
+	}
+}
+
+// webhookRequest is POSTed to a webhook authorizer about a peer.
+type webhookRequest struct {
+	PublicKey string `json:"public_key"`
+	Endpoint  string `json:"endpoint"`
+}
+
+// webhookResponse is what a webhook authorizer allows the peer.
+type webhookResponse struct {
+	AllowedIPs   []netip.Prefix `json:"allowed_ips"`
+	PresharedKey string         `json:"preshared_key"`
+}
+
+// webhookAuthorizer POSTs the base64 public key and the endpoint of peers
+// as JSON to uri, which allows them by answering 200 with their allowed ips
+// and optionally a base64 preshared key, and denies them with 403.
+// Credentials in uri are sent as basic auth.
+func webhookAuthorizer(uri string) device.PeerAuthorizer {
+	return func(ctx context.Context, pk device.NoisePublicKey, endpoint string) (*device.PeerAuthorization, error) {
+		body, err := json.Marshal(webhookRequest{PublicKey: base64.StdEncoding.EncodeToString(pk[:]), Endpoint: endpoint})
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusForbidden:
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("peer authorizer answered %s", resp.Status)
+		}
+
+		var allowed webhookResponse
+		if err := json.NewDecoder(resp.Body).Decode(&allowed); err != nil {
+			return nil, err
+		}
+		auth := &device.PeerAuthorization{AllowedIPs: allowed.AllowedIPs}
+		if allowed.PresharedKey != "" {
+			psk, err := base64.StdEncoding.DecodeString(allowed.PresharedKey)
+			if err != nil || len(psk) != len(auth.PresharedKey) {
+				return nil, errors.New("peer authorizer answered an invalid preshared key")
+			}
+			copy(auth.PresharedKey[:], psk)
+		}
+		return auth, nil
+	}
+}
+
+// RADIUS codes and attributes, RFC 2865, 3162 and 6911
+const (
+	radiusAccessRequest = 1
+	radiusAccessAccept  = 2
+	radiusAccessReject  = 3
+
+	radiusUserName             = 1
+	radiusUserPassword         = 2
+	radiusFramedIPAddress      = 8
+	radiusCallingStationID     = 31
+	radiusNASIdentifier        = 32
+	radiusMessageAuthenticator = 80
+	radiusFramedIPv6Prefix     = 97
+	radiusFramedIPv6Address    = 168
+
+	// radiusRetransmit is how often an unanswered request is sent again
+	radiusRetransmit = time.Second
+)
+
+// radiusAuthorizer sends an Access-Request for peers to the radius server
+// at addr, with the base64 public key as both the user name and the
+// password and the endpoint as the calling station. Access-Accept allows
+// the peer the Framed-IP-Address, Framed-IPv6-Prefix and
+// Framed-IPv6-Address in it. Responses without a valid
+// Message-Authenticator are ignored.
+func radiusAuthorizer(addr, secret string) device.PeerAuthorizer {
+	return func(ctx context.Context, pk device.NoisePublicKey, endpoint string) (*device.PeerAuthorization, error) {
+		user := base64.StdEncoding.EncodeToString(pk[:])
+		req, authenticator, err := radiusRequest(secret, user, endpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = c.SetDeadline(deadline)
+		}
+
+		buf := make([]byte, 4096)
+		for {
+			if _, err := c.Write(req); err != nil {
+				return nil, err
+			}
+			_ = c.SetReadDeadline(time.Now().Add(radiusRetransmit))
+			n, err := c.Read(buf)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && ctx.Err() == nil {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			resp := buf[:n]
+			if !radiusValidResponse(resp, req[1], authenticator, secret) {
+				continue
+			}
+			switch resp[0] {
+			case radiusAccessAccept:
+				return &device.PeerAuthorization{AllowedIPs: radiusFramedPrefixes(resp[20:])}, nil
+			case radiusAccessReject:
+				return nil, nil
+			default:
+				return nil, fmt.Errorf("radius server answered code %d", resp[0])
+			}
+		}
+	}
+}
+
+// radiusRequest returns an Access-Request for user with its password set
+// to user too, and its request authenticator.
+func radiusRequest(secret, user, endpoint string) ([]byte, [16]byte, error) {
+	var authenticator [16]byte
+	var id [1]byte
+	if _, err := rand.Read(authenticator[:]); err != nil {
+		return nil, authenticator, err
+	}
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, authenticator, err
+	}
+
+	// The password is padded to 16 bytes and hidden by a chain of md5
+	// hashes of the secret
+	password := make([]byte, (len(user)+15)/16*16)
+	copy(password, user)
+	prev := authenticator[:]
+	for i := 0; i < len(password); i += 16 {
+		h := md5.Sum(append([]byte(secret), prev...))
+		for j := range h {
+			password[i+j] ^= h[j]
+		}
+		prev = password[i : i+16]
+	}
+
+	pkt := []byte{radiusAccessRequest, id[0], 0, 0}
+	pkt = append(pkt, authenticator[:]...)
+	// The Message-Authenticator goes first, so it is found at a fixed
+	// offset and filled in once the packet is complete
+	pkt = append(pkt, radiusMessageAuthenticator, 18)
+	pkt = append(pkt, make([]byte, 16)...)
+	for _, attr := range []struct {
+		typ   byte
+		value []byte
+	}{
+		{radiusUserName, []byte(user)},
+		{radiusUserPassword, password},
+		{radiusCallingStationID, []byte(endpoint)},
+		{radiusNASIdentifier, []byte("warp-plus")},
+	} {
+		if len(attr.value) > 253 {
+			return nil, authenticator, fmt.Errorf("radius attribute %d is too long", attr.typ)
+		}
+		pkt = append(pkt, attr.typ, byte(len(attr.value)+2))
+		pkt = append(pkt, attr.value...)
+	}
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write(pkt)
+	copy(pkt[22:38], mac.Sum(nil))
+	return pkt, authenticator, nil
+}
+
+// radiusValidResponse reports whether resp answers the request with id and
+// authenticator, as signed with secret. The Message-Authenticator is
+// required, RFC 3579 3.2, as the md5 response authenticator alone can be
+// forged by an attacker on the path, CVE-2024-3596 (BlastRADIUS).
+func radiusValidResponse(resp []byte, id byte, authenticator [16]byte, secret string) bool {
+	if len(resp) < 20 || resp[1] != id || int(binary.BigEndian.Uint16(resp[2:])) != len(resp) {
+		return false
+	}
+	h := md5.New()
+	h.Write(resp[:4])
+	h.Write(authenticator[:])
+	h.Write(resp[20:])
+	h.Write([]byte(secret))
+	if !hmac.Equal(h.Sum(nil), resp[4:20]) {
+		return false
+	}
+
+	offset, n := radiusAttribute(resp[20:], radiusMessageAuthenticator)
+	if offset < 0 || n != 16 {
+		return false
+	}
+	offset += 20
+	// Computed over the response with the request authenticator in place
+	// of its own and the Message-Authenticator zeroed
+	signed := bytes.Clone(resp)
+	copy(signed[4:20], authenticator[:])
+	clear(signed[offset : offset+16])
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write(signed)
+	return hmac.Equal(mac.Sum(nil), resp[offset:offset+16])
+}
+
+// radiusAttribute returns the offset in attrs of the value of the first
+// attribute of typ and its length, or -1 if there is none.
+func radiusAttribute(attrs []byte, typ byte) (int, int) {
+	for offset := 0; offset+2 <= len(attrs); {
+		n := int(attrs[offset+1])
+		if n < 2 || offset+n > len(attrs) {
+			return -1, 0
+		}
+		if attrs[offset] == typ {
+			return offset + 2, n - 2
+		}
+		offset += n
+	}
+	return -1, 0
+}
+
+// radiusFramedPrefixes returns the addresses framed by the attributes of
+// an Access-Accept.
+func radiusFramedPrefixes(attrs []byte) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for len(attrs) >= 2 {
+		typ, n := attrs[0], int(attrs[1])
+		if n < 2 || n > len(attrs) {
+			break
+		}
+		value := attrs[2:n]
+		attrs = attrs[n:]
+
+		switch {
+		case typ == radiusFramedIPAddress && len(value) == 4:
+			prefixes = append(prefixes, netip.PrefixFrom(netip.AddrFrom4([4]byte(value)), 32))
+		case typ == radiusFramedIPv6Address && len(value) == 16:
+			prefixes = append(prefixes, netip.PrefixFrom(netip.AddrFrom16([16]byte(value)), 128))
+		case typ == radiusFramedIPv6Prefix && len(value) >= 2 && int(value[1]) <= 128:
+			var addr [16]byte
+			copy(addr[:], value[2:])
+			if p, err := netip.AddrFrom16(addr).Prefix(int(value[1])); err == nil {
+				prefixes = append(prefixes, p)
+			}
+		}
+	}
+	return prefixes
+}
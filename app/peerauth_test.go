@@ -0,0 +1,183 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/device"
+)
+
+const testRadiusSecret = "s3cret"
+
+// radiusTestResponse returns a response of code to the request with id
+// and authenticator carrying attrs, signed with secret, with a
+// Message-Authenticator first if withMA is set.
+func radiusTestResponse(code, id byte, authenticator [16]byte, secret string, attrs []byte, withMA bool) []byte {
+	pkt := []byte{code, id, 0, 0}
+	pkt = append(pkt, authenticator[:]...)
+	if withMA {
+		pkt = append(pkt, radiusMessageAuthenticator, 18)
+		pkt = append(pkt, make([]byte, 16)...)
+	}
+	pkt = append(pkt, attrs...)
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+
+	if withMA {
+		mac := hmac.New(md5.New, []byte(secret))
+		mac.Write(pkt)
+		copy(pkt[22:38], mac.Sum(nil))
+	}
+	h := md5.New()
+	h.Write(pkt)
+	h.Write([]byte(secret))
+	copy(pkt[4:20], h.Sum(nil))
+	return pkt
+}
+
+func TestRadiusRequest(t *testing.T) {
+	const user = "hwKzgIBnYsGx1Zmyp0oX0t8PmKm4a8XQHuKMFbnYIX8="
+	req, authenticator, err := radiusRequest(testRadiusSecret, user, "192.0.2.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req[0] != radiusAccessRequest || int(binary.BigEndian.Uint16(req[2:])) != len(req) || !bytes.Equal(req[4:20], authenticator[:]) {
+		t.Fatalf("malformed header % x", req[:20])
+	}
+
+	offset, n := radiusAttribute(req[20:], radiusMessageAuthenticator)
+	if offset < 0 || n != 16 {
+		t.Fatal("no Message-Authenticator")
+	}
+	offset += 20
+	signed := bytes.Clone(req)
+	clear(signed[offset : offset+16])
+	mac := hmac.New(md5.New, []byte(testRadiusSecret))
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), req[offset:offset+16]) {
+		t.Fatal("invalid Message-Authenticator")
+	}
+
+	value := func(typ byte) []byte {
+		offset, n := radiusAttribute(req[20:], typ)
+		if offset < 0 {
+			t.Fatalf("no attribute %d", typ)
+		}
+		return req[20+offset : 20+offset+n]
+	}
+	if got := string(value(radiusUserName)); got != user {
+		t.Fatalf("got user name %q, want %q", got, user)
+	}
+	if got := string(value(radiusCallingStationID)); got != "192.0.2.1:51820" {
+		t.Fatalf("got calling station %q", got)
+	}
+
+	// RFC 2865 5.2
+	hidden := value(radiusUserPassword)
+	password := make([]byte, len(hidden))
+	prev := authenticator[:]
+	for i := 0; i < len(hidden); i += 16 {
+		h := md5.Sum(append([]byte(testRadiusSecret), prev...))
+		for j := range h {
+			password[i+j] = hidden[i+j] ^ h[j]
+		}
+		prev = hidden[i : i+16]
+	}
+	if got := string(bytes.TrimRight(password, "\x00")); got != user {
+		t.Fatalf("got password %q, want %q", got, user)
+	}
+}
+
+func TestRadiusValidResponse(t *testing.T) {
+	var authenticator [16]byte
+	copy(authenticator[:], "0123456789abcdef")
+	framed := []byte{radiusFramedIPAddress, 6, 10, 0, 0, 2}
+	valid := radiusTestResponse(radiusAccessAccept, 7, authenticator, testRadiusSecret, framed, true)
+
+	tamper := func(b []byte, i int) []byte {
+		b = bytes.Clone(b)
+		b[i] ^= 1
+		return b
+	}
+	tests := []struct {
+		name string
+		resp []byte
+		want bool
+	}{
+		{"valid", valid, true},
+		{"no Message-Authenticator", radiusTestResponse(radiusAccessAccept, 7, authenticator, testRadiusSecret, framed, false), false},
+		{"tampered Message-Authenticator", tamper(valid, 25), false},
+		{"tampered attribute", tamper(valid, len(valid)-1), false},
+		{"other secret", radiusTestResponse(radiusAccessAccept, 7, authenticator, "other", framed, true), false},
+		{"other id", radiusTestResponse(radiusAccessAccept, 8, authenticator, testRadiusSecret, framed, true), false},
+		{"truncated", valid[:len(valid)-1], false},
+		{"short", valid[:19], false},
+	}
+	for _, tt := range tests {
+		if got := radiusValidResponse(tt.resp, 7, authenticator, testRadiusSecret); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRadiusFramedPrefixes(t *testing.T) {
+	attrs := []byte{radiusFramedIPAddress, 6, 10, 0, 0, 2}
+	attrs = append(attrs, radiusFramedIPv6Address, 18)
+	attrs = append(attrs, netip.MustParseAddr("fd00::2").AsSlice()...)
+	attrs = append(attrs, radiusFramedIPv6Prefix, 12, 0, 64, 0x20, 0x01, 0x0d, 0xb8, 0, 1, 0, 0)
+	// Malformed ones are skipped
+	attrs = append(attrs, radiusFramedIPAddress, 4, 10, 0)
+	attrs = append(attrs, radiusFramedIPv6Prefix, 4, 0, 200)
+
+	want := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.2/32"),
+		netip.MustParsePrefix("fd00::2/128"),
+		netip.MustParsePrefix("2001:db8:1::/64"),
+	}
+	if got := radiusFramedPrefixes(attrs); !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got := radiusFramedPrefixes([]byte{radiusFramedIPAddress, 40, 10}); len(got) != 0 {
+		t.Fatalf("got %v from a truncated attribute", got)
+	}
+}
+
+func TestRadiusAuthorizer(t *testing.T) {
+	for _, withMA := range []bool{true, false} {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		go func() {
+			buf := make([]byte, 4096)
+			for {
+				n, addr, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				req := buf[:n]
+				resp := radiusTestResponse(radiusAccessAccept, req[1], [16]byte(req[4:20]), testRadiusSecret, []byte{radiusFramedIPAddress, 6, 10, 0, 0, 2}, withMA)
+				_, _ = pc.WriteTo(resp, addr)
+			}
+		}()
+
+		authorize := radiusAuthorizer(pc.LocalAddr().String(), testRadiusSecret)
+		ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+		auth, err := authorize(ctx, device.NoisePublicKey{1}, "192.0.2.1:51820")
+		cancel()
+		switch {
+		case withMA && (err != nil || auth == nil || !slices.Equal(auth.AllowedIPs, []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32")})):
+			t.Fatalf("got %+v, %v from an accepting server", auth, err)
+		case !withMA && (err == nil || auth != nil):
+			t.Fatalf("got %+v, %v from a server without Message-Authenticator, want an error", auth, err)
+		}
+	}
+}
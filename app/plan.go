@@ -0,0 +1,154 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+)
+
+// Plan is how RunWarp would bring the tunnel up with some options on the
+// current network, worked out from what is cached without connecting.
+type Plan struct {
+	// Mode is the outbound serving the proxy, or dns-only
+	Mode string
+	Tun  bool
+	// Network is the fingerprint of the current network, empty if it
+	// couldn't be told
+	Network string
+	// Endpoint is the first endpoint tried, and EndpointSource how it was
+	// picked, one of the PlanEndpoint constants. Endpoint is empty for
+	// random endpoints, which are only picked when connecting. Scan
+	// replaces it with the best scanned endpoints.
+	Endpoint       string
+	EndpointSource string
+	Scan           bool
+	MTU            int
+	Keepalive      time.Duration
+	// Transports are tried in this order until one comes up, or all at
+	// once if Race is set
+	Transports []string
+	Race       bool
+	Identities []PlannedIdentity
+}
+
+const (
+	PlanEndpointGiven      = "given"
+	PlanEndpointRemembered = "remembered"
+	PlanEndpointRandom     = "random"
+)
+
+// PlannedIdentity is a warp identity the tunnel would use.
+type PlannedIdentity struct {
+	Name string
+	// Cached is false for identities that would be registered first
+	Cached      bool
+	DeviceID    string
+	AccountType string
+}
+
+// PlanWarp returns how RunWarp would bring the tunnel up with opts.
+func PlanWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) Plan {
+	plan := Plan{Mode: opts.outboundTag(), Tun: opts.Tun || opts.Sidecar}
+	if opts.DNSOnly != nil {
+		plan.Mode = "dns-only"
+		return plan
+	}
+	if opts.WireguardConfig != "" {
+		plan.Transports = []string{"wireguard"}
+		return plan
+	}
+
+	plan.Network = networkFingerprint(ctx)
+	blocklist := loadEndpointBlocklist(l, opts.CacheDir)
+	profiles := loadNetworkProfiles(l, opts.CacheDir)
+	profile, ok := profiles.get(plan.Network)
+	ok = ok && plan.Network != ""
+
+	switch {
+	case opts.Endpoint != "":
+		plan.Endpoint, plan.EndpointSource = opts.Endpoint, PlanEndpointGiven
+	case ok && profile.Endpoint != "" && !blocklist.blocked(plan.Network, profile.Endpoint):
+		plan.Endpoint, plan.EndpointSource = profile.Endpoint, PlanEndpointRemembered
+	default:
+		plan.EndpointSource = PlanEndpointRandom
+	}
+	plan.Scan = opts.Scan != nil
+
+	if opts.MTU == 0 && ok && profile.MTU != 0 {
+		opts.MTU = profile.MTU
+	}
+	plan.MTU = opts.mtu()
+	if opts.AdaptiveKeepalive && ok && profile.Keepalive != 0 {
+		opts.Keepalive = profile.Keepalive
+	}
+	plan.Keepalive = time.Duration(opts.keepalive()) * time.Second
+
+	switch {
+	case opts.racing():
+		plan.Race = true
+		plan.Transports = []string{"warp"}
+		if opts.Scan != nil {
+			plan.Transports = append(plan.Transports, "warp (best scanned)")
+		}
+		if opts.Masque != "" {
+			plan.Transports = append(plan.Transports, "masque "+RedactURL(opts.Masque))
+		}
+	case len(opts.Fallback) > 0:
+		plan.Transports = orderTransports(opts.Fallback, profile.Transports)
+	case opts.Bridges != nil:
+		for _, b := range opts.Bridges.ordered() {
+			plan.Transports = append(plan.Transports, "bridge "+RedactURL(b.String()))
+		}
+	case opts.Masque != "":
+		plan.Transports = []string{"masque " + RedactURL(opts.Masque)}
+	default:
+		plan.Transports = []string{plan.Mode}
+	}
+
+	names := identityNames[:1]
+	if opts.Gool || opts.Standby || slices.Contains(opts.Fallback, "gool") {
+		names = identityNames[:2]
+	}
+	// A failback brings the earlier transport up with identities of its own
+	if canFailback(opts) {
+		names = slices.Clip(names)
+		for _, name := range names {
+			names = append(names, failbackPrefix+name)
+		}
+	}
+	for _, name := range names {
+		pi := PlannedIdentity{Name: name}
+		ident, err := warp.LoadIdentity(opts.identities(), name)
+		switch {
+		case err == nil:
+			pi.Cached, pi.DeviceID, pi.AccountType = true, ident.ID, ident.Account.AccountType
+		case !errors.Is(err, os.ErrNotExist):
+			l.Warn("failed to load identity", "identity", name, "error", err)
+		}
+		plan.Identities = append(plan.Identities, pi)
+	}
+	return plan
+}
+
+// RedactURL hides the credentials of u, if it is a url with any.
+func RedactURL(u string) string {
+	scheme, rest, ok := strings.Cut(u, "://")
+	if !ok {
+		return u
+	}
+	end := strings.IndexAny(rest, "/?#")
+	if end < 0 {
+		end = len(rest)
+	}
+	at := strings.LastIndex(rest[:end], "@")
+	if at < 0 {
+		return u
+	}
+	return scheme + "://REDACTED@" + rest[at+1:]
+}
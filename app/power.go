@@ -0,0 +1,255 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/control"
+	"github.com/bepass-org/warp-plus/wireguard/device"
+)
+
+const (
+	// powerCheckInterval is how often the power source is detected, and
+	// the battery keepalive applied to tunnels that came up since
+	powerCheckInterval = 30 * time.Second
+	// batteryKeepalive is the shortest keepalive interval on battery
+	batteryKeepalive = 25 * time.Second
+	// batteryWorkers bounds the crypto workers of each tunnel brought up
+	// on battery
+	batteryWorkers = 2
+	// scoreRefreshInterval is how often the endpoint scores are refreshed
+	// in the background on ac power, when scanning is enabled
+	scoreRefreshInterval = 30 * time.Minute
+)
+
+// Power tunes the tunnel for the power source, detected or hinted. On
+// battery keepalives are sent less often, fewer crypto workers are started
+// and endpoint scores aren't refreshed in the background. A nil Power keeps
+// the tunnel tuned for ac power.
+type Power struct {
+	mu sync.Mutex
+	// hint overrides detection, empty when detecting
+	hint   string
+	source string
+	wake   chan struct{}
+	// raised holds the keepalive intervals of the peers raised on battery,
+	// by device and public key
+	raised map[*device.Device]map[string]int
+}
+
+// NewPower returns a Power following hint, control.PowerAuto detects the
+// source.
+func NewPower(hint string) (*Power, error) {
+	p := &Power{wake: make(chan struct{}, 1), raised: make(map[*device.Device]map[string]int)}
+	if err := p.setHint(hint); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Power) setHint(hint string) error {
+	switch hint {
+	case control.PowerAuto:
+		hint = ""
+	case control.PowerAC, control.PowerBattery:
+	default:
+		return fmt.Errorf("unknown power source %q, expected ac, battery or auto", hint)
+	}
+
+	p.mu.Lock()
+	p.hint = hint
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// detect returns the hinted or detected power source.
+func (p *Power) detect() (string, error) {
+	p.mu.Lock()
+	hint := p.hint
+	p.mu.Unlock()
+	if hint != "" {
+		return hint, nil
+	}
+
+	battery, err := onBattery()
+	if err != nil {
+		return control.PowerAC, err
+	}
+	if battery {
+		return control.PowerBattery, nil
+	}
+	return control.PowerAC, nil
+}
+
+func (p *Power) status() control.PowerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return control.PowerStatus{Source: p.source, Hinted: p.hint != ""}
+}
+
+// tuneKeepalives raises the keepalive interval of the peers of devs to
+// batteryKeepalive on battery, and puts them back on ac power.
+func (p *Power) tuneKeepalives(devs []*device.Device, battery bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var errs []error
+	current := make(map[*device.Device]bool, len(devs))
+	for _, dev := range devs {
+		current[dev] = true
+		raised := p.raised[dev]
+
+		if !battery {
+			for peer, secs := range raised {
+				errs = append(errs, setKeepalive(dev, peer, secs))
+			}
+			continue
+		}
+
+		for peer, secs := range peerKeepalives(dev) {
+			if _, ok := raised[peer]; ok || secs == 0 || secs >= int(batteryKeepalive.Seconds()) {
+				continue
+			}
+			if err := setKeepalive(dev, peer, int(batteryKeepalive.Seconds())); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if raised == nil {
+				raised = make(map[string]int)
+				p.raised[dev] = raised
+			}
+			raised[peer] = secs
+		}
+	}
+
+	// Forget devices that went down, and all of them once back on ac
+	for dev := range p.raised {
+		if !battery || !current[dev] {
+			delete(p.raised, dev)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// peerKeepalives returns the keepalive intervals of dev's peers in seconds,
+// by hex public key.
+func peerKeepalives(dev *device.Device) map[string]int {
+	get, err := dev.IpcGet()
+	if err != nil {
+		return nil
+	}
+
+	keepalives := make(map[string]int)
+	var peer string
+	scanner := bufio.NewScanner(strings.NewReader(get))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "public_key":
+			peer = value
+		case "persistent_keepalive_interval":
+			if peer != "" {
+				keepalives[peer], _ = strconv.Atoi(value)
+			}
+		}
+	}
+	return keepalives
+}
+
+func setKeepalive(dev *device.Device, peer string, secs int) error {
+	return dev.IpcSet(fmt.Sprintf("public_key=%s\nupdate_only=true\npersistent_keepalive_interval=%d\n", peer, secs))
+}
+
+// PowerStatus reports the power source the tunnel is tuned for.
+func (s *Supervisor) PowerStatus() (control.PowerStatus, error) {
+	if s.opts.Power == nil {
+		return control.PowerStatus{}, errors.New("battery awareness is off")
+	}
+	return s.opts.Power.status(), nil
+}
+
+// SetPowerSource tunes the tunnel for source regardless of the detected
+// one, control.PowerAuto detects it again.
+func (s *Supervisor) SetPowerSource(source string) error {
+	if s.opts.Power == nil {
+		return errors.New("battery awareness is off")
+	}
+	return s.opts.Power.setHint(source)
+}
+
+// tunePower tunes the tunnel for the current power source, reporting
+// whether it is the battery.
+func (s *Supervisor) tunePower() (battery bool) {
+	p := s.opts.Power
+	source, err := p.detect()
+	if err != nil {
+		s.l.Debug("failed to detect the power source", "error", err)
+	}
+
+	p.mu.Lock()
+	changed := source != p.source
+	p.source = source
+	p.mu.Unlock()
+
+	battery = source == control.PowerBattery
+	if changed {
+		s.l.Info("tuning the tunnel for the power source", "source", source)
+		if battery {
+			device.SetMaxWorkers(batteryWorkers)
+		} else {
+			device.SetMaxWorkers(0)
+		}
+		s.events.emit(Event{Type: EventPower, Mode: s.mode.Load().(string), Power: source})
+	}
+	if err := p.tuneKeepalives(s.health.devices(), battery); err != nil {
+		s.l.Warn("failed to tune keepalives", "error", err)
+	}
+	return battery
+}
+
+// watchPower keeps the tunnel tuned for the power source until ctx is done,
+// refreshing the endpoint scores in the background on ac power.
+func (s *Supervisor) watchPower(ctx context.Context) {
+	check := time.NewTicker(powerCheckInterval)
+	defer check.Stop()
+
+	var refresh <-chan time.Time
+	if s.opts.Scan != nil && s.opts.Scores != nil {
+		ticker := time.NewTicker(scoreRefreshInterval)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-check.C:
+			s.tunePower()
+		case <-s.opts.Power.wake:
+			s.tunePower()
+		case <-refresh:
+			if s.tunePower() {
+				continue
+			}
+			if err := s.ScanEndpoints(); err != nil {
+				s.l.Debug("failed to refresh endpoint scores", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const powerSupplyDir = "/sys/class/power_supply"
+
+// onBattery reports whether the host runs on battery, that is it has a
+// battery and no mains or usb supply is online.
+func onBattery() (bool, error) {
+	supplies, err := os.ReadDir(powerSupplyDir)
+	if err != nil {
+		return false, err
+	}
+
+	battery := false
+	for _, s := range supplies {
+		dir := filepath.Join(powerSupplyDir, s.Name())
+		kind, err := os.ReadFile(filepath.Join(dir, "type"))
+		if err != nil {
+			continue
+		}
+		switch strings.TrimSpace(string(kind)) {
+		case "Battery":
+			// Peripherals such as mice report their batteries too
+			if scope, err := os.ReadFile(filepath.Join(dir, "scope")); err == nil && strings.TrimSpace(string(scope)) == "Device" {
+				continue
+			}
+			battery = true
+		case "Mains", "USB", "USB_C", "USB_PD":
+			if online, err := os.ReadFile(filepath.Join(dir, "online")); err == nil && strings.TrimSpace(string(online)) == "1" {
+				return false, nil
+			}
+		}
+	}
+	return battery, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !windows
+
+package app
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// onBattery reports whether the host runs on battery.
+func onBattery() (bool, error) {
+	out, err := exec.Command("pmset", "-g", "ps").Output()
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(string(out), "'Battery Power'"), nil
+}
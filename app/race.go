@@ -0,0 +1,118 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// racer is one way of reaching warp raced at startup.
+type racer struct {
+	name string
+	// endpoint returns the endpoint to connect to
+	endpoint func(ctx context.Context) (string, error)
+	masque   bool
+}
+
+type raceResult struct {
+	racer    int
+	endpoint string
+	opts     WarpOptions
+	tnet     *netstack.Net
+	err      error
+}
+
+// racing reports whether opts race the ways of reaching warp, which is only
+// done for plain warp served as a proxy.
+func (opts WarpOptions) racing() bool {
+	return opts.Race && !opts.Tun && !opts.Gool && opts.Psiphon == nil && len(opts.Fallback) == 0
+}
+
+// raceWarp connects to the endpoint, the best scanned endpoint and through
+// the masque proxy at once, as far as they are enabled, and serves the
+// proxy over whichever comes up first, cancelling the others. It returns
+// the endpoint that won.
+func raceWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) (string, error) {
+	// make primary identity
+	ident, err := loadIdentity(l, opts, "primary")
+	if err != nil {
+		l.Error("couldn't load primary warp identity")
+		return opts.Endpoint, err
+	}
+
+	direct := func(context.Context) (string, error) {
+		return opts.Endpoint, nil
+	}
+	racers := []racer{{name: "direct", endpoint: direct}}
+	if opts.Scan != nil {
+		racers = append(racers, racer{name: "scan", endpoint: func(ctx context.Context) (string, error) {
+			scanOpts := *opts.Scan
+			scanOpts.PrivateKey = ident.PrivateKey
+			scanOpts.PublicKey = ident.Config.Peers[0].PublicKey
+			scanOpts.Scored = opts.Scores.record
+
+			res, err := wiresocks.RunScan(ctx, l, scanOpts)
+			if err != nil {
+				return "", err
+			}
+			opts.Telemetry.recordScan(res)
+			if len(res) == 0 {
+				return "", errors.New("scan found no endpoints")
+			}
+			return res[0].AddrPort.String(), nil
+		}})
+	}
+	if opts.Masque != "" {
+		racers = append(racers, racer{name: "masque", endpoint: direct, masque: true})
+	}
+
+	results := make(chan raceResult, len(racers))
+	cancels := make([]context.CancelFunc, len(racers))
+	for i, r := range racers {
+		rctx, cancel := context.WithCancel(ctx)
+		cancels[i] = cancel
+
+		go func() {
+			res := raceResult{racer: i, opts: opts}
+			if !r.masque {
+				res.opts.Masque = ""
+			}
+
+			res.endpoint, res.err = r.endpoint(rctx)
+			if res.err == nil {
+				var conf wiresocks.Configuration
+				conf, res.err = warpConfig(ident, res.opts, res.endpoint)
+				if res.err == nil {
+					res.tnet, _, res.err = connectUserspace(rctx, l.With("racer", r.name), &conf, res.opts)
+				}
+			}
+			results <- res
+		}()
+	}
+
+	var errs []error
+	for range racers {
+		res := <-results
+		name := racers[res.racer].name
+		if res.err != nil {
+			cancels[res.racer]()
+			l.Info("racer failed", "racer", name, "error", res.err)
+			errs = append(errs, fmt.Errorf("%s: %w", name, res.err))
+			continue
+		}
+
+		l.Info("racer won", "racer", name, "endpoint", res.endpoint)
+		for i, cancel := range cancels {
+			if i != res.racer {
+				cancel()
+			}
+		}
+		// Run a proxy on the userspace stack
+		return res.endpoint, startInbounds(ctx, l, res.tnet, res.opts)
+	}
+	return opts.Endpoint, errors.Join(errs...)
+}
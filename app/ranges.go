@@ -0,0 +1,164 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+)
+
+const (
+	// rangesDir holds the last fetched copy of every scan range url, used
+	// when fetching it fails
+	rangesDir = "scan-ranges"
+	// rangesFetchTimeout bounds fetching a single scan range url
+	rangesFetchTimeout = 10 * time.Second
+	// rangesMaxSize bounds a scan range list
+	rangesMaxSize = 1 << 20
+	// CloudflareRanges is the scan range source standing for the ranges
+	// Cloudflare publishes for its edge
+	CloudflareRanges = "cloudflare"
+)
+
+// cloudflareRangeURLs are the published Cloudflare edge ranges.
+var cloudflareRangeURLs = []string{
+	"https://www.cloudflare.com/ips-v4",
+	"https://www.cloudflare.com/ips-v6",
+}
+
+// LoadScanRanges reads the ranges to scan for endpoints from sources, files
+// or http(s) urls listing a CIDR or address per line, with # comments.
+// Urls are fetched on every start, falling back to the copy cached in
+// cacheDir when that fails. Without sources, or if none could be read, the
+// pinned warp prefixes are used.
+func LoadScanRanges(ctx context.Context, l *slog.Logger, cacheDir string, sources []string) []netip.Prefix {
+	l = l.With("subsystem", "scan-ranges")
+
+	var expanded []string
+	for _, s := range sources {
+		if s == CloudflareRanges {
+			expanded = append(expanded, cloudflareRangeURLs...)
+			continue
+		}
+		expanded = append(expanded, s)
+	}
+
+	var prefixes []netip.Prefix
+	for _, s := range expanded {
+		p, err := loadScanRange(ctx, l, cacheDir, s)
+		if err != nil {
+			l.Warn("skipping scan ranges", "source", s, "error", err)
+			continue
+		}
+		l.Debug("loaded scan ranges", "source", s, "prefixes", len(p))
+		prefixes = append(prefixes, p...)
+	}
+
+	if len(prefixes) == 0 {
+		if len(sources) > 0 {
+			l.Warn("no scan ranges could be loaded, using the pinned warp prefixes")
+		}
+		return warp.WarpPrefixes()
+	}
+	return prefixes
+}
+
+func loadScanRange(ctx context.Context, l *slog.Logger, cacheDir, source string) ([]netip.Prefix, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+		return parseScanRanges(data)
+	}
+
+	sum := sha256.Sum256([]byte(source))
+	cached := filepath.Join(cacheDir, rangesDir, hex.EncodeToString(sum[:8]))
+
+	data, err := fetchScanRange(ctx, source)
+	if err == nil {
+		var prefixes []netip.Prefix
+		if prefixes, err = parseScanRanges(data); err == nil {
+			if err := os.MkdirAll(filepath.Dir(cached), 0o755); err == nil {
+				if err := os.WriteFile(cached, data, 0o644); err != nil {
+					l.Debug("failed to cache scan ranges", "source", source, "error", err)
+				}
+			}
+			return prefixes, nil
+		}
+	}
+
+	data, cerr := os.ReadFile(cached)
+	if cerr != nil {
+		return nil, err
+	}
+	l.Info("failed to fetch scan ranges, using the cached copy", "source", source, "error", err)
+	return parseScanRanges(data)
+}
+
+func fetchScanRange(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, rangesFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, rangesMaxSize))
+}
+
+// parseScanRanges parses a list of CIDRs or addresses, one per line.
+func parseScanRanges(data []byte) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if !strings.Contains(line, "/") {
+			addr, err := netip.ParseAddr(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(prefixes) == 0 {
+		return nil, errors.New("no ranges listed")
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,116 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/bepass-org/warp-plus/control"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// remoteConfigFile keeps the last applied remote config, so that it
+// survives restarts and its serial can't be replayed.
+const remoteConfigFile = "remote-config.json"
+
+// withRemoteConfig returns opts changed by c.
+func withRemoteConfig(opts WarpOptions, c control.RemoteConfig) (WarpOptions, error) {
+	for _, e := range c.Endpoints {
+		if _, _, err := net.SplitHostPort(e); err != nil {
+			return opts, fmt.Errorf("invalid endpoint %q: %w", e, err)
+		}
+	}
+	if len(c.Endpoints) > 0 {
+		opts.Endpoint = c.Endpoints[0]
+	}
+
+	if c.Routes != nil {
+		opts.Routes = nil
+		for _, s := range c.Routes {
+			r, err := wiresocks.ParseRouteRule(s)
+			if err != nil {
+				return opts, err
+			}
+			opts.Routes = append(opts.Routes, r)
+		}
+		if err := checkRoutes(opts); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+func loadRemoteConfig(cacheDir string) (control.RemoteConfig, error) {
+	var c control.RemoteConfig
+	data, err := os.ReadFile(filepath.Join(cacheDir, remoteConfigFile))
+	if err != nil {
+		return c, err
+	}
+	return c, json.Unmarshal(data, &c)
+}
+
+func saveRemoteConfig(cacheDir string, c control.RemoteConfig) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(cacheDir, remoteConfigFile), data, 0o600)
+}
+
+// RestoreRemoteConfig returns opts changed by the last applied remote
+// config, if there is one.
+func RestoreRemoteConfig(l *slog.Logger, opts WarpOptions) WarpOptions {
+	c, err := loadRemoteConfig(opts.CacheDir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return opts
+	case err != nil:
+		l.Warn("ignoring corrupt remote config", "error", err)
+		return opts
+	}
+
+	restored, err := withRemoteConfig(opts, c)
+	if err != nil {
+		l.Warn("ignoring remote config", "serial", c.Serial, "error", err)
+		return opts
+	}
+	l.Info("restored remote config", "serial", c.Serial)
+	return restored
+}
+
+// ApplyConfig brings the tunnel back up with a config pushed by a remote
+// controller, on the first of its endpoints that works.
+func (s *Supervisor) ApplyConfig(c control.RemoteConfig) error {
+	if !s.mu.TryLock() {
+		return errors.New("tunnel is already being brought up")
+	}
+	defer s.mu.Unlock()
+
+	if prev, err := loadRemoteConfig(s.opts.CacheDir); err == nil && c.Serial <= prev.Serial {
+		return fmt.Errorf("config serial %d is not newer than the applied %d", c.Serial, prev.Serial)
+	}
+	opts, err := withRemoteConfig(s.opts, c)
+	if err != nil {
+		return err
+	}
+
+	endpoints := c.Endpoints
+	if len(endpoints) == 0 {
+		endpoints = []string{opts.Endpoint}
+	}
+	if opts, err = s.restartOn(opts, endpoints); err != nil {
+		return err
+	}
+	s.opts = opts
+
+	s.l.Info("applied remote config", "serial", c.Serial, "endpoint", opts.Endpoint)
+	opts.Audit.Record(actorAPI, "remote_config_applied", "serial", c.Serial, "endpoint", opts.Endpoint, "routes", len(opts.Routes))
+	return saveRemoteConfig(opts.CacheDir, c)
+}
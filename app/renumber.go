@@ -0,0 +1,164 @@
+package app
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun"
+)
+
+// tunnelPrefixBits is the prefix length the tun interface is addressed with.
+const tunnelPrefixBits = 24
+
+// renumberCandidates are tried in order when the address assigned by warp
+// collides with a local network.
+var renumberCandidates = []netip.Addr{
+	netip.MustParseAddr("172.16.0.2"),
+	netip.MustParseAddr("172.29.0.2"),
+	netip.MustParseAddr("10.254.254.2"),
+	netip.MustParseAddr("100.100.100.2"),
+	netip.MustParseAddr("192.168.254.2"),
+}
+
+// localPrefixes returns the prefixes of every address assigned to the host,
+// ignoring our own tun interface.
+func localPrefixes() []netip.Prefix {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var prefixes []netip.Prefix
+	for _, iface := range ifaces {
+		if iface.Name == "warp0" || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, ok := netip.AddrFromSlice(ipNet.IP)
+			if !ok {
+				continue
+			}
+			ones, _ := ipNet.Mask.Size()
+			prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ones).Masked())
+		}
+	}
+	return prefixes
+}
+
+// tunnelAddress returns the address to put on the tun interface in place of
+// want, renumbering to a free private range if want's subnet overlaps one of
+// the local networks.
+func tunnelAddress(want netip.Addr) netip.Addr {
+	local := localPrefixes()
+	collides := func(addr netip.Addr) bool {
+		p := netip.PrefixFrom(addr, tunnelPrefixBits).Masked()
+		for _, l := range local {
+			if l.Overlaps(p) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !collides(want) {
+		return want
+	}
+	for _, addr := range renumberCandidates {
+		if addr.Is4() == want.Is4() && !collides(addr) {
+			return addr
+		}
+	}
+	return want
+}
+
+// natTun translates between the address the tun interface is numbered with
+// and the address warp assigned us, so a renumbered interface keeps working.
+type natTun struct {
+	tun.Device
+	local  [4]byte
+	remote [4]byte
+}
+
+// newNATTun wraps dev so packets leaving from local appear to come from
+// remote and replies to remote are delivered to local. Only IPv4 is
+// translated, dev is returned as is if the addresses are equal.
+func newNATTun(dev tun.Device, local, remote netip.Addr) tun.Device {
+	if local == remote || !local.Is4() || !remote.Is4() {
+		return dev
+	}
+	return &natTun{Device: dev, local: local.As4(), remote: remote.As4()}
+}
+
+func (t *natTun) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n, err := t.Device.Read(bufs, sizes, offset)
+	for i := 0; i < n; i++ {
+		rewriteIPv4(bufs[i][offset:offset+sizes[i]], 12, t.local, t.remote)
+	}
+	return n, err
+}
+
+func (t *natTun) Write(bufs [][]byte, offset int) (int, error) {
+	for _, buf := range bufs {
+		rewriteIPv4(buf[offset:], 16, t.remote, t.local)
+	}
+	return t.Device.Write(bufs, offset)
+}
+
+// rewriteIPv4 replaces the source (off 12) or destination (off 16) address
+// of an IPv4 packet if it equals from, fixing up the header and transport
+// checksums.
+func rewriteIPv4(pkt []byte, off int, from, to [4]byte) {
+	if len(pkt) < 20 || pkt[0]>>4 != 4 {
+		return
+	}
+	ihl := int(pkt[0]&0x0f) * 4
+	if ihl < 20 || len(pkt) < ihl || [4]byte(pkt[off:off+4]) != from {
+		return
+	}
+
+	updateChecksum(pkt[10:12], from, to)
+
+	// TCP and UDP checksums cover the addresses through the pseudo header,
+	// only the first fragment carries a transport header.
+	if binary.BigEndian.Uint16(pkt[6:8])&0x1fff == 0 {
+		l4 := pkt[ihl:]
+		switch pkt[9] {
+		case 6: // TCP
+			if len(l4) >= 18 {
+				updateChecksum(l4[16:18], from, to)
+			}
+		case 17: // UDP
+			if len(l4) >= 8 && binary.BigEndian.Uint16(l4[6:8]) != 0 {
+				updateChecksum(l4[6:8], from, to)
+				if binary.BigEndian.Uint16(l4[6:8]) == 0 {
+					binary.BigEndian.PutUint16(l4[6:8], 0xffff)
+				}
+			}
+		}
+	}
+
+	copy(pkt[off:off+4], to[:])
+}
+
+// updateChecksum incrementally updates a ones' complement checksum for a
+// four byte field changing from old to new (RFC 1624).
+func updateChecksum(sum []byte, old, new [4]byte) {
+	s := uint32(^binary.BigEndian.Uint16(sum))
+	for i := 0; i < 4; i += 2 {
+		s += uint32(^binary.BigEndian.Uint16(old[i:]))
+		s += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	binary.BigEndian.PutUint16(sum, ^uint16(s))
+}
@@ -0,0 +1,183 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand/v2"
+	"testing"
+)
+
+// checksum is the ones' complement checksum of b, started from sum.
+func checksum(sum uint32, b []byte) uint16 {
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(binary.BigEndian.Uint16(b))
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// ipv4Packet returns a packet of proto from src to dst with ihl bytes of
+// header, carrying payload, with all of its checksums computed in full.
+func ipv4Packet(proto byte, ihl int, src, dst [4]byte, payload []byte) []byte {
+	pkt := make([]byte, ihl+len(payload))
+	pkt[0] = 0x40 | byte(ihl/4)
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[8], pkt[9] = 64, proto
+	copy(pkt[12:], src[:])
+	copy(pkt[16:], dst[:])
+	copy(pkt[ihl:], payload)
+	fillChecksums(pkt)
+	return pkt
+}
+
+// fillChecksums computes the checksums of pkt from scratch.
+func fillChecksums(pkt []byte) {
+	ihl := int(pkt[0]&0x0f) * 4
+	binary.BigEndian.PutUint16(pkt[10:], 0)
+	binary.BigEndian.PutUint16(pkt[10:], checksum(0, pkt[:ihl]))
+
+	l4 := pkt[ihl:]
+	pseudo := func() uint32 {
+		return uint32(binary.BigEndian.Uint16(pkt[12:])) + uint32(binary.BigEndian.Uint16(pkt[14:])) +
+			uint32(binary.BigEndian.Uint16(pkt[16:])) + uint32(binary.BigEndian.Uint16(pkt[18:])) +
+			uint32(pkt[9]) + uint32(len(l4))
+	}
+	switch pkt[9] {
+	case 6:
+		binary.BigEndian.PutUint16(l4[16:], 0)
+		binary.BigEndian.PutUint16(l4[16:], checksum(pseudo(), l4))
+	case 17:
+		if binary.BigEndian.Uint16(l4[6:]) == 0 {
+			return
+		}
+		binary.BigEndian.PutUint16(l4[6:], 0)
+		sum := checksum(pseudo(), l4)
+		if sum == 0 {
+			sum = 0xffff
+		}
+		binary.BigEndian.PutUint16(l4[6:], sum)
+	case 1:
+		binary.BigEndian.PutUint16(l4[2:], 0)
+		binary.BigEndian.PutUint16(l4[2:], checksum(0, l4))
+	}
+}
+
+func TestUpdateChecksum(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	for range 1000 {
+		b := make([]byte, 4+r.IntN(32)*2)
+		for i := range b {
+			b[i] = byte(r.Uint32())
+		}
+		// The four byte field is at an even offset, as addresses are
+		at := 2 * r.IntN((len(b)-4)/2+1)
+		sum := make([]byte, 2)
+		binary.BigEndian.PutUint16(sum, checksum(0, b))
+
+		var old, new [4]byte
+		copy(old[:], b[at:])
+		binary.BigEndian.PutUint32(new[:], r.Uint32())
+		copy(b[at:], new[:])
+
+		updateChecksum(sum, old, new)
+		want := checksum(0, b)
+		got := binary.BigEndian.Uint16(sum)
+		// 0x0000 and 0xffff are the same sum in ones' complement
+		if got != want && got|want != 0xffff {
+			t.Fatalf("updated checksum %#04x, want %#04x", got, want)
+		}
+	}
+}
+
+func TestRewriteIPv4(t *testing.T) {
+	local, remote := [4]byte{172, 16, 0, 2}, [4]byte{10, 1, 2, 3}
+	peer := [4]byte{162, 159, 192, 1}
+	r := rand.New(rand.NewPCG(3, 4))
+	payload := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(r.Uint32())
+		}
+		return b
+	}
+
+	tests := []struct {
+		name string
+		pkt  []byte
+	}{
+		{"tcp", ipv4Packet(6, 20, local, peer, payload(20+333))},
+		{"tcp with ip options", ipv4Packet(6, 24, local, peer, payload(40))},
+		{"udp", ipv4Packet(17, 20, local, peer, payload(8+57))},
+		{"udp without checksum", func() []byte {
+			p := payload(8 + 12)
+			p[6], p[7] = 0, 0
+			return ipv4Packet(17, 20, local, peer, p)
+		}()},
+		{"icmp", ipv4Packet(1, 20, local, peer, payload(8+56))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := tt.pkt
+			ihl := int(pkt[0]&0x0f) * 4
+			noUDPChecksum := pkt[9] == 17 && binary.BigEndian.Uint16(pkt[ihl+6:]) == 0
+
+			// Out the tunnel, as natTun.Read rewrites the source
+			rewriteIPv4(pkt, 12, local, remote)
+			if [4]byte(pkt[12:16]) != remote {
+				t.Fatalf("source is %v, want %v", pkt[12:16], remote)
+			}
+			want := bytes.Clone(pkt)
+			fillChecksums(want)
+			if !bytes.Equal(pkt, want) {
+				t.Fatalf("checksums after rewriting the source differ from computing them in full:\n%x\n%x", pkt, want)
+			}
+			if noUDPChecksum && binary.BigEndian.Uint16(pkt[ihl+6:]) != 0 {
+				t.Fatal("udp checksum was added")
+			}
+
+			// And a reply back in, as natTun.Write rewrites the destination
+			copy(pkt[12:], peer[:])
+			copy(pkt[16:], remote[:])
+			fillChecksums(pkt)
+			rewriteIPv4(pkt, 16, remote, local)
+			want = bytes.Clone(pkt)
+			fillChecksums(want)
+			if [4]byte(pkt[16:20]) != local || !bytes.Equal(pkt, want) {
+				t.Fatalf("rewriting the destination got\n%x, want\n%x", pkt, want)
+			}
+		})
+	}
+
+	t.Run("other address", func(t *testing.T) {
+		pkt := ipv4Packet(6, 20, peer, local, payload(40))
+		orig := bytes.Clone(pkt)
+		rewriteIPv4(pkt, 12, local, remote)
+		if !bytes.Equal(pkt, orig) {
+			t.Fatal("rewrote a packet from another address")
+		}
+	})
+
+	t.Run("later fragment", func(t *testing.T) {
+		// Only the first fragment has the transport header to fix up
+		pkt := ipv4Packet(17, 20, local, peer, payload(64))
+		binary.BigEndian.PutUint16(pkt[6:], 8)
+		fillChecksums(pkt)
+		body := bytes.Clone(pkt[20:])
+		rewriteIPv4(pkt, 12, local, remote)
+		if !bytes.Equal(pkt[20:], body) || checksum(0, pkt[:20]) != 0 {
+			t.Fatal("fragment payload changed, or header checksum broken")
+		}
+	})
+
+	t.Run("short", func(t *testing.T) {
+		pkt := ipv4Packet(6, 20, local, peer, payload(40))
+		for n := range len(pkt) {
+			rewriteIPv4(bytes.Clone(pkt[:n]), 12, local, remote)
+		}
+	})
+}
@@ -0,0 +1,412 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/doh"
+	"github.com/bepass-org/warp-plus/wireguard/device"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+const (
+	endpointPinsFile = "endpoint-pins.json"
+	// endpointResolveInterval is how often host name endpoints are resolved
+	// again, in case their addresses changed
+	endpointResolveInterval = 5 * time.Minute
+	// endpointPinInterval is how often the addresses peers handshake on
+	// are checked to pin them
+	endpointPinInterval = 30 * time.Second
+	// endpointResolveTimeout bounds a resolution
+	endpointResolveTimeout = 10 * time.Second
+)
+
+// srvService is the service looked up for srv:// endpoints
+const srvService = "_wireguard._udp."
+
+// hostEndpoint is a peer endpoint given by host name, as HOST:PORT, or by
+// domain publishing the endpoints, as srv://DOMAIN or svcb://DOMAIN[:PORT].
+type hostEndpoint struct {
+	name       string
+	candidates []netip.AddrPort
+	// current is the address the peer is on since switched
+	current  netip.AddrPort
+	switched time.Time
+}
+
+// endpointResolver resolves the host name and published endpoints of the
+// peers of a wireguard config and keeps them on a working address: it
+// resolves them again periodically and when their handshakes go unanswered,
+// moving the peers to another address, and pins the addresses they
+// handshake on in CacheDir so they are preferred from then on.
+type endpointResolver struct {
+	l        *slog.Logger
+	dns      doh.Exchanger
+	pinsPath string
+
+	mu    sync.Mutex
+	pins  map[string]netip.AddrPort
+	peers map[string]*hostEndpoint // by hex public key
+}
+
+func newEndpointResolver(l *slog.Logger, opts WarpOptions) *endpointResolver {
+	r := &endpointResolver{
+		l:        l,
+		dns:      doh.PlainServer(netip.AddrPortFrom(opts.DnsAddr, 53)),
+		pinsPath: filepath.Join(opts.CacheDir, endpointPinsFile),
+		pins:     make(map[string]netip.AddrPort),
+		peers:    make(map[string]*hostEndpoint),
+	}
+	if opts.ResolveDoH {
+		// The bootstrap addresses reach the resolver without resolving it
+		upstream, _ := doh.CloudflareUpstream(doh.FilterNone)
+		r.dns = doh.NewClient(upstream, doh.ProtocolDoH, nil)
+	}
+
+	data, err := os.ReadFile(r.pinsPath)
+	if err != nil {
+		return r
+	}
+	if err := json.Unmarshal(data, &r.pins); err != nil {
+		l.Warn("ignoring corrupt endpoint pins", "path", r.pinsPath, "error", err)
+		r.pins = make(map[string]netip.AddrPort)
+	}
+	return r
+}
+
+// add resolves the endpoint of peer unless it is an address, and sets it
+// to the address the peer starts on.
+func (r *endpointResolver) add(ctx context.Context, peer *wiresocks.PeerConfig) error {
+	if _, err := netip.ParseAddrPort(peer.Endpoint); err == nil {
+		return nil
+	}
+
+	e := &hostEndpoint{name: peer.Endpoint}
+	if err := r.resolve(ctx, e); err != nil {
+		return fmt.Errorf("resolving endpoint %s: %w", peer.Endpoint, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.current = r.choose(e, netip.AddrPort{})
+	e.switched = time.Now()
+	r.peers[peer.PublicKey] = e
+	peer.Endpoint = e.current.String()
+	return nil
+}
+
+// resolve looks up the candidate addresses of e, preferring IPv4 ones.
+func (r *endpointResolver) resolve(ctx context.Context, e *hostEndpoint) error {
+	ctx, cancel := context.WithTimeout(ctx, endpointResolveTimeout)
+	defer cancel()
+
+	var candidates []netip.AddrPort
+	var err error
+	switch {
+	case strings.HasPrefix(e.name, "srv://"):
+		candidates, err = r.discoverSRV(ctx, strings.TrimPrefix(e.name, "srv://"))
+	case strings.HasPrefix(e.name, "svcb://"):
+		candidates, err = r.discoverHTTPS(ctx, strings.TrimPrefix(e.name, "svcb://"))
+	default:
+		var host, port string
+		if host, port, err = net.SplitHostPort(e.name); err != nil {
+			return fmt.Errorf("invalid endpoint %q: %w", e.name, err)
+		}
+		candidates, err = r.lookupHost(ctx, host, port)
+	}
+	if err != nil {
+		return err
+	}
+
+	var v4, v6 []netip.AddrPort
+	for _, c := range candidates {
+		c = netip.AddrPortFrom(c.Addr().Unmap(), c.Port())
+		switch {
+		case c.Addr().Is4():
+			v4 = append(v4, c)
+		case c.Addr().Is6():
+			v6 = append(v6, c)
+		}
+	}
+	if len(v4) == 0 {
+		v4 = v6
+	}
+	if len(v4) == 0 {
+		return fmt.Errorf("%s has no addresses", e.name)
+	}
+	e.candidates = v4
+	return nil
+}
+
+// lookupHost returns the addresses of host with port.
+func (r *endpointResolver) lookupHost(ctx context.Context, host, port string) ([]netip.AddrPort, error) {
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	addrs, err := doh.LookupAddrs(ctx, r.dns, host)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]netip.AddrPort, 0, len(addrs))
+	for _, addr := range addrs {
+		candidates = append(candidates, netip.AddrPortFrom(addr, uint16(p)))
+	}
+	return candidates, nil
+}
+
+// discoverSRV returns the addresses of the targets with the lowest priority
+// among the srv records of the wireguard service of domain that resolve.
+func (r *endpointResolver) discoverSRV(ctx context.Context, domain string) ([]netip.AddrPort, error) {
+	records, err := doh.LookupSRV(ctx, r.dns, srvService+domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []netip.AddrPort
+	for i, record := range records {
+		if len(candidates) > 0 && record.Priority != records[i-1].Priority {
+			break
+		}
+		found, err := r.lookupHost(ctx, record.Target, strconv.Itoa(int(record.Port)))
+		if err != nil {
+			r.l.Debug("failed to resolve srv target", "target", record.Target, "error", err)
+			continue
+		}
+		candidates = append(candidates, found...)
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no srv target of %s resolves", domain)
+	}
+	return candidates, nil
+}
+
+// discoverHTTPS returns the addresses of the endpoints with the lowest
+// priority among the HTTPS records of name, given as DOMAIN[:PORT]. Their
+// addresses are those hinted, or else those of their target, and their port
+// the one in the record, or else PORT. An alias record is followed once.
+func (r *endpointResolver) discoverHTTPS(ctx context.Context, name string) ([]netip.AddrPort, error) {
+	domain, port := name, ""
+	if host, p, err := net.SplitHostPort(name); err == nil {
+		domain, port = host, p
+	}
+
+	records, err := doh.LookupHTTPS(ctx, r.dns, domain)
+	if err == nil && records[0].Priority == 0 && records[0].Target != "" {
+		domain = records[0].Target
+		records, err = doh.LookupHTTPS(ctx, r.dns, domain)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []netip.AddrPort
+	for i, record := range records {
+		if record.Priority == 0 {
+			continue
+		}
+		if len(candidates) > 0 && record.Priority != records[i-1].Priority {
+			break
+		}
+		recordPort := port
+		if record.Port != 0 {
+			recordPort = strconv.Itoa(int(record.Port))
+		}
+		if recordPort == "" {
+			r.l.Debug("skipping https record without port", "domain", domain, "target", record.Target)
+			continue
+		}
+		if len(record.Hints) > 0 {
+			p, err := strconv.ParseUint(recordPort, 10, 16)
+			if err != nil || p == 0 {
+				return nil, fmt.Errorf("invalid port %q", recordPort)
+			}
+			for _, addr := range record.Hints {
+				candidates = append(candidates, netip.AddrPortFrom(addr, uint16(p)))
+			}
+			continue
+		}
+		target := record.Target
+		if target == "" {
+			target = domain
+		}
+		found, err := r.lookupHost(ctx, target, recordPort)
+		if err != nil {
+			r.l.Debug("failed to resolve https target", "target", target, "error", err)
+			continue
+		}
+		candidates = append(candidates, found...)
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no https record of %s gives a usable endpoint", domain)
+	}
+	return candidates, nil
+}
+
+// choose returns the pinned address of e if it is still a candidate, or
+// else a random one, other than avoid if possible.
+func (r *endpointResolver) choose(e *hostEndpoint, avoid netip.AddrPort) netip.AddrPort {
+	if pin, ok := r.pins[e.name]; ok && pin != avoid && slices.Contains(e.candidates, pin) {
+		return pin
+	}
+	candidates := slices.DeleteFunc(slices.Clone(e.candidates), func(c netip.AddrPort) bool {
+		return c == avoid
+	})
+	if len(candidates) == 0 {
+		return e.candidates[0]
+	}
+	return candidates[rand.IntN(len(candidates))]
+}
+
+// rotate moves the peers of conf off the addresses they failed to come up
+// on, unpinning those.
+func (r *endpointResolver) rotate(conf *wiresocks.Configuration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, peer := range conf.Peers {
+		e := r.peers[peer.PublicKey]
+		if e == nil {
+			continue
+		}
+		r.unpin(e)
+		e.current = r.choose(e, e.current)
+		e.switched = time.Now()
+		conf.Peers[i].Endpoint = e.current.String()
+	}
+}
+
+// watch keeps the peers of dev on working addresses until ctx is done.
+func (r *endpointResolver) watch(ctx context.Context, dev *device.Device) {
+	if len(r.peers) == 0 {
+		return
+	}
+
+	dev.SetPathDegradedHandler(func(publicKey device.NoisePublicKey, reason string) {
+		r.l.Warn("peer path degrading", "peer", base64.StdEncoding.EncodeToString(publicKey[:]), "reason", reason)
+		if reason == "handshake unanswered" {
+			// The handler must not block the device
+			go r.reresolve(ctx, dev, hex.EncodeToString(publicKey[:]), true)
+		}
+	})
+
+	go func() {
+		resolveTicker := time.NewTicker(endpointResolveInterval)
+		defer resolveTicker.Stop()
+		pinTicker := time.NewTicker(endpointPinInterval)
+		defer pinTicker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-resolveTicker.C:
+				for key := range r.peers {
+					r.reresolve(ctx, dev, key, false)
+				}
+			case <-pinTicker.C:
+				r.pinWorking(dev)
+			}
+		}
+	}()
+}
+
+// reresolve resolves the endpoint of the peer with key again and moves the
+// peer to another address if its own is gone, or failed.
+func (r *endpointResolver) reresolve(ctx context.Context, dev *device.Device, key string, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e := r.peers[key]
+	if e == nil {
+		return
+	}
+	if err := r.resolve(ctx, e); err != nil {
+		r.l.Warn("failed to resolve peer endpoint", "endpoint", e.name, "error", err)
+		if !failed {
+			return
+		}
+		// Try another of the addresses resolved before
+	}
+
+	var avoid netip.AddrPort
+	switch {
+	case failed:
+		avoid = e.current
+		r.unpin(e)
+	case slices.Contains(e.candidates, e.current):
+		return
+	}
+	next := r.choose(e, avoid)
+	if next == e.current {
+		return
+	}
+
+	if err := dev.IpcSet(fmt.Sprintf("public_key=%s\nendpoint=%s\n", key, next)); err != nil {
+		r.l.Warn("failed to switch peer endpoint", "endpoint", e.name, "address", next, "error", err)
+		return
+	}
+	r.l.Info("switched peer endpoint", "endpoint", e.name, "from", e.current, "to", next)
+	e.current = next
+	e.switched = time.Now()
+}
+
+// pinWorking pins the addresses peers completed a handshake on.
+func (r *endpointResolver) pinWorking(dev *device.Device) {
+	stats := peerStats(dev)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := false
+	for _, e := range r.peers {
+		if pin, ok := r.pins[e.name]; ok && pin == e.current {
+			continue
+		}
+		for _, s := range stats {
+			if s.Endpoint == e.current.String() && s.LastHandshake.After(e.switched) {
+				r.pins[e.name] = e.current
+				changed = true
+				break
+			}
+		}
+	}
+	if changed {
+		r.save()
+	}
+}
+
+// unpin forgets the pinned address of e if it is the current one.
+func (r *endpointResolver) unpin(e *hostEndpoint) {
+	if pin, ok := r.pins[e.name]; ok && pin == e.current {
+		delete(r.pins, e.name)
+		r.save()
+	}
+}
+
+func (r *endpointResolver) save() {
+	data, err := json.MarshalIndent(r.pins, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(r.pinsPath), os.ModePerm)
+	}
+	if err == nil {
+		err = os.WriteFile(r.pinsPath, data, 0o644)
+	}
+	if err != nil {
+		r.l.Warn("failed to save endpoint pins", "path", r.pinsPath, "error", err)
+	}
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// sleepCheckInterval is how often the wall clock is compared with the
+	// monotonic one
+	sleepCheckInterval = 5 * time.Second
+	// minSleep is how far the wall clock has to run ahead of the monotonic
+	// one, which stands still while the host sleeps, to count as a resume
+	minSleep = 10 * time.Second
+)
+
+// watchResume handshakes the tunnels afresh whenever the host resumes from
+// sleep until ctx is done, noticed by the clocks drifting apart or from the
+// os where it tells.
+func (s *Supervisor) watchResume(ctx context.Context) {
+	resumed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case resumed <- struct{}{}:
+		default:
+		}
+	}
+	if err := watchResumeEvents(ctx, notify); err != nil {
+		s.l.Debug("failed to watch for resume events", "error", err)
+	}
+
+	ticker := time.NewTicker(sleepCheckInterval)
+	defer ticker.Stop()
+
+	last, lastResume := time.Now(), time.Time{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			// Round strips the monotonic reading
+			slept := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+			last = now
+			if slept < minSleep {
+				continue
+			}
+			s.l.Info("host resumed from sleep", "slept", slept.Round(time.Second))
+		case <-resumed:
+			s.l.Info("host resumed from sleep")
+		}
+
+		// Both ways may notice the same resume
+		if time.Since(lastResume) < sleepCheckInterval {
+			continue
+		}
+		lastResume = time.Now()
+		for _, dev := range s.health.devices() {
+			dev.Resume()
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package app
+
+import "context"
+
+// watchResumeEvents calls resumed when the os reports resuming from sleep.
+// The clocks drifting apart tell elsewhere.
+func watchResumeEvents(context.Context, func()) error {
+	return nil
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"context"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	powrprof                                     = windows.NewLazySystemDLL("powrprof.dll")
+	procPowerRegisterSuspendResumeNotification   = powrprof.NewProc("PowerRegisterSuspendResumeNotification")
+	procPowerUnregisterSuspendResumeNotification = powrprof.NewProc("PowerUnregisterSuspendResumeNotification")
+)
+
+const (
+	deviceNotifyCallback  = 2
+	pbtAPMResumeAutomatic = 0x12
+)
+
+// deviceNotifySubscribeParameters is DEVICE_NOTIFY_SUBSCRIBE_PARAMETERS.
+type deviceNotifySubscribeParameters struct {
+	callback uintptr
+	context  uintptr
+}
+
+// watchResumeEvents calls resumed when the os reports resuming from sleep
+// until ctx is done. The monotonic clock keeps running during sleep on
+// Windows, so this is the only way to tell.
+func watchResumeEvents(ctx context.Context, resumed func()) error {
+	params := &deviceNotifySubscribeParameters{
+		callback: windows.NewCallback(func(_, kind, _ uintptr) uintptr {
+			if kind == pbtAPMResumeAutomatic {
+				resumed()
+			}
+			return 0
+		}),
+	}
+
+	var handle uintptr
+	r, _, _ := procPowerRegisterSuspendResumeNotification.Call(deviceNotifyCallback, uintptr(unsafe.Pointer(params)), uintptr(unsafe.Pointer(&handle)))
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+
+	go func() {
+		<-ctx.Done()
+		_, _, _ = procPowerUnregisterSuspendResumeNotification.Call(handle)
+		runtime.KeepAlive(params)
+	}()
+	return nil
+}
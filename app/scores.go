@@ -0,0 +1,117 @@
+package app
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/control"
+	"github.com/bepass-org/warp-plus/ipscanner"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// EndpointScores keeps the endpoints the latest scan scored, for external
+// schedulers to choose from. A nil EndpointScores drops them.
+type EndpointScores struct {
+	mu        sync.Mutex
+	endpoints []ipscanner.IPInfo
+}
+
+func NewEndpointScores() *EndpointScores {
+	return &EndpointScores{}
+}
+
+func (e *EndpointScores) record(endpoints []ipscanner.IPInfo) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.endpoints = endpoints
+}
+
+func (e *EndpointScores) list() []control.EndpointScore {
+	if e == nil {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	scores := make([]control.EndpointScore, 0, len(e.endpoints))
+	for _, info := range e.endpoints {
+		scores = append(scores, control.EndpointScore{
+			Endpoint:     info.AddrPort.String(),
+			RTTMillis:    info.RTT.Milliseconds(),
+			JitterMillis: info.Jitter.Milliseconds(),
+			Loss:         info.Loss,
+			Probes:       info.Probes,
+			ScoreMillis:  info.Score().Milliseconds(),
+			ScannedAt:    info.CreatedAt,
+		})
+	}
+	return scores
+}
+
+// EndpointScores returns the endpoints of the latest scan, best first.
+func (s *Supervisor) EndpointScores() []control.EndpointScore {
+	return s.opts.Scores.list()
+}
+
+// ScanEndpoints scans for endpoints like a rescan, but leaves the tunnel on
+// its current endpoint.
+func (s *Supervisor) ScanEndpoints() error {
+	if !s.mu.TryLock() {
+		return errors.New("tunnel is already being brought up")
+	}
+	defer s.mu.Unlock()
+
+	switch {
+	case s.ctx == nil:
+		return errors.New("tunnel is not running")
+	case s.opts.WireguardConfig != "":
+		return errors.New("can't scan for endpoints of a wireguard config")
+	case s.opts.Scores == nil:
+		return errors.New("endpoint scores are not kept")
+	}
+
+	ident, err := loadIdentity(s.l, s.opts, "primary")
+	if err != nil {
+		return err
+	}
+	scanOpts := wiresocks.ScanOptions{V4: s.opts.V4, V6: s.opts.V6, MaxRTT: rescanMaxRTT, Prefixes: s.opts.ScanRanges}
+	if s.opts.Scan != nil {
+		scanOpts = *s.opts.Scan
+	}
+	scanOpts.PrivateKey = ident.PrivateKey
+	scanOpts.PublicKey = ident.Config.Peers[0].PublicKey
+	scanOpts.Scored = s.opts.Scores.record
+
+	start := time.Now()
+	if _, err := wiresocks.RunScan(s.ctx, s.l, scanOpts); err != nil {
+		return err
+	}
+	s.l.Info("scanned endpoints", "took", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// UseEndpoints brings the tunnel back up on the first of endpoints that
+// works, as chosen by an external scheduler. Later restarts keep using it.
+func (s *Supervisor) UseEndpoints(endpoints []string) error {
+	if !s.mu.TryLock() {
+		return errors.New("tunnel is already being brought up")
+	}
+	defer s.mu.Unlock()
+
+	if s.opts.WireguardConfig != "" {
+		return errors.New("can't choose endpoints of a wireguard config")
+	}
+	opts, err := s.restartOn(s.opts, endpoints)
+	if err != nil {
+		return err
+	}
+	s.opts = opts
+	return nil
+}
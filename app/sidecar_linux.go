@@ -0,0 +1,154 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// capNetAdmin is the bit of CAP_NET_ADMIN in the capability sets.
+const capNetAdmin = 12
+
+// sidecarChain is the iptables chain holding the sidecar's lockdown rules.
+const sidecarChain = "WARP_PLUS"
+
+// checkSidecar verifies the container was given what sidecar mode needs,
+// which is all it needs:
+//
+//	--cap-add NET_ADMIN                            tun, routes, rules and iptables
+//	--device /dev/net/tun                          the tun interface
+//	--sysctl net.ipv4.conf.all.src_valid_mark=1    replies to fwmarked packets
+//
+// and the ip and iptables commands in the image.
+func checkSidecar(l *slog.Logger) error {
+	var problems []string
+
+	if ok, err := hasCapability(capNetAdmin); err != nil || !ok {
+		problems = append(problems, "CAP_NET_ADMIN is missing (--cap-add NET_ADMIN)")
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		problems = append(problems, "/dev/net/tun is missing (--device /dev/net/tun)")
+	}
+	for _, cmd := range []string{"ip", "iptables", "ip6tables"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			problems = append(problems, cmd+" is not installed")
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("sidecar setup incomplete: %s", strings.Join(problems, "; "))
+	}
+
+	// /proc/sys is read-only in most containers, so this can't be fixed up
+	// later and replies would be dropped by reverse path filtering
+	if v, err := os.ReadFile("/proc/sys/net/ipv4/conf/all/src_valid_mark"); err == nil && strings.TrimSpace(string(v)) != "1" {
+		l.Warn("src_valid_mark is off, set it with --sysctl net.ipv4.conf.all.src_valid_mark=1 if the tunnel doesn't come up")
+	}
+	return nil
+}
+
+// hasCapability reports whether capability bit is in the effective set.
+func hasCapability(bit uint) (bool, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+			if err != nil {
+				return false, err
+			}
+			return caps&(1<<bit) != 0, nil
+		}
+	}
+	return false, errors.New("no effective capabilities in /proc/self/status")
+}
+
+// lockdownSidecar rejects all outgoing traffic of the network namespace
+// that would leave neither through the tunnel nor as wireguard's own fwmarked
+// packets, so no container sharing the namespace can leak around the
+// tunnel. Loopback and the bypass prefixes stay open, keeping the proxy
+// reachable from the other containers and cluster services working. Rules
+// left behind by an earlier run are replaced, and the rules are removed
+// again when ctx is done.
+func lockdownSidecar(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
+	mark := strconv.FormatUint(uint64(opts.FwMark), 10)
+
+	var installed []string
+	cleanup := func() {
+		for _, cmd := range installed {
+			for _, args := range [][]string{
+				{"-D", "OUTPUT", "-j", sidecarChain},
+				{"-F", sidecarChain},
+				{"-X", sidecarChain},
+			} {
+				if out, err := exec.Command(cmd, args...).CombinedOutput(); err != nil {
+					l.Warn("failed to remove sidecar rule", "command", cmd, "error", err, "output", strings.TrimSpace(string(out)))
+				}
+			}
+		}
+	}
+
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		if removeSidecarChain(cmd) {
+			l.Warn("removed the sidecar rules left behind by an earlier run", "command", cmd)
+		}
+
+		rules := [][]string{
+			{"-N", sidecarChain},
+			{"-A", sidecarChain, "-o", "lo", "-j", "RETURN"},
+			{"-A", sidecarChain, "-o", tunName, "-j", "RETURN"},
+			{"-A", sidecarChain, "-m", "mark", "--mark", mark, "-j", "RETURN"},
+		}
+		for _, prefix := range bypassPrefixes(opts.BypassCIDRs) {
+			if prefix.Addr().Is6() == (cmd == "ip6tables") {
+				rules = append(rules, []string{"-A", sidecarChain, "-d", prefix.String(), "-j", "RETURN"})
+			}
+		}
+		rules = append(rules,
+			[]string{"-A", sidecarChain, "-j", "REJECT"},
+			[]string{"-I", "OUTPUT", "-j", sidecarChain},
+		)
+
+		for i, args := range rules {
+			if out, err := exec.Command(cmd, args...).CombinedOutput(); err != nil {
+				cleanup()
+				return fmt.Errorf("%s %s: %w: %s", cmd, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+			}
+			if i == 0 {
+				installed = append(installed, cmd)
+			}
+		}
+	}
+
+	l.Info("sidecar lockdown active, traffic can only leave through the tunnel")
+
+	go func() {
+		<-ctx.Done()
+		cleanup()
+	}()
+	return nil
+}
+
+// removeSidecarChain removes sidecarChain, and the jumps to it, left behind
+// by a run that didn't get to clean up, reporting whether there was one.
+func removeSidecarChain(cmd string) bool {
+	if exec.Command(cmd, "-n", "-L", sidecarChain).Run() != nil {
+		return false
+	}
+	for exec.Command(cmd, "-D", "OUTPUT", "-j", sidecarChain).Run() == nil {
+		// Once per jump
+	}
+	_ = exec.Command(cmd, "-F", sidecarChain).Run()
+	_ = exec.Command(cmd, "-X", sidecarChain).Run()
+	return true
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+func checkSidecar(_ *slog.Logger) error {
+	return errors.New("sidecar mode is only supported on linux")
+}
+
+func lockdownSidecar(_ context.Context, _ *slog.Logger, _ WarpOptions) error {
+	return nil
+}
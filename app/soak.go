@@ -0,0 +1,252 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// soakWarmup is how many samples are left out of the trend, while
+	// caches and pools fill up
+	soakWarmup = 2
+	// soakSettle is how long goroutines of finished requests get to exit
+	// before a sample
+	soakSettle = 2 * time.Second
+	// soakGoroutineGrowth and soakHeapGrowth are how far the trend of
+	// the samples may rise over a soak before it counts as a leak
+	soakGoroutineGrowth = 20
+	soakHeapGrowth      = 16 << 20
+	soakRequestTimeout  = 30 * time.Second
+)
+
+// SoakOptions are how long Soak runs and how hard it works the tunnel.
+type SoakOptions struct {
+	Duration time.Duration
+	// Cycle is how often the tunnel is taken down and brought back up,
+	// with a network change simulated halfway in between. Resource use is
+	// sampled after every cycle.
+	Cycle time.Duration
+	// Load is how many requests to URL are kept in flight through the
+	// proxy, the captive portal probe unless given
+	Load int
+	URL  string
+	// Sampled is called with each sample as it is taken
+	Sampled func(SoakSample)
+}
+
+// SoakSample is the resource use of the process after a cycle.
+type SoakSample struct {
+	Elapsed    time.Duration
+	Goroutines int
+	HeapAlloc  uint64
+	// Requests and Failed are the requests made through the proxy since
+	// the previous sample, and how many of them failed
+	Requests int64
+	Failed   int64
+}
+
+// SoakReport is the outcome of a soak.
+type SoakReport struct {
+	Samples []SoakSample
+	// GoroutineGrowth and HeapGrowth are how much the trend of the samples
+	// past the warmup rose over the soak
+	GoroutineGrowth float64
+	HeapGrowth      float64
+}
+
+// Leaking reports whether the goroutines or the heap trended upward more
+// than a soak allows.
+func (r SoakReport) Leaking() error {
+	var errs []error
+	if r.GoroutineGrowth > soakGoroutineGrowth {
+		errs = append(errs, fmt.Errorf("goroutines grew by %.0f", r.GoroutineGrowth))
+	}
+	if r.HeapGrowth > soakHeapGrowth {
+		errs = append(errs, fmt.Errorf("heap grew by %.1f MiB", r.HeapGrowth/(1<<20)))
+	}
+	return errors.Join(errs...)
+}
+
+// Soak runs the tunnel for opts.Duration, restarting it and simulating
+// network changes while requests go through the proxy, and samples the
+// goroutines and the heap after every cycle. It stops early when ctx is
+// done, reporting what was sampled until then.
+func (s *Supervisor) Soak(ctx context.Context, opts SoakOptions) (SoakReport, error) {
+	switch {
+	case s.opts.Tun || s.opts.Sidecar:
+		return SoakReport{}, errors.New("can't soak the tunnel in tun mode")
+	case s.opts.TrustedNetworks != nil:
+		return SoakReport{}, errors.New("can't soak the tunnel while watching for trusted networks")
+	case s.opts.DNSOnly != nil:
+		return SoakReport{}, errors.New("no tunnel runs in dns-only mode")
+	}
+
+	if opts.URL == "" {
+		opts.URL = captiveProbeURL
+	}
+	if err := s.Run(ctx); err != nil {
+		return SoakReport{}, err
+	}
+	defer s.Stop()
+
+	dialer, err := proxy.SOCKS5("tcp", s.opts.Bind.String(), nil, proxy.Direct)
+	if err != nil {
+		return SoakReport{}, err
+	}
+	client := &http.Client{
+		Timeout: soakRequestTimeout,
+		Transport: &http.Transport{
+			DialContext:       dialer.(proxy.ContextDialer).DialContext,
+			DisableKeepAlives: true,
+		},
+	}
+
+	// Requests hold paused for reading, so sampling waits for those in flight
+	var (
+		paused           sync.RWMutex
+		requests, failed atomic.Int64
+		wg               sync.WaitGroup
+	)
+	loadCtx, stopLoad := context.WithCancel(ctx)
+	defer func() {
+		stopLoad()
+		wg.Wait()
+	}()
+	for i := 0; i < opts.Load; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for loadCtx.Err() == nil {
+				paused.RLock()
+				err := soakRequest(loadCtx, client, opts.URL)
+				paused.RUnlock()
+				requests.Add(1)
+				if err != nil {
+					failed.Add(1)
+					// The tunnel may be down for the restart
+					select {
+					case <-loadCtx.Done():
+					case <-time.After(time.Second):
+					}
+				}
+			}
+		}()
+	}
+
+	var report SoakReport
+	start := time.Now()
+	sample := func() {
+		paused.Lock()
+		defer paused.Unlock()
+		time.Sleep(soakSettle)
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		smp := SoakSample{
+			Elapsed:    time.Since(start),
+			Goroutines: runtime.NumGoroutine(),
+			HeapAlloc:  m.HeapAlloc,
+			Requests:   requests.Swap(0),
+			Failed:     failed.Swap(0),
+		}
+		report.Samples = append(report.Samples, smp)
+		if opts.Sampled != nil {
+			opts.Sampled(smp)
+		}
+	}
+
+	for time.Since(start) < opts.Duration {
+		select {
+		case <-ctx.Done():
+		case <-time.After(opts.Cycle / 2):
+			s.l.Info("soak: simulating network change")
+			for _, dev := range s.health.devices() {
+				dev.Resume()
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(opts.Cycle / 2):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		s.l.Info("soak: restarting tunnel")
+		s.mu.Lock()
+		s.down()
+		err := s.start(s.opts)
+		s.mu.Unlock()
+		if err != nil {
+			s.l.Warn("soak: failed to bring the tunnel back up", "error", err)
+		}
+		sample()
+	}
+
+	report.GoroutineGrowth, report.HeapGrowth = soakTrend(report.Samples)
+	return report, nil
+}
+
+func soakRequest(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+// soakTrend fits a line to the goroutines and heap of the samples past the
+// warmup, returning how much each rose from the first of them to the last.
+// Single restarts holding on to something don't make a trend, only what
+// keeps piling up does.
+func soakTrend(samples []SoakSample) (goroutines, heap float64) {
+	if len(samples) < soakWarmup+3 {
+		return 0, 0
+	}
+	samples = samples[soakWarmup:]
+	xs := make([]float64, len(samples))
+	gs := make([]float64, len(samples))
+	hs := make([]float64, len(samples))
+	for i, smp := range samples {
+		xs[i] = smp.Elapsed.Hours()
+		gs[i] = float64(smp.Goroutines)
+		hs[i] = float64(smp.HeapAlloc)
+	}
+	span := xs[len(xs)-1] - xs[0]
+	return slope(xs, gs) * span, slope(xs, hs) * span
+}
+
+// slope is the slope of the least squares line through xs and ys.
+func slope(xs, ys []float64) float64 {
+	var mx, my float64
+	for i := range xs {
+		mx += xs[i]
+		my += ys[i]
+	}
+	n := float64(len(xs))
+	mx, my = mx/n, my/n
+	var num, den float64
+	for i := range xs {
+		num += (xs[i] - mx) * (ys[i] - my)
+		den += (xs[i] - mx) * (xs[i] - mx)
+	}
+	if den == 0 {
+		return 0
+	}
+	return num / den
+}
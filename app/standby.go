@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wireguard/device"
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// Tunnels watched by a standby
+const (
+	tunnelPrimary = iota
+	tunnelStandby
+)
+
+var tunnelNames = [2]string{"primary", "standby"}
+
+// standby keeps a second tunnel handshaked to another endpoint, with the
+// secondary identity, next to the primary one. Connections move to the
+// other tunnel as soon as the path of the one in use degrades, as long as
+// the other completed a handshake since it last degraded itself.
+type standby struct {
+	l        *slog.Logger
+	failover *wiresocks.Failover
+
+	mu       sync.Mutex
+	devs     [2]*device.Device
+	degraded [2]time.Time
+}
+
+// startStandby watches the primary tunnel and brings up the standby one in
+// the background, returning the failover the proxies dial through.
+func startStandby(ctx context.Context, l *slog.Logger, opts WarpOptions, primary string, tnet *netstack.Net, dev *device.Device) *wiresocks.Failover {
+	s := &standby{l: l.With("subsystem", "standby"), failover: wiresocks.NewFailover(tnet)}
+	s.watch(tunnelPrimary, dev)
+
+	go func() {
+		endpoint, err := standbyEndpoint(opts, primary)
+		if err != nil {
+			s.l.Warn("failed to pick a standby endpoint", "error", err)
+			return
+		}
+
+		ident, err := loadIdentity(l, opts, "secondary")
+		if err != nil {
+			s.l.Warn("couldn't load secondary warp identity", "error", err)
+			return
+		}
+		conf, err := warpConfig(ident, opts, endpoint)
+		if err != nil {
+			s.l.Warn("failed to bring up standby tunnel", "error", err)
+			return
+		}
+		tnet, dev, err := connectUserspace(ctx, l.With("tunnel", "standby"), &conf, opts)
+		if err != nil {
+			s.l.Warn("failed to bring up standby tunnel", "endpoint", endpoint, "error", err)
+			return
+		}
+
+		s.watch(tunnelStandby, dev)
+		s.failover.SetStandby(tnet)
+		s.l.Info("standby tunnel up", "endpoint", endpoint)
+	}()
+
+	return s.failover
+}
+
+// standbyEndpoint returns the best scanned endpoint other than primary, or
+// a random one.
+func standbyEndpoint(opts WarpOptions, primary string) (string, error) {
+	for _, score := range opts.Scores.list() {
+		if score.Endpoint != primary {
+			return score.Endpoint, nil
+		}
+	}
+
+	var endpoint string
+	for i := 0; i < randomEndpointTries; i++ {
+		addrPort, err := warp.RandomWarpEndpoint(opts.V4, opts.V6)
+		if err != nil {
+			return "", err
+		}
+		if endpoint = addrPort.String(); endpoint != primary {
+			break
+		}
+	}
+	return endpoint, nil
+}
+
+// watch fails over when the path of tunnel i degrades.
+func (s *standby) watch(i int, dev *device.Device) {
+	s.mu.Lock()
+	s.devs[i] = dev
+	s.mu.Unlock()
+
+	dev.SetPathDegradedHandler(func(publicKey device.NoisePublicKey, reason string) {
+		s.l.Warn("peer path degrading", "tunnel", tunnelNames[i], "peer", base64.StdEncoding.EncodeToString(publicKey[:]), "reason", reason)
+		// The handler must not block the device
+		go s.pathDegraded(i)
+	})
+}
+
+func (s *standby) pathDegraded(i int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.degraded[i] = time.Now()
+	active := tunnelPrimary
+	if s.failover.OnStandby() {
+		active = tunnelStandby
+	}
+	if i != active {
+		return
+	}
+
+	other := 1 - i
+	if s.devs[other] == nil || !lastHandshake(s.devs[other]).After(s.degraded[other]) {
+		s.l.Warn("no healthy tunnel to fail over to", "tunnel", tunnelNames[i])
+		return
+	}
+	if s.failover.Switch() {
+		s.l.Info("failed over", "from", tunnelNames[i], "to", tunnelNames[other])
+	}
+}
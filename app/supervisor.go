@@ -0,0 +1,363 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/bepass-org/warp-plus/control"
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+const (
+	// rescanMaxRTT is the scanner rtt limit of a rescan when scanning wasn't
+	// enabled at startup
+	rescanMaxRTT = time.Second
+	// rebindAttempts is how often bringing the tunnel back up is retried
+	// while the previous one still holds the listening addresses
+	rebindAttempts = 10
+	rebindInterval = 500 * time.Millisecond
+	// eventPollInterval is how often the tunnel health is checked for
+	// changes to report as events
+	eventPollInterval = 2 * time.Second
+	// quotaCheckInterval is how often the warp+ data left is checked
+	quotaCheckInterval = time.Hour
+	// quotaLowThreshold is the warp+ data left below which EventQuotaLow
+	// is sent
+	quotaLowThreshold = 1 << 30
+)
+
+// Supervisor runs the tunnel and brings it back up in another mode or on
+// freshly scanned endpoints on request.
+type Supervisor struct {
+	l      *slog.Logger
+	health *Health
+	events *Events
+	mode   atomic.Value
+
+	// mu serializes bringing the tunnel up
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	opts   WarpOptions
+	// renewChecked is when the identities were last checked for being
+	// revoked
+	renewChecked time.Time
+}
+
+func NewSupervisor(l *slog.Logger, opts WarpOptions) *Supervisor {
+	s := &Supervisor{l: l, health: opts.Health, events: opts.Events, opts: opts}
+	s.mode.Store(opts.outboundTag())
+	return s
+}
+
+// Run brings the tunnel up like RunWarp, keeping it up until ctx is done.
+func (s *Supervisor) Run(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ctx = ctx
+	if s.events != nil {
+		go s.watch(ctx, s.opts)
+	}
+	go s.watchIdentities(ctx)
+	go s.watchResume(ctx)
+	if s.opts.Bridges != nil {
+		go s.opts.Bridges.watch(ctx, s.l)
+	}
+	if s.opts.Power != nil {
+		// Workers are bounded as tunnels come up
+		s.tunePower()
+		go s.watchPower(ctx)
+	}
+	return s.start(s.opts)
+}
+
+// start brings the tunnel up with opts, between its up hooks. s.mu must be
+// held.
+func (s *Supervisor) start(opts WarpOptions) error {
+	var endpoints []string
+	if opts.Endpoint != "" {
+		endpoints = []string{opts.Endpoint}
+	}
+	if err := opts.Hooks.run(s.l, hookPreUp, opts, endpoints); err != nil {
+		return err
+	}
+
+	// The tunnel outlives s.ctx so that Stop can take it down between the
+	// down hooks, shutting down only aborts bringing it up
+	ctx, cancel := context.WithCancel(context.WithoutCancel(s.ctx))
+	up := make(chan struct{})
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-up:
+		}
+	}()
+
+	run := func() (err error) {
+		for attempt := 1; ; attempt++ {
+			err = RunWarp(ctx, s.l, opts)
+			// The previous tunnel closes its listeners in the background
+			if !errors.Is(err, syscall.EADDRINUSE) || attempt == rebindAttempts {
+				return err
+			}
+			time.Sleep(rebindInterval)
+		}
+	}
+	err := run()
+	if err != nil && ctx.Err() == nil && s.renewIdentities(opts) {
+		err = run()
+	}
+	close(up)
+	if err == nil {
+		err = opts.Hooks.run(s.l, hookPostUp, opts, s.endpoints())
+	}
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	s.cancel = cancel
+	s.mode.Store(opts.outboundTag())
+	return nil
+}
+
+// down takes the tunnel down between its down hooks. s.mu must be held.
+func (s *Supervisor) down() {
+	if s.cancel == nil {
+		return
+	}
+
+	if err := s.opts.Hooks.run(s.l, hookPreDown, s.opts, s.endpoints()); err != nil {
+		s.l.Warn("hook failed", "error", err)
+	}
+	s.cancel()
+	s.cancel = nil
+	if err := s.opts.Hooks.run(s.l, hookPostDown, s.opts, nil); err != nil {
+		s.l.Warn("hook failed", "error", err)
+	}
+}
+
+// Stop takes the tunnel down for good once the context passed to Run is
+// done.
+func (s *Supervisor) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.down()
+}
+
+// restart takes the tunnel down and brings it back up with opts, or with
+// the previous options if that fails. s.mu must be held.
+func (s *Supervisor) restart(opts WarpOptions) error {
+	switch {
+	case s.ctx == nil:
+		return errors.New("tunnel is not running")
+	case opts.Tun || opts.Sidecar:
+		return errors.New("can't reconfigure the tunnel in tun mode")
+	case opts.TrustedNetworks != nil:
+		return errors.New("can't reconfigure the tunnel while watching for trusted networks")
+	case opts.DNSOnly != nil:
+		return errors.New("no tunnel runs in dns-only mode")
+	}
+
+	s.l.Info("reconfiguring tunnel", "mode", opts.outboundTag())
+	s.down()
+
+	err := s.start(opts)
+	if err == nil {
+		return nil
+	}
+	s.l.Warn("failed to reconfigure tunnel, restoring it", "error", err)
+	if rerr := s.start(s.opts); rerr != nil {
+		s.l.Error("failed to restore tunnel", "error", rerr)
+	}
+	return err
+}
+
+// restartOn restarts the tunnel with opts on the first of endpoints that
+// works, returning the options it came up with. s.mu must be held.
+func (s *Supervisor) restartOn(opts WarpOptions, endpoints []string) (WarpOptions, error) {
+	var err error
+	for _, e := range endpoints {
+		opts.Endpoint = e
+		if err = s.restart(opts); err == nil {
+			return opts, nil
+		}
+	}
+	return opts, err
+}
+
+// endpoints returns the endpoints of the tunnel peers.
+func (s *Supervisor) endpoints() []string {
+	var endpoints []string
+	for _, t := range s.health.Tunnels() {
+		endpoints = append(endpoints, t.Endpoint)
+	}
+	return endpoints
+}
+
+// TunnelStatus reports the current mode and the stats of the tunnel peers.
+func (s *Supervisor) TunnelStatus() control.TunnelStatus {
+	return control.TunnelStatus{
+		Mode:    s.mode.Load().(string),
+		Tunnels: s.health.Tunnels(),
+	}
+}
+
+// SwitchMode brings the tunnel back up in mode, warp, gool or psiphon:CC.
+func (s *Supervisor) SwitchMode(mode string) error {
+	gool, psiphonOpts, err := parseMode(mode)
+	if err != nil {
+		return err
+	}
+
+	if !s.mu.TryLock() {
+		return errors.New("tunnel is already being brought up")
+	}
+	defer s.mu.Unlock()
+
+	if s.opts.WireguardConfig != "" {
+		return errors.New("can't switch modes of a wireguard config")
+	}
+
+	opts := s.opts
+	opts.Gool = gool
+	opts.Psiphon = psiphonOpts
+	opts.Fallback = nil
+	opts.Bridges = nil
+	if err := s.restart(opts); err != nil {
+		return err
+	}
+	s.opts = opts
+	return nil
+}
+
+// Rescan scans for the best endpoints and brings the tunnel back up on
+// them. Later restarts keep using them, as they are remembered for the
+// network.
+func (s *Supervisor) Rescan() error {
+	if !s.mu.TryLock() {
+		return errors.New("tunnel is already being brought up")
+	}
+	defer s.mu.Unlock()
+
+	if s.opts.WireguardConfig != "" {
+		return errors.New("can't scan for endpoints of a wireguard config")
+	}
+
+	opts := s.opts
+	opts.Endpoint = ""
+	if opts.Scan == nil {
+		opts.Scan = &wiresocks.ScanOptions{V4: opts.V4, V6: opts.V6, MaxRTT: rescanMaxRTT, Prefixes: opts.ScanRanges}
+	}
+	if err := s.restart(opts); err != nil {
+		return err
+	}
+	s.opts.Endpoint = ""
+	return nil
+}
+
+// watch turns changes in the tunnel health and the warp+ data left into
+// events until ctx is done. Polling picks up every way the tunnel comes and
+// goes, including restarts and trusted networks.
+func (s *Supervisor) watch(ctx context.Context, opts WarpOptions) {
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+	quota := time.NewTicker(quotaCheckInterval)
+	defer quota.Stop()
+
+	up, healthy, checkedQuota, quotaLow := false, true, false, false
+	var unknownIndex, rotations uint64
+	checkQuota := func() {
+		checkedQuota = true
+		remaining, ok := quotaRemaining(s.l, opts)
+		if !ok {
+			return
+		}
+		if low := remaining < quotaLowThreshold; low != quotaLow {
+			quotaLow = low
+			if low {
+				s.events.emit(Event{Type: EventQuotaLow, QuotaRemaining: remaining})
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if up {
+				s.events.emit(Event{Type: EventDown})
+			}
+			return
+		case <-quota.C:
+			checkQuota()
+		case <-ticker.C:
+			mode := s.mode.Load().(string)
+			nowUp, _ := s.health.Status()
+			if nowUp != up {
+				up = nowUp
+				if up {
+					s.events.emit(Event{Type: EventUp, Mode: mode, Endpoints: s.endpoints()})
+					if !checkedQuota {
+						checkQuota()
+					}
+				} else {
+					s.events.emit(Event{Type: EventDown, Mode: mode})
+				}
+			}
+
+			// The count starts over with every device brought up
+			if n := s.health.unknownIndexPackets(); n > unknownIndex {
+				s.events.emit(Event{Type: EventStaleSession, Mode: mode, Packets: n - unknownIndex})
+				unknownIndex = n
+			} else if n < unknownIndex {
+				unknownIndex = n
+			}
+			if n := s.health.keypairRotations(); n > rotations {
+				s.events.emit(Event{Type: EventRekey, Mode: mode, Rotations: n - rotations})
+				rotations = n
+			} else if n < rotations {
+				rotations = n
+			}
+
+			if nowHealthy := s.health.Healthy(); nowHealthy != healthy {
+				healthy = nowHealthy
+				if healthy {
+					s.events.emit(Event{Type: EventRecovered, Mode: mode})
+				} else {
+					s.events.emit(Event{Type: EventStalled, Mode: mode})
+				}
+			}
+		}
+	}
+}
+
+// quotaRemaining returns the warp+ data left on the primary identity, if
+// it has a data limit.
+func quotaRemaining(l *slog.Logger, opts WarpOptions) (int64, bool) {
+	if opts.WireguardConfig != "" {
+		return 0, false
+	}
+
+	ident, err := warp.LoadIdentity(opts.identities(), "primary")
+	if err != nil {
+		return 0, false
+	}
+	account, err := warp.GetAccount(ident.Token, ident.ID)
+	if err != nil {
+		l.Debug("failed to check warp+ data left", "error", err)
+		return 0, false
+	}
+	if account.AccountType != "limited" {
+		return 0, false
+	}
+	return account.PremiumData, true
+}
@@ -0,0 +1,91 @@
+package app
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+)
+
+// bufferUnits are the multipliers of the size suffixes of buffers.
+var bufferUnits = map[string]int{
+	"": 1, "k": 1 << 10, "kib": 1 << 10, "m": 1 << 20, "mib": 1 << 20, "g": 1 << 30, "gib": 1 << 30,
+}
+
+// ParseTCPTuning parses the tuning of the TCP of the userspace stack given
+// as comma separated KEY=VALUE settings:
+//
+//	cc=reno|cubic      congestion control
+//	rcvbuf=SIZE        receive buffer of connections to start with
+//	sndbuf=SIZE        send buffer of connections to start with
+//	maxbuf=SIZE        what buffers may grow to
+//	sack=on|off        selective acknowledgements, on by default
+//	wscale=on|off      window scaling, on by default
+//	autotune=on|off    grow receive buffers with throughput, off by default
+//
+// with SIZE in bytes, or with a K, M or G suffix.
+func ParseTCPTuning(s string) (netstack.TCPTuning, error) {
+	var t netstack.TCPTuning
+	for _, setting := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(setting), "=")
+		if !ok {
+			return t, fmt.Errorf("invalid tcp setting %q: want KEY=VALUE", setting)
+		}
+
+		var err error
+		switch key {
+		case "cc":
+			if !slices.Contains(netstack.CongestionControls, value) {
+				return t, fmt.Errorf("invalid congestion control %q (valid values: %s)", value, strings.Join(netstack.CongestionControls, ", "))
+			}
+			t.CongestionControl = value
+		case "rcvbuf":
+			t.ReceiveBufferSize, err = parseBufferSize(value)
+		case "sndbuf":
+			t.SendBufferSize, err = parseBufferSize(value)
+		case "maxbuf":
+			t.MaxBufferSize, err = parseBufferSize(value)
+		case "sack":
+			var on bool
+			on, err = parseOnOff(value)
+			t.NoSACK = !on
+		case "wscale":
+			var on bool
+			on, err = parseOnOff(value)
+			t.NoWindowScaling = !on
+		case "autotune":
+			t.AutoTune, err = parseOnOff(value)
+		default:
+			return t, fmt.Errorf("unknown tcp setting %q", key)
+		}
+		if err != nil {
+			return t, fmt.Errorf("invalid tcp setting %s: %w", key, err)
+		}
+	}
+	return t, nil
+}
+
+// parseBufferSize parses a size in bytes, or with a K, M or G suffix.
+func parseBufferSize(s string) (int, error) {
+	lower := strings.ToLower(s)
+	digits := strings.TrimRight(lower, "kmgib")
+	unit, ok := bufferUnits[lower[len(digits):]]
+	n, err := strconv.Atoi(digits)
+	if !ok || err != nil || n <= 0 || n > (1<<31-1)/unit {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * unit, nil
+}
+
+func parseOnOff(s string) (bool, error) {
+	switch s {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	default:
+		return false, fmt.Errorf("want on or off, not %q", s)
+	}
+}
@@ -0,0 +1,263 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner"
+)
+
+const telemetryCrashFile = "telemetry-crashes.json"
+
+// Telemetry aggregates coarse, anonymous counts for the opt-in reporter:
+// how often each tunnel method connects, the median rtt of scans and
+// fingerprints of crashes. Nothing identifying a user, endpoint or
+// destination is kept. A nil Telemetry records nothing.
+type Telemetry struct {
+	mu       sync.Mutex
+	path     string
+	connects map[string]*connectCount
+	scans    []int64
+	// crashed is set once a panic is recorded
+	crashed atomic.Bool
+}
+
+type connectCount struct {
+	Success int `json:"success"`
+	Failure int `json:"failure"`
+}
+
+// telemetryReport is what gets sent to the endpoint.
+type telemetryReport struct {
+	Version  string                  `json:"version"`
+	OS       string                  `json:"os"`
+	Arch     string                  `json:"arch"`
+	Connects map[string]connectCount `json:"connects,omitempty"`
+	// ScanMedians holds the median rtt in milliseconds of each scan
+	ScanMedians []int64 `json:"scan_medians_ms,omitempty"`
+	// Crashes holds fingerprints of crashes since the last report
+	Crashes []string `json:"crashes,omitempty"`
+}
+
+// NewTelemetry returns a Telemetry keeping crash fingerprints in cacheDir
+// until they are reported.
+func NewTelemetry(cacheDir string) *Telemetry {
+	return &Telemetry{
+		path:     filepath.Join(cacheDir, telemetryCrashFile),
+		connects: make(map[string]*connectCount),
+	}
+}
+
+// recordConnect counts whether bringing up the tunnel with method worked.
+func (t *Telemetry) recordConnect(method string, err error) {
+	if t == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	// Keep psiphon:CC down to the method
+	method, _, _ = strings.Cut(method, ":")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.connects[method]
+	if !ok {
+		c = &connectCount{}
+		t.connects[method] = c
+	}
+	if err == nil {
+		c.Success++
+	} else {
+		c.Failure++
+	}
+}
+
+// recordScan keeps the median rtt of a scan's results.
+func (t *Telemetry) recordScan(res []ipscanner.IPInfo) {
+	if t == nil || len(res) == 0 {
+		return
+	}
+
+	rtts := make([]time.Duration, len(res))
+	for i := range res {
+		rtts[i] = res[i].RTT
+	}
+	slices.Sort(rtts)
+
+	t.mu.Lock()
+	t.scans = append(t.scans, rtts[len(rtts)/2].Milliseconds())
+	t.mu.Unlock()
+}
+
+// Recover records a fingerprint of a panic for the next report and panics
+// again. It must be deferred directly.
+func (t *Telemetry) Recover() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	t.RecordPanic(r)
+	panic(r)
+}
+
+// RecordPanic records a fingerprint of the panic r, which is being
+// recovered from on the calling goroutine, for the next report. It is meant
+// as the panic hook of devices and proxies, which panic again after. Only
+// the first panic is recorded, as that is the one crashing the process,
+// however many hooks it goes through on its way up.
+func (t *Telemetry) RecordPanic(r any) {
+	if t == nil || !t.crashed.CompareAndSwap(false, true) {
+		return
+	}
+	// The fingerprint is only sent by a later run, so it has to outlive
+	// this one.
+	_ = t.saveCrashes(append(t.loadCrashes(), crashFingerprint(r)))
+}
+
+// crashFingerprint hashes the panic's type and the functions on the stack,
+// leaving out the message, arguments and file paths, which may carry
+// addresses or usernames.
+func crashFingerprint(r any) string {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%T\n", r)
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "runtime.") {
+			fmt.Fprintln(h, frame.Function)
+		}
+		if !more {
+			break
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+func (t *Telemetry) loadCrashes() []string {
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return nil
+	}
+	var crashes []string
+	_ = json.Unmarshal(data, &crashes)
+	return crashes
+}
+
+func (t *Telemetry) saveCrashes(crashes []string) error {
+	data, err := json.Marshal(crashes)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(t.path, data, 0o600)
+}
+
+// snapshot returns what was recorded since the last reset.
+func (t *Telemetry) snapshot(version string) telemetryReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r := telemetryReport{
+		Version:     version,
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		Connects:    make(map[string]connectCount, len(t.connects)),
+		ScanMedians: slices.Clone(t.scans),
+		Crashes:     t.loadCrashes(),
+	}
+	for method, c := range t.connects {
+		if c.Success != 0 || c.Failure != 0 {
+			r.Connects[method] = *c
+		}
+	}
+	return r
+}
+
+// reset drops what r reported, keeping anything recorded since.
+func (t *Telemetry) reset(r telemetryReport) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for method, c := range r.Connects {
+		t.connects[method].Success -= c.Success
+		t.connects[method].Failure -= c.Failure
+	}
+	t.scans = t.scans[len(r.ScanMedians):]
+	if len(r.Crashes) > 0 {
+		_ = os.Remove(t.path)
+	}
+}
+
+// Report sends the recorded aggregates as JSON to endpoint every interval
+// until ctx is done. Reports with nothing new are skipped.
+func (t *Telemetry) Report(ctx context.Context, l *slog.Logger, endpoint, version string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r := t.snapshot(version)
+		if r.empty() {
+			continue
+		}
+		if err := sendTelemetry(ctx, endpoint, r); err != nil {
+			l.Debug("failed to send telemetry", "error", err)
+			continue
+		}
+		t.reset(r)
+	}
+}
+
+func (r telemetryReport) empty() bool {
+	return len(r.Connects) == 0 && len(r.ScanMedians) == 0 && len(r.Crashes) == 0
+}
+
+func sendTelemetry(ctx context.Context, endpoint string, r telemetryReport) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("telemetry endpoint returned %s", resp.Status)
+	}
+	return nil
+}
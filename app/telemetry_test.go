@@ -0,0 +1,36 @@
+package app
+
+import (
+	"testing"
+)
+
+// recovered runs f, returning the value of the panic that got out of it.
+func recovered(f func()) (r any) {
+	defer func() { r = recover() }()
+	f()
+	return nil
+}
+
+func TestTelemetryRecover(t *testing.T) {
+	tm := NewTelemetry(t.TempDir())
+
+	if r := recovered(func() { defer tm.Recover(); panic("boom") }); r != "boom" {
+		t.Fatalf("got %v out of Recover, want it to panic again", r)
+	}
+	crashes := tm.loadCrashes()
+	if len(crashes) != 1 || len(crashes[0]) != 16 {
+		t.Fatalf("got crashes %q, want one fingerprint", crashes)
+	}
+
+	// A hook further up the same goroutine sees the panic again
+	tm.RecordPanic("boom")
+	if got := tm.loadCrashes(); len(got) != 1 {
+		t.Fatalf("got crashes %q, want the panic recorded once", got)
+	}
+
+	var none *Telemetry
+	if r := recovered(func() { defer none.Recover(); panic("boom") }); r != "boom" {
+		t.Fatalf("got %v out of a nil Recover, want it to panic again", r)
+	}
+	none.RecordPanic("boom")
+}
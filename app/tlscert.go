@@ -0,0 +1,145 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+const (
+	inboundCertFile = "inbound-tls.crt"
+	inboundKeyFile  = "inbound-tls.key"
+	// legacyCertFile and legacyKeyFile held the certificate while only
+	// the socks proxy could be served over TLS
+	legacyCertFile = "socks-tls.crt"
+	legacyKeyFile  = "socks-tls.key"
+)
+
+// TLSOptions serves an inbound over TLS. When no certificate is given a
+// self-signed one is generated once and kept in the cache directory, so
+// clients only need to trust it a single time.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+}
+
+func loadCertificate(l *slog.Logger, cacheDir string, opts TLSOptions) (tls.Certificate, error) {
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		return tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	}
+
+	certPath := filepath.Join(cacheDir, inboundCertFile)
+	keyPath := filepath.Join(cacheDir, inboundKeyFile)
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return cert, err
+	}
+
+	// Clients may already trust the certificate kept for the socks proxy
+	cert, err = migrateCertificate(l, cacheDir)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return cert, err
+	}
+
+	certPEM, keyPEM, err := generateSelfSignedCert()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.MkdirAll(cacheDir, os.ModePerm); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(certPath, certPEM, 0o644); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		return tls.Certificate{}, err
+	}
+	l.Info("generated self-signed tls certificate", "path", certPath)
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// migrateCertificate moves a self-signed certificate generated for the
+// socks proxy alone to where the inbounds share it.
+func migrateCertificate(l *slog.Logger, cacheDir string) (tls.Certificate, error) {
+	legacyCertPath := filepath.Join(cacheDir, legacyCertFile)
+	legacyKeyPath := filepath.Join(cacheDir, legacyKeyFile)
+	cert, err := tls.LoadX509KeyPair(legacyCertPath, legacyKeyPath)
+	if err != nil {
+		return cert, err
+	}
+
+	certPath := filepath.Join(cacheDir, inboundCertFile)
+	if err := os.Rename(legacyKeyPath, filepath.Join(cacheDir, inboundKeyFile)); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.Rename(legacyCertPath, certPath); err != nil {
+		return tls.Certificate{}, err
+	}
+	l.Info("moved self-signed tls certificate", "from", legacyCertPath, "path", certPath)
+	return cert, nil
+}
+
+func generateSelfSignedCert() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "warp-plus"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// tlsOption loads the certificate for an inbound served over TLS.
+func tlsOption(l *slog.Logger, cacheDir string, opts TLSOptions) (wiresocks.ProxyOption, error) {
+	cert, err := loadCertificate(l, cacheDir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+	return wiresocks.WithTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}), nil
+}
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadCertificate(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+
+	cert, err := loadCertificate(l, dir, TLSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	for _, name := range []string{"localhost", "127.0.0.1", "::1"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Errorf("generated certificate isn't valid for %s: %v", name, err)
+		}
+	}
+	info, err := os.Stat(filepath.Join(dir, inboundKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("key is kept with mode %v, want 0600", info.Mode().Perm())
+	}
+
+	// Clients trust the certificate once
+	again, err := loadCertificate(l, dir, TLSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Certificate[0], cert.Certificate[0]) {
+		t.Fatal("certificate was generated again")
+	}
+
+	// A given certificate is loaded as is
+	given, err := loadCertificate(l, t.TempDir(), TLSOptions{
+		CertFile: filepath.Join(dir, inboundCertFile),
+		KeyFile:  filepath.Join(dir, inboundKeyFile),
+	})
+	if err != nil || !bytes.Equal(given.Certificate[0], cert.Certificate[0]) {
+		t.Fatalf("given certificate not loaded: %v", err)
+	}
+	if _, err := loadCertificate(l, dir, TLSOptions{CertFile: filepath.Join(dir, inboundCertFile)}); err == nil {
+		t.Fatal("loaded a given certificate without its key")
+	}
+}
+
+func TestLoadCertificateMigrates(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	certPEM, keyPEM, err := generateSelfSignedCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, legacyCertFile), certPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, legacyKeyFile), keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := loadCertificate(l, dir, TLSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := os.ReadFile(filepath.Join(dir, inboundCertFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(kept, certPEM) {
+		t.Fatal("certificate of the socks proxy was not kept")
+	}
+	if block, _ := pem.Decode(certPEM); !bytes.Equal(cert.Certificate[0], block.Bytes) {
+		t.Fatal("loaded certificate is not the kept one")
+	}
+	for _, name := range []string{legacyCertFile, legacyKeyFile} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const torStartTimeout = 30 * time.Second
+
+// TorOptions routes .onion addresses and the listed domains through Tor.
+type TorOptions struct {
+	// SOCKS is the address of the Tor SOCKS port
+	SOCKS   netip.AddrPort
+	Domains []string
+}
+
+// StartTor launches the tor binary found in PATH with a SOCKS port on a
+// free loopback port and its data kept under cacheDir. Tor is stopped when
+// ctx is done.
+func StartTor(ctx context.Context, l *slog.Logger, cacheDir string) (netip.AddrPort, error) {
+	l = l.With("subsystem", "tor")
+
+	bin, err := exec.LookPath("tor")
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("tor not found: %w", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	socks := ln.Addr().(*net.TCPAddr).AddrPort()
+	_ = ln.Close()
+
+	dataDir := filepath.Join(cacheDir, "tor")
+	if err := os.MkdirAll(dataDir, 0o700); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	cmd := exec.CommandContext(ctx, bin,
+		"--SocksPort", socks.String(),
+		"--DataDirectory", dataDir,
+		"--Log", "notice stdout",
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if err := cmd.Start(); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	ready := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		opened := false
+		for scanner.Scan() {
+			line := scanner.Text()
+			l.Debug(line)
+			if !opened && strings.Contains(line, "Opened Socks listener") {
+				opened = true
+				close(ready)
+			}
+			if strings.Contains(line, "Bootstrapped 100%") {
+				l.Info("tor bootstrapped")
+			}
+		}
+		_ = cmd.Wait()
+		if ctx.Err() == nil {
+			l.Error("tor exited unexpectedly")
+		}
+	}()
+
+	select {
+	case <-ready:
+	case <-time.After(torStartTimeout):
+		_ = cmd.Process.Kill()
+		return netip.AddrPort{}, fmt.Errorf("tor did not open its socks port within %s", torStartTimeout)
+	case <-ctx.Done():
+		return netip.AddrPort{}, ctx.Err()
+	}
+
+	l.Info("tor started", "socks", socks)
+	return socks, nil
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultTrustedCheckInterval = 10 * time.Second
+
+// TrustedNetworkOptions lists networks on which the tunnel is kept down.
+// A network is trusted when the current Wi-Fi SSID or the MAC address of
+// the default gateway matches one of the configured values.
+type TrustedNetworkOptions struct {
+	SSIDs       []string
+	GatewayMACs []string
+	Interval    time.Duration
+}
+
+// matchTrustedNetwork reports whether the current network is trusted and
+// which rule matched.
+func matchTrustedNetwork(opts TrustedNetworkOptions) (bool, string) {
+	if len(opts.SSIDs) > 0 {
+		if ssid, err := currentSSID(); err == nil && ssid != "" {
+			for _, s := range opts.SSIDs {
+				if s == ssid {
+					return true, "ssid=" + ssid
+				}
+			}
+		}
+	}
+
+	if len(opts.GatewayMACs) > 0 {
+		if mac, err := defaultGatewayMAC(); err == nil && mac != "" {
+			mac = normalizeMAC(mac)
+			for _, m := range opts.GatewayMACs {
+				if normalizeMAC(m) == mac {
+					return true, "gateway=" + mac
+				}
+			}
+		}
+	}
+
+	return false, ""
+}
+
+// normalizeMAC returns mac as lower case octets of two digits separated by
+// colons, as macOS leaves the leading zeros of octets out and Windows
+// separates them with dashes. A mac that doesn't parse is only lower cased.
+func normalizeMAC(mac string) string {
+	octets := strings.Split(strings.ReplaceAll(mac, "-", ":"), ":")
+	if len(octets) != 6 {
+		return strings.ToLower(mac)
+	}
+	for i, octet := range octets {
+		b, err := strconv.ParseUint(octet, 16, 8)
+		if err != nil {
+			return strings.ToLower(mac)
+		}
+		octets[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(octets, ":")
+}
+
+// watchTrustedNetworks periodically checks the current network and brings
+// the tunnel down while on a trusted network, and back up when leaving it.
+func watchTrustedNetworks(ctx context.Context, l *slog.Logger, opts WarpOptions) {
+	l = l.With("subsystem", "trusted-network")
+
+	trusted := *opts.TrustedNetworks
+	opts.TrustedNetworks = nil
+
+	interval := trusted.Interval
+	if interval <= 0 {
+		interval = defaultTrustedCheckInterval
+	}
+
+	var cancel context.CancelFunc
+	stop := func() {
+		if cancel != nil {
+			cancel()
+			cancel = nil
+		}
+	}
+	defer stop()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	first := true
+	for {
+		onTrusted, match := matchTrustedNetwork(trusted)
+		switch {
+		case onTrusted && (cancel != nil || first):
+			l.Info("on trusted network, tunnel disabled", "match", match)
+			stop()
+		case !onTrusted && cancel == nil:
+			l.Info("not on a trusted network, enabling tunnel")
+			runCtx, runCancel := context.WithCancel(ctx)
+			if err := RunWarp(runCtx, l, opts); err != nil {
+				l.Error("failed to bring up tunnel", "error", err)
+				runCancel()
+				break
+			}
+			cancel = runCancel
+		}
+		first = false
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
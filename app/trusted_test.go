@@ -0,0 +1,17 @@
+package app
+
+import "testing"
+
+func TestNormalizeMAC(t *testing.T) {
+	for mac, want := range map[string]string{
+		"aa:bb:cc:dd:ee:ff": "aa:bb:cc:dd:ee:ff",
+		"0:1b:c:d:e:f":      "00:1b:0c:0d:0e:0f",
+		"AA-BB-0C-0D-0E-0F": "aa:bb:0c:0d:0e:0f",
+		"Not-A-Mac":         "not-a-mac",
+		"1:2:3:4:5:100":     "1:2:3:4:5:100",
+	} {
+		if got := normalizeMAC(mac); got != want {
+			t.Errorf("normalizeMAC(%q) = %q, want %q", mac, got, want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/bepass-org/warp-plus/wireguard/device"
+	wgtun "github.com/bepass-org/warp-plus/wireguard/tun"
+)
+
+const tunName = "warp0"
+
+// srcValidMark is the sysctl letting replies to marked packets pass reverse
+// path filtering.
+const srcValidMark = "/proc/sys/net/ipv4/conf/all/src_valid_mark"
+
+func newNormalTun(l *slog.Logger, _ []netip.Addr, addr netip.Addr) (wgtun.Device, error) {
+	tunDev, err := wgtun.CreateTUN(tunName, 1280)
+	if err != nil {
+		return nil, err
+	}
+
+	// Renumber the interface if warp's address collides with the LAN and
+	// translate between the two on the way through
+	local := tunnelAddress(addr)
+	if local != addr {
+		l.Warn("tunnel address collides with a local network, renumbering", "assigned", addr, "local", local)
+	}
+
+	prefix := netip.PrefixFrom(local, tunnelPrefixBits).String()
+	if err := ipCommand("-4", "address", "replace", prefix, "dev", tunName); err != nil {
+		tunDev.Close()
+		return nil, err
+	}
+	if err := ipCommand("link", "set", tunName, "mtu", "1280", "up"); err != nil {
+		tunDev.Close()
+		return nil, err
+	}
+
+	return newNATTun(tunDev, local, addr), nil
+}
+
+// routeTun points the default route of ipv4, and of ipv6 if the tun
+// interface has an ipv6 address, at the tun interface through a dedicated
+// routing table, the way wg-quick does. Wireguard's own sockets carry fwmark
+// and skip that table, so the encrypted traffic keeps using the real
+// default route instead of looping back into the tunnel. Bypass prefixes
+// are looked up in the main table ahead of all that. The rules are removed
+// and src_valid_mark put back again when ctx is done; the routes go away
+// with the interface.
+func routeTun(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
+	fwmark, table := opts.FwMark, opts.RouteTable
+	if fwmark == 0 {
+		return errors.New("tun mode on linux requires a non-zero fwmark")
+	}
+
+	mark, tbl := strconv.FormatUint(uint64(fwmark), 10), strconv.FormatUint(uint64(table), 10)
+	rules := [][]string{
+		{"not", "fwmark", mark, "table", tbl},
+		{"table", "main", "suppress_prefixlength", "0"},
+	}
+
+	var installed [][]string
+	cleanup := func() {
+		for i := len(installed) - 1; i >= 0; i-- {
+			args := append([]string{installed[i][0], "rule", "delete"}, installed[i][1:]...)
+			if err := ipCommand(args...); err != nil {
+				l.Warn("failed to remove routing rule", "error", err)
+			}
+		}
+	}
+
+	// Routing v6 into the interface without a v6 address on it would only
+	// blackhole it
+	v6 := hasIPv6Address(tunName)
+	families := []string{"-4"}
+	if v6 {
+		families = append(families, "-6")
+	} else {
+		l.Info("tun interface has no ipv6 address, leaving ipv6 routes alone")
+	}
+
+	for _, family := range families {
+		if err := ipCommand(family, "route", "replace", "default", "dev", tunName, "table", tbl); err != nil {
+			cleanup()
+			return err
+		}
+		for _, rule := range rules {
+			if err := ipCommand(append([]string{family, "rule", "add"}, rule...)...); err != nil {
+				cleanup()
+				return err
+			}
+			installed = append(installed, append([]string{family}, rule...))
+		}
+	}
+
+	// Rules added later take precedence, so these win over the ones above
+	for _, prefix := range bypassPrefixes(opts.BypassCIDRs) {
+		rule := []string{"-4", "to", prefix.String(), "table", "main"}
+		if prefix.Addr().Is6() {
+			if !v6 {
+				continue
+			}
+			rule[0] = "-6"
+		}
+		if err := ipCommand(append([]string{rule[0], "rule", "add"}, rule[1:]...)...); err != nil {
+			cleanup()
+			return err
+		}
+		installed = append(installed, rule)
+	}
+
+	// Enable srcValidMark, putting it back as it was once done
+	restoreSysctl := func() {}
+	if prev, err := os.ReadFile(srcValidMark); err != nil {
+		l.Warn("failed to enable src_valid_mark", "error", err)
+	} else if strings.TrimSpace(string(prev)) != "1" {
+		if err := os.WriteFile(srcValidMark, []byte("1"), 0o644); err != nil {
+			l.Warn("failed to enable src_valid_mark", "error", err)
+		} else {
+			restoreSysctl = func() {
+				if err := os.WriteFile(srcValidMark, prev, 0o644); err != nil {
+					l.Warn("failed to restore src_valid_mark", "error", err)
+				}
+			}
+		}
+	}
+
+	l.Info("routing through tun", "table", table, "fwmark", fwmark)
+
+	go func() {
+		<-ctx.Done()
+		cleanup()
+		restoreSysctl()
+	}()
+
+	if opts.Sidecar {
+		return lockdownSidecar(ctx, l, opts)
+	}
+	return nil
+}
+
+// hasIPv6Address reports whether the interface name has a global ipv6
+// address.
+func hasIPv6Address(name string) bool {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return false
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() == nil && ipnet.IP.IsGlobalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+func ipCommand(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func bindToIface(_ *device.Device) error {
+	return nil
+}
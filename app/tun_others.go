@@ -1,15 +1,17 @@
-//go:build !windows
+//go:build !windows && !linux
 
 package app
 
 import (
+	"context"
+	"log/slog"
 	"net/netip"
 
 	"github.com/bepass-org/warp-plus/wireguard/device"
 	wgtun "github.com/bepass-org/warp-plus/wireguard/tun"
 )
 
-func newNormalTun(_ []netip.Addr) (wgtun.Device, error) {
+func newNormalTun(_ *slog.Logger, _ []netip.Addr, _ netip.Addr) (wgtun.Device, error) {
 	tunDev, err := wgtun.CreateTUN("warp0", 1280)
 	if err != nil {
 		return nil, err
@@ -20,3 +22,7 @@ func newNormalTun(_ []netip.Addr) (wgtun.Device, error) {
 func bindToIface(_ *device.Device) error {
 	return nil
 }
+
+func routeTun(_ context.Context, _ *slog.Logger, _ WarpOptions) error {
+	return nil
+}
@@ -3,8 +3,10 @@
 package app
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/netip"
 
@@ -20,7 +22,7 @@ const wintunGUID = "c33d325f-20cd-44e5-998c-19b0c15b4df1"
 const family4 = winipcfg.AddressFamily(windows.AF_INET)
 const family6 = winipcfg.AddressFamily(windows.AF_INET6)
 
-func newNormalTun(dns []netip.Addr) (wgtun.Device, error) {
+func newNormalTun(l *slog.Logger, dns []netip.Addr, addr netip.Addr) (wgtun.Device, error) {
 	guid, _ := windows.GUIDFromString(wintunGUID)
 	tunDev, err := wgtun.CreateTUNWithRequestedGUID("warp0", &guid, 1280)
 	if err != nil {
@@ -30,7 +32,14 @@ func newNormalTun(dns []netip.Addr) (wgtun.Device, error) {
 	nativeTunDevice := tunDev.(*tun.NativeTun)
 	luid := winipcfg.LUID(nativeTunDevice.LUID())
 
-	err = luid.SetIPAddressesForFamily(family4, []netip.Prefix{netip.MustParsePrefix("172.16.0.2/24")})
+	// Renumber the interface if warp's address collides with the LAN and
+	// translate between the two on the way through
+	local := tunnelAddress(addr)
+	if local != addr {
+		l.Warn("tunnel address collides with a local network, renumbering", "assigned", addr, "local", local)
+	}
+
+	err = luid.SetIPAddressesForFamily(family4, []netip.Prefix{netip.PrefixFrom(local, tunnelPrefixBits)})
 	if err != nil {
 		return nil, err
 	}
@@ -103,14 +112,72 @@ tryAgain6:
 		return nil, fmt.Errorf("unable to set DNS: %w", err)
 	}
 
-	return tunDev, nil
+	return newNATTun(tunDev, local, addr), nil
 
 }
 
-func getAutoDetectInterfaceByFamily(family winipcfg.AddressFamily) (string, error) {
+// routeTun adds routes for the bypass prefixes through the physical default
+// gateway, at the metric of its default route, so they are kept off the
+// tunnel. newNormalTun routes everything else through the interface and
+// bindToIface keeps wireguard's own traffic off it. The routes are removed
+// again when ctx is done.
+func routeTun(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
+	type gateway struct {
+		luid    winipcfg.LUID
+		nextHop netip.Addr
+		metric  uint32
+	}
+	gateways := make(map[winipcfg.AddressFamily]*gateway)
+	for _, family := range []winipcfg.AddressFamily{family4, family6} {
+		ifaceM, nextHop, route, err := defaultGatewayByFamily(family)
+		if err != nil {
+			l.Debug("no default gateway to bypass the tunnel through", "family", family, "error", err)
+			continue
+		}
+		gateways[family] = &gateway{luid: ifaceM.LUID, nextHop: nextHop, metric: route.Metric}
+	}
+
+	type route struct {
+		gw     *gateway
+		prefix netip.Prefix
+	}
+	var added []route
+	for _, prefix := range bypassPrefixes(opts.BypassCIDRs) {
+		family := family4
+		if prefix.Addr().Is6() {
+			family = family6
+		}
+		gw := gateways[family]
+		if gw == nil {
+			continue
+		}
+		err := gw.luid.AddRoute(prefix, gw.nextHop, gw.metric)
+		if errors.Is(err, windows.ERROR_OBJECT_ALREADY_EXISTS) {
+			continue
+		} else if err != nil {
+			l.Warn("failed to add bypass route", "prefix", prefix, "error", err)
+			continue
+		}
+		added = append(added, route{gw: gw, prefix: prefix})
+	}
+
+	go func() {
+		<-ctx.Done()
+		for _, r := range added {
+			if err := r.gw.luid.DeleteRoute(r.prefix, r.gw.nextHop); err != nil {
+				l.Warn("failed to remove bypass route", "prefix", r.prefix, "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// defaultGatewayByFamily finds the physical interface holding the default
+// route of family, along with its next hop and the route itself.
+func defaultGatewayByFamily(family winipcfg.AddressFamily) (*winipcfg.IPAdapterAddresses, netip.Addr, *winipcfg.MibIPforwardRow2, error) {
 	interfaces, err := winipcfg.GetAdaptersAddresses(family, winipcfg.GAAFlagIncludeGateways)
 	if err != nil {
-		return "", fmt.Errorf("get default interface failure. %w", err)
+		return nil, netip.Addr{}, nil, fmt.Errorf("get default interface failure. %w", err)
 	}
 
 	var destination netip.Prefix
@@ -125,22 +192,28 @@ func getAutoDetectInterfaceByFamily(family winipcfg.AddressFamily) (string, erro
 			continue
 		}
 
-		ifname := ifaceM.FriendlyName()
-
-		if ifname == "warp0" {
+		if ifaceM.FriendlyName() == "warp0" {
 			continue
 		}
 
 		for gatewayAddress := ifaceM.FirstGatewayAddress; gatewayAddress != nil; gatewayAddress = gatewayAddress.Next {
 			nextHop, _ := netip.AddrFromSlice(gatewayAddress.Address.IP())
 
-			if _, err = ifaceM.LUID.Route(destination, nextHop.Unmap()); err == nil {
-				return ifname, nil
+			if route, err := ifaceM.LUID.Route(destination, nextHop.Unmap()); err == nil {
+				return ifaceM, nextHop.Unmap(), route, nil
 			}
 		}
 	}
 
-	return "", errors.New("interface not found")
+	return nil, netip.Addr{}, nil, errors.New("interface not found")
+}
+
+func getAutoDetectInterfaceByFamily(family winipcfg.AddressFamily) (string, error) {
+	ifaceM, _, _, err := defaultGatewayByFamily(family)
+	if err != nil {
+		return "", err
+	}
+	return ifaceM.FriendlyName(), nil
 }
 
 func bindToIface(dev *device.Device) error {
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// lowMemoryUDPFlows bounds the UDP flows under the low memory profile,
+// each of which holds a socket, a goroutine and its reply buffer.
+const lowMemoryUDPFlows = 256
+
+// ParseUDPTimeouts parses the idle timeouts of UDP flows given as comma
+// separated settings, each a DURATION for flows to any port, quic=DURATION
+// for flows recognized as QUIC or PORT=DURATION for flows to that port,
+// such as "5m,quic=2m,53=10s". What is not given keeps the timeouts of
+// wiresocks.DefaultUDPTimeouts.
+func ParseUDPTimeouts(s string) (wiresocks.UDPTimeouts, error) {
+	t := wiresocks.DefaultUDPTimeouts.Clone()
+	if s == "" {
+		return t, nil
+	}
+
+	for _, setting := range strings.Split(s, ",") {
+		setting = strings.TrimSpace(setting)
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			value = setting
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Second {
+			return t, fmt.Errorf("invalid udp timeout %q: want a duration of at least 1s", setting)
+		}
+
+		switch {
+		case !ok:
+			t.Default = d
+		case key == "quic":
+			t.QUIC = d
+		default:
+			p, err := strconv.ParseUint(key, 10, 16)
+			if err != nil || p == 0 {
+				return t, fmt.Errorf("invalid udp timeout %q: want quic or a port, not %q", setting, key)
+			}
+			t.Ports[uint16(p)] = d
+		}
+	}
+	return t, nil
+}
+
+// NewUDPNAT returns the UDP NAT table shared by the proxies, with the idle
+// timeouts in timeouts as parsed by ParseUDPTimeouts and at most maxFlows
+// flows, or 0 for the default, which is lower under the low memory
+// profile.
+func NewUDPNAT(timeouts string, maxFlows int, lowMemory bool) (*wiresocks.UDPNAT, error) {
+	t, err := ParseUDPTimeouts(timeouts)
+	if err != nil {
+		return nil, err
+	}
+	if maxFlows == 0 && lowMemory {
+		maxFlows = lowMemoryUDPFlows
+	}
+	return wiresocks.NewUDPNAT(maxFlows, t), nil
+}
@@ -0,0 +1,36 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+func TestParseUDPTimeouts(t *testing.T) {
+	got, err := ParseUDPTimeouts("2m, quic=30s,53=5s,27015=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Default != 2*time.Minute || got.QUIC != 30*time.Second || got.Ports[53] != 5*time.Second || got.Ports[27015] != time.Hour {
+		t.Fatalf("got %+v", got)
+	}
+	if wiresocks.DefaultUDPTimeouts.Ports[53] != 10*time.Second {
+		t.Fatal("default timeouts modified")
+	}
+
+	// What isn't given keeps the defaults
+	got, err = ParseUDPTimeouts("443=2m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Default != wiresocks.DefaultUDPTimeouts.Default || got.QUIC != wiresocks.DefaultUDPTimeouts.QUIC || got.Ports[53] != 10*time.Second {
+		t.Fatalf("got %+v, want the defaults besides port 443", got)
+	}
+
+	for _, s := range []string{"500ms", "5", "quic=", "dns=10s", "0=10s", "65536=10s", "5m,,"} {
+		if _, err := ParseUDPTimeouts(s); err == nil {
+			t.Errorf("parsed invalid timeouts %q", s)
+		}
+	}
+}
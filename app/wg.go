@@ -4,12 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/bepass-org/warp-plus/masque"
 	"github.com/bepass-org/warp-plus/wireguard/conn"
 	"github.com/bepass-org/warp-plus/wireguard/device"
 	wgtun "github.com/bepass-org/warp-plus/wireguard/tun"
@@ -93,14 +95,64 @@ func waitHandshake(ctx context.Context, l *slog.Logger, dev *device.Device) erro
 	return nil
 }
 
-func establishWireguard(l *slog.Logger, conf *wiresocks.Configuration, tunDev wgtun.Device, bind bool, fwmark uint32, t string) error {
+// newBind returns the bind a tunnel to the warp endpoints sends its
+// traffic through.
+func (opts WarpOptions) newBind(l *slog.Logger) conn.Bind {
+	if opts.Masque != "" {
+		return masque.NewBind(l.With("subsystem", "masque"), opts.Masque)
+	}
+	return conn.NewDefaultBind()
+}
+
+func establishWireguard(ctx context.Context, l *slog.Logger, conf *wiresocks.Configuration, tunDev wgtun.Device, wgBind conn.Bind, bind bool, fwmark uint32, t string, health *Health, telemetry *Telemetry) (*device.Device, error) {
+	if conf.Interface.FEC != "" {
+		data, parity, err := conn.ParseFEC(conf.Interface.FEC)
+		if err != nil {
+			return nil, err
+		}
+		wgBind = conn.NewFECBind(wgBind, data, parity)
+	}
+
 	// create the IPC message to establish the wireguard conn
 	var request bytes.Buffer
 
 	request.WriteString(fmt.Sprintf("private_key=%s\n", conf.Interface.PrivateKey))
+	if conf.Interface.ListenPort != 0 {
+		request.WriteString(fmt.Sprintf("listen_port=%d\n", conf.Interface.ListenPort))
+	}
 	if bind && fwmark != 0 {
 		request.WriteString(fmt.Sprintf("fwmark=%d\n", fwmark))
 	}
+	if conf.Interface.CipherSuite != "" {
+		request.WriteString(fmt.Sprintf("cipher_suite=%s\n", conf.Interface.CipherSuite))
+	}
+	if conf.Interface.ReorderDepth > 0 {
+		request.WriteString(fmt.Sprintf("reorder_depth=%d\n", conf.Interface.ReorderDepth))
+	}
+	if conf.Interface.Shaping != "" {
+		request.WriteString(fmt.Sprintf("shaping=%s\n", conf.Interface.Shaping))
+	}
+	if conf.Interface.DecoyInterval > 0 {
+		request.WriteString(fmt.Sprintf("decoy_interval=%d\n", conf.Interface.DecoyInterval))
+	}
+	if conf.Interface.InitFragments > 0 {
+		request.WriteString(fmt.Sprintf("init_fragments=%d\n", conf.Interface.InitFragments))
+	}
+	if conf.Interface.InitJunk > 0 {
+		request.WriteString(fmt.Sprintf("init_junk=%d\n", conf.Interface.InitJunk))
+	}
+	if conf.Interface.InitMimic != "" {
+		request.WriteString(fmt.Sprintf("init_mimic=%s\n", conf.Interface.InitMimic))
+	}
+	if conf.Interface.UnknownIndexRecovery {
+		request.WriteString("unknown_index_recovery=true\n")
+	}
+	if conf.Interface.PresharedMAC1 {
+		request.WriteString("preshared_mac1=true\n")
+	}
+	if conf.Interface.KnockKey != "" {
+		request.WriteString(fmt.Sprintf("knock_key=%s\n", conf.Interface.KnockKey))
+	}
 
 	for _, peer := range conf.Peers {
 		request.WriteString(fmt.Sprintf("public_key=%s\n", peer.PublicKey))
@@ -117,31 +169,48 @@ func establishWireguard(l *slog.Logger, conf *wiresocks.Configuration, tunDev wg
 
 	dev := device.NewDevice(
 		tunDev,
-		conn.NewDefaultBind(),
+		wgBind,
 		device.NewSLogger(l.With("subsystem", "wireguard-go")),
 	)
 
+	dev.SetPathDegradedHandler(func(publicKey device.NoisePublicKey, reason string) {
+		l.Warn("peer path degrading", "peer", base64.StdEncoding.EncodeToString(publicKey[:]), "reason", reason)
+	})
+	if telemetry != nil {
+		dev.SetPanicHook(telemetry.RecordPanic)
+	}
+
 	if err := dev.IpcSet(request.String()); err != nil {
-		return err
+		return nil, err
 	}
 
 	if err := dev.Up(); err != nil {
-		return err
+		return nil, err
 	}
 
 	if bind {
 		if err := bindToIface(dev); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
+	hctx, cancel := context.WithDeadline(ctx, time.Now().Add(15*time.Second))
 	defer cancel()
-	if err := waitHandshake(ctx, l, dev); err != nil {
+	if err := waitHandshake(hctx, l, dev); err != nil {
 		dev.BindClose()
 		dev.Close()
-		return err
+		return nil, err
 	}
 
-	return nil
+	health.track(ctx, dev)
+
+	// Tear the device down together with the context so the tunnel can be
+	// brought up again later in the same process.
+	go func() {
+		<-ctx.Done()
+		dev.BindClose()
+		dev.Close()
+	}()
+
+	return dev, nil
 }
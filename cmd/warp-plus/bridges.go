@@ -0,0 +1,34 @@
+package main
+
+import (
+	_ "embed"
+	"os"
+
+	"github.com/bepass-org/warp-plus/update"
+)
+
+// builtinBridges is the bridge list shipped with the binary, trusted as is.
+// Release builds may fill bridges.json with community bridges.
+//
+//go:embed bridges.json
+var builtinBridges []byte
+
+// bridgesKey is the minisign public key bridge lists are signed with, set at
+// build time by the release workflow. --bridges-key overrides it.
+var bridgesKey string = ""
+
+// loadBridgesKey parses key, a .pub file or base64, or bridgesKey if empty.
+// It reports false if there is neither.
+func loadBridgesKey(key string) (update.PublicKey, bool, error) {
+	if key == "" {
+		key = bridgesKey
+	}
+	if key == "" {
+		return update.PublicKey{}, false, nil
+	}
+	if data, err := os.ReadFile(key); err == nil {
+		key = string(data)
+	}
+	k, err := update.ParsePublicKey(key)
+	return k, err == nil, err
+}
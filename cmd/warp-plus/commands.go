@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bepass-org/warp-plus/control"
+	"github.com/bepass-org/warp-plus/i18n"
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wiresocks"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffhelp"
+)
+
+// commands are subcommands, most of which talk to a running instance through
+// its control api.
+var commands = map[string]func(c *control.Client, args []string) error{
+	"config":      pushConfig,
+	"connections": listConnections,
+	"devices":     manageDevices,
+	"endpoints":   manageEndpoints,
+	"power":       managePower,
+	"kill":        killConnection,
+	"logs":        dumpLogs,
+	"peers":       managePeers,
+	"relay":       runRelay,
+	"status":      showStatus,
+	"tui":         runTUI,
+	"upgrade":     upgradeInstance,
+	"update":      updateBinary,
+}
+
+// runCommand runs the subcommand named by args[0], if there is one, and
+// reports whether it handled the invocation.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return false
+	}
+
+	fs := ff.NewFlagSet(appName + " " + args[0])
+	addr := fs.StringLong("control", control.DefaultAddress, "control api address of the running instance")
+	token := fs.StringLong("control-token", "", "bearer token for the control api")
+	ca := fs.StringLong("control-ca", "", "talk to the control api over tls, trusting the cas in this file")
+	cert := fs.StringLong("control-client-cert", "", "talk to the control api over tls, presenting this client certificate file")
+	key := fs.StringLong("control-client-key", "", "private key file for --control-client-cert")
+	lang := fs.StringLong("lang", "", fmt.Sprintf("language of the output (valid values: %s, default: from the locale)", i18n.Tags))
+
+	err := ff.Parse(fs, args[1:], envOptions...)
+	if err == nil {
+		err = setLanguage(*lang)
+	}
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs))
+		os.Exit(0)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, i18n.T("error: %v", err))
+		os.Exit(1)
+	}
+
+	c := control.NewClient(*addr).WithToken(*token)
+	if *ca != "" || *cert != "" || *key != "" {
+		config, err := control.ClientTLSConfig(*ca, *cert, *key)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, i18n.T("error: %v", err))
+			os.Exit(1)
+		}
+		c = c.WithTLS(config)
+	}
+
+	if err := cmd(c, fs.GetArgs()); err != nil {
+		fmt.Fprintln(os.Stderr, i18n.T("error: %v", err))
+		os.Exit(1)
+	}
+	return true
+}
+
+// showStatus prints the mode and the peers of the tunnel with the latency
+// percentiles of their handshakes.
+func showStatus(c *control.Client, _ []string) error {
+	var status control.TunnelStatus
+	if err := c.Do(http.MethodGet, "/tunnel", &status); err != nil {
+		return err
+	}
+
+	fmt.Println(i18n.T("mode: %s", status.Mode))
+	if len(status.Tunnels) == 0 {
+		fmt.Println(i18n.T("no tunnel is up"))
+		return nil
+	}
+
+	millis := func(ms int64) string {
+		if ms == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%d ms", ms)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, i18n.T("ENDPOINT\tLAST HANDSHAKE\tRTT\tHANDSHAKES\tP50\tP95\tP99\tKEY AGE\tROTATIONS"))
+	for _, t := range status.Tunnels {
+		handshake := i18n.T("never")
+		if !t.LastHandshake.IsZero() {
+			handshake = i18n.T("%s ago", time.Since(t.LastHandshake).Truncate(time.Second))
+		}
+		keyAge := "-"
+		if !t.KeypairCreated.IsZero() {
+			keyAge = time.Since(t.KeypairCreated).Truncate(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%d\n", t.Endpoint, handshake, millis(t.RTTMillis),
+			t.Handshakes, millis(t.HandshakeP50Millis), millis(t.HandshakeP95Millis), millis(t.HandshakeP99Millis),
+			keyAge, t.KeypairRotations)
+	}
+	return w.Flush()
+}
+
+func listConnections(c *control.Client, _ []string) error {
+	var flows []wiresocks.Flow
+	if err := c.Do(http.MethodGet, "/connections", &flows); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, i18n.T("ID\tSOURCE\tDESTINATION\tPROTOCOL\tSENT\tRECEIVED\tAGE"))
+	for _, f := range flows {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\t%s\n",
+			f.ID, f.Source, f.Destination, f.Protocol, f.BytesSent, f.BytesReceived,
+			time.Since(f.Started).Truncate(time.Second))
+	}
+	return w.Flush()
+}
+
+func killConnection(c *control.Client, args []string) error {
+	if len(args) != 1 {
+		return errors.New(i18n.T("usage: kill <id>"))
+	}
+	if _, err := strconv.ParseUint(args[0], 10, 64); err != nil {
+		return fmt.Errorf(i18n.T("invalid connection id: %w"), err)
+	}
+	return c.Do(http.MethodDelete, "/connections/"+args[0], nil)
+}
+
+func manageDevices(c *control.Client, args []string) error {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		return listDevices(c)
+	case args[0] == "remove" && len(args) > 1:
+		for _, id := range args[1:] {
+			if err := c.Do(http.MethodDelete, "/devices/"+url.PathEscape(id), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	case args[0] == "bind" && len(args) == 1:
+		return c.Do(http.MethodPost, "/devices/bind", nil)
+	}
+	return errors.New(i18n.T("usage: devices [list | remove <id>... | bind]"))
+}
+
+func manageEndpoints(c *control.Client, args []string) error {
+	switch {
+	case len(args) == 0 || args[0] == "list" && len(args) == 1:
+		var scores []control.EndpointScore
+		if err := c.Do(http.MethodGet, "/endpoints", &scores); err != nil {
+			return err
+		}
+		return printEndpointScores(scores)
+	case args[0] == "scan" && len(args) == 1:
+		var scores []control.EndpointScore
+		if err := c.WithTimeout(reconfigureTimeout).Do(http.MethodPost, "/endpoints/scan", &scores); err != nil {
+			return err
+		}
+		return printEndpointScores(scores)
+	case args[0] == "use" && len(args) > 1:
+		return c.WithTimeout(reconfigureTimeout).Send(http.MethodPost, "/endpoints/use", args[1:])
+	}
+	return errors.New(i18n.T("usage: endpoints [list | scan | use <endpoint>...]"))
+}
+
+func managePower(c *control.Client, args []string) error {
+	switch len(args) {
+	case 0:
+		var status control.PowerStatus
+		if err := c.Do(http.MethodGet, "/power", &status); err != nil {
+			return err
+		}
+		if status.Hinted {
+			fmt.Println(i18n.T("tuned for %s power, as set", status.Source))
+		} else {
+			fmt.Println(i18n.T("tuned for %s power, as detected", status.Source))
+		}
+		return nil
+	case 1:
+		return c.Do(http.MethodPost, "/power/"+url.PathEscape(args[0]), nil)
+	}
+	return errors.New(i18n.T("usage: power [ac | battery | auto]"))
+}
+
+func printEndpointScores(scores []control.EndpointScore) error {
+	if len(scores) == 0 {
+		fmt.Println(i18n.T("no endpoints were scanned yet, run 'endpoints scan'"))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, i18n.T("ENDPOINT\tSCORE\tRTT\tJITTER\tLOSS\tSCANNED"))
+	for _, s := range scores {
+		fmt.Fprintf(w, "%s\t%d ms\t%d ms\t%d ms\t%.0f%%\t%s\n", s.Endpoint, s.ScoreMillis, s.RTTMillis, s.JitterMillis,
+			100*s.Loss, i18n.T("%s ago", time.Since(s.ScannedAt).Truncate(time.Second)))
+	}
+	return w.Flush()
+}
+
+func listDevices(c *control.Client) error {
+	var devices []control.Device
+	if err := c.Do(http.MethodGet, "/devices", &devices); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, i18n.T("ID\tNAME\tTYPE\tMODEL\tCREATED\tACTIVE"))
+	for _, d := range devices {
+		id, active := d.ID, i18n.T("no")
+		if d.Current {
+			id += " *"
+		}
+		if d.Active {
+			active = i18n.T("yes")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", id, d.Name, d.Type, d.Model, d.Created, active)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("%d of %d devices bound, * marks this instance", len(devices), warp.MaxDevices))
+	return nil
+}
+
+// pushConfig sends a remote config and its minisign signature, by default
+// the file next to it with .minisig appended.
+func pushConfig(c *control.Client, args []string) error {
+	if len(args) < 2 || len(args) > 3 || args[0] != "push" {
+		return errors.New(i18n.T("usage: config push <file> [signature]"))
+	}
+	sigFile := args[1] + ".minisig"
+	if len(args) == 3 {
+		sigFile = args[2]
+	}
+
+	config, err := os.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+	sig, err := os.ReadFile(sigFile)
+	if err != nil {
+		return err
+	}
+	return c.WithTimeout(reconfigureTimeout).Send(http.MethodPost, "/config", control.SignedConfig{Config: config, Signature: string(sig)})
+}
+
+func dumpLogs(c *control.Client, _ []string) error {
+	return c.Stream(http.MethodGet, "/logs", os.Stdout)
+}
+
+func upgradeInstance(c *control.Client, _ []string) error {
+	// The new process brings its tunnel up before the request completes
+	return c.WithTimeout(upgradeTimeout+10*time.Second).Do(http.MethodPost, "/upgrade", nil)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/bepass-org/warp-plus/app"
+	"github.com/bepass-org/warp-plus/i18n"
+	"github.com/peterbourgon/ff/v4"
+)
+
+// secretFlags are printed redacted by --dry-run.
+var secretFlags = []string{"key", "control-token", "control-read-token", "shadowsocks-password", "vless-id", "chain", "knock-key"}
+
+// urlFlags may carry credentials in their urls, which --dry-run redacts.
+var urlFlags = []string{"masque", "bridges", "scan-ranges", "telemetry", "authorize-peers"}
+
+// printDryRun writes the effective value of every flag with where it was
+// given, and how the tunnel would be brought up with opts.
+func printDryRun(ctx context.Context, l *slog.Logger, w io.Writer, fs *ff.FlagSet, args []string, opts app.WarpOptions) {
+	sources, _ := flagSources(fs, args)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, i18n.T("FLAG\tVALUE\tFROM"))
+	_ = fs.WalkFlags(func(f ff.Flag) error {
+		name, ok := f.GetLongName()
+		if !ok {
+			short, _ := f.GetShortName()
+			name = string(short)
+		}
+		value := redactFlag(name, f.GetValue())
+
+		from := i18n.T("default")
+		if f.IsSet() {
+			from = "--" + name
+			for _, s := range sources {
+				if s.name == name {
+					from = s.where
+					break
+				}
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", name, value, from)
+		return nil
+	})
+	_ = tw.Flush()
+
+	plan := app.PlanWarp(ctx, l, opts)
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if plan.Tun {
+		fmt.Fprintln(tw, i18n.T("mode\t%s in tun mode", plan.Mode))
+	} else {
+		fmt.Fprintln(tw, i18n.T("mode\t%s", plan.Mode))
+	}
+	if plan.Network != "" {
+		fmt.Fprintln(tw, i18n.T("network\t%s", plan.Network))
+	}
+	switch plan.EndpointSource {
+	case app.PlanEndpointGiven:
+		fmt.Fprintln(tw, i18n.T("endpoint\t%s", plan.Endpoint))
+	case app.PlanEndpointRemembered:
+		fmt.Fprintln(tw, i18n.T("endpoint\t%s, remembered for this network", plan.Endpoint))
+	case app.PlanEndpointRandom:
+		fmt.Fprintln(tw, i18n.T("endpoint\ta random warp endpoint"))
+	}
+	if plan.Scan {
+		fmt.Fprintln(tw, i18n.T("scan\tthe best scanned endpoints are used instead"))
+	}
+	if plan.MTU != 0 {
+		fmt.Fprintln(tw, i18n.T("mtu\t%d", plan.MTU))
+		fmt.Fprintln(tw, i18n.T("keepalive\t%v", plan.Keepalive))
+	}
+	if len(plan.Transports) > 0 {
+		if plan.Race {
+			fmt.Fprintln(tw, i18n.T("transports\t%s, all at once", strings.Join(plan.Transports, ", ")))
+		} else {
+			fmt.Fprintln(tw, i18n.T("transports\t%s, in turn", strings.Join(plan.Transports, ", ")))
+		}
+	}
+	for _, ident := range plan.Identities {
+		if ident.Cached {
+			fmt.Fprintln(tw, i18n.T("identity %s\tdevice %s, %s account", ident.Name, ident.DeviceID, ident.AccountType))
+		} else {
+			fmt.Fprintln(tw, i18n.T("identity %s\tto be registered", ident.Name))
+		}
+	}
+	_ = tw.Flush()
+}
+
+// redactFlag returns value, the value of the flag name, with the secrets
+// it may carry redacted.
+func redactFlag(name, value string) string {
+	switch {
+	case value == "":
+	case slices.Contains(secretFlags, name):
+		value = "REDACTED"
+	case slices.Contains(urlFlags, name):
+		values := strings.Split(value, ", ")
+		for i, v := range values {
+			values[i] = app.RedactURL(v)
+		}
+		value = strings.Join(values, ", ")
+	case name == "api-header":
+		values := strings.Split(value, ", ")
+		for i, v := range values {
+			header, _, _ := strings.Cut(v, ":")
+			values[i] = header + ": REDACTED"
+		}
+		value = strings.Join(values, ", ")
+	}
+	return value
+}
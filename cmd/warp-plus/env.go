@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/peterbourgon/ff/v4"
+)
+
+// envPrefix is the prefix of environment variables that set flags, e.g.
+// WARP_BIND for --bind or WARP_DIRECT_DOMAIN for --direct-domain.
+const envPrefix = "WARP"
+
+// envOptions makes ff.Parse read flags from the environment. Repeatable
+// flags take one value per line, which suits multi-line values in
+// container manifests.
+var envOptions = []ff.Option{
+	ff.WithEnvVarPrefix(envPrefix),
+	ff.WithEnvVarSplit("\n"),
+}
+
+// trimEnv trims surrounding whitespace left over by multi-line values off
+// the WARP_* variables that set flags of fs.
+func trimEnv(fs *ff.FlagSet) {
+	known := envKeys(fs)
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if !known[key] {
+			continue
+		}
+		if trimmed := strings.TrimSpace(value); trimmed != value {
+			os.Setenv(key, trimmed)
+		}
+	}
+}
+
+// unknownEnv returns the WARP_* variables that set no flag of fs, which
+// are warned about as likely typos but not rejected, since other tools
+// sharing the environment may use the prefix too. The identity store's
+// own WARP_PLUS_IDENTITY_* variables are left out.
+func unknownEnv(fs *ff.FlagSet) []string {
+	known := envKeys(fs)
+	var unknown []string
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(key, envPrefix+"_") && !known[key] && !strings.HasPrefix(key, warp.DefaultIdentityEnvPrefix+"_") {
+			unknown = append(unknown, key)
+		}
+	}
+	return unknown
+}
+
+// envKeys returns the environment variables of the flags of fs.
+func envKeys(fs *ff.FlagSet) map[string]bool {
+	known := make(map[string]bool)
+	_ = fs.WalkFlags(func(f ff.Flag) error {
+		if short, ok := f.GetShortName(); ok {
+			known[envKey(string(short))] = true
+		}
+		if long, ok := f.GetLongName(); ok {
+			known[envKey(long)] = true
+		}
+		return nil
+	})
+	return known
+}
+
+// envKey maps a flag name to its environment variable the way ff does.
+func envKey(name string) string {
+	return envPrefix + "_" + strings.NewReplacer("-", "_", ".", "_", "/", "_").Replace(strings.ToUpper(name))
+}
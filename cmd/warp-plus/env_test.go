@@ -0,0 +1,36 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/peterbourgon/ff/v4"
+)
+
+func TestEnv(t *testing.T) {
+	t.Setenv("WARP_BIND", " 127.0.0.1:9000\n")
+	t.Setenv("WARP_BINDD", "127.0.0.1:9001")
+	t.Setenv("WARP_PLUS_IDENTITY_PRIMARY", "{}")
+
+	fs := ff.NewFlagSet(appName)
+	bind := fs.String('b', "bind", "127.0.0.1:8086", "")
+	fs.StringLong("config", "", "")
+
+	// A typo is no reason not to start
+	if err := parseFlags(fs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if *bind != "127.0.0.1:9000" {
+		t.Fatalf("got bind %q, want it trimmed", *bind)
+	}
+
+	unknown := unknownEnv(fs)
+	if !slices.Contains(unknown, "WARP_BINDD") {
+		t.Fatalf("got unknown %v, want WARP_BINDD", unknown)
+	}
+	for _, key := range []string{"WARP_BIND", "WARP_PLUS_IDENTITY_PRIMARY"} {
+		if slices.Contains(unknown, key) {
+			t.Fatalf("got unknown %v, want no %s", unknown, key)
+		}
+	}
+}
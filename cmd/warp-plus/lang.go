@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"syscall"
+
+	"github.com/bepass-org/warp-plus/i18n"
+)
+
+// setLanguage selects the output language by tag, keeping the one detected
+// from the locale if tag is empty.
+func setLanguage(tag string) error {
+	if tag == "" {
+		return nil
+	}
+	lang, ok := i18n.Lookup(tag)
+	if !ok {
+		return fmt.Errorf("unsupported language %q (valid values: %s)", tag, i18n.Tags)
+	}
+	i18n.Set(lang)
+	return nil
+}
+
+// listenFlags maps the addresses the flags make the process listen on to
+// the flags, for explain to point at the one whose address is taken. It is
+// filled in by listensOn while the flags are parsed.
+var listenFlags = make(map[string]string)
+
+// listensOn records that flag makes the process listen on address.
+func listensOn(flag, address string) {
+	listenFlags[address] = "--" + flag
+}
+
+// explain returns advice on an error users commonly run into, or "" if
+// there is none.
+func explain(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return i18n.T("The tunnel could not be established in time. The endpoint may be blocked on this network, try --scan to find another one, or --gool or --cfon.")
+	case errors.Is(err, syscall.EADDRINUSE):
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Addr != nil {
+			if flag, ok := listenFlags[opErr.Addr.String()]; ok {
+				return i18n.T("The address %s is already in use, possibly by another instance. Choose another one with %s.", opErr.Addr, flag)
+			}
+		}
+		return i18n.T("The address is already in use, possibly by another instance.")
+	case errors.Is(err, fs.ErrPermission):
+		return i18n.T("Permission denied. Tun mode and ports below 1024 need root, or an administrator on Windows.")
+	}
+	return ""
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/i18n"
+)
+
+func TestExplainAddressInUse(t *testing.T) {
+	defer i18n.Set(i18n.Current())
+	i18n.Set(i18n.English)
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	address := taken.Addr().String()
+
+	_, err = net.Listen("tcp", address)
+	if err == nil {
+		t.Fatal("listened on a taken address")
+	}
+	// Wrapped on its way up like the errors of the proxy listeners
+	err = fmt.Errorf("failed to listen on %s: %w", address, err)
+
+	if got := explain(err); !strings.Contains(got, "already in use") || strings.Contains(got, "--") {
+		t.Errorf("explain of an address no flag listens on = %q, want no flag named", got)
+	}
+
+	defer clear(listenFlags)
+	listensOn("bind", "127.0.0.1:8086")
+	listensOn("control", address)
+	if got := explain(err); !strings.Contains(got, address) || !strings.Contains(got, "--control") {
+		t.Errorf("explain = %q, want it to point at --control", got)
+	}
+}
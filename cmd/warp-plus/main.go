@@ -5,31 +5,75 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
 	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/adrg/xdg"
 	"github.com/bepass-org/warp-plus/app"
+	"github.com/bepass-org/warp-plus/control"
+	"github.com/bepass-org/warp-plus/doh"
+	"github.com/bepass-org/warp-plus/i18n"
+	"github.com/bepass-org/warp-plus/logring"
+	"github.com/bepass-org/warp-plus/masque"
+	"github.com/bepass-org/warp-plus/proxy/pkg/shadowsocks"
 	p "github.com/bepass-org/warp-plus/psiphon"
+	"github.com/bepass-org/warp-plus/update"
+	"github.com/bepass-org/warp-plus/upgrade"
 	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wireguard/device"
 	"github.com/bepass-org/warp-plus/wiresocks"
 
 	"github.com/carlmjohnson/versioninfo"
 	"github.com/peterbourgon/ff/v4"
 	"github.com/peterbourgon/ff/v4/ffhelp"
-	"github.com/peterbourgon/ff/v4/ffjson"
 )
 
 const appName = "warp-plus"
 
+// healthCheckInterval is how often --exit-on-unhealthy checks the tunnel.
+const healthCheckInterval = 10 * time.Second
+
+// telemetryInterval is how often --telemetry reports.
+const telemetryInterval = time.Hour
+
+const (
+	// upgradeTimeout is how long the upgraded process gets to come up
+	upgradeTimeout = 2 * time.Minute
+	// drainTimeout is how long connections are given to finish after an
+	// upgrade before the old process exits anyway
+	drainTimeout = 30 * time.Minute
+)
+
+// lowMemoryLogRing is the --log-ring default under --low-memory.
+const lowMemoryLogRing = 100
+
 var version string = ""
 
 func main() {
+	i18n.Set(i18n.Detect())
+
+	if runCommand(os.Args[1:]) {
+		return
+	}
+
+	args := os.Args[1:]
 	fs := ff.NewFlagSet(appName)
+	var soak *soakFlags
+	if len(args) > 0 && args[0] == "soak" {
+		args = args[1:]
+		fs = ff.NewFlagSet(appName + " soak")
+		soak = addSoakFlags(fs)
+	}
 	var (
 		v4       = fs.BoolShort('4', "only use IPv4 for random warp endpoint")
 		v6       = fs.BoolShort('6', "only use IPv6 for random warp endpoint")
@@ -37,33 +81,127 @@ func main() {
 		bind     = fs.String('b', "bind", "127.0.0.1:8086", "socks bind address")
 		endpoint = fs.String('e', "endpoint", "", "warp endpoint")
 		key      = fs.String('k', "key", "", "warp key")
+		xBinds   = fs.StringListLong("extra-bind", "also serve the proxy on this address, or on a unix socket as unix:PATH (repeatable)")
+		sockMode = fs.StringLong("socket-mode", "0600", "file permissions of the unix sockets of --extra-bind")
+		srcAllow = fs.StringListLong("allow-source", "only let connections in to the proxy and other inbounds from loopback and this CIDR, as CIDR for every inbound or ADDR:PORT=CIDR for the one bound there (repeatable)")
 		dns      = fs.StringLong("dns", "1.1.1.1", "DNS address")
 		gool     = fs.BoolLong("gool", "enable gool mode (warp in warp)")
 		psiphon  = fs.BoolLong("cfon", "enable psiphon mode (must provide country as well)")
 		country  = fs.StringEnumLong("country", fmt.Sprintf("psiphon country code (valid values: %s)", p.Countries), p.Countries...)
 		scan     = fs.BoolLong("scan", "enable warp scanning")
 		rtt      = fs.DurationLong("rtt", 1000*time.Millisecond, "scanner rtt limit")
+		scanRngs = fs.StringListLong("scan-ranges", "scan this file or url listing CIDRs, or 'cloudflare' for the published edge ranges, instead of the pinned warp prefixes (repeatable)")
 		cacheDir = fs.StringLong("cache-dir", "", "directory to store generated profiles")
+		idStore  = fs.StringLong("identity-store", "", "keep the warp identities here instead of the cache dir: file:DIR, env[:PREFIX], vault:MOUNT/PATH or k8s:DIR")
 		tun      = fs.BoolLong("tun-experimental", "enable tun interface (experimental)")
 		fwmark   = fs.UintLong("fwmark", 0x1375, "set linux firewall mark for tun mode")
+		rtTable  = fs.UintLong("route-table", 51820, "linux routing table for tun mode routes")
+		bypass   = fs.StringListLong("bypass-cidr", "keep this CIDR off the tunnel in tun mode, in addition to the LAN ranges (repeatable)")
+		sidecar  = fs.BoolLong("sidecar", "run as a container network sidecar: tun mode with all traffic bypassing the tunnel blocked (linux only)")
+		listen   = fs.StringListLong("listener", "serve another proxy through a tunnel of its own, as ADDR=MODE with MODE warp, gool or psiphon:CC (repeatable)")
+		routes   = fs.StringListLong("route", "send connections to a domain and its subdomains, or a CIDR, through an outbound, as MATCH=TAG with TAG warp, gool, psiphon:CC, wireguard, direct or block (repeatable)")
+		splitDNS = fs.StringListLong("split-dns-domain", "in tun mode, resolve only this domain and its subdomains through the tunnel dns (repeatable)")
 		reserved = fs.StringLong("reserved", "", "override wireguard reserved value (format: '1,2,3')")
+		apiVer   = fs.StringLong("api-version", warp.DefaultClientProfile.APIVersion, "warp api version path, tracking the official client build")
+		apiUA    = fs.StringLong("api-user-agent", warp.DefaultClientProfile.UserAgent, "user agent sent to the warp api")
+		apiCV    = fs.StringLong("api-client-version", warp.DefaultClientProfile.ClientVersion, "CF-Client-Version sent to the warp api")
+		apiType  = fs.StringLong("api-device-type", warp.DefaultClientProfile.DeviceType, "device type registered with the warp api")
+		apiModel = fs.StringLong("api-device-model", warp.DefaultClientProfile.DeviceModel, "device model registered with the warp api")
+		apiHdrs  = fs.StringListLong("api-header", "send this header to the warp api, as 'Name: value' (repeatable)")
 		wgConf   = fs.StringLong("wgconf", "", "path to a normal wireguard config")
+		power    = fs.StringLong("power", "", "tune keepalives, crypto workers and background scans for the power source, 'auto' to detect it or 'ac' or 'battery'")
+		keepIntv = fs.StringLong("keepalive", "5s", "keepalive interval of warp peers, or 'adaptive' to measure the nat timeout of the network and keep alive just often enough (proxy mode only)")
+		standby  = fs.BoolLong("standby", "keep a second tunnel up to the next best endpoint and move connections to it as soon as the first one degrades")
+		race     = fs.BoolLong("race", "connect to the endpoint, the best scanned endpoint and through --masque at once at startup, keeping the first to come up")
+		fallback = fs.StringLong("fallback", "", "bring the tunnel up over the first of these comma separated transports that works, trying those that worked on the network before first: warp, gool, masque or psiphon:CC")
+		masq     = fs.StringLong("masque", "", "send the wireguard traffic through this connect-udp (MASQUE) proxy over HTTP/3, a host or a URI template with {target_host} and {target_port}")
+		bridges  = fs.StringListLong("bridges", "bring the tunnel up through the first community bridge that works, from this file or url of a signed bridge list or 'builtin' (repeatable)")
+		brFront  = fs.StringLong("bridges-front", "", "fetch bridge list urls by connecting to this domain fronting host instead")
+		brKey    = fs.StringLong("bridges-key", "", "minisign public key bridge lists are signed with, a .pub file or base64 (default: the release key)")
+		preUp    = fs.StringListLong("pre-up", "run this shell command before the tunnel comes up, %i is replaced with the interface (repeatable)")
+		postUp   = fs.StringListLong("post-up", "run this shell command after the tunnel came up (repeatable)")
+		preDown  = fs.StringListLong("pre-down", "run this shell command before the tunnel goes down (repeatable)")
+		postDown = fs.StringListLong("post-down", "run this shell command after the tunnel went down (repeatable)")
+		tSSIDs   = fs.StringListLong("trusted-ssid", "disable the tunnel while connected to this Wi-Fi SSID (repeatable)")
+		tGWs     = fs.StringListLong("trusted-gateway", "disable the tunnel while the default gateway has this MAC address (repeatable)")
+		dnsOnly  = fs.BoolLong("dns-only", "skip the tunnel and only run a local encrypted DNS resolver")
+		dnsBind  = fs.StringLong("dns-bind", "127.0.0.1:5053", "dns-only resolver bind address")
+		dnsFilt  = fs.StringEnumLong("dns-filter", fmt.Sprintf("dns-only filtering variant (valid values: %s)", doh.Filters), doh.Filters...)
+		dnsProto = fs.StringEnumLong("dns-protocol", "dns-only upstream protocol (valid values: doh, dot)", string(doh.ProtocolDoH), string(doh.ProtocolDoT))
+		gwDoH    = fs.StringLong("gateway-doh", "", "zero trust dns location id to resolve through in dns-only mode (default: that of the zero trust account the identity is enrolled in, without --dns-filter)")
+		dnsBoot  = fs.StringListLong("dns-bootstrap", "reach the dns-only upstream at this address instead of its published ones (repeatable)")
+		blkPage  = fs.StringLong("block-page", "", "serve a page explaining gateway blocked domains on this address")
+		direct   = fs.StringListLong("direct-domain", "route this domain and its subdomains around the tunnel, matched by SNI/Host for raw IPs (repeatable)")
+		ctlAddr  = fs.StringLong("control", "", "serve the control api on this address (e.g. "+control.DefaultAddress+")")
+		ctlAdmin = fs.StringListLong("control-token", "require this bearer token for the control api, allowing everything (repeatable)")
+		ctlRead  = fs.StringListLong("control-read-token", "also accept this bearer token, allowing only read-only requests (repeatable)")
+		ctlCert  = fs.StringLong("control-cert", "", "serve the control api over tls with this certificate file")
+		ctlKey   = fs.StringLong("control-key", "", "private key file for --control-cert")
+		ctlCA    = fs.StringLong("control-client-ca", "", "only accept control api clients with a certificate signed by a ca in this file")
+		rmtKey   = fs.StringLong("remote-key", "", "accept configs pushed to the control api signed with this minisign public key, a .pub file or base64")
+		autoUpd  = fs.BoolLong("auto-update", "install signed new releases automatically and restart into them")
+		telURL   = fs.StringLong("telemetry", "", "opt in to sending anonymous aggregates (connect success by mode, scan rtt medians, crash fingerprints) to this url")
+		notify   = fs.BoolLong("notify", "show desktop notifications when the tunnel connects, disconnects, stalls or runs low on warp+ data")
+		auditLog = fs.StringLong("audit-log", "", "append identity, endpoint and control api changes to this file as json lines")
+		evSock   = fs.StringLong("event-socket", "", "stream state events as newline delimited json on this unix socket, or to the named pipe already there")
+		exitBad  = fs.BoolLong("exit-on-unhealthy", "exit once the tunnel is wedged so a supervisor can restart it")
+		cpuRX    = fs.StringLong("cpu-rx", "", "pin udp receive workers to these cpus (e.g. '0-3' or 'node0', linux only)")
+		cpuCrypt = fs.StringLong("cpu-crypto", "", "pin crypto workers to these cpus (e.g. '4-7' or 'node1', linux only)")
+		cpuTX    = fs.StringLong("cpu-tx", "", "pin udp send workers to these cpus (e.g. '0-3' or 'node0', linux only)")
+		keyLog   = fs.StringLong("insecure-keylog", "", "append wireguard session keys to this file in wireshark keylog format, letting anyone who reads it decrypt the tunnel (wgkeylog builds only)")
+		lowMem   = fs.BoolLong("low-memory", "shrink queues and buffers for low-RAM devices such as routers")
+		tcpTune  = fs.StringLong("tcp-tuning", "", "tune the tcp of the userspace stack, as comma separated cc=reno|cubic, rcvbuf=SIZE, sndbuf=SIZE, maxbuf=SIZE, sack=on|off, wscale=on|off and autotune=on|off")
+		udpTime  = fs.StringLong("udp-timeout", "", "close proxied udp flows idle for this long, as comma separated DURATION for any port, quic=DURATION for flows recognized as quic and PORT=DURATION for a port (default: 5m,quic=1m,53=10s)")
+		udpFlows = fs.UintLong("udp-max-flows", 0, "keep at most this many proxied udp flows open, closing the least recently used first (0 for 1024, 256 with --low-memory)")
+		captive  = fs.BoolLong("captive-portal", "detect captive portals and let portal traffic bypass the tunnel until logged in")
+		sockTLS  = fs.BoolLong("socks-tls", "serve the proxy over tls, with a self-signed certificate unless one is given")
+		tlsCert  = fs.StringLong("tls-cert", "", "certificate file for --socks-tls and --vless-tls")
+		tlsKey   = fs.StringLong("tls-key", "", "private key file for --socks-tls and --vless-tls")
+		stun     = fs.StringEnumLong("stun", fmt.Sprintf("handle webrtc stun and turn through the proxy: allow like other traffic, block, or tunnel to keep direct and route rules from leaking the real address (valid values: %s)", wiresocks.STUNPolicies), wiresocks.STUNPolicies...)
+		rResolve = fs.BoolLong("remote-resolve", "resolve the SNI/Host of connections to literal IPs inside the tunnel")
+		sniffPts = fs.StringLong("sniff-ports", "", "sniff the SNI/Host of connections to literal IPs only on these comma separated ports, where clients speak first (default: 80,443,8080,8443)")
+		ssBind   = fs.StringLong("shadowsocks", "", "serve a shadowsocks inbound on this address (e.g. 0.0.0.0:8388)")
+		ssMethod = fs.StringEnumLong("shadowsocks-method", fmt.Sprintf("shadowsocks cipher (valid values: %s)", shadowsocks.Methods()), shadowsocks.Methods()...)
+		ssPass   = fs.StringLong("shadowsocks-password", "", "shadowsocks password")
+		vlBind   = fs.StringLong("vless", "", "serve a vless inbound on this address (e.g. 0.0.0.0:443)")
+		vlIDs    = fs.StringListLong("vless-id", "vless user id, a uuid or any string of up to 30 bytes (repeatable)")
+		vlTLS    = fs.BoolLong("vless-tls", "serve the vless inbound over tls, with a self-signed certificate unless one is given")
+		chain    = fs.StringLong("chain", "", "exit through this vless:// or trojan:// server after the tunnel (trojan carries tcp only)")
+		tor      = fs.StringLong("tor", "", "route .onion and --tor-domain through tor, given its socks address or 'launch' to start tor from PATH")
+		torDoms  = fs.StringListLong("tor-domain", "route this domain and its subdomains through tor (repeatable)")
+		reorder  = fs.UintLong("reorder-depth", 0, "hold back up to this many out of order packets on receive to resequence them (0 to disable)")
+		shaping  = fs.StringLong("shaping", "", fmt.Sprintf("pad and pace sent packets to look like this kind of traffic, at the cost of bandwidth (valid values: %s)", device.ShapingProfiles()))
+		decoy    = fs.DurationLong("decoy", 0, "send a few dummy packets whenever the tunnel has been idle for about this long, so it doesn't go silent (0 to disable)")
+		initFrag = fs.UintLong("init-fragments", 0, "split handshake initiations over up to this many datagrams, for a relay restoring them (0 to disable)")
+		initJunk = fs.UintLong("init-junk", 0, "wrap handshake initiations after up to this many random bytes, for a relay restoring them (0 to disable)")
+		initMimc = fs.StringLong("init-mimic", "", "make handshake initiations look like a quic initial, for a relay or warp-plus peer stripping it (valid values: quic)")
+		recStale = fs.BoolLong("recover-stale", "handshake right away with peers still sending on sessions from before a restart")
+		knockKey = fs.StringLong("knock-key", "", "knock with this base64 key before handshakes, which --wgconf peers running warp-plus with it drop unanswered otherwise")
+		pskMAC   = fs.BoolLong("psk-mac", "key handshake macs by the preshared key too, so only --wgconf peers running warp-plus with it get an answer")
+		fec      = fs.StringLong("fec", "", "add parity datagrams at this DATA:PARITY ratio, such as 4:1, to rebuild lost ones at --wgconf peers running warp-plus with the same ratio")
+		authPeer = fs.StringLong("authorize-peers", "", "ask this webhook (http(s)://...) or radius server (radius://SECRET@HOST[:PORT]) about unknown peers handshaking with the --wgconf device, adding those it allows")
+		rslvDoH  = fs.BoolLong("resolve-doh", "resolve host name endpoints of --wgconf peers over DoH to 1.1.1.1 instead of plain dns to --dns")
+		fwdPings = fs.BoolLong("forward-pings", "answer pings --wgconf peers send through the tunnel to other hosts by pinging them from this host, in proxy mode")
+		mtu      = fs.UintLong("mtu", 0, "override the tunnel mtu, remembered for the current network (0 for default)")
+		lang     = fs.StringLong("lang", "", fmt.Sprintf("language of command output, error explanations and pages (valid values: %s, default: from the locale)", i18n.Tags))
+		logRing  = fs.UintLong("log-ring", 1000, "number of recent log records kept for dumping via the control api (0 to disable, 100 unless given with --low-memory)")
+		ringDbg  = fs.BoolLong("log-ring-debug", "keep debug records in the log ring too, which has every one of them built even when not written")
+		preset   = fs.StringLong("preset", "", fmt.Sprintf("default flags not given otherwise to those of this preset, a name or a .json file (builtin: %s)", presetNames()))
+		dryRun   = fs.BoolLong("dry-run", "print the effective flags, where each was given, and how the tunnel would be brought up, then exit without connecting")
 		_        = fs.String('c', "config", "", "path to config file")
 		verFlag  = fs.BoolLong("version", "displays version number")
 	)
 
-	err := ff.Parse(
-		fs,
-		os.Args[1:],
-		ff.WithConfigFileFlag("config"),
-		ff.WithConfigFileParser(ffjson.Parse),
-	)
+	err := parseFlags(fs, args)
+	if err == nil {
+		err = setLanguage(*lang)
+	}
 	switch {
 	case errors.Is(err, ff.ErrHelp):
 		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs))
 		os.Exit(0)
 	case err != nil:
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		fmt.Fprintln(os.Stderr, i18n.T("error: %v", err))
 		os.Exit(1)
 	}
 
@@ -75,28 +213,94 @@ func main() {
 		os.Exit(0)
 	}
 
-	l := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	var handler slog.Handler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo})
 
 	if *verbose {
-		l = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		handler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
 	}
 
-	if *psiphon && *gool {
-		fatal(l, errors.New("can't use cfon and gool at the same time"))
+	if f, _ := fs.GetFlag("log-ring"); *lowMem && !f.IsSet() {
+		*logRing = lowMemoryLogRing
 	}
 
-	if *v4 && *v6 {
-		fatal(l, errors.New("can't force v4 and v6 at the same time"))
+	var logs *logring.Ring
+	if *logRing > 0 {
+		level := slog.LevelInfo
+		if *ringDbg {
+			level = slog.LevelDebug
+		}
+		logs = logring.New(int(*logRing))
+		handler = logring.NewHandler(logs, level, handler)
+	}
+
+	l := slog.New(handler)
+
+	for _, key := range unknownEnv(fs) {
+		l.Warn("ignoring environment variable that sets no flag", "name", key)
+	}
+
+	if *preset != "" {
+		l.Info("preset applied, flags given explicitly take precedence", "preset", *preset)
 	}
 
 	if !*v4 && !*v6 {
 		*v4, *v6 = true, true
 	}
 
+	if *cpuRX != "" || *cpuCrypt != "" || *cpuTX != "" {
+		var affinity device.WorkerAffinity
+		for _, c := range []struct {
+			list string
+			cpus *[]int
+		}{{*cpuRX, &affinity.RX}, {*cpuCrypt, &affinity.Crypto}, {*cpuTX, &affinity.TX}} {
+			if *c.cpus, err = device.ParseCPUList(c.list); err != nil {
+				fatal(l, fmt.Errorf("invalid cpu list: %w", err))
+			}
+		}
+		if err := device.SetWorkerAffinity(affinity); err != nil {
+			fatal(l, err)
+		}
+		l.Info("worker cpu affinity enabled", "rx", affinity.RX, "crypto", affinity.Crypto, "tx", affinity.TX)
+	}
+
+	if *keyLog != "" {
+		f, err := os.OpenFile(*keyLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			fatal(l, fmt.Errorf("failed to open keylog: %w", err))
+		}
+		if err := device.SetKeyLog(f); err != nil {
+			fatal(l, err)
+		}
+		l.Warn("logging wireguard session keys, the tunnel is not private", "path", *keyLog)
+	}
+
+	if *mtu != 0 && (*mtu < 1280 || *mtu > 1500) {
+		fatal(l, errors.New("mtu must be between 1280 and 1500"))
+	}
+
+	apiProfile := warp.DefaultClientProfile
+	apiProfile.APIVersion = *apiVer
+	apiProfile.UserAgent = *apiUA
+	apiProfile.ClientVersion = *apiCV
+	apiProfile.DeviceType = *apiType
+	apiProfile.DeviceModel = *apiModel
+	for _, h := range *apiHdrs {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			fatal(l, fmt.Errorf("invalid api header %q: want 'Name: value'", h))
+		}
+		if apiProfile.Headers == nil {
+			apiProfile.Headers = make(map[string]string)
+		}
+		apiProfile.Headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	warp.SetClientProfile(apiProfile)
+
 	bindAddrPort, err := netip.ParseAddrPort(*bind)
 	if err != nil {
 		fatal(l, fmt.Errorf("invalid bind address: %w", err))
 	}
+	listensOn("bind", bindAddrPort.String())
 
 	dnsAddr, err := netip.ParseAddr(*dns)
 	if err != nil {
@@ -111,8 +315,55 @@ func main() {
 		Gool:            *gool,
 		Tun:             *tun,
 		FwMark:          uint32(*fwmark),
+		RouteTable:      uint32(*rtTable),
+		SplitDNSDomains: *splitDNS,
+		Sidecar:         *sidecar,
 		WireguardConfig: *wgConf,
 		Reserved:        *reserved,
+		DirectDomains:   *direct,
+		Conns:           wiresocks.NewConnTracker(),
+		Health:          app.NewHealth(),
+		Scores:          app.NewEndpointScores(),
+		Outbounds:       wiresocks.NewOutbounds(),
+		LowMemory:       *lowMem,
+		V4:              *v4,
+		V6:              *v6,
+		MTU:             int(*mtu),
+		ReorderDepth:    int(*reorder),
+		RecoverStale:    *recStale,
+		PresharedMAC:    *pskMAC,
+		KnockKey:        *knockKey,
+		FEC:             *fec,
+		AuthorizePeers:  *authPeer,
+		ResolveDoH:      *rslvDoH,
+		ForwardPings:    *fwdPings,
+		CaptivePortal:   *captive,
+		RemoteResolve:   *rResolve,
+		STUNPolicy:      wiresocks.STUNPolicy(*stun),
+		ExtraBinds:      *xBinds,
+	}
+
+	var sourceRules []wiresocks.SourceRule
+	for _, s := range *srcAllow {
+		r, err := wiresocks.ParseSourceRule(s)
+		if err != nil {
+			fatal(l, err)
+		}
+		sourceRules = append(sourceRules, r)
+	}
+	opts.SourceACL = wiresocks.NewSourceACL(sourceRules)
+
+	if len(*xBinds) > 0 {
+		mode, err := strconv.ParseUint(*sockMode, 8, 32)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid socket mode: %w", err))
+		}
+		opts.SocketMode = os.FileMode(mode)
+		for _, b := range *xBinds {
+			if _, address, err := wiresocks.ParseBind(b); err == nil {
+				listensOn("extra-bind", address)
+			}
+		}
 	}
 
 	switch {
@@ -125,6 +376,126 @@ func main() {
 	default:
 		opts.CacheDir = "warp_plus_cache"
 	}
+	if *idStore != "" {
+		if opts.Identities, err = warp.OpenIdentityStore(*idStore, opts.CacheDir); err != nil {
+			fatal(l, err)
+		}
+	}
+
+	if *auditLog != "" {
+		audit, err := app.OpenAudit(l, *auditLog)
+		if err != nil {
+			fatal(l, err)
+		}
+		opts.Audit = audit
+	}
+
+	if *masq != "" {
+		opts.Masque = *masq
+		if !strings.Contains(opts.Masque, "://") {
+			opts.Masque = fmt.Sprintf(masque.DefaultTemplate, opts.Masque)
+		}
+		u, err := masque.Expand(opts.Masque, netip.AddrPortFrom(netip.IPv4Unspecified(), 0))
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid masque proxy: %w", err))
+		}
+		l.Info("sending wireguard traffic through masque proxy", "proxy", u.Host)
+	}
+
+	if *fallback != "" {
+		if opts.Fallback, err = app.ParseFallback(*fallback); err != nil {
+			fatal(l, fmt.Errorf("invalid fallback chain: %w", err))
+		}
+		if (opts.Masque != "") != slices.Contains(opts.Fallback, "masque") {
+			fatal(l, errors.New("the fallback chain must include masque exactly when --masque is given"))
+		}
+		l.Info("fallback enabled", "transports", opts.Fallback)
+	}
+
+	opts.Race = *race
+
+	if *keepIntv == "adaptive" {
+		if *tun || *sidecar {
+			fatal(l, errors.New("adaptive keepalive only works in proxy mode"))
+		}
+		l.Info("adaptive keepalive enabled")
+		opts.AdaptiveKeepalive = true
+	} else {
+		d, err := time.ParseDuration(*keepIntv)
+		if err != nil || d < time.Second || d > math.MaxUint16*time.Second {
+			fatal(l, fmt.Errorf("invalid keepalive interval: %q", *keepIntv))
+		}
+		opts.Keepalive = d
+	}
+
+	if *shaping != "" {
+		if !slices.Contains(device.ShapingProfiles(), *shaping) {
+			fatal(l, fmt.Errorf("unknown shaping profile: %q", *shaping))
+		}
+		l.Info("traffic shaping enabled", "profile", *shaping)
+		opts.Shaping = *shaping
+	}
+
+	if *decoy != 0 {
+		if *decoy < time.Second || *decoy > math.MaxUint16*time.Second {
+			fatal(l, fmt.Errorf("invalid decoy interval: %v", *decoy))
+		}
+		l.Info("decoy traffic enabled", "interval", *decoy)
+		opts.Decoy = *decoy
+	}
+
+	if *initFrag != 0 || *initJunk != 0 {
+		if *initFrag == 1 || *initFrag > device.MaxInitiationFragments || *initJunk > device.MaxInitiationJunk {
+			fatal(l, fmt.Errorf("initiations can be split over 2 to %d datagrams and wrapped after up to %d bytes of junk", device.MaxInitiationFragments, device.MaxInitiationJunk))
+		}
+		l.Info("initiation framing enabled, the endpoint must be a relay", "fragments", *initFrag, "junk", *initJunk)
+		opts.InitFragments = int(*initFrag)
+		opts.InitJunk = int(*initJunk)
+	}
+
+	if *initMimc != "" {
+		if *initMimc != device.InitiationMimicQUIC {
+			fatal(l, fmt.Errorf("unknown initiation mimicry: %q", *initMimc))
+		}
+		l.Info("initiation mimicry enabled, the endpoint must be a relay or warp-plus", "mimic", *initMimc)
+		opts.InitMimic = *initMimc
+	}
+
+	if *power != "" {
+		opts.Power, err = app.NewPower(*power)
+		if err != nil {
+			fatal(l, err)
+		}
+		l.Info("battery awareness enabled", "power", *power)
+	}
+
+	if *standby {
+		l.Info("standby tunnel enabled")
+		opts.Standby = true
+	}
+
+	if *telURL != "" {
+		if u, err := url.Parse(*telURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			fatal(l, errors.New("--telemetry must be an http or https url"))
+		}
+		l.Info("telemetry enabled", "url", *telURL)
+		opts.Telemetry = app.NewTelemetry(opts.CacheDir)
+	}
+
+	if len(*preUp) > 0 || len(*postUp) > 0 || len(*preDown) > 0 || len(*postDown) > 0 {
+		opts.Hooks = &app.Hooks{PreUp: *preUp, PostUp: *postUp, PreDown: *preDown, PostDown: *postDown}
+	}
+
+	if *notify || *evSock != "" {
+		opts.Events = app.NewEvents()
+	}
+
+	if *notify {
+		if err := app.NotifyEvents(l.With("subsystem", "notify"), opts.Events); err != nil {
+			fatal(l, fmt.Errorf("can't show notifications: %w", err))
+		}
+		l.Info("desktop notifications enabled")
+	}
 
 	if *psiphon {
 		l.Info("psiphon mode enabled", "country", *country)
@@ -140,26 +511,359 @@ func main() {
 		l.Info("tun mode enabled")
 	}
 
-	// If the endpoint is not set, choose a random warp endpoint
-	if opts.Endpoint == "" {
-		addrPort, err := warp.RandomWarpEndpoint(*v4, *v6)
+	if *sidecar {
+		l.Info("sidecar mode enabled")
+	}
+
+	for _, s := range *listen {
+		listener, err := app.ParseListener(s)
 		if err != nil {
 			fatal(l, err)
 		}
-		opts.Endpoint = addrPort.String()
+		l.Info("extra listener enabled", "listener", listener)
+		listensOn("listener", listener.Bind.String())
+		opts.Listeners = append(opts.Listeners, listener)
+	}
+
+	for _, s := range *routes {
+		r, err := wiresocks.ParseRouteRule(s)
+		if err != nil {
+			fatal(l, err)
+		}
+		opts.Routes = append(opts.Routes, r)
+	}
+
+	for _, cidr := range *bypass {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid bypass cidr: %w", err))
+		}
+		opts.BypassCIDRs = append(opts.BypassCIDRs, prefix)
+	}
+
+	tlsOpts := &app.TLSOptions{CertFile: *tlsCert, KeyFile: *tlsKey}
+
+	if *sockTLS {
+		l.Info("socks over tls enabled")
+		opts.SocksTLS = tlsOpts
+	}
+
+	if *ssBind != "" {
+		ssAddrPort, err := netip.ParseAddrPort(*ssBind)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid shadowsocks address: %w", err))
+		}
+		if *ssPass == "" {
+			fatal(l, errors.New("shadowsocks requires a password"))
+		}
+		opts.Shadowsocks = &app.ShadowsocksOptions{Bind: ssAddrPort, Method: *ssMethod, Password: *ssPass}
+		listensOn("shadowsocks", ssAddrPort.String())
+	}
+
+	if *vlBind != "" {
+		vlAddrPort, err := netip.ParseAddrPort(*vlBind)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid vless address: %w", err))
+		}
+		if len(*vlIDs) == 0 {
+			fatal(l, errors.New("vless requires at least one --vless-id"))
+		}
+		opts.VLESS = &app.VLESSOptions{Bind: vlAddrPort, IDs: *vlIDs}
+		listensOn("vless", vlAddrPort.String())
+		if *vlTLS {
+			opts.VLESS.TLS = tlsOpts
+		}
+	}
+
+	if *chain != "" {
+		opts.Chain, err = wiresocks.ParseChainHop(*chain)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid chain: %w", err))
+		}
+	}
+
+	if *tcpTune != "" {
+		opts.TCPTuning, err = app.ParseTCPTuning(*tcpTune)
+		if err != nil {
+			fatal(l, err)
+		}
+	}
+
+	if *lowMem {
+		app.ApplyLowMemoryProfile(&opts)
+		l.Info("low memory profile enabled")
+	}
+
+	if *sniffPts != "" {
+		opts.SniffPorts, err = wiresocks.ParseSniffPorts(*sniffPts)
+		if err != nil {
+			fatal(l, err)
+		}
+	}
+
+	opts.UDPNAT, err = app.NewUDPNAT(*udpTime, int(*udpFlows), *lowMem)
+	if err != nil {
+		fatal(l, err)
+	}
+
+	if len(*tSSIDs) > 0 || len(*tGWs) > 0 {
+		l.Info("trusted network detection enabled", "ssids", *tSSIDs, "gateways", *tGWs)
+		opts.TrustedNetworks = &app.TrustedNetworkOptions{SSIDs: *tSSIDs, GatewayMACs: *tGWs}
+	}
+
+	if *dnsOnly {
+		dnsBindAddrPort, err := netip.ParseAddrPort(*dnsBind)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid dns bind address: %w", err))
+		}
+		l.Info("dns-only mode enabled", "filter", *dnsFilt, "protocol", *dnsProto)
+		opts.DNSOnly = &app.DNSOnlyOptions{Bind: dnsBindAddrPort, Filter: *dnsFilt, Protocol: doh.Protocol(*dnsProto), Gateway: *gwDoH}
+		listensOn("dns-bind", dnsBindAddrPort.String())
+
+		for _, s := range *dnsBoot {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				fatal(l, fmt.Errorf("invalid dns bootstrap address: %w", err))
+			}
+			opts.DNSOnly.Bootstrap = append(opts.DNSOnly.Bootstrap, addr)
+		}
+
+		if *blkPage != "" {
+			opts.DNSOnly.BlockPage, err = netip.ParseAddrPort(*blkPage)
+			if err != nil {
+				fatal(l, fmt.Errorf("invalid block page address: %w", err))
+			}
+			listensOn("block-page", opts.DNSOnly.BlockPage.String())
+		}
 	}
 
 	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	if len(*scanRngs) > 0 {
+		opts.ScanRanges = app.LoadScanRanges(ctx, l, opts.CacheDir, *scanRngs)
+		if opts.Scan != nil {
+			opts.Scan.Prefixes = opts.ScanRanges
+		}
+	}
+
+	if len(*bridges) > 0 {
+		key, ok, err := loadBridgesKey(*brKey)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid bridges key: %w", err))
+		}
+		var embedded []byte
+		var sources []string
+		for _, source := range *bridges {
+			if source == "builtin" {
+				embedded = builtinBridges
+				continue
+			}
+			if !ok {
+				fatal(l, errors.New("bridge lists can't be verified without --bridges-key in this build"))
+			}
+			sources = append(sources, source)
+		}
+		if opts.Bridges, err = app.LoadBridges(ctx, l, opts.CacheDir, embedded, sources, *brFront, key); err != nil {
+			fatal(l, err)
+		}
+	}
+
+	if *tor != "" {
+		opts.Tor = &app.TorOptions{Domains: *torDoms}
+		switch {
+		case *tor != "launch":
+			opts.Tor.SOCKS, err = netip.ParseAddrPort(*tor)
+		case !*dryRun:
+			opts.Tor.SOCKS, err = app.StartTor(ctx, l, opts.CacheDir)
+		}
+		if err != nil {
+			fatal(l, fmt.Errorf("failed to set up tor: %w", err))
+		}
+		l.Info("tor routing enabled", "socks", opts.Tor.SOCKS, "domains", *torDoms)
+	}
+
+	var remoteKey update.PublicKey
+	if *rmtKey != "" {
+		k := *rmtKey
+		if data, err := os.ReadFile(k); err == nil {
+			k = string(data)
+		}
+		if remoteKey, err = update.ParsePublicKey(k); err != nil {
+			fatal(l, err)
+		}
+		opts = app.RestoreRemoteConfig(l, opts)
+	}
+
+	if *dryRun {
+		printDryRun(ctx, l, os.Stdout, fs, args, opts)
+		return
+	}
+
+	tunnel := app.NewSupervisor(l, opts)
+	if soak != nil {
+		runSoak(ctx, l, tunnel, soak)
+		return
+	}
+	opts.Audit.Record(app.ActorCLI, "started",
+		"mode", tunnel.TunnelStatus().Mode,
+		"bind", bindAddrPort.String(),
+		"endpoint", opts.Endpoint,
+		"license", opts.License != "",
+		"cache_dir", opts.CacheDir,
+	)
+
+	var upgrading atomic.Bool
+	upgraded := make(chan struct{})
+	restart := func() error {
+		if opts.Tun {
+			return errors.New("upgrade is not supported in tun mode")
+		}
+		if !upgrading.CompareAndSwap(false, true) {
+			return errors.New("upgrade already in progress")
+		}
+		l.Info("upgrading")
+		if err := upgrade.Upgrade(upgradeTimeout); err != nil {
+			upgrading.Store(false)
+			return err
+		}
+		close(upgraded)
+		return nil
+	}
+
+	if *ctlAddr != "" {
+		ctlAddrPort, err := netip.ParseAddrPort(*ctlAddr)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid control address: %w", err))
+		}
+		listensOn("control", ctlAddrPort.String())
+
+		ctlOpts := []control.Option{control.WithBind(ctlAddrPort), control.WithLogger(l.With("subsystem", "control"))}
+		if len(*ctlAdmin)+len(*ctlRead) > 0 {
+			tokens := make(map[string]control.Role)
+			for _, t := range *ctlRead {
+				tokens[t] = control.RoleRead
+			}
+			for _, t := range *ctlAdmin {
+				tokens[t] = control.RoleAdmin
+			}
+			ctlOpts = append(ctlOpts, control.WithTokens(tokens))
+		}
+		switch {
+		case *ctlCert != "" || *ctlKey != "":
+			config, err := control.ServerTLSConfig(*ctlCert, *ctlKey, *ctlCA)
+			if err != nil {
+				fatal(l, fmt.Errorf("invalid control tls config: %w", err))
+			}
+			ctlOpts = append(ctlOpts, control.WithTLS(config))
+		case *ctlCA != "":
+			fatal(l, errors.New("--control-client-ca requires --control-cert and --control-key"))
+		}
+		if !ctlAddrPort.Addr().IsLoopback() && len(*ctlAdmin)+len(*ctlRead) == 0 && *ctlCA == "" {
+			l.Warn("control api is reachable from other hosts without authentication, consider --control-token")
+		}
+		if opts.Audit != nil {
+			ctlOpts = append(ctlOpts, control.WithAuditor(opts.Audit))
+		}
+		ctl := control.NewServer(ctlOpts...)
+		ctl.RegisterConnections(opts.Conns)
+		ctl.RegisterUDPNAT(opts.UDPNAT)
+		ctl.RegisterSourceACL(opts.SourceACL)
+		ctl.RegisterPAC(bindAddrPort, *direct)
+		ctl.RegisterHealth(opts.Health)
+		ctl.RegisterTunnel(tunnel)
+		ctl.RegisterEndpoints(tunnel)
+		ctl.RegisterPower(tunnel)
+		ctl.RegisterDevices(app.NewDevices(l.With("subsystem", "devices"), opts))
+		ctl.RegisterUpgrade(restart)
+		if *rmtKey != "" {
+			ctl.RegisterRemoteConfig(tunnel, remoteKey)
+		}
+		if logs != nil {
+			ctl.RegisterLogs(logs)
+		}
+		if err := ctl.ListenAndServe(ctx); err != nil {
+			fatal(l, err)
+		}
+	}
+
+	if *evSock != "" {
+		if err := app.ServeEvents(ctx, l.With("subsystem", "events"), *evSock, opts.Events); err != nil {
+			fatal(l, fmt.Errorf("failed to serve events: %w", err))
+		}
+	}
+
+	if *autoUpd {
+		go autoUpdate(ctx, l.With("subsystem", "update"), restart)
+	}
+
+	if opts.Telemetry != nil {
+		if version == "" {
+			version = versioninfo.Short()
+		}
+		go opts.Telemetry.Report(ctx, l.With("subsystem", "telemetry"), *telURL, version, telemetryInterval)
+	}
+
+	if *exitBad {
+		go func() {
+			ticker := time.NewTicker(healthCheckInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if !opts.Health.Healthy() {
+						fatal(l, errors.New("tunnel is unhealthy, exiting"))
+					}
+				}
+			}
+		}()
+	}
+
 	go func() {
-		if err := app.RunWarp(ctx, l, opts); err != nil {
+		defer opts.Telemetry.Recover()
+		if err := tunnel.Run(ctx); err != nil {
 			fatal(l, err)
 		}
+		if err := upgrade.Ready(); err != nil {
+			l.Warn("failed to report readiness to the previous process", "error", err)
+		}
 	}()
 
-	<-ctx.Done()
+	select {
+	case <-ctx.Done():
+		tunnel.Stop()
+	case <-upgraded:
+		drain(l, opts.Conns)
+	}
+}
+
+// drain stops accepting once an upgrade handed the listeners over, and
+// waits for the proxied connections to finish or drainTimeout.
+func drain(l *slog.Logger, conns *wiresocks.ConnTracker) {
+	upgrade.Close()
+	l.Info("handed over to the upgraded process, draining connections")
+
+	deadline := time.After(drainTimeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-deadline:
+			l.Info("drain timed out", "connections", len(conns.Flows()))
+			return
+		case <-ticker.C:
+			if len(conns.Flows()) == 0 {
+				return
+			}
+		}
+	}
 }
 
 func fatal(l *slog.Logger, err error) {
 	l.Error(err.Error())
+	if advice := explain(err); advice != "" {
+		fmt.Fprintln(os.Stderr, advice)
+	}
 	os.Exit(1)
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bepass-org/warp-plus/control"
+	"github.com/bepass-org/warp-plus/i18n"
+	"github.com/bepass-org/warp-plus/warp"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffhelp"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	// defaultListenPort is the server port when the endpoint has none
+	defaultListenPort = 51820
+	// peerKeepalive keeps the clients reachable behind nat
+	peerKeepalive = 25
+	// qrSize is the width and height of the written qr codes in pixels
+	qrSize = 512
+)
+
+// peer is a generated client of the exit server.
+type peer struct {
+	name         string
+	tenant       string
+	key          warp.Key
+	presharedKey warp.Key
+	addr         netip.Addr
+}
+
+// label names the peer in the server config, after its tenant if it has one.
+func (p peer) label() string {
+	if p.tenant == "" {
+		return p.name
+	}
+	return p.tenant + "/" + p.name
+}
+
+func managePeers(c *control.Client, args []string) error {
+	switch {
+	case len(args) > 0 && args[0] == "generate":
+		return generatePeers(args[1:])
+	case len(args) > 0 && args[0] == "stats":
+		return showTenantStats(args[1:])
+	case len(args) > 0 && args[0] == "quota":
+		return runQuotas(args[1:])
+	case len(args) == 1 && args[0] == "usage":
+		return showQuotas(c)
+	case len(args) > 1 && args[0] == "reset":
+		return c.Send(http.MethodPost, "/quotas/reset", args[1:])
+	}
+	return errors.New(i18n.T("usage: peers [generate | stats | quota] [flags] | peers usage | peers reset <peer>..."))
+}
+
+func generatePeers(args []string) error {
+	fs := ff.NewFlagSet(appName + " peers generate")
+	var (
+		count    = fs.UintLong("count", 1, "number of client peers to generate, without --tenant")
+		tenantsF = fs.StringListLong("tenant", "generate COUNT peers for the tenant NAME in a slice of the subnet, isolated from the other tenants and limited to RATE each way if given, as NAME:COUNT[:RATE] such as acme:10:20mbit (repeatable)")
+		subnet   = fs.StringLong("subnet", "10.10.0.0/24", "tunnel subnet, the server takes its first address and the peers the following ones")
+		endpoint = fs.StringLong("endpoint", "", "public address the clients reach the server at, as HOST:PORT")
+		dns      = fs.StringLong("dns", "1.1.1.1", "dns server of the clients")
+		allowed  = fs.StringListLong("allowed-ip", "route this CIDR through the server on the clients (repeatable, default: everything)")
+		out      = fs.StringLong("out", "peers", "directory to write the configs and qr codes to")
+		qr       = fs.BoolLong("qr", "also print the client configs as qr codes to the terminal")
+	)
+	err := ff.Parse(fs, args)
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs))
+		return nil
+	case err != nil:
+		return err
+	}
+
+	prefix, err := netip.ParsePrefix(*subnet)
+	if err != nil {
+		return fmt.Errorf(i18n.T("invalid subnet: %w"), err)
+	}
+	prefix = prefix.Masked()
+	if *endpoint == "" {
+		return errors.New(i18n.T("--endpoint is required"))
+	}
+	host, portStr, err := splitEndpoint(*endpoint)
+	if err != nil {
+		return err
+	}
+	if _, err := netip.ParseAddr(*dns); err != nil {
+		return fmt.Errorf(i18n.T("invalid dns address: %w"), err)
+	}
+	allowedIPs := []string{"0.0.0.0/0", "::/0"}
+	if len(*allowed) > 0 {
+		allowedIPs = nil
+		for _, s := range *allowed {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return fmt.Errorf(i18n.T("invalid allowed ip: %w"), err)
+			}
+			allowedIPs = append(allowedIPs, p.String())
+		}
+	}
+
+	tenants, err := parseTenants(*tenantsF)
+	if err != nil {
+		return err
+	}
+
+	serverKey, err := warp.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	serverAddr := prefix.Addr().Next()
+	var peers []peer
+	if len(tenants) > 0 {
+		peers, err = assignTenants(prefix, serverAddr, tenants)
+	} else {
+		peers, err = assignPeers(prefix, serverAddr, "", int(*count))
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(*out, 0o700); err != nil {
+		return err
+	}
+
+	var server strings.Builder
+	fmt.Fprintf(&server, "[Interface]\nPrivateKey = %s\nAddress = %s\nListenPort = %s\n",
+		serverKey, netip.PrefixFrom(serverAddr, prefix.Bits()), portStr)
+	// Forward and masquerade the peers' traffic out of the server
+	ipt, forward := "iptables", "net.ipv4.ip_forward"
+	if prefix.Addr().Is6() {
+		ipt, forward = "ip6tables", "net.ipv6.conf.all.forwarding"
+	}
+	fmt.Fprintf(&server, "PostUp = sysctl -q -w %s=1; %s -t nat -A POSTROUTING -s %s -j MASQUERADE\n", forward, ipt, prefix)
+	fmt.Fprintf(&server, "PostDown = %s -t nat -D POSTROUTING -s %s -j MASQUERADE\n", ipt, prefix)
+	if len(tenants) > 0 {
+		server.WriteString(tenantHooks(ipt, tenants))
+	}
+
+	for _, p := range peers {
+		fmt.Fprintf(&server, "\n[Peer]\n# %s\nPublicKey = %s\nPresharedKey = %s\nAllowedIPs = %s\n",
+			p.label(), p.key.PublicKey(), p.presharedKey, netip.PrefixFrom(p.addr, p.addr.BitLen()))
+
+		client := fmt.Sprintf("[Interface]\nPrivateKey = %s\nAddress = %s\nDNS = %s\n\n[Peer]\nPublicKey = %s\nPresharedKey = %s\nEndpoint = %s\nAllowedIPs = %s\nPersistentKeepalive = %d\n",
+			p.key, netip.PrefixFrom(p.addr, p.addr.BitLen()), *dns,
+			serverKey.PublicKey(), p.presharedKey, net.JoinHostPort(host, portStr), strings.Join(allowedIPs, ", "), peerKeepalive)
+		dir := filepath.Join(*out, p.tenant)
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, p.name+".conf"), []byte(client), 0o600); err != nil {
+			return err
+		}
+
+		code, err := qrcode.New(client, qrcode.Medium)
+		if err != nil {
+			return err
+		}
+		if err := code.WriteFile(qrSize, filepath.Join(dir, p.name+".png")); err != nil {
+			return err
+		}
+		if *qr {
+			fmt.Printf("%s\n%s\n", p.label(), code.ToSmallString(false))
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(*out, "server.conf"), []byte(server.String()), 0o600); err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("wrote the server config and %d peer configs to %s", len(peers), *out))
+	return nil
+}
+
+// assignPeers returns count peers of tenant with the addresses of prefix
+// following its first one, skipping the server address.
+func assignPeers(prefix netip.Prefix, server netip.Addr, tenant string, count int) ([]peer, error) {
+	if count < 1 {
+		return nil, errors.New(i18n.T("count must be at least 1"))
+	}
+
+	addr := prefix.Addr()
+	peers := make([]peer, 0, count)
+	for i := 1; i <= count; i++ {
+		if addr = addr.Next(); addr == server {
+			addr = addr.Next()
+		}
+		// The last IPv4 address is the broadcast address
+		if !prefix.Contains(addr) || (addr.Is4() && !prefix.Contains(addr.Next())) {
+			return nil, errors.New(i18n.T("subnet %s is too small for %d peers", prefix, count))
+		}
+
+		key, err := warp.GeneratePrivateKey()
+		if err != nil {
+			return nil, err
+		}
+		psk, err := warp.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, peer{name: "peer" + strconv.Itoa(i), tenant: tenant, key: key, presharedKey: psk, addr: addr})
+	}
+	return peers, nil
+}
+
+// splitEndpoint splits the server endpoint, defaulting the port.
+func splitEndpoint(endpoint string) (host, port string, err error) {
+	bare := strings.Trim(endpoint, "[]")
+	if _, err := netip.ParseAddr(bare); err == nil || !strings.Contains(endpoint, ":") {
+		return bare, strconv.Itoa(defaultListenPort), nil
+	}
+
+	host, port, err = net.SplitHostPort(endpoint)
+	if err == nil {
+		var p uint64
+		if p, err = strconv.ParseUint(port, 10, 16); err == nil && p == 0 {
+			err = errors.New("port 0")
+		}
+	}
+	if err == nil && host == "" {
+		err = errors.New("missing host")
+	}
+	if err != nil {
+		return "", "", fmt.Errorf(i18n.T("invalid endpoint: %w"), err)
+	}
+	return host, port, nil
+}
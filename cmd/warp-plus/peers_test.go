@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/netip"
+	"strconv"
+	"testing"
+)
+
+func TestAssignPeers(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		server  string
+		count   int
+		want    []string
+		wantErr bool
+	}{
+		{prefix: "10.10.0.0/24", server: "10.10.0.1", count: 3, want: []string{"10.10.0.2", "10.10.0.3", "10.10.0.4"}},
+		{prefix: "10.10.0.0/24", server: "10.10.0.3", count: 3, want: []string{"10.10.0.1", "10.10.0.2", "10.10.0.4"}},
+		// The network and broadcast addresses are left out
+		{prefix: "10.10.0.0/30", server: "10.10.0.1", count: 1, want: []string{"10.10.0.2"}},
+		{prefix: "10.10.0.0/30", server: "10.10.0.1", count: 2, wantErr: true},
+		{prefix: "10.10.0.0/24", server: "10.10.0.1", count: 254, wantErr: true},
+		// IPv6 has no broadcast address
+		{prefix: "fd00::/126", server: "fd00::1", count: 2, want: []string{"fd00::2", "fd00::3"}},
+		{prefix: "fd00::/126", server: "fd00::1", count: 3, wantErr: true},
+		{prefix: "10.10.0.0/24", server: "10.10.0.1", count: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		peers, err := assignPeers(netip.MustParsePrefix(tt.prefix), netip.MustParseAddr(tt.server), "acme", tt.count)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("assignPeers(%s, %s, %d) assigned %d peers, want an error", tt.prefix, tt.server, tt.count, len(peers))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("assignPeers(%s, %s, %d): %v", tt.prefix, tt.server, tt.count, err)
+			continue
+		}
+		if len(peers) != len(tt.want) {
+			t.Errorf("assignPeers(%s, %s, %d) assigned %d peers, want %d", tt.prefix, tt.server, tt.count, len(peers), len(tt.want))
+			continue
+		}
+		keys := make(map[string]bool)
+		for i, p := range peers {
+			if p.addr.String() != tt.want[i] || p.name != "peer"+strconv.Itoa(i+1) || p.tenant != "acme" {
+				t.Errorf("assignPeers(%s, %s, %d) peer %d is %s %s/%s, want %s peer%d of acme", tt.prefix, tt.server, tt.count, i, p.addr, p.tenant, p.name, tt.want[i], i+1)
+			}
+			keys[p.key.String()], keys[p.presharedKey.String()] = true, true
+		}
+		if len(keys) != 2*len(peers) {
+			t.Errorf("assignPeers(%s, %s, %d) reused keys", tt.prefix, tt.server, tt.count)
+		}
+	}
+}
+
+func TestSplitEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint   string
+		host, port string
+		wantErr    bool
+	}{
+		{endpoint: "exit.example.com", host: "exit.example.com", port: "51820"},
+		{endpoint: "exit.example.com:443", host: "exit.example.com", port: "443"},
+		{endpoint: "203.0.113.1", host: "203.0.113.1", port: "51820"},
+		{endpoint: "203.0.113.1:2408", host: "203.0.113.1", port: "2408"},
+		{endpoint: "[2001:db8::1]", host: "2001:db8::1", port: "51820"},
+		{endpoint: "2001:db8::1", host: "2001:db8::1", port: "51820"},
+		{endpoint: "[2001:db8::1]:2408", host: "2001:db8::1", port: "2408"},
+		{endpoint: "exit.example.com:65536", wantErr: true},
+		{endpoint: "exit.example.com:0", wantErr: true},
+		{endpoint: "exit.example.com:http", wantErr: true},
+		{endpoint: ":2408", wantErr: true},
+	}
+	for _, tt := range tests {
+		host, port, err := splitEndpoint(tt.endpoint)
+		if (err != nil) != tt.wantErr || host != tt.host || port != tt.port {
+			t.Errorf("splitEndpoint(%q) = %q, %q, %v, want %q, %q, error %v", tt.endpoint, host, port, err, tt.host, tt.port, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/adrg/xdg"
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffjson"
+)
+
+// builtinPresets bundle flags known to get through the filtering of a
+// country, named by its country code. They are config files in the format
+// of --config.
+//
+//go:embed presets/*.json
+var builtinPresets embed.FS
+
+// presetsDir is where presets are looked up before the builtin ones, so
+// that they can be updated without a new release.
+func presetsDir() string {
+	return filepath.Join(xdg.ConfigHome, appName, "presets")
+}
+
+// presetNames returns the names of the builtin presets.
+func presetNames() []string {
+	entries, _ := builtinPresets.ReadDir("presets")
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), ".json"))
+	}
+	return names
+}
+
+// loadPreset reads preset, a .json file or the name of a preset in
+// presetsDir or builtin.
+func loadPreset(preset string) ([]byte, error) {
+	if strings.HasSuffix(preset, ".json") {
+		return os.ReadFile(preset)
+	}
+	if strings.ContainsAny(preset, `/\`) {
+		return nil, fmt.Errorf("invalid preset name %q", preset)
+	}
+
+	data, err := os.ReadFile(filepath.Join(presetsDir(), preset+".json"))
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return data, err
+	}
+	data, err = builtinPresets.ReadFile(path.Join("presets", preset+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("unknown preset %q (valid values: %s)", preset, presetNames())
+	}
+	return data, nil
+}
+
+// applyPreset sets the flags of preset that weren't given on the command
+// line, in the environment or in the config file, skipping those that
+// conflict with a flag that was, so that e.g. --gool takes the place of the
+// fallback of the preset.
+func applyPreset(flags *ff.FlagSet, preset string) error {
+	data, err := loadPreset(preset)
+	if err != nil {
+		return err
+	}
+
+	// given holds the flags given by name, and enabled those of them that
+	// aren't turned off
+	given := make(map[string]bool)
+	enabled := make(map[string]bool)
+	_ = flags.WalkFlags(func(f ff.Flag) error {
+		name := flagName(f)
+		given[name] = f.IsSet()
+		enabled[name] = f.IsSet() && f.GetValue() != "" && f.GetValue() != "false"
+		return nil
+	})
+	conflicts := func(name string) bool {
+		return slices.ContainsFunc(flagConflicts, func(c [2]string) bool {
+			return c[0] == name && enabled[c[1]] || c[1] == name && enabled[c[0]]
+		})
+	}
+
+	return ffjson.Parse(bytes.NewReader(data), func(name, value string) error {
+		f, ok := flags.GetFlag(name)
+		if !ok || name == "preset" || name == "config" {
+			return fmt.Errorf("preset %s: unknown flag %q", preset, name)
+		}
+		if name := flagName(f); given[name] || conflicts(name) {
+			return nil
+		}
+		if err := f.SetValue(value); err != nil {
+			return fmt.Errorf("preset %s: %s: %w", preset, name, err)
+		}
+		return nil
+	})
+}
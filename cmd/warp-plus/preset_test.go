@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/peterbourgon/ff/v4"
+)
+
+// presetFlagSet returns a flag set with the flags of every builtin preset,
+// typed after their values, and the flags they conflict with or need.
+func presetFlagSet(t *testing.T) *ff.FlagSet {
+	t.Helper()
+	fs := ff.NewFlagSet(appName)
+	fs.StringLong("preset", "", "")
+	fs.StringLong("config", "", "")
+	for _, name := range []string{"gool", "cfon", "dns-only", "tun-experimental", "sidecar", "race", "standby"} {
+		fs.BoolLong(name, "")
+	}
+	for _, preset := range presetNames() {
+		data, err := loadPreset(preset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var values map[string]any
+		if err := json.Unmarshal(data, &values); err != nil {
+			t.Fatalf("preset %s: %v", preset, err)
+		}
+		for name, v := range values {
+			if _, ok := fs.GetFlag(name); ok {
+				continue
+			}
+			switch v.(type) {
+			case bool:
+				fs.BoolLong(name, "")
+			case []any:
+				fs.StringListLong(name, "")
+			default:
+				fs.StringLong(name, "", "")
+			}
+		}
+	}
+	for _, c := range flagConflicts {
+		for _, name := range c {
+			if _, ok := fs.GetFlag(name); !ok {
+				fs.StringLong(name, "", "")
+			}
+		}
+	}
+	for _, r := range flagRequires {
+		for _, name := range append([]string{r.flag}, r.needs...) {
+			if _, ok := fs.GetFlag(name); !ok {
+				fs.StringLong(name, "", "")
+			}
+		}
+	}
+	return fs
+}
+
+func TestBuiltinPresets(t *testing.T) {
+	for _, preset := range presetNames() {
+		t.Run(preset, func(t *testing.T) {
+			fs := presetFlagSet(t)
+			if err := parseFlags(fs, []string{"--preset", preset}); err != nil {
+				t.Fatal(err)
+			}
+			if f, _ := fs.GetFlag("scan"); f.GetValue() != "true" {
+				t.Fatal("preset not applied")
+			}
+		})
+	}
+}
+
+func TestPresetRequires(t *testing.T) {
+	fs := presetFlagSet(t)
+	if err := parseFlags(fs, []string{"--preset", "ir", "--dns-only"}); err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := fs.GetFlag("dns-bootstrap"); f.GetValue() == "" {
+		t.Fatal("dns-bootstrap of the preset not applied with --dns-only")
+	}
+
+	// Given explicitly, a flag still needs the others
+	fs = presetFlagSet(t)
+	err := parseFlags(fs, []string{"--preset", "ir", "--dns-bootstrap", "1.1.1.1"})
+	if err == nil || !strings.Contains(err.Error(), "requires --dns-only") {
+		t.Fatalf("got %v, want --dns-bootstrap to require --dns-only", err)
+	}
+}
+
+func TestPresetConflicts(t *testing.T) {
+	for _, preset := range presetNames() {
+		for _, mode := range []string{"--gool", "--cfon", "--race"} {
+			t.Run(preset+mode, func(t *testing.T) {
+				fs := presetFlagSet(t)
+				if err := parseFlags(fs, []string{"--preset", preset, mode}); err != nil {
+					t.Fatal(err)
+				}
+				if f, _ := fs.GetFlag("fallback"); f.GetValue() != "" {
+					t.Fatalf("fallback %q of the preset applied with %s", f.GetValue(), mode)
+				}
+				if f, _ := fs.GetFlag("scan"); f.GetValue() != "true" {
+					t.Fatal("flags not conflicting with " + mode + " not applied")
+				}
+			})
+		}
+	}
+
+	// Turned off, a flag doesn't keep the preset from setting others
+	fs := presetFlagSet(t)
+	if err := parseFlags(fs, []string{"--preset", "ir", "--gool=false"}); err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := fs.GetFlag("fallback"); f.GetValue() == "" {
+		t.Fatal("fallback of the preset not applied with --gool=false")
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bepass-org/warp-plus/control"
+	"github.com/bepass-org/warp-plus/i18n"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffhelp"
+)
+
+// quotaMonth is the layout of the month usage counts for, which is UTC.
+const quotaMonth = "2006-01"
+
+var (
+	// sizePattern is a byte count such as 50GiB or 1.5TB
+	sizePattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([KMGT]i?B|B)?$`)
+	sizeUnits   = map[string]float64{
+		"": 1, "B": 1,
+		"KB": 1e3, "MB": 1e6, "GB": 1e9, "TB": 1e12,
+		"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30, "TiB": 1 << 40,
+	}
+	// hashlimitRate is a rate in the units of the iptables hashlimit match
+	hashlimitRate = regexp.MustCompile(`^[0-9]+[kmg]?b/s$`)
+)
+
+// parseSize parses a byte count such as 50GiB or 1.5TB.
+func parseSize(s string) (uint64, error) {
+	m := sizePattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, errors.New(i18n.T("invalid size %q: want a size such as 50GiB", s))
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(n * sizeUnits[m[2]]), nil
+}
+
+// peerUsage is what a peer used in the month.
+type peerUsage struct {
+	Bytes uint64 `json:"bytes"`
+	// Received and Sent are the counters of wg last seen, which start over
+	// when the interface is recreated
+	Received uint64 `json:"received"`
+	Sent     uint64 `json:"sent"`
+	Exceeded bool   `json:"exceeded"`
+	// AllowedIPs are the addresses the rules enforcing the quota match
+	AllowedIPs []netip.Prefix `json:"allowed_ips,omitempty"`
+}
+
+// quotaState is what the quota tracker keeps across restarts.
+type quotaState struct {
+	Month string                `json:"month"`
+	Peers map[string]*peerUsage `json:"peers"`
+}
+
+// quotaTracker counts the traffic of the peers of an exit server and blocks
+// or throttles those over their monthly quota until the month ends.
+type quotaTracker struct {
+	iface string
+	// path is the file the state is kept in
+	path string
+	// names maps public keys to the names of the peers in the server config
+	names map[string]string
+	// quota applies to peers without one of quotas, by name or tenant
+	quota  uint64
+	quotas map[string]uint64
+	// throttle limits peers over quota to this hashlimit rate each way
+	// rather than blocking them
+	throttle string
+	l        *slog.Logger
+
+	mu    sync.Mutex
+	state quotaState
+}
+
+func (t *quotaTracker) load() error {
+	t.state = quotaState{Peers: make(map[string]*peerUsage)}
+	b, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &t.state); err != nil {
+		return fmt.Errorf("%s: %w", t.path, err)
+	}
+	if t.state.Peers == nil {
+		t.state.Peers = make(map[string]*peerUsage)
+	}
+	return nil
+}
+
+// save writes the state, replacing the file so a crash leaves either the
+// old or the new one.
+func (t *quotaTracker) save() error {
+	b, err := json.MarshalIndent(t.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// quotaOf returns the quota of the peer with public key key, zero for none.
+func (t *quotaTracker) quotaOf(key string) uint64 {
+	name := t.names[key]
+	if q, ok := t.quotas[name]; ok {
+		return q
+	}
+	if tenant, _, ok := strings.Cut(name, "/"); ok {
+		if q, ok := t.quotas[tenant]; ok {
+			return q
+		}
+	}
+	return t.quota
+}
+
+// poll adds what the peers transferred since the last poll to their usage
+// and enforces the quotas of those over them.
+func (t *quotaTracker) poll(now time.Time) error {
+	peers, err := dumpPeers(t.iface)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if month := now.UTC().Format(quotaMonth); month != t.state.Month {
+		for key, u := range t.state.Peers {
+			if u.Exceeded {
+				t.lift(key, u)
+			}
+			u.Bytes, u.Exceeded = 0, false
+		}
+		t.state.Month = month
+	}
+
+	for _, p := range peers {
+		u := t.state.Peers[p.key]
+		if u == nil {
+			u = &peerUsage{}
+			t.state.Peers[p.key] = u
+		}
+		u.Bytes += counterDelta(u.Received, p.received) + counterDelta(u.Sent, p.sent)
+		u.Received, u.Sent = p.received, p.sent
+		if len(p.allowedIPs) > 0 {
+			u.AllowedIPs = p.allowedIPs
+		}
+
+		quota := t.quotaOf(p.key)
+		if quota == 0 || u.Bytes < quota {
+			continue
+		}
+		if !u.Exceeded {
+			t.l.Warn("peer is over its monthly quota", "peer", t.name(p.key), "bytes", u.Bytes, "quota", quota, "throttle", t.throttle)
+			u.Exceeded = true
+		}
+		// Enforced on every poll, to survive the firewall being reloaded
+		t.enforce(p.key, u)
+	}
+	return t.save()
+}
+
+// counterDelta returns how much a wg counter grew, which starts over from
+// zero when the interface is recreated.
+func counterDelta(last, current uint64) uint64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
+
+func (t *quotaTracker) name(key string) string {
+	if name := t.names[key]; name != "" {
+		return name
+	}
+	return key
+}
+
+// rules returns the iptables rules blocking or throttling traffic from and
+// to prefix.
+func (t *quotaTracker) rules(key string, prefix netip.Prefix) [][]string {
+	rules := [][]string{
+		{"FORWARD", "-i", t.iface, "-s", prefix.String()},
+		{"FORWARD", "-o", t.iface, "-d", prefix.String()},
+	}
+	sum := sha256.Sum256([]byte(key))
+	for i, dir := range []string{"u", "d"} {
+		if t.throttle != "" {
+			// hashlimit names are at most 15 characters
+			name := "quota" + hex.EncodeToString(sum[:4]) + dir
+			rules[i] = append(rules[i], "-m", "hashlimit", "--hashlimit-name", name, "--hashlimit-above", t.throttle)
+		}
+		rules[i] = append(rules[i], "-j", "DROP")
+	}
+	return rules
+}
+
+func (t *quotaTracker) enforce(key string, u *peerUsage) {
+	for _, prefix := range u.AllowedIPs {
+		for _, rule := range t.rules(key, prefix) {
+			if iptables(prefix, "-C", rule) == nil {
+				continue
+			}
+			if err := iptables(prefix, "-I", rule); err != nil {
+				t.l.Error("failed to enforce quota", "peer", t.name(key), "error", err)
+			}
+		}
+	}
+}
+
+func (t *quotaTracker) lift(key string, u *peerUsage) {
+	for _, prefix := range u.AllowedIPs {
+		for _, rule := range t.rules(key, prefix) {
+			for iptables(prefix, "-D", rule) == nil {
+				// Until no copy of the rule is left
+			}
+		}
+	}
+	t.l.Info("lifted the quota enforcement of a peer", "peer", t.name(key))
+}
+
+// iptables runs the iptables command of the family of prefix.
+func iptables(prefix netip.Prefix, op string, rule []string) error {
+	cmd := "iptables"
+	if prefix.Addr().Is6() {
+		cmd = "ip6tables"
+	}
+	return exec.Command(cmd, append([]string{"-w", op}, rule...)...).Run()
+}
+
+func (t *quotaTracker) PeerQuotas() []control.PeerQuota {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	quotas := make([]control.PeerQuota, 0, len(t.state.Peers))
+	for key, u := range t.state.Peers {
+		quotas = append(quotas, control.PeerQuota{
+			PublicKey: key,
+			Name:      t.names[key],
+			Month:     t.state.Month,
+			Bytes:     u.Bytes,
+			Quota:     t.quotaOf(key),
+			Exceeded:  u.Exceeded,
+		})
+	}
+	sort.Slice(quotas, func(i, j int) bool {
+		if quotas[i].Name != quotas[j].Name {
+			return quotas[i].Name < quotas[j].Name
+		}
+		return quotas[i].PublicKey < quotas[j].PublicKey
+	})
+	return quotas
+}
+
+// ResetQuotas resets the peers given by public key or name.
+func (t *quotaTracker) ResetQuotas(peers []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, peer := range peers {
+		found := false
+		for key, u := range t.state.Peers {
+			if key != peer && t.names[key] != peer {
+				continue
+			}
+			if u.Exceeded {
+				t.lift(key, u)
+			}
+			u.Bytes, u.Exceeded = 0, false
+			found = true
+		}
+		if !found {
+			return fmt.Errorf("unknown peer %s", peer)
+		}
+	}
+	return t.save()
+}
+
+// runQuotas keeps the peers of a running exit server to monthly quotas,
+// serving their usage on the control api.
+func runQuotas(args []string) error {
+	fs := ff.NewFlagSet(appName + " peers quota")
+	var (
+		config   = fs.StringLong("config", "/etc/wireguard/server.conf", "server config written by peers generate")
+		iface    = fs.StringLong("interface", "", "wireguard interface of the server (default: named after the config, as by wg-quick)")
+		quota    = fs.StringLong("quota", "", "monthly quota of every peer, such as 50GiB (default: no limit)")
+		quotas   = fs.StringListLong("peer-quota", "monthly quota of a peer or of every peer of a tenant, as NAME=SIZE such as acme/peer1=100GiB or acme=20GiB (repeatable)")
+		throttle = fs.StringLong("throttle", "", "limit peers over quota to this rate each way, such as 128kb/s, rather than blocking them")
+		state    = fs.StringLong("state", "", "file keeping the usage across restarts (default: next to the config)")
+		interval = fs.DurationLong("interval", time.Minute, "how often to read the counters of the peers")
+		ctlAddr  = fs.StringLong("control", control.DefaultAddress, "serve the usage of the peers on this address")
+		ctlToken = fs.StringLong("control-token", "", "require this bearer token for the control api")
+	)
+	err := ff.Parse(fs, args, envOptions...)
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs))
+		return nil
+	case err != nil:
+		return err
+	}
+
+	t := &quotaTracker{iface: *iface, path: *state, quotas: make(map[string]uint64), throttle: *throttle}
+	if *quota != "" {
+		if t.quota, err = parseSize(*quota); err != nil {
+			return err
+		}
+	}
+	for _, s := range *quotas {
+		name, size, ok := strings.Cut(s, "=")
+		if !ok || name == "" {
+			return errors.New(i18n.T("invalid peer quota %q: want NAME=SIZE", s))
+		}
+		if t.quotas[name], err = parseSize(size); err != nil {
+			return err
+		}
+	}
+	if t.throttle != "" && !hashlimitRate.MatchString(t.throttle) {
+		return errors.New(i18n.T("invalid throttle %q: want a rate such as 128kb/s", t.throttle))
+	}
+	bind, err := netip.ParseAddrPort(*ctlAddr)
+	if err != nil {
+		return err
+	}
+
+	if t.names, err = readPeerNames(*config); err != nil {
+		return err
+	}
+	if t.iface == "" {
+		t.iface = strings.TrimSuffix(filepath.Base(*config), filepath.Ext(*config))
+	}
+	if t.path == "" {
+		t.path = strings.TrimSuffix(*config, filepath.Ext(*config)) + "-quota.json"
+	}
+	if err := t.load(); err != nil {
+		return err
+	}
+
+	t.l = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo})).With("subsystem", "quota")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ctlOpts := []control.Option{control.WithBind(bind), control.WithLogger(t.l)}
+	if *ctlToken != "" {
+		ctlOpts = append(ctlOpts, control.WithTokens(map[string]control.Role{*ctlToken: control.RoleAdmin}))
+	}
+	srv := control.NewServer(ctlOpts...)
+	srv.RegisterQuotas(t)
+	if err := srv.ListenAndServe(ctx); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		if err := t.poll(time.Now()); err != nil {
+			t.l.Error("failed to update the usage of the peers", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// showQuotas prints the usage of the peers of an exit server kept to quotas
+// by peers quota.
+func showQuotas(c *control.Client) error {
+	var quotas []control.PeerQuota
+	if err := c.Do(http.MethodGet, "/quotas", &quotas); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, i18n.T("PEER\tMONTH\tUSED\tQUOTA\tEXCEEDED"))
+	for _, q := range quotas {
+		name, quota, exceeded := q.Name, "-", i18n.T("no")
+		if name == "" {
+			name = q.PublicKey
+		}
+		if q.Quota > 0 {
+			quota = formatBytes(float64(q.Quota))
+		}
+		if q.Exceeded {
+			exceeded = i18n.T("yes")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, q.Month, formatBytes(float64(q.Bytes)), quota, exceeded)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/bepass-org/warp-plus/control"
+	"github.com/bepass-org/warp-plus/i18n"
+	"github.com/bepass-org/warp-plus/masque"
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wiresocks"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffhelp"
+)
+
+// runRelay runs the remote end of a custom transport until interrupted: a
+// connect-udp proxy for --masque, or a relay to a warp endpoint restoring
+// the handshake initiations of clients framing them.
+func runRelay(_ *control.Client, args []string) error {
+	if len(args) > 0 && args[0] == "masque" {
+		return runMasqueRelay(args[1:])
+	}
+	if len(args) != 2 {
+		return errors.New(i18n.T("usage: relay <listen address> <endpoint> | relay masque [flags] <listen address>"))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return wiresocks.RunInitiationRelay(ctx, relayLogger(), args[0], args[1])
+}
+
+// runMasqueRelay serves connect-udp to the warp endpoints, for clients
+// started with --masque pointing at it.
+func runMasqueRelay(args []string) error {
+	fs := ff.NewFlagSet(appName + " relay masque")
+	var (
+		cert = fs.StringLong("cert", "", "tls certificate file, which clients must trust")
+		key  = fs.StringLong("key", "", "private key file for --cert")
+		auth = fs.StringLong("auth", "", "require clients to authorize as USER:PASSWORD")
+	)
+	err := ff.Parse(fs, args, envOptions...)
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs))
+		return nil
+	case err != nil:
+		return err
+	}
+	if len(fs.GetArgs()) != 1 || *cert == "" || *key == "" {
+		return errors.New(i18n.T("usage: relay masque --cert <file> --key <file> [--auth <user:password>] <listen address>"))
+	}
+	username, password, ok := strings.Cut(*auth, ":")
+	if *auth != "" && !ok {
+		return errors.New(i18n.T("--auth must be USER:PASSWORD"))
+	}
+
+	pair, err := tls.LoadX509KeyPair(*cert, *key)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	srv := masque.NewServer(relayLogger(), warp.WarpPrefixes(), username, password)
+	return srv.ListenAndServe(ctx, fs.GetArgs()[0], &tls.Config{Certificates: []tls.Certificate{pair}})
+}
+
+func relayLogger() *slog.Logger {
+	l := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	return l.With("subsystem", "relay")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bepass-org/warp-plus/app"
+	"github.com/bepass-org/warp-plus/i18n"
+
+	"github.com/peterbourgon/ff/v4"
+)
+
+// soakFlags are the flags of 'soak', which runs the tunnel with the usual
+// flags otherwise.
+type soakFlags struct {
+	hours *uint
+	cycle *time.Duration
+	load  *uint
+	url   *string
+}
+
+func addSoakFlags(fs *ff.FlagSet) *soakFlags {
+	return &soakFlags{
+		hours: fs.UintLong("hours", 24, "soak for this many hours"),
+		cycle: fs.DurationLong("cycle", 5*time.Minute, "restart the tunnel this often, simulating a network change halfway in between"),
+		load:  fs.UintLong("load", 4, "keep this many requests in flight through the proxy"),
+		url:   fs.StringLong("url", "", "fetch this url through the proxy (default: the captive portal probe)"),
+	}
+}
+
+// runSoak soaks the tunnel and exits with an error if the goroutines or
+// the heap trended upward.
+func runSoak(ctx context.Context, l *slog.Logger, tunnel *app.Supervisor, f *soakFlags) {
+	report, err := tunnel.Soak(ctx, app.SoakOptions{
+		Duration: time.Duration(*f.hours) * time.Hour,
+		Cycle:    *f.cycle,
+		Load:     int(*f.load),
+		URL:      *f.url,
+		Sampled: func(s app.SoakSample) {
+			l.Info("soak sample", "elapsed", s.Elapsed.Round(time.Second), "goroutines", s.Goroutines,
+				"heap", s.HeapAlloc, "requests", s.Requests, "failed", s.Failed)
+		},
+	})
+	if err != nil {
+		fatal(l, err)
+	}
+
+	fmt.Println(i18n.T("%d samples, goroutines grew by %.0f and the heap by %.1f MiB",
+		len(report.Samples), report.GoroutineGrowth, report.HeapGrowth/(1<<20)))
+	if err := report.Leaking(); err != nil {
+		fatal(l, fmt.Errorf("soak failed: %w", err))
+	}
+	fmt.Println(i18n.T("no leaks found"))
+}
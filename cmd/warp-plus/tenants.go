@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bepass-org/warp-plus/i18n"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffhelp"
+)
+
+// activeWithin is how recent the handshake of a peer counting as active is,
+// WireGuard expires sessions older than this.
+const activeWithin = 3 * time.Minute
+
+var (
+	// tenantName is what a tenant may be called, as it names a directory
+	tenantName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	// tcRate is a rate in the units of tc
+	tcRate = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[kmgt]?bit$`)
+)
+
+// tenant is a group of exit server peers sharing a slice of the subnet and a
+// rate limit.
+type tenant struct {
+	name   string
+	count  int
+	rate   string
+	prefix netip.Prefix
+}
+
+// parseTenants parses tenants given as NAME:COUNT[:RATE].
+func parseTenants(specs []string) ([]tenant, error) {
+	tenants := make([]tenant, 0, len(specs))
+	seen := make(map[string]bool)
+	for _, s := range specs {
+		parts := strings.Split(s, ":")
+		if len(parts) < 2 || len(parts) > 3 || !tenantName.MatchString(parts[0]) {
+			return nil, errors.New(i18n.T("invalid tenant %q: want NAME:COUNT[:RATE]", s))
+		}
+		count, err := strconv.Atoi(parts[1])
+		if err != nil || count < 1 {
+			return nil, errors.New(i18n.T("invalid tenant %q: want NAME:COUNT[:RATE]", s))
+		}
+		t := tenant{name: parts[0], count: count}
+		if len(parts) == 3 {
+			if !tcRate.MatchString(parts[2]) {
+				return nil, errors.New(i18n.T("invalid rate %q of tenant %s: want a rate such as 20mbit", parts[2], t.name))
+			}
+			t.rate = parts[2]
+		}
+		if seen[t.name] {
+			return nil, errors.New(i18n.T("tenant %s is given twice", t.name))
+		}
+		seen[t.name] = true
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
+
+// assignTenants splits prefix into a slice per tenant and assigns the peers
+// of each tenant the addresses of its slice, skipping the server address.
+func assignTenants(prefix netip.Prefix, server netip.Addr, tenants []tenant) ([]peer, error) {
+	bits := prefix.Bits()
+	for 1<<(bits-prefix.Bits()) < len(tenants) {
+		bits++
+	}
+	// Each slice needs room for a peer besides its first and last address
+	if bits > prefix.Addr().BitLen()-2 {
+		return nil, errors.New(i18n.T("subnet %s is too small for %d tenants", prefix, len(tenants)))
+	}
+
+	var peers []peer
+	for i := range tenants {
+		tenants[i].prefix = slicePrefix(prefix, bits, i)
+		p, err := assignPeers(tenants[i].prefix, server, tenants[i].name, tenants[i].count)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, p...)
+	}
+	return peers, nil
+}
+
+// slicePrefix returns the i-th prefix of length bits within prefix.
+func slicePrefix(prefix netip.Prefix, bits, i int) netip.Prefix {
+	size := prefix.Addr().BitLen()
+	n := new(big.Int).SetBytes(prefix.Addr().AsSlice())
+	n.Add(n, new(big.Int).Lsh(big.NewInt(int64(i)), uint(size-bits)))
+	addr, _ := netip.AddrFromSlice(n.FillBytes(make([]byte, size/8)))
+	return netip.PrefixFrom(addr, bits)
+}
+
+// tenantHooks returns the wg-quick hooks that keep the tenants from reaching
+// each other through the server and limit the rates of those that have one.
+// The tc qdiscs go away with the interface.
+func tenantHooks(ipt string, tenants []tenant) string {
+	proto, match := "ip", "ip"
+	if ipt == "ip6tables" {
+		proto, match = "ipv6", "ip6"
+	}
+
+	var b strings.Builder
+	for _, t := range tenants {
+		rule := fmt.Sprintf("FORWARD -i %%i -o %%i -s %s -d %s -j ACCEPT", t.prefix, t.prefix)
+		fmt.Fprintf(&b, "PostUp = %s -A %s\nPostDown = %s -D %s\n", ipt, rule, ipt, rule)
+	}
+	fmt.Fprintf(&b, "PostUp = %s -A FORWARD -i %%i -o %%i -j DROP\nPostDown = %s -D FORWARD -i %%i -o %%i -j DROP\n", ipt, ipt)
+
+	shaped := false
+	for i, t := range tenants {
+		if t.rate == "" {
+			continue
+		}
+		if !shaped {
+			b.WriteString("PostUp = tc qdisc add dev %i root handle 1: htb; tc qdisc add dev %i handle ffff: ingress\n")
+			shaped = true
+		}
+		// Shape what the tenant downloads and police what it uploads
+		class := fmt.Sprintf("1:%x", i+1)
+		fmt.Fprintf(&b, "PostUp = tc class add dev %%i parent 1: classid %s htb rate %s; "+
+			"tc filter add dev %%i parent 1: protocol %s prio 1 u32 match %s dst %s flowid %s; "+
+			"tc filter add dev %%i parent ffff: protocol %s prio 1 u32 match %s src %s police rate %s burst 64k drop flowid :1\n",
+			class, t.rate, proto, match, t.prefix, class, proto, match, t.prefix, t.rate)
+	}
+	return b.String()
+}
+
+// tenantUsage is what the peers of a tenant transferred.
+type tenantUsage struct {
+	peers    int
+	active   int
+	received uint64
+	sent     uint64
+}
+
+// showTenantStats prints the transfer of the peers of a running exit server
+// by tenant, as reported by wg.
+func showTenantStats(args []string) error {
+	fs := ff.NewFlagSet(appName + " peers stats")
+	var (
+		config = fs.StringLong("config", "/etc/wireguard/server.conf", "server config written by peers generate")
+		iface  = fs.StringLong("interface", "", "wireguard interface of the server (default: named after the config, as by wg-quick)")
+	)
+	err := ff.Parse(fs, args)
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs))
+		return nil
+	case err != nil:
+		return err
+	}
+
+	names, err := readPeerNames(*config)
+	if err != nil {
+		return err
+	}
+	if *iface == "" {
+		*iface = strings.TrimSuffix(filepath.Base(*config), filepath.Ext(*config))
+	}
+	peers, err := dumpPeers(*iface)
+	if err != nil {
+		return err
+	}
+
+	usage := make(map[string]*tenantUsage)
+	for _, p := range peers {
+		name, _, ok := strings.Cut(names[p.key], "/")
+		if !ok {
+			name = ""
+		}
+		u := usage[name]
+		if u == nil {
+			u = &tenantUsage{}
+			usage[name] = u
+		}
+		u.peers++
+		if time.Since(p.handshake) < activeWithin {
+			u.active++
+		}
+		u.received += p.received
+		u.sent += p.sent
+	}
+
+	tenants := make([]string, 0, len(usage))
+	for name := range usage {
+		tenants = append(tenants, name)
+	}
+	sort.Strings(tenants)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, i18n.T("TENANT\tPEERS\tACTIVE\tRECEIVED\tSENT"))
+	for _, name := range tenants {
+		u := usage[name]
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", name, u.peers, u.active,
+			formatBytes(float64(u.received)), formatBytes(float64(u.sent)))
+	}
+	return w.Flush()
+}
+
+// readPeerNames maps the public keys of the peers in a server config written
+// by peers generate to the comments naming them, as peerN or TENANT/peerN.
+func readPeerNames(config string) (map[string]string, error) {
+	f, err := os.Open(config)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names := make(map[string]string)
+	var name string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "[Peer]":
+			name = ""
+		case strings.HasPrefix(line, "#"):
+			name = strings.TrimSpace(line[1:])
+		default:
+			if key, value, ok := strings.Cut(line, "="); ok && strings.TrimSpace(key) == "PublicKey" {
+				names[strings.TrimSpace(value)] = name
+			}
+		}
+	}
+	return names, scanner.Err()
+}
+
+// wgPeer is a peer of a wireguard interface as dumped by wg.
+type wgPeer struct {
+	key        string
+	allowedIPs []netip.Prefix
+	handshake  time.Time
+	received   uint64
+	sent       uint64
+}
+
+// dumpPeers returns the peers of the wireguard interface iface.
+func dumpPeers(iface string) ([]wgPeer, error) {
+	dump, err := exec.Command("wg", "show", iface, "dump").Output()
+	if err != nil {
+		return nil, fmt.Errorf(i18n.T("reading the peers of %s: %w"), iface, err)
+	}
+
+	var peers []wgPeer
+	lines := strings.Split(strings.TrimSpace(string(dump)), "\n")
+	// The first line is the interface, the others peers with their public
+	// key, preshared key, endpoint, allowed ips, latest handshake, received
+	// and sent bytes and keepalive
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 8 {
+			continue
+		}
+		p := wgPeer{key: fields[0]}
+		for _, s := range strings.Split(fields[3], ",") {
+			if prefix, err := netip.ParsePrefix(s); err == nil {
+				p.allowedIPs = append(p.allowedIPs, prefix)
+			}
+		}
+		if handshake, _ := strconv.ParseInt(fields[4], 10, 64); handshake > 0 {
+			p.handshake = time.Unix(handshake, 0)
+		}
+		p.received, _ = strconv.ParseUint(fields[5], 10, 64)
+		p.sent, _ = strconv.ParseUint(fields[6], 10, 64)
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
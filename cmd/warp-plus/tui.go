@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bepass-org/warp-plus/control"
+	"github.com/bepass-org/warp-plus/i18n"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+const (
+	// tuiRefreshInterval is how often the tui polls the tunnel state
+	tuiRefreshInterval = time.Second
+	// reconfigureTimeout bounds a rescan or mode switch, which includes
+	// scanning and the handshake of the new tunnel
+	reconfigureTimeout = 3 * time.Minute
+)
+
+type (
+	tickMsg   struct{}
+	statusMsg struct {
+		status control.TunnelStatus
+		at     time.Time
+		err    error
+	}
+	// doneMsg reports the outcome of a rescan or mode switch
+	doneMsg struct {
+		action string
+		err    error
+	}
+)
+
+// rate is the throughput of a tunnel peer in bytes per second.
+type rate struct {
+	rx, tx float64
+}
+
+type tuiModel struct {
+	c *control.Client
+
+	status control.TunnelStatus
+	at     time.Time
+	rates  map[string]rate
+	err    error
+
+	// busy names the reconfiguration in progress, if any
+	busy   string
+	notice string
+	// prompt is set while a mode is being typed in
+	prompt bool
+	input  string
+}
+
+func runTUI(c *control.Client, _ []string) error {
+	_, err := tea.NewProgram(&tuiModel{c: c}, tea.WithAltScreen()).Run()
+	return err
+}
+
+func (m *tuiModel) Init() tea.Cmd {
+	return m.fetch
+}
+
+func (m *tuiModel) fetch() tea.Msg {
+	var status control.TunnelStatus
+	err := m.c.Do(http.MethodGet, "/tunnel", &status)
+	return statusMsg{status: status, at: time.Now(), err: err}
+}
+
+// reconfigure runs a rescan or mode switch in the background.
+func (m *tuiModel) reconfigure(action, path string) tea.Cmd {
+	m.busy = action
+	m.notice = ""
+	return func() tea.Msg {
+		return doneMsg{action: action, err: m.c.WithTimeout(reconfigureTimeout).Do(http.MethodPost, path, nil)}
+	}
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tickMsg:
+		return m, m.fetch
+
+	case statusMsg:
+		m.err = msg.err
+		if msg.err == nil {
+			m.updateRates(msg.status, msg.at)
+		}
+		return m, tea.Tick(tuiRefreshInterval, func(time.Time) tea.Msg { return tickMsg{} })
+
+	case doneMsg:
+		m.busy = ""
+		if msg.err != nil {
+			m.notice = i18n.T("%s failed: %v", msg.action, msg.err)
+		} else {
+			m.notice = i18n.T("%s done", msg.action)
+		}
+		return m, nil
+
+	case tea.KeyMsg:
+		if m.prompt {
+			return m, m.typeMode(msg)
+		}
+
+		switch msg.String() {
+		case "q", "ctrl+c":
+			return m, tea.Quit
+		}
+		if m.busy != "" {
+			return m, nil
+		}
+		switch msg.String() {
+		case "r":
+			return m, m.reconfigure(i18n.T("rescan"), "/tunnel/rescan")
+		case "w", "g":
+			mode := map[string]string{"w": "warp", "g": "gool"}[msg.String()]
+			return m, m.reconfigure(i18n.T("switch to %s", mode), "/tunnel/mode/"+mode)
+		case "p":
+			m.prompt, m.input = true, "psiphon:"
+		case "m":
+			m.prompt, m.input = true, ""
+		}
+	}
+	return m, nil
+}
+
+// typeMode edits the mode prompt, switching once it is submitted.
+func (m *tuiModel) typeMode(msg tea.KeyMsg) tea.Cmd {
+	switch msg.Type {
+	case tea.KeyEnter:
+		m.prompt = false
+		if m.input == "" {
+			return nil
+		}
+		return m.reconfigure(i18n.T("switch to %s", m.input), "/tunnel/mode/"+m.input)
+	case tea.KeyEsc, tea.KeyCtrlC:
+		m.prompt = false
+	case tea.KeyBackspace:
+		if len(m.input) > 0 {
+			m.input = m.input[:len(m.input)-1]
+		}
+	case tea.KeyRunes:
+		m.input += string(msg.Runes)
+	}
+	return nil
+}
+
+// updateRates derives per peer throughput from the traffic counters since
+// the previous poll.
+func (m *tuiModel) updateRates(status control.TunnelStatus, at time.Time) {
+	prev := make(map[string]control.TunnelStats, len(m.status.Tunnels))
+	for _, t := range m.status.Tunnels {
+		prev[t.Endpoint] = t
+	}
+
+	rates := make(map[string]rate, len(status.Tunnels))
+	if elapsed := at.Sub(m.at).Seconds(); elapsed > 0 {
+		for _, t := range status.Tunnels {
+			p, ok := prev[t.Endpoint]
+			// Counters start over when the tunnel is brought back up
+			if !ok || t.RxBytes < p.RxBytes || t.TxBytes < p.TxBytes {
+				continue
+			}
+			rates[t.Endpoint] = rate{
+				rx: float64(t.RxBytes-p.RxBytes) / elapsed,
+				tx: float64(t.TxBytes-p.TxBytes) / elapsed,
+			}
+		}
+	}
+
+	m.status, m.at, m.rates = status, at, rates
+}
+
+func (m *tuiModel) View() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s  %s\n\n", appName, i18n.T("mode: %s", m.status.Mode))
+
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, i18n.T("ENDPOINT\tHANDSHAKE\tRTT\tDOWN\tUP\tRECEIVED\tSENT"))
+	for _, t := range m.status.Tunnels {
+		handshake := i18n.T("never")
+		if !t.LastHandshake.IsZero() {
+			handshake = i18n.T("%s ago", m.at.Sub(t.LastHandshake).Truncate(time.Second))
+		}
+		rtt := "-"
+		if t.RTTMillis != 0 {
+			rtt = fmt.Sprintf("%d ms", t.RTTMillis)
+		}
+		r := m.rates[t.Endpoint]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s/s\t%s/s\t%s\t%s\n",
+			t.Endpoint, handshake, rtt,
+			formatBytes(r.rx), formatBytes(r.tx),
+			formatBytes(float64(t.RxBytes)), formatBytes(float64(t.TxBytes)))
+	}
+	_ = w.Flush()
+	if len(m.status.Tunnels) == 0 {
+		fmt.Fprintln(&b, i18n.T("no tunnel is up"))
+	}
+
+	b.WriteString("\n")
+	switch {
+	case m.err != nil:
+		fmt.Fprintln(&b, i18n.T("error: %v", m.err))
+	case m.busy != "":
+		fmt.Fprintln(&b, i18n.T("%s in progress...", m.busy))
+	case m.notice != "":
+		fmt.Fprintln(&b, m.notice)
+	}
+
+	if m.prompt {
+		fmt.Fprintf(&b, "%s %s_\n", i18n.T("mode (warp, gool or psiphon:CC):"), m.input)
+	} else {
+		fmt.Fprintln(&b, i18n.T("r rescan  w warp  g gool  p psiphon  m mode  q quit"))
+	}
+	return b.String()
+}
+
+// formatBytes formats a byte count with a binary unit.
+func formatBytes(n float64) string {
+	const units = "KMGT"
+	if n < 1024 {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	i := -1
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", n, units[i])
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bepass-org/warp-plus/control"
+	"github.com/bepass-org/warp-plus/i18n"
+	"github.com/bepass-org/warp-plus/update"
+)
+
+// updateKey is the minisign public key releases are signed with, set at
+// build time by the release workflow. Builds without it refuse to update.
+var updateKey string = ""
+
+const (
+	// autoUpdateInterval is how often --auto-update checks for a release
+	autoUpdateInterval = 24 * time.Hour
+	// updateTimeout bounds checking for and installing a release
+	updateTimeout = 5 * time.Minute
+)
+
+func loadUpdateKey() (update.PublicKey, error) {
+	if updateKey == "" {
+		return update.PublicKey{}, errors.New(i18n.T("this build has no update signing key"))
+	}
+	return update.ParsePublicKey(updateKey)
+}
+
+func updateBinary(_ *control.Client, args []string) error {
+	check := len(args) == 1 && args[0] == "check"
+	if len(args) > 0 && !check {
+		return errors.New(i18n.T("usage: update [check]"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+	defer cancel()
+
+	r, err := update.Latest(ctx)
+	if err != nil {
+		return err
+	}
+	if version == "" {
+		return errors.New(i18n.T("unversioned build, latest release is %s", r.Tag))
+	}
+	if !r.IsNewer(version) {
+		fmt.Println(i18n.T("%s is up to date", r.Tag))
+		return nil
+	}
+	if check {
+		fmt.Println(i18n.T("%s is available", r.Tag))
+		return nil
+	}
+
+	key, err := loadUpdateKey()
+	if err != nil {
+		return err
+	}
+	if err := update.Apply(ctx, r, key); err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("updated to %s, run '%s upgrade' to restart a running instance into it", r.Tag, appName))
+	return nil
+}
+
+// autoUpdate installs new releases as they come out and restarts into them.
+func autoUpdate(ctx context.Context, l *slog.Logger, restart func() error) {
+	key, err := loadUpdateKey()
+	if err != nil {
+		l.Warn("auto-update disabled", "error", err)
+		return
+	}
+
+	ticker := time.NewTicker(autoUpdateInterval)
+	defer ticker.Stop()
+	for {
+		uctx, cancel := context.WithTimeout(ctx, updateTimeout)
+		r, err := update.Latest(uctx)
+		switch {
+		case err != nil:
+			l.Warn("failed to check for updates", "error", err)
+		case r.IsNewer(version):
+			if err := update.Apply(uctx, r, key); err != nil {
+				l.Warn("failed to install update", "release", r.Tag, "error", err)
+				break
+			}
+			l.Info("installed update", "release", r.Tag)
+			if err := restart(); err != nil {
+				l.Warn("restart to finish the update", "error", err)
+			}
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/warp-plus/app"
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wireguard/device"
+	"github.com/bepass-org/warp-plus/wiresocks"
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffjson"
+)
+
+// flagSource is a value given to a flag, with where it was given, so that
+// errors can point at it.
+type flagSource struct {
+	name  string
+	value string
+	// where is the command line flag, environment variable, or file and
+	// line the value was given at
+	where string
+	// preset is set for values of the preset, which only default flags
+	preset bool
+}
+
+func (s flagSource) String() string {
+	if strings.Contains(s.where, ":") {
+		return fmt.Sprintf("%s (%s)", s.where, s.name)
+	}
+	return s.where
+}
+
+// flagConflicts are flags that can't be given together.
+var flagConflicts = [][2]string{
+	{"4", "6"},
+	{"cfon", "gool"},
+	{"cfon", "tun-experimental"},
+	{"bind", "tun-experimental"},
+	{"bind", "sidecar"},
+	{"masque", "tun-experimental"},
+	{"masque", "sidecar"},
+	{"fallback", "gool"},
+	{"fallback", "cfon"},
+	{"fallback", "wgconf"},
+	{"race", "tun-experimental"},
+	{"race", "sidecar"},
+	{"race", "gool"},
+	{"race", "cfon"},
+	{"race", "wgconf"},
+	{"race", "fallback"},
+	{"standby", "tun-experimental"},
+	{"standby", "sidecar"},
+	{"standby", "gool"},
+	{"standby", "cfon"},
+	{"standby", "wgconf"},
+	{"standby", "race"},
+	{"bridges", "tun-experimental"},
+	{"bridges", "sidecar"},
+	{"bridges", "gool"},
+	{"bridges", "cfon"},
+	{"bridges", "wgconf"},
+	{"bridges", "race"},
+	{"bridges", "fallback"},
+	{"bridges", "masque"},
+	{"bridges", "standby"},
+	{"extra-bind", "cfon"},
+	{"extra-bind", "tun-experimental"},
+	{"extra-bind", "sidecar"},
+	{"allow-source", "cfon"},
+	{"allow-source", "tun-experimental"},
+	{"allow-source", "sidecar"},
+}
+
+// flagRequires are flags that only work with one of some other flags.
+var flagRequires = []struct {
+	flag  string
+	needs []string
+}{
+	{"tor-domain", []string{"tor"}},
+	{"remote-key", []string{"control"}},
+	{"control-key", []string{"control-cert"}},
+	{"control-client-ca", []string{"control-cert"}},
+	{"tls-cert", []string{"socks-tls", "vless-tls"}},
+	{"tls-key", []string{"socks-tls", "vless-tls"}},
+	{"bridges-front", []string{"bridges"}},
+	{"bridges-key", []string{"bridges"}},
+	{"dns-bootstrap", []string{"dns-only"}},
+	{"block-page", []string{"dns-only"}},
+	{"psk-mac", []string{"wgconf"}},
+	{"knock-key", []string{"wgconf"}},
+	{"fec", []string{"wgconf"}},
+	{"authorize-peers", []string{"wgconf"}},
+	{"resolve-doh", []string{"wgconf"}},
+	{"forward-pings", []string{"wgconf"}},
+	{"socket-mode", []string{"extra-bind"}},
+}
+
+// flagChecks validate the values of flags beyond their type, each value of
+// repeatable flags on its own.
+var flagChecks = map[string]func(string) error{
+	"bind":          checkAddrPort,
+	"dns-bind":      checkAddrPort,
+	"block-page":    checkAddrPort,
+	"shadowsocks":   checkAddrPort,
+	"vless":         checkAddrPort,
+	"dns":           checkAddr,
+	"dns-bootstrap": checkAddr,
+	"bypass-cidr": func(s string) error {
+		_, err := netip.ParsePrefix(s)
+		return err
+	},
+	"reserved": func(s string) error {
+		_, err := wiresocks.ParseReserved(s)
+		return err
+	},
+	"extra-bind": func(s string) error {
+		_, _, err := wiresocks.ParseBind(s)
+		return err
+	},
+	"allow-source": func(s string) error {
+		_, err := wiresocks.ParseSourceRule(s)
+		return err
+	},
+	"socket-mode": func(s string) error {
+		if m, err := strconv.ParseUint(s, 8, 32); err != nil || m > 0o777 {
+			return fmt.Errorf("invalid socket mode %q: want octal permissions such as 0660", s)
+		}
+		return nil
+	},
+	"route": func(s string) error {
+		_, err := wiresocks.ParseRouteRule(s)
+		return err
+	},
+	"listener": func(s string) error {
+		_, err := app.ParseListener(s)
+		return err
+	},
+	"fallback": func(s string) error {
+		if s == "" {
+			return nil
+		}
+		_, err := app.ParseFallback(s)
+		return err
+	},
+	"remote-key":  checkPublicKey,
+	"bridges-key": checkPublicKey,
+	"identity-store": func(s string) error {
+		_, err := warp.OpenIdentityStore(s, "")
+		return err
+	},
+	"authorize-peers": func(s string) error {
+		_, err := app.ParsePeerAuthorizer(s)
+		return err
+	},
+	"tcp-tuning": func(s string) error {
+		_, err := app.ParseTCPTuning(s)
+		return err
+	},
+	"udp-timeout": func(s string) error {
+		_, err := app.ParseUDPTimeouts(s)
+		return err
+	},
+	"knock-key": func(s string) error {
+		_, err := wiresocks.EncodeBase64ToHex(s)
+		return err
+	},
+	"mtu": func(s string) error {
+		if n, err := strconv.ParseUint(s, 0, 64); err == nil && n != 0 && (n < 1280 || n > 1500) {
+			return errors.New("mtu must be between 1280 and 1500")
+		}
+		return nil
+	},
+	"keepalive": func(s string) error {
+		if s == "adaptive" {
+			return nil
+		}
+		if d, err := time.ParseDuration(s); err != nil || d < time.Second || d > math.MaxUint16*time.Second {
+			return fmt.Errorf("invalid keepalive interval: %q", s)
+		}
+		return nil
+	},
+	"shaping": func(s string) error {
+		if s != "" && !slices.Contains(device.ShapingProfiles(), s) {
+			return fmt.Errorf("unknown shaping profile: %q", s)
+		}
+		return nil
+	},
+	"init-mimic": func(s string) error {
+		if s != "" && s != device.InitiationMimicQUIC {
+			return fmt.Errorf("unknown initiation mimicry: %q", s)
+		}
+		return nil
+	},
+}
+
+func checkAddrPort(s string) error {
+	_, err := netip.ParseAddrPort(s)
+	return err
+}
+
+func checkAddr(s string) error {
+	_, err := netip.ParseAddr(s)
+	return err
+}
+
+func checkPublicKey(s string) error {
+	_, ok, err := loadBridgesKey(s)
+	if err == nil && !ok {
+		err = errors.New("empty key")
+	}
+	return err
+}
+
+// parseFlags sets the flags of fs from args, the environment, the config
+// file and the preset, in that order of precedence, and validates them.
+func parseFlags(fs *ff.FlagSet, args []string) error {
+	trimEnv(fs)
+	err := ff.Parse(
+		fs,
+		args,
+		append(envOptions,
+			ff.WithConfigFileFlag("config"),
+			ff.WithConfigFileParser(ffjson.Parse),
+		)...,
+	)
+	if f, ok := fs.GetFlag("preset"); ok && err == nil && f.GetValue() != "" {
+		err = applyPreset(fs, f.GetValue())
+	}
+	// ff.Parse stops at the first problem without saying where it was
+	// given, the validator reports all of them with their lines
+	if !errors.Is(err, ff.ErrHelp) {
+		if verr := validateFlags(fs, args); verr != nil {
+			err = verr
+		}
+	}
+	return err
+}
+
+// validateFlags checks the flags given in args, the environment, the config
+// file and the preset of fs for unknown names, malformed values, and flags
+// that conflict with or need others, reporting every problem found with
+// where it was given.
+func validateFlags(fs *ff.FlagSet, args []string) error {
+	sources, errs := flagSources(fs, args)
+
+	for _, s := range sources {
+		f, _ := fs.GetFlag(s.name)
+		if err := checkType(f, s.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s, err))
+			continue
+		}
+		if check, ok := flagChecks[s.name]; ok {
+			if err := check(s.value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s, err))
+			}
+		}
+	}
+
+	// where returns where flag was given its value, following the
+	// precedence of ff.Parse, or "" if it wasn't or was turned off
+	where := func(flag string) string {
+		f, ok := fs.GetFlag(flag)
+		if !ok || !f.IsSet() || f.GetValue() == "" || f.GetValue() == "false" {
+			return ""
+		}
+		for _, s := range sources {
+			if s.name == flag {
+				return s.String()
+			}
+		}
+		return "--" + flag
+	}
+	// fromPreset reports whether flag was only given by the preset
+	fromPreset := func(flag string) bool {
+		return !slices.ContainsFunc(sources, func(s flagSource) bool { return s.name == flag && !s.preset })
+	}
+
+	for _, c := range flagConflicts {
+		if a, b := where(c[0]), where(c[1]); a != "" && b != "" {
+			errs = append(errs, fmt.Errorf("%s: can't be used with %s", a, b))
+		}
+	}
+	// A preset sets flags for every mode it may be used with, those the
+	// mode given doesn't need are ignored
+	for _, r := range flagRequires {
+		a := where(r.flag)
+		if a == "" || fromPreset(r.flag) || slices.ContainsFunc(r.needs, func(need string) bool { return where(need) != "" }) {
+			continue
+		}
+		errs = append(errs, fmt.Errorf("%s: requires --%s", a, strings.Join(r.needs, " or --")))
+	}
+	return errors.Join(errs...)
+}
+
+// flagSources returns the values given to flags on the command line, in the
+// environment, in the config file and in the preset, in that order of
+// precedence, along with the names given that are no flags of fs.
+func flagSources(fs *ff.FlagSet, args []string) ([]flagSource, []error) {
+	var (
+		sources []flagSource
+		errs    []error
+	)
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") || arg == "-" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		f, ok := fs.GetFlag(name)
+		if !ok {
+			// ff.Parse reports these
+			continue
+		}
+		if !hasValue {
+			value = "true"
+			if f.GetPlaceholder() != "" && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+		}
+		sources = append(sources, flagSource{name: flagName(f), value: value, where: arg[:len(arg)-len(strings.TrimLeft(arg, "-"))] + name})
+	}
+
+	_ = fs.WalkFlags(func(f ff.Flag) error {
+		for _, key := range []string{envKeyOf(f, true), envKeyOf(f, false)} {
+			value, ok := os.LookupEnv(key)
+			if key == "" || !ok {
+				continue
+			}
+			for _, v := range strings.Split(value, "\n") {
+				sources = append(sources, flagSource{name: flagName(f), value: v, where: key})
+			}
+		}
+		return nil
+	})
+
+	type file struct {
+		name   string
+		load   func() ([]byte, error)
+		preset bool
+	}
+	var files []file
+	if f, ok := fs.GetFlag("config"); ok && f.GetValue() != "" {
+		path := f.GetValue()
+		files = append(files, file{path, func() ([]byte, error) { return os.ReadFile(path) }, false})
+	}
+	if f, ok := fs.GetFlag("preset"); ok && f.GetValue() != "" {
+		preset := f.GetValue()
+		files = append(files, file{"preset " + preset, func() ([]byte, error) { return loadPreset(preset) }, true})
+	}
+	for _, file := range files {
+		data, err := file.load()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err = walkConfig(data, func(name, value string, line int) {
+			s := flagSource{name: name, value: value, where: fmt.Sprintf("%s:%d", file.name, line), preset: file.preset}
+			f, ok := fs.GetFlag(name)
+			if !ok || name == "config" || name == "preset" {
+				errs = append(errs, fmt.Errorf("%s: unknown flag%s", s, suggestFlag(fs, name)))
+				return
+			}
+			s.name = flagName(f)
+			sources = append(sources, s)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%w", file.name, err))
+		}
+	}
+	return sources, errs
+}
+
+// flagName returns the long name of f, or its short name if it has none.
+func flagName(f ff.Flag) string {
+	if long, ok := f.GetLongName(); ok {
+		return long
+	}
+	short, _ := f.GetShortName()
+	return string(short)
+}
+
+// envKeyOf returns the environment variable of the long or short name of
+// f, or "" if it has none.
+func envKeyOf(f ff.Flag, long bool) string {
+	if long {
+		if name, ok := f.GetLongName(); ok {
+			return envKey(name)
+		}
+		return ""
+	}
+	if short, ok := f.GetShortName(); ok {
+		return envKey(string(short))
+	}
+	return ""
+}
+
+// checkType checks that value parses as the type of f.
+func checkType(f ff.Flag, value string) error {
+	var err error
+	switch f.GetPlaceholder() {
+	case "":
+		_, err = strconv.ParseBool(value)
+	case "DURATION":
+		_, err = time.ParseDuration(value)
+	case "UINT":
+		_, err = strconv.ParseUint(value, 0, 64)
+	case "INT":
+		_, err = strconv.ParseInt(value, 0, 64)
+	case "FLOAT64":
+		_, err = strconv.ParseFloat(value, 64)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q", value)
+	}
+	return nil
+}
+
+// walkConfig calls fn with every flag set by the JSON config file data, in
+// the format of ffjson, along with its line. Each element of an array is a
+// value on its own.
+func walkConfig(data []byte, fn func(name, value string, line int)) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	line := func(offset int64) int {
+		return 1 + bytes.Count(data[:offset], []byte("\n"))
+	}
+	syntax := func(err error) error {
+		var serr *json.SyntaxError
+		if errors.As(err, &serr) {
+			return fmt.Errorf("%d: %w", line(serr.Offset), err)
+		}
+		if err != nil {
+			return fmt.Errorf("%d: %w", line(dec.InputOffset()), err)
+		}
+		return nil
+	}
+	scalar := func(tok json.Token) (string, bool) {
+		switch v := tok.(type) {
+		case string:
+			return v, true
+		case json.Number:
+			return v.String(), true
+		case bool:
+			return strconv.FormatBool(v), true
+		}
+		return "", false
+	}
+
+	var object func(prefix string) error
+	object = func(prefix string) error {
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return syntax(err)
+			}
+			name := prefix + tok.(string)
+			at := line(dec.InputOffset())
+
+			tok, err = dec.Token()
+			if err != nil {
+				return syntax(err)
+			}
+			switch tok {
+			case json.Delim('{'):
+				if err := object(name + "."); err != nil {
+					return err
+				}
+			case json.Delim('['):
+				for dec.More() {
+					tok, err := dec.Token()
+					if err != nil {
+						return syntax(err)
+					}
+					value, ok := scalar(tok)
+					if !ok {
+						return fmt.Errorf("%d: %s: arrays may only hold strings, numbers and booleans", at, name)
+					}
+					fn(name, value, line(dec.InputOffset()))
+				}
+			default:
+				value, ok := scalar(tok)
+				if !ok {
+					return fmt.Errorf("%d: %s: null is no value", at, name)
+				}
+				fn(name, value, at)
+				continue
+			}
+			// the closing delimiter
+			if _, err := dec.Token(); err != nil {
+				return syntax(err)
+			}
+		}
+		return nil
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return syntax(err)
+	}
+	if tok != json.Delim('{') {
+		return errors.New("1: expected an object")
+	}
+	if err := object(""); err != nil {
+		return err
+	}
+	_, err = dec.Token()
+	return syntax(err)
+}
+
+// suggestFlag returns a hint naming the flag of fs closest to name, if
+// any is close.
+func suggestFlag(fs *ff.FlagSet, name string) string {
+	best, bestDist := "", 3
+	_ = fs.WalkFlags(func(f ff.Flag) error {
+		if long, ok := f.GetLongName(); ok {
+			if d := editDistance(name, long); d < bestDist {
+				best, bestDist = long, d
+			}
+		}
+		return nil
+	})
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %q?", best)
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,63 @@
+package control
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Auditor records changes made through the control api.
+type Auditor interface {
+	// Record records an action by an actor, api for requests, with
+	// details given as alternating keys and values
+	Record(actor, action string, details ...any)
+}
+
+// WithAuditor records every request that changes state, anything but GET
+// and HEAD, with a, along with who made it as far as the server can tell.
+func WithAuditor(a Auditor) Option {
+	return func(s *Server) {
+		s.auditor = a
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (s *Server) audit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		s.auditor.Record("api", r.Method+" "+r.URL.Path, "status", rec.status, "remote", r.RemoteAddr, "identity", s.identity(r))
+	})
+}
+
+// identity describes who made r by what it authenticated with, the role of
+// its token and the common name of its verified client certificate, or
+// anonymous without either. Anything the client merely claims, such as its
+// user agent, is left out.
+func (s *Server) identity(r *http.Request) string {
+	var ids []string
+	if role, ok := s.role(r); ok {
+		ids = append(ids, "token:"+string(role))
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		ids = append(ids, "cert:"+r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	}
+	if len(ids) == 0 {
+		return "anonymous"
+	}
+	return strings.Join(ids, " ")
+}
@@ -0,0 +1,65 @@
+package control
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type auditRecorder struct {
+	actor, action string
+	details       map[string]any
+}
+
+func (a *auditRecorder) Record(actor, action string, details ...any) {
+	a.actor, a.action = actor, action
+	a.details = make(map[string]any)
+	for i := 0; i+1 < len(details); i += 2 {
+		a.details[fmt.Sprint(details[i])] = details[i+1]
+	}
+}
+
+func TestAuditIdentity(t *testing.T) {
+	clientCert := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "alice"}}}}}
+	tests := []struct {
+		name   string
+		tokens map[string]Role
+		token  string
+		tls    *tls.ConnectionState
+		want   string
+	}{
+		{name: "no auth", want: "anonymous"},
+		{name: "admin token", tokens: map[string]Role{"a": RoleAdmin, "r": RoleRead}, token: "a", want: "token:admin"},
+		{name: "read token", tokens: map[string]Role{"a": RoleAdmin, "r": RoleRead}, token: "r", want: "token:read"},
+		{name: "client certificate", tls: clientCert, want: "cert:alice"},
+		{name: "both", tokens: map[string]Role{"a": RoleAdmin}, token: "a", tls: clientCert, want: "token:admin cert:alice"},
+		{name: "unverified certificate", tls: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "mallory"}}}}, want: "anonymous"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &auditRecorder{}
+			s := NewServer(WithTokens(tt.tokens), WithAuditor(rec))
+			h := s.audit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			r := httptest.NewRequest(http.MethodPost, "/tunnel/rescan", nil)
+			// Claimed by anyone, so it must not count
+			r.Header.Set("User-Agent", clientUserAgent)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			r.TLS = tt.tls
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if rec.actor != "api" || rec.action != "POST /tunnel/rescan" {
+				t.Fatalf("got %s %s, want api POST /tunnel/rescan", rec.actor, rec.action)
+			}
+			if got := rec.details["identity"]; got != tt.want {
+				t.Fatalf("got identity %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package control
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Role is what an api token may do.
+type Role string
+
+const (
+	// RoleRead may only inspect the instance, with GET and HEAD requests
+	RoleRead Role = "read"
+	// RoleAdmin may also change it
+	RoleAdmin Role = "admin"
+)
+
+// publicPaths are served without a token, for health probes and browsers
+// fetching the pac file, which can't send one.
+var publicPaths = map[string]bool{
+	"/healthz":   true,
+	"/readyz":    true,
+	"/proxy.pac": true,
+}
+
+// WithTokens requires every request but health probes and the pac file to
+// carry one of tokens as a bearer token, allowing it what its role allows.
+func WithTokens(tokens map[string]Role) Option {
+	return func(s *Server) {
+		s.tokens = tokens
+	}
+}
+
+// WithTLS serves the api over tls. Set ClientAuth and ClientCAs to only
+// accept clients with a certificate.
+func WithTLS(config *tls.Config) Option {
+	return func(s *Server) {
+		s.tls = config
+	}
+}
+
+// ServerTLSConfig loads the certificate of the control server. If
+// clientCAFile is not empty, clients must present a certificate signed by
+// one of the authorities in it.
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		if config.ClientCAs, err = loadCertPool(clientCAFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientTLSConfig trusts the authorities in caFile, or the system ones if it
+// is empty, and presents the client certificate in certFile and keyFile, if
+// given.
+func ClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// role returns the role of the bearer token of r. Every token is compared
+// in constant time, so timing doesn't tell how close a guess was.
+func (s *Server) role(r *http.Request) (Role, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+
+	var role Role
+	for t, tr := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			role = tr
+		}
+	}
+	return role, role != ""
+}
+
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		role, ok := s.role(r)
+		switch {
+		case !ok:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid api token"))
+			return
+		case role != RoleAdmin && r.Method != http.MethodGet && r.Method != http.MethodHead:
+			writeError(w, http.StatusForbidden, errors.New("api token is read-only"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedHost reports whether host, the Host header of a request, names the
+// server. Only the bind address, loopback and localhost are accepted, or any
+// address when bound to all of them, and the names of the certificate when
+// serving tls, so a page whose domain was rebound to the server's address
+// can't reach it under its own name.
+func (s *Server) allowedHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return s.certificateName(host)
+	}
+	addr = addr.Unmap().WithZone("")
+	bind := s.bind.Addr().Unmap()
+	return addr.IsLoopback() || addr == bind || bind.IsUnspecified()
+}
+
+// certificateName reports whether name is one of the names of the
+// certificate the api is served with.
+func (s *Server) certificateName(name string) bool {
+	if s.tls == nil {
+		return false
+	}
+	for _, cert := range s.tls.Certificates {
+		if cert.Leaf == nil && len(cert.Certificate) > 0 {
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				continue
+			}
+			cert.Leaf = leaf
+		}
+		if cert.Leaf != nil && cert.Leaf.VerifyHostname(name) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin reports whether r, if sent by a browser, comes from a page
+// served by the api itself. Browsers send Origin with every cross-origin
+// request that can change anything, tools don't send it at all.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return r.Header.Get("Sec-Fetch-Site") != "cross-site"
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// guard rejects requests for another host and, unless tokens are required,
+// which browsers can't send cross-origin without the api allowing it,
+// state changing requests from pages of other origins.
+func (s *Server) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.allowedHost(r.Host) {
+			writeError(w, http.StatusMisdirectedRequest, fmt.Errorf("unexpected host %q", r.Host))
+			return
+		}
+		if len(s.tokens) == 0 && r.Method != http.MethodGet && r.Method != http.MethodHead && !sameOrigin(r) {
+			writeError(w, http.StatusForbidden, errors.New("cross-origin request denied"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
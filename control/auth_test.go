@@ -0,0 +1,55 @@
+package control
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestGuard(t *testing.T) {
+	tests := []struct {
+		name   string
+		bind   string
+		tokens map[string]Role
+		method string
+		host   string
+		origin string
+		site   string
+		want   int
+	}{
+		{name: "bind address", bind: "192.168.1.2:8087", method: http.MethodGet, host: "192.168.1.2:8087", want: http.StatusOK},
+		{name: "localhost", bind: "127.0.0.1:8087", method: http.MethodGet, host: "localhost:8087", want: http.StatusOK},
+		{name: "loopback v6", bind: "127.0.0.1:8087", method: http.MethodGet, host: "[::1]:8087", want: http.StatusOK},
+		{name: "rebound domain", bind: "127.0.0.1:8087", method: http.MethodGet, host: "attacker.example:8087", want: http.StatusMisdirectedRequest},
+		{name: "rebound domain with token", bind: "127.0.0.1:8087", tokens: map[string]Role{"t": RoleAdmin}, method: http.MethodGet, host: "attacker.example", want: http.StatusMisdirectedRequest},
+		{name: "other address", bind: "192.168.1.2:8087", method: http.MethodGet, host: "10.0.0.1:8087", want: http.StatusMisdirectedRequest},
+		{name: "any address when unspecified", bind: "0.0.0.0:8087", method: http.MethodGet, host: "10.0.0.1:8087", want: http.StatusOK},
+		{name: "cli post", bind: "127.0.0.1:8087", method: http.MethodPost, host: "127.0.0.1:8087", want: http.StatusOK},
+		{name: "same origin post", bind: "127.0.0.1:8087", method: http.MethodPost, host: "127.0.0.1:8087", origin: "http://127.0.0.1:8087", want: http.StatusOK},
+		{name: "cross origin post", bind: "127.0.0.1:8087", method: http.MethodPost, host: "127.0.0.1:8087", origin: "https://attacker.example", want: http.StatusForbidden},
+		{name: "cross site post without origin", bind: "127.0.0.1:8087", method: http.MethodPost, host: "127.0.0.1:8087", site: "cross-site", want: http.StatusForbidden},
+		{name: "cross origin get", bind: "127.0.0.1:8087", method: http.MethodGet, host: "127.0.0.1:8087", origin: "https://attacker.example", want: http.StatusOK},
+		{name: "cross origin post with tokens", bind: "127.0.0.1:8087", tokens: map[string]Role{"t": RoleAdmin}, method: http.MethodPost, host: "127.0.0.1:8087", origin: "https://attacker.example", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(WithBind(netip.MustParseAddrPort(tt.bind)), WithTokens(tt.tokens))
+			h := s.guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			r := httptest.NewRequest(tt.method, "/connections", nil)
+			r.Host = tt.host
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.site != "" {
+				r.Header.Set("Sec-Fetch-Site", tt.site)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package control
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// clientUserAgent is the user agent of requests made by Client.
+const clientUserAgent = "warp-plus-cli"
+
+// Client talks to the control API of a running instance.
+type Client struct {
+	base  string
+	http  *http.Client
+	token string
+}
+
+func NewClient(address string) *Client {
+	return &Client{
+		base: "http://" + address,
+		http: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// WithTimeout returns a copy of c whose requests time out after d.
+func (c *Client) WithTimeout(d time.Duration) *Client {
+	return &Client{
+		base:  c.base,
+		http:  &http.Client{Timeout: d, Transport: c.http.Transport},
+		token: c.token,
+	}
+}
+
+// WithToken returns a copy of c that authenticates with an api token.
+func (c *Client) WithToken(token string) *Client {
+	return &Client{
+		base:  c.base,
+		http:  c.http,
+		token: token,
+	}
+}
+
+// WithTLS returns a copy of c that talks to the api over tls.
+func (c *Client) WithTLS(config *tls.Config) *Client {
+	return &Client{
+		base:  "https://" + strings.TrimPrefix(c.base, "http://"),
+		http:  &http.Client{Timeout: c.http.Timeout, Transport: &http.Transport{TLSClientConfig: config}},
+		token: c.token,
+	}
+}
+
+// Send performs a request with v encoded as the JSON body.
+func (c *Client) Send(method, path string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := c.request(method, path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Stream performs a request and copies the response body to w.
+func (c *Client) Stream(method, path string, w io.Writer) error {
+	resp, err := c.request(method, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Do performs a request and decodes the JSON response into v, if v is not
+// nil.
+func (c *Client) Do(method, path string, v any) error {
+	resp, err := c.request(method, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if v == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// request performs a request and turns error responses into errors.
+func (c *Client) request(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", clientUserAgent)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err == nil && apiErr.Error != "" {
+			return nil, errors.New(apiErr.Error)
+		}
+		return nil, fmt.Errorf("control api returned status: %s", resp.Status)
+	}
+	return resp, nil
+}
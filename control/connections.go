@@ -0,0 +1,33 @@
+package control
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// RegisterConnections exposes the active proxied connections:
+//
+//	GET    /connections       list active connections
+//	DELETE /connections/{id}  terminate a connection
+func (s *Server) RegisterConnections(t *wiresocks.ConnTracker) {
+	s.HandleFunc("GET /connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, t.Flows())
+	})
+
+	s.HandleFunc("DELETE /connections/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid connection id"))
+			return
+		}
+
+		if !t.Kill(id) {
+			writeError(w, http.StatusNotFound, errors.New("connection not found"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
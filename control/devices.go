@@ -0,0 +1,57 @@
+package control
+
+import "net/http"
+
+// Device is a device bound to the warp+ license.
+type Device struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Model   string `json:"model"`
+	Created string `json:"created"`
+	Active  bool   `json:"active"`
+	// Current is set for the identities of the running instance
+	Current bool `json:"current"`
+}
+
+// DeviceManager manages the devices bound to the warp+ license.
+type DeviceManager interface {
+	Devices() ([]Device, error)
+	// RemoveDevice unbinds a device from the license
+	RemoveDevice(id string) error
+	// BindDevice binds the identities of the running instance to the
+	// license
+	BindDevice() error
+}
+
+// RegisterDevices exposes the devices bound to the warp+ license:
+//
+//	GET    /devices       list devices bound to the license
+//	DELETE /devices/{id}  unbind a device from the license
+//	POST   /devices/bind  bind this instance to the license
+func (s *Server) RegisterDevices(m DeviceManager) {
+	s.HandleFunc("GET /devices", func(w http.ResponseWriter, _ *http.Request) {
+		devices, err := m.Devices()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, devices)
+	})
+
+	s.HandleFunc("DELETE /devices/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := m.RemoveDevice(r.PathValue("id")); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	s.HandleFunc("POST /devices/bind", func(w http.ResponseWriter, _ *http.Request) {
+		if err := m.BindDevice(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
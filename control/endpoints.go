@@ -0,0 +1,71 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// EndpointScore is how the scanner rated an endpoint.
+type EndpointScore struct {
+	Endpoint     string  `json:"endpoint"`
+	RTTMillis    int64   `json:"rtt_ms"`
+	JitterMillis int64   `json:"jitter_ms"`
+	Loss         float64 `json:"loss"`
+	Probes       int     `json:"probes"`
+	// ScoreMillis combines rtt, jitter and loss, lower is better
+	ScoreMillis int64     `json:"score_ms"`
+	ScannedAt   time.Time `json:"scanned_at"`
+}
+
+// EndpointScorer scans for endpoints and brings the tunnel up on the ones
+// chosen from them.
+type EndpointScorer interface {
+	// EndpointScores returns the endpoints of the latest scan, best first
+	EndpointScores() []EndpointScore
+	// ScanEndpoints scans for endpoints, leaving the tunnel alone
+	ScanEndpoints() error
+	// UseEndpoints brings the tunnel back up on the first of endpoints
+	// that works
+	UseEndpoints(endpoints []string) error
+}
+
+// RegisterEndpoints exposes the scanner scores to external schedulers, and
+// takes their choice back:
+//
+//	GET  /endpoints       scores of the latest scan, best first
+//	POST /endpoints/scan  scan again without touching the tunnel
+//	POST /endpoints/use   bring the tunnel up on the first working endpoint of a json list
+//
+// Scanning and switching return once done.
+func (s *Server) RegisterEndpoints(m EndpointScorer) {
+	s.HandleFunc("GET /endpoints", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, m.EndpointScores())
+	})
+
+	s.HandleFunc("POST /endpoints/scan", func(w http.ResponseWriter, _ *http.Request) {
+		if err := m.ScanEndpoints(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, m.EndpointScores())
+	})
+
+	s.HandleFunc("POST /endpoints/use", func(w http.ResponseWriter, r *http.Request) {
+		var endpoints []string
+		if err := json.NewDecoder(r.Body).Decode(&endpoints); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(endpoints) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("no endpoints given"))
+			return
+		}
+		if err := m.UseEndpoints(endpoints); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
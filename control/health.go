@@ -0,0 +1,47 @@
+package control
+
+import (
+	"net/http"
+	"time"
+)
+
+// HealthChecker reports the state of the tunnel.
+type HealthChecker interface {
+	// Status reports whether a tunnel is up and the age of its last
+	// handshake.
+	Status() (up bool, handshakeAge time.Duration)
+	// Healthy reports false once the tunnel is wedged.
+	Healthy() bool
+}
+
+type healthStatus struct {
+	Status              string  `json:"status"`
+	TunnelUp            bool    `json:"tunnel_up"`
+	HandshakeAgeSeconds float64 `json:"handshake_age_seconds,omitempty"`
+}
+
+// RegisterHealth exposes container friendly probes:
+//
+//	GET /healthz  liveness, fails once the tunnel is wedged
+//	GET /readyz   readiness, fails until the tunnel is up and while wedged
+func (s *Server) RegisterHealth(h HealthChecker) {
+	probe := func(ready bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, _ *http.Request) {
+			up, age := h.Status()
+			status := healthStatus{Status: "ok", TunnelUp: up}
+			if up {
+				status.HandshakeAgeSeconds = age.Seconds()
+			}
+
+			code := http.StatusOK
+			if !h.Healthy() || (ready && !up) {
+				status.Status = "unavailable"
+				code = http.StatusServiceUnavailable
+			}
+			writeJSON(w, code, status)
+		}
+	}
+
+	s.HandleFunc("GET /healthz", probe(false))
+	s.HandleFunc("GET /readyz", probe(true))
+}
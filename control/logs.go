@@ -0,0 +1,17 @@
+package control
+
+import (
+	"net/http"
+
+	"github.com/bepass-org/warp-plus/logring"
+)
+
+// RegisterLogs exposes the in-memory log ring:
+//
+//	GET /logs  dump recent log records, including debug records
+func (s *Server) RegisterLogs(r *logring.Ring) {
+	s.HandleFunc("GET /logs", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = r.WriteTo(w)
+	})
+}
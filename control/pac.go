@@ -0,0 +1,73 @@
+package control
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// RegisterPAC serves a proxy auto-config file that sends everything except
+// the direct domains, private addresses and plain host names through the
+// proxy listening on proxy:
+//
+//	GET /proxy.pac  the generated PAC file
+func (s *Server) RegisterPAC(proxy netip.AddrPort, direct []string) {
+	s.HandleFunc("GET /proxy.pac", func(w http.ResponseWriter, r *http.Request) {
+		// A wildcard bind isn't reachable as such, point browsers at the
+		// host they fetched the PAC file from instead
+		host := proxy.Addr().String()
+		if proxy.Addr().IsUnspecified() {
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				host = h
+			} else {
+				host = r.Host
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		_, _ = w.Write([]byte(generatePAC(net.JoinHostPort(host, strconv.Itoa(int(proxy.Port()))), direct)))
+	})
+}
+
+// generatePAC returns a PAC file sending everything but direct, plain host
+// names and private addresses through proxy. Private addresses are only
+// matched for hosts given as ip addresses: resolving names for isInNet
+// would leak every host looked up to the local resolver, which the proxy is
+// there to avoid.
+func generatePAC(proxy string, direct []string) string {
+	var b strings.Builder
+
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\tif (isPlainHostName(host)) {\n")
+	b.WriteString("\t\treturn \"DIRECT\";\n")
+	b.WriteString("\t}\n")
+
+	for _, d := range direct {
+		d = strings.ToLower(strings.TrimPrefix(d, "."))
+		if d == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "\tif (dnsDomainIs(host, %s) || host == %s) {\n", strconv.Quote("."+d), strconv.Quote(d))
+		b.WriteString("\t\treturn \"DIRECT\";\n")
+		b.WriteString("\t}\n")
+	}
+
+	b.WriteString("\tif (/^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host) && (\n")
+	b.WriteString("\t\tisInNet(host, \"10.0.0.0\", \"255.0.0.0\") ||\n")
+	b.WriteString("\t\tisInNet(host, \"172.16.0.0\", \"255.240.0.0\") ||\n")
+	b.WriteString("\t\tisInNet(host, \"192.168.0.0\", \"255.255.0.0\") ||\n")
+	b.WriteString("\t\tisInNet(host, \"127.0.0.0\", \"255.0.0.0\"))) {\n")
+	b.WriteString("\t\treturn \"DIRECT\";\n")
+	b.WriteString("\t}\n")
+	b.WriteString("\tif (host.indexOf(\":\") >= 0 && /^(::1$|f[cd]|fe[89ab])/i.test(host)) {\n")
+	b.WriteString("\t\treturn \"DIRECT\";\n")
+	b.WriteString("\t}\n")
+
+	fmt.Fprintf(&b, "\treturn %s;\n", strconv.Quote("SOCKS5 "+proxy+"; SOCKS "+proxy+"; PROXY "+proxy))
+	b.WriteString("}\n")
+
+	return b.String()
+}
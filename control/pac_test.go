@@ -0,0 +1,23 @@
+package control
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeneratePAC(t *testing.T) {
+	pac := generatePAC("127.0.0.1:8086", []string{".Example.com"})
+
+	// Resolving would leak every host looked up to the local resolver
+	if strings.Contains(pac, "dnsResolve") {
+		t.Fatal("pac file resolves host names")
+	}
+	direct := strings.Index(pac, `dnsDomainIs(host, ".example.com") || host == "example.com"`)
+	private := strings.Index(pac, "isInNet(host")
+	if direct < 0 || private < 0 || direct > private {
+		t.Fatalf("direct domains not checked before private addresses:\n%s", pac)
+	}
+	if !strings.Contains(pac, `return "SOCKS5 127.0.0.1:8086; SOCKS 127.0.0.1:8086; PROXY 127.0.0.1:8086";`) {
+		t.Fatalf("pac file doesn't send the rest through the proxy:\n%s", pac)
+	}
+}
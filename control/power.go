@@ -0,0 +1,52 @@
+package control
+
+import (
+	"net/http"
+)
+
+// Power sources
+const (
+	PowerAC      = "ac"
+	PowerBattery = "battery"
+	// PowerAuto clears a hint, going back to detecting the source
+	PowerAuto = "auto"
+)
+
+// PowerStatus is the power source the tunnel is tuned for.
+type PowerStatus struct {
+	// Source is PowerAC or PowerBattery
+	Source string `json:"source"`
+	// Hinted is set when the source was given rather than detected
+	Hinted bool `json:"hinted"`
+}
+
+// PowerManager tunes the tunnel for the power source.
+type PowerManager interface {
+	PowerStatus() (PowerStatus, error)
+	// SetPowerSource overrides the detected source, PowerAuto detects it
+	// again
+	SetPowerSource(source string) error
+}
+
+// RegisterPower exposes the power source and lets it be hinted:
+//
+//	GET  /power           source the tunnel is tuned for
+//	POST /power/{source}  tune it for ac or battery, or auto to detect the source again
+func (s *Server) RegisterPower(m PowerManager) {
+	s.HandleFunc("GET /power", func(w http.ResponseWriter, _ *http.Request) {
+		status, err := m.PowerStatus()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+
+	s.HandleFunc("POST /power/{source}", func(w http.ResponseWriter, r *http.Request) {
+		if err := m.SetPowerSource(r.PathValue("source")); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,57 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// PeerQuota is the traffic of a peer of an exit server this month.
+type PeerQuota struct {
+	PublicKey string `json:"public_key"`
+	// Name is the peer as named in the server config, if it is
+	Name string `json:"name,omitempty"`
+	// Month is the month the usage counts for, as 2006-01
+	Month string `json:"month"`
+	// Bytes is what the peer sent and received this month
+	Bytes uint64 `json:"bytes"`
+	// Quota is what it may use in a month, zero for no limit
+	Quota uint64 `json:"quota"`
+	// Exceeded is set once the peer is blocked or throttled for the month
+	Exceeded bool `json:"exceeded"`
+}
+
+// QuotaManager keeps the peers of an exit server to their monthly quotas.
+type QuotaManager interface {
+	PeerQuotas() []PeerQuota
+	// ResetQuotas forgets what the peers with the given public keys used
+	// this month, lifting their blocks or throttles
+	ResetQuotas(keys []string) error
+}
+
+// RegisterQuotas exposes the usage of the peers and lets it be reset:
+//
+//	GET  /quotas        usage of every peer this month
+//	POST /quotas/reset  reset the peers whose public keys are in the body
+func (s *Server) RegisterQuotas(m QuotaManager) {
+	s.HandleFunc("GET /quotas", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, m.PeerQuotas())
+	})
+
+	s.HandleFunc("POST /quotas/reset", func(w http.ResponseWriter, r *http.Request) {
+		var keys []string
+		if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(keys) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("no peers given"))
+			return
+		}
+		if err := m.ResetQuotas(keys); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,110 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/update"
+)
+
+const (
+	// configPushInterval is the least time between two config pushes with
+	// a valid signature, applied or not
+	configPushInterval = 30 * time.Second
+	// maxConfigSize bounds a pushed config with its signature
+	maxConfigSize = 1 << 20
+)
+
+// RemoteConfig is configuration pushed by a remote controller. Omitted
+// fields keep their current value.
+type RemoteConfig struct {
+	// Serial must grow with every config, so that an older or replayed
+	// config is refused
+	Serial uint64 `json:"serial"`
+	// Expires refuses the config after this time, so that a captured
+	// config can't be pushed long after it was meant for
+	Expires time.Time `json:"expires"`
+	// Endpoints are tried in order, the tunnel stays on the first that
+	// comes up
+	Endpoints []string `json:"endpoints,omitempty"`
+	// Routes replace the routing rules, as MATCH=TAG like --route
+	Routes []string `json:"routes,omitempty"`
+}
+
+// SignedConfig is a RemoteConfig in json with its minisign signature.
+type SignedConfig struct {
+	Config []byte `json:"config"`
+	// Signature is the contents of the .minisig file
+	Signature string `json:"signature"`
+}
+
+// ConfigManager applies remote configs.
+type ConfigManager interface {
+	// ApplyConfig brings the tunnel back up with c, refusing configs
+	// whose serial isn't newer than the last applied one
+	ApplyConfig(c RemoteConfig) error
+}
+
+// RegisterRemoteConfig lets a remote controller push configs signed with
+// the operator key:
+//
+//	POST /config  apply a SignedConfig
+//
+// Pushes with a valid signature are accepted at most every
+// configPushInterval, so that those without one can't hold off the
+// controller. Applying returns once the tunnel is back up.
+func (s *Server) RegisterRemoteConfig(m ConfigManager, key update.PublicKey) {
+	var (
+		mu   sync.Mutex
+		last time.Time
+	)
+
+	s.HandleFunc("POST /config", func(w http.ResponseWriter, r *http.Request) {
+		var signed SignedConfig
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxConfigSize)).Decode(&signed); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := key.Verify(signed.Config, []byte(signed.Signature)); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+
+		mu.Lock()
+		if wait := configPushInterval - time.Since(last); wait > 0 {
+			mu.Unlock()
+			w.Header().Set("Retry-After", fmt.Sprint(int(wait.Seconds())+1))
+			writeError(w, http.StatusTooManyRequests, errors.New("config was pushed too recently"))
+			return
+		}
+		last = time.Now()
+		mu.Unlock()
+
+		var c RemoteConfig
+		dec := json.NewDecoder(strings.NewReader(string(signed.Config)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&c); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid config: %w", err))
+			return
+		}
+		switch {
+		case c.Expires.IsZero():
+			writeError(w, http.StatusBadRequest, errors.New("config has no expiry"))
+			return
+		case time.Now().After(c.Expires):
+			writeError(w, http.StatusBadRequest, errors.New("config has expired"))
+			return
+		}
+
+		if err := m.ApplyConfig(c); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,106 @@
+package control
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/update"
+	"golang.org/x/crypto/blake2b"
+)
+
+type configRecorder struct {
+	applied []RemoteConfig
+}
+
+func (m *configRecorder) ApplyConfig(c RemoteConfig) error {
+	m.applied = append(m.applied, c)
+	return nil
+}
+
+// signConfig signs c like minisign -S with priv, whose key id is all zero.
+func signConfig(t *testing.T, priv ed25519.PrivateKey, c any) SignedConfig {
+	t.Helper()
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const comment = "timestamp:1700000000"
+	sum := blake2b.Sum512(data)
+	signature := ed25519.Sign(priv, sum[:])
+	global := ed25519.Sign(priv, append(append([]byte(nil), signature...), comment...))
+	raw := append(append([]byte("ED"), make([]byte, 8)...), signature...)
+	return SignedConfig{
+		Config: data,
+		Signature: "untrusted comment: test\n" +
+			base64.StdEncoding.EncodeToString(raw) + "\n" +
+			"trusted comment: " + comment + "\n" +
+			base64.StdEncoding.EncodeToString(global) + "\n",
+	}
+}
+
+// testKey returns a minisign public key, with an all zero key id, and its
+// private key.
+func testKey(t *testing.T) (update.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := update.ParsePublicKey(base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), make([]byte, 8)...), pub...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, priv
+}
+
+func TestRemoteConfig(t *testing.T) {
+	key, priv := testKey(t)
+	_, otherPriv := testKey(t)
+
+	m := &configRecorder{}
+	s := NewServer()
+	s.RegisterRemoteConfig(m, key)
+	push := func(signed SignedConfig) int {
+		body, _ := json.Marshal(signed)
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/config", bytes.NewReader(body)))
+		return w.Code
+	}
+
+	expires := time.Now().Add(time.Hour)
+	steps := []struct {
+		name   string
+		signed SignedConfig
+		want   int
+	}{
+		// Pushes with a bad signature don't hold off the controller
+		{"bad signature", signConfig(t, otherPriv, RemoteConfig{Serial: 1, Expires: expires}), http.StatusForbidden},
+		{"bad signature again", signConfig(t, otherPriv, RemoteConfig{Serial: 1, Expires: expires}), http.StatusForbidden},
+		{"valid", signConfig(t, priv, RemoteConfig{Serial: 1, Expires: expires, Endpoints: []string{"162.159.192.1:2408"}}), http.StatusNoContent},
+		{"too soon", signConfig(t, priv, RemoteConfig{Serial: 2, Expires: expires}), http.StatusTooManyRequests},
+	}
+	for _, step := range steps {
+		if got := push(step.signed); got != step.want {
+			t.Fatalf("%s: got status %d, want %d", step.name, got, step.want)
+		}
+	}
+	if len(m.applied) != 1 || m.applied[0].Serial != 1 {
+		t.Fatalf("got applied configs %+v, want the valid one", m.applied)
+	}
+
+	s = NewServer()
+	s.RegisterRemoteConfig(m, key)
+	if got := push(signConfig(t, priv, map[string]any{"serial": 3})); got != http.StatusBadRequest {
+		t.Fatalf("got status %d for a config without expiry, want %d", got, http.StatusBadRequest)
+	}
+	if len(m.applied) != 1 {
+		t.Fatalf("applied %d configs, want 1", len(m.applied))
+	}
+}
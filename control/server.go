@@ -0,0 +1,117 @@
+package control
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/bepass-org/warp-plus/upgrade"
+)
+
+// DefaultAddress is the address the control server listens on by default.
+const DefaultAddress = "127.0.0.1:8087"
+
+// Server is a local REST API used to inspect and manage a running instance.
+type Server struct {
+	// bind is the address to listen on
+	bind netip.AddrPort
+	// mux routes requests to the registered handlers
+	mux *http.ServeMux
+	// logger error log
+	logger *slog.Logger
+	// auditor records state changing requests, if set
+	auditor Auditor
+	// tokens maps api tokens to their roles, no tokens allows everything
+	tokens map[string]Role
+	// tls serves the api over tls, if set
+	tls *tls.Config
+}
+
+type Option func(*Server)
+
+func WithBind(bind netip.AddrPort) Option {
+	return func(s *Server) {
+		s.bind = bind
+	}
+}
+
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+func NewServer(options ...Option) *Server {
+	s := &Server{
+		bind:   netip.MustParseAddrPort(DefaultAddress),
+		mux:    http.NewServeMux(),
+		logger: slog.Default(),
+	}
+
+	for _, option := range options {
+		option(s)
+	}
+
+	return s
+}
+
+// HandleFunc registers a handler for the given pattern.
+func (s *Server) HandleFunc(pattern string, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// ListenAndServe starts serving in the background until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	ln, err := upgrade.Listen("tcp", s.bind.String())
+	if err != nil {
+		return err
+	}
+
+	if s.tls != nil {
+		ln = tls.NewListener(ln, s.tls)
+	}
+
+	var handler http.Handler = s.mux
+	if len(s.tokens) > 0 {
+		handler = s.authorize(handler)
+	}
+	handler = s.guard(handler)
+	// Denied requests are audited too
+	if s.auditor != nil {
+		handler = s.audit(handler)
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			s.logger.Error("control server stopped", "error", err)
+		}
+	}()
+
+	s.logger.Info("serving control api", "address", s.bind, "tls", s.tls != nil, "tokens", len(s.tokens))
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
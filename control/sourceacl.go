@@ -0,0 +1,17 @@
+package control
+
+import (
+	"net/http"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// RegisterSourceACL exposes the connection counts of inbounds with source
+// rules:
+//
+//	GET /source-acl  connections accepted and rejected per inbound
+func (s *Server) RegisterSourceACL(acl *wiresocks.SourceACL) {
+	s.HandleFunc("GET /source-acl", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, acl.Stats())
+	})
+}
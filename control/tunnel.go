@@ -0,0 +1,79 @@
+package control
+
+import (
+	"net/http"
+	"time"
+)
+
+// TunnelStats describes a wireguard peer of the running tunnel.
+type TunnelStats struct {
+	Endpoint string `json:"endpoint"`
+	RxBytes  uint64 `json:"rx_bytes"`
+	TxBytes  uint64 `json:"tx_bytes"`
+	// LastHandshake is zero until the first handshake completes
+	LastHandshake time.Time `json:"last_handshake"`
+	// RTTMillis is the smoothed handshake round trip time, zero until
+	// measured
+	RTTMillis int64 `json:"rtt_ms"`
+	// Handshakes counts the completed handshakes, the percentiles are of
+	// their latency from the first initiation to the response,
+	// retransmissions included
+	Handshakes         uint64 `json:"handshakes"`
+	HandshakeP50Millis int64  `json:"handshake_p50_ms"`
+	HandshakeP95Millis int64  `json:"handshake_p95_ms"`
+	HandshakeP99Millis int64  `json:"handshake_p99_ms"`
+	// KeypairCreated is when the session keys in use were derived, zero
+	// until the first handshake completes. KeypairSent and KeypairReceived
+	// count the messages carried under them.
+	KeypairCreated  time.Time `json:"keypair_created"`
+	KeypairSent     uint64    `json:"keypair_sent"`
+	KeypairReceived uint64    `json:"keypair_received"`
+	// KeypairRotations counts the session keys put in use since the
+	// tunnel came up
+	KeypairRotations uint64 `json:"keypair_rotations"`
+}
+
+// TunnelStatus is the state of the running tunnel.
+type TunnelStatus struct {
+	Mode    string        `json:"mode"`
+	Tunnels []TunnelStats `json:"tunnels"`
+}
+
+// TunnelManager reports on the running tunnel and brings it back up
+// differently on request.
+type TunnelManager interface {
+	TunnelStatus() TunnelStatus
+	// SwitchMode brings the tunnel back up in mode, such as gool
+	SwitchMode(mode string) error
+	// Rescan brings the tunnel back up on freshly scanned endpoints
+	Rescan() error
+}
+
+// RegisterTunnel exposes the tunnel state and lets it be reconfigured:
+//
+//	GET  /tunnel              mode and per peer endpoint, traffic, handshakes, rtt and session keys
+//	POST /tunnel/mode/{mode}  bring the tunnel back up in another mode
+//	POST /tunnel/rescan       bring the tunnel back up on freshly scanned endpoints
+//
+// Reconfiguring returns once the tunnel is back up.
+func (s *Server) RegisterTunnel(m TunnelManager) {
+	s.HandleFunc("GET /tunnel", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, m.TunnelStatus())
+	})
+
+	s.HandleFunc("POST /tunnel/mode/{mode}", func(w http.ResponseWriter, r *http.Request) {
+		if err := m.SwitchMode(r.PathValue("mode")); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	s.HandleFunc("POST /tunnel/rescan", func(w http.ResponseWriter, _ *http.Request) {
+		if err := m.Rescan(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,17 @@
+package control
+
+import (
+	"net/http"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// RegisterUDPNAT exposes the flow counts of the UDP NAT table:
+//
+//	GET /udp-nat  active flows, and how many were opened, failed, expired,
+//	              evicted and migrated
+func (s *Server) RegisterUDPNAT(n *wiresocks.UDPNAT) {
+	s.HandleFunc("GET /udp-nat", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, n.Stats())
+	})
+}
@@ -0,0 +1,20 @@
+package control
+
+import (
+	"net/http"
+)
+
+// RegisterUpgrade exposes zero-downtime upgrades:
+//
+//	POST /upgrade  start the binary now on disk and hand the listeners over
+//
+// upgrade performs the handover and returns once the new process serves.
+func (s *Server) RegisterUpgrade(upgrade func() error) {
+	s.HandleFunc("POST /upgrade", func(w http.ResponseWriter, _ *http.Request) {
+		if err := upgrade(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,256 @@
+package doh
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/noql-net/certpool"
+)
+
+const (
+	dnsMessageType = "application/dns-message"
+	maxMessageSize = 65535
+	defaultTimeout = 5 * time.Second
+	// maxIdleTLS bounds the idle DoT connections kept for reuse
+	maxIdleTLS = 4
+	// idleTLSTimeout is how long a DoT connection is kept idle, shorter than
+	// resolvers keep them open for
+	idleTLSTimeout = 10 * time.Second
+)
+
+// DialFunc dials a connection to the upstream resolver.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Client forwards raw DNS messages to an encrypted upstream resolver.
+type Client struct {
+	upstream Upstream
+	protocol Protocol
+	dial     DialFunc
+	http     *http.Client
+
+	mu sync.Mutex
+	// idle holds the DoT connections open for reuse, the most recently used
+	// last
+	idle []idleConn
+}
+
+// idleConn is a DoT connection and when it was last used.
+type idleConn struct {
+	conn *tls.Conn
+	used time.Time
+}
+
+// NewClient returns a client for the given upstream. If dial is nil the
+// system dialer is used.
+func NewClient(upstream Upstream, protocol Protocol, dial DialFunc) *Client {
+	if dial == nil {
+		d := &net.Dialer{Timeout: defaultTimeout}
+		dial = d.DialContext
+	}
+
+	c := &Client{
+		upstream: upstream,
+		protocol: protocol,
+		dial:     dial,
+	}
+
+	c.http = &http.Client{
+		Timeout: defaultTimeout,
+		Transport: &http.Transport{
+			DialContext:       c.dialBootstrap,
+			ForceAttemptHTTP2: true,
+			TLSClientConfig: &tls.Config{
+				ServerName: upstream.ServerName,
+				RootCAs:    certpool.Roots(),
+			},
+		},
+	}
+
+	return c
+}
+
+// dialBootstrap connects to the first reachable bootstrap address, falling
+// back to the address as given when no bootstrap addresses are configured.
+func (c *Client) dialBootstrap(ctx context.Context, network, address string) (net.Conn, error) {
+	if len(c.upstream.Bootstrap) == 0 {
+		return c.dial(ctx, network, address)
+	}
+
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, addr := range c.upstream.Bootstrap {
+		conn, err := c.dial(ctx, network, netip.AddrPortFrom(addr, uint16(portNum)).String())
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// Exchange sends a DNS query in wire format and returns the response.
+func (c *Client) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	switch c.protocol {
+	case ProtocolDoT:
+		return c.exchangeTLS(ctx, query)
+	default:
+		return c.exchangeHTTPS(ctx, query)
+	}
+}
+
+func (c *Client) exchangeHTTPS(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.upstream.URL, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned status: %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+}
+
+func (c *Client) exchangeTLS(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) > maxMessageSize {
+		return nil, errors.New("query too large")
+	}
+
+	// A connection the resolver closed while idle fails the first query
+	// sent on it, which is sent again on the next one
+	for conn := c.takeIdle(); conn != nil; conn = c.takeIdle() {
+		if resp, err := c.exchangeOn(ctx, conn, query); err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	raw, err := c.dialBootstrap(ctx, "tcp", net.JoinHostPort(c.upstream.ServerName, "853"))
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, &tls.Config{
+		ServerName: c.upstream.ServerName,
+		RootCAs:    certpool.Roots(),
+	})
+	return c.exchangeOn(ctx, conn, query)
+}
+
+// exchangeOn sends query on conn and reads the response, keeping conn for
+// reuse if it worked and closing it if not.
+func (c *Client) exchangeOn(ctx context.Context, conn *tls.Conn, query []byte) ([]byte, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := writeStreamMessage(conn, query); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := readStreamMessage(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.putIdle(conn)
+	return resp, nil
+}
+
+// takeIdle returns the most recently used idle DoT connection, nil if there
+// is none, closing those idle for too long.
+func (c *Client) takeIdle() *tls.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.idle) > 0 {
+		ic := c.idle[len(c.idle)-1]
+		c.idle = c.idle[:len(c.idle)-1]
+		if time.Since(ic.used) < idleTLSTimeout {
+			return ic.conn
+		}
+		ic.conn.Close()
+	}
+	return nil
+}
+
+// putIdle keeps conn for reuse, closing the least recently used idle
+// connection if there are too many.
+func (c *Client) putIdle(conn *tls.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.idle) == maxIdleTLS {
+		c.idle[0].conn.Close()
+		c.idle = c.idle[1:]
+	}
+	c.idle = append(c.idle, idleConn{conn: conn, used: time.Now()})
+}
+
+// CloseIdleConnections closes the connections kept open for reuse.
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle = nil
+	c.mu.Unlock()
+
+	for _, ic := range idle {
+		ic.conn.Close()
+	}
+	c.http.CloseIdleConnections()
+}
+
+// writeStreamMessage writes a length-prefixed DNS message (RFC 1035 4.2.2).
+func writeStreamMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readStreamMessage reads a length-prefixed DNS message.
+func readStreamMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,289 @@
+package doh
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// typeHTTPS is the HTTPS record type, RFC 9460, which dnsmessage doesn't
+// know
+const typeHTTPS dnsmessage.Type = 65
+
+// HTTPS service parameter keys, RFC 9460 14.3.2
+const (
+	svcParamPort     = 3
+	svcParamIPv4Hint = 4
+	svcParamIPv6Hint = 6
+)
+
+// SRV is a service record.
+type SRV struct {
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+}
+
+// HTTPS is a ServiceMode HTTPS record, or an AliasMode one if Priority is
+// zero.
+type HTTPS struct {
+	Priority uint16
+	// Target is where the service is, the name looked up itself if empty
+	Target string
+	// Port is the port of the service, zero if not given
+	Port  uint16
+	Hints []netip.Addr
+}
+
+// PlainServer exchanges DNS messages unencrypted with the resolver at its
+// address, over udp and over tcp for answers too long for udp.
+type PlainServer netip.AddrPort
+
+// Exchange sends a DNS query in wire format and returns the response.
+func (s PlainServer) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < 12 || len(query) > maxMessageSize {
+		return nil, errors.New("invalid query")
+	}
+	// Queries go out with a random id that the answer has to match
+	query = append([]byte(nil), query...)
+	id := query[:2]
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", netip.AddrPort(s).String())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if err := c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp := buf[:n]
+		if n < 12 || resp[0] != id[0] || resp[1] != id[1] {
+			continue
+		}
+		// Truncated, ask again over tcp
+		if resp[2]&0x02 != 0 {
+			return s.exchangeTCP(ctx, query, deadline)
+		}
+		return resp, nil
+	}
+}
+
+func (s PlainServer) exchangeTCP(ctx context.Context, query []byte, deadline time.Time) ([]byte, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", netip.AddrPort(s).String())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if err := c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if err := writeStreamMessage(c, query); err != nil {
+		return nil, err
+	}
+	return readStreamMessage(c)
+}
+
+// LookupAddrs resolves the IPv4 and IPv6 addresses of host through x.
+func LookupAddrs(ctx context.Context, x Exchanger, host string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	var lastErr error
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, err := lookup(ctx, x, host, typ)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, a := range answers {
+			switch r := a.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, netip.AddrFrom4(r.A))
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, netip.AddrFrom16(r.AAAA))
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("%s has no addresses", host)
+		}
+		return nil, lastErr
+	}
+	return addrs, nil
+}
+
+// LookupSRV resolves the service records of name through x, ordered by
+// priority.
+func LookupSRV(ctx context.Context, x Exchanger, name string) ([]SRV, error) {
+	answers, err := lookup(ctx, x, name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	var records []SRV
+	for _, a := range answers {
+		if r, ok := a.Body.(*dnsmessage.SRVResource); ok {
+			records = append(records, SRV{
+				Target:   strings.TrimSuffix(r.Target.String(), "."),
+				Port:     r.Port,
+				Priority: r.Priority,
+				Weight:   r.Weight,
+			})
+		}
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s has no srv records", name)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Priority < records[j].Priority
+	})
+	return records, nil
+}
+
+// LookupHTTPS resolves the HTTPS records of name through x, ordered by
+// priority.
+func LookupHTTPS(ctx context.Context, x Exchanger, name string) ([]HTTPS, error) {
+	answers, err := lookup(ctx, x, name, typeHTTPS)
+	if err != nil {
+		return nil, err
+	}
+	var records []HTTPS
+	for _, a := range answers {
+		r, ok := a.Body.(*dnsmessage.UnknownResource)
+		if !ok || a.Header.Type != typeHTTPS {
+			continue
+		}
+		if record, err := parseHTTPS(r.Data); err == nil {
+			records = append(records, record)
+		}
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s has no https records", name)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Priority < records[j].Priority
+	})
+	return records, nil
+}
+
+// parseHTTPS parses the data of an HTTPS record, RFC 9460 2.2.
+func parseHTTPS(data []byte) (HTTPS, error) {
+	var r HTTPS
+	if len(data) < 3 {
+		return r, errors.New("short https record")
+	}
+	r.Priority = binary.BigEndian.Uint16(data)
+	data = data[2:]
+
+	// The target name is never compressed
+	var labels []string
+	for {
+		if len(data) == 0 || int(data[0]) >= len(data) {
+			return r, errors.New("bad https record target")
+		}
+		n := int(data[0])
+		if n == 0 {
+			data = data[1:]
+			break
+		}
+		labels = append(labels, string(data[1:1+n]))
+		data = data[1+n:]
+	}
+	r.Target = strings.Join(labels, ".")
+
+	for len(data) >= 4 {
+		key, n := binary.BigEndian.Uint16(data), int(binary.BigEndian.Uint16(data[2:]))
+		if 4+n > len(data) {
+			return r, errors.New("bad https record parameter")
+		}
+		value := data[4 : 4+n]
+		data = data[4+n:]
+
+		switch key {
+		case svcParamPort:
+			if len(value) == 2 {
+				r.Port = binary.BigEndian.Uint16(value)
+			}
+		case svcParamIPv4Hint:
+			for ; len(value) >= 4; value = value[4:] {
+				r.Hints = append(r.Hints, netip.AddrFrom4([4]byte(value)))
+			}
+		case svcParamIPv6Hint:
+			for ; len(value) >= 16; value = value[16:] {
+				r.Hints = append(r.Hints, netip.AddrFrom16([16]byte(value)))
+			}
+		}
+	}
+	return r, nil
+}
+
+// lookup resolves the records of name of type typ through x.
+func lookup(ctx context.Context, x Exchanger, name string, typ dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The id is zero as recommended for DoH, RFC 8484 4.1
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: n, Type: typ, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := x.Exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, err
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("resolving %s: %s", strings.TrimSuffix(name, "."), h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	// CNAMEs are followed by the resolver, and answered too
+	return p.AllAnswers()
+}
@@ -0,0 +1,248 @@
+package doh
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// minUDPSize is the largest response every client takes over udp, RFC 1035
+// 4.2.1, and more only when it says so with EDNS, RFC 6891 6.2.5.
+const minUDPSize = 512
+
+// Exchanger resolves a DNS query given in wire format.
+type Exchanger interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// Server is a plain DNS listener that forwards every query to an Exchanger.
+type Server struct {
+	// bind is the address to listen on for both udp and tcp
+	bind netip.AddrPort
+	// upstream answers forwarded queries
+	upstream Exchanger
+	// onBlock is called for every response the upstream blocked
+	onBlock func(Verdict)
+	// logger error log
+	logger *slog.Logger
+}
+
+type Option func(*Server)
+
+func WithBind(bind netip.AddrPort) Option {
+	return func(s *Server) {
+		s.bind = bind
+	}
+}
+
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithBlockHandler registers a callback for responses in which the upstream
+// resolver reports a policy block.
+func WithBlockHandler(f func(Verdict)) Option {
+	return func(s *Server) {
+		s.onBlock = f
+	}
+}
+
+func NewServer(upstream Exchanger, options ...Option) *Server {
+	s := &Server{
+		bind:     netip.MustParseAddrPort("127.0.0.1:53"),
+		upstream: upstream,
+		logger:   slog.Default(),
+	}
+
+	for _, option := range options {
+		option(s)
+	}
+
+	return s
+}
+
+// ListenAndServe starts the udp and tcp listeners and serves queries in the
+// background until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	pc, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(s.bind))
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(s.bind))
+	if err != nil {
+		_ = pc.Close()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = pc.Close()
+		_ = ln.Close()
+	}()
+
+	go s.serveUDP(ctx, pc)
+	go s.serveTCP(ctx, ln)
+
+	return nil
+}
+
+func (s *Server) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	resp, err := s.upstream.Exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.onBlock != nil {
+		if v, ok := BlockVerdict(resp); ok {
+			s.onBlock(v)
+		}
+	}
+
+	return resp, nil
+}
+
+func (s *Server) serveUDP(ctx context.Context, pc *net.UDPConn) {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := pc.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Error("failed to read udp query", "error", err)
+			}
+			return
+		}
+
+		query := make([]byte, n)
+		copy(query, buf[:n])
+
+		go func() {
+			resp, err := s.exchange(ctx, query)
+			if err != nil {
+				s.logger.Debug("failed to resolve query", "error", err)
+				return
+			}
+			resp = truncate(resp, udpSize(query))
+			if _, err := pc.WriteToUDPAddrPort(resp, addr); err != nil {
+				s.logger.Debug("failed to write udp response", "error", err)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP(ctx context.Context, ln *net.TCPListener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Error("failed to accept tcp connection", "error", err)
+			}
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			for {
+				query, err := readStreamMessage(conn)
+				if err != nil {
+					return
+				}
+
+				resp, err := s.exchange(ctx, query)
+				if err != nil {
+					s.logger.Debug("failed to resolve query", "error", err)
+					return
+				}
+
+				if err := writeStreamMessage(conn, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// udpSize returns the size of the largest udp response the client of query
+// takes.
+func udpSize(query []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return minUDPSize
+	}
+	if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return minUDPSize
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return minUDPSize
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			// The OPT record carries the size in its class
+			return max(minUDPSize, int(h.Class))
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return minUDPSize
+		}
+	}
+}
+
+// truncate returns resp if it fits in size, or else its header and question
+// with the TC bit set, so the client retries over tcp, RFC 2181 9. The OPT
+// record of resp is kept for EDNS clients.
+func truncate(resp []byte, size int) []byte {
+	if len(resp) <= size {
+		return resp
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return resp
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return resp
+	}
+	var opt *dnsmessage.Resource
+	if p.SkipAllAnswers() == nil && p.SkipAllAuthorities() == nil {
+		additionals, _ := p.AllAdditionals()
+		for i := range additionals {
+			if additionals[i].Header.Type == dnsmessage.TypeOPT {
+				opt = &additionals[i]
+				break
+			}
+		}
+	}
+
+	h.Truncated = true
+	b := dnsmessage.NewBuilder(nil, h)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return resp
+	}
+	for _, q := range questions {
+		if err := b.Question(q); err != nil {
+			return resp
+		}
+	}
+	if opt != nil {
+		if err := b.StartAdditionals(); err != nil {
+			return resp
+		}
+		if err := b.OPTResource(opt.Header, *opt.Body.(*dnsmessage.OPTResource)); err != nil {
+			return resp
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return resp
+	}
+	return msg
+}
@@ -0,0 +1,111 @@
+package doh
+
+import (
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsMessage builds a message asking for name, answering with answers A
+// records, with an OPT record advertising udpSize if it isn't zero.
+func dnsMessage(t *testing.T, name string, answers int, udpSize uint16) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 7, Response: answers > 0})
+	n := dnsmessage.MustNewName(name)
+	if err := b.StartQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Question(dnsmessage.Question{Name: n, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.StartAnswers(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < answers; i++ {
+		h := dnsmessage.ResourceHeader{Name: n, Class: dnsmessage.ClassINET, TTL: 60}
+		if err := b.AResource(h, dnsmessage.AResource{A: netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}).As4()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if udpSize > 0 {
+		if err := b.StartAdditionals(); err != nil {
+			t.Fatal(err)
+		}
+		h := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(".")}
+		if err := h.SetEDNS0(int(udpSize), dnsmessage.RCodeSuccess, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.OPTResource(h, dnsmessage.OPTResource{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestUDPSize(t *testing.T) {
+	for _, tt := range []struct {
+		advertised uint16
+		want       int
+	}{
+		{0, 512},
+		{256, 512},
+		{1232, 1232},
+		{4096, 4096},
+	} {
+		if got := udpSize(dnsMessage(t, "example.com.", 0, tt.advertised)); got != tt.want {
+			t.Errorf("advertising %d: got %d, want %d", tt.advertised, got, tt.want)
+		}
+	}
+	if got := udpSize([]byte{1, 2, 3}); got != minUDPSize {
+		t.Errorf("got %d for a malformed query, want %d", got, minUDPSize)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	small := dnsMessage(t, "example.com.", 2, 0)
+	if got := truncate(small, minUDPSize); string(got) != string(small) {
+		t.Fatal("truncated a response that fits")
+	}
+
+	// Far more answers than fit in 512 bytes
+	resp := dnsMessage(t, "example.com.", 100, 4096)
+	got := truncate(resp, minUDPSize)
+	if len(got) > minUDPSize {
+		t.Fatalf("truncated to %d bytes, want at most %d", len(got), minUDPSize)
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Truncated || h.ID != 7 {
+		t.Fatalf("header %+v, want the TC bit and the id kept", h)
+	}
+	q, err := p.Question()
+	if err != nil || q.Name.String() != "example.com." {
+		t.Fatalf("question %v, %v, want example.com.", q, err)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	if answers, err := p.AllAnswers(); err != nil || len(answers) != 0 {
+		t.Fatalf("kept %d answers, %v", len(answers), err)
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		t.Fatal(err)
+	}
+	if extra, err := p.AllAdditionals(); err != nil || len(extra) != 1 || extra[0].Header.Type != dnsmessage.TypeOPT {
+		t.Fatalf("additionals %v, %v, want the OPT record", extra, err)
+	}
+
+	// An EDNS client taking more gets it whole
+	if got := truncate(resp, 4096); string(got) != string(resp) {
+		t.Fatal("truncated a response within the advertised size")
+	}
+}
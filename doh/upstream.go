@@ -0,0 +1,92 @@
+package doh
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Protocol is the transport used to reach an upstream resolver.
+type Protocol string
+
+const (
+	ProtocolDoH Protocol = "doh"
+	ProtocolDoT Protocol = "dot"
+)
+
+// Upstream describes an encrypted DNS resolver.
+type Upstream struct {
+	// URL is the RFC 8484 endpoint used for DoH.
+	URL string
+	// ServerName is the TLS server name used for DoT and for
+	// verifying the DoH certificate.
+	ServerName string
+	// Bootstrap holds addresses used to reach the resolver without
+	// having to resolve its hostname first.
+	Bootstrap []netip.Addr
+}
+
+// Filter variants offered by Cloudflare's public resolver.
+const (
+	FilterNone    = "none"
+	FilterMalware = "malware"
+	FilterFamily  = "family"
+)
+
+// Filters lists the valid filter variant names.
+var Filters = []string{FilterNone, FilterMalware, FilterFamily}
+
+// CloudflareUpstream returns the 1.1.1.1 resolver for the given filter variant.
+func CloudflareUpstream(filter string) (Upstream, error) {
+	switch filter {
+	case FilterNone, "":
+		return Upstream{
+			URL:        "https://cloudflare-dns.com/dns-query",
+			ServerName: "cloudflare-dns.com",
+			Bootstrap: []netip.Addr{
+				netip.MustParseAddr("1.1.1.1"),
+				netip.MustParseAddr("1.0.0.1"),
+				netip.MustParseAddr("2606:4700:4700::1111"),
+				netip.MustParseAddr("2606:4700:4700::1001"),
+			},
+		}, nil
+	case FilterMalware:
+		return Upstream{
+			URL:        "https://security.cloudflare-dns.com/dns-query",
+			ServerName: "security.cloudflare-dns.com",
+			Bootstrap: []netip.Addr{
+				netip.MustParseAddr("1.1.1.2"),
+				netip.MustParseAddr("1.0.0.2"),
+				netip.MustParseAddr("2606:4700:4700::1112"),
+				netip.MustParseAddr("2606:4700:4700::1002"),
+			},
+		}, nil
+	case FilterFamily:
+		return Upstream{
+			URL:        "https://family.cloudflare-dns.com/dns-query",
+			ServerName: "family.cloudflare-dns.com",
+			Bootstrap: []netip.Addr{
+				netip.MustParseAddr("1.1.1.3"),
+				netip.MustParseAddr("1.0.0.3"),
+				netip.MustParseAddr("2606:4700:4700::1113"),
+				netip.MustParseAddr("2606:4700:4700::1003"),
+			},
+		}, nil
+	default:
+		return Upstream{}, fmt.Errorf("unknown filter variant %q", filter)
+	}
+}
+
+// GatewayUpstream returns the account-specific Cloudflare Gateway DoH
+// resolver for the given DNS location ID.
+func GatewayUpstream(id string) (Upstream, error) {
+	if id == "" || strings.ContainsAny(id, "./:") {
+		return Upstream{}, fmt.Errorf("invalid gateway location id %q", id)
+	}
+
+	host := id + ".cloudflare-gateway.com"
+	return Upstream{
+		URL:        "https://" + host + "/dns-query",
+		ServerName: host,
+	}, nil
+}
@@ -0,0 +1,97 @@
+package doh
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// optionCodeEDE is the EDNS0 Extended DNS Error option (RFC 8914).
+const optionCodeEDE = 15
+
+// Extended DNS Error info codes used by filtering resolvers.
+const (
+	edeBlocked    = 15
+	edeCensored   = 16
+	edeFiltered   = 17
+	edeProhibited = 18
+)
+
+// Verdict describes why a filtering resolver refused to resolve a name.
+type Verdict struct {
+	Domain string
+	Reason string
+}
+
+// BlockVerdict inspects a DNS response and reports whether the upstream
+// resolver blocked the queried name. Cloudflare Gateway signals policy
+// blocks with an Extended DNS Error and answers with the unspecified address
+// when no block page is configured.
+func BlockVerdict(resp []byte) (Verdict, bool) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(resp); err != nil {
+		return Verdict{}, false
+	}
+
+	q, err := p.Question()
+	if err != nil {
+		return Verdict{}, false
+	}
+	v := Verdict{Domain: strings.TrimSuffix(q.Name.String(), ".")}
+	if err := p.SkipAllQuestions(); err != nil {
+		return Verdict{}, false
+	}
+
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return Verdict{}, false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return Verdict{}, false
+	}
+	additionals, err := p.AllAdditionals()
+	if err != nil {
+		return Verdict{}, false
+	}
+
+	for _, rr := range additionals {
+		opt, ok := rr.Body.(*dnsmessage.OPTResource)
+		if !ok {
+			continue
+		}
+		for _, o := range opt.Options {
+			if o.Code != optionCodeEDE || len(o.Data) < 2 {
+				continue
+			}
+			switch binary.BigEndian.Uint16(o.Data) {
+			case edeBlocked, edeCensored, edeFiltered, edeProhibited:
+				v.Reason = string(o.Data[2:])
+				if v.Reason == "" {
+					v.Reason = "blocked by resolver policy"
+				}
+				return v, true
+			}
+		}
+	}
+
+	if len(answers) == 0 {
+		return Verdict{}, false
+	}
+	for _, rr := range answers {
+		switch b := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			if b.A != [4]byte{} {
+				return Verdict{}, false
+			}
+		case *dnsmessage.AAAAResource:
+			if b.AAAA != [16]byte{} {
+				return Verdict{}, false
+			}
+		default:
+			return Verdict{}, false
+		}
+	}
+	v.Reason = "blocked by resolver policy"
+	return v, true
+}
@@ -0,0 +1,109 @@
+package i18n
+
+var persian = map[string]string{
+	// Command output
+	"error: %v":                               "خطا: %v",
+	"usage: kill <id>":                        "استفاده: kill <id>",
+	"invalid connection id: %w":               "شناسه اتصال نامعتبر است: %w",
+	"usage: update [check]":                   "استفاده: update [check]",
+	"%s is up to date":                        "%s به‌روز است",
+	"%s is available":                         "%s در دسترس است",
+	"unversioned build, latest release is %s": "این نسخه شماره نسخه ندارد، آخرین انتشار %s است",
+	"this build has no update signing key":    "این نسخه کلید امضای به‌روزرسانی ندارد",
+	"updated to %s, run '%s upgrade' to restart a running instance into it": "به %s به‌روز شد، برای راه‌اندازی مجدد نمونه در حال اجرا با آن '%s upgrade' را اجرا کنید",
+	"usage: devices [list | remove <id>... | bind]":                         "استفاده: devices [list | remove <id>... | bind]",
+	"ID\tNAME\tTYPE\tMODEL\tCREATED\tACTIVE":                                "شناسه\tنام\tنوع\tمدل\tایجاد\tفعال",
+	"yes":                                                                   "بله",
+	"no":                                                                    "خیر",
+	"%d of %d devices bound, * marks this instance":                         "%d از %d دستگاه متصل است، * نشان‌دهنده این نمونه است",
+	"usage: peers [generate | stats | quota] [flags] | peers usage | peers reset <peer>...":    "استفاده: peers [generate | stats | quota] [flags] | peers usage | peers reset <peer>...",
+	"invalid size %q: want a size such as 50GiB":                                               "اندازه %q نامعتبر است: باید اندازه‌ای مانند 50GiB باشد",
+	"invalid peer quota %q: want NAME=SIZE":                                                    "سهمیه همتای %q نامعتبر است: باید به شکل NAME=SIZE باشد",
+	"invalid throttle %q: want a rate such as 128kb/s":                                         "محدودیت سرعت %q نامعتبر است: باید نرخی مانند 128kb/s باشد",
+	"PEER\tMONTH\tUSED\tQUOTA\tEXCEEDED":                                                       "همتا\tماه\tمصرف\tسهمیه\tعبور از سهمیه",
+	"invalid tenant %q: want NAME:COUNT[:RATE]":                                                "مستأجر %q نامعتبر است: باید به شکل NAME:COUNT[:RATE] باشد",
+	"invalid rate %q of tenant %s: want a rate such as 20mbit":                                 "نرخ %q مستأجر %s نامعتبر است: باید نرخی مانند 20mbit باشد",
+	"tenant %s is given twice":                                                                 "مستأجر %s دو بار داده شده است",
+	"subnet %s is too small for %d tenants":                                                    "زیرشبکه %s برای %d مستأجر بسیار کوچک است",
+	"reading the peers of %s: %w":                                                              "خواندن همتاهای %s: %w",
+	"TENANT\tPEERS\tACTIVE\tRECEIVED\tSENT":                                                    "مستأجر\tهمتاها\tفعال\tدریافتی\tارسالی",
+	"invalid subnet: %w":                                                                       "زیرشبکه نامعتبر است: %w",
+	"--endpoint is required":                                                                   "--endpoint الزامی است",
+	"invalid dns address: %w":                                                                  "آدرس DNS نامعتبر است: %w",
+	"invalid allowed ip: %w":                                                                   "آی‌پی مجاز نامعتبر است: %w",
+	"invalid endpoint: %w":                                                                     "اندپوینت نامعتبر است: %w",
+	"count must be at least 1":                                                                 "تعداد باید دست‌کم ۱ باشد",
+	"subnet %s is too small for %d peers":                                                      "زیرشبکه %s برای %d همتا بسیار کوچک است",
+	"wrote the server config and %d peer configs to %s":                                        "پیکربندی سرور و %d پیکربندی همتا در %s نوشته شد",
+	"usage: config push <file> [signature]":                                                    "استفاده: config push <file> [signature]",
+	"ENDPOINT\tLAST HANDSHAKE\tRTT\tHANDSHAKES\tP50\tP95\tP99\tKEY AGE\tROTATIONS":             "اندپوینت\tآخرین دست‌دهی\tRTT\tدست‌دهی‌ها\tP50\tP95\tP99\tعمر کلید\tچرخش‌ها",
+	"usage: endpoints [list | scan | use <endpoint>...]":                                       "استفاده: endpoints [list | scan | use <endpoint>...]",
+	"no endpoints were scanned yet, run 'endpoints scan'":                                      "هنوز اندپوینتی اسکن نشده است، 'endpoints scan' را اجرا کنید",
+	"ENDPOINT\tSCORE\tRTT\tJITTER\tLOSS\tSCANNED":                                              "اندپوینت\tامتیاز\tRTT\tنوسان\tاتلاف\tاسکن",
+	"tuned for %s power, as set":                                                               "تنظیم شده برای برق %s، طبق تعیین کاربر",
+	"tuned for %s power, as detected":                                                          "تنظیم شده برای برق %s، طبق تشخیص",
+	"usage: relay <listen address> <endpoint> | relay masque [flags] <listen address>":         "استفاده: relay <listen address> <endpoint> | relay masque [flags] <listen address>",
+	"usage: relay masque --cert <file> --key <file> [--auth <user:password>] <listen address>": "استفاده: relay masque --cert <file> --key <file> [--auth <user:password>] <listen address>",
+	"--auth must be USER:PASSWORD":                                                             "مقدار --auth باید به شکل USER:PASSWORD باشد",
+	"usage: power [ac | battery | auto]":                                                       "استفاده: power [ac | battery | auto]",
+	"ID\tSOURCE\tDESTINATION\tPROTOCOL\tSENT\tRECEIVED\tAGE":                                   "شناسه\tمبدأ\tمقصد\tپروتکل\tارسالی\tدریافتی\tمدت",
+
+	// Terminal UI
+	"mode: %s": "حالت: %s",
+	"ENDPOINT\tHANDSHAKE\tRTT\tDOWN\tUP\tRECEIVED\tSENT": "اندپوینت\tدست‌دهی\tRTT\tدانلود\tآپلود\tدریافتی\tارسالی",
+	"never":                            "هرگز",
+	"%s ago":                           "%s پیش",
+	"no tunnel is up":                  "هیچ تونلی برقرار نیست",
+	"rescan":                           "اسکن مجدد",
+	"switch to %s":                     "تغییر به %s",
+	"%s in progress...":                "%s در حال انجام...",
+	"%s done":                          "%s انجام شد",
+	"%s failed: %v":                    "%s ناموفق بود: %v",
+	"mode (warp, gool or psiphon:CC):": "حالت (warp، gool یا psiphon:CC):",
+	"r rescan  w warp  g gool  p psiphon  m mode  q quit": "r اسکن مجدد  w وارپ  g گول  p سایفون  m حالت  q خروج",
+
+	// Notifications
+	"Connected":                    "متصل شد",
+	"The tunnel is up in %s mode.": "تونل در حالت %s برقرار است.",
+	"Disconnected":                 "قطع شد",
+	"The tunnel is down.":          "تونل قطع است.",
+	"Connection stalled":           "اتصال متوقف شد",
+	"Handshakes stopped completing, traffic is not getting through.": "دست‌دهی‌ها دیگر انجام نمی‌شوند، ترافیک عبور نمی‌کند.",
+	"Connection recovered":             "اتصال بازیابی شد",
+	"Handshakes are completing again.": "دست‌دهی‌ها دوباره انجام می‌شوند.",
+	"WARP+ data running low":           "حجم WARP+ رو به اتمام است",
+	"%.2f GiB of WARP+ data left.":     "%.2f گیگابایت از حجم WARP+ باقی مانده است.",
+	"WARP+ license not applied":        "لایسنس WARP+ اعمال نشد",
+	"The license is bound to too many devices, running on a free account. Remove a stale one with warp-plus devices remove.": "لایسنس به تعداد زیادی دستگاه متصل است، با حساب رایگان اجرا می‌شود. یک دستگاه قدیمی را با warp-plus devices remove حذف کنید.",
+
+	// Error explanations
+	"The tunnel could not be established in time. The endpoint may be blocked on this network, try --scan to find another one, or --gool or --cfon.": "تونل به موقع برقرار نشد. ممکن است این اندپوینت در این شبکه مسدود باشد، برای یافتن اندپوینت دیگر از --scan استفاده کنید، یا --gool یا --cfon را امتحان کنید.",
+	"The address %s is already in use, possibly by another instance. Choose another one with %s.":                                                    "آدرس %s در حال استفاده است، شاید توسط نمونه دیگری از برنامه. با %s آدرس دیگری انتخاب کنید.",
+	"The address is already in use, possibly by another instance.":                                                                                   "این آدرس در حال استفاده است، شاید توسط نمونه دیگری از برنامه.",
+	"Permission denied. Tun mode and ports below 1024 need root, or an administrator on Windows.":                                                    "دسترسی رد شد. حالت tun و پورت‌های کمتر از ۱۰۲۴ به دسترسی root، یا در ویندوز به دسترسی مدیر نیاز دارند.",
+
+	// Block page
+	"Blocked by DNS policy": "مسدود شده توسط سیاست DNS",
+	"The following domains were filtered by the upstream resolver. Contact your Zero Trust administrator if you believe a domain was blocked by mistake.": "دامنه‌های زیر توسط سرور DNS بالادستی فیلتر شدند. اگر فکر می‌کنید دامنه‌ای به اشتباه مسدود شده است، با مدیر Zero Trust خود تماس بگیرید.",
+	"Time":                          "زمان",
+	"Domain":                        "دامنه",
+	"Reason":                        "دلیل",
+	"No domains have been blocked.": "هیچ دامنه‌ای مسدود نشده است.",
+	"FLAG\tVALUE\tFROM":             "پرچم\tمقدار\tمنبع",
+	"default":                       "پیش‌فرض",
+	"mode\t%s":                      "حالت\t%s",
+	"mode\t%s in tun mode":          "حالت\t%s در حالت tun",
+	"network\t%s":                   "شبکه\t%s",
+	"endpoint\t%s":                  "اندپوینت\t%s",
+	"endpoint\t%s, remembered for this network":         "اندپوینت\t%s، به خاطر سپرده شده برای این شبکه",
+	"endpoint\ta random warp endpoint":                  "اندپوینت\tیک اندپوینت تصادفی warp",
+	"scan\tthe best scanned endpoints are used instead": "اسکن\tبه جای آن بهترین اندپوینت‌های اسکن شده استفاده می‌شوند",
+	"mtu\t%d":                            "mtu\t%d",
+	"keepalive\t%v":                      "keepalive\t%v",
+	"transports\t%s, all at once":        "انتقال‌ها\t%s، همه با هم",
+	"transports\t%s, in turn":            "انتقال‌ها\t%s، به ترتیب",
+	"identity %s\tdevice %s, %s account": "هویت %s\tدستگاه %s، حساب %s",
+	"identity %s\tto be registered":      "هویت %s\tهنوز ثبت نشده",
+	"%d samples, goroutines grew by %.0f and the heap by %.1f MiB": "%d نمونه، گوروتین‌ها %.0f و هیپ %.1f مگابایت رشد کردند",
+	"no leaks found": "نشتی پیدا نشد",
+}
@@ -0,0 +1,149 @@
+// Package i18n translates user facing output: command output, error
+// explanations and pages served to browsers. Messages are looked up by
+// their English format string, so untranslated messages fall back to
+// English. Log messages are not translated.
+package i18n
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Language is a message catalog.
+type Language struct {
+	// Tag is the language's BCP 47 tag, e.g. "fa"
+	Tag string
+	// RTL is set for languages written right to left
+	RTL      bool
+	messages map[string]string
+}
+
+var (
+	English = &Language{Tag: "en"}
+	Persian = &Language{Tag: "fa", RTL: true, messages: persian}
+)
+
+var languages = []*Language{English, Persian}
+
+// Tags lists the tags of the available languages.
+var Tags = func() []string {
+	tags := make([]string, len(languages))
+	for i, lang := range languages {
+		tags[i] = lang.Tag
+	}
+	return tags
+}()
+
+var current atomic.Pointer[Language]
+
+func init() {
+	current.Store(English)
+}
+
+// Current returns the language output is translated to.
+func Current() *Language {
+	return current.Load()
+}
+
+// Set selects the language output is translated to.
+func Set(lang *Language) {
+	current.Store(lang)
+}
+
+// Lookup returns the language for a locale name such as "fa", "fa-IR" or
+// "fa_IR.UTF-8".
+func Lookup(locale string) (*Language, bool) {
+	// Strip the encoding and modifier, and the region
+	locale, _, _ = strings.Cut(locale, ".")
+	locale, _, _ = strings.Cut(locale, "@")
+	base, _, _ := strings.Cut(strings.ReplaceAll(locale, "_", "-"), "-")
+	base = strings.ToLower(base)
+
+	for _, lang := range languages {
+		if lang.Tag == base {
+			return lang, true
+		}
+	}
+	return nil, false
+}
+
+// Detect returns the language of the user's locale, English if it has no
+// catalog.
+func Detect() *Language {
+	// Same precedence as setlocale(3)
+	for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if locale := os.Getenv(env); locale != "" {
+			if lang, ok := Lookup(locale); ok {
+				return lang
+			}
+			return English
+		}
+	}
+	for _, locale := range systemLocales() {
+		if lang, ok := Lookup(locale); ok {
+			return lang
+		}
+	}
+	return English
+}
+
+// FromAcceptLanguage returns the preferred language of an Accept-Language
+// header that has a catalog, or the current language if none has.
+func FromAcceptLanguage(header string) *Language {
+	type weighted struct {
+		locale string
+		q      float64
+	}
+
+	var prefs []weighted
+	for _, part := range strings.Split(header, ",") {
+		locale, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if locale != "" && q > 0 {
+			prefs = append(prefs, weighted{locale, q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+
+	for _, p := range prefs {
+		if lang, ok := Lookup(p.locale); ok {
+			return lang
+		}
+	}
+	return Current()
+}
+
+// T formats a message in lang, falling back to English when lang has no
+// translation for it.
+func (lang *Language) T(format string, args ...any) string {
+	if msg, ok := lang.messages[format]; ok {
+		format = msg
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// Dir returns the html dir attribute value for lang.
+func (lang *Language) Dir() string {
+	if lang.RTL {
+		return "rtl"
+	}
+	return "ltr"
+}
+
+// T formats a message in the current language.
+func T(format string, args ...any) string {
+	return Current().T(format, args...)
+}
@@ -0,0 +1,79 @@
+package i18n
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		locale string
+		want   *Language
+	}{
+		{"fa", Persian},
+		{"fa-IR", Persian},
+		{"fa_IR.UTF-8", Persian},
+		{"fa_IR@calendar=persian", Persian},
+		{"FA-ir", Persian},
+		{"en_US.UTF-8", English},
+		{"en", English},
+		{"de_DE", nil},
+		{"C", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, ok := Lookup(tt.locale)
+		if got != tt.want || ok != (tt.want != nil) {
+			t.Errorf("Lookup(%q) = %v, %v, want %v", tt.locale, got, ok, tt.want)
+		}
+	}
+}
+
+func TestFromAcceptLanguage(t *testing.T) {
+	defer Set(Current())
+	Set(English)
+
+	tests := []struct {
+		header string
+		want   *Language
+	}{
+		{"fa-IR,fa;q=0.9,en-US;q=0.8,en;q=0.7", Persian},
+		{"en-US,en;q=0.9,fa;q=0.8", English},
+		{"de-DE,fa;q=0.5", Persian},
+		{"en;q=0.2, fa;q=0.8", Persian},
+		// Weights keep the order of equally preferred languages
+		{"fa;q=0.5,en;q=0.5", Persian},
+		{"fa;q=0,en;q=0.1", English},
+		{"fa;q=x,en", English},
+		{"de-DE,fr", English},
+		{"", English},
+	}
+	for _, tt := range tests {
+		if got := FromAcceptLanguage(tt.header); got != tt.want {
+			t.Errorf("FromAcceptLanguage(%q) = %s, want %s", tt.header, got.Tag, tt.want.Tag)
+		}
+	}
+
+	// Without a match the current language is kept
+	Set(Persian)
+	if got := FromAcceptLanguage("de-DE"); got != Persian {
+		t.Errorf("FromAcceptLanguage(%q) = %s, want the current language", "de-DE", got.Tag)
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	const format = "The address %s is already in use, possibly by another instance. Choose another one with %s."
+	if got := Persian.T(format, "127.0.0.1:8086", "--bind"); !strings.Contains(got, "127.0.0.1:8086") || !strings.Contains(got, "--bind") || got == English.T(format, "127.0.0.1:8086", "--bind") {
+		t.Errorf("Persian.T = %q, want a translation with the arguments", got)
+	}
+	if got := Persian.T("untranslated %d", 1); got != "untranslated 1" {
+		t.Errorf("Persian.T fell back to %q, want the English message", got)
+	}
+
+	// Translations take the arguments of their message
+	for format, msg := range persian {
+		if strings.Count(format, "%") != strings.Count(msg, "%") {
+			t.Errorf("translation of %q has other verbs: %q", format, msg)
+		}
+	}
+}
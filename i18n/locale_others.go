@@ -0,0 +1,9 @@
+//go:build !windows
+
+package i18n
+
+// systemLocales returns nothing, the locale environment variables are all
+// there is.
+func systemLocales() []string {
+	return nil
+}
@@ -0,0 +1,12 @@
+package i18n
+
+import "golang.org/x/sys/windows"
+
+// systemLocales returns the user's preferred display languages.
+func systemLocales() []string {
+	locales, err := windows.GetUserPreferredUILanguages(windows.MUI_LANGUAGE_NAME)
+	if err != nil {
+		return nil
+	}
+	return locales
+}
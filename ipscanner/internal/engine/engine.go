@@ -64,7 +64,7 @@ func (e *Engine) Run(ctx context.Context) {
 					}
 					continue
 				}
-				e.log.Debug("ping success", "addr", ipInfo.AddrPort, "rtt", ipInfo.RTT)
+				e.log.Debug("ping success", "addr", ipInfo.AddrPort, "rtt", ipInfo.RTT, "jitter", ipInfo.Jitter, "loss", ipInfo.Loss)
 				e.ipQueue.Enqueue(ipInfo)
 			}
 		}
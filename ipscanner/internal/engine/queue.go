@@ -46,13 +46,14 @@ func (q *IPQueue) Enqueue(info statute.IPInfo) bool {
 				"created", ipInfo.CreatedAt,
 				"addr", ipInfo.AddrPort,
 				"rtt", ipInfo.RTT,
+				"score", ipInfo.Score(),
 			)
 		}
 	}()
 
-	q.log.Debug("Enqueue: Sorting queue by RTT")
+	q.log.Debug("Enqueue: Sorting queue by score")
 	sort.Slice(q.queue, func(i, j int) bool {
-		return q.queue[i].RTT < q.queue[j].RTT
+		return q.queue[i].Score() < q.queue[j].Score()
 	})
 
 	if len(q.queue) == 0 {
@@ -63,12 +64,12 @@ func (q *IPQueue) Enqueue(info statute.IPInfo) bool {
 
 	if info.RTT <= q.rttThreshold {
 		q.log.Debug("Enqueue: the new item's RTT is less than at least one of the members.")
-		if len(q.queue) >= q.maxQueueSize && info.RTT < q.queue[len(q.queue)-1].RTT {
+		if len(q.queue) >= q.maxQueueSize && info.Score() < q.queue[len(q.queue)-1].Score() {
 			q.log.Debug("Enqueue: the queue is full, remove the item with the highest RTT.")
 			q.queue = q.queue[:len(q.queue)-1]
 		} else if len(q.queue) < q.maxQueueSize {
 			q.log.Debug("Enqueue: Insert the new item in a sorted position.")
-			index := sort.Search(len(q.queue), func(i int) bool { return q.queue[i].RTT > info.RTT })
+			index := sort.Search(len(q.queue), func(i int) bool { return q.queue[i].Score() > info.Score() })
 			q.queue = append(q.queue[:index], append([]statute.IPInfo{info}, q.queue[index:]...)...)
 		} else {
 			q.log.Debug("Enqueue: The Queue is full but we keep the new item in the reserved queue.")
@@ -104,6 +105,7 @@ func (q *IPQueue) Dequeue() (statute.IPInfo, bool) {
 				"created", ipInfo.CreatedAt,
 				"addr", ipInfo.AddrPort,
 				"rtt", ipInfo.RTT,
+				"score", ipInfo.Score(),
 			)
 		}
 	}()
@@ -145,6 +147,7 @@ func (q *IPQueue) Expire() {
 				"created", ipInfo.CreatedAt,
 				"addr", ipInfo.AddrPort,
 				"rtt", ipInfo.RTT,
+				"score", ipInfo.Score(),
 			)
 		}
 	}()
@@ -177,12 +180,12 @@ func (q *IPQueue) AvailableIPs(desc bool) []statute.IPInfo {
 	sortedQueue := make([]statute.IPInfo, len(q.queue))
 	copy(sortedQueue, q.queue)
 
-	// Sort by RTT ascending/descending
+	// Sort by score ascending/descending
 	sort.Slice(sortedQueue, func(i, j int) bool {
 		if desc {
-			return sortedQueue[i].RTT > sortedQueue[j].RTT
+			return sortedQueue[i].Score() > sortedQueue[j].Score()
 		}
-		return sortedQueue[i].RTT < sortedQueue[j].RTT
+		return sortedQueue[i].Score() < sortedQueue[j].Score()
 	})
 
 	return sortedQueue
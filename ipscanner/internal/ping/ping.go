@@ -104,5 +104,7 @@ func (p *Ping) calc(ctx context.Context, tp statute.IPing) (statute.IPInfo, erro
 	if err != nil {
 		return statute.IPInfo{}, err
 	}
-	return pr.Result(), nil
+	info := pr.Result()
+	info.Probes = max(info.Probes, 1)
+	return info, nil
 }
@@ -20,14 +20,31 @@ import (
 	"golang.org/x/crypto/curve25519"
 )
 
+const (
+	// warpProbes is how many handshakes an address is probed with, to tell
+	// its jitter and loss
+	warpProbes = 3
+	// handshakeTimeout bounds the first probe of an address
+	handshakeTimeout = 5 * time.Second
+	// minProbeTimeout is the least time a later probe waits, which is four
+	// times the round trip of the first otherwise
+	minProbeTimeout = 500 * time.Millisecond
+	// firstSenderIndex is the sender index of the first probe, later ones
+	// count up from it so that late responses can't be mistaken for theirs
+	firstSenderIndex = 28
+)
+
 type WarpPingResult struct {
 	AddrPort netip.AddrPort
 	RTT      time.Duration
+	Jitter   time.Duration
+	Loss     float64
+	Probes   int
 	Err      error
 }
 
 func (h *WarpPingResult) Result() statute.IPInfo {
-	return statute.IPInfo{AddrPort: h.AddrPort, RTT: h.RTT, CreatedAt: time.Now()}
+	return statute.IPInfo{AddrPort: h.AddrPort, RTT: h.RTT, Jitter: h.Jitter, Loss: h.Loss, Probes: h.Probes, CreatedAt: time.Now()}
 }
 
 func (h *WarpPingResult) Error() error {
@@ -57,18 +74,21 @@ func (h *WarpPing) Ping() statute.IPingResult {
 
 func (h *WarpPing) PingContext(ctx context.Context) statute.IPingResult {
 	addr := netip.AddrPortFrom(h.IP, warp.RandomWarpPort())
-	rtt, err := initiateHandshake(
+	rtts, lost, err := initiateHandshake(
 		ctx,
 		addr,
 		h.PrivateKey,
 		h.PeerPublicKey,
 		h.PresharedKey,
+		warpProbes,
 	)
 	if err != nil {
 		return h.errorResult(err)
 	}
 
-	return &WarpPingResult{AddrPort: addr, RTT: rtt, Err: nil}
+	rtt, jitter := statute.RTTStats(rtts)
+	probes := len(rtts) + lost
+	return &WarpPingResult{AddrPort: addr, RTT: rtt, Jitter: jitter, Loss: float64(lost) / float64(probes), Probes: probes, Err: nil}
 }
 
 func (h *WarpPing) errorResult(err error) *WarpPingResult {
@@ -132,20 +152,22 @@ func randomInt(min, max uint64) uint64 {
 	return min + n.Uint64()
 }
 
-func initiateHandshake(ctx context.Context, serverAddr netip.AddrPort, privateKeyBase64, peerPublicKeyBase64, presharedKeyBase64 string) (time.Duration, error) {
+// handshakeInitiation returns a handshake initiation packet and the
+// handshake state to read the response with.
+func handshakeInitiation(privateKeyBase64, peerPublicKeyBase64, presharedKeyBase64 string, senderIndex uint32) ([]byte, *noise.HandshakeState, error) {
 	staticKeyPair, err := staticKeypair(privateKeyBase64)
 	if err != nil {
-		return 0, err
+		return nil, nil, err
 	}
 
 	peerPublicKey, err := base64.StdEncoding.DecodeString(peerPublicKeyBase64)
 	if err != nil {
-		return 0, err
+		return nil, nil, err
 	}
 
 	presharedKey, err := base64.StdEncoding.DecodeString(presharedKeyBase64)
 	if err != nil {
-		return 0, err
+		return nil, nil, err
 	}
 
 	if presharedKeyBase64 == "" {
@@ -154,7 +176,7 @@ func initiateHandshake(ctx context.Context, serverAddr netip.AddrPort, privateKe
 
 	ephemeral, err := ephemeralKeypair()
 	if err != nil {
-		return 0, err
+		return nil, nil, err
 	}
 
 	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
@@ -171,7 +193,7 @@ func initiateHandshake(ctx context.Context, serverAddr netip.AddrPort, privateKe
 		Random:                rand.Reader,
 	})
 	if err != nil {
-		return 0, err
+		return nil, nil, err
 	}
 
 	// Prepare handshake initiation packet
@@ -185,22 +207,22 @@ func initiateHandshake(ctx context.Context, serverAddr netip.AddrPort, privateKe
 	tai64nTimestampBuf = binary.BigEndian.AppendUint32(tai64nTimestampBuf, uint32(now.Nanosecond()))
 	msg, _, _, err := hs.WriteMessage(nil, tai64nTimestampBuf)
 	if err != nil {
-		return 0, err
+		return nil, nil, err
 	}
 
 	initiationPacket := new(bytes.Buffer)
 	binary.Write(initiationPacket, binary.BigEndian, []byte{0x01, 0x00, 0x00, 0x00})
-	binary.Write(initiationPacket, binary.BigEndian, uint32ToBytes(28))
+	binary.Write(initiationPacket, binary.BigEndian, uint32ToBytes(senderIndex))
 	binary.Write(initiationPacket, binary.BigEndian, msg)
 
 	macKey := blake2s.Sum256(append([]byte("mac1----"), peerPublicKey...))
 	hasher, err := blake2s.New128(macKey[:]) // using macKey as the key
 	if err != nil {
-		return 0, err
+		return nil, nil, err
 	}
 	_, err = hasher.Write(initiationPacket.Bytes())
 	if err != nil {
-		return 0, err
+		return nil, nil, err
 	}
 	initiationPacketMAC := hasher.Sum(nil)
 
@@ -208,9 +230,22 @@ func initiateHandshake(ctx context.Context, serverAddr netip.AddrPort, privateKe
 	binary.Write(initiationPacket, binary.BigEndian, initiationPacketMAC[:16])
 	binary.Write(initiationPacket, binary.BigEndian, [16]byte{})
 
+	return initiationPacket.Bytes(), hs, nil
+}
+
+// initiateHandshake completes probes handshakes with serverAddr, returning
+// the round trips of the answered ones and how many went unanswered. Only
+// the first is preceded by junk packets, it fails the whole probe if it
+// goes unanswered.
+func initiateHandshake(ctx context.Context, serverAddr netip.AddrPort, privateKeyBase64, peerPublicKeyBase64, presharedKeyBase64 string, probes int) (rtts []time.Duration, lost int, err error) {
+	packet, hs, err := handshakeInitiation(privateKeyBase64, peerPublicKeyBase64, presharedKeyBase64, firstSenderIndex)
+	if err != nil {
+		return nil, 0, err
+	}
+
 	conn, err := net.Dial("udp", serverAddr.String())
 	if err != nil {
-		return 0, err
+		return nil, 0, err
 	}
 	defer conn.Close()
 
@@ -219,66 +254,100 @@ func initiateHandshake(ctx context.Context, serverAddr netip.AddrPort, privateKe
 	for i := uint64(0); i < numPackets; i++ {
 		select {
 		case <-ctx.Done():
-			return 0, ctx.Err()
+			return nil, 0, ctx.Err()
 		default:
 			packetSize := randomInt(40, 100)
 			_, err := rand.Read(randomPacket[:packetSize])
 			if err != nil {
-				return 0, fmt.Errorf("error generating random packet: %w", err)
+				return nil, 0, fmt.Errorf("error generating random packet: %w", err)
 			}
 
 			_, err = conn.Write(randomPacket[:packetSize])
 			if err != nil {
-				return 0, fmt.Errorf("error sending random packet: %w", err)
+				return nil, 0, fmt.Errorf("error sending random packet: %w", err)
 			}
 
 			time.Sleep(time.Duration(randomInt(20, 250)) * time.Millisecond)
 		}
 	}
 
-	_, err = initiationPacket.WriteTo(conn)
+	rtt, err := exchangeHandshake(conn, packet, hs, firstSenderIndex, handshakeTimeout)
 	if err != nil {
+		return nil, 0, err
+	}
+	rtts = append(rtts, rtt)
+
+	timeout := max(4*rtt, minProbeTimeout)
+	for len(rtts)+lost < probes && ctx.Err() == nil {
+		index := uint32(firstSenderIndex + len(rtts) + lost)
+		packet, hs, err := handshakeInitiation(privateKeyBase64, peerPublicKeyBase64, presharedKeyBase64, index)
+		if err != nil {
+			return nil, 0, err
+		}
+		if rtt, err := exchangeHandshake(conn, packet, hs, index, timeout); err != nil {
+			lost++
+		} else {
+			rtts = append(rtts, rtt)
+		}
+	}
+	return rtts, lost, nil
+}
+
+// exchangeHandshake sends a handshake initiation and returns the round trip
+// to its response. Responses that don't belong to it, like late ones to an
+// earlier probe, are skipped.
+func exchangeHandshake(conn net.Conn, packet []byte, hs *noise.HandshakeState, senderIndex uint32, timeout time.Duration) (time.Duration, error) {
+	if _, err := conn.Write(packet); err != nil {
 		return 0, err
 	}
 	t0 := time.Now()
 
 	response := make([]byte, 92)
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	i, err := conn.Read(response)
-	if err != nil {
-		return 0, err
+	conn.SetReadDeadline(t0.Add(timeout))
+	for {
+		i, err := conn.Read(response)
+		if err != nil {
+			return 0, err
+		}
+		rtt := time.Since(t0)
+		if err := checkHandshakeResponse(response[:i], hs, senderIndex); err != nil {
+			continue
+		}
+		return rtt, nil
 	}
-	rtt := time.Since(t0)
+}
 
+func checkHandshakeResponse(response []byte, hs *noise.HandshakeState, senderIndex uint32) error {
+	i := len(response)
 	if i < 60 {
-		return 0, fmt.Errorf("invalid handshake response length %d bytes", i)
+		return fmt.Errorf("invalid handshake response length %d bytes", i)
 	}
 
 	// Check the response type
 	if response[0] != 2 { // 2 is the message type for response
-		return 0, errors.New("invalid response type")
+		return errors.New("invalid response type")
 	}
 
 	// Extract sender and receiver index from the response
 	// peer index
 	_ = binary.LittleEndian.Uint32(response[4:8])
-	// our index(we set it to 28)
+	// our index
 	ourIndex := binary.LittleEndian.Uint32(response[8:12])
-	if ourIndex != 28 { // Check if the response corresponds to our sender index
-		return 0, errors.New("invalid sender index in response")
+	if ourIndex != senderIndex { // Check if the response corresponds to our sender index
+		return errors.New("invalid sender index in response")
 	}
 
 	payload, _, _, err := hs.ReadMessage(nil, response[12:60])
 	if err != nil {
-		return 0, err
+		return err
 	}
 
 	// Check if the payload is empty (as expected in WireGuard handshake)
 	if len(payload) != 0 {
-		return 0, errors.New("unexpected payload in response")
+		return errors.New("unexpected payload in response")
 	}
 
-	return rtt, nil
+	return nil
 }
 
 func NewWarpPing(ip netip.Addr, opts *statute.ScannerOptions) *WarpPing {
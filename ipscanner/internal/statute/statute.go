@@ -29,11 +29,45 @@ var (
 )
 
 type IPInfo struct {
-	AddrPort  netip.AddrPort
-	RTT       time.Duration
+	AddrPort netip.AddrPort
+	// RTT is the mean round trip of the answered probes
+	RTT time.Duration
+	// Jitter is the mean deviation of the round trips from RTT
+	Jitter time.Duration
+	// Loss is the share of probes that went unanswered
+	Loss float64
+	// Probes counts the probes sent, pings other than warp send one
+	Probes    int
 	CreatedAt time.Time
 }
 
+// Score rates the address for selection, lower is better. It is the round
+// trip with twice the jitter added, inflated by the loss so that a lossy
+// address has to be a lot faster to win.
+func (i IPInfo) Score() time.Duration {
+	score := float64(i.RTT + 2*i.Jitter)
+	if delivered := 1 - i.Loss; delivered > 0 {
+		score /= delivered * delivered
+	}
+	return time.Duration(score)
+}
+
+// RTTStats returns the mean of rtts and their mean deviation from it.
+func RTTStats(rtts []time.Duration) (mean, jitter time.Duration) {
+	if len(rtts) == 0 {
+		return 0, 0
+	}
+	var sum time.Duration
+	for _, rtt := range rtts {
+		sum += rtt
+	}
+	mean = sum / time.Duration(len(rtts))
+	for _, rtt := range rtts {
+		jitter += (rtt - mean).Abs()
+	}
+	return mean, jitter / time.Duration(len(rtts))
+}
+
 type ScannerOptions struct {
 	UseIPv4               bool
 	UseIPv6               bool
@@ -0,0 +1,160 @@
+// Package logring keeps recent log records, optionally including debug
+// records that are not otherwise written, in a fixed size in-memory ring so
+// they can be inspected after an incident.
+package logring
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// maxAttrs is the number of attributes kept per record, extra ones are
+// dropped.
+const maxAttrs = 16
+
+type entry struct {
+	time   time.Time
+	level  slog.Level
+	msg    string
+	attrs  [maxAttrs]slog.Attr
+	nattrs int
+}
+
+// Ring is a fixed size buffer of log records. All entries are allocated up
+// front and overwritten in place.
+type Ring struct {
+	mu      sync.Mutex
+	entries []entry
+	next    int
+	full    bool
+}
+
+func New(size int) *Ring {
+	return &Ring{entries: make([]entry, size)}
+}
+
+func (r *Ring) add(rec slog.Record, prefix string, attrs []slog.Attr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e := &r.entries[r.next]
+	e.time = rec.Time
+	e.level = rec.Level
+	e.msg = rec.Message
+	e.nattrs = 0
+	for _, a := range attrs {
+		if e.nattrs == maxAttrs {
+			break
+		}
+		e.attrs[e.nattrs] = a
+		e.nattrs++
+	}
+	rec.Attrs(func(a slog.Attr) bool {
+		if e.nattrs == maxAttrs {
+			return false
+		}
+		if prefix != "" {
+			a.Key = prefix + a.Key
+		}
+		e.attrs[e.nattrs] = a
+		e.nattrs++
+		return true
+	})
+
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// WriteTo writes the buffered records, oldest first, one per line.
+func (r *Ring) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	start, count := 0, r.next
+	if r.full {
+		start, count = r.next, len(r.entries)
+	}
+
+	var written int64
+	for i := 0; i < count; i++ {
+		e := &r.entries[(start+i)%len(r.entries)]
+		n, err := fmt.Fprintf(w, "time=%s level=%s msg=%q", e.time.Format(time.RFC3339Nano), e.level, e.msg)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		for _, a := range e.attrs[:e.nattrs] {
+			n, err = fmt.Fprintf(w, " %s=%q", a.Key, a.Value.String())
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+		n, err = io.WriteString(w, "\n")
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Handler records the records of level or above in a Ring and passes those
+// enabled for the wrapped handler on to it.
+type Handler struct {
+	ring   *Ring
+	level  slog.Leveler
+	next   slog.Handler
+	prefix string
+	attrs  []slog.Attr
+}
+
+func NewHandler(ring *Ring, level slog.Leveler, next slog.Handler) *Handler {
+	return &Handler{ring: ring, level: level, next: next}
+}
+
+// Enabled reports true for records the ring keeps, even when the wrapped
+// handler would discard them. A ring kept at debug level has every debug
+// record built, which costs on busy paths.
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() || h.next.Enabled(ctx, level)
+}
+
+func (h *Handler) Handle(ctx context.Context, rec slog.Record) error {
+	if rec.Level >= h.level.Level() {
+		h.ring.add(rec, h.prefix, h.attrs)
+	}
+	if !h.next.Enabled(ctx, rec.Level) {
+		return nil
+	}
+	return h.next.Handle(ctx, rec)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.next = h.next.WithAttrs(attrs)
+	h2.attrs = make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	h2.attrs = append(h2.attrs, h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		h2.attrs = append(h2.attrs, a)
+	}
+	return &h2
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.next = h.next.WithGroup(name)
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
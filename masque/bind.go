@@ -0,0 +1,225 @@
+package masque
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/conn"
+
+	"github.com/quic-go/quic-go"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// dialTimeout bounds setting up the flow to an endpoint
+	dialTimeout = 10 * time.Second
+	// MTU is the largest tunnel mtu whose wireguard packets fit in a
+	// datagram of a QUIC packet of the minimum size
+	MTU = 1150
+)
+
+type packet struct {
+	b  []byte
+	ep netip.AddrPort
+}
+
+// Bind is a conn.Bind that sends the wireguard traffic to every endpoint
+// through a connect-udp proxy. Flows are set up on the first packet to an
+// endpoint and again after they fail.
+type Bind struct {
+	l        *slog.Logger
+	template string
+	// dial sets up a flow, Dial unless replaced by tests
+	dial func(ctx context.Context, template string, target netip.AddrPort) (*Conn, error)
+	// dials runs one dial to each endpoint at a time, outside of mu
+	dials singleflight.Group
+
+	mu     sync.Mutex
+	conns  map[netip.AddrPort]*Conn
+	recv   chan packet
+	closed chan struct{}
+}
+
+var _ conn.Bind = (*Bind)(nil)
+
+// NewBind returns a Bind using the proxy at the connect-udp URI template.
+func NewBind(l *slog.Logger, template string) *Bind {
+	return &Bind{l: l, template: template, dial: Dial}
+}
+
+func (b *Bind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conns != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	b.conns = make(map[netip.AddrPort]*Conn)
+	b.recv = make(chan packet, 128)
+	b.closed = make(chan struct{})
+	return []conn.ReceiveFunc{b.makeReceiveFunc(b.recv, b.closed)}, port, nil
+}
+
+func (b *Bind) makeReceiveFunc(recv <-chan packet, closed <-chan struct{}) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		select {
+		case <-closed:
+			return 0, net.ErrClosed
+		case p := <-recv:
+			sizes[0] = copy(packets[0], p.b)
+			eps[0] = &conn.StdNetEndpoint{AddrPort: p.ep}
+			return 1, nil
+		}
+	}
+}
+
+func (b *Bind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conns == nil {
+		return nil
+	}
+	close(b.closed)
+	for _, c := range b.conns {
+		c.Close()
+	}
+	b.conns = nil
+	return nil
+}
+
+// SetMark is a no-op, the flows aren't sent from a socket of their own.
+func (b *Bind) SetMark(uint32) error {
+	return nil
+}
+
+func (b *Bind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	target := ep.(*conn.StdNetEndpoint).AddrPort
+	c, err := b.flow(target)
+	if err != nil {
+		return err
+	}
+
+	for _, buf := range bufs {
+		err := c.WritePacket(buf)
+		var tooLarge *quic.DatagramTooLargeError
+		if errors.As(err, &tooLarge) {
+			// The flow is fine, the mtu is too large
+			return err
+		}
+		if err != nil {
+			b.drop(target, c)
+			return err
+		}
+	}
+	return nil
+}
+
+// flow returns the flow to target, setting it up if there is none.
+// Packets to other endpoints don't wait for the flow to be set up, and
+// those to target share the one dial.
+func (b *Bind) flow(target netip.AddrPort) (*Conn, error) {
+	b.mu.Lock()
+	if b.conns == nil {
+		b.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	if c, ok := b.conns[target]; ok {
+		b.mu.Unlock()
+		return c, nil
+	}
+	closed := b.closed
+	b.mu.Unlock()
+
+	ch := b.dials.DoChan(target.String(), func() (any, error) {
+		return b.setUp(target)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*Conn), nil
+	case <-closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// setUp dials a flow to target and starts passing on what it receives.
+func (b *Bind) setUp(target netip.AddrPort) (*Conn, error) {
+	b.mu.Lock()
+	if b.conns == nil {
+		b.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	// Set up by the dial this one was waiting to start after
+	if c, ok := b.conns[target]; ok {
+		b.mu.Unlock()
+		return c, nil
+	}
+	recv, closed := b.recv, b.closed
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	c, err := b.dial(ctx, b.template, target)
+	if err != nil {
+		b.l.Warn("failed to set up masque flow", "endpoint", target, "error", err)
+		return nil, err
+	}
+
+	b.mu.Lock()
+	// Closed, and maybe opened again, while dialing
+	if b.closed != closed {
+		b.mu.Unlock()
+		c.Close()
+		return nil, net.ErrClosed
+	}
+	b.conns[target] = c
+	b.mu.Unlock()
+	b.l.Debug("masque flow set up", "endpoint", target)
+
+	go func() {
+		for {
+			p, err := c.ReadPacket(context.Background())
+			if err != nil {
+				b.drop(target, c)
+				return
+			}
+			select {
+			case recv <- packet{b: p, ep: target}:
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+// drop closes a failed flow, so that the next packet sets up another one.
+func (b *Bind) drop(target netip.AddrPort, c *Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conns != nil && b.conns[target] == c {
+		delete(b.conns, target)
+	}
+	c.Close()
+}
+
+func (b *Bind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	e, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &conn.StdNetEndpoint{AddrPort: e}, nil
+}
+
+func (b *Bind) BatchSize() int {
+	return 1
+}
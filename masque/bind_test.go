@@ -0,0 +1,112 @@
+package masque
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBindFlowDial(t *testing.T) {
+	slow := netip.MustParseAddrPort("192.0.2.1:2408")
+	fast := netip.MustParseAddrPort("192.0.2.2:2408")
+	errRefused := errors.New("refused")
+
+	var dials atomic.Int32
+	release := make(chan struct{})
+	b := NewBind(slog.New(slog.NewTextHandler(io.Discard, nil)), DefaultTemplate)
+	b.dial = func(ctx context.Context, template string, target netip.AddrPort) (*Conn, error) {
+		if target == slow {
+			dials.Add(1)
+			<-release
+		}
+		return nil, errRefused
+	}
+	if _, _, err := b.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := b.flow(slow)
+			errs <- err
+		}()
+	}
+	waitFor(t, func() bool { return dials.Load() == 1 })
+
+	// Another endpoint doesn't wait for the dial in progress
+	if _, err := b.flow(fast); !errors.Is(err, errRefused) {
+		t.Fatalf("got %v for another endpoint, want %v", err, errRefused)
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if !errors.Is(err, errRefused) {
+			t.Fatalf("got %v, want the error of the shared dial", err)
+		}
+	}
+	if n := dials.Load(); n != 1 {
+		t.Fatalf("dialed %d times, want once", n)
+	}
+}
+
+func TestBindCloseWhileDialing(t *testing.T) {
+	target := netip.MustParseAddrPort("192.0.2.1:2408")
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	b := NewBind(slog.New(slog.NewTextHandler(io.Discard, nil)), DefaultTemplate)
+	b.dial = func(ctx context.Context, template string, target netip.AddrPort) (*Conn, error) {
+		close(dialing)
+		<-release
+		return nil, errors.New("refused")
+	}
+	defer close(release)
+	if _, _, err := b.Open(0); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := b.flow(target)
+		errc <- err
+	}()
+	<-dialing
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("got %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("send kept waiting for the dial after close")
+	}
+	if _, err := b.flow(target); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v after close, want %v", err, net.ErrClosed)
+	}
+}
@@ -0,0 +1,180 @@
+// Package masque proxies UDP over HTTP/3 as specified by RFC 9298
+// (connect-udp), so that the tunnel looks like any other QUIC traffic on
+// networks that fingerprint the wireguard handshake.
+package masque
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/noql-net/certpool"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// DefaultTemplate is the URI template of the well known connect-udp path,
+// for use with a proxy host.
+const DefaultTemplate = "https://%s/.well-known/masque/udp/{target_host}/{target_port}/"
+
+// contextID is the context of plain UDP payloads in HTTP datagrams.
+const contextID = 0
+
+// Expand fills in the target of a connect-udp URI template.
+func Expand(template string, target netip.AddrPort) (*url.URL, error) {
+	host := target.Addr().String()
+	if target.Addr().Is6() {
+		host = strings.ReplaceAll(host, ":", "%3A")
+	}
+	u, err := url.Parse(strings.NewReplacer(
+		"{target_host}", host,
+		"{target_port}", strconv.Itoa(int(target.Port())),
+	).Replace(template))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, errors.New("masque proxy must be an https url")
+	}
+	return u, nil
+}
+
+// Conn is a UDP flow to one target through the proxy.
+type Conn struct {
+	qconn quic.Connection
+	str   http3.RequestStream
+}
+
+// Dial asks the proxy at the URI template for a UDP flow to target.
+// Credentials in the template are sent as basic proxy authorization.
+func Dial(ctx context.Context, template string, target netip.AddrPort) (*Conn, error) {
+	u, err := Expand(template, target)
+	if err != nil {
+		return nil, err
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	raddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	pconn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	qconn, err := quic.Dial(ctx, pconn, raddr, &tls.Config{
+		ServerName: u.Hostname(),
+		RootCAs:    certpool.Roots(),
+		NextProtos: []string{http3.NextProtoH3},
+	}, &quic.Config{
+		EnableDatagrams: true,
+		KeepAlivePeriod: 10 * time.Second,
+	})
+	if err != nil {
+		pconn.Close()
+		return nil, err
+	}
+	c := &Conn{qconn: qconn}
+	// Closing the connection doesn't close a socket passed to Dial
+	context.AfterFunc(qconn.Context(), func() { pconn.Close() })
+
+	if err := c.connect(ctx, u); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Conn) connect(ctx context.Context, u *url.URL) error {
+	rt := &http3.SingleDestinationRoundTripper{Connection: c.qconn, EnableDatagrams: true}
+	hconn := rt.Start()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-hconn.Context().Done():
+		return context.Cause(hconn.Context())
+	case <-hconn.ReceivedSettings():
+	}
+	settings := hconn.Settings()
+	if !settings.EnableExtendedConnect || !settings.EnableDatagrams {
+		return errors.New("proxy doesn't support extended connect with datagrams")
+	}
+
+	str, err := rt.OpenRequestStream(ctx)
+	if err != nil {
+		return err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Proto:  "connect-udp",
+		Host:   u.Host,
+		Header: http.Header{"Capsule-Protocol": {"?1"}},
+		URL:    u,
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		req.SetBasicAuth(u.User.Username(), password)
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		req.Header.Del("Authorization")
+		u.User = nil
+	}
+	if err := str.SendRequestHeader(req); err != nil {
+		return err
+	}
+	resp, err := str.ReadResponse()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("proxy refused the flow: %s", resp.Status)
+	}
+
+	c.str = str
+	return nil
+}
+
+// ReadPacket returns the next UDP payload from the target.
+func (c *Conn) ReadPacket(ctx context.Context) ([]byte, error) {
+	for {
+		data, err := c.str.ReceiveDatagram(ctx)
+		if err != nil {
+			return nil, err
+		}
+		r := bytes.NewReader(data)
+		id, err := quicvarint.Read(r)
+		// Datagrams of unknown contexts are dropped
+		if err != nil || id != contextID {
+			continue
+		}
+		return data[len(data)-r.Len():], nil
+	}
+}
+
+// WritePacket sends a UDP payload to the target.
+func (c *Conn) WritePacket(b []byte) error {
+	data := make([]byte, 0, quicvarint.Len(contextID)+len(b))
+	data = quicvarint.Append(data, contextID)
+	return c.str.SendDatagram(append(data, b...))
+}
+
+func (c *Conn) Close() error {
+	if c.str != nil {
+		c.str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+		c.str.Close()
+	}
+	return c.qconn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+}
@@ -0,0 +1,200 @@
+package masque
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// flowIdleTimeout closes flows that carried nothing in either direction for
+// this long.
+const flowIdleTimeout = 3 * time.Minute
+
+// Server is a connect-udp proxy serving the well known path of
+// DefaultTemplate, the remote end of a Bind for running a bridge to the
+// warp endpoints. Flows are only proxied to targets within the allowed
+// prefixes, so it is no open proxy.
+type Server struct {
+	l       *slog.Logger
+	allowed []netip.Prefix
+	// username and password are required as basic proxy authorization,
+	// if set
+	username, password string
+}
+
+// NewServer returns a Server proxying flows to targets within allowed.
+// Clients have to authorize with username and password unless both are
+// empty.
+func NewServer(l *slog.Logger, allowed []netip.Prefix, username, password string) *Server {
+	return &Server{l: l, allowed: allowed, username: username, password: password}
+}
+
+// ListenAndServe serves the proxy on the UDP address addr with tlsConfig
+// until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context, addr string, tlsConfig *tls.Config) error {
+	srv := &http3.Server{
+		Addr:            addr,
+		TLSConfig:       http3.ConfigureTLSConfig(tlsConfig),
+		EnableDatagrams: true,
+		QUICConfig: &quic.Config{
+			EnableDatagrams: true,
+			KeepAlivePeriod: 10 * time.Second,
+		},
+		Handler: s,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	s.l.Info("serving connect-udp", "address", addr)
+	err := srv.ListenAndServe()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect || r.Proto != "connect-udp" {
+		http.Error(w, "expected connect-udp", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="masque"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	target, ok := parseTarget(r.URL.Path)
+	if !ok {
+		http.Error(w, "malformed target", http.StatusBadRequest)
+		return
+	}
+	if !s.allow(target) {
+		http.Error(w, "target not allowed", http.StatusForbidden)
+		return
+	}
+	streamer, ok := w.(http3.HTTPStreamer)
+	if !ok {
+		http.Error(w, "expected http/3", http.StatusBadRequest)
+		return
+	}
+
+	udp, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(target))
+	if err != nil {
+		s.l.Warn("failed to reach target", "target", target, "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer udp.Close()
+
+	w.Header().Set("Capsule-Protocol", "?1")
+	w.WriteHeader(http.StatusOK)
+	str := streamer.HTTPStream()
+	defer str.Close()
+
+	s.l.Debug("flow opened", "client", r.RemoteAddr, "target", target)
+	defer s.l.Debug("flow closed", "client", r.RemoteAddr, "target", target)
+	proxyFlow(r.Context(), str, udp)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.username == "" && s.password == "" {
+		return true
+	}
+	auth := r.Header.Get("Proxy-Authorization")
+	req := &http.Request{Header: http.Header{"Authorization": {auth}}}
+	username, password, ok := req.BasicAuth()
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(username), []byte(s.username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) == 1
+}
+
+func (s *Server) allow(target netip.AddrPort) bool {
+	for _, p := range s.allowed {
+		if p.Contains(target.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTarget parses the target of a path expanded from DefaultTemplate.
+func parseTarget(path string) (netip.AddrPort, bool) {
+	rest, ok := strings.CutPrefix(path, "/.well-known/masque/udp/")
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	host, port, ok := strings.Cut(rest, "/")
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	addr, err := netip.ParseAddr(strings.ReplaceAll(host, "%3A", ":"))
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	p, err := strconv.ParseUint(strings.TrimSuffix(port, "/"), 10, 16)
+	if err != nil || p == 0 {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(addr.Unmap(), uint16(p)), true
+}
+
+// proxyFlow passes payloads between the datagrams of str and udp until
+// either fails or the flow goes idle.
+func proxyFlow(ctx context.Context, str http3.Stream, udp *net.UDPConn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := time.AfterFunc(flowIdleTimeout, cancel)
+	defer idle.Stop()
+
+	go func() {
+		defer cancel()
+		buf := make([]byte, 65535)
+		for {
+			n, err := udp.Read(buf)
+			if err != nil {
+				return
+			}
+			idle.Reset(flowIdleTimeout)
+			data := make([]byte, 0, quicvarint.Len(contextID)+n)
+			data = quicvarint.Append(data, contextID)
+			if err := str.SendDatagram(append(data, buf[:n]...)); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = udp.Close()
+	}()
+
+	for {
+		data, err := str.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		r := bytes.NewReader(data)
+		id, err := quicvarint.Read(r)
+		// Datagrams of unknown contexts are dropped
+		if err != nil || id != contextID {
+			continue
+		}
+		idle.Reset(flowIdleTimeout)
+		if _, err := udp.Write(data[len(data)-r.Len():]); err != nil {
+			return
+		}
+	}
+}
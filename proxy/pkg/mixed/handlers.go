@@ -82,6 +82,20 @@ func WithUserForwardAddressFunc(packetForwardAddress statute.PacketForwardAddres
 	}
 }
 
+func WithClientOnlyUDP() Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.ClientOnlyUDP = true
+	}
+}
+
+// WithPanicHook passes the value of a panic while serving a connection to
+// hook before it crashes the process.
+func WithPanicHook(hook func(any)) Option {
+	return func(p *Proxy) {
+		p.panicHook = hook
+	}
+}
+
 func WithContext(ctx context.Context) Option {
 	return func(p *Proxy) {
 		p.ctx = ctx
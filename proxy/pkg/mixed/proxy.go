@@ -38,6 +38,8 @@ type Proxy struct {
 	logger *slog.Logger
 	// ctx is default context
 	ctx context.Context
+	// panicHook is passed the panics of connection goroutines, if set
+	panicHook func(any)
 }
 
 func NewProxy(options ...Option) *Proxy {
@@ -89,7 +91,7 @@ func (p *Proxy) ListenAndServe() error {
 		p.listener = ln
 	}
 
-	p.bind = p.listener.Addr().(*net.TCPAddr).String()
+	p.bind = p.listener.Addr().String()
 
 	// ensure listener will be closed
 	defer func() {
@@ -115,6 +117,7 @@ func (p *Proxy) ListenAndServe() error {
 			// Start a new goroutine to handle each connection
 			// This way, the server can handle multiple connections concurrently
 			go func() {
+				defer p.recoverPanic()
 				defer conn.Close()
 				err := p.handleConnection(conn)
 				if err != nil {
@@ -125,6 +128,19 @@ func (p *Proxy) ListenAndServe() error {
 	}
 }
 
+// recoverPanic passes a panic to the panic hook and panics again. It must
+// be deferred directly.
+func (p *Proxy) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if p.panicHook != nil {
+		p.panicHook(r)
+	}
+	panic(r)
+}
+
 func (p *Proxy) handleConnection(conn net.Conn) error {
 	// Create a SwitchConn
 	switchConn := NewSwitchConn(conn)
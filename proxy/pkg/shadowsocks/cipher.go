@@ -0,0 +1,88 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+type aeadSpec struct {
+	keySize int
+	new     func(key []byte) (cipher.AEAD, error)
+}
+
+var methods = map[string]aeadSpec{
+	"aes-128-gcm":            {16, newGCM},
+	"aes-256-gcm":            {32, newGCM},
+	"chacha20-ietf-poly1305": {32, chacha20poly1305.New},
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Methods returns the supported AEAD method names.
+func Methods() []string {
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Cipher holds the master key of an AEAD method.
+type Cipher struct {
+	spec aeadSpec
+	key  []byte
+}
+
+// NewCipher derives the master key for method from password.
+func NewCipher(method, password string) (*Cipher, error) {
+	spec, ok := methods[method]
+	if !ok {
+		return nil, fmt.Errorf("unsupported shadowsocks method: %s", method)
+	}
+	return &Cipher{spec: spec, key: kdf(password, spec.keySize)}, nil
+}
+
+// SaltSize returns the size of the per-session salt, equal to the key size.
+func (c *Cipher) SaltSize() int {
+	return c.spec.keySize
+}
+
+// aead returns the session AEAD for salt, keyed with
+// HKDF-SHA1(key, salt, "ss-subkey").
+func (c *Cipher) aead(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, c.spec.keySize)
+	if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, err
+	}
+	return c.spec.new(subkey)
+}
+
+// kdf is OpenSSL's EVP_BytesToKey with MD5 and no salt, as used by every
+// shadowsocks implementation to turn passwords into keys.
+func kdf(password string, keyLen int) []byte {
+	var b, prev []byte
+	h := md5.New()
+	for len(b) < keyLen {
+		h.Reset()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		b = append(b, prev...)
+	}
+	return b[:keyLen]
+}
@@ -0,0 +1,216 @@
+package shadowsocks
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// maxPayloadSize is the largest payload of a single chunk.
+const maxPayloadSize = 0x3FFF
+
+var (
+	errReplayedSalt = errors.New("shadowsocks: replayed salt")
+	errChunkTooLong = errors.New("shadowsocks: chunk longer than the maximum payload")
+)
+
+// conn encrypts and decrypts the AEAD chunk stream of a shadowsocks TCP
+// session: [salt][len][len tag][payload][payload tag]...
+type conn struct {
+	net.Conn
+	cipher *Cipher
+	salts  *saltFilter
+
+	// read state
+	rAEAD  cipher.AEAD
+	rNonce []byte
+	rBuf   []byte
+	rLeft  []byte
+	// rSalt is the salt of the peer until its first chunk authenticates
+	rSalt []byte
+
+	// write state
+	wMu    sync.Mutex
+	wAEAD  cipher.AEAD
+	wNonce []byte
+	wBuf   []byte
+}
+
+func newConn(c net.Conn, ciph *Cipher, salts *saltFilter) *conn {
+	return &conn{Conn: c, cipher: ciph, salts: salts}
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	if c.rAEAD == nil {
+		salt := make([]byte, c.cipher.SaltSize())
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return 0, err
+		}
+		aead, err := c.cipher.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.rAEAD = aead
+		c.rSalt = salt
+		c.rNonce = make([]byte, aead.NonceSize())
+		c.rBuf = make([]byte, maxPayloadSize+aead.Overhead())
+	}
+
+	if len(c.rLeft) == 0 {
+		payload, err := c.readChunk()
+		if err != nil {
+			return 0, err
+		}
+		c.rLeft = payload
+	}
+
+	n := copy(p, c.rLeft)
+	c.rLeft = c.rLeft[n:]
+	return n, nil
+}
+
+func (c *conn) readChunk() ([]byte, error) {
+	overhead := c.rAEAD.Overhead()
+
+	buf := c.rBuf[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return nil, err
+	}
+	length, err := c.rAEAD.Open(buf[:0], c.rNonce, buf, nil)
+	if err != nil {
+		return nil, err
+	}
+	increment(c.rNonce)
+
+	// The salt is only recorded once the session proved to know the key,
+	// so that probes sending junk salts can't flush those of clients out
+	// of the filter
+	if c.rSalt != nil {
+		salt := c.rSalt
+		c.rSalt = nil
+		if c.salts != nil && !c.salts.add(salt) {
+			return nil, errReplayedSalt
+		}
+	}
+
+	// The length is capped at maxPayloadSize, its two high bits are
+	// reserved and must be zero
+	size := int(binary.BigEndian.Uint16(length))
+	if size > maxPayloadSize {
+		return nil, errChunkTooLong
+	}
+	buf = c.rBuf[:size+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return nil, err
+	}
+	payload, err := c.rAEAD.Open(buf[:0], c.rNonce, buf, nil)
+	if err != nil {
+		return nil, err
+	}
+	increment(c.rNonce)
+
+	return payload, nil
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	c.wMu.Lock()
+	defer c.wMu.Unlock()
+
+	var out []byte
+	if c.wAEAD == nil {
+		salt := make([]byte, c.cipher.SaltSize())
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		// A peer reflecting this stream back is then taken for a replay
+		if c.salts != nil {
+			c.salts.add(salt)
+		}
+		aead, err := c.cipher.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.wAEAD = aead
+		c.wNonce = make([]byte, aead.NonceSize())
+		c.wBuf = make([]byte, 0, c.cipher.SaltSize()+2+maxPayloadSize+2*aead.Overhead())
+		out = append(c.wBuf, salt...)
+		// The salt goes out even without a payload, so that the peer can
+		// set up its side of the session
+		if len(p) == 0 {
+			_, err := c.Conn.Write(out)
+			return 0, err
+		}
+	}
+
+	written := 0
+	for len(p) > 0 {
+		size := min(len(p), maxPayloadSize)
+		if out == nil {
+			out = c.wBuf[:0]
+		}
+
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(size))
+		out = c.wAEAD.Seal(out, c.wNonce, length[:], nil)
+		increment(c.wNonce)
+		out = c.wAEAD.Seal(out, c.wNonce, p[:size], nil)
+		increment(c.wNonce)
+
+		if _, err := c.Conn.Write(out); err != nil {
+			return written, err
+		}
+		written += size
+		p = p[size:]
+		out = nil
+	}
+	return written, nil
+}
+
+// increment treats b as a little-endian counter.
+func increment(b []byte) {
+	for i := range b {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
+
+// saltFilter remembers recently seen salts so replayed sessions, a common
+// active probing technique, are rejected.
+type saltFilter struct {
+	mu    sync.Mutex
+	seen  map[string]struct{}
+	order []string
+	next  int
+}
+
+func newSaltFilter(size int) *saltFilter {
+	return &saltFilter{
+		seen:  make(map[string]struct{}, size),
+		order: make([]string, size),
+	}
+}
+
+// add records salt and reports whether it was new.
+func (f *saltFilter) add(salt []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := string(salt)
+	if _, ok := f.seen[key]; ok {
+		return false
+	}
+
+	if old := f.order[f.next]; old != "" {
+		delete(f.seen, old)
+	}
+	f.order[f.next] = key
+	f.next = (f.next + 1) % len(f.order)
+	f.seen[key] = struct{}{}
+	return true
+}
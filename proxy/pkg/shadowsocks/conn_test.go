@@ -0,0 +1,240 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipe returns a client and a server end of a shadowsocks session over an
+// in-memory connection.
+func pipe(t *testing.T, method string) (client, server *conn) {
+	t.Helper()
+	c, err := NewCipher(method, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	_ = a.SetDeadline(time.Now().Add(5 * time.Second))
+	_ = b.SetDeadline(time.Now().Add(5 * time.Second))
+	return newConn(a, c, nil), newConn(b, c, newSaltFilter(16))
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, method := range Methods() {
+		t.Run(method, func(t *testing.T) {
+			client, server := pipe(t, method)
+
+			// Longer than a chunk, so it is split
+			want := bytes.Repeat([]byte("warp-plus "), 2*maxPayloadSize/10)
+			go func() {
+				_, _ = client.Write(want)
+			}()
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(server, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatal("payload changed in transit")
+			}
+		})
+	}
+}
+
+func TestEmptyWriteSendsSalt(t *testing.T) {
+	c, err := NewCipher("aes-128-gcm", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	_ = b.SetDeadline(time.Now().Add(5 * time.Second))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := newConn(a, c, nil).Write(nil)
+		done <- err
+	}()
+	salt := make([]byte, c.SaltSize())
+	if _, err := io.ReadFull(b, salt); err != nil {
+		t.Fatalf("salt not sent: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMalformedChunks(t *testing.T) {
+	c, err := NewCipher("chacha20-ietf-poly1305", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := bytes.Repeat([]byte{1}, c.SaltSize())
+
+	// chunk seals length and payload as a client would, after salt
+	chunk := func(length uint16, payload []byte) []byte {
+		aead, err := c.aead(salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := make([]byte, aead.NonceSize())
+		var l [2]byte
+		binary.BigEndian.PutUint16(l[:], length)
+		out := aead.Seal(append([]byte(nil), salt...), nonce, l[:], nil)
+		increment(nonce)
+		return aead.Seal(out, nonce, payload, nil)
+	}
+
+	tamperedPayload := chunk(5, []byte("hello"))
+	tamperedPayload[len(tamperedPayload)-1] ^= 1
+	tamperedLength := chunk(5, []byte("hello"))
+	tamperedLength[len(salt)] ^= 1
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"too long", chunk(maxPayloadSize+1, make([]byte, 16)), errChunkTooLong},
+		{"reserved bits", chunk(0xc005, []byte("hello")), errChunkTooLong},
+		{"tampered payload", tamperedPayload, nil},
+		{"tampered length", tamperedLength, nil},
+		{"truncated", chunk(5, []byte("hello"))[:len(salt)+10], io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer b.Close()
+			_ = b.SetDeadline(time.Now().Add(5 * time.Second))
+			go func() {
+				_, _ = a.Write(tt.data)
+				a.Close()
+			}()
+
+			_, err := newConn(b, c, nil).Read(make([]byte, 64))
+			if err == nil {
+				t.Fatal("malformed chunk accepted")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayedSalt(t *testing.T) {
+	c, err := NewCipher("aes-256-gcm", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salts := newSaltFilter(16)
+
+	var session bytes.Buffer
+	if _, err := newConn(&bufConn{w: &session}, c, nil).Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []error{nil, errReplayedSalt} {
+		r := newConn(&bufConn{r: bytes.NewReader(session.Bytes())}, c, salts)
+		if _, err := r.Read(make([]byte, 64)); !errors.Is(err, want) {
+			t.Fatalf("session %d: got %v, want %v", i, err, want)
+		}
+	}
+}
+
+func TestJunkSaltsNotRecorded(t *testing.T) {
+	c, err := NewCipher("aes-256-gcm", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salts := newSaltFilter(4)
+
+	var session bytes.Buffer
+	if _, err := newConn(&bufConn{w: &session}, c, nil).Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newConn(&bufConn{r: bytes.NewReader(session.Bytes())}, c, salts).Read(make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+
+	// More junk salts than the filter holds, none of which authenticate
+	for i := 0; i < 16; i++ {
+		junk := bytes.Repeat([]byte{byte(i)}, c.SaltSize()+64)
+		if _, err := newConn(&bufConn{r: bytes.NewReader(junk)}, c, salts).Read(make([]byte, 64)); err == nil {
+			t.Fatal("junk session accepted")
+		}
+	}
+
+	r := newConn(&bufConn{r: bytes.NewReader(session.Bytes())}, c, salts)
+	if _, err := r.Read(make([]byte, 64)); !errors.Is(err, errReplayedSalt) {
+		t.Fatalf("got %v replaying after junk salts, want %v", err, errReplayedSalt)
+	}
+}
+
+func TestReflectedSalt(t *testing.T) {
+	c, err := NewCipher("chacha20-ietf-poly1305", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salts := newSaltFilter(16)
+
+	// What the server sends comes back to it as a new session
+	var reply bytes.Buffer
+	if _, err := newConn(&bufConn{w: &reply}, c, salts).Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	r := newConn(&bufConn{r: bytes.NewReader(reply.Bytes())}, c, salts)
+	if _, err := r.Read(make([]byte, 64)); !errors.Is(err, errReplayedSalt) {
+		t.Fatalf("got %v reading a reflected session, want %v", err, errReplayedSalt)
+	}
+}
+
+// bufConn is a net.Conn reading from r and writing to w.
+type bufConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *bufConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *bufConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+func TestProbeDiscardBounded(t *testing.T) {
+	c, err := NewCipher("aes-128-gcm", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	defer a.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- NewServer(c).ServeConn(b)
+	}()
+
+	// A probe that keeps sending garbage is cut off after the limit
+	garbage := bytes.Repeat([]byte{0x42}, 1024)
+	_ = a.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	written := 0
+	for written <= 2*probeDiscardLimit {
+		n, err := a.Write(garbage)
+		written += n
+		if err != nil {
+			break
+		}
+	}
+	if written > probeDiscardLimit+c.SaltSize()+len(garbage) {
+		t.Fatalf("read %d bytes of a probe, want at most about %d", written, probeDiscardLimit)
+	}
+	if err := <-served; err == nil {
+		t.Fatal("handshake of a probe succeeded")
+	}
+}
@@ -0,0 +1,281 @@
+package shadowsocks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+const (
+	ipv4Address = 0x01
+	fqdnAddress = 0x03
+	ipv6Address = 0x04
+)
+
+const (
+	// saltFilterSize is the number of recent salts checked for replays
+	saltFilterSize = 16384
+	// handshakeTimeout bounds how long a client may take to send the
+	// target address
+	handshakeTimeout = 30 * time.Second
+	// probeDiscardLimit bounds what is read from a client whose handshake
+	// failed before the connection is closed
+	probeDiscardLimit = 64 << 10
+	// maxAcceptDelay caps the backoff after failed accepts
+	maxAcceptDelay = time.Second
+)
+
+var errUnrecognizedAddrType = errors.New("unrecognized address type")
+
+// Server is accepting connections and handling the details of the
+// shadowsocks AEAD protocol
+type Server struct {
+	// bind is the address to listen on
+	Bind string
+
+	Listener net.Listener
+
+	// Cipher is the AEAD method and key clients must use
+	Cipher *Cipher
+
+	// ProxyDial specifies the optional proxyDial function for
+	// establishing the transport connection.
+	ProxyDial statute.ProxyDialFunc
+	// UserConnectHandle gives the user control to handle the TCP CONNECT requests
+	UserConnectHandle statute.UserConnectHandler
+	// Logger error log
+	Logger *slog.Logger
+	// Context is default context
+	Context context.Context
+	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
+	BytesPool statute.BytesPool
+
+	salts *saltFilter
+}
+
+func NewServer(c *Cipher, options ...ServerOption) *Server {
+	s := &Server{
+		Bind:      statute.DefaultBindAddress,
+		Cipher:    c,
+		ProxyDial: statute.DefaultProxyDial(),
+		Logger:    slog.Default(),
+		Context:   statute.DefaultContext(),
+		salts:     newSaltFilter(saltFilterSize),
+	}
+
+	for _, option := range options {
+		option(s)
+	}
+
+	return s
+}
+
+type ServerOption func(*Server)
+
+func WithLogger(logger *slog.Logger) ServerOption {
+	return func(s *Server) {
+		s.Logger = logger
+	}
+}
+
+func WithBind(bindAddress string) ServerOption {
+	return func(s *Server) {
+		s.Bind = bindAddress
+	}
+}
+
+func WithListener(ln net.Listener) ServerOption {
+	return func(s *Server) {
+		s.Listener = ln
+	}
+}
+
+func WithConnectHandle(handler statute.UserConnectHandler) ServerOption {
+	return func(s *Server) {
+		s.UserConnectHandle = handler
+	}
+}
+
+func WithProxyDial(proxyDial statute.ProxyDialFunc) ServerOption {
+	return func(s *Server) {
+		s.ProxyDial = proxyDial
+	}
+}
+
+func WithContext(ctx context.Context) ServerOption {
+	return func(s *Server) {
+		s.Context = ctx
+	}
+}
+
+func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
+	return func(s *Server) {
+		s.BytesPool = bytesPool
+	}
+}
+
+func (s *Server) ListenAndServe() error {
+	// Create a new listener
+	if s.Listener == nil {
+		ln, err := net.Listen("tcp", s.Bind)
+		if err != nil {
+			return err // Return error if binding was unsuccessful
+		}
+		s.Listener = ln
+	}
+
+	s.Bind = s.Listener.Addr().String()
+
+	// ensure listener will be closed
+	defer func() {
+		_ = s.Listener.Close()
+	}()
+
+	// Create a cancelable context based on s.Context
+	ctx, cancel := context.WithCancel(s.Context)
+	defer cancel() // Ensure resources are cleaned up
+
+	// Start to accept connections and serve them
+	var delay time.Duration
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			conn, err := s.Listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			if err != nil {
+				// Such as running out of file descriptors, back off
+				// instead of spinning until some are freed
+				delay = min(max(2*delay, 5*time.Millisecond), maxAcceptDelay)
+				s.Logger.Error(err.Error(), "retry_in", delay)
+				time.Sleep(delay)
+				continue
+			}
+			delay = 0
+
+			// Start a new goroutine to handle each connection
+			// This way, the server can handle multiple connections concurrently
+			go func() {
+				err := s.ServeConn(conn)
+				if err != nil {
+					s.Logger.Error(err.Error()) // Log errors from ServeConn
+				}
+			}()
+		}
+	}
+}
+
+func (s *Server) ServeConn(conn net.Conn) error {
+	sc := newConn(conn, s.Cipher, s.salts)
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	host, port, err := readAddr(sc)
+	if err != nil {
+		// Don't give probes a timing or close signal to fingerprint,
+		// keep reading until the peer gives up, up to a limit so that
+		// they can't hold the connection open forever
+		_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		_, _ = io.CopyN(io.Discard, conn, probeDiscardLimit)
+		_ = conn.Close()
+		return fmt.Errorf("shadowsocks handshake failed: %w", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	destination := net.JoinHostPort(host, strconv.Itoa(port))
+	if s.UserConnectHandle == nil {
+		return s.embedHandleConnect(sc, destination)
+	}
+
+	proxyReq := &statute.ProxyRequest{
+		Conn:        sc,
+		Reader:      io.Reader(sc),
+		Writer:      io.Writer(sc),
+		Network:     "tcp",
+		Destination: destination,
+		DestHost:    host,
+		DestPort:    int32(port),
+	}
+
+	return s.UserConnectHandle(proxyReq)
+}
+
+func (s *Server) embedHandleConnect(conn net.Conn, destination string) error {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	target, err := s.ProxyDial(s.Context, "tcp", destination)
+	if err != nil {
+		return fmt.Errorf("connect to %v failed: %w", destination, err)
+	}
+	defer func() {
+		_ = target.Close()
+	}()
+
+	var buf1, buf2 []byte
+	if s.BytesPool != nil {
+		buf1 = s.BytesPool.Get()
+		buf2 = s.BytesPool.Get()
+		defer func() {
+			s.BytesPool.Put(buf1)
+			s.BytesPool.Put(buf2)
+		}()
+	} else {
+		buf1 = make([]byte, 32*1024)
+		buf2 = make([]byte, 32*1024)
+	}
+	return statute.Tunnel(s.Context, target, conn, buf1, buf2)
+}
+
+// readAddr reads the SOCKS style target address every session starts with.
+func readAddr(r io.Reader) (string, int, error) {
+	var addrType [1]byte
+	if _, err := io.ReadFull(r, addrType[:]); err != nil {
+		return "", 0, err
+	}
+
+	var host string
+	switch addrType[0] {
+	case ipv4Address:
+		addr := make(net.IP, net.IPv4len)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return "", 0, err
+		}
+		host = addr.String()
+	case ipv6Address:
+		addr := make(net.IP, net.IPv6len)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return "", 0, err
+		}
+		host = addr.String()
+	case fqdnAddress:
+		var addrLen [1]byte
+		if _, err := io.ReadFull(r, addrLen[:]); err != nil {
+			return "", 0, err
+		}
+		fqdn := make([]byte, addrLen[0])
+		if _, err := io.ReadFull(r, fqdn); err != nil {
+			return "", 0, err
+		}
+		host = string(fqdn)
+	default:
+		return "", 0, errUnrecognizedAddrType
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(port[:])), nil
+}
@@ -56,7 +56,7 @@ func (s *Server) ListenAndServe() error {
 		s.Listener = ln
 	}
 
-	s.Bind = s.Listener.Addr().(*net.TCPAddr).String()
+	s.Bind = s.Listener.Addr().String()
 
 	// ensure listener will be closed
 	defer func() {
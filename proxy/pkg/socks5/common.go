@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 	"net"
 	"strconv"
@@ -298,16 +297,19 @@ func splitHostPort(address string) (string, int, error) {
 }
 
 type readStruct struct {
-	data []byte
-	err  error
+	data   []byte
+	target string
+	err    error
 }
 
 type udpCustomConn struct {
 	net.PacketConn
 	assocTCPConn net.Conn
+	clientOnly   bool
 	lock         sync.Mutex
 	sourceAddr   net.Addr
 	targetAddr   net.Addr
+	target       string
 	replyPrefix  []byte
 	firstRead    sync.Once
 	frc          chan bool
@@ -331,15 +333,16 @@ func (cc *udpCustomConn) asyncReadPackets() {
 				break
 			}
 			if n < 3 {
-				cc.packetQueue <- &readStruct{
-					data: nil,
-					err:  err,
-				}
-				break
+				continue
 			}
-			if cc.sourceAddr == nil {
-				cc.sourceAddr = addr
+			if !cc.fromClient(addr) {
+				continue
 			}
+			// replies follow the client when its port changes, as behind a
+			// NAT that rebinds or a QUIC connection that migrates
+			cc.lock.Lock()
+			cc.sourceAddr = addr
+			cc.lock.Unlock()
 
 			reader := bytes.NewBuffer(tempBuf[3:n])
 			targetAddr, err := readAddr(reader)
@@ -356,34 +359,68 @@ func (cc *udpCustomConn) asyncReadPackets() {
 					IP:   targetAddr.IP,
 					Port: targetAddr.Port,
 				}
-			}
-			if targetAddr.String() != cc.targetAddr.String() {
-				cc.packetQueue <- &readStruct{
-					data: nil,
-					err:  fmt.Errorf("ignore non-target addresses %s", targetAddr.String()),
-				}
-				break
+				cc.target = targetAddr.String()
 			}
 			cc.firstRead.Do(func() {
 				// ok we have source and destination address now user can handle new ProxyReq
 				cc.frc <- true
 			})
+			// The buffer is reused for the next packet
 			cc.packetQueue <- &readStruct{
-				data: reader.Bytes(),
-				err:  nil,
+				data:   append([]byte(nil), reader.Bytes()...),
+				target: targetAddr.String(),
+				err:    nil,
 			}
 		}
 	}()
 }
 
+// fromClient reports whether addr is of the host that made the
+// association, which is all that can send on it with clientOnly set.
+func (cc *udpCustomConn) fromClient(addr net.Addr) bool {
+	if !cc.clientOnly {
+		return true
+	}
+	client, ok := cc.assocTCPConn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	from, ok := addr.(*net.UDPAddr)
+	return ok && from.AddrPort().Addr().Unmap() == client.AddrPort().Addr().Unmap()
+}
+
+// Read reads the next packet for the first target, dropping those for
+// others.
 func (cc *udpCustomConn) Read(b []byte) (int, error) {
+	for {
+		n, target, err := cc.ReadPacket(b)
+		if err != nil || target == cc.target {
+			return n, err
+		}
+	}
+}
+
+// ReadPacket reads the next packet and the target it is for.
+func (cc *udpCustomConn) ReadPacket(b []byte) (int, string, error) {
 	// wait for packet data
 	read := <-cc.packetQueue
 	if read.err != nil {
-		return 0, read.err
+		return 0, "", read.err
+	}
+	return copy(b, read.data), read.target, nil
+}
+
+// WritePacket sends b to the client as a packet from target.
+func (cc *udpCustomConn) WritePacket(b []byte, target string) (int, error) {
+	prefix := bytes.NewBuffer(make([]byte, 3, 16+len(b)))
+	if err := writeAddrWithStr(prefix, target); err != nil {
+		return 0, err
 	}
-	copy(b, read.data)
-	return len(read.data), nil
+	prefix.Write(b)
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	_, err := cc.WriteTo(prefix.Bytes(), cc.sourceAddr)
+	return len(b), err
 }
 
 func (cc *udpCustomConn) Write(b []byte) (int, error) {
@@ -36,6 +36,9 @@ type Server struct {
 	Context context.Context
 	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
 	BytesPool statute.BytesPool
+	// ClientOnlyUDP drops the packets of UDP associations sent from other
+	// hosts than the client that made the association
+	ClientOnlyUDP bool
 }
 
 func NewServer(options ...ServerOption) *Server {
@@ -67,7 +70,7 @@ func (s *Server) ListenAndServe() error {
 		s.Listener = ln
 	}
 
-	s.Bind = s.Listener.Addr().(*net.TCPAddr).String()
+	s.Bind = s.Listener.Addr().String()
 
 	// ensure listener will be closed
 	defer func() {
@@ -150,6 +153,12 @@ func WithContext(ctx context.Context) ServerOption {
 	}
 }
 
+func WithClientOnlyUDP() ServerOption {
+	return func(s *Server) {
+		s.ClientOnlyUDP = true
+	}
+}
+
 func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
 	return func(s *Server) {
 		s.BytesPool = bytesPool
@@ -326,6 +335,7 @@ func (s *Server) handleAssociate(req *request) error {
 	cConn := &udpCustomConn{
 		PacketConn:   udpConn,
 		assocTCPConn: req.Conn,
+		clientOnly:   s.ClientOnlyUDP,
 		frc:          make(chan bool),
 		packetQueue:  make(chan *readStruct),
 	}
@@ -335,6 +345,17 @@ func (s *Server) handleAssociate(req *request) error {
 	// wait for first packet so that target sender and receiver get known
 	<-cConn.frc
 
+	// the association ends with the TCP connection it came on
+	go func() {
+		var buf [1]byte
+		for {
+			if _, err := req.Conn.Read(buf[:]); err != nil {
+				_ = cConn.Close()
+				return
+			}
+		}
+	}()
+
 	proxyReq := &statute.ProxyRequest{
 		Conn:        cConn,
 		Reader:      cConn,
@@ -32,6 +32,16 @@ type ProxyRequest struct {
 	DestPort    int32
 }
 
+// PacketConn is the Conn of a UDP associate request, which carries packets
+// for any target the client sends to, not just the one of the request.
+type PacketConn interface {
+	net.Conn
+	// ReadPacket reads the next packet and the target it is for
+	ReadPacket(b []byte) (n int, target string, err error)
+	// WritePacket sends b to the client as a packet from target
+	WritePacket(b []byte, target string) (n int, err error)
+}
+
 // UserConnectHandler is used for socks5, socks4 and http
 type UserConnectHandler func(request *ProxyRequest) error
 
@@ -0,0 +1,68 @@
+package trojan
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+const (
+	connectCommand = 0x01
+
+	ipv4Address = 0x01
+	fqdnAddress = 0x03
+	ipv6Address = 0x04
+)
+
+// ClientConn starts a Trojan TCP session to destination over conn, which
+// must already be a TLS connection to the server:
+//
+//	hex(sha224(password)) CRLF command atyp addr port CRLF payload
+func ClientConn(conn net.Conn, password, network, destination string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network: %s", network)
+	}
+
+	host, portStr, err := net.SplitHostPort(destination)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum224([]byte(password))
+
+	hdr := make([]byte, 0, 56+2+1+1+1+len(host)+2+2)
+	hdr = hex.AppendEncode(hdr, sum[:])
+	hdr = append(hdr, '\r', '\n', connectCommand)
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if addr.Is4() {
+			hdr = append(hdr, ipv4Address)
+		} else {
+			hdr = append(hdr, ipv6Address)
+		}
+		hdr = append(hdr, addr.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("destination host too long")
+		}
+		hdr = append(hdr, fqdnAddress, byte(len(host)))
+		hdr = append(hdr, host...)
+	}
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(port))
+	hdr = append(hdr, '\r', '\n')
+
+	if _, err := conn.Write(hdr); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,89 @@
+package vless
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// ClientConn starts a VLESS session to destination over conn, which must
+// already be connected to the server. UDP packets written to and read from
+// the returned connection are framed as the protocol requires.
+func ClientConn(conn net.Conn, id UUID, network, destination string) (net.Conn, error) {
+	var cmd Command
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		cmd = TCPCommand
+	case "udp", "udp4", "udp6":
+		cmd = UDPCommand
+	default:
+		return nil, fmt.Errorf("unsupported network: %s", network)
+	}
+
+	host, portStr, err := net.SplitHostPort(destination)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, 0, 22+len(host))
+	hdr = append(hdr, version)
+	hdr = append(hdr, id[:]...)
+	hdr = append(hdr, 0, byte(cmd))
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(port))
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if addr.Is4() {
+			hdr = append(hdr, ipv4Address)
+		} else {
+			hdr = append(hdr, ipv6Address)
+		}
+		hdr = append(hdr, addr.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("destination host too long")
+		}
+		hdr = append(hdr, fqdnAddress, byte(len(host)))
+		hdr = append(hdr, host...)
+	}
+
+	if _, err := conn.Write(hdr); err != nil {
+		return nil, err
+	}
+
+	var c net.Conn = &clientConn{Conn: conn}
+	if cmd == UDPCommand {
+		c = &packetConn{Conn: c}
+	}
+	return c, nil
+}
+
+// clientConn strips the response header, version and addons, from the
+// start of the stream.
+type clientConn struct {
+	net.Conn
+	received bool
+}
+
+func (c *clientConn) Read(p []byte) (int, error) {
+	if !c.received {
+		var hdr [2]byte
+		if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+			return 0, err
+		}
+		if hdr[0] != version {
+			return 0, fmt.Errorf("unsupported VLESS version: %d", hdr[0])
+		}
+		if _, err := io.CopyN(io.Discard, c.Conn, int64(hdr[1])); err != nil {
+			return 0, err
+		}
+		c.received = true
+	}
+	return c.Conn.Read(p)
+}
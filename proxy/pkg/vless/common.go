@@ -0,0 +1,198 @@
+package vless
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const version = 0x00
+
+// Command is a VLESS request command.
+type Command byte
+
+const (
+	TCPCommand Command = 0x01
+	UDPCommand Command = 0x02
+	MuxCommand Command = 0x03
+)
+
+func (cmd Command) String() string {
+	switch cmd {
+	case TCPCommand:
+		return "vless tcp"
+	case UDPCommand:
+		return "vless udp"
+	case MuxCommand:
+		return "vless mux"
+	default:
+		return "vless " + strconv.Itoa(int(cmd))
+	}
+}
+
+const (
+	ipv4Address = 0x01
+	fqdnAddress = 0x02
+	ipv6Address = 0x03
+)
+
+var (
+	errUnrecognizedAddrType = errors.New("unrecognized address type")
+	errUnknownUser          = errors.New("unknown user id")
+)
+
+// UUID is a VLESS user id.
+type UUID [16]byte
+
+// ParseUUID parses a canonical UUID. Like Xray, any other string of at most
+// 30 bytes is mapped to the UUIDv5 of the string in the nil namespace.
+func ParseUUID(s string) (UUID, error) {
+	var id UUID
+	if b, err := hex.DecodeString(strings.ReplaceAll(s, "-", "")); err == nil && len(b) == len(id) && len(s) == 36 {
+		copy(id[:], b)
+		return id, nil
+	}
+
+	if s == "" || len(s) > 30 {
+		return id, fmt.Errorf("invalid vless id: %q", s)
+	}
+
+	h := sha1.New()
+	h.Write(make([]byte, len(id)))
+	h.Write([]byte(s))
+	copy(id[:], h.Sum(nil))
+	id[6] = id[6]&0x0f | 0x50
+	id[8] = id[8]&0x3f | 0x80
+	return id, nil
+}
+
+type request struct {
+	Command Command
+	Host    string
+	Port    int
+}
+
+// readRequest reads the request header, checking the user id against users:
+//
+//	version(1) uuid(16) addons_len(1) addons command(1) port(2) atyp(1) addr
+func readRequest(r io.Reader, users map[UUID]struct{}) (*request, error) {
+	var hdr [18]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != version {
+		return nil, fmt.Errorf("unsupported VLESS version: %d", hdr[0])
+	}
+	if _, ok := users[UUID(hdr[1:17])]; !ok {
+		return nil, errUnknownUser
+	}
+
+	// Addons are protobuf encoded flow settings, which plain TCP ignores
+	if _, err := io.CopyN(io.Discard, r, int64(hdr[17])); err != nil {
+		return nil, err
+	}
+
+	var cmd [1]byte
+	if _, err := io.ReadFull(r, cmd[:]); err != nil {
+		return nil, err
+	}
+	req := &request{Command: Command(cmd[0])}
+	if req.Command == MuxCommand {
+		return req, nil
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+	req.Port = int(binary.BigEndian.Uint16(port[:]))
+
+	var addrType [1]byte
+	if _, err := io.ReadFull(r, addrType[:]); err != nil {
+		return nil, err
+	}
+	switch addrType[0] {
+	case ipv4Address:
+		addr := make(net.IP, net.IPv4len)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return nil, err
+		}
+		req.Host = addr.String()
+	case ipv6Address:
+		addr := make(net.IP, net.IPv6len)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return nil, err
+		}
+		req.Host = addr.String()
+	case fqdnAddress:
+		var addrLen [1]byte
+		if _, err := io.ReadFull(r, addrLen[:]); err != nil {
+			return nil, err
+		}
+		fqdn := make([]byte, addrLen[0])
+		if _, err := io.ReadFull(r, fqdn); err != nil {
+			return nil, err
+		}
+		req.Host = string(fqdn)
+	default:
+		return nil, errUnrecognizedAddrType
+	}
+
+	return req, nil
+}
+
+// responseConn prepends the response header, version and an empty addons
+// block, to the first write.
+type responseConn struct {
+	net.Conn
+	sent bool
+}
+
+func (c *responseConn) Write(p []byte) (int, error) {
+	if c.sent {
+		return c.Conn.Write(p)
+	}
+	c.sent = true
+	if _, err := c.Conn.Write(append([]byte{version, 0}, p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// packetConn carries UDP over the stream, each packet prefixed with its
+// big-endian length.
+type packetConn struct {
+	net.Conn
+}
+
+func (c *packetConn) Read(p []byte) (int, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(c.Conn, length[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(length[:]))
+	if size > len(p) {
+		_, _ = io.CopyN(io.Discard, c.Conn, int64(size))
+		return 0, io.ErrShortBuffer
+	}
+	return io.ReadFull(c.Conn, p[:size])
+}
+
+func (c *packetConn) Write(p []byte) (int, error) {
+	if len(p) > 0xffff {
+		return 0, errors.New("packet too large")
+	}
+	buf := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(buf, uint16(len(p)))
+	copy(buf[2:], p)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
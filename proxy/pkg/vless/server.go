@@ -0,0 +1,211 @@
+package vless
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// Server is accepting connections and handling the details of the VLESS
+// protocol
+type Server struct {
+	// bind is the address to listen on
+	Bind string
+
+	Listener net.Listener
+
+	// Users are the ids clients may authenticate with
+	Users map[UUID]struct{}
+
+	// ProxyDial specifies the optional proxyDial function for
+	// establishing the transport connection.
+	ProxyDial statute.ProxyDialFunc
+	// UserConnectHandle gives the user control to handle the TCP and UDP
+	// requests, UDP packets are framed on the request connection
+	UserConnectHandle statute.UserConnectHandler
+	// Logger error log
+	Logger *slog.Logger
+	// Context is default context
+	Context context.Context
+	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
+	BytesPool statute.BytesPool
+}
+
+func NewServer(users []UUID, options ...ServerOption) *Server {
+	s := &Server{
+		Bind:      statute.DefaultBindAddress,
+		Users:     make(map[UUID]struct{}, len(users)),
+		ProxyDial: statute.DefaultProxyDial(),
+		Logger:    slog.Default(),
+		Context:   statute.DefaultContext(),
+	}
+	for _, id := range users {
+		s.Users[id] = struct{}{}
+	}
+
+	for _, option := range options {
+		option(s)
+	}
+
+	return s
+}
+
+type ServerOption func(*Server)
+
+func WithLogger(logger *slog.Logger) ServerOption {
+	return func(s *Server) {
+		s.Logger = logger
+	}
+}
+
+func WithBind(bindAddress string) ServerOption {
+	return func(s *Server) {
+		s.Bind = bindAddress
+	}
+}
+
+func WithListener(ln net.Listener) ServerOption {
+	return func(s *Server) {
+		s.Listener = ln
+	}
+}
+
+func WithConnectHandle(handler statute.UserConnectHandler) ServerOption {
+	return func(s *Server) {
+		s.UserConnectHandle = handler
+	}
+}
+
+func WithProxyDial(proxyDial statute.ProxyDialFunc) ServerOption {
+	return func(s *Server) {
+		s.ProxyDial = proxyDial
+	}
+}
+
+func WithContext(ctx context.Context) ServerOption {
+	return func(s *Server) {
+		s.Context = ctx
+	}
+}
+
+func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
+	return func(s *Server) {
+		s.BytesPool = bytesPool
+	}
+}
+
+func (s *Server) ListenAndServe() error {
+	// Create a new listener
+	if s.Listener == nil {
+		ln, err := net.Listen("tcp", s.Bind)
+		if err != nil {
+			return err // Return error if binding was unsuccessful
+		}
+		s.Listener = ln
+	}
+
+	s.Bind = s.Listener.Addr().String()
+
+	// ensure listener will be closed
+	defer func() {
+		_ = s.Listener.Close()
+	}()
+
+	// Create a cancelable context based on s.Context
+	ctx, cancel := context.WithCancel(s.Context)
+	defer cancel() // Ensure resources are cleaned up
+
+	// Start to accept connections and serve them
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			conn, err := s.Listener.Accept()
+			if err != nil {
+				s.Logger.Error(err.Error())
+				continue
+			}
+
+			// Start a new goroutine to handle each connection
+			// This way, the server can handle multiple connections concurrently
+			go func() {
+				err := s.ServeConn(conn)
+				if err != nil {
+					s.Logger.Error(err.Error()) // Log errors from ServeConn
+				}
+			}()
+		}
+	}
+}
+
+func (s *Server) ServeConn(conn net.Conn) error {
+	req, err := readRequest(conn, s.Users)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("vless handshake failed: %w", err)
+	}
+
+	var network string
+	var reqConn net.Conn = &responseConn{Conn: conn}
+	switch req.Command {
+	case TCPCommand:
+		network = "tcp"
+	case UDPCommand:
+		network = "udp"
+		reqConn = &packetConn{Conn: reqConn}
+	default:
+		_ = conn.Close()
+		return fmt.Errorf("unsupported Command: %v", req.Command)
+	}
+
+	destination := net.JoinHostPort(req.Host, strconv.Itoa(req.Port))
+	if s.UserConnectHandle == nil {
+		return s.embedHandleConnect(reqConn, network, destination)
+	}
+
+	proxyReq := &statute.ProxyRequest{
+		Conn:        reqConn,
+		Reader:      io.Reader(reqConn),
+		Writer:      io.Writer(reqConn),
+		Network:     network,
+		Destination: destination,
+		DestHost:    req.Host,
+		DestPort:    int32(req.Port),
+	}
+
+	return s.UserConnectHandle(proxyReq)
+}
+
+func (s *Server) embedHandleConnect(conn net.Conn, network, destination string) error {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	target, err := s.ProxyDial(s.Context, network, destination)
+	if err != nil {
+		return fmt.Errorf("connect to %v failed: %w", destination, err)
+	}
+	defer func() {
+		_ = target.Close()
+	}()
+
+	var buf1, buf2 []byte
+	if s.BytesPool != nil {
+		buf1 = s.BytesPool.Get()
+		buf2 = s.BytesPool.Get()
+		defer func() {
+			s.BytesPool.Put(buf1)
+			s.BytesPool.Put(buf2)
+		}()
+	} else {
+		buf1 = make([]byte, 32*1024)
+		buf2 = make([]byte, 32*1024)
+	}
+	return statute.Tunnel(s.Context, target, conn, buf1, buf2)
+}
@@ -0,0 +1,106 @@
+package update
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// PublicKey is a minisign public key.
+type PublicKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+// ParsePublicKey parses a minisign public key, either bare base64 or the
+// contents of a .pub file.
+func ParsePublicKey(s string) (PublicKey, error) {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[len(lines)-1]))
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("invalid public key: %w", err)
+	}
+	if len(raw) != 2+8+ed25519.PublicKeySize || string(raw[:2]) != "Ed" {
+		return PublicKey{}, errors.New("invalid public key: not an ed25519 minisign key")
+	}
+
+	var pk PublicKey
+	copy(pk.id[:], raw[2:10])
+	pk.key = ed25519.PublicKey(raw[10:])
+	return pk, nil
+}
+
+// Verify checks sig, the contents of a .minisig file, over data. Both
+// legacy and prehashed signatures are accepted.
+func (pk PublicKey) Verify(data, sig []byte) error {
+	_, err := pk.verify(data, sig)
+	return err
+}
+
+// VerifyRelease checks sig over data like Verify, and that its trusted
+// comment names file and tag, as "file:NAME" and "tag:TAG", so a signed
+// archive of another platform or release can't be passed off as this one.
+func (pk PublicKey) VerifyRelease(data, sig []byte, file, tag string) error {
+	comment, err := pk.verify(data, sig)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(comment)
+	if !slices.Contains(fields, "file:"+file) {
+		return fmt.Errorf("signature is not for %s", file)
+	}
+	if !slices.Contains(fields, "tag:"+tag) {
+		return fmt.Errorf("signature is not for release %s", tag)
+	}
+	return nil
+}
+
+// verify checks sig over data, returning its trusted comment.
+func (pk PublicKey) verify(data, sig []byte) (string, error) {
+	lines := strings.Split(strings.TrimSpace(string(sig)), "\n")
+	if len(lines) < 4 {
+		return "", errors.New("invalid signature: truncated")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(raw) != 2+8+ed25519.SignatureSize {
+		return "", errors.New("invalid signature: malformed")
+	}
+	alg, id, signature := string(raw[:2]), raw[2:10], raw[10:]
+	if !bytes.Equal(id, pk.id[:]) {
+		return "", errors.New("signature made with a different key")
+	}
+
+	message := data
+	switch alg {
+	case "Ed":
+	case "ED":
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	default:
+		return "", fmt.Errorf("unsupported signature algorithm %q", alg)
+	}
+	if !ed25519.Verify(pk.key, message, signature) {
+		return "", errors.New("signature verification failed")
+	}
+
+	// The trusted comment is covered by a second signature
+	comment, ok := strings.CutPrefix(strings.TrimRight(lines[2], "\r"), "trusted comment: ")
+	if !ok {
+		return "", errors.New("invalid signature: missing trusted comment")
+	}
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return "", errors.New("invalid signature: malformed trusted comment signature")
+	}
+	if !ed25519.Verify(pk.key, append(bytes.Clone(signature), comment...), global) {
+		return "", errors.New("trusted comment verification failed")
+	}
+	return comment, nil
+}
@@ -0,0 +1,138 @@
+package update
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// testSigner signs like minisign -S, prehashed.
+type testSigner struct {
+	id   [8]byte
+	priv ed25519.PrivateKey
+	pub  PublicKey
+}
+
+func newTestSigner(t *testing.T) testSigner {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := testSigner{id: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}, priv: priv}
+	raw := append(append([]byte("Ed"), s.id[:]...), pub...)
+	if s.pub, err = ParsePublicKey(base64.StdEncoding.EncodeToString(raw)); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func (s testSigner) sign(data []byte, comment string) []byte {
+	sum := blake2b.Sum512(data)
+	signature := ed25519.Sign(s.priv, sum[:])
+	global := ed25519.Sign(s.priv, append(append([]byte(nil), signature...), comment...))
+	raw := append(append([]byte("ED"), s.id[:]...), signature...)
+	return []byte("untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(raw) + "\n" +
+		"trusted comment: " + comment + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n")
+}
+
+func TestVerify(t *testing.T) {
+	s := newTestSigner(t)
+	data := []byte("archive")
+	const comment = "timestamp:1700000000 file:warp-plus_linux-amd64.zip tag:v1.2.4"
+	sig := s.sign(data, comment)
+
+	if err := s.pub.Verify(data, sig); err != nil {
+		t.Fatalf("valid signature: %v", err)
+	}
+	if err := s.pub.VerifyRelease(data, sig, "warp-plus_linux-amd64.zip", "v1.2.4"); err != nil {
+		t.Fatalf("valid release signature: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		data, sig  []byte
+		file, tag  string
+		wantSubstr string
+	}{
+		{
+			name: "bad signature",
+			data: []byte("tampered archive"), sig: sig,
+			file: "warp-plus_linux-amd64.zip", tag: "v1.2.4",
+			wantSubstr: "signature verification failed",
+		},
+		{
+			name: "tampered comment",
+			data: data, sig: []byte(strings.Replace(string(sig), "tag:v1.2.4", "tag:v9.9.9", 1)),
+			file: "warp-plus_linux-amd64.zip", tag: "v9.9.9",
+			wantSubstr: "trusted comment verification failed",
+		},
+		{
+			name: "wrong asset",
+			data: data, sig: sig,
+			file: "warp-plus_windows-amd64.zip", tag: "v1.2.4",
+			wantSubstr: "not for warp-plus_windows-amd64.zip",
+		},
+		{
+			name: "downgrade",
+			data: data, sig: sig,
+			file: "warp-plus_linux-amd64.zip", tag: "v1.2.5",
+			wantSubstr: "not for release v1.2.5",
+		},
+		{
+			name: "other key",
+			data: data, sig: newTestSigner(t).sign(data, comment),
+			file: "warp-plus_linux-amd64.zip", tag: "v1.2.4",
+			wantSubstr: "signature verification failed",
+		},
+		{
+			name: "no file in comment",
+			data: data, sig: s.sign(data, "timestamp:1700000000 tag:v1.2.4"),
+			file: "warp-plus_linux-amd64.zip", tag: "v1.2.4",
+			wantSubstr: "not for warp-plus_linux-amd64.zip",
+		},
+		{
+			name: "truncated",
+			data: data, sig: []byte("untrusted comment: x\n"),
+			file: "warp-plus_linux-amd64.zip", tag: "v1.2.4",
+			wantSubstr: "truncated",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.pub.VerifyRelease(tt.data, tt.sig, tt.file, tt.tag)
+			if err == nil || !strings.Contains(err.Error(), tt.wantSubstr) {
+				t.Fatalf("got %v, want error containing %q", err, tt.wantSubstr)
+			}
+		})
+	}
+}
+
+func TestIsNewer(t *testing.T) {
+	tests := []struct {
+		tag, current string
+		want         bool
+	}{
+		{"v1.2.5", "refs/tags/v1.2.4", true},
+		{"v1.10.0", "v1.9.9", true},
+		{"v2.0.0", "v2.0.0-rc.1", true},
+		{"v1.2.4", "refs/tags/v1.2.4", false},
+		{"v1.2.3", "refs/tags/v1.2.4", false},
+		{"v1.2.4-rc.1", "v1.2.4", false},
+		{"v1.2.5", "", false},
+		{"v1.2.5", "refs/heads/master", false},
+		{"nightly", "v1.2.4", false},
+		{"1.2.5", "1.2.4", true},
+	}
+	for _, tt := range tests {
+		if got := (Release{Tag: tt.tag}).IsNewer(tt.current); got != tt.want {
+			t.Errorf("Release{%q}.IsNewer(%q) = %v, want %v", tt.tag, tt.current, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Package update replaces the running binary with the latest release from
+// GitHub, after checking its minisign signature.
+package update
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+const (
+	// releasesURL is the GitHub API endpoint of the latest release.
+	releasesURL = "https://api.github.com/repos/bepass-org/warp-plus/releases/latest"
+	// maxAssetSize bounds downloads.
+	maxAssetSize = 100 << 20
+	// signatureSuffix is appended to an asset name for its signature.
+	signatureSuffix = ".minisig"
+)
+
+// Release is a published release and its downloadable assets.
+type Release struct {
+	Tag    string `json:"tag_name"`
+	Assets []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (r Release) assetURL(name string) (string, bool) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL, true
+		}
+	}
+	return "", false
+}
+
+// AssetName returns the name of the release archive built for the running
+// platform, following the release workflow's naming.
+func AssetName() string {
+	name := runtime.GOOS + "-" + runtime.GOARCH
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			// Releases only spell out the non-default float mode
+			if (s.Key == "GOARM" || s.Key == "GOMIPS") && s.Value != "" && s.Value != "hardfloat" {
+				name += s.Value
+			}
+		}
+	}
+	return "warp-plus_" + name + ".zip"
+}
+
+// Latest fetches the latest release.
+func Latest(ctx context.Context) (Release, error) {
+	body, err := get(ctx, releasesURL)
+	if err != nil {
+		return Release{}, fmt.Errorf("failed to fetch latest release: %w", err)
+	}
+
+	var r Release
+	if err := json.Unmarshal(body, &r); err != nil {
+		return Release{}, fmt.Errorf("failed to decode latest release: %w", err)
+	}
+	return r, nil
+}
+
+// IsNewer reports whether r is a later version than the running one, given
+// as set by the release workflow. Unversioned builds and tags that aren't
+// semantic versions never count as outdated, so nothing older or unknown
+// gets installed.
+func (r Release) IsNewer(current string) bool {
+	return semver.Compare(canonicalVersion(r.Tag), canonicalVersion(current)) > 0 &&
+		semver.IsValid(canonicalVersion(current))
+}
+
+// canonicalVersion returns tag as a semantic version with a leading v, or
+// "" if it isn't one.
+func canonicalVersion(tag string) string {
+	tag = strings.TrimPrefix(tag, "refs/tags/")
+	if !strings.HasPrefix(tag, "v") {
+		tag = "v" + tag
+	}
+	if !semver.IsValid(tag) {
+		return ""
+	}
+	return tag
+}
+
+// Apply downloads the platform's archive of r, verifies it against key and
+// atomically replaces the running executable with the binary inside.
+func Apply(ctx context.Context, r Release, key PublicKey) error {
+	name := AssetName()
+	url, ok := r.assetURL(name)
+	if !ok {
+		return fmt.Errorf("release %s has no asset %s", r.Tag, name)
+	}
+	sigURL, ok := r.assetURL(name + signatureSuffix)
+	if !ok {
+		return fmt.Errorf("release %s has no signature for %s", r.Tag, name)
+	}
+
+	archive, err := get(ctx, url)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	sig, err := get(ctx, sigURL)
+	if err != nil {
+		return fmt.Errorf("failed to download signature: %w", err)
+	}
+	if err := key.VerifyRelease(archive, sig, name, r.Tag); err != nil {
+		return fmt.Errorf("refusing %s: %w", name, err)
+	}
+
+	binary, err := extract(archive)
+	if err != nil {
+		return err
+	}
+	return replaceExecutable(binary)
+}
+
+// extract returns the warp-plus binary from a release archive.
+func extract(archive []byte) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid release archive: %w", err)
+	}
+
+	want := "warp-plus"
+	if runtime.GOOS == "windows" {
+		want += ".exe"
+	}
+	for _, f := range zr.File {
+		if filepath.Base(f.Name) != want {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(io.LimitReader(rc, maxAssetSize))
+	}
+	return nil, fmt.Errorf("release archive has no %s", want)
+}
+
+// replaceExecutable swaps binary in for the running executable by renaming
+// over it, so it is either fully replaced or untouched. Windows can't
+// replace a running executable, so it is moved aside first.
+func replaceExecutable(binary []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".warp-plus-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o755); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp.Name(), exe); err != nil {
+			return errors.Join(err, os.Rename(old, exe))
+		}
+		return nil
+	}
+	return os.Rename(tmp.Name(), exe)
+}
+
+func get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxAssetSize))
+}
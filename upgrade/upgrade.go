@@ -0,0 +1,317 @@
+// Package upgrade hands listening sockets over to a newly started binary,
+// so a running instance can be replaced without refusing connections. The
+// old process keeps serving the connections it already accepted until they
+// finish.
+//
+// Only listeners are handed over. The new process brings its own tunnel up
+// with the same identity, which takes the session at the server over from
+// the old one, so connections the old process drains through the tunnel
+// may stall. Upgrades are for proxy listeners, not for tun mode.
+//
+// Listeners can be handed over within the process too, see Share.
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// envInherit lists the inherited listeners of a process started by an
+// upgrade, in file descriptor order after the readiness pipe. It doesn't
+// start with WARP_ as those are reserved for flags.
+const envInherit = "WARPPLUS_UPGRADE"
+
+// readyFD is the write end of the pipe a new process reports readiness on.
+const readyFD = 3
+
+var (
+	mu sync.Mutex
+	// parsed is set once the environment has been read
+	parsed bool
+	// upgraded is set in a process started by an upgrade
+	upgraded bool
+	// inherited holds listeners handed over and not yet claimed, by key
+	inherited map[string]*os.File
+	// listeners holds every open listener by key
+	listeners = make(map[string]*listener)
+	// sharing is set while Listen takes over the sockets of listeners open
+	// in this process, see Share
+	sharing bool
+	// shared holds the listeners whose sockets were taken over since Share
+	shared []*listener
+)
+
+type listener struct {
+	net.Listener
+	key string
+}
+
+func (l *listener) Close() error {
+	mu.Lock()
+	if listeners[l.key] == l {
+		delete(listeners, l.key)
+	}
+	mu.Unlock()
+	return l.Listener.Close()
+}
+
+func key(network, address string) string {
+	return network + "/" + address
+}
+
+// parseEnv picks up the listeners handed over by the previous process. mu
+// must be held.
+func parseEnv() {
+	if parsed {
+		return
+	}
+	parsed = true
+
+	names := os.Getenv(envInherit)
+	if names == "" {
+		return
+	}
+	os.Unsetenv(envInherit)
+	upgraded = true
+
+	inherited = make(map[string]*os.File)
+	for i, name := range strings.Split(names, ";") {
+		inherited[name] = os.NewFile(uintptr(readyFD+1+i), name)
+	}
+}
+
+// Listen is like net.Listen, but takes over the listener for the same
+// address from the previous process when started by an upgrade.
+func Listen(network, address string) (net.Listener, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	parseEnv()
+
+	k := key(network, address)
+	var ln net.Listener
+	var err error
+	if f, ok := inherited[k]; ok {
+		delete(inherited, k)
+		ln, err = net.FileListener(f)
+		f.Close()
+	} else if old, ok := listeners[k]; ok && sharing && !anyPort(address) {
+		if ln, err = dup(old.Listener); err == nil {
+			shared = append(shared, old)
+		}
+	} else {
+		ln, err = net.Listen(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The process a unix socket is handed to keeps serving on its path
+	// after this one closes it
+	if ul, ok := ln.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+
+	tracked := &listener{Listener: ln, key: k}
+	listeners[k] = tracked
+	return tracked, nil
+}
+
+// anyPort reports whether address leaves the port to the system, so that
+// listening on it twice yields two listeners.
+func anyPort(address string) bool {
+	_, port, err := net.SplitHostPort(address)
+	return err == nil && port == "0"
+}
+
+// dup returns a listener on the socket of ln.
+func dup(ln net.Listener) (net.Listener, error) {
+	filer, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("can't share a %T", ln)
+	}
+	f, err := filer.File()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// Share makes Listen take over the socket of a listener open in this
+// process on the same address instead of failing, so a second set of
+// servers can start accepting next to the first. Calling done ends that,
+// and if commit is set closes the listeners that were taken over, which
+// moves new connections to the servers that took them over while those
+// already accepted continue.
+func Share() (done func(commit bool), err error) {
+	if runtime.GOOS == "windows" {
+		return nil, errors.New("sharing listeners is not supported on windows")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sharing {
+		return nil, errors.New("listeners are already being shared")
+	}
+	sharing = true
+
+	return func(commit bool) {
+		mu.Lock()
+		old := shared
+		sharing, shared = false, nil
+		if !commit {
+			// The listeners that were taken over stay the ones
+			// handed over on an upgrade
+			for _, ln := range old {
+				listeners[ln.key] = ln
+			}
+		}
+		mu.Unlock()
+
+		if commit {
+			for _, ln := range old {
+				ln.Close()
+			}
+		}
+	}, nil
+}
+
+// systemdEnv are variables systemd sets for the processes of a unit.
+var systemdEnv = []string{"INVOCATION_ID", "NOTIFY_SOCKET"}
+
+// Supported returns why upgrades can't be performed in this process, or
+// nil. Under systemd the new process would be part of the unit of the old
+// one, and be killed with it once it exits.
+func Supported() error {
+	if runtime.GOOS == "windows" {
+		return errors.New("upgrade is not supported on windows")
+	}
+	for _, env := range systemdEnv {
+		if os.Getenv(env) != "" {
+			return errors.New("upgrade is not supported under systemd, which stops the new process with the old one, restart the unit instead")
+		}
+	}
+	return nil
+}
+
+// Upgrade starts the current executable with the same arguments, handing
+// it every open listener, and returns once it reports being ready through
+// Ready. The caller should then Close its listeners, drain and exit.
+func Upgrade(timeout time.Duration) error {
+	if err := Supported(); err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	files := []*os.File{w}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var names []string
+	mu.Lock()
+	for k, ln := range listeners {
+		filer, ok := ln.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		f, err := filer.File()
+		if err != nil {
+			mu.Unlock()
+			return fmt.Errorf("failed to hand over %s: %w", k, err)
+		}
+		files = append(files, f)
+		names = append(names, k)
+	}
+	mu.Unlock()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), envInherit+"="+strings.Join(names, ";"))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Our copy of the write end has to go, or the read below never sees
+	// the new process exiting
+	w.Close()
+	files = files[1:]
+
+	ready := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := r.Read(b[:])
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			_ = cmd.Wait()
+			return fmt.Errorf("new process exited before becoming ready: %s", cmd.ProcessState)
+		}
+	case <-time.After(timeout):
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return errors.New("new process did not become ready in time")
+	}
+
+	return cmd.Process.Release()
+}
+
+// Ready tells the process that started this one through an upgrade that it
+// is serving, and closes listeners that were handed over but not taken
+// over. It does nothing in a process not started by an upgrade.
+func Ready() error {
+	mu.Lock()
+	defer mu.Unlock()
+	parseEnv()
+
+	if !upgraded {
+		return nil
+	}
+	upgraded = false
+
+	for k, f := range inherited {
+		f.Close()
+		delete(inherited, k)
+	}
+
+	f := os.NewFile(readyFD, "upgrade-ready")
+	defer f.Close()
+	_, err := f.Write([]byte{1})
+	return err
+}
+
+// Close closes every open listener, so the process stops accepting while
+// the connections it has continue.
+func Close() {
+	mu.Lock()
+	open := make([]*listener, 0, len(listeners))
+	for _, ln := range listeners {
+		open = append(open, ln)
+	}
+	mu.Unlock()
+
+	for _, ln := range open {
+		ln.Close()
+	}
+}
@@ -0,0 +1,159 @@
+package upgrade
+
+import (
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// envTestAddress is the address the test binary listens on when started by
+// an upgrade in TestUpgrade.
+const envTestAddress = "WARPPLUS_UPGRADE_TEST_ADDRESS"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(envInherit) != "" {
+		upgradedProcess()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// upgradedProcess takes the listener of TestUpgrade over, reports being
+// ready and greets one connection.
+func upgradedProcess() {
+	ln, err := Listen("tcp", os.Getenv(envTestAddress))
+	if err != nil {
+		os.Exit(2)
+	}
+	if err := Ready(); err != nil {
+		os.Exit(3)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		os.Exit(4)
+	}
+	_, _ = conn.Write([]byte("new"))
+	conn.Close()
+	os.Exit(0)
+}
+
+func TestUpgrade(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("upgrade is not supported on windows")
+	}
+	for _, env := range systemdEnv {
+		t.Setenv(env, "")
+	}
+
+	// Listeners are handed over by the address they were opened with
+	const address = "127.0.0.1:0"
+	ln, err := Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	t.Setenv(envTestAddress, address)
+
+	if err := Upgrade(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	Close()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("listener not handed over: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil || string(b) != "new" {
+		t.Fatalf("got %q, %v from the upgraded process, want %q", b, err, "new")
+	}
+}
+
+func TestSupported(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("upgrade is not supported on windows")
+	}
+	for _, env := range systemdEnv {
+		t.Setenv(env, "")
+	}
+	if err := Supported(); err != nil {
+		t.Fatalf("got %v outside systemd", err)
+	}
+
+	for _, env := range systemdEnv {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, "1")
+			if err := Supported(); err == nil {
+				t.Fatal("upgrade supported under systemd")
+			}
+			if err := Upgrade(time.Second); err == nil {
+				t.Fatal("upgraded under systemd")
+			}
+		})
+	}
+}
+
+func TestShare(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sharing listeners is not supported on windows")
+	}
+
+	// Listeners are shared by the address they were opened with, which
+	// can't leave the port to the system
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := free.Addr().String()
+	free.Close()
+
+	ln, err := Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if _, err := Listen("tcp", address); err == nil {
+		t.Fatal("listened twice on an address without sharing")
+	}
+
+	for _, commit := range []bool{false, true} {
+		done, err := Share()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Share(); err == nil {
+			t.Fatal("shared twice at once")
+		}
+		next, err := Listen("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done(commit)
+
+		// Without a commit the servers that tried to take over go down
+		// on their own, and the first ones keep accepting
+		open, closed := next, ln
+		if !commit {
+			open, closed = ln, next
+			next.Close()
+		}
+		if _, err := closed.Accept(); err == nil {
+			t.Fatal("listener left open")
+		}
+		conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted, err := open.Accept()
+		if err != nil {
+			t.Fatalf("commit %v: %v", commit, err)
+		}
+		accepted.Close()
+		conn.Close()
+	}
+}
@@ -1,43 +1,27 @@
 package warp
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
-	"os"
-	"path/filepath"
 )
 
 var identityFile = "wgcf-identity.json"
 
-func saveIdentity(a Identity, path string) error {
-	file, err := os.Create(filepath.Join(path, identityFile))
-	if err != nil {
-		return err
-	}
-
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	err = encoder.Encode(a)
-	if err != nil {
-		return err
-	}
-
-	return file.Close()
-}
-
-func LoadOrCreateIdentity(l *slog.Logger, path, license string) (*Identity, error) {
+// LoadOrCreateIdentity loads the identity stored under name, registering
+// and storing a new one if there is none or it is unusable, and binds it
+// to the warp+ license unless it already is.
+func LoadOrCreateIdentity(l *slog.Logger, store IdentityStore, name, license string) (*Identity, error) {
 	l = l.With("subsystem", "warp/account")
 
-	i, err := LoadIdentity(path)
+	i, err := LoadIdentity(store, name)
 	if err != nil {
-		l.Info("failed to load identity", "path", path, "error", err)
-		if err := os.RemoveAll(path); err != nil {
-			return nil, err
-		}
-
-		if err := os.MkdirAll(path, os.ModePerm); err != nil {
-			return nil, err
+		l.Info("failed to load identity", "identity", name, "error", err)
+		if rmErr := store.Remove(name); errors.Is(rmErr, ErrReadOnlyStore) {
+			// Identities of read only stores are provisioned from outside
+			return nil, fmt.Errorf("failed to load identity %s: %w", name, err)
+		} else if rmErr != nil {
+			return nil, rmErr
 		}
 
 		i, err = CreateIdentity(l, license)
@@ -45,25 +29,18 @@ func LoadOrCreateIdentity(l *slog.Logger, path, license string) (*Identity, erro
 			return nil, err
 		}
 
-		if err = saveIdentity(i, path); err != nil {
+		if err = store.Save(name, i); err != nil {
 			return nil, err
 		}
-	}
-
-	if license != "" && i.Account.License != license {
-		l.Info("updating account license key")
-		_, err := UpdateAccount(i.Token, i.ID, license)
-		if err != nil {
-			return nil, err
-		}
-
-		iAcc, err := GetAccount(i.Token, i.ID)
-		if err != nil {
+	} else if license != "" && i.Account.License != license {
+		if err := tryLicense(l, &i, license); err != nil {
 			return nil, err
 		}
-		i.Account = iAcc
 
-		if err = saveIdentity(i, path); err != nil {
+		// The license is applied again on every start otherwise
+		if err = store.Save(name, i); errors.Is(err, ErrReadOnlyStore) {
+			l.Warn("can't save the identity bound to the license", "identity", name, "error", err)
+		} else if err != nil {
 			return nil, err
 		}
 	}
@@ -72,20 +49,9 @@ func LoadOrCreateIdentity(l *slog.Logger, path, license string) (*Identity, erro
 	return &i, nil
 }
 
-func LoadIdentity(path string) (Identity, error) {
-	identityPath := filepath.Join(path, identityFile)
-	_, err := os.Stat(identityPath)
-	if err != nil {
-		return Identity{}, err
-	}
-
-	fileBytes, err := os.ReadFile(identityPath)
-	if err != nil {
-		return Identity{}, err
-	}
-
-	i := &Identity{}
-	err = json.Unmarshal(fileBytes, i)
+// LoadIdentity loads the identity stored under name.
+func LoadIdentity(store IdentityStore, name string) (Identity, error) {
+	i, err := store.Load(name)
 	if err != nil {
 		return Identity{}, err
 	}
@@ -94,7 +60,7 @@ func LoadIdentity(path string) (Identity, error) {
 		return Identity{}, errors.New("identity contains 0 peers")
 	}
 
-	return *i, nil
+	return i, nil
 }
 
 func CreateIdentity(l *slog.Logger, license string) (Identity, error) {
@@ -112,20 +78,55 @@ func CreateIdentity(l *slog.Logger, license string) (Identity, error) {
 	}
 
 	if license != "" {
-		l.Info("updating account license key")
-		_, err := UpdateAccount(i.Token, i.ID, license)
-		if err != nil {
-			return Identity{}, err
-		}
-
-		ac, err := GetAccount(i.Token, i.ID)
-		if err != nil {
+		if err := tryLicense(l, &i, license); err != nil {
 			return Identity{}, err
 		}
-		i.Account = ac
 	}
 
 	i.PrivateKey = privateKey
 
 	return i, nil
 }
+
+// BindIdentity binds the identity stored under name to the warp+ license,
+// unless it already is.
+func BindIdentity(l *slog.Logger, store IdentityStore, name, license string) error {
+	i, err := LoadIdentity(store, name)
+	if err != nil {
+		return err
+	}
+	if i.Account.License == license {
+		return nil
+	}
+
+	if err := applyLicense(l, &i, license); err != nil {
+		return err
+	}
+	return store.Save(name, i)
+}
+
+func applyLicense(l *slog.Logger, i *Identity, license string) error {
+	l.Info("updating account license key")
+	if _, err := UpdateAccount(i.Token, i.ID, license); err != nil {
+		return err
+	}
+
+	ac, err := GetAccount(i.Token, i.ID)
+	if err != nil {
+		return err
+	}
+	i.Account = ac
+	return nil
+}
+
+// tryLicense is like applyLicense, but keeps the free account when the
+// license is bound to too many devices. Binding is tried again on the next
+// start, once a device has been removed.
+func tryLicense(l *slog.Logger, i *Identity, license string) error {
+	err := applyLicense(l, i, license)
+	if errors.Is(err, ErrTooManyDevices) {
+		l.Warn("license is bound to too many devices, using a free account until one is removed", "limit", MaxDevices)
+		return nil
+	}
+	return err
+}
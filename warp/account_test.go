@@ -0,0 +1,177 @@
+package warp_test
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/warp/warptest"
+)
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func useServer(t *testing.T) *warptest.Server {
+	t.Helper()
+	s := warptest.NewServer()
+	t.Cleanup(s.Close)
+	t.Cleanup(s.Use())
+	return s
+}
+
+func TestLoadOrCreateIdentity(t *testing.T) {
+	s := useServer(t)
+	store := warp.FileStore{Dir: t.TempDir()}
+
+	created, err := warp.LoadOrCreateIdentity(discard, store, "primary", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Token == "" || created.PrivateKey == "" || len(created.Config.Peers) == 0 {
+		t.Fatalf("incomplete identity: %+v", created)
+	}
+	if created.Account.WarpPlus {
+		t.Fatal("free identity has warp+")
+	}
+
+	loaded, err := warp.LoadOrCreateIdentity(discard, store, "primary", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ID != created.ID || loaded.PrivateKey != created.PrivateKey {
+		t.Fatal("identity registered again instead of loaded")
+	}
+
+	license := s.AddLicense()
+	bound, err := warp.LoadOrCreateIdentity(discard, store, "primary", license)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bound.ID != created.ID || bound.Account.License != license || !bound.Account.WarpPlus {
+		t.Fatalf("identity not bound to the license: %+v", bound.Account)
+	}
+	if n := len(s.Devices()); n != 1 {
+		t.Fatalf("registered %d devices, want 1", n)
+	}
+}
+
+func TestTooManyDevices(t *testing.T) {
+	s := useServer(t)
+	license := s.AddLicense()
+	store := warp.FileStore{Dir: t.TempDir()}
+	for i := 0; i < warp.MaxDevices; i++ {
+		if _, err := warp.LoadOrCreateIdentity(discard, store, string(rune('a'+i)), license); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A new identity keeps its free account rather than failing
+	extra, err := warp.LoadOrCreateIdentity(discard, store, "extra", license)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extra.Account.License == license {
+		t.Fatal("identity bound to a license with too many devices")
+	}
+	if err := warp.BindIdentity(discard, store, "extra", license); !errors.Is(err, warp.ErrTooManyDevices) {
+		t.Fatalf("got %v binding to a full license, want ErrTooManyDevices", err)
+	}
+}
+
+func TestBoundDevices(t *testing.T) {
+	s := useServer(t)
+	license := s.AddLicense()
+	store := warp.FileStore{Dir: t.TempDir()}
+	first, err := warp.LoadOrCreateIdentity(discard, store, "first", license)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := warp.LoadOrCreateIdentity(discard, store, "second", license)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := warp.GetBoundDevices(first.Token, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("got %d bound devices, want 2", len(devices))
+	}
+
+	renamed, err := warp.UpdateBoundDevice(first.Token, first.ID, second.ID, "laptop", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed.Name != "laptop" || renamed.Active {
+		t.Fatalf("device not updated: %+v", renamed)
+	}
+
+	if err := warp.RemoveBoundDevice(first.Token, first.ID, second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if devices, err = warp.GetBoundDevices(first.Token, first.ID); err != nil || len(devices) != 1 {
+		t.Fatalf("got %d bound devices after removing one, want 1 (%v)", len(devices), err)
+	}
+
+	reset, err := warp.ResetAccountLicense(first.Token, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reset.License == "" || reset.License == license {
+		t.Fatalf("license not reset: %q", reset.License)
+	}
+}
+
+func TestRevoked(t *testing.T) {
+	s := useServer(t)
+	i, err := warp.LoadOrCreateIdentity(discard, warp.FileStore{Dir: t.TempDir()}, "primary", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := warp.GetAccount(i.Token, i.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Revoke(i.ID)
+	if _, err := warp.GetAccount(i.Token, i.ID); !errors.Is(err, warp.ErrRevoked) {
+		t.Fatalf("got %v for a revoked identity, want ErrRevoked", err)
+	}
+	if _, err := warp.GetSourceDevice(i.Token, i.ID); !errors.Is(err, warp.ErrRevoked) {
+		t.Fatalf("got %v for a revoked identity, want ErrRevoked", err)
+	}
+	if _, err := warp.GetAccount("wrong", i.ID); !errors.Is(err, warp.ErrRevoked) {
+		t.Fatalf("got %v for a wrong token, want ErrRevoked", err)
+	}
+
+	// A blocked network is not a revoked identity
+	s.Fail(http.StatusForbidden, 1)
+	if _, err := warp.GetAccount("wrong", i.ID); err == nil || errors.Is(err, warp.ErrRevoked) {
+		t.Fatalf("got %v for a forbidden request, want another error", err)
+	}
+}
+
+func TestClientProfile(t *testing.T) {
+	s := useServer(t)
+	p := warp.DefaultClientProfile
+	p.APIVersion = "v0i9999"
+	p.UserAgent = "WARP/9999"
+	p.Headers = map[string]string{"X-Test": "1"}
+	warp.SetClientProfile(p)
+	t.Cleanup(func() { warp.SetClientProfile(warp.DefaultClientProfile) })
+
+	if _, err := warp.CreateIdentity(discard, ""); err != nil {
+		t.Fatal(err)
+	}
+	reqs := s.Requests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests, want 1", len(reqs))
+	}
+	r := reqs[0]
+	if !strings.HasPrefix(r.Path, "/"+p.APIVersion+"/") || r.Header.Get("User-Agent") != p.UserAgent || r.Header.Get("X-Test") != "1" {
+		t.Fatalf("request does not follow the client profile: %s %s %v", r.Method, r.Path, r.Header)
+	}
+}
@@ -4,25 +4,67 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
 const (
-	apiBase string = "https://api.cloudflareclient.com/v0a4005"
+	// DefaultAPIHost is the warp api requests go to unless SetAPI is
+	// called
+	DefaultAPIHost = "https://api.cloudflareclient.com"
+	// MaxDevices is how many devices a warp+ license can be bound to
+	MaxDevices = 5
 )
 
-var client = makeClient()
+// ErrTooManyDevices is returned when binding a device to a license that is
+// already bound to MaxDevices devices.
+var ErrTooManyDevices = errors.New("too many devices are bound to the license")
+
+// ErrRevoked is returned when the api refuses the credentials of an
+// identity, as it does once the account is banned or the device deleted.
+var ErrRevoked = errors.New("identity was revoked")
+
+// revoked reports whether resp refuses the credentials of the request. Only
+// 401 does, 403 is also what the edge answers networks it blocks or rate
+// limits with, which says nothing about the identity.
+func revoked(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusUnauthorized
+}
+
+var (
+	apiHost = DefaultAPIHost
+	client  = makeClient()
+)
+
+// SetAPI makes later api requests go to host through c, such as to a mock
+// of the api, or through the default client if c is nil. It must not be
+// called concurrently with them.
+func SetAPI(host string, c *http.Client) {
+	if c == nil {
+		c = makeClient()
+	}
+	apiHost, client = host, c
+}
+
+func apiBase() string {
+	return apiHost + "/" + profile.APIVersion
+}
 
 func defaultHeaders() map[string]string {
-	return map[string]string{
+	headers := map[string]string{
 		"Content-Type":      "application/json; charset=UTF-8",
-		"User-Agent":        "okhttp/3.12.1",
-		"CF-Client-Version": "a-6.30-3596",
+		"User-Agent":        profile.UserAgent,
+		"CF-Client-Version": profile.ClientVersion,
 	}
+	for k, v := range profile.Headers {
+		headers[k] = v
+	}
+	return headers
 }
 
 func makeClient() *http.Client {
@@ -93,6 +135,14 @@ type IdentityConfig struct {
 	ClientID  string                  `json:"client_id"`
 }
 
+// IdentityPolicy is the device policy of an identity enrolled in a Zero
+// Trust account.
+type IdentityPolicy struct {
+	// GatewayUniqueID is the DNS location of the account, reached at
+	// GatewayUniqueID.cloudflare-gateway.com
+	GatewayUniqueID string `json:"gateway_unique_id"`
+}
+
 type Identity struct {
 	PrivateKey      string          `json:"private_key"`
 	Key             string          `json:"key"`
@@ -113,6 +163,7 @@ type Identity struct {
 	Created         string          `json:"created"`
 	Updated         string          `json:"updated"`
 	WaitlistEnabled bool            `json:"waitlist_enabled"`
+	Policy          *IdentityPolicy `json:"policy,omitempty"`
 }
 
 type IdentityDevice struct {
@@ -131,7 +182,7 @@ type License struct {
 }
 
 func GetAccount(authToken, deviceID string) (IdentityAccount, error) {
-	reqUrl := fmt.Sprintf("%s/reg/%s/account", apiBase, deviceID)
+	reqUrl := fmt.Sprintf("%s/reg/%s/account", apiBase(), deviceID)
 	method := "GET"
 
 	req, err := http.NewRequest(method, reqUrl, nil)
@@ -152,6 +203,9 @@ func GetAccount(authToken, deviceID string) (IdentityAccount, error) {
 	}
 	defer resp.Body.Close()
 
+	if revoked(resp) {
+		return IdentityAccount{}, ErrRevoked
+	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		return IdentityAccount{}, fmt.Errorf("API request failed with status: %s", resp.Status)
 	}
@@ -171,7 +225,7 @@ func GetAccount(authToken, deviceID string) (IdentityAccount, error) {
 }
 
 func GetBoundDevices(authToken, deviceID string) ([]IdentityDevice, error) {
-	reqUrl := fmt.Sprintf("%s/reg/%s/account/devices", apiBase, deviceID)
+	reqUrl := fmt.Sprintf("%s/reg/%s/account/devices", apiBase(), deviceID)
 	method := "GET"
 
 	req, err := http.NewRequest(method, reqUrl, nil)
@@ -211,7 +265,7 @@ func GetBoundDevices(authToken, deviceID string) ([]IdentityDevice, error) {
 }
 
 func GetSourceDevice(authToken, deviceID string) (Identity, error) {
-	reqUrl := fmt.Sprintf("%s/reg/%s", apiBase, deviceID)
+	reqUrl := fmt.Sprintf("%s/reg/%s", apiBase(), deviceID)
 	method := "GET"
 
 	req, err := http.NewRequest(method, reqUrl, nil)
@@ -232,6 +286,9 @@ func GetSourceDevice(authToken, deviceID string) (Identity, error) {
 	}
 	defer resp.Body.Close()
 
+	if revoked(resp) {
+		return Identity{}, ErrRevoked
+	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		return Identity{}, fmt.Errorf("API request failed with status: %s", resp.Status)
 	}
@@ -251,7 +308,7 @@ func GetSourceDevice(authToken, deviceID string) (Identity, error) {
 }
 
 func Register(publicKey string) (Identity, error) {
-	reqUrl := fmt.Sprintf("%s/reg", apiBase)
+	reqUrl := fmt.Sprintf("%s/reg", apiBase())
 	method := "POST"
 
 	data := map[string]interface{}{
@@ -259,9 +316,9 @@ func Register(publicKey string) (Identity, error) {
 		"fcm_token":    "",
 		"tos":          time.Now().Format(time.RFC3339Nano),
 		"key":          publicKey,
-		"type":         "Android",
-		"model":        "PC",
-		"locale":       "en_US",
+		"type":         profile.DeviceType,
+		"model":        profile.DeviceModel,
+		"locale":       profile.Locale,
 		"warp_enabled": true,
 	}
 
@@ -306,7 +363,7 @@ func Register(publicKey string) (Identity, error) {
 }
 
 func ResetAccountLicense(authToken, deviceID string) (License, error) {
-	reqUrl := fmt.Sprintf("%s/reg/%s/account/license", apiBase, deviceID)
+	reqUrl := fmt.Sprintf("%s/reg/%s/account/license", apiBase(), deviceID)
 	method := "POST"
 
 	req, err := http.NewRequest(method, reqUrl, nil)
@@ -346,7 +403,7 @@ func ResetAccountLicense(authToken, deviceID string) (License, error) {
 }
 
 func UpdateAccount(authToken, deviceID, license string) (IdentityAccount, error) {
-	reqUrl := fmt.Sprintf("%s/reg/%s/account", apiBase, deviceID)
+	reqUrl := fmt.Sprintf("%s/reg/%s/account", apiBase(), deviceID)
 	method := "PUT"
 
 	jsonBody, err := json.Marshal(map[string]interface{}{"license": license})
@@ -372,16 +429,19 @@ func UpdateAccount(authToken, deviceID, license string) (IdentityAccount, error)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return IdentityAccount{}, fmt.Errorf("API request failed with status: %s", resp.Status)
-	}
-
 	// convert response to byte array
 	responseData, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return IdentityAccount{}, err
 	}
 
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		if strings.Contains(strings.ToLower(string(responseData)), "too many") {
+			return IdentityAccount{}, ErrTooManyDevices
+		}
+		return IdentityAccount{}, fmt.Errorf("API request failed with status: %s", resp.Status)
+	}
+
 	var rspData = IdentityAccount{}
 	if err := json.Unmarshal(responseData, &rspData); err != nil {
 		return IdentityAccount{}, err
@@ -391,7 +451,7 @@ func UpdateAccount(authToken, deviceID, license string) (IdentityAccount, error)
 }
 
 func UpdateBoundDevice(authToken, deviceID, otherDeviceID, name string, active bool) (IdentityDevice, error) {
-	reqUrl := fmt.Sprintf("%s/reg/%s/account/reg/%s", apiBase, deviceID, otherDeviceID)
+	reqUrl := fmt.Sprintf("%s/reg/%s/account/reg/%s", apiBase(), deviceID, otherDeviceID)
 	method := "PATCH"
 
 	data := map[string]interface{}{
@@ -440,8 +500,37 @@ func UpdateBoundDevice(authToken, deviceID, otherDeviceID, name string, active b
 	return rspData, nil
 }
 
+func RemoveBoundDevice(authToken, deviceID, otherDeviceID string) error {
+	reqUrl := fmt.Sprintf("%s/reg/%s/account/reg/%s", apiBase(), deviceID, otherDeviceID)
+	method := "DELETE"
+
+	req, err := http.NewRequest(method, reqUrl, nil)
+	if err != nil {
+		return err
+	}
+
+	// Set headers
+	for k, v := range defaultHeaders() {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Authorization", "Bearer "+authToken)
+
+	// Create HTTP client and execute request
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("API request failed with status: %s", resp.Status)
+	}
+
+	return nil
+}
+
 func UpdateSourceDevice(authToken, deviceID, publicKey string) (Identity, error) {
-	reqUrl := fmt.Sprintf("%s/reg/%s", apiBase, deviceID)
+	reqUrl := fmt.Sprintf("%s/reg/%s", apiBase(), deviceID)
 	method := "PATCH"
 
 	jsonBody, err := json.Marshal(map[string]interface{}{"key": publicKey})
@@ -486,7 +575,7 @@ func UpdateSourceDevice(authToken, deviceID, publicKey string) (Identity, error)
 }
 
 func DeleteDevice(authToken, deviceID string) error {
-	reqUrl := fmt.Sprintf("%s/reg/%s", apiBase, deviceID)
+	reqUrl := fmt.Sprintf("%s/reg/%s", apiBase(), deviceID)
 	method := "DELETE"
 
 	req, err := http.NewRequest(method, reqUrl, nil)
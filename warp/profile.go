@@ -0,0 +1,39 @@
+package warp
+
+// ClientProfile is how the client identifies itself to the warp api. The
+// api rejects or throttles registrations from client versions it considers
+// outdated, so these can be updated to mimic a current official client
+// without a new release.
+type ClientProfile struct {
+	// APIVersion is the api path prefix, which tracks the client build
+	APIVersion string
+	// UserAgent is sent in the User-Agent header
+	UserAgent string
+	// ClientVersion is sent in the CF-Client-Version header
+	ClientVersion string
+	// DeviceType, DeviceModel and Locale describe the device at
+	// registration
+	DeviceType  string
+	DeviceModel string
+	Locale      string
+	// Headers are sent with every request, overriding the ones above
+	Headers map[string]string
+}
+
+// DefaultClientProfile mimics the official Android client.
+var DefaultClientProfile = ClientProfile{
+	APIVersion:    "v0a4005",
+	UserAgent:     "okhttp/3.12.1",
+	ClientVersion: "a-6.30-3596",
+	DeviceType:    "Android",
+	DeviceModel:   "PC",
+	Locale:        "en_US",
+}
+
+var profile = DefaultClientProfile
+
+// SetClientProfile changes how later api requests identify the client. It
+// must not be called concurrently with them.
+func SetClientProfile(p ClientProfile) {
+	profile = p
+}
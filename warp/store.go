@@ -0,0 +1,282 @@
+package warp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// IdentityStore keeps identities under names such as primary.
+type IdentityStore interface {
+	// Load returns the identity stored under name, or an error wrapping
+	// os.ErrNotExist if there is none
+	Load(name string) (Identity, error)
+	Save(name string, i Identity) error
+	Remove(name string) error
+}
+
+// ErrReadOnlyStore is returned when saving to or removing from a store
+// whose identities are provisioned from outside.
+var ErrReadOnlyStore = errors.New("identity store is read only")
+
+// DefaultIdentityEnvPrefix is the prefix of the variables an EnvStore reads
+// unless given another.
+const DefaultIdentityEnvPrefix = "WARP_PLUS_IDENTITY"
+
+// OpenIdentityStore returns the store spec describes:
+//
+//	file[:DIR]        a directory per identity in DIR, dir unless given
+//	env[:PREFIX]      PREFIX_PRIMARY and so on, see EnvStore
+//	vault:MOUNT/PATH  a kv version 2 engine of the vault at VAULT_ADDR, see VaultStore
+//	k8s:DIR           a kubernetes secret mounted at DIR, see SecretStore
+func OpenIdentityStore(spec, dir string) (IdentityStore, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "file":
+		if arg == "" {
+			arg = dir
+		}
+		return FileStore{Dir: arg}, nil
+	case "env":
+		if arg == "" {
+			arg = DefaultIdentityEnvPrefix
+		}
+		return EnvStore{Prefix: arg}, nil
+	case "vault":
+		mount, p, ok := strings.Cut(strings.Trim(arg, "/"), "/")
+		if !ok || mount == "" || p == "" {
+			return nil, fmt.Errorf("invalid vault identity store %q: want vault:MOUNT/PATH", spec)
+		}
+		addr := os.Getenv("VAULT_ADDR")
+		if addr == "" {
+			return nil, errors.New("vault identity store requires VAULT_ADDR")
+		}
+		return &VaultStore{Addr: addr, Token: os.Getenv("VAULT_TOKEN"), Mount: mount, Path: p}, nil
+	case "k8s":
+		if arg == "" {
+			return nil, fmt.Errorf("invalid kubernetes identity store %q: want k8s:DIR", spec)
+		}
+		return SecretStore{Dir: arg}, nil
+	default:
+		return nil, fmt.Errorf("unknown identity store %q", kind)
+	}
+}
+
+// MoveIdentity moves the identity stored under from to to, replacing any
+// stored there.
+func MoveIdentity(store IdentityStore, from, to string) error {
+	i, err := store.Load(from)
+	if err != nil {
+		return err
+	}
+	if err := store.Save(to, i); err != nil {
+		return err
+	}
+	return store.Remove(from)
+}
+
+// decodeIdentity decodes an identity from json, or from base64 encoded
+// json, which survives being passed around in environments and secrets.
+func decodeIdentity(b []byte) (Identity, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] != '{' {
+		decoded, err := base64.StdEncoding.DecodeString(string(b))
+		if err != nil {
+			return Identity{}, errors.New("identity is neither json nor base64")
+		}
+		b = decoded
+	}
+	var i Identity
+	if err := json.Unmarshal(b, &i); err != nil {
+		return Identity{}, err
+	}
+	return i, nil
+}
+
+// FileStore keeps every identity in a directory of Dir named after it, in
+// the layout of wgcf.
+type FileStore struct {
+	Dir string
+}
+
+func (s FileStore) Load(name string) (Identity, error) {
+	b, err := os.ReadFile(filepath.Join(s.Dir, name, identityFile))
+	if err != nil {
+		return Identity{}, err
+	}
+	return decodeIdentity(b)
+}
+
+func (s FileStore) Save(name string, i Identity) error {
+	dir := filepath.Join(s.Dir, name)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.Create(filepath.Join(dir, identityFile))
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(i); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (s FileStore) Remove(name string) error {
+	return os.RemoveAll(filepath.Join(s.Dir, name))
+}
+
+// EnvStore reads identities injected into the environment, as json or
+// base64 encoded json, from variables named Prefix_NAME, such as
+// WARP_PLUS_IDENTITY_PRIMARY. It is read only.
+type EnvStore struct {
+	Prefix string
+}
+
+func (s EnvStore) Load(name string) (Identity, error) {
+	key := s.Prefix + "_" + strings.ToUpper(name)
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return Identity{}, fmt.Errorf("%s is not set: %w", key, os.ErrNotExist)
+	}
+	i, err := decodeIdentity([]byte(v))
+	if err != nil {
+		return Identity{}, fmt.Errorf("%s: %w", key, err)
+	}
+	return i, nil
+}
+
+func (EnvStore) Save(string, Identity) error { return ErrReadOnlyStore }
+func (EnvStore) Remove(string) error         { return ErrReadOnlyStore }
+
+// SecretStore reads identities from a kubernetes secret mounted at Dir,
+// whose keys are named after the identities and hold json or base64
+// encoded json. It is read only, as mounted secrets are.
+type SecretStore struct {
+	Dir string
+}
+
+func (s SecretStore) Load(name string) (Identity, error) {
+	b, err := os.ReadFile(filepath.Join(s.Dir, name))
+	if err != nil {
+		return Identity{}, err
+	}
+	return decodeIdentity(b)
+}
+
+func (SecretStore) Save(string, Identity) error { return ErrReadOnlyStore }
+func (SecretStore) Remove(string) error         { return ErrReadOnlyStore }
+
+// VaultStore keeps identities in a kv version 2 secrets engine of a
+// HashiCorp Vault at Addr, mounted at Mount, as secrets under Path named
+// after them.
+type VaultStore struct {
+	Addr  string
+	Token string
+	Mount string
+	Path  string
+	// Client makes the requests, a client with a timeout if nil
+	Client *http.Client
+}
+
+// vaultSecret is the body of kv version 2 reads and writes.
+type vaultSecret struct {
+	Data struct {
+		Identity *Identity `json:"identity"`
+	} `json:"data"`
+}
+
+func (s *VaultStore) url(kind, name string) string {
+	return strings.TrimSuffix(s.Addr, "/") + "/v1/" + url.PathEscape(s.Mount) + "/" + kind + "/" + strings.Trim(s.Path, "/") + "/" + url.PathEscape(name)
+}
+
+func (s *VaultStore) do(method, u string, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", s.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	c := s.Client
+	if c == nil {
+		c = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("vault secret %s: %w", u, os.ErrNotExist)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("vault request failed with status: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+func (s *VaultStore) Load(name string) (Identity, error) {
+	resp, err := s.do(http.MethodGet, s.url("data", name), nil)
+	if err != nil {
+		return Identity{}, err
+	}
+	defer resp.Body.Close()
+
+	var secret struct {
+		Data vaultSecret `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return Identity{}, err
+	}
+	if secret.Data.Data.Identity == nil {
+		return Identity{}, fmt.Errorf("vault secret %s holds no identity: %w", name, os.ErrNotExist)
+	}
+	return *secret.Data.Data.Identity, nil
+}
+
+func (s *VaultStore) Save(name string, i Identity) error {
+	var secret vaultSecret
+	secret.Data.Identity = &i
+	resp, err := s.do(http.MethodPost, s.url("data", name), secret)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Remove deletes every version of the secret of the identity.
+func (s *VaultStore) Remove(name string) error {
+	resp, err := s.do(http.MethodDelete, s.url("metadata", name), nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
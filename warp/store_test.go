@@ -0,0 +1,117 @@
+package warp_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/warp"
+)
+
+func TestReadOnlyStores(t *testing.T) {
+	useServer(t)
+	i, err := warp.LoadOrCreateIdentity(discard, warp.FileStore{Dir: t.TempDir()}, "primary", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("TEST_IDENTITY_PRIMARY", base64.StdEncoding.EncodeToString(b))
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "primary"), b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, store := range []warp.IdentityStore{warp.EnvStore{Prefix: "TEST_IDENTITY"}, warp.SecretStore{Dir: dir}} {
+		loaded, err := warp.LoadOrCreateIdentity(discard, store, "primary", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.ID != i.ID || loaded.PrivateKey != i.PrivateKey {
+			t.Fatalf("%T loaded another identity", store)
+		}
+
+		// Identities missing from a read only store are not registered
+		if _, err := warp.LoadOrCreateIdentity(discard, store, "other", ""); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%T: got %v loading a missing identity, want ErrNotExist", store, err)
+		}
+		if err := store.Save("other", *i); !errors.Is(err, warp.ErrReadOnlyStore) {
+			t.Fatalf("%T: got %v saving, want ErrReadOnlyStore", store, err)
+		}
+	}
+}
+
+func TestVaultStore(t *testing.T) {
+	useServer(t)
+
+	var mu sync.Mutex
+	secrets := make(map[string][]byte)
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+
+		name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		switch {
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/secret/data/warp/"):
+			b, ok := secrets[name]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{"data":`))
+			w.Write(b)
+			w.Write([]byte(`}`))
+		case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/v1/secret/data/warp/"):
+			b, _ := io.ReadAll(r.Body)
+			secrets[name] = b
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/warp/"):
+			delete(secrets, name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer vault.Close()
+
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "token")
+	store, err := warp.OpenIdentityStore("vault:secret/warp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := warp.LoadOrCreateIdentity(discard, store, "primary", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := store.Load("primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ID != created.ID || loaded.PrivateKey != created.PrivateKey {
+		t.Fatal("vault returned another identity")
+	}
+
+	if err := store.Remove("primary"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load("primary"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("got %v loading a removed identity, want ErrNotExist", err)
+	}
+}
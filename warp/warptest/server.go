@@ -0,0 +1,416 @@
+// Package warptest mocks the parts of the warp api the client uses, the
+// registration of devices and the accounts and licenses they are bound to,
+// so that changes to the control plane can be developed and tested offline.
+package warptest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+)
+
+// PremiumData is the warp+ data of the accounts of the mock, in bytes.
+const PremiumData = 10 << 30
+
+// Request is a request the mock received.
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+}
+
+// Server is a mock of the warp api. Its state is kept in memory, starting
+// out empty.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	devices  map[string]*device
+	accounts map[string]*account // by license
+	peer     warp.IdentityConfigPeer
+	requests []Request
+	// failures answers the next requests with failStatus
+	failures   int
+	failStatus int
+}
+
+type device struct {
+	id, token, key string
+	name           string
+	active         bool
+	revoked        bool
+	created        time.Time
+	account        *account
+}
+
+type account struct {
+	id, license string
+	warpPlus    bool
+	created     time.Time
+}
+
+// NewServer starts a mock of the warp api. It is closed when the returned
+// server is.
+func NewServer() *Server {
+	s := &Server{
+		devices:  make(map[string]*device),
+		accounts: make(map[string]*account),
+	}
+	key, err := warp.GeneratePrivateKey()
+	if err != nil {
+		panic(fmt.Sprintf("warptest: failed to generate a key: %v", err))
+	}
+	s.peer = warp.IdentityConfigPeer{
+		PublicKey: key.PublicKey().String(),
+		Endpoint: warp.IdentityConfigPeerEndpoint{
+			V4:    "162.159.192.1:0",
+			V6:    "[2606:4700:d0::a29f:c001]:0",
+			Host:  "engage.cloudflareclient.com:2408",
+			Ports: []uint16{2408, 500, 1701, 4500},
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /{version}/reg", s.register)
+	mux.HandleFunc("GET /{version}/reg/{id}", s.auth(s.getDevice))
+	mux.HandleFunc("PATCH /{version}/reg/{id}", s.auth(s.updateDevice))
+	mux.HandleFunc("DELETE /{version}/reg/{id}", s.auth(s.deleteDevice))
+	mux.HandleFunc("GET /{version}/reg/{id}/account", s.auth(s.getAccount))
+	mux.HandleFunc("PUT /{version}/reg/{id}/account", s.auth(s.updateAccount))
+	mux.HandleFunc("GET /{version}/reg/{id}/account/devices", s.auth(s.getBoundDevices))
+	mux.HandleFunc("POST /{version}/reg/{id}/account/license", s.auth(s.resetLicense))
+	mux.HandleFunc("PATCH /{version}/reg/{id}/account/reg/{other}", s.auth(s.updateBoundDevice))
+	mux.HandleFunc("DELETE /{version}/reg/{id}/account/reg/{other}", s.auth(s.removeBoundDevice))
+
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone()})
+		fail := s.failures > 0
+		if fail {
+			s.failures--
+		}
+		status := s.failStatus
+		s.mu.Unlock()
+		if fail {
+			writeError(w, status, http.StatusText(status))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	return s
+}
+
+// Use points the warp api requests of the process at the mock until
+// restore is called.
+func (s *Server) Use() (restore func()) {
+	warp.SetAPI(s.URL, s.Client())
+	return func() { warp.SetAPI(warp.DefaultAPIHost, nil) }
+}
+
+// Requests returns the requests received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Devices returns the ids of the registered devices.
+func (s *Server) Devices() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.devices))
+	for id := range s.devices {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// AddLicense creates a warp+ account and returns its license, for devices
+// to be bound to.
+func (s *Server) AddLicense() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.newAccount()
+	a.warpPlus = true
+	return a.license
+}
+
+// Revoke makes the api refuse the credentials of the device, as when its
+// account is banned.
+func (s *Server) Revoke(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.devices[id]; ok {
+		d.revoked = true
+	}
+}
+
+// Fail answers the next n requests with status, as the api does while it
+// is degraded or blocks the network they come from.
+func (s *Server) Fail(status, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failStatus, s.failures = status, n
+}
+
+// newAccount creates an account with a fresh license. s.mu must be held.
+func (s *Server) newAccount() *account {
+	license := fmt.Sprintf("%s-%s-%s", randomHex(4), randomHex(4), randomHex(4))
+	a := &account{id: randomHex(16), license: license, created: time.Now()}
+	s.accounts[license] = a
+	return a
+}
+
+// boundDevices returns the active devices bound to a. s.mu must be held.
+func (s *Server) boundDevices(a *account) []*device {
+	var ds []*device
+	for _, d := range s.devices {
+		if d.account == a && d.active {
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
+
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Key == "" {
+		writeError(w, http.StatusBadRequest, "Invalid public key.")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := &device{
+		id:      "t." + randomHex(16),
+		token:   randomHex(32),
+		key:     req.Key,
+		active:  true,
+		created: time.Now(),
+		account: s.newAccount(),
+	}
+	s.devices[d.id] = d
+	writeJSON(w, http.StatusOK, s.identity(d, true))
+}
+
+// auth checks the bearer token of the device in the path before passing
+// it on to h.
+func (s *Server) auth(h func(http.ResponseWriter, *http.Request, *device)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		d, ok := s.devices[r.PathValue("id")]
+		if !ok || r.Header.Get("Authorization") != "Bearer "+d.token {
+			writeError(w, http.StatusUnauthorized, "Unauthorized.")
+			return
+		}
+		if d.revoked {
+			writeError(w, http.StatusUnauthorized, "Unauthorized.")
+			return
+		}
+		h(w, r, d)
+	}
+}
+
+func (s *Server) getDevice(w http.ResponseWriter, _ *http.Request, d *device) {
+	writeJSON(w, http.StatusOK, s.identity(d, false))
+}
+
+func (s *Server) updateDevice(w http.ResponseWriter, r *http.Request, d *device) {
+	var req struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request.")
+		return
+	}
+	if req.Key != "" {
+		d.key = req.Key
+	}
+	writeJSON(w, http.StatusOK, s.identity(d, false))
+}
+
+func (s *Server) deleteDevice(w http.ResponseWriter, _ *http.Request, d *device) {
+	delete(s.devices, d.id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getAccount(w http.ResponseWriter, _ *http.Request, d *device) {
+	writeJSON(w, http.StatusOK, s.account(d.account))
+}
+
+func (s *Server) updateAccount(w http.ResponseWriter, r *http.Request, d *device) {
+	var req struct {
+		License string `json:"license"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request.")
+		return
+	}
+	a, ok := s.accounts[req.License]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Invalid license.")
+		return
+	}
+	if a != d.account {
+		if len(s.boundDevices(a)) >= warp.MaxDevices {
+			writeError(w, http.StatusForbidden, "Too many connected devices.")
+			return
+		}
+		d.account = a
+	}
+	writeJSON(w, http.StatusOK, s.account(a))
+}
+
+func (s *Server) getBoundDevices(w http.ResponseWriter, _ *http.Request, d *device) {
+	devices := []warp.IdentityDevice{}
+	for _, other := range s.devices {
+		if other.account == d.account {
+			devices = append(devices, boundDevice(other, d))
+		}
+	}
+	writeJSON(w, http.StatusOK, devices)
+}
+
+func (s *Server) resetLicense(w http.ResponseWriter, _ *http.Request, d *device) {
+	a := d.account
+	delete(s.accounts, a.license)
+	a.license = fmt.Sprintf("%s-%s-%s", randomHex(4), randomHex(4), randomHex(4))
+	s.accounts[a.license] = a
+	writeJSON(w, http.StatusOK, warp.License{License: a.license})
+}
+
+func (s *Server) updateBoundDevice(w http.ResponseWriter, r *http.Request, d *device) {
+	other, ok := s.devices[r.PathValue("other")]
+	if !ok || other.account != d.account {
+		writeError(w, http.StatusNotFound, "Device not found.")
+		return
+	}
+	var req struct {
+		Active *bool   `json:"active"`
+		Name   *string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request.")
+		return
+	}
+	if req.Active != nil {
+		other.active = *req.Active
+	}
+	if req.Name != nil {
+		other.name = *req.Name
+	}
+	writeJSON(w, http.StatusOK, boundDevice(other, d))
+}
+
+func (s *Server) removeBoundDevice(w http.ResponseWriter, r *http.Request, d *device) {
+	other, ok := s.devices[r.PathValue("other")]
+	if !ok || other.account != d.account {
+		writeError(w, http.StatusNotFound, "Device not found.")
+		return
+	}
+	delete(s.devices, other.id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// identity returns d as the api describes a registered device, with its
+// token only on registration. s.mu must be held.
+func (s *Server) identity(d *device, withToken bool) warp.Identity {
+	i := warp.Identity{
+		ID:          d.id,
+		Key:         d.key,
+		Type:        "Android",
+		Model:       "PC",
+		Name:        d.name,
+		Locale:      "en_US",
+		Enabled:     d.active,
+		WarpEnabled: true,
+		Account:     s.account(d.account),
+		Config: warp.IdentityConfig{
+			ClientID: "AAAA",
+			Peers:    []warp.IdentityConfigPeer{s.peer},
+			Interface: warp.IdentityConfigInterface{
+				Addresses: warp.IdentityConfigInterfaceAddresses{
+					V4: "172.16.0.2",
+					V6: "2606:4700:110:8f81:d551:a0:532e:a2b3",
+				},
+			},
+		},
+		Created: d.created.Format(time.RFC3339Nano),
+		Updated: d.created.Format(time.RFC3339Nano),
+	}
+	if withToken {
+		i.Token = d.token
+	}
+	return i
+}
+
+// account returns a as the api describes it. s.mu must be held.
+func (s *Server) account(a *account) warp.IdentityAccount {
+	ia := warp.IdentityAccount{
+		ID:          a.id,
+		License:     a.license,
+		AccountType: "free",
+		Role:        "child",
+		Created:     a.created.Format(time.RFC3339Nano),
+		Updated:     a.created.Format(time.RFC3339Nano),
+	}
+	if a.warpPlus {
+		ia.AccountType = "limited"
+		ia.WarpPlus = true
+		ia.PremiumData = PremiumData
+		ia.Quota = PremiumData
+	}
+	return ia
+}
+
+// boundDevice returns d as listed among the devices of its account to
+// self.
+func boundDevice(d, self *device) warp.IdentityDevice {
+	role := "child"
+	if d == self {
+		role = "parent"
+	}
+	return warp.IdentityDevice{
+		ID:        d.id,
+		Name:      d.name,
+		Type:      "Android",
+		Model:     "PC",
+		Created:   d.created.Format(time.RFC3339Nano),
+		Activated: d.created.Format(time.RFC3339Nano),
+		Active:    d.active,
+		Role:      role,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error in the envelope the api uses.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]any{
+		"result":  nil,
+		"success": false,
+		"errors":  []map[string]any{{"code": status, "message": message}},
+	})
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("warptest: failed to read random bytes: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
@@ -324,8 +324,8 @@ func (bind *WinRingBind) Close() error {
 // TODO: When all Binds handle IdealBatchSize, remove this dynamic function and
 // rename the IdealBatchSize constant to BatchSize.
 func (bind *WinRingBind) BatchSize() int {
-	// TODO: implement batching in and out of the ring
-	return 1
+	// Receives are batched; sends still go out of the ring one at a time.
+	return IdealBatchSize
 }
 
 func (bind *WinRingBind) SetMark(mark uint32) error {
@@ -352,86 +352,107 @@ func (bind *afWinRingBind) InsertReceiveRequest() error {
 //go:linkname procyield runtime.procyield
 func procyield(cycles uint32)
 
-func (bind *afWinRingBind) Receive(buf []byte, isOpen *atomic.Uint32) (int, Endpoint, error) {
+// Receive dequeues up to len(bufs) completed receives at once, so a busy
+// socket is drained with a single completion queue call instead of one call
+// per packet.
+func (bind *afWinRingBind) Receive(bufs [][]byte, sizes []int, eps []Endpoint, isOpen *atomic.Uint32) (int, error) {
 	if isOpen.Load() != 1 {
-		return 0, nil, net.ErrClosed
+		return 0, net.ErrClosed
 	}
 	bind.rx.mu.Lock()
 	defer bind.rx.mu.Unlock()
 
 	var err error
 	var count uint32
-	var results [1]winrio.Result
+	var results [IdealBatchSize]winrio.Result
+	batch := results[:min(len(bufs), len(results))]
 retry:
 	count = 0
 	for tries := 0; count == 0 && tries < receiveSpins; tries++ {
 		if tries > 0 {
 			if isOpen.Load() != 1 {
-				return 0, nil, net.ErrClosed
+				return 0, net.ErrClosed
 			}
 			procyield(1)
 		}
-		count = winrio.DequeueCompletion(bind.rx.cq, results[:])
+		count = winrio.DequeueCompletion(bind.rx.cq, batch)
 	}
 	if count == 0 {
 		err = winrio.Notify(bind.rx.cq)
 		if err != nil {
-			return 0, nil, err
+			return 0, err
 		}
 		var bytes uint32
 		var key uintptr
 		var overlapped *windows.Overlapped
 		err = windows.GetQueuedCompletionStatus(bind.rx.iocp, &bytes, &key, &overlapped, windows.INFINITE)
 		if err != nil {
-			return 0, nil, err
+			return 0, err
 		}
 		if isOpen.Load() != 1 {
-			return 0, nil, net.ErrClosed
+			return 0, net.ErrClosed
 		}
-		count = winrio.DequeueCompletion(bind.rx.cq, results[:])
+		count = winrio.DequeueCompletion(bind.rx.cq, batch)
 		if count == 0 {
-			return 0, nil, io.ErrNoProgress
+			return 0, io.ErrNoProgress
 		}
 	}
-	bind.rx.Return(1)
-	err = bind.InsertReceiveRequest()
-	if err != nil {
-		return 0, nil, err
+
+	// Copy the packets out before their ring slots are reposted.
+	var firstErr error
+	received := 0
+	for i, result := range batch[:count] {
+		sizes[i] = 0
+		eps[i] = nil
+		// We limit the MTU well below the 65k max for practicality, but this means a remote host can still send us
+		// huge packets. Just skip them, callers ignore zero sized entries.
+		if windows.Errno(result.Status) == windows.WSAEMSGSIZE {
+			continue
+		}
+		if result.Status != 0 {
+			if firstErr == nil {
+				firstErr = windows.Errno(result.Status)
+			}
+			continue
+		}
+		packet := (*ringPacket)(unsafe.Pointer(uintptr(result.RequestContext)))
+		ep := packet.addr
+		sizes[i] = copy(bufs[i], packet.data[:result.BytesTransferred])
+		eps[i] = &ep
+		received++
+	}
+
+	bind.rx.Return(count)
+	for i := uint32(0); i < count; i++ {
+		err = bind.InsertReceiveRequest()
+		if err != nil {
+			return 0, err
+		}
 	}
-	// We limit the MTU well below the 65k max for practicality, but this means a remote host can still send us
-	// huge packets. Just try again when this happens. The infinite loop this could cause is still limited to
-	// attacker bandwidth, just like the rest of the receive path.
-	if windows.Errno(results[0].Status) == windows.WSAEMSGSIZE {
+
+	if received == 0 {
+		if firstErr != nil {
+			return 0, firstErr
+		}
+		// The attacker bandwidth limited loop from oversized packets.
 		if isOpen.Load() != 1 {
-			return 0, nil, net.ErrClosed
+			return 0, net.ErrClosed
 		}
 		goto retry
 	}
-	if results[0].Status != 0 {
-		return 0, nil, windows.Errno(results[0].Status)
-	}
-	packet := (*ringPacket)(unsafe.Pointer(uintptr(results[0].RequestContext)))
-	ep := packet.addr
-	n := copy(buf, packet.data[:results[0].BytesTransferred])
-	return n, &ep, nil
+	return int(count), nil
 }
 
 func (bind *WinRingBind) receiveIPv4(bufs [][]byte, sizes []int, eps []Endpoint) (int, error) {
 	bind.mu.RLock()
 	defer bind.mu.RUnlock()
-	n, ep, err := bind.v4.Receive(bufs[0], &bind.isOpen)
-	sizes[0] = n
-	eps[0] = ep
-	return 1, err
+	return bind.v4.Receive(bufs, sizes, eps, &bind.isOpen)
 }
 
 func (bind *WinRingBind) receiveIPv6(bufs [][]byte, sizes []int, eps []Endpoint) (int, error) {
 	bind.mu.RLock()
 	defer bind.mu.RUnlock()
-	n, ep, err := bind.v6.Receive(bufs[0], &bind.isOpen)
-	sizes[0] = n
-	eps[0] = ep
-	return 1, err
+	return bind.v6.Receive(bufs, sizes, eps, &bind.isOpen)
 }
 
 func (bind *afWinRingBind) Send(buf []byte, nend *WinRingEndpoint, isOpen *atomic.Uint32) error {
@@ -11,6 +11,7 @@ import (
 	"net"
 	"net/netip"
 	"os"
+	"sync/atomic"
 
 	"github.com/bepass-org/warp-plus/wireguard/conn"
 )
@@ -21,6 +22,7 @@ type ChannelBind struct {
 	closeSignal      chan bool
 	source4, source6 ChannelEndpoint
 	target4, target6 ChannelEndpoint
+	filter           atomic.Pointer[func([]byte) bool]
 }
 
 type ChannelEndpoint uint16
@@ -55,6 +57,17 @@ func NewChannelBinds() [2]conn.Bind {
 	return [2]conn.Bind{&binds[0], &binds[1]}
 }
 
+// SetFilter makes the bind pass every datagram it sends to filter first,
+// dropping the ones filter returns false for. Tests use it to watch the
+// packets of a device, or to lose them. A nil filter sends everything.
+func (c *ChannelBind) SetFilter(filter func(b []byte) bool) {
+	if filter == nil {
+		c.filter.Store(nil)
+		return
+	}
+	c.filter.Store(&filter)
+}
+
 func (c ChannelEndpoint) ClearSrc() {}
 
 func (c ChannelEndpoint) SrcToString() string { return "" }
@@ -113,6 +126,9 @@ func (c *ChannelBind) Send(bufs [][]byte, ep conn.Endpoint) error {
 		case <-c.closeSignal:
 			return net.ErrClosed
 		default:
+			if filter := c.filter.Load(); filter != nil && !(*filter)(b) {
+				continue
+			}
 			bc := make([]byte, len(b))
 			copy(bc, b)
 			if ep.(ChannelEndpoint) == c.target4 {
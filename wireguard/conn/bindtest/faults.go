@@ -0,0 +1,115 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package bindtest
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/conn"
+)
+
+// Faults are the impairments a FaultBind puts on the datagrams it sends.
+// Probabilities are between 0 and 1, the zero Faults sends everything
+// untouched.
+type Faults struct {
+	// Loss is the probability a datagram is dropped
+	Loss float64
+	// Duplicate is the probability a datagram is sent twice
+	Duplicate float64
+	// Reorder is the probability a datagram is held back for ReorderDelay
+	// on top of its latency, so the ones sent after it overtake it
+	Reorder      float64
+	ReorderDelay time.Duration
+	// Latency delays every datagram, and Jitter up to that much more
+	Latency time.Duration
+	Jitter  time.Duration
+}
+
+// FaultBind is a conn.Bind that loses, duplicates, reorders and delays
+// the datagrams sent through the bind it wraps, as set with SetFaults.
+// Wrapping both binds of a pair impairs both directions.
+type FaultBind struct {
+	conn.Bind
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	faults  Faults
+	wg      sync.WaitGroup
+	dropped atomic.Int64
+}
+
+var _ conn.Bind = (*FaultBind)(nil)
+
+// NewFaultBind wraps bind. The faults are drawn from a source seeded with
+// seed, so a test sending the same datagrams sees the same faults.
+func NewFaultBind(bind conn.Bind, seed int64) *FaultBind {
+	return &FaultBind{Bind: bind, rand: rand.New(rand.NewSource(seed))}
+}
+
+// SetFaults replaces the faults applied to datagrams sent from now on.
+func (b *FaultBind) SetFaults(faults Faults) {
+	b.mu.Lock()
+	b.faults = faults
+	b.mu.Unlock()
+}
+
+// Dropped returns how many datagrams were lost so far.
+func (b *FaultBind) Dropped() int64 {
+	return b.dropped.Load()
+}
+
+// Wait blocks until the datagrams held back by latency or reordering have
+// been sent. It must not be called while the bind is still sending.
+func (b *FaultBind) Wait() {
+	b.wg.Wait()
+}
+
+func (b *FaultBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	for _, buf := range bufs {
+		copies, delay := b.fate()
+		for i := 0; i < copies; i++ {
+			if delay == 0 {
+				if err := b.Bind.Send([][]byte{buf}, ep); err != nil {
+					return err
+				}
+				continue
+			}
+			held := append([]byte(nil), buf...)
+			b.wg.Add(1)
+			time.AfterFunc(delay, func() {
+				defer b.wg.Done()
+				b.Bind.Send([][]byte{held}, ep)
+			})
+		}
+	}
+	return nil
+}
+
+// fate draws how many copies of a datagram are sent and after how long.
+func (b *FaultBind) fate() (copies int, delay time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f := &b.faults
+	if f.Loss > 0 && b.rand.Float64() < f.Loss {
+		b.dropped.Add(1)
+		return 0, 0
+	}
+	copies = 1
+	if f.Duplicate > 0 && b.rand.Float64() < f.Duplicate {
+		copies = 2
+	}
+	delay = f.Latency
+	if f.Jitter > 0 {
+		delay += time.Duration(b.rand.Int63n(int64(f.Jitter)))
+	}
+	if f.Reorder > 0 && b.rand.Float64() < f.Reorder {
+		delay += f.ReorderDelay
+	}
+	return copies, delay
+}
@@ -0,0 +1,362 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Forward error correction adds parity datagrams to what a bind sends, so
+ * the other end can rebuild a lost datagram instead of the connections in
+ * the tunnel waiting for a retransmission. Sent datagrams are grouped by
+ * destination into groups of up to data datagrams, the datagram at index i
+ * of a group being covered by parity datagram i%parity, the xor of all the
+ * datagrams it covers. A parity datagram rebuilds one datagram it covers
+ * lost from the group. Groups left short are closed after FECFlushDelay.
+ *
+ * Every datagram is framed with a header, so both ends must use the same
+ * ratio, and nothing but another FECBind understands what they send:
+ *
+ *	kind (1) | index (1) | count (1) | zero (1) | group (4)
+ *
+ * Parity datagrams carry the number of datagrams in their group in count,
+ * and the xor of the covered datagrams each prefixed with its length.
+ */
+
+const (
+	// FECHeaderSize is the size of the header every datagram is framed
+	// with
+	FECHeaderSize = 8
+	// FECFlushDelay is how long a group is left open for more datagrams
+	FECFlushDelay = 5 * time.Millisecond
+	// MaxFECData bounds the datagrams in a group
+	MaxFECData = 32
+
+	fecKindData   = 0xd0
+	fecKindParity = 0xd1
+	// fecWindow is how many groups before the newest one are kept for
+	// rebuilding datagrams, from each source
+	fecWindow = 64
+)
+
+// ParseFEC parses a forward error correction ratio, DATA:PARITY, such as
+// 4:1 for a parity datagram every 4 datagrams.
+func ParseFEC(s string) (data, parity int, err error) {
+	ds, ps, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid fec ratio %q: want DATA:PARITY", s)
+	}
+	if data, err = strconv.Atoi(ds); err != nil || data < 1 || data > MaxFECData {
+		return 0, 0, fmt.Errorf("invalid fec ratio %q: data must be 1 to %d", s, MaxFECData)
+	}
+	if parity, err = strconv.Atoi(ps); err != nil || parity < 1 || parity > data {
+		return 0, 0, fmt.Errorf("invalid fec ratio %q: parity must be 1 to %d", s, data)
+	}
+	return data, parity, nil
+}
+
+// FECBind is a Bind adding forward error correction to the datagrams sent
+// through the Bind it wraps, and rebuilding lost ones from those received.
+type FECBind struct {
+	Bind
+	data, parity int
+
+	sendMu sync.Mutex
+	// encoders holds the open group of each destination
+	encoders map[string]*fecEncoder
+
+	recvMu sync.Mutex
+	// decoders holds the recent groups of each source
+	decoders map[string]*fecDecoder
+}
+
+var _ Bind = (*FECBind)(nil)
+
+// NewFECBind wraps bind, adding parity datagrams to every data datagrams
+// it sends, see ParseFEC.
+func NewFECBind(bind Bind, data, parity int) *FECBind {
+	return &FECBind{
+		Bind:     bind,
+		data:     data,
+		parity:   parity,
+		encoders: make(map[string]*fecEncoder),
+		decoders: make(map[string]*fecDecoder),
+	}
+}
+
+// fecEncoder builds the parity datagrams of the open group to a
+// destination.
+type fecEncoder struct {
+	ep    Endpoint
+	group uint32
+	// count is the number of datagrams sent in the group
+	count  int
+	parity [][]byte
+	flush  *time.Timer
+}
+
+// fecDecoder keeps the recent groups from a source.
+type fecDecoder struct {
+	newest uint32
+	groups map[uint32]*fecGroup
+}
+
+// fecGroup is what was received of a group, the xor of the datagrams
+// covered by each parity datagram, and which of them arrived.
+type fecGroup struct {
+	acc      [][]byte
+	received uint64
+}
+
+// xorInto xors src into *dst, growing it to fit.
+func xorInto(dst *[]byte, src []byte) {
+	if len(*dst) < len(src) {
+		*dst = append(*dst, make([]byte, len(src)-len(*dst))...)
+	}
+	d := *dst
+	for i, b := range src {
+		d[i] ^= b
+	}
+}
+
+// fold xors b prefixed with its length into *dst.
+func fold(dst *[]byte, b []byte) {
+	if n := 2 + len(b); len(*dst) < n {
+		*dst = append(*dst, make([]byte, n-len(*dst))...)
+	}
+	d := *dst
+	d[0] ^= byte(len(b) >> 8)
+	d[1] ^= byte(len(b))
+	for i, c := range b {
+		d[2+i] ^= c
+	}
+}
+
+func putFECHeader(b []byte, kind byte, index, count int, group uint32) {
+	b[0], b[1], b[2], b[3] = kind, byte(index), byte(count), 0
+	binary.LittleEndian.PutUint32(b[4:], group)
+}
+
+func (b *FECBind) Send(bufs [][]byte, ep Endpoint) error {
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+
+	key := ep.DstToString()
+	enc := b.encoders[key]
+	if enc == nil {
+		enc = &fecEncoder{parity: make([][]byte, b.parity)}
+		b.encoders[key] = enc
+	}
+	enc.ep = ep
+
+	out := make([][]byte, 0, len(bufs)+b.parity)
+	for _, buf := range bufs {
+		framed := make([]byte, FECHeaderSize+len(buf))
+		putFECHeader(framed, fecKindData, enc.count, 0, enc.group)
+		copy(framed[FECHeaderSize:], buf)
+		out = append(out, framed)
+
+		fold(&enc.parity[enc.count%b.parity], buf)
+		enc.count++
+		if enc.count == b.data {
+			out = append(out, b.closeGroup(enc)...)
+		}
+	}
+	if enc.count > 0 && enc.flush == nil {
+		group := enc.group
+		enc.flush = time.AfterFunc(FECFlushDelay, func() { b.flush(key, group) })
+	}
+	return b.send(out, ep)
+}
+
+// flush closes the group to key if it is still open.
+func (b *FECBind) flush(key string, group uint32) {
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+
+	enc := b.encoders[key]
+	if enc == nil || enc.group != group || enc.count == 0 {
+		return
+	}
+	_ = b.send(b.closeGroup(enc), enc.ep)
+}
+
+// closeGroup returns the parity datagrams of the open group of enc and
+// opens the next one. b.sendMu must be held.
+func (b *FECBind) closeGroup(enc *fecEncoder) [][]byte {
+	var out [][]byte
+	for i, p := range enc.parity {
+		// A short group may leave parity datagrams covering nothing
+		if i >= enc.count {
+			break
+		}
+		framed := make([]byte, FECHeaderSize+len(p))
+		putFECHeader(framed, fecKindParity, i, enc.count, enc.group)
+		copy(framed[FECHeaderSize:], p)
+		out = append(out, framed)
+		enc.parity[i] = p[:0]
+		clear(p)
+	}
+	if enc.flush != nil {
+		enc.flush.Stop()
+		enc.flush = nil
+	}
+	enc.group++
+	enc.count = 0
+	return out
+}
+
+// send sends bufs through the wrapped bind in batches it takes.
+func (b *FECBind) send(bufs [][]byte, ep Endpoint) error {
+	batch := b.Bind.BatchSize()
+	for len(bufs) > 0 {
+		n := min(batch, len(bufs))
+		if err := b.Bind.Send(bufs[:n], ep); err != nil {
+			return err
+		}
+		bufs = bufs[n:]
+	}
+	return nil
+}
+
+func (b *FECBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.Bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, fn := range fns {
+		fns[i] = b.makeReceiveFunc(fn)
+	}
+	return fns, actualPort, nil
+}
+
+func (b *FECBind) makeReceiveFunc(fn ReceiveFunc) ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+		n, err := fn(packets, sizes, eps)
+		for i := 0; i < n; i++ {
+			sizes[i] = b.receive(packets[i], sizes[i], eps[i])
+		}
+		return n, err
+	}
+}
+
+// receive unframes the datagram of size in packet, or replaces a parity
+// datagram with the datagram it rebuilds, returning the new size, zero
+// when there is nothing to pass on.
+func (b *FECBind) receive(packet []byte, size int, ep Endpoint) int {
+	if size < FECHeaderSize || packet[3] != 0 {
+		return 0
+	}
+	kind, index, count := packet[0], int(packet[1]), int(packet[2])
+	group := binary.LittleEndian.Uint32(packet[4:])
+	payload := packet[FECHeaderSize:size]
+
+	b.recvMu.Lock()
+	defer b.recvMu.Unlock()
+
+	switch kind {
+	case fecKindData:
+		if index >= b.data {
+			return 0
+		}
+		// A duplicate folded in twice would cancel itself out
+		if g := b.group(ep, group); g != nil && g.received&(1<<index) == 0 {
+			g.received |= 1 << index
+			fold(&g.acc[index%b.parity], payload)
+		}
+		return copy(packet, payload)
+
+	case fecKindParity:
+		if index >= b.parity || count > b.data {
+			return 0
+		}
+		g := b.group(ep, group)
+		if g == nil {
+			return 0
+		}
+		missing := -1
+		for i := index; i < count; i += b.parity {
+			if g.received&(1<<i) != 0 {
+				continue
+			}
+			if missing >= 0 {
+				// More than one lost, which xor can't rebuild
+				return 0
+			}
+			missing = i
+		}
+		if missing < 0 {
+			return 0
+		}
+
+		xorInto(&g.acc[index], payload)
+		rebuilt := g.acc[index]
+		g.received |= 1 << missing
+		if len(rebuilt) < 2 {
+			return 0
+		}
+		size := int(binary.BigEndian.Uint16(rebuilt))
+		if size > len(rebuilt)-2 || size > len(packet) {
+			return 0
+		}
+		return copy(packet, rebuilt[2:2+size])
+	}
+	return 0
+}
+
+// group returns what was received of group from ep, nil if it is too old
+// to be kept. b.recvMu must be held.
+func (b *FECBind) group(ep Endpoint, group uint32) *fecGroup {
+	key := ep.DstToString()
+	dec := b.decoders[key]
+	if dec == nil {
+		dec = &fecDecoder{newest: group, groups: make(map[uint32]*fecGroup)}
+		b.decoders[key] = dec
+	}
+
+	// Group numbers wrap, so they are compared by distance
+	if ahead := int32(group - dec.newest); ahead > 0 {
+		dec.newest = group
+		for old := range dec.groups {
+			if int32(dec.newest-old) > fecWindow {
+				delete(dec.groups, old)
+			}
+		}
+	} else if -ahead > fecWindow {
+		return nil
+	}
+
+	g := dec.groups[group]
+	if g == nil {
+		g = &fecGroup{acc: make([][]byte, b.parity)}
+		dec.groups[group] = g
+	}
+	return g
+}
+
+// BindSocketToInterface4 binds the wrapped bind, if it can be.
+func (b *FECBind) BindSocketToInterface4(interfaceIndex uint32, blackhole bool) error {
+	bind, ok := b.Bind.(BindSocketToInterface)
+	if !ok {
+		return errors.New("bind can't be bound to an interface")
+	}
+	return bind.BindSocketToInterface4(interfaceIndex, blackhole)
+}
+
+// BindSocketToInterface6 binds the wrapped bind, if it can be.
+func (b *FECBind) BindSocketToInterface6(interfaceIndex uint32, blackhole bool) error {
+	bind, ok := b.Bind.(BindSocketToInterface)
+	if !ok {
+		return errors.New("bind can't be bound to an interface")
+	}
+	return bind.BindSocketToInterface6(interfaceIndex, blackhole)
+}
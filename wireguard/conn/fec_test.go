@@ -0,0 +1,117 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn_test
+
+import (
+	"bytes"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/wireguard/conn"
+	"github.com/bepass-org/warp-plus/wireguard/conn/bindtest"
+)
+
+func TestParseFEC(t *testing.T) {
+	data, parity, err := conn.ParseFEC("4:2")
+	if err != nil || data != 4 || parity != 2 {
+		t.Fatalf("got %d:%d, %v, want 4:2", data, parity, err)
+	}
+	for _, s := range []string{"", "4", "0:1", "4:0", "4:5", "33:1", "a:1"} {
+		if _, _, err := conn.ParseFEC(s); err == nil {
+			t.Errorf("parsed invalid ratio %q", s)
+		}
+	}
+}
+
+// fecPair returns two FEC binds sending to each other, the datagrams a
+// sends numbered in order and dropped if lost says so, the receive func
+// of b, and the endpoint of b.
+func fecPair(t *testing.T, data, parity int, lost func(n int) bool) (a conn.Bind, recv conn.ReceiveFunc, ep conn.Endpoint) {
+	binds := bindtest.NewChannelBinds()
+	var sent atomic.Int64
+	binds[0].(*bindtest.ChannelBind).SetFilter(func([]byte) bool {
+		return !lost(int(sent.Add(1) - 1))
+	})
+
+	a = conn.NewFECBind(binds[0], data, parity)
+	b := conn.NewFECBind(binds[1], data, parity)
+	if _, _, err := a.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	fns, _, err := b.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	ep, err = binds[0].ParseEndpoint("127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, fns[0], ep
+}
+
+// receiveFEC receives n datagrams from recv, returning what they carried
+// once unframed or rebuilt.
+func receiveFEC(t *testing.T, recv conn.ReceiveFunc, n int) [][]byte {
+	var got [][]byte
+	for i := 0; i < n; i++ {
+		packets, sizes, eps := [][]byte{make([]byte, 1500)}, []int{0}, []conn.Endpoint{nil}
+		if _, err := recv(packets, sizes, eps); err != nil {
+			t.Fatal(err)
+		}
+		if sizes[0] > 0 {
+			got = append(got, packets[0][:sizes[0]])
+		}
+	}
+	return got
+}
+
+func fecPackets(ids ...int) [][]byte {
+	var packets [][]byte
+	for _, id := range ids {
+		packets = append(packets, bytes.Repeat([]byte{byte(id)}, 10+7*id))
+	}
+	return packets
+}
+
+func TestFECRebuildsLost(t *testing.T) {
+	// The datagrams go out as d0 d1 d2 d3 p0 p1 for each group. In the
+	// first, parity 1 covers d1 and parity 0 covers d2, so both come back.
+	// In the second, d0 and d2 are both covered by parity 0, which rebuilds
+	// neither.
+	dropped := []int{1, 2, 6, 8}
+	a, recv, ep := fecPair(t, 4, 2, func(n int) bool { return slices.Contains(dropped, n) })
+
+	if err := a.Send(fecPackets(0, 1, 2, 3, 4, 5, 6, 7), ep); err != nil {
+		t.Fatal(err)
+	}
+	got := receiveFEC(t, recv, 12-len(dropped))
+
+	slices.SortFunc(got, bytes.Compare)
+	want := fecPackets(0, 1, 2, 3, 5, 7)
+	if !slices.EqualFunc(got, want, bytes.Equal) {
+		t.Fatalf("received %d packets %v, want %v", len(got), got, want)
+	}
+}
+
+func TestFECFlushesShortGroups(t *testing.T) {
+	// A lone datagram is covered by the parity datagram sent once the
+	// group is left short
+	a, recv, ep := fecPair(t, 4, 1, func(n int) bool { return n == 0 })
+
+	if err := a.Send(fecPackets(3), ep); err != nil {
+		t.Fatal(err)
+	}
+	got := receiveFEC(t, recv, 1)
+	if want := fecPackets(3); !slices.EqualFunc(got, want, bytes.Equal) {
+		t.Fatalf("received %v, want %v", got, want)
+	}
+}
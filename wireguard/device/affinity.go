@@ -0,0 +1,124 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// WorkerAffinity lists the CPUs the different kinds of workers may run on.
+// An empty list leaves the workers to the Go scheduler.
+type WorkerAffinity struct {
+	RX     []int // UDP receive routines
+	Crypto []int // encryption, decryption and handshake workers
+	TX     []int // per-peer sequential senders
+}
+
+type workerKind int
+
+const (
+	workerRX workerKind = iota
+	workerCrypto
+	workerTX
+)
+
+var (
+	workerAffinity atomic.Pointer[WorkerAffinity]
+	maxWorkers     atomic.Int32
+)
+
+// SetMaxWorkers bounds the encryption, decryption and handshake workers of
+// devices created afterwards, one of each per CPU by default. Zero removes
+// the bound.
+func SetMaxWorkers(n int) {
+	maxWorkers.Store(int32(n))
+}
+
+// SetWorkerAffinity pins workers started afterwards to the given CPUs. It
+// should be called before devices are created. Pinning is only supported
+// on Linux.
+func SetWorkerAffinity(a WorkerAffinity) error {
+	if runtime.GOOS != "linux" && (len(a.RX) > 0 || len(a.Crypto) > 0 || len(a.TX) > 0) {
+		return errors.New("worker cpu affinity is only supported on linux")
+	}
+	workerAffinity.Store(&a)
+	return nil
+}
+
+// pinWorker locks the calling goroutine to its OS thread and restricts the
+// thread to the CPUs configured for kind. The thread is never unlocked, so
+// it exits together with the goroutine instead of returning to the
+// scheduler with a restricted CPU set.
+func (device *Device) pinWorker(kind workerKind) {
+	a := workerAffinity.Load()
+	if a == nil {
+		return
+	}
+
+	var cpus []int
+	switch kind {
+	case workerRX:
+		cpus = a.RX
+	case workerCrypto:
+		cpus = a.Crypto
+	case workerTX:
+		cpus = a.TX
+	}
+	if len(cpus) == 0 {
+		return
+	}
+
+	runtime.LockOSThread()
+	if err := setThreadAffinity(cpus); err != nil {
+		device.log.Errorf("Failed to set worker cpu affinity: %v", err)
+	}
+}
+
+// MaxCPU bounds the CPUs of a cpu list, it is the size of a Linux cpu set.
+const MaxCPU = 1024
+
+// ParseCPUList parses a Linux style cpu list such as "0-3,8,10-11", or
+// "node<N>" for all CPUs of a NUMA node.
+func ParseCPUList(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	if node, ok := strings.CutPrefix(s, "node"); ok {
+		n, err := strconv.Atoi(node)
+		if err != nil {
+			return nil, fmt.Errorf("invalid numa node %q", node)
+		}
+		return numaNodeCPUs(n)
+	}
+
+	var cpus []int
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu %q", lo)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return nil, fmt.Errorf("invalid cpu range %q", part)
+			}
+		}
+		if last >= MaxCPU {
+			return nil, fmt.Errorf("cpu %d out of range, cpus go up to %d", last, MaxCPU-1)
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "errors"
+
+func setThreadAffinity(cpus []int) error {
+	return errors.New("not supported on this platform")
+}
+
+func numaNodeCPUs(node int) ([]int, error) {
+	return nil, errors.New("numa nodes are only supported on linux")
+}
@@ -0,0 +1,39 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []int
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "3", want: []int{3}},
+		{in: "0-3,8,10-11", want: []int{0, 1, 2, 3, 8, 10, 11}},
+		{in: "3-1", wantErr: true},
+		{in: "1023", want: []int{1023}},
+		{in: "1024", wantErr: true},
+		{in: "0-2147483647", wantErr: true},
+		{in: "a", wantErr: true},
+		{in: "nodex", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCPUList(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseCPUList(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ParseCPUList(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -8,6 +8,7 @@ package device
 import (
 	"runtime"
 	"sync"
+	"time"
 )
 
 // An outboundQueue is a channel of QueueOutboundElements awaiting encryption.
@@ -135,3 +136,97 @@ func (device *Device) flushOutboundQueue(q *autodrainingOutboundQueue) {
 		}
 	}
 }
+
+// A stagedQueue holds the packets of a peer waiting for a session or for
+// the sequential sender to catch up, oldest first. It is bounded, and
+// drops the oldest packets to make room for new ones.
+type stagedQueue struct {
+	mu      sync.Mutex
+	ring    []*QueueOutboundElementsContainer
+	head    int
+	count   int
+	packets int // packets in all containers
+}
+
+func newStagedQueue(size int) *stagedQueue {
+	return &stagedQueue{ring: make([]*QueueOutboundElementsContainer, size)}
+}
+
+// push adds c at the back, returning the oldest container if it was
+// dropped to make room.
+func (q *stagedQueue) push(c *QueueOutboundElementsContainer) (dropped *QueueOutboundElementsContainer) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.count == len(q.ring) {
+		dropped = q.popLocked()
+	}
+	q.ring[(q.head+q.count)%len(q.ring)] = c
+	q.count++
+	q.packets += len(c.elems)
+	return dropped
+}
+
+// offer adds c at the back if there is room, and reports whether it did.
+func (q *stagedQueue) offer(c *QueueOutboundElementsContainer) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.count == len(q.ring) {
+		return false
+	}
+	q.ring[(q.head+q.count)%len(q.ring)] = c
+	q.count++
+	q.packets += len(c.elems)
+	return true
+}
+
+// pop removes the oldest container, or returns nil if there is none.
+func (q *stagedQueue) pop() *QueueOutboundElementsContainer {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.count == 0 {
+		return nil
+	}
+	return q.popLocked()
+}
+
+// popFit removes the oldest container if it holds at most room packets.
+func (q *stagedQueue) popFit(room int) *QueueOutboundElementsContainer {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.count == 0 || len(q.ring[q.head].elems) > room {
+		return nil
+	}
+	return q.popLocked()
+}
+
+func (q *stagedQueue) popLocked() *QueueOutboundElementsContainer {
+	c := q.ring[q.head]
+	q.ring[q.head] = nil
+	q.head = (q.head + 1) % len(q.ring)
+	q.count--
+	q.packets -= len(c.elems)
+	return c
+}
+
+// peek returns when the oldest container was staged and the number of
+// packets staged.
+func (q *stagedQueue) peek() (oldest time.Time, packets int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.count == 0 {
+		return time.Time{}, 0
+	}
+	return q.ring[q.head].staged, q.packets
+}
+
+func (q *stagedQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.count
+}
@@ -0,0 +1,155 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+/* A CipherSuite bundles the key derivation and AEAD used by the handshake
+ * and for transport data. Anything other than the default suite is not
+ * WireGuard and only interoperates with peers configured with the same
+ * suite, there is no negotiation on the wire.
+ */
+type CipherSuite interface {
+	KDF1(t0 *[blake2s.Size]byte, key, input []byte)
+	KDF2(t0, t1 *[blake2s.Size]byte, key, input []byte)
+	KDF3(t0, t1, t2 *[blake2s.Size]byte, key, input []byte)
+
+	// NewAEAD returns an AEAD for a 32 byte key which accepts the
+	// 12 byte nonces used by the protocol.
+	NewAEAD(key []byte) (cipher.AEAD, error)
+}
+
+const DefaultCipherSuite = "chacha20poly1305-blake2s"
+
+var cipherSuites = struct {
+	sync.RWMutex
+	suites map[string]CipherSuite
+}{
+	suites: map[string]CipherSuite{
+		DefaultCipherSuite:          blake2sSuite{newAEAD: chacha20poly1305.New},
+		"xchacha20poly1305-blake2s": blake2sSuite{newAEAD: newXChaCha20Poly1305},
+		"aes256gcm-blake2s":         blake2sSuite{newAEAD: newAES256GCM},
+	},
+}
+
+// RegisterCipherSuite makes a cipher suite available under name, so that
+// experimental builds can add their own suites.
+func RegisterCipherSuite(name string, suite CipherSuite) {
+	cipherSuites.Lock()
+	defer cipherSuites.Unlock()
+	cipherSuites.suites[name] = suite
+}
+
+// CipherSuites returns the names of all registered cipher suites.
+func CipherSuites() []string {
+	cipherSuites.RLock()
+	defer cipherSuites.RUnlock()
+
+	names := make([]string, 0, len(cipherSuites.suites))
+	for name := range cipherSuites.suites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupCipherSuite(name string) (CipherSuite, bool) {
+	cipherSuites.RLock()
+	defer cipherSuites.RUnlock()
+	suite, ok := cipherSuites.suites[name]
+	return suite, ok
+}
+
+type namedCipherSuite struct {
+	name string
+	CipherSuite
+}
+
+func (device *Device) cipherSuite() CipherSuite {
+	return device.suite.Load().CipherSuite
+}
+
+// SetCipherSuite selects the registered cipher suite used for all new
+// handshakes and sessions.
+func (device *Device) SetCipherSuite(name string) error {
+	suite, ok := lookupCipherSuite(name)
+	if !ok {
+		return errors.New("unknown cipher suite")
+	}
+	device.suite.Store(&namedCipherSuite{name: name, CipherSuite: suite})
+	return nil
+}
+
+// blake2sSuite uses the standard HKDF over HMAC-BLAKE2s with a
+// configurable AEAD.
+type blake2sSuite struct {
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func (blake2sSuite) KDF1(t0 *[blake2s.Size]byte, key, input []byte) {
+	KDF1(t0, key, input)
+}
+
+func (blake2sSuite) KDF2(t0, t1 *[blake2s.Size]byte, key, input []byte) {
+	KDF2(t0, t1, key, input)
+}
+
+func (blake2sSuite) KDF3(t0, t1, t2 *[blake2s.Size]byte, key, input []byte) {
+	KDF3(t0, t1, t2, key, input)
+}
+
+func (s blake2sSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	return s.newAEAD(key)
+}
+
+func newAES256GCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// xchacha20poly1305 adapts XChaCha20-Poly1305 to 12 byte nonces by
+// zero extending them.
+type xchacha20poly1305 struct {
+	cipher.AEAD
+}
+
+func newXChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return xchacha20poly1305{aead}, nil
+}
+
+func (xchacha20poly1305) NonceSize() int {
+	return chacha20poly1305.NonceSize
+}
+
+func (x xchacha20poly1305) extend(nonce []byte) []byte {
+	var n [chacha20poly1305.NonceSizeX]byte
+	copy(n[chacha20poly1305.NonceSizeX-len(nonce):], nonce)
+	return n[:]
+}
+
+func (x xchacha20poly1305) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	return x.AEAD.Seal(dst, x.extend(nonce), plaintext, additionalData)
+}
+
+func (x xchacha20poly1305) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	return x.AEAD.Open(dst, x.extend(nonce), ciphertext, additionalData)
+}
@@ -0,0 +1,116 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+)
+
+func TestCipherSuiteHandshake(t *testing.T) {
+	for _, name := range CipherSuites() {
+		t.Run(name, func(t *testing.T) {
+			dev1 := randDevice(t)
+			dev2 := randDevice(t)
+			defer dev1.Close()
+			defer dev2.Close()
+
+			assertNil(t, dev1.SetCipherSuite(name))
+			assertNil(t, dev2.SetCipherSuite(name))
+
+			peer1, err := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+			assertNil(t, err)
+			peer2, err := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+			assertNil(t, err)
+			peer1.Start()
+			peer2.Start()
+
+			msg1, err := dev1.CreateMessageInitiation(peer2)
+			assertNil(t, err)
+			if dev2.ConsumeMessageInitiation(msg1) == nil {
+				t.Fatal("handshake failed at initiation message")
+			}
+
+			msg2, err := dev2.CreateMessageResponse(peer1)
+			assertNil(t, err)
+			if dev1.ConsumeMessageResponse(msg2) == nil {
+				t.Fatal("handshake failed at response message")
+			}
+
+			assertNil(t, peer1.BeginSymmetricSession())
+			assertNil(t, peer2.BeginSymmetricSession())
+
+			key1 := peer1.keypairs.next.Load()
+			key2 := peer2.keypairs.current
+
+			testMsg := []byte("wireguard test message")
+			var nonce [12]byte
+			out := key1.send.Seal(nil, nonce[:], testMsg, nil)
+			out, err = key2.receive.Open(out[:0], nonce[:], out, nil)
+			assertNil(t, err)
+			assertEqual(t, out, testMsg)
+		})
+	}
+}
+
+func TestCipherSuiteMismatch(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	assertNil(t, dev1.SetCipherSuite("aes256gcm-blake2s"))
+
+	peer1, err := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	assertNil(t, err)
+	peer2, err := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+	assertNil(t, err)
+	peer1.Start()
+	peer2.Start()
+
+	msg1, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	if dev2.ConsumeMessageInitiation(msg1) != nil {
+		t.Fatal("handshake succeeded with mismatched cipher suites")
+	}
+}
+
+func TestSetUnknownCipherSuite(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	if err := dev.SetCipherSuite("rot13"); err == nil {
+		t.Fatal("unknown cipher suite accepted")
+	}
+}
+
+func BenchmarkCipherSuiteSeal(b *testing.B) {
+	var key [32]byte
+	var nonce [12]byte
+	packet := make([]byte, DefaultMTU)
+	out := make([]byte, 0, DefaultMTU+64)
+
+	for _, name := range CipherSuites() {
+		suite, _ := lookupCipherSuite(name)
+		aead, err := suite.NewAEAD(key[:])
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(packet)))
+			for i := 0; i < b.N; i++ {
+				out = aead.Seal(out[:0], nonce[:], packet, nil)
+			}
+		})
+	}
+}
+
+func BenchmarkKDF2(b *testing.B) {
+	var t0, t1 [32]byte
+	var key, input [32]byte
+	for i := 0; i < b.N; i++ {
+		KDF2(&t0, &t1, key[:], input[:])
+	}
+}
@@ -0,0 +1,48 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "time"
+
+// Clock is the time source of the protocol timers, handshake rate limits
+// and key lifetimes of a device. Devices use the system clock unless a
+// virtual one is set with SetClock, which lets tests step through rekeys
+// and expiry without waiting minutes for them.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once d has passed, like
+	// time.AfterFunc
+	AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+// ClockTimer is a timer started by a Clock.
+type ClockTimer interface {
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return time.AfterFunc(d, f)
+}
+
+// SetClock replaces the clock of the device. It must be called before any
+// peers are added, as their timers are started on the clock the device
+// has then.
+func (device *Device) SetClock(clock Clock) {
+	device.clock = clock
+}
+
+func (device *Device) now() time.Time {
+	return device.clock.Now()
+}
+
+func (device *Device) since(t time.Time) time.Duration {
+	return device.clock.Now().Sub(t)
+}
@@ -0,0 +1,278 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/conn/bindtest"
+	"github.com/bepass-org/warp-plus/wireguard/tun/tuntest"
+)
+
+// virtualClock is a Clock that only moves when Advance is called. Timers
+// that come due are called in order from Advance itself, so once it returns
+// every expiry up to the new time has run.
+type virtualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*virtualTimer
+}
+
+type virtualTimer struct {
+	clock  *virtualClock
+	when   time.Time
+	f      func()
+	active bool
+}
+
+func newVirtualClock() *virtualClock {
+	return &virtualClock{now: time.Unix(1700000000, 0)}
+}
+
+func (c *virtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *virtualClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &virtualTimer{clock: c, when: c.now.Add(d), f: f, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *virtualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	for {
+		var next *virtualTimer
+		for _, t := range c.timers {
+			if t.active && !t.when.After(target) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		c.now = next.when
+		next.active = false
+		c.mu.Unlock()
+		next.f()
+		c.mu.Lock()
+	}
+	c.now = target
+	c.mu.Unlock()
+}
+
+func (t *virtualTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.when = t.clock.now.Add(d)
+	t.active = true
+	return active
+}
+
+func (t *virtualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+// clockTestPair is a testPair whose devices share a virtual clock, and
+// which counts the handshake initiations each device gets through.
+type clockTestPair struct {
+	testPair
+	clock     *virtualClock
+	initiated [2]atomic.Int32
+	drop      [2]atomic.Bool
+}
+
+func genClockTestPair(t *testing.T, opts ...func(*Device)) *clockTestPair {
+	p := &clockTestPair{clock: newVirtualClock()}
+	opts = append([]func(*Device){func(d *Device) { d.SetClock(p.clock) }}, opts...)
+	p.testPair = genTestPair(t, false, opts...)
+	for i := range p.testPair {
+		i := i
+		bind := p.testPair[i].dev.net.bind
+		if faulty, ok := bind.(*bindtest.FaultBind); ok {
+			bind = faulty.Bind
+		}
+		bind.(*bindtest.ChannelBind).SetFilter(func(b []byte) bool {
+			if len(b) == MessageInitiationSize && b[0] == MessageInitiationType {
+				p.initiated[i].Add(1)
+			}
+			return !p.drop[i].Load()
+		})
+		// Up tried a handshake before the endpoints were set. Call off
+		// its retries, so the first device to send starts the session.
+		p.peer(i).timers.retransmitHandshake.Del()
+	}
+	p.clock.Advance(RekeyTimeout)
+	return p
+}
+
+func (p *clockTestPair) peer(i int) *Peer {
+	dev := p.testPair[i].dev
+	dev.peers.RLock()
+	defer dev.peers.RUnlock()
+	for _, peer := range dev.peers.keyMap {
+		return peer
+	}
+	return nil
+}
+
+// settle lets the keepalive answering the last data packet go out, so no
+// timer but the key lifetimes is left pending on either device.
+func (p *clockTestPair) settle(t *testing.T) {
+	t.Helper()
+	p.clock.Advance(KeepaliveTimeout + time.Millisecond)
+	waitFor(t, "timers to settle", func() bool {
+		for i := range p.testPair {
+			timers := &p.peer(i).timers
+			if timers.sendKeepalive.IsPending() || timers.newHandshake.IsPending() {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClockRekeyAfterTime(t *testing.T) {
+	pair := genClockTestPair(t)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	pair.settle(t)
+
+	initiator := pair.peer(1)
+	first := initiator.keypairs.Current()
+	if first == nil || !first.isInitiator {
+		t.Fatal("no keypair initiated by the first device")
+	}
+	if n := pair.initiated[1].Load(); n != 1 {
+		t.Fatalf("got %d initiations before rekey, want 1", n)
+	}
+
+	pair.clock.Advance(RekeyAfterTime - time.Second - pair.clock.Now().Sub(first.created))
+	pair.Send(t, Ping, nil)
+	if initiator.keypairs.Current() != first {
+		t.Fatal("keypair replaced before RekeyAfterTime")
+	}
+
+	pair.clock.Advance(2 * time.Second)
+	pair.Send(t, Ping, nil)
+	waitFor(t, "rekey", func() bool {
+		current := initiator.keypairs.Current()
+		return current != nil && current != first
+	})
+	if n := pair.initiated[1].Load(); n != 2 {
+		t.Fatalf("got %d initiations after rekey, want 2", n)
+	}
+	if n := pair.initiated[0].Load(); n != 0 {
+		t.Fatalf("responder sent %d initiations, want 0", n)
+	}
+}
+
+func TestClockResponderRekey(t *testing.T) {
+	pair := genClockTestPair(t)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	pair.settle(t)
+
+	responder := pair.peer(0)
+	first := responder.keypairs.Current()
+	if first == nil || first.isInitiator {
+		t.Fatal("no keypair responded to by the first device")
+	}
+
+	// Rekeying is left to the initiator until late in the session
+	pair.clock.Advance(ResponderRekeyAfterTime - pair.clock.Now().Sub(first.created))
+	responder.keepKeyFreshSending()
+	if n := pair.initiated[0].Load(); n != 0 {
+		t.Fatalf("responder sent %d initiations before %v, want 0", n, ResponderRekeyAfterTime)
+	}
+
+	pair.clock.Advance(time.Second)
+	pair.Send(t, Pong, nil)
+	waitFor(t, "responder rekey", func() bool {
+		current := responder.keypairs.Current()
+		return current != nil && current != first && current.isInitiator
+	})
+	if n := pair.initiated[0].Load(); n != 1 {
+		t.Fatalf("responder sent %d initiations, want 1", n)
+	}
+}
+
+func TestClockRejectAfterTime(t *testing.T) {
+	pair := genClockTestPair(t)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	pair.settle(t)
+
+	// Past RejectAfterTime the old keypair can't be used anymore, so
+	// sending has to wait for a new handshake.
+	pair.clock.Advance(RejectAfterTime)
+	pair.Send(t, Ping, nil)
+	if n := pair.initiated[1].Load(); n != 2 {
+		t.Fatalf("got %d initiations after keypair expiry, want 2", n)
+	}
+	pair.Send(t, Pong, nil)
+	pair.settle(t)
+
+	pair.clock.Advance(RejectAfterTime * 3)
+	for i := range pair.testPair {
+		peer := pair.peer(i)
+		peer.keypairs.RLock()
+		current, previous := peer.keypairs.current, peer.keypairs.previous
+		peer.keypairs.RUnlock()
+		if current != nil || previous != nil {
+			t.Errorf("device %d kept its keys after %v", i, RejectAfterTime*3)
+		}
+	}
+}
+
+func TestClockRetransmitHandshake(t *testing.T) {
+	pair := genClockTestPair(t)
+	pair.drop[0].Store(true)
+
+	pair.testPair[1].tun.Outbound <- tuntest.Ping(pair.testPair[0].ip, pair.testPair[1].ip)
+	initiator := pair.peer(1)
+	for want := int32(1); want <= MaxTimerHandshakes+2; want++ {
+		waitFor(t, "handshake initiation", func() bool {
+			return pair.initiated[1].Load() == want
+		})
+		pair.clock.Advance(RekeyTimeout + RekeyTimeoutJitterMaxMs*time.Millisecond)
+	}
+	if initiator.timers.retransmitHandshake.IsPending() {
+		t.Fatal("still retrying the handshake after giving up")
+	}
+	if !initiator.timers.zeroKeyMaterial.IsPending() {
+		t.Fatal("key material not set to be cleared after giving up")
+	}
+
+	pair.clock.Advance(RekeyAttemptTime)
+	if n := pair.initiated[1].Load(); n != MaxTimerHandshakes+2 {
+		t.Fatalf("got %d initiations, want %d", n, MaxTimerHandshakes+2)
+	}
+}
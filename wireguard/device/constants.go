@@ -37,4 +37,17 @@ const (
 const (
 	UnderLoadAfterTime = time.Second // how long does the device remain under load after detected
 	MaxPeers           = 1 << 16     // maximum number of configured peers
+
+	HandshakeInitiationBurst  = 16                    // initiations sent back to back before pacing starts
+	HandshakeInitiationPacing = time.Millisecond * 10 // spacing between paced initiations across all peers
+
+	// ResponderRekeyAfterTime is the keypair age at which the responder
+	// handshakes itself if the initiator hasn't rekeyed, late enough to
+	// leave rekeying to the initiator and early enough to retry before
+	// RejectAfterTime
+	ResponderRekeyAfterTime = RejectAfterTime - KeepaliveTimeout - RekeyTimeout*2
+
+	// MaxCoalesceDelay is how long staged packets are held back, while
+	// the sequential sender is busy, for more to be sealed with them
+	MaxCoalesceDelay = time.Microsecond * 250
 )
@@ -18,7 +18,8 @@ import (
 type CookieChecker struct {
 	sync.RWMutex
 	mac1 struct {
-		key [blake2s.Size]byte
+		key       [blake2s.Size]byte
+		publicKey NoisePublicKey
 	}
 	mac2 struct {
 		secret        [blake2s.Size]byte
@@ -30,7 +31,8 @@ type CookieChecker struct {
 type CookieGenerator struct {
 	sync.RWMutex
 	mac1 struct {
-		key [blake2s.Size]byte
+		key       [blake2s.Size]byte
+		publicKey NoisePublicKey
 	}
 	mac2 struct {
 		cookie        [blake2s.Size128]byte
@@ -53,6 +55,7 @@ func (st *CookieChecker) Init(pk NoisePublicKey) {
 		hash.Write(pk[:])
 		hash.Sum(st.mac1.key[:0])
 	}()
+	st.mac1.publicKey = pk
 
 	// mac2 state
 
@@ -70,13 +73,27 @@ func (st *CookieChecker) CheckMAC1(msg []byte) bool {
 	st.RLock()
 	defer st.RUnlock()
 
+	return checkMAC1(msg, &st.mac1.key)
+}
+
+// CheckPresharedMAC1 checks mac1 against the key derived from psk as well,
+// see presharedMAC1Key.
+func (st *CookieChecker) CheckPresharedMAC1(msg []byte, psk *NoisePresharedKey) bool {
+	st.RLock()
+	key := presharedMAC1Key(st.mac1.publicKey, psk)
+	st.RUnlock()
+
+	return checkMAC1(msg, &key)
+}
+
+func checkMAC1(msg []byte, key *[blake2s.Size]byte) bool {
 	size := len(msg)
 	smac2 := size - blake2s.Size128
 	smac1 := smac2 - blake2s.Size128
 
 	var mac1 [blake2s.Size128]byte
 
-	mac, _ := blake2s.New128(st.mac1.key[:])
+	mac, _ := blake2s.New128(key[:])
 	mac.Write(msg[:smac1])
 	mac.Sum(mac1[:0])
 
@@ -180,6 +197,7 @@ func (st *CookieGenerator) Init(pk NoisePublicKey) {
 		hash.Write(pk[:])
 		hash.Sum(st.mac1.key[:0])
 	}()
+	st.mac1.publicKey = pk
 
 	func() {
 		hash, _ := blake2s.New256(nil)
@@ -213,6 +231,16 @@ func (st *CookieGenerator) ConsumeReply(msg *MessageCookieReply) bool {
 }
 
 func (st *CookieGenerator) AddMacs(msg []byte) {
+	st.addMacs(msg, nil)
+}
+
+// AddPresharedMacs adds macs like AddMacs, with mac1 keyed by psk as well,
+// see presharedMAC1Key.
+func (st *CookieGenerator) AddPresharedMacs(msg []byte, psk *NoisePresharedKey) {
+	st.addMacs(msg, psk)
+}
+
+func (st *CookieGenerator) addMacs(msg []byte, psk *NoisePresharedKey) {
 	size := len(msg)
 
 	smac2 := size - blake2s.Size128
@@ -226,8 +254,12 @@ func (st *CookieGenerator) AddMacs(msg []byte) {
 
 	// set mac1
 
+	key := st.mac1.key
+	if psk != nil {
+		key = presharedMAC1Key(st.mac1.publicKey, psk)
+	}
 	func() {
-		mac, _ := blake2s.New128(st.mac1.key[:])
+		mac, _ := blake2s.New128(key[:])
 		mac.Write(msg[:smac1])
 		mac.Sum(mac1[:0])
 	}()
@@ -246,3 +278,15 @@ func (st *CookieGenerator) AddMacs(msg []byte) {
 		mac.Sum(mac2[:0])
 	}()
 }
+
+// presharedMAC1Key derives the mac1 key of messages to the holder of pk from
+// psk too, so that only those knowing psk can make a mac1 it accepts rather
+// than anyone knowing pk.
+func presharedMAC1Key(pk NoisePublicKey, psk *NoisePresharedKey) (key [blake2s.Size]byte) {
+	hash, _ := blake2s.New256(nil)
+	hash.Write([]byte(WGLabelPresharedMAC1))
+	hash.Write(pk[:])
+	hash.Write(psk[:])
+	hash.Sum(key[:0])
+	return key
+}
@@ -0,0 +1,60 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/cpu"
+)
+
+/* The ChaCha20-Poly1305 and BLAKE2s implementations in x/crypto already
+ * pick vectorized assembly at runtime based on CPU features, falling back
+ * to portable Go. cryptoBackends mirrors that selection so the active
+ * backends show up in the log; benchmarks live in ciphersuite_test.go.
+ */
+func cryptoBackends() string {
+	chacha, blake, aes := "generic", "generic", "generic"
+
+	switch runtime.GOARCH {
+	case "amd64":
+		switch {
+		case cpu.X86.HasAVX2 && cpu.X86.HasBMI2:
+			chacha = "avx2"
+		case cpu.X86.HasSSSE3:
+			chacha = "ssse3"
+		}
+		switch {
+		case cpu.X86.HasSSE41:
+			blake = "sse4.1"
+		case cpu.X86.HasSSSE3:
+			blake = "ssse3"
+		case cpu.X86.HasSSE2:
+			blake = "sse2"
+		}
+		if cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ {
+			aes = "aes-ni"
+		}
+	case "386":
+		switch {
+		case cpu.X86.HasSSSE3:
+			blake = "ssse3"
+		case cpu.X86.HasSSE2:
+			blake = "sse2"
+		}
+	case "arm64":
+		// ChaCha20 uses NEON unconditionally, Poly1305 is portable
+		chacha = "neon"
+		if cpu.ARM64.HasAES && cpu.ARM64.HasPMULL {
+			aes = "armv8-aes"
+		}
+	case "ppc64le", "s390x":
+		chacha = "vector"
+	}
+
+	return fmt.Sprintf("chacha20poly1305=%s blake2s=%s aes-gcm=%s", chacha, blake, aes)
+}
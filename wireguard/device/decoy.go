@@ -0,0 +1,41 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "time"
+
+const (
+	// DecoyBurst bounds the number of decoy packets sent at once
+	DecoyBurst = 3
+	// minDecoySize is the smallest content size of a decoy packet
+	minDecoySize = 32
+)
+
+// SetDecoyInterval sends a few dummy packets of random sizes to peers that
+// went without data sent for about interval, so an idle tunnel doesn't go
+// silent between bursts. They are cover packets, dropped by peers after
+// decryption. A shaping profile with cover traffic of its own takes
+// precedence. Zero, the default, sends none.
+func (device *Device) SetDecoyInterval(interval time.Duration) {
+	device.decoyInterval.Store(int64(max(interval, 0)))
+
+	select {
+	case device.shapingChanged <- struct{}{}:
+	default:
+	}
+}
+
+// coverProfile returns the profile cover packets are sent after, nil if
+// none are sent.
+func (device *Device) coverProfile() *ShapingProfile {
+	if shaping := device.shaping.Load(); shaping != nil && shaping.CoverIdle > 0 {
+		return shaping.ShapingProfile
+	}
+	if interval := time.Duration(device.decoyInterval.Load()); interval > 0 {
+		return &ShapingProfile{CoverIdle: interval, CoverBurst: DecoyBurst}
+	}
+	return nil
+}
@@ -63,6 +63,49 @@ type Device struct {
 		limiter        ratelimiter.Ratelimiter
 	}
 
+	handshakePacer handshakePacer
+
+	suite atomic.Pointer[namedCipherSuite]
+
+	reorderDepth atomic.Int32
+
+	shaping        atomic.Pointer[namedShapingProfile]
+	decoyInterval  atomic.Int64
+	shapingChanged chan struct{}
+
+	initFragments atomic.Int32
+	initJunk      atomic.Int32
+	initQUIC      atomic.Bool
+
+	presharedMAC1 atomic.Bool
+
+	knock struct {
+		sync.Mutex
+		key  atomic.Pointer[NoisePresharedKey]
+		seen map[[knockNonceSize]byte]time.Time // knock nonces to their expiry
+		open map[string]time.Time               // knocked sources to their expiry
+	}
+
+	pathDegraded atomic.Pointer[PathDegradedHandler]
+
+	panicHook atomic.Pointer[func(any)]
+
+	peerAuth struct {
+		sync.Mutex
+		authorizer atomic.Pointer[PeerAuthorizer]
+		pending    map[NoisePublicKey]bool           // peers being asked about
+		denied     map[NoisePublicKey]time.Time      // denied peers to their expiry
+		authorized map[NoisePublicKey]authorizedPeer // peers the authorizer added
+		tokens     int                               // authorizations that may start now
+		refilled   time.Time                         // when tokens were last refilled
+	}
+
+	unknownIndex struct {
+		count      atomic.Uint64
+		lastReport atomic.Int64 // nano seconds since epoch on the device clock
+		recovery   atomic.Bool
+	}
+
 	allowedips    AllowedIPs
 	indexTable    IndexTable
 	cookieChecker CookieChecker
@@ -89,6 +132,7 @@ type Device struct {
 	ipcMutex sync.RWMutex
 	closed   chan struct{}
 	log      *Logger
+	clock    Clock
 }
 
 // deviceState represents the state of a Device.
@@ -214,7 +258,7 @@ func (device *Device) Down() error {
 
 func (device *Device) IsUnderLoad() bool {
 	// check if currently under load
-	now := time.Now()
+	now := device.now()
 	underLoad := len(device.queue.handshake.c) >= QueueHandshakeSize/8
 	if underLoad {
 		device.rate.underLoadUntil.Store(now.Add(UnderLoadAfterTime).UnixNano())
@@ -283,7 +327,9 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 	device := new(Device)
 	device.state.state.Store(uint32(deviceStateDown))
 	device.closed = make(chan struct{})
+	device.shapingChanged = make(chan struct{}, 1)
 	device.log = logger
+	device.clock = systemClock{}
 	device.net.bind = bind
 	device.tun.device = tunDevice
 	mtu, err := device.tun.device.MTU()
@@ -295,6 +341,8 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
 	device.rate.limiter.Init()
 	device.indexTable.Init()
+	device.SetCipherSuite(DefaultCipherSuite)
+	device.log.Verbosef("Crypto backends: %s", cryptoBackends())
 
 	device.PopulatePools()
 
@@ -307,6 +355,9 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 	// start workers
 
 	cpus := runtime.NumCPU()
+	if n := int(maxWorkers.Load()); n > 0 {
+		cpus = min(cpus, n)
+	}
 	device.state.stopping.Wait()
 	device.queue.encryption.wg.Add(cpus) // One for each RoutineHandshake
 	for i := 0; i < cpus; i++ {
@@ -319,6 +370,7 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 	device.queue.encryption.wg.Add(1) // RoutineReadFromTUN
 	go device.RoutineReadFromTUN()
 	go device.RoutineTUNEventReader()
+	go device.RoutineCoverTraffic()
 
 	return device
 }
@@ -409,7 +461,7 @@ func (device *Device) SendKeepalivesToPeersWithCurrentKeypair() {
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
 		peer.keypairs.RLock()
-		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(RejectAfterTime).Before(time.Now())
+		sendKeepalive := peer.keypairs.current != nil && device.since(peer.keypairs.current.created) <= RejectAfterTime
 		peer.keypairs.RUnlock()
 		if sendKeepalive {
 			peer.SendKeepalive()
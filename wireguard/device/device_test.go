@@ -7,6 +7,7 @@ package device
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -148,8 +149,9 @@ func (pair *testPair) Send(tb testing.TB, ping SendDirection, done chan struct{}
 	}
 }
 
-// genTestPair creates a testPair.
-func genTestPair(tb testing.TB, realSocket bool) (pair testPair) {
+// genTestPair creates a testPair. Each opt is applied to both devices
+// before they are configured.
+func genTestPair(tb testing.TB, realSocket bool, opts ...func(*Device)) (pair testPair) {
 	cfg, endpointCfg := genConfigs(tb)
 	var binds [2]conn.Bind
 	if realSocket {
@@ -167,6 +169,9 @@ func genTestPair(tb testing.TB, realSocket bool) (pair testPair) {
 			level = LogLevelError
 		}
 		p.dev = NewDevice(p.tun.TUN(), binds[i], NewLogger(level, fmt.Sprintf("dev%d: ", i)))
+		for _, opt := range opts {
+			opt(p.dev)
+		}
 		if err := p.dev.IpcSet(cfg[i]); err != nil {
 			tb.Errorf("failed to configure device %d: %v", i, err)
 			p.dev.Close()
@@ -474,3 +479,172 @@ func TestBatchSize(t *testing.T) {
 		t.Errorf("expected batch size %d, got %d", want, got)
 	}
 }
+
+// newSendTestPeer returns a running peer with a session, of a device that
+// is up and batches up to batchSize packets. Nothing reads its outbound
+// queue or the encryption queue.
+func newSendTestPeer(t *testing.T, batchSize int) *Peer {
+	t.Helper()
+	device := &Device{log: NewLogger(LogLevelSilent, ""), clock: systemClock{}}
+	device.net.bind = &fakeBindSized{batchSize}
+	device.tun.device = &fakeTUNDeviceSized{batchSize}
+	device.PopulatePools()
+	device.queue.encryption = &outboundQueue{c: make(chan *QueueOutboundElementsContainer, 2*QueueOutboundSize)}
+	device.state.state.Store(uint32(deviceStateUp))
+
+	peer := &Peer{device: device}
+	peer.queue.staged = newStagedQueue(QueueStagedSize)
+	peer.queue.outbound = &autodrainingOutboundQueue{c: make(chan *QueueOutboundElementsContainer, QueueOutboundSize)}
+	peer.keypairs.current = &Keypair{created: device.now()}
+	peer.isRunning.Store(true)
+	return peer
+}
+
+// testPackets returns a container of packets carrying ids.
+func testPackets(peer *Peer, ids ...uint16) *QueueOutboundElementsContainer {
+	c := peer.device.GetOutboundElementsContainer()
+	for _, id := range ids {
+		elem := peer.device.NewOutboundElement()
+		elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+2]
+		binary.BigEndian.PutUint16(elem.packet, id)
+		c.elems = append(c.elems, elem)
+	}
+	return c
+}
+
+// fillOutbound leaves room for n containers in the outbound queue of peer.
+func fillOutbound(peer *Peer, n int) {
+	for len(peer.queue.outbound.c) < cap(peer.queue.outbound.c)-n {
+		peer.queue.outbound.c <- peer.device.GetOutboundElementsContainer()
+	}
+}
+
+// drainOutbound empties the outbound queue of peer and returns the ids of
+// the packets in it and their nonces, in order.
+func drainOutbound(peer *Peer) (ids []uint16, nonces []uint64) {
+	for {
+		select {
+		case c := <-peer.queue.outbound.c:
+			for _, elem := range c.elems {
+				ids = append(ids, binary.BigEndian.Uint16(elem.packet))
+				nonces = append(nonces, elem.nonce)
+			}
+		default:
+			return ids, nonces
+		}
+	}
+}
+
+func TestSendStagedBackedUp(t *testing.T) {
+	peer := newSendTestPeer(t, 4)
+
+	// The first batch takes the last room in the outbound queue, and the
+	// containers that don't fit into it stay staged in order
+	fillOutbound(peer, 1)
+	peer.StagePackets(testPackets(peer, 0, 1, 2))
+	peer.StagePackets(testPackets(peer, 3, 4, 5))
+	peer.StagePackets(testPackets(peer, 6, 7, 8))
+	peer.SendStagedPackets()
+
+	// Staging more than the queue holds while the sender is backed up
+	// drops the oldest packets: 3 to 5, 6 to 8, then 9 and 10
+	next := uint16(9)
+	for i := 0; i < QueueStagedSize-2+4; i++ {
+		peer.StagePackets(testPackets(peer, next))
+		peer.SendStagedPackets()
+		next++
+	}
+	if got := peer.queue.droppedTx.Load(); got != 8 {
+		t.Fatalf("dropped %d packets, want 8", got)
+	}
+
+	ids, _ := drainOutbound(peer)
+	peer.SendStagedPackets()
+	more, nonces := drainOutbound(peer)
+	ids = append(ids, more...)
+
+	want := []uint16{0, 1, 2}
+	for id := uint16(11); id < next; id++ {
+		want = append(want, id)
+	}
+	if len(ids) != len(want) {
+		t.Fatalf("sent %d packets, want %d", len(ids), len(want))
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("packet %d is %d, want %d", i, ids[i], want[i])
+		}
+	}
+	for i := 1; i < len(nonces); i++ {
+		if nonces[i] != nonces[i-1]+1 {
+			t.Fatalf("nonces out of order: %v", nonces)
+		}
+	}
+}
+
+func TestSendStagedCoalesced(t *testing.T) {
+	peer := newSendTestPeer(t, 8)
+	clock := newVirtualClock()
+	peer.device.clock = clock
+
+	// Containers staged before the sender gets to them are sealed as one
+	// batch, in order. The rest waits for the sender to finish it.
+	peer.StagePackets(testPackets(peer, 0, 1))
+	peer.StagePackets(testPackets(peer, 2, 3, 4))
+	peer.StagePackets(testPackets(peer, 5, 6))
+	peer.StagePackets(testPackets(peer, 7, 8))
+	peer.SendStagedPackets()
+	if n := len(peer.device.queue.encryption.c); n != 1 {
+		t.Fatalf("queued %d batches for encryption, want 1", n)
+	}
+	if first := <-peer.device.queue.encryption.c; len(first.elems) != 7 {
+		t.Fatalf("first batch holds %d packets, want 7", len(first.elems))
+	}
+	ids, nonces := drainOutbound(peer)
+
+	peer.SendStagedPackets()
+	clock.Advance(MaxCoalesceDelay)
+	more, moreNonces := drainOutbound(peer)
+	ids, nonces = append(ids, more...), append(nonces, moreNonces...)
+
+	if len(ids) != 9 {
+		t.Fatalf("sent %d packets, want 9", len(ids))
+	}
+	for i, id := range ids {
+		if id != uint16(i) || nonces[i] != uint64(i) {
+			t.Fatalf("packet %d is %d with nonce %d", i, id, nonces[i])
+		}
+	}
+}
+
+func TestSendStagedLatencyCap(t *testing.T) {
+	peer := newSendTestPeer(t, 8)
+	clock := newVirtualClock()
+	peer.device.clock = clock
+
+	// While the sender is busy, less than a batch is held back for more
+	fillOutbound(peer, cap(peer.queue.outbound.c)-1)
+	peer.StagePackets(testPackets(peer, 0, 1))
+	peer.SendStagedPackets()
+	clock.Advance(MaxCoalesceDelay / 2)
+	peer.StagePackets(testPackets(peer, 2, 3))
+	peer.SendStagedPackets()
+	if n := len(peer.queue.outbound.c); n != 1 {
+		t.Fatalf("sent %d batches before the cap, want none", n-1)
+	}
+
+	// The timer sends them once the oldest waited MaxCoalesceDelay
+	clock.Advance(MaxCoalesceDelay / 2)
+	if ids, _ := drainOutbound(peer); len(ids) != 4 || len(peer.device.queue.encryption.c) != 1 {
+		t.Fatalf("sent %v in %d batches at the cap, want 4 packets in 1", ids, len(peer.device.queue.encryption.c))
+	}
+
+	// A full batch isn't held back
+	fillOutbound(peer, cap(peer.queue.outbound.c)-1)
+	peer.StagePackets(testPackets(peer, 4, 5, 6, 7))
+	peer.StagePackets(testPackets(peer, 8, 9, 10, 11))
+	peer.SendStagedPackets()
+	if ids, _ := drainOutbound(peer); len(ids) != 8 {
+		t.Fatalf("sent %d packets of a full batch, want 8", len(ids))
+	}
+}
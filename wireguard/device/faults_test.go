@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/conn/bindtest"
+	"github.com/bepass-org/warp-plus/wireguard/tun/tuntest"
+)
+
+// genFaultTestPair creates a clockTestPair whose binds impair what they
+// send as set on the returned FaultBinds.
+func genFaultTestPair(t *testing.T) (*clockTestPair, [2]*bindtest.FaultBind) {
+	var faults [2]*bindtest.FaultBind
+	i := 0
+	pair := genClockTestPair(t, func(d *Device) {
+		faults[i] = bindtest.NewFaultBind(d.net.bind, int64(i+1))
+		d.net.bind = faults[i]
+		i++
+	})
+	return pair, faults
+}
+
+func TestFaultsHandshakeLoss(t *testing.T) {
+	pair, faults := genFaultTestPair(t)
+	faults[0].SetFaults(bindtest.Faults{Loss: 1})
+
+	p0, p1 := &pair.testPair[0], &pair.testPair[1]
+	p1.tun.Outbound <- tuntest.Ping(p0.ip, p1.ip)
+	const lost = 3
+	for want := int64(1); want <= lost; want++ {
+		waitFor(t, "handshake response", func() bool {
+			return pair.initiated[1].Load() == int32(want) && faults[0].Dropped() == want
+		})
+		if want == lost {
+			faults[0].SetFaults(bindtest.Faults{})
+		}
+		pair.clock.Advance(RekeyTimeout + RekeyTimeoutJitterMaxMs*time.Millisecond)
+	}
+
+	select {
+	case <-p0.tun.Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping did not transit once the responses got through")
+	}
+	if n := pair.initiated[1].Load(); n != lost+1 {
+		t.Fatalf("got %d initiations, want %d", n, lost+1)
+	}
+}
+
+func TestFaultsReplayWindow(t *testing.T) {
+	pair, faults := genFaultTestPair(t)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	faults[1].SetFaults(bindtest.Faults{
+		Duplicate:    0.3,
+		Reorder:      0.3,
+		ReorderDelay: 5 * time.Millisecond,
+		Jitter:       time.Millisecond,
+	})
+
+	// Every packet has to come out of the tunnel once, however late or
+	// often the datagram carrying it arrived.
+	const count = 200
+	p0, p1 := &pair.testPair[0], &pair.testPair[1]
+	go func() {
+		for i := uint16(0); i < count; i++ {
+			msg := tuntest.Ping(p0.ip, p1.ip)
+			binary.BigEndian.PutUint16(msg[len(msg)-2:], i)
+			p1.tun.Outbound <- msg
+		}
+	}()
+	seen := make(map[uint16]bool)
+	deadline := time.After(5 * time.Second)
+	for len(seen) < count {
+		select {
+		case msg := <-p0.tun.Inbound:
+			seq := binary.BigEndian.Uint16(msg[len(msg)-2:])
+			if seen[seq] {
+				t.Fatalf("packet %d came out twice", seq)
+			}
+			seen[seq] = true
+		case <-deadline:
+			t.Fatalf("%d of %d packets came out", len(seen), count)
+		}
+	}
+
+	faults[1].Wait()
+	select {
+	case msg := <-p0.tun.Inbound:
+		t.Fatalf("packet %d came out twice", binary.BigEndian.Uint16(msg[len(msg)-2:]))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,252 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
+/* Initiation framing changes the fixed 148 byte shape of handshake
+ * initiations, which some networks classify first packets by. Initiations
+ * are wrapped after random junk and split over several datagrams, the
+ * first of which may be made to look like a QUIC initial. Peers don't
+ * understand the framing, so it is only of use through a relay that
+ * restores initiations with an InitiationReassembler before forwarding
+ * them, or with a peer running this device, which strips QUIC and junk
+ * framing on receive.
+ */
+
+const (
+	MessageInitiationFragmentType = 5
+	MessageInitiationJunkType     = 6
+
+	// MaxInitiationFragments bounds the datagrams an initiation is split
+	// over, and MaxInitiationJunk the random bytes it is wrapped after
+	MaxInitiationFragments = 8
+	MaxInitiationJunk      = 255
+
+	// InitiationMimicQUIC wraps the first datagram of an initiation in the
+	// long header of a QUIC version 1 initial, padded to its minimum size
+	InitiationMimicQUIC = "quic"
+)
+
+const (
+	// initiationFragmentHeaderSize is the type, the initiation id, and the
+	// index and count of a fragment
+	initiationFragmentHeaderSize = 4
+	// initiationJunkHeaderSize is the type and length of the junk
+	initiationJunkHeaderSize = 2
+
+	// quicMimicHeaderSize is the first byte, version, destination
+	// connection id length and id, empty source connection id and token,
+	// and two byte length of the mimicked initial, followed by a one byte
+	// packet number
+	quicMimicHeaderSize = 1 + 4 + 1 + quicMimicDCIDSize + 1 + 1 + 2
+	quicMimicDCIDSize   = 8
+	quicMimicMinSize    = 1200
+)
+
+// SetInitiationFraming splits handshake initiations over up to fragments
+// datagrams and wraps them after up to junk random bytes, both counts
+// picked at random for every initiation. Zeroes, the default, send plain
+// initiations.
+func (device *Device) SetInitiationFraming(fragments, junk int) {
+	device.initFragments.Store(int32(min(max(fragments, 0), MaxInitiationFragments)))
+	device.initJunk.Store(int32(min(max(junk, 0), MaxInitiationJunk)))
+}
+
+// SetInitiationMimicry makes the first datagram of handshake initiations
+// look like another protocol, InitiationMimicQUIC or the empty name for
+// none.
+func (device *Device) SetInitiationMimicry(name string) error {
+	switch name {
+	case "":
+		device.initQUIC.Store(false)
+	case InitiationMimicQUIC:
+		device.initQUIC.Store(true)
+	default:
+		return errors.New("unknown initiation mimicry")
+	}
+	return nil
+}
+
+// frameInitiation returns the datagrams packet is sent as.
+func (device *Device) frameInitiation(packet []byte) [][]byte {
+	if junk := int(device.initJunk.Load()); junk > 0 {
+		n := int(randomInt(1, uint64(junk)+1))
+		framed := make([]byte, initiationJunkHeaderSize+n+len(packet))
+		framed[0] = MessageInitiationJunkType
+		framed[1] = byte(n)
+		rand.Read(framed[initiationJunkHeaderSize : initiationJunkHeaderSize+n])
+		copy(framed[initiationJunkHeaderSize+n:], packet)
+		packet = framed
+	}
+
+	fragments := int(device.initFragments.Load())
+	if fragments < 2 {
+		if device.initQUIC.Load() {
+			packet = wrapQUIC(packet)
+		}
+		return [][]byte{packet}
+	}
+	count := int(randomInt(2, uint64(fragments)+1))
+
+	// cut at distinct random points so fragment sizes vary
+	cuts := make([]int, 0, count+1)
+	cuts = append(cuts, 0)
+	for len(cuts) < count {
+		cut := int(randomInt(1, uint64(len(packet))))
+		if !slices.Contains(cuts, cut) {
+			cuts = append(cuts, cut)
+		}
+	}
+	cuts = append(cuts, len(packet))
+	slices.Sort(cuts)
+
+	var id [1]byte
+	rand.Read(id[:])
+	bufs := make([][]byte, count)
+	for i := range bufs {
+		chunk := packet[cuts[i]:cuts[i+1]]
+		buf := make([]byte, initiationFragmentHeaderSize+len(chunk))
+		buf[0] = MessageInitiationFragmentType
+		buf[1] = id[0]
+		buf[2] = byte(i)
+		buf[3] = byte(count)
+		copy(buf[initiationFragmentHeaderSize:], chunk)
+		bufs[i] = buf
+	}
+	if device.initQUIC.Load() {
+		bufs[0] = wrapQUIC(bufs[0])
+	}
+	return bufs
+}
+
+// wrapQUIC wraps payload in the long header of a QUIC initial. The bits
+// header protection would mask, the ids, the packet number and the padding
+// are random.
+func wrapQUIC(payload []byte) []byte {
+	b := make([]byte, max(quicMimicHeaderSize+1+len(payload), quicMimicMinSize))
+	rand.Read(b)
+	b[0] = 0xc0 | b[0]&0x0f
+	binary.BigEndian.PutUint32(b[1:5], 1)
+	b[5] = quicMimicDCIDSize
+	b[6+quicMimicDCIDSize] = 0 // source connection id length
+	b[7+quicMimicDCIDSize] = 0 // token length
+	binary.BigEndian.PutUint16(b[quicMimicHeaderSize-2:], 0x4000|uint16(1+len(payload)))
+	copy(b[quicMimicHeaderSize+1:], payload)
+	return b
+}
+
+// unwrapQUIC returns the payload of a datagram wrapped by wrapQUIC,
+// reporting false for anything else.
+func unwrapQUIC(b []byte) ([]byte, bool) {
+	if len(b) < quicMimicHeaderSize+1 || b[0]&0xf0 != 0xc0 || binary.BigEndian.Uint32(b[1:5]) != 1 ||
+		b[5] != quicMimicDCIDSize || b[6+quicMimicDCIDSize] != 0 || b[7+quicMimicDCIDSize] != 0 {
+		return nil, false
+	}
+	length := binary.BigEndian.Uint16(b[quicMimicHeaderSize-2:])
+	if length&0xc000 != 0x4000 {
+		return nil, false
+	}
+	end := quicMimicHeaderSize + int(length&0x3fff)
+	if length&0x3fff < 2 || end > len(b) {
+		return nil, false
+	}
+	return b[quicMimicHeaderSize+1 : end], true
+}
+
+// stripInitiationFraming returns the initiation in packet if it was wrapped
+// as a QUIC initial or after junk, or packet itself. Fragments need state
+// and are left to an InitiationReassembler.
+func stripInitiationFraming(packet []byte) []byte {
+	if payload, ok := unwrapQUIC(packet); ok {
+		packet = payload
+	}
+	if len(packet) >= initiationJunkHeaderSize && packet[0] == MessageInitiationJunkType {
+		if initiation, ok := unwrapInitiation(packet); ok {
+			return initiation
+		}
+	}
+	return packet
+}
+
+// InitiationReassembler restores the handshake initiations a device with
+// initiation framing sends, for a relay to forward them to the peer. A relay
+// keeps one per client. It is not safe for concurrent use.
+type InitiationReassembler struct {
+	id        byte
+	count     int
+	received  int
+	fragments [MaxInitiationFragments][]byte
+}
+
+// Restore returns the message to forward for packet, which is packet itself
+// unless framed. It reports false while an initiation is still missing
+// fragments, or if packet is malformed.
+func (r *InitiationReassembler) Restore(packet []byte) ([]byte, bool) {
+	if payload, ok := unwrapQUIC(packet); ok {
+		packet = payload
+	}
+	if len(packet) < 4 {
+		return packet, true
+	}
+
+	switch packet[0] {
+	case MessageInitiationFragmentType:
+		if len(packet) <= initiationFragmentHeaderSize {
+			return nil, false
+		}
+		id, index, count := packet[1], int(packet[2]), int(packet[3])
+		if count < 2 || count > MaxInitiationFragments || index >= count {
+			return nil, false
+		}
+		// A new initiation drops what is left of the previous one
+		if r.count == 0 || id != r.id || count != r.count {
+			r.reset()
+			r.id, r.count = id, count
+		}
+		if r.fragments[index] == nil {
+			r.fragments[index] = append([]byte(nil), packet[initiationFragmentHeaderSize:]...)
+			r.received++
+		}
+		if r.received < r.count {
+			return nil, false
+		}
+
+		var whole []byte
+		for _, fragment := range r.fragments[:r.count] {
+			whole = append(whole, fragment...)
+		}
+		r.reset()
+		if len(whole) >= 4 && whole[0] == MessageInitiationJunkType {
+			return unwrapInitiation(whole)
+		}
+		return whole, true
+
+	case MessageInitiationJunkType:
+		return unwrapInitiation(packet)
+	}
+	return packet, true
+}
+
+func (r *InitiationReassembler) reset() {
+	*r = InitiationReassembler{}
+}
+
+// unwrapInitiation strips the junk an initiation was wrapped after. Only
+// the first byte of the type is checked, the others may carry reserved
+// bytes.
+func unwrapInitiation(packet []byte) ([]byte, bool) {
+	n := initiationJunkHeaderSize + int(packet[1])
+	if len(packet) < n+MessageInitiationSize || packet[n] != MessageInitiationType {
+		return nil, false
+	}
+	return packet[n:], true
+}
@@ -0,0 +1,100 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"crypto/rand"
+	mathrand "math/rand"
+	"testing"
+)
+
+func TestInitiationFraming(t *testing.T) {
+	packet := make([]byte, MessageInitiationSize)
+	rand.Read(packet)
+	packet[0] = MessageInitiationType
+
+	for _, tt := range []struct {
+		fragments, junk int
+		mimic           string
+	}{
+		{0, 0, ""},
+		{0, 40, ""},
+		{2, 0, ""},
+		{MaxInitiationFragments, 0, ""},
+		{4, MaxInitiationJunk, ""},
+		{0, 0, InitiationMimicQUIC},
+		{3, 16, InitiationMimicQUIC},
+	} {
+		device := new(Device)
+		device.SetInitiationFraming(tt.fragments, tt.junk)
+		if err := device.SetInitiationMimicry(tt.mimic); err != nil {
+			t.Fatal(err)
+		}
+
+		var r InitiationReassembler
+		for i := 0; i < 20; i++ {
+			bufs := device.frameInitiation(packet)
+			if tt.fragments > 1 && (len(bufs) < 2 || len(bufs) > tt.fragments) {
+				t.Fatalf("%+v: sent %d fragments", tt, len(bufs))
+			}
+			if tt.mimic != "" && (bufs[0][0]&0xf0 != 0xc0 || len(bufs[0]) < quicMimicMinSize) {
+				t.Fatalf("%+v: first datagram %x... of %d bytes is no quic initial", tt, bufs[0][:8], len(bufs[0]))
+			}
+			mathrand.Shuffle(len(bufs), func(i, j int) { bufs[i], bufs[j] = bufs[j], bufs[i] })
+
+			var restored []byte
+			for j, buf := range bufs {
+				msg, ok := r.Restore(buf)
+				if ok != (j == len(bufs)-1) {
+					t.Fatalf("%+v: fragment %d of %d restored %v", tt, j, len(bufs), ok)
+				}
+				restored = msg
+			}
+			if !bytes.Equal(restored, packet) {
+				t.Fatalf("%+v: restored %x, want %x", tt, restored, packet)
+			}
+		}
+	}
+}
+
+func TestInitiationReassemblerPassthrough(t *testing.T) {
+	var r InitiationReassembler
+	for _, packet := range [][]byte{
+		{MessageTransportType, 0, 0, 0, 1, 2, 3},
+		{1, 2},
+	} {
+		if msg, ok := r.Restore(packet); !ok || !bytes.Equal(msg, packet) {
+			t.Fatalf("restored %x to %x, %v", packet, msg, ok)
+		}
+	}
+	if _, ok := r.Restore([]byte{MessageInitiationJunkType, 200, 0, 0, 0}); ok {
+		t.Fatal("restored truncated junk")
+	}
+}
+
+func TestStripInitiationFraming(t *testing.T) {
+	packet := make([]byte, MessageInitiationSize)
+	rand.Read(packet)
+	packet[0] = MessageInitiationType
+
+	device := new(Device)
+	device.SetInitiationFraming(0, 32)
+	if err := device.SetInitiationMimicry(InitiationMimicQUIC); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if got := stripInitiationFraming(device.frameInitiation(packet)[0]); !bytes.Equal(got, packet) {
+			t.Fatalf("stripped to %x, want %x", got, packet)
+		}
+	}
+	if got := stripInitiationFraming(packet); !bytes.Equal(got, packet) {
+		t.Fatal("plain initiation changed")
+	}
+	if err := device.SetInitiationMimicry("dtls"); err == nil {
+		t.Fatal("unknown mimicry accepted")
+	}
+}
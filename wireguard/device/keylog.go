@@ -0,0 +1,25 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// sessionKeys is the key material of a handshake, captured for the keylog
+// of builds with the wgkeylog tag.
+type sessionKeys struct {
+	isInitiator    bool
+	localIndex     uint32
+	remoteIndex    uint32
+	localEphemeral NoisePrivateKey
+	remoteStatic   NoisePublicKey
+	presharedKey   NoisePresharedKey
+	handshakeHash  [blake2s.Size]byte
+	sendKey        [chacha20poly1305.KeySize]byte
+	recvKey        [chacha20poly1305.KeySize]byte
+}
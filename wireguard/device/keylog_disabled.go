@@ -0,0 +1,22 @@
+//go:build !wgkeylog
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"io"
+)
+
+const keyLogEnabled = false
+
+// SetKeyLog fails, keylog support needs a build with the wgkeylog tag.
+func SetKeyLog(w io.Writer) error {
+	return errors.New("keylog support needs a build with the wgkeylog tag")
+}
+
+func (peer *Peer) logSessionKeys(keys *sessionKeys) {}
@@ -0,0 +1,99 @@
+//go:build wgkeylog
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// keyLogEnv names the file the keys of every session are appended to, in
+// the keylog format of the wireshark WireGuard dissector (wg.keylog_file).
+// Lines starting with # hold the derived transport keys and the handshake
+// hash for comparing against other implementations by hand.
+const keyLogEnv = "WG_KEYLOGFILE"
+
+const keyLogEnabled = true
+
+var keyLog struct {
+	sync.Mutex
+	once sync.Once
+	w    io.Writer
+}
+
+// SetKeyLog appends the keys of every later session to w instead of the
+// file named by WG_KEYLOGFILE. Whoever reads w can decrypt the tunnel.
+func SetKeyLog(w io.Writer) error {
+	keyLog.once.Do(func() {})
+
+	keyLog.Lock()
+	defer keyLog.Unlock()
+	keyLog.w = w
+	return nil
+}
+
+func openKeyLog() {
+	path := os.Getenv(keyLogEnv)
+	if path == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open %s: %v\n", keyLogEnv, err)
+		return
+	}
+	keyLog.w = f
+}
+
+func (peer *Peer) logSessionKeys(keys *sessionKeys) {
+	keyLog.once.Do(openKeyLog)
+	keyLog.Lock()
+	enabled := keyLog.w != nil
+	keyLog.Unlock()
+	if !enabled || keys.localEphemeral.IsZero() {
+		return
+	}
+
+	device := peer.device
+	device.staticIdentity.RLock()
+	localStatic := device.staticIdentity.privateKey
+	device.staticIdentity.RUnlock()
+
+	b64 := base64.StdEncoding.EncodeToString
+	role := "responder"
+	if keys.isInitiator {
+		role = "initiator"
+	}
+	entry := fmt.Sprintf("# %s %s peer=%s local_index=%d remote_index=%d suite=%s\n"+
+		"# HANDSHAKE_HASH = %s\n"+
+		"# SEND_KEY = %s\n"+
+		"# RECEIVE_KEY = %s\n"+
+		"LOCAL_STATIC_PRIVATE_KEY = %s\n"+
+		"REMOTE_STATIC_PUBLIC_KEY = %s\n"+
+		"LOCAL_EPHEMERAL_PRIVATE_KEY = %s\n"+
+		"PRESHARED_KEY = %s\n",
+		time.Now().UTC().Format(time.RFC3339Nano), role, peer, keys.localIndex, keys.remoteIndex, device.suite.Load().name,
+		b64(keys.handshakeHash[:]),
+		b64(keys.sendKey[:]),
+		b64(keys.recvKey[:]),
+		b64(localStatic[:]),
+		b64(keys.remoteStatic[:]),
+		b64(keys.localEphemeral[:]),
+		b64(keys.presharedKey[:]),
+	)
+
+	keyLog.Lock()
+	defer keyLog.Unlock()
+	if keyLog.w != nil {
+		_, _ = io.WriteString(keyLog.w, entry)
+	}
+}
@@ -0,0 +1,80 @@
+//go:build wgkeylog
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyLog(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "keylog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNil(t, SetKeyLog(f))
+	defer SetKeyLog(nil)
+
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1, err := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	assertNil(t, err)
+	peer2, err := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+	assertNil(t, err)
+	peer1.Start()
+	peer2.Start()
+
+	msg1, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	if dev2.ConsumeMessageInitiation(msg1) == nil {
+		t.Fatal("handshake failed at initiation message")
+	}
+	msg2, err := dev2.CreateMessageResponse(peer1)
+	assertNil(t, err)
+	if dev1.ConsumeMessageResponse(msg2) == nil {
+		t.Fatal("handshake failed at response message")
+	}
+	assertNil(t, peer1.BeginSymmetricSession())
+	assertNil(t, peer2.BeginSymmetricSession())
+
+	data, err := os.ReadFile(f.Name())
+	assertNil(t, err)
+	entries := make([]map[string]string, 0, 2)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if strings.HasPrefix(line, "# ") && !strings.Contains(line, " = ") {
+			entries = append(entries, make(map[string]string))
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "# "), " = ")
+		if !ok || len(entries) == 0 {
+			t.Fatalf("malformed keylog line %q", line)
+		}
+		entries[len(entries)-1][key] = value
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d keylog entries, want 2", len(entries))
+	}
+
+	responder, initiator := entries[0], entries[1]
+	if responder["SEND_KEY"] != initiator["RECEIVE_KEY"] || responder["RECEIVE_KEY"] != initiator["SEND_KEY"] {
+		t.Error("transport keys of the initiator and responder don't match")
+	}
+	if responder["HANDSHAKE_HASH"] != initiator["HANDSHAKE_HASH"] {
+		t.Error("handshake hashes don't match")
+	}
+	for _, key := range []string{"LOCAL_STATIC_PRIVATE_KEY", "REMOTE_STATIC_PUBLIC_KEY", "LOCAL_EPHEMERAL_PRIVATE_KEY", "PRESHARED_KEY"} {
+		if initiator[key] == "" {
+			t.Errorf("keylog entry lacks %s", key)
+		}
+	}
+}
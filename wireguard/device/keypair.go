@@ -23,6 +23,7 @@ import (
 
 type Keypair struct {
 	sendNonce    atomic.Uint64
+	received     atomic.Uint64
 	send         cipher.AEAD
 	receive      cipher.AEAD
 	replayFilter replay.Filter
@@ -45,6 +46,29 @@ func (kp *Keypairs) Current() *Keypair {
 	return kp.current
 }
 
+// KeypairStats describes the current keypair of a peer, the session
+// handshaked last that both ends have confirmed.
+type KeypairStats struct {
+	Created  time.Time
+	Sent     uint64
+	Received uint64
+	// Rotations is how many keypairs have become current since the peer
+	// was created
+	Rotations uint64
+}
+
+// KeypairStats returns the statistics of the current keypair of the peer.
+// Created is zero when there is none.
+func (peer *Peer) KeypairStats() KeypairStats {
+	stats := KeypairStats{Rotations: peer.keypairRotations.Load()}
+	if keypair := peer.keypairs.Current(); keypair != nil {
+		stats.Created = keypair.created
+		stats.Sent = keypair.sendNonce.Load()
+		stats.Received = keypair.received.Load()
+	}
+	return stats
+}
+
 func (device *Device) DeleteKeypair(key *Keypair) {
 	if key != nil {
 		device.indexTable.Delete(key.localIndex)
@@ -0,0 +1,43 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeypairStats(t *testing.T) {
+	pair := genClockTestPair(t)
+	if stats := pair.peer(1).KeypairStats(); !stats.Created.IsZero() || stats.Rotations != 0 {
+		t.Fatalf("got %+v before the first handshake", stats)
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	pair.settle(t)
+
+	initiator := pair.peer(1)
+	first := initiator.KeypairStats()
+	if first.Rotations != 1 || first.Sent == 0 || first.Received == 0 {
+		t.Fatalf("got %+v after the first session, want one rotation with messages both ways", first)
+	}
+
+	pair.clock.Advance(RekeyAfterTime + time.Second)
+	pair.Send(t, Ping, nil)
+	// The responder puts the new keypair in use once the keepalive
+	// confirming it arrives
+	waitFor(t, "rekey", func() bool {
+		return initiator.KeypairStats().Rotations == 2 && pair.peer(0).KeypairStats().Rotations == 2
+	})
+	pair.Send(t, Pong, nil)
+	second := initiator.KeypairStats()
+	if !second.Created.After(first.Created) {
+		t.Fatalf("rotated keypair created at %v, first at %v", second.Created, first.Created)
+	}
+	if second.Sent == 0 || second.Received != 1 {
+		t.Fatalf("got %+v after the pong, want the keepalive sent and the pong received", second)
+	}
+}
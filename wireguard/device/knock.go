@@ -0,0 +1,156 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+
+	"github.com/bepass-org/warp-plus/wireguard/conn"
+)
+
+/* Knocking keeps a responder silent towards anyone who doesn't hold the
+ * knock key. Before every initiation a knocking device sends a knock, a
+ * datagram of a random nonce and a mac of it and the current time keyed by
+ * the knock key, which looks like random bytes on the wire. A responder
+ * with the key drops initiations unanswered, before even checking their
+ * mac, unless a fresh knock came from the same source just before, so an
+ * active prober can't tell it from a closed port. Knocks are only
+ * accepted once, and only within KnockWindow of the responder's clock.
+ */
+
+const (
+	// KnockSize is the size of a knock datagram
+	KnockSize = knockNonceSize + knockMACSize
+	// KnockWindow is the time slot knocks are made for. Knocks from the
+	// slots next to the current one are accepted too, for clocks drifting
+	// apart.
+	KnockWindow = 30 * time.Second
+	// KnockOpenTime is how long a knock lets initiations from its source
+	// through
+	KnockOpenTime = RekeyTimeout
+
+	knockNonceSize = 16
+	knockMACSize   = 24
+	// maxKnocks bounds the nonces and sources remembered
+	maxKnocks = 4096
+)
+
+// SetKnockKey makes the device knock with key before sending handshake
+// initiations, and drop those it receives from sources that didn't knock
+// with it. Peers have to share the key. A zero key, the default, disables
+// knocking.
+func (device *Device) SetKnockKey(key NoisePresharedKey) {
+	device.knock.Lock()
+	defer device.knock.Unlock()
+
+	if key == (NoisePresharedKey{}) {
+		device.knock.key.Store(nil)
+	} else {
+		device.knock.key.Store(&key)
+	}
+	device.knock.seen = make(map[[knockNonceSize]byte]time.Time)
+	device.knock.open = make(map[string]time.Time)
+}
+
+// knockMAC returns the mac of a knock with nonce for the time slot.
+func knockMAC(key *NoisePresharedKey, nonce []byte, slot int64) []byte {
+	var buf [blake2s.Size]byte
+	mac, _ := blake2s.New256(key[:])
+	mac.Write(nonce)
+	binary.Write(mac, binary.LittleEndian, slot)
+	return mac.Sum(buf[:0])[:knockMACSize]
+}
+
+func knockSlot(now time.Time) int64 {
+	return now.Unix() / int64(KnockWindow/time.Second)
+}
+
+// createKnock returns a knock to send before an initiation, nil if the
+// device doesn't knock.
+func (device *Device) createKnock() []byte {
+	key := device.knock.key.Load()
+	if key == nil {
+		return nil
+	}
+	knock := make([]byte, KnockSize)
+	if _, err := rand.Read(knock[:knockNonceSize]); err != nil {
+		return nil
+	}
+	copy(knock[knockNonceSize:], knockMAC(key, knock[:knockNonceSize], knockSlot(device.now())))
+	return knock
+}
+
+// receivedKnock reports whether packet is a valid knock, and if so lets
+// initiations from endpoint through for KnockOpenTime.
+func (device *Device) receivedKnock(packet []byte, endpoint conn.Endpoint) bool {
+	key := device.knock.key.Load()
+	if key == nil || len(packet) != KnockSize {
+		return false
+	}
+
+	now := device.now()
+	nonce, mac := packet[:knockNonceSize], packet[knockNonceSize:]
+	valid := false
+	for slot := knockSlot(now) - 1; slot <= knockSlot(now)+1; slot++ {
+		if hmac.Equal(mac, knockMAC(key, nonce, slot)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return false
+	}
+
+	device.knock.Lock()
+	defer device.knock.Unlock()
+
+	// A nonce is remembered past the last slot its knock is valid in
+	seen := [knockNonceSize]byte(nonce)
+	if _, ok := device.knock.seen[seen]; ok {
+		device.log.Verbosef("Received replayed knock from %s", endpoint.DstToString())
+		return true
+	}
+	if !addKnock(device.knock.seen, seen, now, now.Add(3*KnockWindow)) ||
+		!addKnock(device.knock.open, endpoint.DstToString(), now, now.Add(KnockOpenTime)) {
+		device.log.Verbosef("Dropped knock from %s, too many outstanding", endpoint.DstToString())
+	}
+	return true
+}
+
+// addKnock sets m[k] to expiry, making room by dropping expired entries.
+// It reports false if there was none.
+func addKnock[K comparable](m map[K]time.Time, k K, now, expiry time.Time) bool {
+	if len(m) >= maxKnocks {
+		for k, expiry := range m {
+			if now.After(expiry) {
+				delete(m, k)
+			}
+		}
+		if len(m) >= maxKnocks {
+			return false
+		}
+	}
+	m[k] = expiry
+	return true
+}
+
+// knocked reports whether initiations from endpoint are let through, as
+// the device doesn't require knocks or endpoint knocked recently.
+func (device *Device) knocked(endpoint conn.Endpoint) bool {
+	if device.knock.key.Load() == nil {
+		return true
+	}
+
+	device.knock.Lock()
+	expiry, ok := device.knock.open[endpoint.DstToString()]
+	device.knock.Unlock()
+	return ok && !device.now().After(expiry)
+}
@@ -0,0 +1,88 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/conn/bindtest"
+	"github.com/bepass-org/warp-plus/wireguard/tun/tuntest"
+)
+
+func TestKnock(t *testing.T) {
+	key, other := NoisePresharedKey{1}, NoisePresharedKey{2}
+	tests := []struct {
+		name    string
+		keys    [2]NoisePresharedKey
+		answers bool
+	}{
+		{"both", [2]NoisePresharedKey{key, key}, true},
+		{"initiator without", [2]NoisePresharedKey{key, {}}, false},
+		{"other key", [2]NoisePresharedKey{key, other}, false},
+		{"responder without", [2]NoisePresharedKey{{}, key}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pair := genClockTestPair(t)
+			for i := range pair.testPair {
+				pair.testPair[i].dev.SetKnockKey(tt.keys[i])
+			}
+			if tt.answers {
+				pair.Send(t, Ping, nil)
+				pair.Send(t, Pong, nil)
+				return
+			}
+
+			// The responder must not give itself away by sending anything
+			var sent atomic.Int32
+			pair.testPair[0].dev.net.bind.(*bindtest.ChannelBind).SetFilter(func([]byte) bool {
+				sent.Add(1)
+				return true
+			})
+			p0, p1 := &pair.testPair[0], &pair.testPair[1]
+			p1.tun.Outbound <- tuntest.Ping(p0.ip, p1.ip)
+			waitFor(t, "initiation", func() bool {
+				return pair.initiated[1].Load() == 1
+			})
+			time.Sleep(50 * time.Millisecond)
+			if n := sent.Load(); n != 0 {
+				t.Fatalf("responder sent %d datagrams", n)
+			}
+			if n := pair.peer(0).rxBytes.Load(); n != 0 {
+				t.Fatalf("responder accepted %d bytes", n)
+			}
+		})
+	}
+}
+
+func TestKnockReplay(t *testing.T) {
+	pair := genClockTestPair(t)
+	dev := pair.testPair[0].dev
+	dev.SetKnockKey(NoisePresharedKey{1})
+	source, replayer := bindtest.ChannelEndpoint(1), bindtest.ChannelEndpoint(2)
+
+	knock := dev.createKnock()
+	if !dev.receivedKnock(knock, source) || !dev.knocked(source) {
+		t.Fatal("knock not accepted")
+	}
+	dev.receivedKnock(knock, replayer)
+	if dev.knocked(replayer) {
+		t.Fatal("replayed knock let initiations through")
+	}
+
+	pair.clock.Advance(KnockOpenTime + time.Millisecond)
+	if dev.knocked(source) {
+		t.Fatal("knock let initiations through past KnockOpenTime")
+	}
+
+	stale := dev.createKnock()
+	pair.clock.Advance(2 * KnockWindow)
+	if dev.receivedKnock(stale, source) {
+		t.Fatal("knock accepted past its time slot")
+	}
+}
@@ -0,0 +1,131 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// handshakeLatencyBuckets are the upper bounds of the handshake latency
+// histogram, from a nearby endpoint up to several retransmissions. Longer
+// handshakes fall into a last, open bucket.
+var handshakeLatencyBuckets = [...]time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	75 * time.Millisecond,
+	100 * time.Millisecond,
+	150 * time.Millisecond,
+	200 * time.Millisecond,
+	300 * time.Millisecond,
+	500 * time.Millisecond,
+	750 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	20 * time.Second,
+}
+
+// HandshakeLatency summarizes how long handshakes took, from the first
+// initiation to consuming the response, retransmissions included.
+type HandshakeLatency struct {
+	Count         uint64
+	P50, P95, P99 time.Duration
+}
+
+// latencyHistogram records the latency of handshake attempts. Unlike
+// rttEstimator it keeps the retransmitted attempts, which are what makes a
+// tunnel slow to come up.
+type latencyHistogram struct {
+	// started is when the first initiation of the outstanding attempt went
+	// out in nano seconds since epoch, zero when none is outstanding
+	started atomic.Int64
+
+	mu     sync.Mutex
+	counts [len(handshakeLatencyBuckets) + 1]uint64
+	total  uint64
+	max    time.Duration
+}
+
+func (h *latencyHistogram) initiationSent(now time.Time) {
+	h.started.CompareAndSwap(0, now.UnixNano())
+}
+
+// abandon forgets the outstanding attempt once the handshake gives up.
+func (h *latencyHistogram) abandon() {
+	h.started.Store(0)
+}
+
+func (h *latencyHistogram) responseReceived(now time.Time) {
+	started := h.started.Swap(0)
+	if started == 0 {
+		return
+	}
+	h.observe(max(now.Sub(time.Unix(0, started)), 0))
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := 0
+	for i < len(handshakeLatencyBuckets) && d > handshakeLatencyBuckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.total++
+	h.max = max(h.max, d)
+}
+
+// percentile interpolates the q quantile linearly within its bucket, as
+// prometheus does. The open bucket ends at the longest handshake seen.
+// h.mu must be held.
+func (h *latencyHistogram) percentile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+
+	rank := q * float64(h.total)
+	var seen uint64
+	for i, n := range h.counts {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		var lower, upper time.Duration
+		if i > 0 {
+			lower = handshakeLatencyBuckets[i-1]
+		}
+		if i < len(handshakeLatencyBuckets) {
+			upper = min(handshakeLatencyBuckets[i], h.max)
+		} else {
+			upper = h.max
+		}
+		return lower + time.Duration(float64(upper-lower)*(rank-float64(seen))/float64(n))
+	}
+	return h.max
+}
+
+func (h *latencyHistogram) summary() HandshakeLatency {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return HandshakeLatency{
+		Count: h.total,
+		P50:   h.percentile(0.50),
+		P95:   h.percentile(0.95),
+		P99:   h.percentile(0.99),
+	}
+}
+
+// HandshakeLatency returns percentiles of the handshakes the peer
+// initiated, zero before the first one completes.
+func (peer *Peer) HandshakeLatency() HandshakeLatency {
+	return peer.handshakeLatency.summary()
+}
@@ -0,0 +1,55 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	if s := h.summary(); s != (HandshakeLatency{}) {
+		t.Fatalf("summary without samples = %+v, want zero", s)
+	}
+
+	now := time.Unix(1700000000, 0)
+	attempt := func(latency time.Duration, retransmits int) {
+		h.initiationSent(now)
+		for i := 0; i < retransmits; i++ {
+			h.initiationSent(now.Add(RekeyTimeout * time.Duration(i+1)))
+		}
+		now = now.Add(latency)
+		h.responseReceived(now)
+	}
+
+	for i := 0; i < 90; i++ {
+		attempt(40*time.Millisecond, 0)
+	}
+	for i := 0; i < 10; i++ {
+		attempt(5*time.Second+40*time.Millisecond, 1)
+	}
+
+	s := h.summary()
+	if s.Count != 100 {
+		t.Fatalf("count = %d, want 100", s.Count)
+	}
+	if s.P50 <= 25*time.Millisecond || s.P50 > 50*time.Millisecond {
+		t.Errorf("p50 = %v, want within the 25-50ms bucket", s.P50)
+	}
+	// Retransmitted attempts count from their first initiation
+	if s.P95 <= 5*time.Second || s.P99 > 5*time.Second+40*time.Millisecond {
+		t.Errorf("p95, p99 = %v, %v, want within 5s and the longest handshake", s.P95, s.P99)
+	}
+
+	// An abandoned attempt isn't completed by a later response
+	h.initiationSent(now)
+	h.abandon()
+	h.responseReceived(now.Add(time.Hour))
+	if s := h.summary(); s.Count != 100 {
+		t.Errorf("count after abandoned attempt = %d, want 100", s.Count)
+	}
+}
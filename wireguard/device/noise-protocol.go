@@ -50,6 +50,10 @@ const (
 	WGIdentifier      = "WireGuard v1 zx2c4 Jason@zx2c4.com"
 	WGLabelMAC1       = "mac1----"
 	WGLabelCookie     = "cookie--"
+
+	// WGLabelPresharedMAC1 labels the mac1 key derived from the preshared
+	// key, see Device.SetPresharedMAC1
+	WGLabelPresharedMAC1 = "pskmac1-"
 )
 
 const (
@@ -138,8 +142,8 @@ var (
 	ZeroNonce       [chacha20poly1305.NonceSize]byte
 )
 
-func mixKey(dst, c *[blake2s.Size]byte, data []byte) {
-	KDF1(dst, c[:], data)
+func mixKey(suite CipherSuite, dst, c *[blake2s.Size]byte, data []byte) {
+	suite.KDF1(dst, c[:], data)
 }
 
 func mixHash(dst, h *[blake2s.Size]byte, data []byte) {
@@ -163,8 +167,8 @@ func (h *Handshake) mixHash(data []byte) {
 	mixHash(&h.hash, &h.hash, data)
 }
 
-func (h *Handshake) mixKey(data []byte) {
-	mixKey(&h.chainKey, &h.chainKey, data)
+func (h *Handshake) mixKey(suite CipherSuite, data []byte) {
+	mixKey(suite, &h.chainKey, &h.chainKey, data)
 }
 
 /* Do basic precomputations
@@ -175,6 +179,8 @@ func init() {
 }
 
 func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, error) {
+	suite := device.cipherSuite()
+
 	device.staticIdentity.RLock()
 	defer device.staticIdentity.RUnlock()
 
@@ -198,7 +204,7 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 		Ephemeral: handshake.localEphemeral.publicKey(),
 	}
 
-	handshake.mixKey(msg.Ephemeral[:])
+	handshake.mixKey(suite, msg.Ephemeral[:])
 	handshake.mixHash(msg.Ephemeral[:])
 
 	// encrypt static key
@@ -207,13 +213,13 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 		return nil, err
 	}
 	var key [chacha20poly1305.KeySize]byte
-	KDF2(
+	suite.KDF2(
 		&handshake.chainKey,
 		&key,
 		handshake.chainKey[:],
 		ss[:],
 	)
-	aead, _ := chacha20poly1305.New(key[:])
+	aead, _ := suite.NewAEAD(key[:])
 	aead.Seal(msg.Static[:0], ZeroNonce[:], device.staticIdentity.publicKey[:], handshake.hash[:])
 	handshake.mixHash(msg.Static[:])
 
@@ -221,14 +227,14 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	if isZero(handshake.precomputedStaticStatic[:]) {
 		return nil, errInvalidPublicKey
 	}
-	KDF2(
+	suite.KDF2(
 		&handshake.chainKey,
 		&key,
 		handshake.chainKey[:],
 		handshake.precomputedStaticStatic[:],
 	)
-	timestamp := tai64n.Now()
-	aead, _ = chacha20poly1305.New(key[:])
+	timestamp := tai64n.At(device.now())
+	aead, _ = suite.NewAEAD(key[:])
 	aead.Seal(msg.Timestamp[:0], ZeroNonce[:], timestamp[:], handshake.hash[:])
 
 	// assign index
@@ -244,7 +250,32 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	return &msg, nil
 }
 
+// openInitiationStatic decrypts the static public key of the initiator of
+// msg, mixing the message into hash and chainKey up to it. The caller holds
+// the static identity lock.
+func (device *Device) openInitiationStatic(suite CipherSuite, msg *MessageInitiation, hash, chainKey *[blake2s.Size]byte) (NoisePublicKey, bool) {
+	mixHash(hash, &InitialHash, device.staticIdentity.publicKey[:])
+	mixHash(hash, hash, msg.Ephemeral[:])
+	mixKey(suite, chainKey, &InitialChainKey, msg.Ephemeral[:])
+
+	var peerPK NoisePublicKey
+	var key [chacha20poly1305.KeySize]byte
+	ss, err := device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
+	if err != nil {
+		return peerPK, false
+	}
+	suite.KDF2(chainKey, &key, chainKey[:], ss[:])
+	aead, _ := suite.NewAEAD(key[:])
+	if _, err := aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:]); err != nil {
+		return peerPK, false
+	}
+	mixHash(hash, hash, msg.Static[:])
+	return peerPK, true
+}
+
 func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
+	suite := device.cipherSuite()
+
 	var (
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
@@ -257,24 +288,10 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	device.staticIdentity.RLock()
 	defer device.staticIdentity.RUnlock()
 
-	mixHash(&hash, &InitialHash, device.staticIdentity.publicKey[:])
-	mixHash(&hash, &hash, msg.Ephemeral[:])
-	mixKey(&chainKey, &InitialChainKey, msg.Ephemeral[:])
-
-	// decrypt static key
-	var peerPK NoisePublicKey
-	var key [chacha20poly1305.KeySize]byte
-	ss, err := device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
-	if err != nil {
-		return nil
-	}
-	KDF2(&chainKey, &key, chainKey[:], ss[:])
-	aead, _ := chacha20poly1305.New(key[:])
-	_, err = aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:])
-	if err != nil {
+	peerPK, ok := device.openInitiationStatic(suite, msg, &hash, &chainKey)
+	if !ok {
 		return nil
 	}
-	mixHash(&hash, &hash, msg.Static[:])
 
 	// lookup peer
 
@@ -295,14 +312,15 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 		handshake.mutex.RUnlock()
 		return nil
 	}
-	KDF2(
+	var key [chacha20poly1305.KeySize]byte
+	suite.KDF2(
 		&chainKey,
 		&key,
 		chainKey[:],
 		handshake.precomputedStaticStatic[:],
 	)
-	aead, _ = chacha20poly1305.New(key[:])
-	_, err = aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
+	aead, _ := suite.NewAEAD(key[:])
+	_, err := aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
 	if err != nil {
 		handshake.mutex.RUnlock()
 		return nil
@@ -312,7 +330,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	// protect against replay & flood
 
 	replay := !timestamp.After(handshake.lastTimestamp)
-	flood := time.Since(handshake.lastInitiationConsumption) <= HandshakeInitationRate
+	flood := device.since(handshake.lastInitiationConsumption) <= HandshakeInitationRate
 	handshake.mutex.RUnlock()
 	if replay {
 		device.log.Verbosef("%v - ConsumeMessageInitiation: handshake replay @ %v", peer, timestamp)
@@ -334,7 +352,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	if timestamp.After(handshake.lastTimestamp) {
 		handshake.lastTimestamp = timestamp
 	}
-	now := time.Now()
+	now := device.now()
 	if now.After(handshake.lastInitiationConsumption) {
 		handshake.lastInitiationConsumption = now
 	}
@@ -349,6 +367,8 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 }
 
 func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error) {
+	suite := device.cipherSuite()
+
 	handshake := &peer.handshake
 	handshake.mutex.Lock()
 	defer handshake.mutex.Unlock()
@@ -379,25 +399,25 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 	}
 	msg.Ephemeral = handshake.localEphemeral.publicKey()
 	handshake.mixHash(msg.Ephemeral[:])
-	handshake.mixKey(msg.Ephemeral[:])
+	handshake.mixKey(suite, msg.Ephemeral[:])
 
 	ss, err := handshake.localEphemeral.sharedSecret(handshake.remoteEphemeral)
 	if err != nil {
 		return nil, err
 	}
-	handshake.mixKey(ss[:])
+	handshake.mixKey(suite, ss[:])
 	ss, err = handshake.localEphemeral.sharedSecret(handshake.remoteStatic)
 	if err != nil {
 		return nil, err
 	}
-	handshake.mixKey(ss[:])
+	handshake.mixKey(suite, ss[:])
 
 	// add preshared key
 
 	var tau [blake2s.Size]byte
 	var key [chacha20poly1305.KeySize]byte
 
-	KDF3(
+	suite.KDF3(
 		&handshake.chainKey,
 		&tau,
 		&key,
@@ -407,7 +427,7 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 
 	handshake.mixHash(tau[:])
 
-	aead, _ := chacha20poly1305.New(key[:])
+	aead, _ := suite.NewAEAD(key[:])
 	aead.Seal(msg.Empty[:0], ZeroNonce[:], nil, handshake.hash[:])
 	handshake.mixHash(msg.Empty[:])
 
@@ -417,6 +437,8 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 }
 
 func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
+	suite := device.cipherSuite()
+
 	if msg.Type != MessageResponseType {
 		return nil
 	}
@@ -452,27 +474,27 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 		// finish 3-way DH
 
 		mixHash(&hash, &handshake.hash, msg.Ephemeral[:])
-		mixKey(&chainKey, &handshake.chainKey, msg.Ephemeral[:])
+		mixKey(suite, &chainKey, &handshake.chainKey, msg.Ephemeral[:])
 
 		ss, err := handshake.localEphemeral.sharedSecret(msg.Ephemeral)
 		if err != nil {
 			return false
 		}
-		mixKey(&chainKey, &chainKey, ss[:])
+		mixKey(suite, &chainKey, &chainKey, ss[:])
 		setZero(ss[:])
 
 		ss, err = device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
 		if err != nil {
 			return false
 		}
-		mixKey(&chainKey, &chainKey, ss[:])
+		mixKey(suite, &chainKey, &chainKey, ss[:])
 		setZero(ss[:])
 
 		// add preshared key (psk)
 
 		var tau [blake2s.Size]byte
 		var key [chacha20poly1305.KeySize]byte
-		KDF3(
+		suite.KDF3(
 			&chainKey,
 			&tau,
 			&key,
@@ -483,7 +505,7 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 
 		// authenticate transcript
 
-		aead, _ := chacha20poly1305.New(key[:])
+		aead, _ := suite.NewAEAD(key[:])
 		_, err = aead.Open(nil, ZeroNonce[:], msg.Empty[:], hash[:])
 		if err != nil {
 			return false
@@ -517,8 +539,18 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
  *
  */
 func (peer *Peer) BeginSymmetricSession() error {
+	suite := peer.device.cipherSuite()
+
 	device := peer.device
 	handshake := &peer.handshake
+
+	// The keylog is written once the handshake is unlocked, it needs the
+	// static identity, which is locked before handshakes
+	var keys sessionKeys
+	if keyLogEnabled {
+		defer peer.logSessionKeys(&keys)
+	}
+
 	handshake.mutex.Lock()
 	defer handshake.mutex.Unlock()
 
@@ -529,7 +561,7 @@ func (peer *Peer) BeginSymmetricSession() error {
 	var recvKey [chacha20poly1305.KeySize]byte
 
 	if handshake.state == handshakeResponseConsumed {
-		KDF2(
+		suite.KDF2(
 			&sendKey,
 			&recvKey,
 			handshake.chainKey[:],
@@ -537,7 +569,7 @@ func (peer *Peer) BeginSymmetricSession() error {
 		)
 		isInitiator = true
 	} else if handshake.state == handshakeResponseCreated {
-		KDF2(
+		suite.KDF2(
 			&recvKey,
 			&sendKey,
 			handshake.chainKey[:],
@@ -548,6 +580,20 @@ func (peer *Peer) BeginSymmetricSession() error {
 		return fmt.Errorf("invalid state for keypair derivation: %v", handshake.state)
 	}
 
+	if keyLogEnabled {
+		keys = sessionKeys{
+			isInitiator:    isInitiator,
+			localIndex:     handshake.localIndex,
+			remoteIndex:    handshake.remoteIndex,
+			localEphemeral: handshake.localEphemeral,
+			remoteStatic:   handshake.remoteStatic,
+			presharedKey:   handshake.presharedKey,
+			handshakeHash:  handshake.hash,
+			sendKey:        sendKey,
+			recvKey:        recvKey,
+		}
+	}
+
 	// zero handshake
 
 	setZero(handshake.chainKey[:])
@@ -558,13 +604,13 @@ func (peer *Peer) BeginSymmetricSession() error {
 	// create AEAD instances
 
 	keypair := new(Keypair)
-	keypair.send, _ = chacha20poly1305.New(sendKey[:])
-	keypair.receive, _ = chacha20poly1305.New(recvKey[:])
+	keypair.send, _ = suite.NewAEAD(sendKey[:])
+	keypair.receive, _ = suite.NewAEAD(recvKey[:])
 
 	setZero(sendKey[:])
 	setZero(recvKey[:])
 
-	keypair.created = time.Now()
+	keypair.created = device.now()
 	keypair.replayFilter.Reset()
 	keypair.isInitiator = isInitiator
 	keypair.localIndex = peer.handshake.localIndex
@@ -595,6 +641,7 @@ func (peer *Peer) BeginSymmetricSession() error {
 		}
 		device.DeleteKeypair(previous)
 		keypairs.current = keypair
+		peer.keypairRotations.Add(1)
 	} else {
 		keypairs.next.Store(keypair)
 		device.DeleteKeypair(next)
@@ -621,5 +668,6 @@ func (peer *Peer) ReceivedWithKeypair(receivedKeypair *Keypair) bool {
 	peer.device.DeleteKeypair(old)
 	keypairs.current = keypairs.next.Load()
 	keypairs.next.Store(nil)
+	peer.keypairRotations.Add(1)
 	return true
 }
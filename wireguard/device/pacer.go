@@ -0,0 +1,40 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+// handshakePacer spreads handshake initiations of all peers over time so
+// that bringing up a device with many peers does not emit a burst of DH
+// computations and UDP packets. It is a GCRA limiter allowing
+// HandshakeInitiationBurst initiations at once and one every
+// HandshakeInitiationPacing after that.
+type handshakePacer struct {
+	mu  sync.Mutex
+	tat time.Time // theoretical arrival time of the next initiation
+}
+
+// reserve claims a slot at now and returns how long the caller has to
+// wait before sending.
+func (p *handshakePacer) reserve(now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.tat.Before(now) {
+		p.tat = now
+	}
+
+	delay := p.tat.Sub(now) - (HandshakeInitiationBurst-1)*HandshakeInitiationPacing
+	p.tat = p.tat.Add(HandshakeInitiationPacing)
+
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
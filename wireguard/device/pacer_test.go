@@ -0,0 +1,34 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandshakePacer(t *testing.T) {
+	var p handshakePacer
+	now := time.Now()
+
+	for i := 0; i < HandshakeInitiationBurst; i++ {
+		if delay := p.reserve(now); delay != 0 {
+			t.Fatalf("initiation %d within burst delayed by %v", i, delay)
+		}
+	}
+
+	prev := p.reserve(now)
+	if prev <= 0 {
+		t.Fatal("initiation beyond burst not delayed")
+	}
+	for i := 0; i < 10; i++ {
+		delay := p.reserve(now)
+		if delay <= prev {
+			t.Fatalf("paced initiation %d delay %v not after previous %v", i, delay, prev)
+		}
+		prev = delay
+	}
+}
@@ -0,0 +1,30 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+// SetPanicHook makes the device pass the value of a panic on any of its
+// goroutines to f before the panic goes on to crash the process. A nil f
+// removes the hook.
+func (device *Device) SetPanicHook(f func(any)) {
+	if f == nil {
+		device.panicHook.Store(nil)
+		return
+	}
+	device.panicHook.Store(&f)
+}
+
+// recoverPanic passes a panic to the panic hook and panics again. It must
+// be deferred directly, at the top of every goroutine of the device.
+func (device *Device) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if f := device.panicHook.Load(); f != nil {
+		(*f)(r)
+	}
+	panic(r)
+}
@@ -0,0 +1,40 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+)
+
+func TestPanicHook(t *testing.T) {
+	recovered := func(f func()) (r any) {
+		defer func() { r = recover() }()
+		f()
+		return nil
+	}
+
+	device := new(Device)
+	if r := recovered(func() { defer device.recoverPanic(); panic("boom") }); r != "boom" {
+		t.Fatalf("got %v out of a device without a hook, want it to panic again", r)
+	}
+
+	var hooked []any
+	device.SetPanicHook(func(r any) { hooked = append(hooked, r) })
+	if r := recovered(func() { defer device.recoverPanic(); panic("boom") }); r != "boom" {
+		t.Fatalf("got %v out of the device, want it to panic again", r)
+	}
+	if r := recovered(func() { defer device.recoverPanic() }); r != nil {
+		t.Fatalf("got %v out of the device without a panic", r)
+	}
+	if len(hooked) != 1 || hooked[0] != "boom" {
+		t.Fatalf("hook got %v, want the one panic", hooked)
+	}
+
+	device.SetPanicHook(nil)
+	if recovered(func() { defer device.recoverPanic(); panic("boom") }); len(hooked) != 1 {
+		t.Fatalf("removed hook got %v", hooked)
+	}
+}
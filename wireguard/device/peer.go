@@ -24,6 +24,11 @@ type Peer struct {
 	txBytes           atomic.Uint64  // bytes send to peer (endpoint)
 	rxBytes           atomic.Uint64  // bytes received from peer
 	lastHandshakeNano atomic.Int64   // nano seconds since epoch
+	lastDataSentNano  atomic.Int64   // nano seconds since epoch
+	keypairRotations  atomic.Uint64  // keypairs that became current
+	rtt               rttEstimator
+	handshakeLatency  latencyHistogram
+	shaper            shapingPacer
 
 	endpoint struct {
 		sync.Mutex
@@ -48,9 +53,14 @@ type Peer struct {
 	}
 
 	queue struct {
-		staged   chan *QueueOutboundElementsContainer // staged packets before a handshake is available
-		outbound *autodrainingOutboundQueue           // sequential ordering of udp transmission
-		inbound  *autodrainingInboundQueue            // sequential ordering of tun writing
+		staged   *stagedQueue               // staged packets before a handshake is available
+		outbound *autodrainingOutboundQueue // sequential ordering of udp transmission
+		inbound  *autodrainingInboundQueue  // sequential ordering of tun writing
+		sendMu   sync.Mutex                 // serializes moving staged packets to the outbound queue
+		flush    ClockTimer                 // sends held back staged packets, guarded by sendMu
+
+		droppedTx atomic.Uint64 // packets dropped under overload, staged or not
+		droppedRx atomic.Uint64 // packets dropped because the inbound queue was full
 	}
 
 	trick    string
@@ -84,7 +94,7 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	peer.device = device
 	peer.queue.outbound = newAutodrainingOutboundQueue(device)
 	peer.queue.inbound = newAutodrainingInboundQueue(device)
-	peer.queue.staged = make(chan *QueueOutboundElementsContainer, QueueStagedSize)
+	peer.queue.staged = newStagedQueue(QueueStagedSize)
 
 	// map public key
 	_, ok := device.peers.keyMap[pk]
@@ -203,7 +213,7 @@ func (peer *Peer) Start() {
 	peer.stopping.Add(2)
 
 	peer.handshake.mutex.Lock()
-	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.lastSentHandshake = peer.device.now().Add(-(RekeyTimeout + time.Second))
 	peer.handshake.mutex.Unlock()
 
 	peer.device.queue.encryption.wg.Add(1) // keep encryption queue open for our writes
@@ -253,7 +263,7 @@ func (peer *Peer) ExpireCurrentKeypairs() {
 	handshake.mutex.Lock()
 	peer.device.indexTable.Delete(handshake.localIndex)
 	handshake.Clear()
-	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.lastSentHandshake = peer.device.now().Add(-(RekeyTimeout + time.Second))
 	handshake.mutex.Unlock()
 
 	keypairs := &peer.keypairs
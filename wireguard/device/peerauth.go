@@ -0,0 +1,261 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"net/netip"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+
+	"github.com/bepass-org/warp-plus/wireguard/conn"
+)
+
+/* A device only answers the peers it is configured with. With a peer
+ * authorizer, it also asks about initiators it doesn't know whose static
+ * key decrypted, who know the public key of the device at least, and adds
+ * them as peers if allowed. The initiation is dropped meanwhile, and the
+ * retry of the initiator RekeyTimeout later finds the peer configured, which
+ * verifies that the initiator holds the private key too. Denied peers aren't
+ * asked about again for a while, so a persistent stranger doesn't make the
+ * device ask on every retry, and the authorizer is asked at most
+ * peerAuthorizationBurst times in a row and once per peerAuthorizationInterval
+ * after that, so initiators flooding in with fresh keys can't overwhelm it.
+ *
+ * Authorized peers are asked about again every peerAuthorizationRecheck, and
+ * removed once denied, once the authorizer is removed, or when they had no
+ * handshake since the last check, so that revoking a peer at the authorizer
+ * takes effect and peers that left don't pile up.
+ */
+
+const (
+	// peerAuthorizationTimeout bounds how long the authorizer may take,
+	// the initiator retries by then
+	peerAuthorizationTimeout = RekeyTimeout
+	// peerDenialTime is how long a denied peer isn't asked about again
+	peerDenialTime = time.Minute
+	// maxPendingAuthorizations bounds the authorizations in flight
+	maxPendingAuthorizations = 16
+	// peerAuthorizationBurst and peerAuthorizationInterval rate limit
+	// asking the authorizer about new peers
+	peerAuthorizationBurst    = maxPendingAuthorizations
+	peerAuthorizationInterval = 250 * time.Millisecond
+	// peerAuthorizationRecheck is how often authorized peers are asked
+	// about again
+	peerAuthorizationRecheck = 10 * time.Minute
+)
+
+// authorizedPeer is a peer added by the authorizer, with the timer asking
+// about it again.
+type authorizedPeer struct {
+	peer  *Peer
+	timer ClockTimer
+}
+
+// PeerAuthorization is what a PeerAuthorizer allows a peer.
+type PeerAuthorization struct {
+	// AllowedIPs are the addresses the peer may send from, and routed to
+	AllowedIPs []netip.Prefix
+	// PresharedKey is mixed into the handshakes of the peer, if not zero
+	PresharedKey NoisePresharedKey
+}
+
+// PeerAuthorizer decides whether a peer the device doesn't know may
+// connect from endpoint, returning nil to deny it. It runs on its own
+// goroutine and ctx is done after peerAuthorizationTimeout.
+type PeerAuthorizer func(ctx context.Context, publicKey NoisePublicKey, endpoint string) (*PeerAuthorization, error)
+
+// SetPeerAuthorizer makes the device ask f about initiators it doesn't know
+// and add those allowed as peers. A nil f removes the authorizer.
+func (device *Device) SetPeerAuthorizer(f PeerAuthorizer) {
+	if f == nil {
+		device.peerAuth.authorizer.Store(nil)
+		return
+	}
+	device.peerAuth.authorizer.Store(&f)
+}
+
+// receivedUnknownInitiation asks the authorizer about the initiator of msg,
+// which wasn't consumed, if the device doesn't know it.
+func (device *Device) receivedUnknownInitiation(msg *MessageInitiation, endpoint conn.Endpoint) {
+	f := device.peerAuth.authorizer.Load()
+	if f == nil {
+		return
+	}
+
+	var hash, chainKey [blake2s.Size]byte
+	device.staticIdentity.RLock()
+	pk, ok := device.openInitiationStatic(device.cipherSuite(), msg, &hash, &chainKey)
+	device.staticIdentity.RUnlock()
+	setZero(hash[:])
+	setZero(chainKey[:])
+	if !ok || device.LookupPeer(pk) != nil {
+		return
+	}
+
+	now := device.now()
+	device.peerAuth.Lock()
+	defer device.peerAuth.Unlock()
+	if device.peerAuth.pending == nil {
+		device.peerAuth.pending = make(map[NoisePublicKey]bool)
+		device.peerAuth.denied = make(map[NoisePublicKey]time.Time)
+		device.peerAuth.authorized = make(map[NoisePublicKey]authorizedPeer)
+		device.peerAuth.tokens = peerAuthorizationBurst
+		device.peerAuth.refilled = now
+	}
+	if device.peerAuth.pending[pk] || len(device.peerAuth.pending) >= maxPendingAuthorizations || now.Before(device.peerAuth.denied[pk]) {
+		return
+	}
+	if !device.takeAuthorizationToken(now) {
+		device.log.Verbosef("Rate limited authorizing unknown peer from %s", endpoint.DstToString())
+		return
+	}
+	device.peerAuth.pending[pk] = true
+	go device.authorizePeer(*f, pk, endpoint.DstToString())
+}
+
+// takeAuthorizationToken reports whether the authorizer may be asked about
+// another peer now, with peerAuth held.
+func (device *Device) takeAuthorizationToken(now time.Time) bool {
+	pa := &device.peerAuth
+	if refill := int(now.Sub(pa.refilled) / peerAuthorizationInterval); refill > 0 {
+		pa.tokens = min(pa.tokens+refill, peerAuthorizationBurst)
+		pa.refilled = pa.refilled.Add(time.Duration(refill) * peerAuthorizationInterval)
+	}
+	if pa.tokens == peerAuthorizationBurst {
+		pa.refilled = now
+	}
+	if pa.tokens == 0 {
+		return false
+	}
+	pa.tokens--
+	return true
+}
+
+func (device *Device) authorizePeer(f PeerAuthorizer, pk NoisePublicKey, endpoint string) {
+	defer device.recoverPanic()
+	ctx, cancel := context.WithTimeout(context.Background(), peerAuthorizationTimeout)
+	auth, err := f(ctx, pk, endpoint)
+	cancel()
+
+	now := device.now()
+	device.peerAuth.Lock()
+	delete(device.peerAuth.pending, pk)
+	for key, until := range device.peerAuth.denied {
+		if !now.Before(until) {
+			delete(device.peerAuth.denied, key)
+		}
+	}
+	if err == nil && auth == nil {
+		device.peerAuth.denied[pk] = now.Add(peerDenialTime)
+	}
+	device.peerAuth.Unlock()
+
+	switch {
+	case err != nil:
+		device.log.Errorf("Failed to authorize unknown peer from %s: %v", endpoint, err)
+		return
+	case auth == nil:
+		device.log.Verbosef("Denied unknown peer from %s", endpoint)
+		return
+	}
+
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+
+	peer, err := device.NewPeer(pk)
+	if err != nil {
+		device.log.Errorf("Failed to add authorized peer from %s: %v", endpoint, err)
+		return
+	}
+	peer.handshake.mutex.Lock()
+	peer.handshake.presharedKey = auth.PresharedKey
+	peer.handshake.mutex.Unlock()
+	for _, prefix := range auth.AllowedIPs {
+		device.allowedips.Insert(prefix, peer)
+	}
+	if device.isUp() {
+		peer.Start()
+	}
+	device.log.Verbosef("%v - Added authorized peer from %s", peer, endpoint)
+
+	device.peerAuth.Lock()
+	device.peerAuth.authorized[pk] = authorizedPeer{
+		peer:  peer,
+		timer: device.clock.AfterFunc(peerAuthorizationRecheck, func() { device.recheckAuthorizedPeer(pk, peer) }),
+	}
+	device.peerAuth.Unlock()
+}
+
+// recheckAuthorizedPeer asks the authorizer about peer, added when it
+// authorized pk, again. It removes peer if it is denied, the authorizer was
+// removed, or it had no handshake since the last check. Failing to ask
+// keeps it until the next check.
+func (device *Device) recheckAuthorizedPeer(pk NoisePublicKey, peer *Peer) {
+	device.peerAuth.Lock()
+	a, ok := device.peerAuth.authorized[pk]
+	if ok && a.peer == peer && device.LookupPeer(pk) != peer {
+		// Removed meanwhile
+		delete(device.peerAuth.authorized, pk)
+		ok = false
+	}
+	device.peerAuth.Unlock()
+	if !ok || a.peer != peer || device.isClosed() {
+		return
+	}
+
+	lastHandshake := time.Unix(0, peer.lastHandshakeNano.Load())
+	f := device.peerAuth.authorizer.Load()
+	peer.endpoint.Lock()
+	endpoint := "unknown"
+	if peer.endpoint.val != nil {
+		endpoint = peer.endpoint.val.DstToString()
+	}
+	peer.endpoint.Unlock()
+
+	var reason string
+	switch {
+	case f == nil:
+		reason = "the authorizer was removed"
+	case device.since(lastHandshake) > peerAuthorizationRecheck:
+		reason = "it is idle"
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), peerAuthorizationTimeout)
+		auth, err := (*f)(ctx, pk, endpoint)
+		cancel()
+		if err != nil {
+			device.log.Errorf("%v - Failed to authorize peer again, keeping it until the next check: %v", peer, err)
+		}
+		if err == nil && auth == nil {
+			reason = "it was denied"
+		}
+	}
+
+	if reason == "" {
+		device.peerAuth.Lock()
+		if a, ok := device.peerAuth.authorized[pk]; ok && a.peer == peer {
+			a.timer.Reset(peerAuthorizationRecheck)
+		}
+		device.peerAuth.Unlock()
+		return
+	}
+
+	device.peerAuth.Lock()
+	if a, ok := device.peerAuth.authorized[pk]; ok && a.peer == peer {
+		delete(device.peerAuth.authorized, pk)
+	}
+	device.peerAuth.Unlock()
+
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+	device.peers.Lock()
+	defer device.peers.Unlock()
+	if device.peers.keyMap[pk] == peer {
+		removePeerLocked(device, peer, pk)
+		device.log.Verbosef("%v - Removed authorized peer as %s", peer, reason)
+	}
+}
@@ -0,0 +1,151 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun/tuntest"
+)
+
+func TestPeerAuthorizer(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		pair := genClockTestPair(t)
+		p0, p1 := &pair.testPair[0], &pair.testPair[1]
+
+		// The second device forgets the first one, and asks about it
+		pk := pair.peer(0).device.staticIdentity.publicKey
+		p1.dev.RemovePeer(pk)
+		var asked atomic.Int32
+		p1.dev.SetPeerAuthorizer(func(_ context.Context, publicKey NoisePublicKey, _ string) (*PeerAuthorization, error) {
+			asked.Add(1)
+			if publicKey != pk {
+				t.Errorf("asked about %x, want %x", publicKey, pk)
+			}
+			if !allow {
+				return nil, nil
+			}
+			return &PeerAuthorization{AllowedIPs: []netip.Prefix{netip.PrefixFrom(p0.ip, 32)}}, nil
+		})
+
+		p0.tun.Outbound <- tuntest.Ping(p1.ip, p0.ip)
+		waitFor(t, "authorizer to be asked", func() bool {
+			return asked.Load() == 1
+		})
+		if !allow {
+			// Retries within the denial time aren't asked about
+			pair.clock.Advance(RekeyTimeout + RekeyTimeoutJitterMaxMs*time.Millisecond)
+			waitFor(t, "handshake retry", func() bool {
+				return pair.initiated[0].Load() >= 2
+			})
+			if n := asked.Load(); n != 1 {
+				t.Fatalf("asked %d times about a denied peer, want 1", n)
+			}
+			if p1.dev.LookupPeer(pk) != nil {
+				t.Fatal("denied peer was added")
+			}
+			continue
+		}
+
+		waitFor(t, "authorized peer to be added", func() bool {
+			return p1.dev.LookupPeer(pk) != nil
+		})
+		pair.clock.Advance(RekeyTimeout + RekeyTimeoutJitterMaxMs*time.Millisecond)
+		pair.Send(t, Pong, nil)
+		pair.Send(t, Ping, nil)
+	}
+}
+
+func TestPeerAuthorizerRecheck(t *testing.T) {
+	for _, deny := range []bool{true, false} {
+		pair := genClockTestPair(t)
+		p0, p1 := &pair.testPair[0], &pair.testPair[1]
+
+		pk := pair.peer(0).device.staticIdentity.publicKey
+		p1.dev.RemovePeer(pk)
+		var asked atomic.Int32
+		var denied atomic.Bool
+		p1.dev.SetPeerAuthorizer(func(context.Context, NoisePublicKey, string) (*PeerAuthorization, error) {
+			asked.Add(1)
+			if denied.Load() {
+				return nil, nil
+			}
+			return &PeerAuthorization{AllowedIPs: []netip.Prefix{netip.PrefixFrom(p0.ip, 32)}}, nil
+		})
+
+		p0.tun.Outbound <- tuntest.Ping(p1.ip, p0.ip)
+		waitFor(t, "authorized peer to be added", func() bool {
+			return p1.dev.LookupPeer(pk) != nil
+		})
+		pair.clock.Advance(RekeyTimeout + RekeyTimeoutJitterMaxMs*time.Millisecond)
+		select {
+		case <-p1.tun.Inbound:
+		case <-time.After(5 * time.Second):
+			t.Fatal("ping of the authorized peer not delivered")
+		}
+
+		// Peers in use are asked about again and kept while allowed
+		pair.clock.Advance(peerAuthorizationRecheck)
+		if n := asked.Load(); n != 2 {
+			t.Fatalf("asked %d times about an authorized peer, want 2", n)
+		}
+		if p1.dev.LookupPeer(pk) == nil {
+			t.Fatal("allowed peer was removed")
+		}
+
+		// Then removed once denied, or idle since the last check
+		denied.Store(deny)
+		if deny {
+			p1.dev.LookupPeer(pk).lastHandshakeNano.Store(pair.clock.Now().UnixNano())
+		}
+		pair.clock.Advance(peerAuthorizationRecheck)
+		if p1.dev.LookupPeer(pk) != nil {
+			t.Fatalf("peer kept, denied %v", deny)
+		}
+		want := int32(2)
+		if deny {
+			want = 3
+		}
+		if n := asked.Load(); n != want {
+			t.Fatalf("asked %d times, want %d", n, want)
+		}
+	}
+}
+
+func TestPeerAuthorizationRate(t *testing.T) {
+	var device Device
+	now := time.Unix(1700000000, 0)
+	device.peerAuth.tokens = peerAuthorizationBurst
+	device.peerAuth.refilled = now
+
+	for i := 0; i < peerAuthorizationBurst; i++ {
+		if !device.takeAuthorizationToken(now) {
+			t.Fatalf("authorization %d of a burst refused", i)
+		}
+	}
+	if device.takeAuthorizationToken(now) {
+		t.Fatal("authorization past the burst allowed")
+	}
+
+	// Refilled one per interval, up to the burst however long it was
+	now = now.Add(peerAuthorizationInterval)
+	if !device.takeAuthorizationToken(now) || device.takeAuthorizationToken(now) {
+		t.Fatal("not refilled by one per interval")
+	}
+	now = now.Add(time.Hour)
+	for i := 0; i < peerAuthorizationBurst; i++ {
+		if !device.takeAuthorizationToken(now) {
+			t.Fatalf("authorization %d after an idle hour refused", i)
+		}
+	}
+	if device.takeAuthorizationToken(now) {
+		t.Fatal("refilled past the burst")
+	}
+}
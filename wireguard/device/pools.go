@@ -8,6 +8,7 @@ package device
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type WaitPool struct {
@@ -90,6 +91,7 @@ func (device *Device) PutOutboundElementsContainer(c *QueueOutboundElementsConta
 		c.elems[i] = nil
 	}
 	c.elems = c.elems[:0]
+	c.staged = time.Time{}
 	device.pool.outboundElementsContainer.Put(c)
 }
 
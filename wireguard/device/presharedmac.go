@@ -0,0 +1,59 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+/* The mac1 of handshake messages is keyed by the public key of their
+ * receiver, so anyone knowing it can make a device spend a Diffie-Hellman
+ * on a probe and, with a response or a cookie reply, confirm it is a
+ * WireGuard responder. With preshared mac1 the key is derived from the
+ * preshared key of the peer as well, and messages without a mac1 of any
+ * peer's preshared key are dropped unanswered before anything is decrypted.
+ * Both ends have to run this device with it enabled, and peers without a
+ * preshared key can't handshake at all.
+ */
+
+// SetPresharedMAC1 keys the mac1 of handshake messages by the preshared key
+// of the peer too, so that only peers knowing it get a device to respond.
+func (device *Device) SetPresharedMAC1(enabled bool) {
+	device.presharedMAC1.Store(enabled)
+}
+
+// checkMAC1 checks the mac1 of a handshake message, against the preshared
+// keys of all peers with preshared mac1.
+func (device *Device) checkMAC1(msg []byte) bool {
+	if !device.presharedMAC1.Load() {
+		return device.cookieChecker.CheckMAC1(msg)
+	}
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	for _, peer := range device.peers.keyMap {
+		peer.handshake.mutex.RLock()
+		psk := peer.handshake.presharedKey
+		peer.handshake.mutex.RUnlock()
+		if psk == (NoisePresharedKey{}) {
+			continue
+		}
+		if device.cookieChecker.CheckPresharedMAC1(msg, &psk) {
+			return true
+		}
+	}
+	return false
+}
+
+// addMacs adds the macs of a handshake message sent to the peer.
+func (peer *Peer) addMacs(msg []byte) {
+	if !peer.device.presharedMAC1.Load() {
+		peer.cookieGenerator.AddMacs(msg)
+		return
+	}
+
+	peer.handshake.mutex.RLock()
+	psk := peer.handshake.presharedKey
+	peer.handshake.mutex.RUnlock()
+	peer.cookieGenerator.AddPresharedMacs(msg, &psk)
+}
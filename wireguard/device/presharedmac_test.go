@@ -0,0 +1,66 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/conn/bindtest"
+	"github.com/bepass-org/warp-plus/wireguard/tun/tuntest"
+)
+
+func TestPresharedMAC1(t *testing.T) {
+	psk, other := NoisePresharedKey{1}, NoisePresharedKey{2}
+	tests := []struct {
+		name    string
+		enabled [2]bool
+		psk     [2]NoisePresharedKey
+		answers bool
+	}{
+		{"both", [2]bool{true, true}, [2]NoisePresharedKey{psk, psk}, true},
+		{"initiator without", [2]bool{true, false}, [2]NoisePresharedKey{psk, psk}, false},
+		{"other psk", [2]bool{true, true}, [2]NoisePresharedKey{psk, other}, false},
+		{"no psk", [2]bool{true, true}, [2]NoisePresharedKey{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pair := genClockTestPair(t)
+			for i := range pair.testPair {
+				pair.testPair[i].dev.SetPresharedMAC1(tt.enabled[i])
+				peer := pair.peer(i)
+				peer.handshake.mutex.Lock()
+				peer.handshake.presharedKey = tt.psk[i]
+				peer.handshake.mutex.Unlock()
+			}
+			if tt.answers {
+				pair.Send(t, Ping, nil)
+				pair.Send(t, Pong, nil)
+				return
+			}
+
+			// The responder must not give itself away by sending anything
+			var sent atomic.Int32
+			pair.testPair[0].dev.net.bind.(*bindtest.ChannelBind).SetFilter(func([]byte) bool {
+				sent.Add(1)
+				return true
+			})
+			p0, p1 := &pair.testPair[0], &pair.testPair[1]
+			p1.tun.Outbound <- tuntest.Ping(p0.ip, p1.ip)
+			waitFor(t, "initiation", func() bool {
+				return pair.initiated[1].Load() == 1
+			})
+			time.Sleep(50 * time.Millisecond)
+			if n := sent.Load(); n != 0 {
+				t.Fatalf("responder sent %d datagrams", n)
+			}
+			if n := pair.peer(0).rxBytes.Load(); n != 0 {
+				t.Fatalf("responder accepted %d bytes", n)
+			}
+		})
+	}
+}
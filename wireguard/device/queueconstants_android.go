@@ -9,11 +9,14 @@ import "github.com/bepass-org/warp-plus/wireguard/conn"
 
 /* Reduce memory consumption for Android */
 
-const (
-	QueueStagedSize            = conn.IdealBatchSize
-	QueueOutboundSize          = 1024
-	QueueInboundSize           = 1024
-	QueueHandshakeSize         = 1024
-	MaxSegmentSize             = (1 << 16) - 1 // largest possible UDP datagram
-	PreallocatedBuffersPerPool = 4096
+// These are vars instead of consts so that memory constrained deployments
+// can reduce them before creating a device.
+var (
+	QueueStagedSize                   = conn.IdealBatchSize
+	QueueOutboundSize                 = 1024
+	QueueInboundSize                  = 1024
+	QueueHandshakeSize                = 1024
+	PreallocatedBuffersPerPool uint32 = 4096
 )
+
+const MaxSegmentSize = (1 << 16) - 1 // largest possible UDP datagram
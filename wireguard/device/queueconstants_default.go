@@ -9,11 +9,14 @@ package device
 
 import "github.com/bepass-org/warp-plus/wireguard/conn"
 
-const (
-	QueueStagedSize            = conn.IdealBatchSize
-	QueueOutboundSize          = 1024
-	QueueInboundSize           = 1024
-	QueueHandshakeSize         = 1024
-	MaxSegmentSize             = (1 << 16) - 1 // largest possible UDP datagram
-	PreallocatedBuffersPerPool = 0             // Disable and allow for infinite memory growth
+// These are vars instead of consts so that memory constrained deployments
+// can reduce them before creating a device.
+var (
+	QueueStagedSize                   = conn.IdealBatchSize
+	QueueOutboundSize                 = 1024
+	QueueInboundSize                  = 1024
+	QueueHandshakeSize                = 1024
+	PreallocatedBuffersPerPool uint32 = 0 // Disable and allow for infinite memory growth
 )
+
+const MaxSegmentSize = (1 << 16) - 1 // largest possible UDP datagram
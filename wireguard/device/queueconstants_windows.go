@@ -5,11 +5,14 @@
 
 package device
 
-const (
-	QueueStagedSize            = 128
-	QueueOutboundSize          = 1024
-	QueueInboundSize           = 1024
-	QueueHandshakeSize         = 1024
-	MaxSegmentSize             = 2048 - 32 // largest possible UDP datagram
-	PreallocatedBuffersPerPool = 0         // Disable and allow for infinite memory growth
+// These are vars instead of consts so that memory constrained deployments
+// can reduce them before creating a device.
+var (
+	QueueStagedSize                   = 128
+	QueueOutboundSize                 = 1024
+	QueueInboundSize                  = 1024
+	QueueHandshakeSize                = 1024
+	PreallocatedBuffersPerPool uint32 = 0 // Disable and allow for infinite memory growth
 )
+
+const MaxSegmentSize = 2048 - 32 // largest possible UDP datagram
@@ -59,7 +59,13 @@ func (peer *Peer) keepKeyFreshReceiving() {
 		return
 	}
 	keypair := peer.keypairs.Current()
-	if keypair != nil && keypair.isInitiator && time.Since(keypair.created) > (RejectAfterTime-KeepaliveTimeout-RekeyTimeout) {
+	if keypair == nil {
+		return
+	}
+	// A responder whose initiator went quiet takes over rekeying, so the
+	// session doesn't expire under it
+	age := peer.device.since(keypair.created)
+	if (keypair.isInitiator && age > RejectAfterTime-KeepaliveTimeout-RekeyTimeout) || (!keypair.isInitiator && age > ResponderRekeyAfterTime) {
 		peer.timers.sentLastMinuteHandshake.Store(true)
 		peer.SendHandshakeInitiation(false)
 	}
@@ -71,6 +77,7 @@ func (peer *Peer) keepKeyFreshReceiving() {
  * IPv4 and IPv6 (separately)
  */
 func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.ReceiveFunc) {
+	defer device.recoverPanic()
 	recvName := recv.PrettyName()
 	defer func() {
 		device.log.Verbosef("Routine: receive incoming %s - stopped", recvName)
@@ -80,6 +87,7 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 	}()
 
 	device.log.Verbosef("Routine: receive incoming %s - started", recvName)
+	device.pinWorker(workerRX)
 
 	// receive datagrams until conn is closed
 
@@ -135,6 +143,16 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 			// check size of packet
 
 			packet := bufsArrs[i][:size]
+			if size == KnockSize && device.receivedKnock(packet, endpoints[i]) {
+				continue
+			}
+			if packet[0] == MessageInitiationJunkType || packet[0]&0xf0 == 0xc0 {
+				// an initiation framed by a peer, see SetInitiationFraming
+				packet = stripInitiationFraming(packet)
+				if len(packet) < MinMessageSize {
+					continue
+				}
+			}
 			packet[1], packet[2], packet[3] = 0, 0, 0
 			msgType := binary.LittleEndian.Uint32(packet[:4])
 
@@ -158,12 +176,15 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 				value := device.indexTable.Lookup(receiver)
 				keypair := value.keypair
 				if keypair == nil {
+					if value.peer == nil {
+						device.receivedUnknownIndex(endpoints[i])
+					}
 					continue
 				}
 
 				// check keypair expiry
 
-				if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
+				if device.since(keypair.created) > RejectAfterTime {
 					continue
 				}
 
@@ -193,6 +214,10 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 				if len(packet) != MessageInitiationSize {
 					continue
 				}
+				if !device.knocked(endpoints[i]) {
+					device.log.Verbosef("Dropped initiation from %s without a knock", endpoints[i].DstToString())
+					continue
+				}
 
 			case MessageResponseType:
 				if len(packet) != MessageResponseSize {
@@ -222,10 +247,18 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 			}
 		}
 		for peer, elemsContainer := range elemsByPeer {
+			queued := false
 			if peer.isRunning.Load() {
-				peer.queue.inbound.c <- elemsContainer
-				device.queue.decryption.c <- elemsContainer
-			} else {
+				select {
+				case peer.queue.inbound.c <- elemsContainer:
+					device.queue.decryption.c <- elemsContainer
+					queued = true
+				default:
+					// Don't let one flooded peer stall receiving for all others.
+					peer.queue.droppedRx.Add(uint64(len(elemsContainer.elems)))
+				}
+			}
+			if !queued {
 				for _, elem := range elemsContainer.elems {
 					device.PutMessageBuffer(elem.buffer)
 					device.PutInboundElement(elem)
@@ -238,10 +271,12 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 }
 
 func (device *Device) RoutineDecryption(id int) {
+	defer device.recoverPanic()
 	var nonce [chacha20poly1305.NonceSize]byte
 
 	defer device.log.Verbosef("Routine: decryption worker %d - stopped", id)
 	device.log.Verbosef("Routine: decryption worker %d - started", id)
+	device.pinWorker(workerCrypto)
 
 	for elemsContainer := range device.queue.decryption.c {
 		for _, elem := range elemsContainer.elems {
@@ -271,11 +306,13 @@ func (device *Device) RoutineDecryption(id int) {
 /* Handles incoming packets related to handshake
  */
 func (device *Device) RoutineHandshake(id int) {
+	defer device.recoverPanic()
 	defer func() {
 		device.log.Verbosef("Routine: handshake worker %d - stopped", id)
 		device.queue.encryption.wg.Done()
 	}()
 	device.log.Verbosef("Routine: handshake worker %d - started", id)
+	device.pinWorker(workerCrypto)
 
 	for elem := range device.queue.handshake.c {
 
@@ -318,7 +355,7 @@ func (device *Device) RoutineHandshake(id int) {
 
 			// check mac fields and maybe ratelimit
 
-			if !device.cookieChecker.CheckMAC1(elem.packet) {
+			if !device.checkMAC1(elem.packet) {
 				device.log.Verbosef("Received packet with invalid mac1")
 				goto skip
 			}
@@ -365,6 +402,7 @@ func (device *Device) RoutineHandshake(id int) {
 
 			peer := device.ConsumeMessageInitiation(&msg)
 			if peer == nil {
+				device.receivedUnknownInitiation(&msg, elem.endpoint)
 				device.log.Verbosef("Received invalid initiation message from %s", elem.endpoint.DstToString())
 				goto skip
 			}
@@ -408,6 +446,14 @@ func (device *Device) RoutineHandshake(id int) {
 			device.log.Verbosef("%v - Received handshake response", peer)
 			peer.rxBytes.Add(uint64(len(elem.packet)))
 
+			now := time.Now()
+			peer.handshakeLatency.responseReceived(now)
+			if rtt, jump := peer.rtt.responseReceived(now); jump {
+				srtt, _ := peer.rtt.estimate()
+				device.log.Verbosef("%v - Handshake round trip jumped to %v (smoothed %v)", peer, rtt, srtt)
+				peer.pathDegraded("rtt increase")
+			}
+
 			// update timers
 
 			peer.timersAnyAuthenticatedPacketTraversal()
@@ -432,6 +478,7 @@ func (device *Device) RoutineHandshake(id int) {
 }
 
 func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
+	defer peer.device.recoverPanic()
 	device := peer.device
 	defer func() {
 		device.log.Verbosef("%v - Routine: sequential receiver - stopped", peer)
@@ -440,12 +487,14 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 	device.log.Verbosef("%v - Routine: sequential receiver - started", peer)
 
 	bufs := make([][]byte, 0, maxBatchSize)
+	var reorder reorderBuffer
 
 	for elemsContainer := range peer.queue.inbound.c {
 		if elemsContainer == nil {
 			return
 		}
 		elemsContainer.Lock()
+		depth := int(device.reorderDepth.Load())
 		validTailPacket := -1
 		dataPacketReceived := false
 		rxBytesLen := uint64(0)
@@ -460,6 +509,7 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 			}
 
 			validTailPacket = i
+			elem.keypair.received.Add(1)
 			if peer.ReceivedWithKeypair(elem.keypair) {
 				peer.SetEndpointFromPacket(elem.endpoint)
 				peer.timersHandshakeComplete()
@@ -469,6 +519,9 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 
 			if len(elem.packet) == 0 {
 				device.log.Verbosef("%v - Receiving keepalive packet", peer)
+				if depth > 0 {
+					bufs = reorder.push(elem, nil, depth, bufs)
+				}
 				continue
 			}
 			dataPacketReceived = true
@@ -512,7 +565,18 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 				continue
 			}
 
-			bufs = append(bufs, elem.buffer[:MessageTransportOffsetContent+len(elem.packet)])
+			data := elem.buffer[:MessageTransportOffsetContent+len(elem.packet)]
+			if depth > 0 {
+				bufs = reorder.push(elem, data, depth, bufs)
+			} else {
+				bufs = append(bufs, data)
+			}
+		}
+
+		// Only hold packets back while more are already waiting, so a gap
+		// that is real loss costs no extra latency
+		if depth == 0 || len(peer.queue.inbound.c) == 0 {
+			bufs = reorder.flush(bufs)
 		}
 
 		peer.rxBytes.Add(rxBytesLen)
@@ -532,9 +596,15 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 			}
 		}
 		for _, elem := range elemsContainer.elems {
-			device.PutMessageBuffer(elem.buffer)
+			if elem.buffer != nil {
+				device.PutMessageBuffer(elem.buffer)
+			}
 			device.PutInboundElement(elem)
 		}
+		for _, buffer := range reorder.release {
+			device.PutMessageBuffer(buffer)
+		}
+		reorder.release = reorder.release[:0]
 		bufs = bufs[:0]
 		device.PutInboundElementsContainer(elemsContainer)
 	}
@@ -0,0 +1,110 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "sort"
+
+// SetReorderDepth sets how many out of order packets per peer are held back
+// on receive while waiting for the ones missing before them. Reordering on
+// the path, as caused by sending over several paths, otherwise looks like
+// loss to TCP inside the tunnel and collapses its throughput. Zero, the
+// default, delivers packets as they arrive.
+func (device *Device) SetReorderDepth(depth int) {
+	device.reorderDepth.Store(int32(max(depth, 0)))
+}
+
+type heldPacket struct {
+	counter uint64
+	// buffer backs data and is owned by the reorder buffer, nil when the
+	// packet carries nothing for the tun device
+	buffer *[MaxMessageSize]byte
+	data   []byte
+}
+
+// reorderBuffer resequences received packets by their keypair counter. It
+// is owned by the peer's sequential receiver and not safe for concurrent use.
+type reorderBuffer struct {
+	keypair *Keypair
+	next    uint64
+	held    []heldPacket
+	// release holds the buffers of emitted held packets, to be returned to
+	// the pool once written to the tun device
+	release []*[MaxMessageSize]byte
+}
+
+// push feeds a validated packet to the buffer and appends every packet now
+// in order to bufs. data is nil for packets with nothing to deliver, such
+// as keepalives, which still fill their slot in the sequence. Held packets
+// take ownership of elem.buffer, setting it to nil.
+func (r *reorderBuffer) push(elem *QueueInboundElement, data []byte, depth int, bufs [][]byte) [][]byte {
+	if elem.keypair != r.keypair {
+		bufs = r.flush(bufs)
+		r.keypair = elem.keypair
+		r.next = elem.counter
+	}
+
+	switch {
+	case elem.counter < r.next:
+		// Arrived after we stopped waiting for it
+		if data != nil {
+			bufs = append(bufs, data)
+		}
+		return bufs
+	case elem.counter == r.next:
+		if data != nil {
+			bufs = append(bufs, data)
+		}
+		r.next++
+		return r.drain(bufs)
+	}
+
+	p := heldPacket{counter: elem.counter}
+	if data != nil {
+		p.buffer, p.data = elem.buffer, data
+		elem.buffer = nil
+	}
+	i := sort.Search(len(r.held), func(i int) bool { return r.held[i].counter > p.counter })
+	r.held = append(r.held, heldPacket{})
+	copy(r.held[i+1:], r.held[i:])
+	r.held[i] = p
+
+	// Too much is held, give up on the oldest gap
+	for len(r.held) > depth {
+		r.next = r.held[0].counter
+		bufs = r.drain(bufs)
+	}
+	return bufs
+}
+
+// drain emits held packets for as long as they continue the sequence.
+func (r *reorderBuffer) drain(bufs [][]byte) [][]byte {
+	n := 0
+	for n < len(r.held) && r.held[n].counter == r.next {
+		bufs = r.emit(r.held[n], bufs)
+		r.next++
+		n++
+	}
+	r.held = append(r.held[:0], r.held[n:]...)
+	return bufs
+}
+
+// flush emits every held packet, skipping over any gaps.
+func (r *reorderBuffer) flush(bufs [][]byte) [][]byte {
+	for _, p := range r.held {
+		bufs = r.emit(p, bufs)
+		r.next = p.counter + 1
+	}
+	r.held = r.held[:0]
+	return bufs
+}
+
+func (r *reorderBuffer) emit(p heldPacket, bufs [][]byte) [][]byte {
+	if p.buffer == nil {
+		return bufs
+	}
+	r.release = append(r.release, p.buffer)
+	return append(bufs, p.data)
+}
@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+)
+
+func TestReorderBuffer(t *testing.T) {
+	keypair := new(Keypair)
+	var r reorderBuffer
+
+	var out []uint64
+	push := func(counter uint64, depth int) {
+		elem := &QueueInboundElement{
+			buffer:  new([MaxMessageSize]byte),
+			keypair: keypair,
+			counter: counter,
+		}
+		elem.buffer[0] = byte(counter)
+		for _, b := range r.push(elem, elem.buffer[:1], depth, nil) {
+			out = append(out, uint64(b[0]))
+		}
+	}
+	expect := func(want ...uint64) {
+		t.Helper()
+		if len(out) != len(want) {
+			t.Fatalf("got %v, want %v", out, want)
+		}
+		for i := range want {
+			if out[i] != want[i] {
+				t.Fatalf("got %v, want %v", out, want)
+			}
+		}
+		out = out[:0]
+	}
+
+	push(0, 4)
+	expect(0)
+
+	// 1 is late, 2 and 3 wait for it
+	push(2, 4)
+	push(3, 4)
+	expect()
+	push(1, 4)
+	expect(1, 2, 3)
+
+	// Exceeding the depth gives up on the gap at 4
+	for c := uint64(5); c <= 9; c++ {
+		push(c, 4)
+	}
+	expect(5, 6, 7, 8, 9)
+
+	// 4 finally shows up and is delivered right away
+	push(4, 4)
+	expect(4)
+
+	// Flushing skips over gaps
+	push(11, 4)
+	push(13, 4)
+	for _, b := range r.flush(nil) {
+		out = append(out, uint64(b[0]))
+	}
+	expect(11, 13)
+	if r.next != 14 {
+		t.Fatalf("next counter %d after flush, want 14", r.next)
+	}
+	if len(r.release) != 9 {
+		t.Fatalf("%d buffers to release, want 9", len(r.release))
+	}
+}
@@ -0,0 +1,27 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+// Resume gets the device passing traffic again after the host slept. Timers
+// and keypair ages don't advance during sleep, so keypairs the remote end
+// has long dropped still look current and would only be replaced once
+// transfers fail. Resume expires them and handshakes with every peer right
+// away, from whatever source address the network now routes through.
+func (device *Device) Resume() {
+	if !device.isUp() {
+		return
+	}
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	for _, peer := range device.peers.keyMap {
+		device.log.Verbosef("%v - Handshaking after resume", peer)
+		peer.markEndpointSrcForClearing()
+		peer.ExpireCurrentKeypairs()
+		peer.SendHandshakeInitiation(false)
+	}
+}
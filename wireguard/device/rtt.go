@@ -0,0 +1,113 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// rttMinSamples is how many samples are needed before a jump is judged
+	rttMinSamples = 3
+	// rttJumpFactor is how far above the smoothed RTT a sample must be to
+	// count as a sudden change, in addition to exceeding the variance bound
+	rttJumpFactor = 2
+	// degradedHandshakeAttempts is the retransmission count at which an
+	// unanswered handshake is reported, well before the hard give up
+	degradedHandshakeAttempts = 2
+)
+
+// PathDegradedHandler is called when a peer's path shows a sudden RTT
+// increase or unanswered handshakes. It runs on device goroutines and must
+// not block.
+type PathDegradedHandler func(publicKey NoisePublicKey, reason string)
+
+// SetPathDegradedHandler registers f to be told about degrading peer paths,
+// an earlier signal to fail over on than the handshake giving up after
+// RekeyAttemptTime. A nil f removes the handler.
+func (device *Device) SetPathDegradedHandler(f PathDegradedHandler) {
+	if f == nil {
+		device.pathDegraded.Store(nil)
+		return
+	}
+	device.pathDegraded.Store(&f)
+}
+
+func (peer *Peer) pathDegraded(reason string) {
+	f := peer.device.pathDegraded.Load()
+	if f == nil {
+		return
+	}
+	peer.handshake.mutex.RLock()
+	key := peer.handshake.remoteStatic
+	peer.handshake.mutex.RUnlock()
+	(*f)(key, reason)
+}
+
+// rttEstimator passively estimates a peer's round trip time from handshake
+// initiations and their responses, smoothed as in RFC 6298. Keepalives are
+// not answered by the remote end and so yield no samples.
+type rttEstimator struct {
+	// sent is when the outstanding initiation went out in nano seconds
+	// since epoch, zero when none is outstanding and negative when it was
+	// retransmitted, which makes its response ambiguous (Karn's algorithm)
+	sent atomic.Int64
+
+	mu      sync.Mutex
+	srtt    time.Duration
+	rttvar  time.Duration
+	samples uint64
+}
+
+func (r *rttEstimator) initiationSent(now time.Time) {
+	if !r.sent.CompareAndSwap(0, now.UnixNano()) {
+		r.sent.Store(-1)
+	}
+}
+
+// responseReceived completes the outstanding initiation and reports whether
+// its round trip was a sudden increase over the estimate.
+func (r *rttEstimator) responseReceived(now time.Time) (rtt time.Duration, jump bool) {
+	sent := r.sent.Swap(0)
+	if sent <= 0 {
+		return 0, false
+	}
+	rtt = max(now.Sub(time.Unix(0, sent)), 0)
+	return rtt, r.update(rtt)
+}
+
+func (r *rttEstimator) update(rtt time.Duration) (jump bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.samples == 0 {
+		r.srtt = rtt
+		r.rttvar = rtt / 2
+	} else {
+		jump = r.samples >= rttMinSamples &&
+			rtt > r.srtt+4*r.rttvar && rtt > rttJumpFactor*r.srtt
+		r.rttvar = (3*r.rttvar + (r.srtt - rtt).Abs()) / 4
+		r.srtt = (7*r.srtt + rtt) / 8
+	}
+	r.samples++
+	return jump
+}
+
+// estimate returns the smoothed RTT and its variation, zero before the
+// first sample.
+func (r *rttEstimator) estimate() (srtt, rttvar time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.srtt, r.rttvar
+}
+
+// RTT returns the peer's smoothed round trip time and its variation as
+// estimated from handshakes, zero before the first completed handshake.
+func (peer *Peer) RTT() (srtt, rttvar time.Duration) {
+	return peer.rtt.estimate()
+}
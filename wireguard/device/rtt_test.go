@@ -0,0 +1,53 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTEstimator(t *testing.T) {
+	var r rttEstimator
+	now := time.Unix(1700000000, 0)
+
+	if _, jump := r.responseReceived(now); jump {
+		t.Fatal("jump without an outstanding initiation")
+	}
+	if srtt, _ := r.estimate(); srtt != 0 {
+		t.Fatalf("estimate without samples = %v, want 0", srtt)
+	}
+
+	roundTrip := func(rtt time.Duration) (time.Duration, bool) {
+		r.initiationSent(now)
+		now = now.Add(rtt)
+		return r.responseReceived(now)
+	}
+
+	for i := 0; i < 5; i++ {
+		rtt, jump := roundTrip(50 * time.Millisecond)
+		if rtt != 50*time.Millisecond || jump {
+			t.Fatalf("sample %d = %v, %v, want 50ms, false", i, rtt, jump)
+		}
+	}
+	if srtt, _ := r.estimate(); srtt != 50*time.Millisecond {
+		t.Fatalf("srtt = %v, want 50ms", srtt)
+	}
+
+	if _, jump := roundTrip(300 * time.Millisecond); !jump {
+		t.Fatal("sudden increase not reported")
+	}
+
+	// a retransmitted initiation makes the response ambiguous
+	r.initiationSent(now)
+	r.initiationSent(now.Add(time.Second))
+	if rtt, _ := r.responseReceived(now.Add(time.Second + 10*time.Millisecond)); rtt != 0 {
+		t.Fatalf("ambiguous sample taken: %v", rtt)
+	}
+	if rtt, _ := roundTrip(60 * time.Millisecond); rtt != 60*time.Millisecond {
+		t.Fatalf("sample after ambiguity = %v, want 60ms", rtt)
+	}
+}
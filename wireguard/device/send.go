@@ -53,17 +53,20 @@ type QueueOutboundElement struct {
 	nonce   uint64                // nonce for encryption
 	keypair *Keypair              // keypair for encryption
 	peer    *Peer                 // related peer
+	cover   bool                  // carries no data, only shapes the traffic
 }
 
 type QueueOutboundElementsContainer struct {
 	sync.Mutex
-	elems []*QueueOutboundElement
+	elems  []*QueueOutboundElement
+	staged time.Time // when the packets were staged, on the device clock
 }
 
 func (device *Device) NewOutboundElement() *QueueOutboundElement {
 	elem := device.GetOutboundElement()
 	elem.buffer = device.GetMessageBuffer()
 	elem.nonce = 0
+	elem.cover = false
 	// keypair and peer were cleared (if necessary) by clearPointers.
 	return elem
 }
@@ -148,7 +151,7 @@ func (peer *Peer) sendRandomPackets() {
 /* Queues a keepalive if no packets are queued for peer
  */
 func (peer *Peer) SendKeepalive() {
-	if len(peer.queue.staged) == 0 && peer.isRunning.Load() {
+	if peer.queue.staged.len() == 0 && peer.isRunning.Load() {
 		if peer.trick != "" && peer.trick != "t0" {
 			peer.device.log.Verbosef("%v - Running tricks! (keepalive)", peer)
 			peer.sendRandomPackets()
@@ -157,10 +160,9 @@ func (peer *Peer) SendKeepalive() {
 		elem := peer.device.NewOutboundElement()
 		elemsContainer := peer.device.GetOutboundElementsContainer()
 		elemsContainer.elems = append(elemsContainer.elems, elem)
-		select {
-		case peer.queue.staged <- elemsContainer:
+		if peer.queue.staged.offer(elemsContainer) {
 			peer.device.log.Verbosef("%v - Sending keepalive packet", peer)
-		default:
+		} else {
 			peer.device.PutMessageBuffer(elem.buffer)
 			peer.device.PutOutboundElement(elem)
 			peer.device.PutOutboundElementsContainer(elemsContainer)
@@ -175,14 +177,14 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	}
 
 	peer.handshake.mutex.RLock()
-	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if peer.device.since(peer.handshake.lastSentHandshake) < RekeyTimeout {
 		peer.handshake.mutex.RUnlock()
 		return nil
 	}
 	peer.handshake.mutex.RUnlock()
 
 	peer.handshake.mutex.Lock()
-	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if peer.device.since(peer.handshake.lastSentHandshake) < RekeyTimeout {
 		peer.handshake.mutex.Unlock()
 		return nil
 	}
@@ -192,9 +194,24 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 		peer.sendRandomPackets()
 	}
 
-	peer.handshake.lastSentHandshake = time.Now()
+	peer.handshake.lastSentHandshake = peer.device.now()
 	peer.handshake.mutex.Unlock()
 
+	if delay := peer.device.handshakePacer.reserve(peer.device.now()); delay > 0 {
+		peer.device.log.Verbosef("%v - Delaying handshake initiation by %v", peer, delay)
+		peer.device.clock.AfterFunc(delay, func() {
+			if peer.device.isClosed() || !peer.isRunning.Load() {
+				return
+			}
+			peer.sendHandshakeInitiation()
+		})
+		return nil
+	}
+
+	return peer.sendHandshakeInitiation()
+}
+
+func (peer *Peer) sendHandshakeInitiation() error {
 	peer.device.log.Verbosef("%v - Sending handshake initiation", peer)
 
 	msg, err := peer.device.CreateMessageInitiation(peer)
@@ -207,12 +224,25 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	writer := bytes.NewBuffer(buf[:0])
 	binary.Write(writer, binary.LittleEndian, msg)
 	packet := writer.Bytes()
-	peer.cookieGenerator.AddMacs(packet)
+	peer.addMacs(packet)
 
 	peer.timersAnyAuthenticatedPacketTraversal()
 	peer.timersAnyAuthenticatedPacketSent()
 
-	err = peer.SendBuffers([][]byte{packet}, false)
+	now := time.Now()
+	peer.rtt.initiationSent(now)
+	peer.handshakeLatency.initiationSent(now)
+	if knock := peer.device.createKnock(); knock != nil {
+		// A failure to send shows with the initiation
+		peer.SendBuffers([][]byte{knock}, true)
+	}
+	if peer.device.initFragments.Load() > 1 || peer.device.initJunk.Load() > 0 || peer.device.initQUIC.Load() {
+		// The framing hides the type the reserved bytes are added by
+		copy(packet[1:4], peer.reserved[:])
+		err = peer.SendBuffers(peer.device.frameInitiation(packet), false)
+	} else {
+		err = peer.SendBuffers([][]byte{packet}, false)
+	}
 	if err != nil {
 		peer.device.log.Errorf("%v - Failed to send handshake initiation: %v", peer, err)
 	}
@@ -223,7 +253,7 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 
 func (peer *Peer) SendHandshakeResponse() error {
 	peer.handshake.mutex.Lock()
-	peer.handshake.lastSentHandshake = time.Now()
+	peer.handshake.lastSentHandshake = peer.device.now()
 	peer.handshake.mutex.Unlock()
 
 	peer.device.log.Verbosef("%v - Sending handshake response", peer)
@@ -238,7 +268,7 @@ func (peer *Peer) SendHandshakeResponse() error {
 	writer := bytes.NewBuffer(buf[:0])
 	binary.Write(writer, binary.LittleEndian, response)
 	packet := writer.Bytes()
-	peer.cookieGenerator.AddMacs(packet)
+	peer.addMacs(packet)
 
 	err = peer.BeginSymmetricSession()
 	if err != nil {
@@ -282,12 +312,14 @@ func (peer *Peer) keepKeyFreshSending() {
 		return
 	}
 	nonce := keypair.sendNonce.Load()
-	if nonce > RekeyAfterMessages || (keypair.isInitiator && time.Since(keypair.created) > RekeyAfterTime) {
+	age := peer.device.since(keypair.created)
+	if nonce > RekeyAfterMessages || (keypair.isInitiator && age > RekeyAfterTime) || (!keypair.isInitiator && age > ResponderRekeyAfterTime) {
 		peer.SendHandshakeInitiation(false)
 	}
 }
 
 func (device *Device) RoutineReadFromTUN() {
+	defer device.recoverPanic()
 	defer func() {
 		device.log.Verbosef("Routine: TUN reader - stopped")
 		device.state.stopping.Done()
@@ -399,104 +431,172 @@ func (device *Device) RoutineReadFromTUN() {
 	}
 }
 
+// StagePackets queues elems to be sent once a session is available and
+// the sequential sender has room. When the staged queue is full, the
+// oldest packets are dropped.
 func (peer *Peer) StagePackets(elems *QueueOutboundElementsContainer) {
-	for {
-		select {
-		case peer.queue.staged <- elems:
-			return
-		default:
-		}
-		select {
-		case tooOld := <-peer.queue.staged:
-			for _, elem := range tooOld.elems {
-				peer.device.PutMessageBuffer(elem.buffer)
-				peer.device.PutOutboundElement(elem)
-			}
-			peer.device.PutOutboundElementsContainer(tooOld)
-		default:
-		}
+	elems.staged = peer.device.now()
+	tooOld := peer.queue.staged.push(elems)
+	if tooOld == nil {
+		return
 	}
+	peer.queue.droppedTx.Add(uint64(len(tooOld.elems)))
+	for _, elem := range tooOld.elems {
+		peer.device.PutMessageBuffer(elem.buffer)
+		peer.device.PutOutboundElement(elem)
+	}
+	peer.device.PutOutboundElementsContainer(tooOld)
 }
 
+// SendStagedPackets gives the staged packets nonces and queues them for
+// encryption and transmission, in the order they were staged. While the
+// sequential sender is backed up they are left staged, and it resumes
+// sending them once it has caught up. While it is only busy, less than a
+// batch is held back for up to MaxCoalesceDelay, see holdStaged.
 func (peer *Peer) SendStagedPackets() {
-top:
-	if len(peer.queue.staged) == 0 || !peer.device.isUp() {
-		return
-	}
+	peer.queue.sendMu.Lock()
+	needHandshake := peer.sendStagedLocked()
+	peer.queue.sendMu.Unlock()
 
-	keypair := peer.keypairs.Current()
-	if keypair == nil || keypair.sendNonce.Load() >= RejectAfterMessages || time.Since(keypair.created) >= RejectAfterTime {
+	if needHandshake {
 		peer.SendHandshakeInitiation(false)
-		return
 	}
+}
+
+// sendStagedLocked is SendStagedPackets with peer.queue.sendMu held, which
+// makes it the only sender on the outbound queue besides Stop. It reports
+// whether a handshake is needed to send the packets left staged.
+func (peer *Peer) sendStagedLocked() (needHandshake bool) {
+	for peer.queue.staged.len() > 0 && peer.device.isUp() {
+		keypair := peer.keypairs.Current()
+		if keypair == nil || keypair.sendNonce.Load() >= RejectAfterMessages || peer.device.since(keypair.created) >= RejectAfterTime {
+			return true
+		}
+
+		// Leave the packets staged while the sequential sender is backed
+		// up, before they are given nonces, which they would otherwise be
+		// given again once resumed. Nothing else fills the queue while
+		// sendMu is held, so it has room for what is taken next.
+		if peer.isRunning.Load() && len(peer.queue.outbound.c) == cap(peer.queue.outbound.c) {
+			return false
+		}
+		if peer.holdStaged() {
+			return false
+		}
+
+		elemsContainer := peer.queue.staged.pop()
+		if elemsContainer == nil {
+			return false
+		}
+		peer.coalesceStaged(elemsContainer)
 
-	for {
 		var elemsContainerOOO *QueueOutboundElementsContainer
-		select {
-		case elemsContainer := <-peer.queue.staged:
-			i := 0
-			for _, elem := range elemsContainer.elems {
-				elem.peer = peer
-				elem.nonce = keypair.sendNonce.Add(1) - 1
-				if elem.nonce >= RejectAfterMessages {
-					keypair.sendNonce.Store(RejectAfterMessages)
-					if elemsContainerOOO == nil {
-						elemsContainerOOO = peer.device.GetOutboundElementsContainer()
-					}
-					elemsContainerOOO.elems = append(elemsContainerOOO.elems, elem)
-					continue
-				} else {
-					elemsContainer.elems[i] = elem
-					i++
+		i := 0
+		for _, elem := range elemsContainer.elems {
+			elem.peer = peer
+			elem.nonce = keypair.sendNonce.Add(1) - 1
+			if elem.nonce >= RejectAfterMessages {
+				keypair.sendNonce.Store(RejectAfterMessages)
+				if elemsContainerOOO == nil {
+					elemsContainerOOO = peer.device.GetOutboundElementsContainer()
 				}
-
-				elem.keypair = keypair
+				elemsContainerOOO.elems = append(elemsContainerOOO.elems, elem)
+				continue
+			} else {
+				elemsContainer.elems[i] = elem
+				i++
 			}
-			elemsContainer.Lock()
-			elemsContainer.elems = elemsContainer.elems[:i]
 
-			if elemsContainerOOO != nil {
-				peer.StagePackets(elemsContainerOOO) // XXX: Out of order, but we can't front-load go chans
-			}
+			elem.keypair = keypair
+		}
+		elemsContainer.Lock()
+		elemsContainer.elems = elemsContainer.elems[:i]
 
-			if len(elemsContainer.elems) == 0 {
-				peer.device.PutOutboundElementsContainer(elemsContainer)
-				goto top
-			}
+		if elemsContainerOOO != nil {
+			peer.StagePackets(elemsContainerOOO) // XXX: Out of order, behind what was staged since
+		}
 
-			// add to parallel and sequential queue
-			if peer.isRunning.Load() {
-				peer.queue.outbound.c <- elemsContainer
+		if len(elemsContainer.elems) == 0 {
+			peer.device.PutOutboundElementsContainer(elemsContainer)
+			continue
+		}
+
+		// add to parallel and sequential queue
+		if peer.isRunning.Load() {
+			select {
+			case peer.queue.outbound.c <- elemsContainer:
 				peer.device.queue.encryption.c <- elemsContainer
-			} else {
-				for _, elem := range elemsContainer.elems {
-					peer.device.PutMessageBuffer(elem.buffer)
-					peer.device.PutOutboundElement(elem)
-				}
-				peer.device.PutOutboundElementsContainer(elemsContainer)
+				continue
+			default:
+				// Only the nil sent by Stop can have taken the room, the
+				// packets go along with the rest of the peer's queues
+				peer.queue.droppedTx.Add(uint64(len(elemsContainer.elems)))
 			}
+		}
+		for _, elem := range elemsContainer.elems {
+			peer.device.PutMessageBuffer(elem.buffer)
+			peer.device.PutOutboundElement(elem)
+		}
+		peer.device.PutOutboundElementsContainer(elemsContainer)
+	}
+	return false
+}
 
-			if elemsContainerOOO != nil {
-				goto top
-			}
-		default:
+// holdStaged reports whether the staged packets are left for more to join
+// them in one batch. They are while the sequential sender is still busy
+// with earlier batches, they make up less than a batch and the oldest of
+// them was staged less than MaxCoalesceDelay ago. A timer sends them once
+// it has been. peer.queue.sendMu must be held.
+func (peer *Peer) holdStaged() bool {
+	if len(peer.queue.outbound.c) == 0 {
+		return false
+	}
+	oldest, packets := peer.queue.staged.peek()
+	if packets >= peer.device.BatchSize() {
+		return false
+	}
+	wait := MaxCoalesceDelay - peer.device.since(oldest)
+	if wait <= 0 {
+		return false
+	}
+
+	if peer.queue.flush == nil {
+		peer.queue.flush = peer.device.clock.AfterFunc(wait, peer.SendStagedPackets)
+	} else {
+		peer.queue.flush.Reset(wait)
+	}
+	return true
+}
+
+// coalesceStaged moves the packets of further staged containers into c, up
+// to the device batch size, so that they are sealed by one encryption worker
+// and sent in one write instead of one container per wake-up. It only takes
+// what is already queued, holdStaged bounds how long that may be waited
+// for. A container that does not fit is left staged.
+func (peer *Peer) coalesceStaged(c *QueueOutboundElementsContainer) {
+	maxBatch := peer.device.BatchSize()
+	for len(c.elems) < maxBatch {
+		next := peer.queue.staged.popFit(maxBatch - len(c.elems))
+		if next == nil {
 			return
 		}
+		c.elems = append(c.elems, next.elems...)
+		next.elems = next.elems[:0]
+		peer.device.PutOutboundElementsContainer(next)
 	}
 }
 
 func (peer *Peer) FlushStagedPackets() {
 	for {
-		select {
-		case elemsContainer := <-peer.queue.staged:
-			for _, elem := range elemsContainer.elems {
-				peer.device.PutMessageBuffer(elem.buffer)
-				peer.device.PutOutboundElement(elem)
-			}
-			peer.device.PutOutboundElementsContainer(elemsContainer)
-		default:
+		elemsContainer := peer.queue.staged.pop()
+		if elemsContainer == nil {
 			return
 		}
+		for _, elem := range elemsContainer.elems {
+			peer.device.PutMessageBuffer(elem.buffer)
+			peer.device.PutOutboundElement(elem)
+		}
+		peer.device.PutOutboundElementsContainer(elemsContainer)
 	}
 }
 
@@ -521,11 +621,13 @@ func calculatePaddingSize(packetSize, mtu int) int {
  * Obs. One instance per core
  */
 func (device *Device) RoutineEncryption(id int) {
+	defer device.recoverPanic()
 	var paddingZeros [PaddingMultiple]byte
 	var nonce [chacha20poly1305.NonceSize]byte
 
 	defer device.log.Verbosef("Routine: encryption worker %d - stopped", id)
 	device.log.Verbosef("Routine: encryption worker %d - started", id)
+	device.pinWorker(workerCrypto)
 
 	for elemsContainer := range device.queue.encryption.c {
 		for _, elem := range elemsContainer.elems {
@@ -540,9 +642,15 @@ func (device *Device) RoutineEncryption(id int) {
 			binary.LittleEndian.PutUint32(fieldReceiver, elem.keypair.remoteIndex)
 			binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
 
-			// pad content to multiple of 16
-			paddingSize := calculatePaddingSize(len(elem.packet), int(device.tun.mtu.Load()))
-			elem.packet = append(elem.packet, paddingZeros[:paddingSize]...)
+			// pad content to multiple of 16, or to the shaping profile
+			if shaping := device.shaping.Load(); shaping != nil {
+				size := len(elem.packet)
+				elem.packet = elem.packet[:size+shaping.paddingSize(size, int(device.tun.mtu.Load()))]
+				clear(elem.packet[size:])
+			} else {
+				paddingSize := calculatePaddingSize(len(elem.packet), int(device.tun.mtu.Load()))
+				elem.packet = append(elem.packet, paddingZeros[:paddingSize]...)
+			}
 
 			// encrypt content and release to consumer
 
@@ -559,12 +667,14 @@ func (device *Device) RoutineEncryption(id int) {
 }
 
 func (peer *Peer) RoutineSequentialSender(maxBatchSize int) {
+	defer peer.device.recoverPanic()
 	device := peer.device
 	defer func() {
 		defer device.log.Verbosef("%v - Routine: sequential sender - stopped", peer)
 		peer.stopping.Done()
 	}()
 	device.log.Verbosef("%v - Routine: sequential sender - started", peer)
+	device.pinWorker(workerTX)
 
 	bufs := make([][]byte, 0, maxBatchSize)
 
@@ -590,7 +700,7 @@ func (peer *Peer) RoutineSequentialSender(maxBatchSize int) {
 		dataSent := false
 		elemsContainer.Lock()
 		for _, elem := range elemsContainer.elems {
-			if len(elem.packet) != MessageKeepaliveSize {
+			if len(elem.packet) != MessageKeepaliveSize && !elem.cover {
 				dataSent = true
 			}
 			bufs = append(bufs, elem.packet)
@@ -599,8 +709,14 @@ func (peer *Peer) RoutineSequentialSender(maxBatchSize int) {
 		peer.timersAnyAuthenticatedPacketTraversal()
 		peer.timersAnyAuthenticatedPacketSent()
 
-		err := peer.SendBuffers(bufs, false)
+		var err error
+		if shaping := device.shaping.Load(); shaping != nil && shaping.Rate > 0 {
+			err = peer.sendPaced(bufs, shaping.ShapingProfile)
+		} else {
+			err = peer.SendBuffers(bufs, false)
+		}
 		if dataSent {
+			peer.lastDataSentNano.Store(time.Now().UnixNano())
 			peer.timersDataSent()
 		}
 		for _, elem := range elemsContainer.elems {
@@ -621,5 +737,9 @@ func (peer *Peer) RoutineSequentialSender(maxBatchSize int) {
 		}
 
 		peer.keepKeyFreshSending()
+
+		if peer.queue.staged.len() > 0 {
+			peer.SendStagedPackets()
+		}
 	}
 }
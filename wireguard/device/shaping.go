@@ -0,0 +1,249 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* A ShapingProfile pads and paces transport packets sent to peers so that
+ * their sizes and timing resemble some common kind of traffic, for networks
+ * classifying flows by their shape rather than their content. Padding is
+ * added inside the encrypted payload, where receivers strip it by the
+ * length of the inner IP packet, so peers need no configuration. Cover
+ * packets carry nothing but zeroes, which receivers drop after decryption.
+ */
+type ShapingProfile struct {
+	// Sizes are the ascending content sizes packets are padded up to,
+	// larger packets are padded up to the MTU.
+	Sizes []int
+	// Rate bounds the packets per second sent to each peer, of which Burst
+	// go out at once, smoothing bursts into a steady flow. Zero leaves the
+	// rate alone.
+	Rate  int
+	Burst int
+	// CoverIdle is how long a peer goes without data sent before cover
+	// packets are sent to it, about as often. Zero sends none.
+	CoverIdle time.Duration
+	// CoverBurst bounds the number of cover packets sent at once, of the
+	// sizes in CoverSizes, or in Sizes if empty.
+	CoverBurst int
+	CoverSizes []int
+}
+
+var shapingProfiles = struct {
+	sync.RWMutex
+	profiles map[string]*ShapingProfile
+}{
+	profiles: map[string]*ShapingProfile{
+		// a video call: audio frame sized packets every 20ms, even when
+		// idle, and video packets just under the MTU at a steady pace
+		"video": {
+			Sizes:      []int{200, 1100},
+			Rate:       600,
+			Burst:      10,
+			CoverIdle:  20 * time.Millisecond,
+			CoverBurst: 1,
+			CoverSizes: []int{200},
+		},
+		// https browsing: small requests and acknowledgements, full sized
+		// packets in bursts, and a few requests now and then while idle
+		"browsing": {
+			Sizes:      []int{128, 640},
+			CoverIdle:  5 * time.Second,
+			CoverBurst: 12,
+		},
+	},
+}
+
+// RegisterShapingProfile makes a shaping profile available under name.
+func RegisterShapingProfile(name string, profile ShapingProfile) {
+	shapingProfiles.Lock()
+	defer shapingProfiles.Unlock()
+	shapingProfiles.profiles[name] = &profile
+}
+
+// ShapingProfiles returns the names of all registered shaping profiles.
+func ShapingProfiles() []string {
+	shapingProfiles.RLock()
+	defer shapingProfiles.RUnlock()
+
+	names := make([]string, 0, len(shapingProfiles.profiles))
+	for name := range shapingProfiles.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type namedShapingProfile struct {
+	name string
+	*ShapingProfile
+}
+
+// SetShaping selects the registered shaping profile packets sent to peers
+// are shaped after, the empty name sends them unshaped.
+func (device *Device) SetShaping(name string) error {
+	if name == "" {
+		device.shaping.Store(nil)
+	} else {
+		shapingProfiles.RLock()
+		profile, ok := shapingProfiles.profiles[name]
+		shapingProfiles.RUnlock()
+		if !ok {
+			return errors.New("unknown shaping profile")
+		}
+		device.shaping.Store(&namedShapingProfile{name: name, ShapingProfile: profile})
+	}
+
+	select {
+	case device.shapingChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// paddingSize returns the padding bringing content of packetSize up to the
+// next size of the profile, or up to the MTU.
+func (p *ShapingProfile) paddingSize(packetSize, mtu int) int {
+	if mtu == 0 || packetSize >= mtu {
+		return calculatePaddingSize(packetSize, mtu)
+	}
+	for _, size := range p.Sizes {
+		if packetSize <= size {
+			return min(size, mtu) - packetSize
+		}
+	}
+	return mtu - packetSize
+}
+
+// shapingPacer paces the packets sent to a peer at the rate of the shaping
+// profile. It is a GCRA limiter like handshakePacer.
+type shapingPacer struct {
+	mu  sync.Mutex
+	tat time.Time // theoretical arrival time of the next packet
+}
+
+// reserve claims slots for n packets, at most the profile's burst, and
+// returns how long the caller has to wait before sending them.
+func (p *shapingPacer) reserve(n int, profile *ShapingProfile) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	interval := time.Second / time.Duration(profile.Rate)
+	now := time.Now()
+	if p.tat.Before(now) {
+		p.tat = now
+	}
+
+	delay := p.tat.Sub(now) - time.Duration(max(profile.Burst, 1)-n)*interval
+	p.tat = p.tat.Add(time.Duration(n) * interval)
+
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// sendPaced sends bufs in bursts paced at the rate of profile.
+func (peer *Peer) sendPaced(bufs [][]byte, profile *ShapingProfile) error {
+	burst := max(profile.Burst, 1)
+	for len(bufs) > 0 {
+		n := min(len(bufs), burst)
+		if delay := peer.shaper.reserve(n, profile); delay > 0 {
+			time.Sleep(delay)
+		}
+		if err := peer.SendBuffers(bufs[:n], false); err != nil {
+			return err
+		}
+		bufs = bufs[n:]
+	}
+	return nil
+}
+
+// RoutineCoverTraffic sends cover packets to the peers that went without
+// data sent for the cover idle time of the shaping profile, or the decoy
+// interval.
+func (device *Device) RoutineCoverTraffic() {
+	defer device.recoverPanic()
+	defer device.log.Verbosef("Routine: cover traffic - stopped")
+	device.log.Verbosef("Routine: cover traffic - started")
+
+	for {
+		cover := device.coverProfile()
+		var tick <-chan time.Time
+		if cover != nil {
+			// jitter by a quarter either way so cover isn't periodic
+			idle := uint64(cover.CoverIdle)
+			tick = time.After(time.Duration(randomInt(idle*3/4, idle*5/4+1)))
+		}
+
+		select {
+		case <-device.closed:
+			return
+		case <-device.shapingChanged:
+			continue
+		case <-tick:
+		}
+
+		device.peers.RLock()
+		for _, peer := range device.peers.keyMap {
+			if !peer.isRunning.Load() || time.Since(time.Unix(0, peer.lastDataSentNano.Load())) < cover.CoverIdle {
+				continue
+			}
+			// Cover must not set off handshakes
+			keypair := peer.keypairs.Current()
+			if keypair == nil || time.Since(keypair.created) >= RejectAfterTime {
+				continue
+			}
+			peer.sendCover(cover)
+		}
+		device.peers.RUnlock()
+	}
+}
+
+// sendCover sends a few cover packets of the sizes of profile, or of
+// random sizes up to the MTU if it has none.
+func (peer *Peer) sendCover(profile *ShapingProfile) {
+	if peer.queue.staged.len() > 0 {
+		return
+	}
+	sizes := profile.CoverSizes
+	if len(sizes) == 0 {
+		sizes = profile.Sizes
+	}
+	mtu := int(peer.device.tun.mtu.Load())
+	if mtu <= 0 {
+		mtu = DefaultMTU
+	}
+
+	elemsContainer := peer.device.GetOutboundElementsContainer()
+	for n := 1 + randomInt(0, uint64(max(profile.CoverBurst, 1))); n > 0; n-- {
+		size := int(randomInt(minDecoySize, uint64(mtu)+1))
+		if len(sizes) > 0 {
+			size = min(sizes[randomInt(0, uint64(len(sizes)))], mtu)
+		}
+		elem := peer.device.NewOutboundElement()
+		elem.cover = true
+		elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+size]
+		clear(elem.packet)
+		elemsContainer.elems = append(elemsContainer.elems, elem)
+	}
+
+	if !peer.queue.staged.offer(elemsContainer) {
+		for _, elem := range elemsContainer.elems {
+			peer.device.PutMessageBuffer(elem.buffer)
+			peer.device.PutOutboundElement(elem)
+		}
+		peer.device.PutOutboundElementsContainer(elemsContainer)
+		return
+	}
+	peer.device.log.Verbosef("%v - Sending %d cover packets", peer, len(elemsContainer.elems))
+	peer.SendStagedPackets()
+}
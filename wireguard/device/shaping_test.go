@@ -0,0 +1,89 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShapingPaddingSize(t *testing.T) {
+	p := &ShapingProfile{Sizes: []int{200, 1100}}
+	for _, tt := range []struct {
+		size, mtu, want int
+	}{
+		{0, 1280, 200},
+		{60, 1280, 200},
+		{200, 1280, 200},
+		{201, 1280, 1100},
+		{1101, 1280, 1280},
+		{1280, 1280, 1280},
+		{150, 160, 160},
+		{60, 0, 64},
+	} {
+		if got := tt.size + p.paddingSize(tt.size, tt.mtu); got != tt.want {
+			t.Errorf("padded %d with mtu %d to %d, want %d", tt.size, tt.mtu, got, tt.want)
+		}
+	}
+}
+
+func TestShapingPacer(t *testing.T) {
+	var p shapingPacer
+	profile := &ShapingProfile{Rate: 100, Burst: 4}
+
+	if delay := p.reserve(4, profile); delay != 0 {
+		t.Fatalf("burst delayed by %v", delay)
+	}
+	delay := p.reserve(4, profile)
+	if want := 4 * 10 * time.Millisecond; delay <= want-time.Millisecond || delay > want {
+		t.Fatalf("second burst delayed by %v, want about %v", delay, want)
+	}
+}
+
+func TestSetShaping(t *testing.T) {
+	device := &Device{shapingChanged: make(chan struct{}, 1)}
+	if err := device.SetShaping("nonexistent"); err == nil {
+		t.Fatal("unknown shaping profile accepted")
+	}
+	for _, name := range ShapingProfiles() {
+		if err := device.SetShaping(name); err != nil {
+			t.Fatalf("shaping profile %s: %v", name, err)
+		}
+		if got := device.shaping.Load().name; got != name {
+			t.Fatalf("shaping after %s, got %s", name, got)
+		}
+	}
+	if err := device.SetShaping(""); err != nil || device.shaping.Load() != nil {
+		t.Fatalf("shaping not cleared: %v", err)
+	}
+}
+
+func TestCoverProfile(t *testing.T) {
+	device := &Device{shapingChanged: make(chan struct{}, 1)}
+	if device.coverProfile() != nil {
+		t.Fatal("cover sent by default")
+	}
+
+	device.SetDecoyInterval(time.Minute)
+	if cover := device.coverProfile(); cover == nil || cover.CoverIdle != time.Minute {
+		t.Fatalf("decoy cover %+v, want one every minute", cover)
+	}
+
+	if err := device.SetShaping("video"); err != nil {
+		t.Fatal(err)
+	}
+	if cover := device.coverProfile(); cover == nil || cover.CoverIdle != 20*time.Millisecond {
+		t.Fatalf("cover %+v, want the shaping profile's", cover)
+	}
+
+	device.SetDecoyInterval(0)
+	if err := device.SetShaping(""); err != nil {
+		t.Fatal(err)
+	}
+	if device.coverProfile() != nil {
+		t.Fatal("cover sent after disabling")
+	}
+}
@@ -48,6 +48,8 @@ func (device *Device) startRouteListener(bind conn.Bind) (*rwcancel.RWCancel, er
 }
 
 func (device *Device) routineRouteListener(bind conn.Bind, netlinkSock int, netlinkCancel *rwcancel.RWCancel) {
+	defer device.recoverPanic()
+
 	type peerEndpointPtr struct {
 		peer     *Peer
 		endpoint *conn.Endpoint
@@ -97,6 +97,46 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			sendf("fwmark=%d", device.net.fwmark)
 		}
 
+		if suite := device.suite.Load(); suite.name != DefaultCipherSuite {
+			sendf("cipher_suite=%s", suite.name)
+		}
+
+		if depth := device.reorderDepth.Load(); depth != 0 {
+			sendf("reorder_depth=%d", depth)
+		}
+
+		if device.unknownIndex.recovery.Load() {
+			sendf("unknown_index_recovery=true")
+		}
+
+		if device.presharedMAC1.Load() {
+			sendf("preshared_mac1=true")
+		}
+
+		if key := device.knock.key.Load(); key != nil {
+			keyf("knock_key", (*[32]byte)(key))
+		}
+
+		if shaping := device.shaping.Load(); shaping != nil {
+			sendf("shaping=%s", shaping.name)
+		}
+
+		if interval := time.Duration(device.decoyInterval.Load()); interval != 0 {
+			sendf("decoy_interval=%d", int(interval.Seconds()))
+		}
+
+		if fragments := device.initFragments.Load(); fragments != 0 {
+			sendf("init_fragments=%d", fragments)
+		}
+
+		if junk := device.initJunk.Load(); junk != 0 {
+			sendf("init_junk=%d", junk)
+		}
+
+		if device.initQUIC.Load() {
+			sendf("init_mimic=%s", InitiationMimicQUIC)
+		}
+
 		for _, peer := range device.peers.keyMap {
 			// Serialize peer state.
 			peer.handshake.mutex.RLock()
@@ -118,6 +158,28 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			sendf("last_handshake_time_nsec=%d", nano)
 			sendf("tx_bytes=%d", peer.txBytes.Load())
 			sendf("rx_bytes=%d", peer.rxBytes.Load())
+			if srtt, rttvar := peer.rtt.estimate(); srtt != 0 {
+				sendf("rtt_ms=%d", srtt.Milliseconds())
+				sendf("rtt_var_ms=%d", rttvar.Milliseconds())
+			}
+			if latency := peer.HandshakeLatency(); latency.Count != 0 {
+				sendf("handshake_count=%d", latency.Count)
+				sendf("handshake_p50_ms=%d", latency.P50.Milliseconds())
+				sendf("handshake_p95_ms=%d", latency.P95.Milliseconds())
+				sendf("handshake_p99_ms=%d", latency.P99.Milliseconds())
+			}
+			keypair := peer.KeypairStats()
+			if !keypair.Created.IsZero() {
+				sendf("keypair_created_sec=%d", keypair.Created.Unix())
+				sendf("keypair_sent=%d", keypair.Sent)
+				sendf("keypair_received=%d", keypair.Received)
+			}
+			sendf("keypair_rotations=%d", keypair.Rotations)
+			sendf("staged_queue_depth=%d", peer.queue.staged.len())
+			sendf("outbound_queue_depth=%d", len(peer.queue.outbound.c))
+			sendf("inbound_queue_depth=%d", len(peer.queue.inbound.c))
+			sendf("tx_queue_dropped=%d", peer.queue.droppedTx.Load())
+			sendf("rx_queue_dropped=%d", peer.queue.droppedRx.Load())
 			sendf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval.Load())
 			sendf("trick=%s", peer.trick)
 			sendf("reserved=%d,%d,%d", peer.reserved[0], peer.reserved[1], peer.reserved[2])
@@ -235,6 +297,80 @@ func (device *Device) handleDeviceLine(key, value string) error {
 			return ipcErrorf(ipc.IpcErrorPortInUse, "failed to update fwmark: %w", err)
 		}
 
+	case "cipher_suite":
+		device.log.Verbosef("UAPI: Updating cipher suite")
+		if err := device.SetCipherSuite(value); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set cipher_suite: %w", err)
+		}
+
+	case "reorder_depth":
+		depth, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid reorder_depth: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating reorder depth")
+		device.SetReorderDepth(int(depth))
+
+	case "unknown_index_recovery":
+		recovery, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid unknown_index_recovery: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating unknown index recovery")
+		device.SetUnknownIndexRecovery(recovery)
+
+	case "preshared_mac1":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid preshared_mac1: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating preshared mac1")
+		device.SetPresharedMAC1(enabled)
+
+	case "knock_key":
+		var key NoisePresharedKey
+		if err := key.FromHex(value); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set knock_key: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating knock key")
+		device.SetKnockKey(key)
+
+	case "shaping":
+		device.log.Verbosef("UAPI: Updating shaping profile")
+		if err := device.SetShaping(value); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set shaping: %w", err)
+		}
+
+	case "decoy_interval":
+		secs, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid decoy_interval: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating decoy interval")
+		device.SetDecoyInterval(time.Duration(secs) * time.Second)
+
+	case "init_fragments":
+		fragments, err := strconv.ParseUint(value, 10, 8)
+		if err != nil || fragments > MaxInitiationFragments {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid init_fragments: %v", value)
+		}
+		device.log.Verbosef("UAPI: Updating initiation fragments")
+		device.SetInitiationFraming(int(fragments), int(device.initJunk.Load()))
+
+	case "init_junk":
+		junk, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid init_junk: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating initiation junk")
+		device.SetInitiationFraming(int(device.initFragments.Load()), int(junk))
+
+	case "init_mimic":
+		device.log.Verbosef("UAPI: Updating initiation mimicry")
+		if err := device.SetInitiationMimicry(value); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set init_mimic: %w", err)
+		}
+
 	case "replace_peers":
 		if value != "true" {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set replace_peers, invalid value: %v", value)
@@ -0,0 +1,68 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"github.com/bepass-org/warp-plus/wireguard/conn"
+)
+
+// unknownIndexReportInterval is how often transport packets for unknown
+// receiver indices are logged, and at most how often they make the device
+// handshake to recover.
+const unknownIndexReportInterval = RekeyTimeout
+
+// UnknownIndexPackets returns how many transport packets arrived for a
+// receiver index the device doesn't know. A remote end still sending them
+// holds a session the device dropped, as after a restart, and keeps
+// sending into the void until its own keys expire.
+func (device *Device) UnknownIndexPackets() uint64 {
+	return device.unknownIndex.count.Load()
+}
+
+// SetUnknownIndexRecovery makes the device handshake with the peer sending
+// transport packets for an unknown receiver index, replacing its stale
+// session right away.
+func (device *Device) SetUnknownIndexRecovery(enabled bool) {
+	device.unknownIndex.recovery.Store(enabled)
+}
+
+func (device *Device) receivedUnknownIndex(endpoint conn.Endpoint) {
+	count := device.unknownIndex.count.Add(1)
+
+	now := device.now().UnixNano()
+	last := device.unknownIndex.lastReport.Load()
+	if now-last < int64(unknownIndexReportInterval) || !device.unknownIndex.lastReport.CompareAndSwap(last, now) {
+		return
+	}
+	device.log.Verbosef("Received transport packets for unknown receiver indices from %s (%d so far)", endpoint.DstToString(), count)
+
+	if !device.unknownIndex.recovery.Load() {
+		return
+	}
+	if peer := device.lookupPeerByEndpoint(endpoint); peer != nil {
+		device.log.Verbosef("%v - Handshaking to replace a stale session", peer)
+		peer.SendHandshakeInitiation(false)
+	}
+}
+
+// lookupPeerByEndpoint returns the peer whose endpoint has the destination
+// of endpoint, if any.
+func (device *Device) lookupPeerByEndpoint(endpoint conn.Endpoint) *Peer {
+	dst := endpoint.DstToString()
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	for _, peer := range device.peers.keyMap {
+		peer.endpoint.Lock()
+		match := peer.endpoint.val != nil && peer.endpoint.val.DstToString() == dst
+		peer.endpoint.Unlock()
+		if match {
+			return peer
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun/tuntest"
+)
+
+func TestUnknownIndex(t *testing.T) {
+	for _, recovery := range []bool{false, true} {
+		pair := genClockTestPair(t)
+		pair.Send(t, Ping, nil)
+		pair.Send(t, Pong, nil)
+		pair.settle(t)
+
+		// The first device forgets the session as if it restarted, while
+		// the second one keeps sending on it
+		p0, p1 := &pair.testPair[0], &pair.testPair[1]
+		p0.dev.SetUnknownIndexRecovery(recovery)
+		pair.peer(0).ZeroAndFlushAll()
+		pair.clock.Advance(RekeyTimeout)
+		stale := pair.peer(1).keypairs.Current()
+		p1.tun.Outbound <- tuntest.Ping(p0.ip, p1.ip)
+
+		waitFor(t, "unknown index packet", func() bool {
+			return p0.dev.UnknownIndexPackets() == 1
+		})
+		if !recovery {
+			if n := pair.initiated[0].Load(); n != 0 {
+				t.Fatalf("sent %d initiations without recovery, want 0", n)
+			}
+			continue
+		}
+
+		waitFor(t, "stale session to be replaced", func() bool {
+			current := pair.peer(1).keypairs.Current()
+			return current != nil && current != stale
+		})
+		if n := pair.initiated[0].Load(); n != 1 {
+			t.Fatalf("sent %d initiations to recover, want 1", n)
+		}
+		pair.Send(t, Ping, nil)
+	}
+}
@@ -32,6 +32,11 @@ func Now() Timestamp {
 	return stamp(time.Now())
 }
 
+// At returns the timestamp of t, for clocks other than the system one.
+func At(t time.Time) Timestamp {
+	return stamp(t)
+}
+
 func (t1 Timestamp) After(t2 Timestamp) bool {
 	return bytes.Compare(t1[:], t2[:]) > 0
 }
@@ -0,0 +1,535 @@
+//go:build netstack_lite
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+// The lite stack is a small TCP/IP of its own, built in place of gVisor with
+// the netstack_lite build tag, for devices short on memory. It keeps no
+// stack wide buffers or goroutines, only what each connection needs.
+//
+// It is a client: TCP connections are dialed, never accepted, while UDP and
+// ping sockets may be bound. IP fragments, options and IPv6 extension
+// headers are dropped, datagrams are never fragmented, and TCP has a window
+// of at most 64KiB, without SACK and with Reno congestion control.
+
+package netstack
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	// outboundQueueLen bounds the packets waiting to go out the tunnel
+	outboundQueueLen = 256
+	// maxQueuedDatagrams bounds the datagrams waiting to be read from a
+	// UDP or ping socket, more are dropped
+	maxQueuedDatagrams = 64
+	// firstEphemeralPort and lastEphemeralPort are the range of the ports,
+	// and ping identifiers, picked for sockets
+	firstEphemeralPort = 32768
+	lastEphemeralPort  = 60999
+	// defaultTTL is the ttl, or hop limit, of the packets sent
+	defaultTTL = 64
+)
+
+// CongestionControls lists the valid TCPTuning.CongestionControl values.
+var CongestionControls = []string{"reno"}
+
+type netTun struct {
+	events         chan tun.Event
+	incomingPacket chan []byte
+	mtu            int
+	dnsServers     []netip.Addr
+	hasV4, hasV6   bool
+	addrs          []netip.Addr
+	forwardPings   atomic.Bool
+	pings          chan struct{}
+	// done is closed with the device, closed guards incomingPacket
+	// against sends after that
+	done    chan struct{}
+	closeMu sync.RWMutex
+	closed  bool
+
+	// rcvBufSize and sndBufSize are the buffers of TCP connections
+	rcvBufSize, sndBufSize int
+	ipID                   atomic.Uint32
+
+	mu   sync.Mutex
+	tcp  map[connID]*TCPConn
+	udp  map[uint16]*UDPConn
+	icmp map[uint16]*PingConn
+}
+
+type Net netTun
+
+// connID identifies a TCP connection.
+type connID struct {
+	local, remote netip.AddrPort
+}
+
+func CreateNetTUN(localAddresses, dnsServers []netip.Addr, mtu int) (tun.Device, *Net, error) {
+	dev := &netTun{
+		events:         make(chan tun.Event, 10),
+		incomingPacket: make(chan []byte, outboundQueueLen),
+		dnsServers:     dnsServers,
+		mtu:            mtu,
+		pings:          make(chan struct{}, maxForwardedPings),
+		done:           make(chan struct{}),
+		tcp:            make(map[connID]*TCPConn),
+		udp:            make(map[uint16]*UDPConn),
+		icmp:           make(map[uint16]*PingConn),
+	}
+	for _, ip := range localAddresses {
+		if !ip.IsValid() {
+			return nil, nil, errors.New("invalid local address")
+		}
+		ip = ip.Unmap()
+		dev.addrs = append(dev.addrs, ip)
+		if ip.Is4() {
+			dev.hasV4 = true
+		} else {
+			dev.hasV6 = true
+		}
+	}
+
+	// The receive buffer beyond the largest unscaled window would never
+	// fill
+	dev.rcvBufSize, dev.sndBufSize = maxUnscaledWindow, 256<<10
+	if TCP.ReceiveBufferSize > 0 {
+		dev.rcvBufSize = min(TCP.ReceiveBufferSize, maxUnscaledWindow)
+	}
+	if TCP.SendBufferSize > 0 {
+		dev.sndBufSize = TCP.SendBufferSize
+	}
+	for _, limit := range []int{TCP.MaxBufferSize, TCPMaxBufferSize} {
+		if limit > 0 {
+			dev.rcvBufSize, dev.sndBufSize = min(dev.rcvBufSize, limit), min(dev.sndBufSize, limit)
+		}
+	}
+	dev.rcvBufSize, dev.sndBufSize = max(dev.rcvBufSize, 4<<10), max(dev.sndBufSize, 4<<10)
+
+	dev.events <- tun.EventUp
+	return dev, (*Net)(dev), nil
+}
+
+func (tun *netTun) Name() (string, error) {
+	return "go", nil
+}
+
+func (tun *netTun) File() *os.File {
+	return nil
+}
+
+func (tun *netTun) Events() <-chan tun.Event {
+	return tun.events
+}
+
+func (tun *netTun) Read(buf [][]byte, sizes []int, offset int) (int, error) {
+	packet, ok := <-tun.incomingPacket
+	if !ok {
+		return 0, os.ErrClosed
+	}
+	sizes[0] = copy(buf[0][offset:], packet)
+	return 1, nil
+}
+
+func (tun *netTun) Write(buf [][]byte, offset int) (int, error) {
+	for _, buf := range buf {
+		packet := buf[offset:]
+		if len(packet) == 0 {
+			continue
+		}
+
+		if tun.forwardPings.Load() && tun.forwardPing(packet) {
+			continue
+		}
+
+		switch packet[0] >> 4 {
+		case 4, 6:
+			tun.deliver(packet)
+		default:
+			return 0, syscall.EAFNOSUPPORT
+		}
+	}
+	return len(buf), nil
+}
+
+// inject passes packet out the tunnel, unless the device is closed.
+func (tun *netTun) inject(packet []byte) {
+	tun.closeMu.RLock()
+	defer tun.closeMu.RUnlock()
+	if tun.closed {
+		return
+	}
+	select {
+	case tun.incomingPacket <- packet:
+	case <-tun.done:
+	}
+}
+
+func (tun *netTun) Close() error {
+	if tun.events != nil {
+		close(tun.events)
+	}
+
+	close(tun.done)
+	tun.closeMu.Lock()
+	if !tun.closed {
+		close(tun.incomingPacket)
+	}
+	tun.closed = true
+	tun.closeMu.Unlock()
+
+	tun.mu.Lock()
+	tcpConns := make([]*TCPConn, 0, len(tun.tcp))
+	for _, c := range tun.tcp {
+		tcpConns = append(tcpConns, c)
+	}
+	udpConns := make([]*UDPConn, 0, len(tun.udp))
+	for _, c := range tun.udp {
+		udpConns = append(udpConns, c)
+	}
+	pingConns := make([]*PingConn, 0, len(tun.icmp))
+	for _, c := range tun.icmp {
+		pingConns = append(pingConns, c)
+	}
+	tun.mu.Unlock()
+
+	for _, c := range tcpConns {
+		c.mu.Lock()
+		c.finish(net.ErrClosed)
+		c.mu.Unlock()
+	}
+	for _, c := range udpConns {
+		c.Close()
+	}
+	for _, c := range pingConns {
+		c.Close()
+	}
+	return nil
+}
+
+func (tun *netTun) MTU() (int, error) {
+	return tun.mtu, nil
+}
+
+func (tun *netTun) BatchSize() int {
+	return 1
+}
+
+// isClosed reports whether the device was closed.
+func (tun *netTun) isClosed() bool {
+	tun.closeMu.RLock()
+	defer tun.closeMu.RUnlock()
+	return tun.closed
+}
+
+// deliver passes a packet from the tunnel to the socket it is for.
+func (tun *netTun) deliver(packet []byte) {
+	var src, dst netip.Addr
+	var proto tcpip.TransportProtocolNumber
+	var payload []byte
+	if packet[0]>>4 == 4 {
+		ip := header.IPv4(packet)
+		if !ip.IsValid(len(packet)) || ip.More() || ip.FragmentOffset() != 0 {
+			return
+		}
+		src, dst = netip.AddrFrom4(ip.SourceAddress().As4()), netip.AddrFrom4(ip.DestinationAddress().As4())
+		proto, payload = ip.TransportProtocol(), ip.Payload()
+	} else {
+		ip := header.IPv6(packet)
+		if !ip.IsValid(len(packet)) {
+			return
+		}
+		src, dst = netip.AddrFrom16(ip.SourceAddress().As16()), netip.AddrFrom16(ip.DestinationAddress().As16())
+		proto, payload = ip.TransportProtocol(), ip.Payload()
+	}
+	if !slices.Contains(tun.addrs, dst) {
+		return
+	}
+
+	switch proto {
+	case header.TCPProtocolNumber:
+		tun.deliverTCP(src, dst, payload)
+	case header.UDPProtocolNumber:
+		tun.deliverUDP(src, dst, payload)
+	case header.ICMPv4ProtocolNumber, header.ICMPv6ProtocolNumber:
+		tun.deliverICMP(src, dst, payload)
+	}
+}
+
+// deliverICMP answers echo requests to the stack, and passes echo replies
+// to ping sockets.
+func (tun *netTun) deliverICMP(src, dst netip.Addr, msg []byte) {
+	if len(msg) < header.ICMPv4MinimumSize {
+		return
+	}
+	switch typ := msg[0]; {
+	case src.Is4() && typ == uint8(header.ICMPv4Echo):
+		tun.injectICMP(src, dst, uint8(header.ICMPv4EchoReply), 0, msg[4:])
+	case src.Is6() && typ == uint8(header.ICMPv6EchoRequest):
+		tun.injectICMP(src, dst, uint8(header.ICMPv6EchoReply), 0, msg[4:])
+	case src.Is4() && typ == uint8(header.ICMPv4EchoReply), src.Is6() && typ == uint8(header.ICMPv6EchoReply):
+		tun.mu.Lock()
+		c := tun.icmp[header.ICMPv4(msg).Ident()]
+		tun.mu.Unlock()
+		if c != nil && c.accepts(src, dst) {
+			c.push(netip.AddrPortFrom(src, 0), msg)
+		}
+	}
+}
+
+// deliverUDP passes a datagram to the socket bound to its port.
+func (tun *netTun) deliverUDP(src, dst netip.Addr, seg []byte) {
+	if len(seg) < header.UDPMinimumSize {
+		return
+	}
+	h := header.UDP(seg)
+	n := int(h.Length())
+	if n < header.UDPMinimumSize || n > len(seg) {
+		return
+	}
+	seg = seg[:n]
+	tun.mu.Lock()
+	c := tun.udp[h.DestinationPort()]
+	tun.mu.Unlock()
+	from := netip.AddrPortFrom(src, h.SourcePort())
+	if c != nil && c.accepts(from, dst) {
+		c.push(from, seg[header.UDPMinimumSize:])
+	}
+}
+
+// localAddr returns the address of the stack to reach remote from.
+func (tun *netTun) localAddr(remote netip.Addr) (netip.Addr, error) {
+	for _, addr := range tun.addrs {
+		if addr.Is4() == remote.Is4() {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, syscall.ENETUNREACH
+}
+
+// ephemeralPort picks a free port, or ping identifier, taken reporting
+// whether one is in use.
+func ephemeralPort(taken func(port uint16) bool) (uint16, error) {
+	const n = lastEphemeralPort - firstEphemeralPort + 1
+	start := randU16() % n
+	for i := uint16(0); i < n; i++ {
+		port := firstEphemeralPort + (start+i)%n
+		if !taken(port) {
+			return port, nil
+		}
+	}
+	return 0, syscall.EADDRNOTAVAIL
+}
+
+// ipPacket returns a packet from src to dst with its IP header filled in,
+// and the n bytes after it for the payload.
+func (tun *netTun) ipPacket(src, dst netip.Addr, proto tcpip.TransportProtocolNumber, n int) (packet, payload []byte) {
+	if src.Is4() {
+		packet = make([]byte, header.IPv4MinimumSize+n)
+		ip := header.IPv4(packet)
+		ip.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(packet)),
+			ID:          uint16(tun.ipID.Add(1)),
+			Flags:       header.IPv4FlagDontFragment,
+			TTL:         defaultTTL,
+			Protocol:    uint8(proto),
+			SrcAddr:     tcpip.AddrFrom4(src.As4()),
+			DstAddr:     tcpip.AddrFrom4(dst.As4()),
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		return packet, packet[header.IPv4MinimumSize:]
+	}
+	packet = make([]byte, header.IPv6MinimumSize+n)
+	header.IPv6(packet).Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(n),
+		TransportProtocol: proto,
+		HopLimit:          defaultTTL,
+		SrcAddr:           tcpip.AddrFrom16(src.As16()),
+		DstAddr:           tcpip.AddrFrom16(dst.As16()),
+	})
+	return packet, packet[header.IPv6MinimumSize:]
+}
+
+// transportChecksum returns the checksum of a TCP or UDP segment whose
+// checksum field is zero.
+func transportChecksum(proto tcpip.TransportProtocolNumber, src, dst netip.Addr, seg []byte) uint16 {
+	xsum := header.PseudoHeaderChecksum(proto, tcpip.AddrFromSlice(src.AsSlice()), tcpip.AddrFromSlice(dst.AsSlice()), uint16(len(seg)))
+	return ^checksum.Checksum(seg, xsum)
+}
+
+// connState is the lock, deadlines and wake ups the sockets of the stack
+// share.
+type connState struct {
+	mu                          sync.Mutex
+	readDeadline, writeDeadline time.Time
+	// changed is closed on any change waits look for, nil when nobody
+	// waits
+	changed chan struct{}
+}
+
+// broadcast wakes the waits, with mu held.
+func (s *connState) broadcast() {
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// wait waits, with mu held, for a broadcast or for deadline to pass,
+// failing if it has.
+func (s *connState) wait(deadline time.Time) error {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		expired = t.C
+	}
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+	changed := s.changed
+
+	s.mu.Unlock()
+	defer s.mu.Lock()
+	select {
+	case <-changed:
+	case <-expired:
+	}
+	return nil
+}
+
+func (s *connState) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline, s.writeDeadline = t, t
+	s.broadcast()
+	return nil
+}
+
+func (s *connState) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline = t
+	s.broadcast()
+	return nil
+}
+
+func (s *connState) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeDeadline = t
+	s.broadcast()
+	return nil
+}
+
+type datagram struct {
+	from netip.AddrPort
+	data []byte
+}
+
+// datagrams queues what a UDP or ping socket receives.
+type datagrams struct {
+	connState
+	queue  []datagram
+	closed bool
+}
+
+// push queues a copy of data, dropping it if the queue is full.
+func (d *datagrams) push(from netip.AddrPort, data []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed || len(d.queue) >= maxQueuedDatagrams {
+		return
+	}
+	d.queue = append(d.queue, datagram{from, slices.Clone(data)})
+	d.broadcast()
+}
+
+// pop reads the next datagram into p, waiting for one until the read
+// deadline.
+func (d *datagrams) pop(p []byte) (int, netip.AddrPort, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		if d.closed {
+			return 0, netip.AddrPort{}, net.ErrClosed
+		}
+		if len(d.queue) > 0 {
+			dg := d.queue[0]
+			d.queue[0] = datagram{}
+			d.queue = d.queue[1:]
+			return copy(p, dg.data), dg.from, nil
+		}
+		if err := d.wait(d.readDeadline); err != nil {
+			return 0, netip.AddrPort{}, err
+		}
+	}
+}
+
+// shut closes the queue, reporting whether it was open.
+func (d *datagrams) shut() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return false
+	}
+	d.closed = true
+	d.queue = nil
+	d.broadcast()
+	return true
+}
+
+// byteQueue is a byte buffer read from the front.
+type byteQueue struct {
+	buf []byte
+	off int
+}
+
+func (q *byteQueue) len() int {
+	return len(q.buf) - q.off
+}
+
+func (q *byteQueue) bytes() []byte {
+	return q.buf[q.off:]
+}
+
+func (q *byteQueue) push(p []byte) {
+	if q.off > 0 && len(q.buf)+len(p) > cap(q.buf) {
+		n := copy(q.buf, q.buf[q.off:])
+		q.buf, q.off = q.buf[:n], 0
+	}
+	q.buf = append(q.buf, p...)
+}
+
+func (q *byteQueue) discard(n int) {
+	q.off += n
+	if q.off == len(q.buf) {
+		q.buf, q.off = q.buf[:0], 0
+	}
+}
+
+func (q *byteQueue) reset() {
+	q.buf, q.off = nil, 0
+}
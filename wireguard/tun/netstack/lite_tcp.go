@@ -0,0 +1,775 @@
+//go:build netstack_lite
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"syscall"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// TCP connection states, RFC 9293 3.3.2. Closed connections skip
+// TIME-WAIT, their ports being picked at random.
+const (
+	tcpSynSent = iota
+	tcpEstablished
+	tcpFinWait1
+	tcpFinWait2
+	tcpCloseWait
+	tcpClosing
+	tcpLastAck
+	tcpClosed
+)
+
+const (
+	tcpInitialRTO = time.Second
+	tcpMinRTO     = 200 * time.Millisecond
+	tcpMaxRTO     = time.Minute
+	// tcpSynRetries and tcpRetries are how often SYNs and segments are
+	// sent again before the connection is given up
+	tcpSynRetries = 5
+	tcpRetries    = 12
+	// tcpFinTimeout is how long a closed connection waits for the FIN of
+	// its peer
+	tcpFinTimeout = time.Minute
+	// tcpInitialWindow is the congestion window to start with, in
+	// segments, RFC 6928
+	tcpInitialWindow = 10
+)
+
+// TCPConn is a TCP connection of the lite stack.
+type TCPConn struct {
+	connState
+	tun   *netTun
+	id    connID
+	state int
+	// err is why the connection ended
+	err error
+
+	iss, sndUna, sndNxt uint32
+	// sndMax is past the last sequence number sent, sndNxt falls back
+	// to sndUna to send again
+	sndMax uint32
+	// snd holds the data from sndUna on, sent or not
+	snd        byteQueue
+	sndBufSize int
+	sndWnd     int
+	// finPending sends a FIN after snd
+	finPending, finSent, finAcked bool
+	mss                           int
+	cwnd, ssthresh, dupAcks       int
+	// recovering is set in fast recovery, until what was sent up to
+	// recover is acknowledged
+	recovering bool
+	recover    uint32
+
+	rto, srtt, rttvar time.Duration
+	// timing is set while the segment at rttSeq, sent at rttStart, is
+	// timed for the round trip
+	timing   bool
+	rttSeq   uint32
+	rttStart time.Time
+	retries  int
+	timer    *time.Timer
+	timerAt  time.Time
+
+	rcvNxt     uint32
+	rcv        byteQueue
+	rcvBufSize int
+	rcvWndSent int
+	rcvFin     bool
+	// ooo holds the segments received ahead of rcvNxt, by sequence
+	ooo []segment
+	// readClosed and writeClosed are set when the connection is shut
+	// down locally
+	readClosed, writeClosed bool
+}
+
+func (tnet *Net) DialContextTCPAddrPort(ctx context.Context, addr netip.AddrPort) (*TCPConn, error) {
+	tun := (*netTun)(tnet)
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	opError := func(err error) error {
+		return &net.OpError{Op: "connect", Net: "tcp", Addr: net.TCPAddrFromAddrPort(addr), Err: err}
+	}
+	if tun.isClosed() {
+		return nil, opError(net.ErrClosed)
+	}
+	if !addr.Addr().IsValid() {
+		return nil, opError(errMissingAddress)
+	}
+	local, err := tun.localAddr(addr.Addr())
+	if err != nil {
+		return nil, opError(err)
+	}
+
+	var iss [4]byte
+	if _, err := rand.Read(iss[:]); err != nil {
+		return nil, opError(err)
+	}
+	mss := tun.mtu - ipHeaderSize(local) - header.TCPMinimumSize
+	c := &TCPConn{
+		tun:        tun,
+		iss:        binary.BigEndian.Uint32(iss[:]),
+		sndBufSize: tun.sndBufSize,
+		rcvBufSize: tun.rcvBufSize,
+		mss:        mss,
+		ssthresh:   1<<31 - 1,
+		rto:        tcpInitialRTO,
+	}
+	c.sndUna, c.sndNxt, c.sndMax = c.iss, c.iss+1, c.iss+1
+	c.timer = time.AfterFunc(time.Hour, c.onTimer)
+	c.timer.Stop()
+
+	tun.mu.Lock()
+	port, err := ephemeralPort(func(port uint16) bool {
+		_, ok := tun.tcp[connID{netip.AddrPortFrom(local, port), addr}]
+		return ok
+	})
+	if err != nil {
+		tun.mu.Unlock()
+		return nil, opError(err)
+	}
+	c.id = connID{netip.AddrPortFrom(local, port), addr}
+	tun.tcp[c.id] = c
+	tun.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendSyn()
+	for c.state == tcpSynSent {
+		if c.changed == nil {
+			c.changed = make(chan struct{})
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+		c.mu.Lock()
+		if err := ctx.Err(); err != nil && c.state == tcpSynSent {
+			c.finish(err)
+		}
+	}
+	if c.state == tcpClosed {
+		return nil, opError(c.err)
+	}
+	return c, nil
+}
+
+func (tnet *Net) DialContextTCP(ctx context.Context, addr *net.TCPAddr) (*TCPConn, error) {
+	if addr == nil {
+		return tnet.DialContextTCPAddrPort(ctx, netip.AddrPort{})
+	}
+	return tnet.DialContextTCPAddrPort(ctx, addr.AddrPort())
+}
+
+func (tnet *Net) DialTCPAddrPort(addr netip.AddrPort) (*TCPConn, error) {
+	return tnet.DialContextTCPAddrPort(context.Background(), addr)
+}
+
+func (tnet *Net) DialTCP(addr *net.TCPAddr) (*TCPConn, error) {
+	return tnet.DialContextTCP(context.Background(), addr)
+}
+
+// deliverTCP passes a segment to its connection, answering those for no
+// connection with a reset.
+func (tun *netTun) deliverTCP(src, dst netip.Addr, seg []byte) {
+	if len(seg) < header.TCPMinimumSize {
+		return
+	}
+	h := header.TCP(seg)
+	off := int(h.DataOffset())
+	if off < header.TCPMinimumSize || off > len(seg) {
+		return
+	}
+	id := connID{netip.AddrPortFrom(dst, h.DestinationPort()), netip.AddrPortFrom(src, h.SourcePort())}
+	tun.mu.Lock()
+	c := tun.tcp[id]
+	tun.mu.Unlock()
+	if c != nil {
+		c.input(h, seg[off:])
+		return
+	}
+
+	// RFC 9293 3.10.7.1
+	flags := h.Flags()
+	if flags&header.TCPFlagRst != 0 {
+		return
+	}
+	if flags&header.TCPFlagAck != 0 {
+		tun.sendTCP(id, header.TCPFields{SeqNum: h.AckNumber(), Flags: header.TCPFlagRst}, false, nil)
+		return
+	}
+	ack := h.SequenceNumber() + uint32(len(seg)-off)
+	if flags&header.TCPFlagSyn != 0 {
+		ack++
+	}
+	if flags&header.TCPFlagFin != 0 {
+		ack++
+	}
+	tun.sendTCP(id, header.TCPFields{AckNum: ack, Flags: header.TCPFlagRst | header.TCPFlagAck}, false, nil)
+}
+
+// sendTCP sends a segment of the connection id, with the maximum segment
+// size option if mss.
+func (tun *netTun) sendTCP(id connID, f header.TCPFields, mss bool, data []byte) {
+	hlen := header.TCPMinimumSize
+	if mss {
+		hlen += header.TCPOptionMSSLength
+	}
+	packet, seg := tun.ipPacket(id.local.Addr(), id.remote.Addr(), header.TCPProtocolNumber, hlen+len(data))
+	h := header.TCP(seg)
+	f.SrcPort, f.DstPort, f.DataOffset = id.local.Port(), id.remote.Port(), uint8(hlen)
+	h.Encode(&f)
+	if mss {
+		header.EncodeMSSOption(uint32(tun.mtu-ipHeaderSize(id.local.Addr())-header.TCPMinimumSize), seg[header.TCPMinimumSize:])
+	}
+	copy(seg[hlen:], data)
+	h.SetChecksum(transportChecksum(header.TCPProtocolNumber, id.local.Addr(), id.remote.Addr(), seg))
+	tun.inject(packet)
+}
+
+// send sends a segment from seq, acknowledging what was received and
+// advertising the window.
+func (c *TCPConn) send(seq uint32, flags header.TCPFlags, data []byte) {
+	c.rcvWndSent = c.rcvWindow()
+	c.tun.sendTCP(c.id, header.TCPFields{
+		SeqNum:     seq,
+		AckNum:     c.rcvNxt,
+		Flags:      flags | header.TCPFlagAck,
+		WindowSize: uint16(c.rcvWndSent),
+	}, false, data)
+}
+
+func (c *TCPConn) sendSyn() {
+	c.rcvWndSent = c.rcvWindow()
+	c.tun.sendTCP(c.id, header.TCPFields{
+		SeqNum:     c.iss,
+		Flags:      header.TCPFlagSyn,
+		WindowSize: uint16(c.rcvWndSent),
+	}, true, nil)
+	if c.retries == 0 {
+		c.timing, c.rttSeq, c.rttStart = true, c.iss, time.Now()
+	}
+	c.armTimer(c.rto)
+}
+
+func (c *TCPConn) rcvWindow() int {
+	return max(min(c.rcvBufSize-c.rcv.len(), maxUnscaledWindow), 0)
+}
+
+// sent is how much of snd was sent, the FIN being all there is beyond it.
+func (c *TCPConn) sent() int {
+	return min(int(c.sndNxt-c.sndUna), c.snd.len())
+}
+
+// output sends what the windows let through of snd, and the FIN after it.
+func (c *TCPConn) output() {
+	switch c.state {
+	case tcpSynSent, tcpClosed:
+		return
+	}
+	for !c.finSent {
+		sent := c.sent()
+		unsent := c.snd.len() - sent
+		wnd := min(c.sndWnd, c.cwnd)
+		if unsent == 0 || sent >= wnd {
+			break
+		}
+		n := min(unsent, c.mss, wnd-sent)
+		c.send(c.sndNxt, header.TCPFlagPsh, c.snd.bytes()[sent:sent+n])
+		if !c.timing {
+			c.timing, c.rttSeq, c.rttStart = true, c.sndNxt, time.Now()
+		}
+		c.sndNxt += uint32(n)
+	}
+	if c.finPending && !c.finSent && c.sent() == c.snd.len() {
+		c.send(c.sndNxt, header.TCPFlagFin, nil)
+		c.finSent = true
+		c.sndNxt++
+	}
+	if seqLess(c.sndMax, c.sndNxt) {
+		c.sndMax = c.sndNxt
+	}
+	// The timer sends again what is unacknowledged, or probes a zero
+	// window
+	if c.timerAt.IsZero() && (c.sndNxt != c.sndUna || c.snd.len() > c.sent()) {
+		c.armTimer(c.rto)
+	}
+}
+
+// input handles a segment for c.
+func (c *TCPConn) input(h header.TCP, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	flags, seq, ack := h.Flags(), h.SequenceNumber(), h.AckNumber()
+
+	switch c.state {
+	case tcpClosed:
+		return
+	case tcpSynSent:
+		if flags&header.TCPFlagAck != 0 && ack != c.iss+1 {
+			if flags&header.TCPFlagRst == 0 {
+				c.tun.sendTCP(c.id, header.TCPFields{SeqNum: ack, Flags: header.TCPFlagRst}, false, nil)
+			}
+			return
+		}
+		if flags&header.TCPFlagRst != 0 {
+			if flags&header.TCPFlagAck != 0 {
+				c.finish(syscall.ECONNREFUSED)
+			}
+			return
+		}
+		if flags&header.TCPFlagSyn == 0 || flags&header.TCPFlagAck == 0 {
+			return
+		}
+		opts := header.ParseSynOptions(h.Options(), true)
+		c.mss = max(min(c.mss, int(opts.MSS)), 64)
+		c.cwnd = tcpInitialWindow * c.mss
+		c.rcvNxt, c.sndUna, c.sndWnd = seq+1, ack, int(h.WindowSize())
+		if c.timing {
+			c.updateRTT(time.Since(c.rttStart))
+		}
+		c.timing, c.retries = false, 0
+		c.stopTimer()
+		c.state = tcpEstablished
+		c.send(c.sndNxt, 0, nil)
+		c.output()
+		c.broadcast()
+		return
+	}
+
+	if flags&header.TCPFlagRst != 0 {
+		// Only a reset exactly in sequence is taken, RFC 5961 3.2
+		if seq == c.rcvNxt {
+			c.finish(syscall.ECONNRESET)
+		}
+		return
+	}
+	if flags&header.TCPFlagSyn != 0 {
+		// The SYN-ACK again, the ACK of it was lost
+		c.send(c.sndNxt, 0, nil)
+		return
+	}
+	if flags&header.TCPFlagAck == 0 {
+		return
+	}
+	fin := flags&header.TCPFlagFin != 0
+	c.onAck(ack, int(h.WindowSize()), len(data) > 0 || fin)
+	if c.state != tcpClosed && (len(data) > 0 || fin) {
+		c.onData(seq, data, fin)
+	}
+}
+
+// onAck handles the acknowledgement and window of a segment.
+func (c *TCPConn) onAck(ack uint32, wnd int, hasData bool) {
+	switch {
+	case seqLess(c.sndUna, ack) && !seqLess(c.sndMax, ack):
+		acked := int(ack - c.sndUna)
+		finAcked := c.finPending && acked > c.snd.len()
+		c.snd.discard(min(acked, c.snd.len()))
+		c.sndUna = ack
+		if seqLess(c.sndNxt, ack) {
+			c.sndNxt = ack
+		}
+		c.sndWnd = wnd
+		if c.timing && seqLess(c.rttSeq, ack) {
+			c.updateRTT(time.Since(c.rttStart))
+			c.timing = false
+		}
+		c.retries, c.dupAcks = 0, 0
+
+		switch {
+		case c.recovering && seqLess(ack, c.recover):
+			// A partial acknowledgement, the next hole is sent
+			// again, RFC 6582 3.2
+			c.retransmit()
+			c.cwnd = max(c.cwnd-acked+c.mss, c.mss)
+		case c.recovering:
+			c.recovering = false
+			c.cwnd = c.ssthresh
+		case c.cwnd < c.ssthresh:
+			// Reno, RFC 5681 3.1
+			c.cwnd += min(acked, c.mss)
+		default:
+			c.cwnd += max(c.mss*c.mss/c.cwnd, 1)
+		}
+
+		c.stopTimer()
+		if c.sndNxt != c.sndUna {
+			c.armTimer(c.rto)
+		}
+		if finAcked && !c.finAcked {
+			c.finSent, c.finAcked = true, true
+			switch c.state {
+			case tcpFinWait1:
+				c.state = tcpFinWait2
+				if c.readClosed {
+					c.armTimer(tcpFinTimeout)
+				}
+			case tcpClosing, tcpLastAck:
+				c.finish(nil)
+				return
+			}
+		}
+		c.broadcast()
+	case ack == c.sndUna:
+		if wnd != c.sndWnd {
+			// A window update, or an answer to a zero window probe
+			c.sndWnd, c.retries = wnd, 0
+			break
+		}
+		if hasData || c.sndNxt == c.sndUna {
+			break
+		}
+		// Fast retransmit and recovery, RFC 5681 3.2
+		c.dupAcks++
+		switch {
+		case c.recovering:
+			c.cwnd += c.mss
+		case c.dupAcks == 3:
+			c.ssthresh = max(int(c.sndNxt-c.sndUna)/2, 2*c.mss)
+			c.cwnd = c.ssthresh + 3*c.mss
+			c.recovering, c.recover = true, c.sndMax
+			c.timing = false
+			c.retransmit()
+		}
+	}
+	c.output()
+}
+
+// retransmit sends the first unacknowledged segment again.
+func (c *TCPConn) retransmit() {
+	if n := min(c.snd.len(), c.mss); n > 0 {
+		c.send(c.sndUna, header.TCPFlagPsh, c.snd.bytes()[:n])
+	} else if c.finSent {
+		c.send(c.sndUna, header.TCPFlagFin, nil)
+	}
+}
+
+// segment is data received out of order.
+type segment struct {
+	seq  uint32
+	data []byte
+	fin  bool
+}
+
+// onData takes the data, and FIN, of a segment, acknowledging it. Those
+// ahead of what is missing are kept for when it arrives.
+func (c *TCPConn) onData(seq uint32, data []byte, fin bool) {
+	if c.rcvFin {
+		c.send(c.sndNxt, 0, nil)
+		return
+	}
+	if seq != c.rcvNxt {
+		end := seq + uint32(len(data))
+		switch {
+		case seqLess(c.rcvNxt, seq):
+			if !seqLess(c.rcvNxt+uint32(c.rcvWndSent), end) {
+				c.queue(segment{seq, slices.Clone(data), fin})
+			}
+			// The duplicate acknowledgement tells the peer what is
+			// missing
+			c.send(c.sndNxt, 0, nil)
+			return
+		case seqLess(c.rcvNxt, end), fin && end == c.rcvNxt:
+			data = data[c.rcvNxt-seq:]
+		default:
+			// Received before
+			c.send(c.sndNxt, 0, nil)
+			return
+		}
+	}
+
+	c.take(data, fin)
+	for len(c.ooo) > 0 && !c.rcvFin && !seqLess(c.rcvNxt, c.ooo[0].seq) {
+		s := c.ooo[0]
+		c.ooo = c.ooo[1:]
+		if end := s.seq + uint32(len(s.data)); seqLess(c.rcvNxt, end) || s.fin && end == c.rcvNxt {
+			c.take(s.data[c.rcvNxt-s.seq:], s.fin)
+		}
+	}
+	c.send(c.sndNxt, 0, nil)
+
+	if c.rcvFin {
+		c.ooo = nil
+		switch c.state {
+		case tcpEstablished:
+			c.state = tcpCloseWait
+		case tcpFinWait1:
+			c.state = tcpClosing
+		case tcpFinWait2:
+			c.finish(nil)
+			return
+		}
+	}
+	c.broadcast()
+}
+
+// take takes data in order, and the FIN after it, as far as the receive
+// buffer allows.
+func (c *TCPConn) take(data []byte, fin bool) {
+	if room := c.rcvBufSize - c.rcv.len(); len(data) > room {
+		data, fin = data[:room], false
+	}
+	if !c.readClosed {
+		c.rcv.push(data)
+	}
+	c.rcvNxt += uint32(len(data))
+	if fin {
+		c.rcvNxt++
+		c.rcvFin = true
+	}
+}
+
+// queue keeps s, received out of order, unless a segment from the same
+// sequence number is kept.
+func (c *TCPConn) queue(s segment) {
+	i, found := slices.BinarySearchFunc(c.ooo, s.seq, func(o segment, seq uint32) int {
+		switch {
+		case seqLess(o.seq, seq):
+			return -1
+		case o.seq == seq:
+			return 0
+		}
+		return 1
+	})
+	if !found {
+		c.ooo = slices.Insert(c.ooo, i, s)
+	}
+}
+
+// updateRTT takes a round trip time sample, RFC 6298 2.
+func (c *TCPConn) updateRTT(r time.Duration) {
+	if c.srtt == 0 {
+		c.srtt, c.rttvar = r, r/2
+	} else {
+		c.rttvar = (3*c.rttvar + (c.srtt - r).Abs()) / 4
+		c.srtt = (7*c.srtt + r) / 8
+	}
+	c.rto = min(max(c.srtt+4*c.rttvar, tcpMinRTO), tcpMaxRTO)
+}
+
+func (c *TCPConn) armTimer(d time.Duration) {
+	c.timerAt = time.Now().Add(d)
+	c.timer.Reset(d)
+}
+
+func (c *TCPConn) stopTimer() {
+	c.timerAt = time.Time{}
+	c.timer.Stop()
+}
+
+// onTimer sends again what is unacknowledged, probes a zero window, or
+// gives up waiting for the FIN of the peer.
+func (c *TCPConn) onTimer() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timerAt.IsZero() || c.state == tcpClosed {
+		return
+	}
+	if d := time.Until(c.timerAt); d > 0 {
+		// Rearmed while firing
+		c.timer.Reset(d)
+		return
+	}
+	c.timerAt = time.Time{}
+
+	if c.state == tcpFinWait2 {
+		c.finish(nil)
+		return
+	}
+	c.retries++
+	c.rto = min(c.rto*2, tcpMaxRTO)
+	c.timing = false
+	if c.state == tcpSynSent {
+		if c.retries > tcpSynRetries {
+			c.finish(syscall.ETIMEDOUT)
+			return
+		}
+		c.sendSyn()
+		return
+	}
+	if c.retries > tcpRetries {
+		c.send(c.sndNxt, header.TCPFlagRst, nil)
+		c.finish(syscall.ETIMEDOUT)
+		return
+	}
+
+	if c.sndNxt == c.sndUna {
+		// A zero window, probed with a byte beyond it, RFC 9293 3.8.6.1
+		if sent := c.sent(); c.snd.len() > sent {
+			c.send(c.sndNxt, 0, c.snd.bytes()[sent:sent+1])
+			c.sndNxt++
+			c.sndMax = max(c.sndMax, c.sndNxt)
+			c.armTimer(c.rto)
+		}
+		return
+	}
+	// Go back to the first unacknowledged segment, RFC 5681 3.1
+	c.ssthresh = max(int(c.sndNxt-c.sndUna)/2, 2*c.mss)
+	c.cwnd, c.dupAcks, c.recovering = c.mss, 0, false
+	c.sndNxt, c.finSent = c.sndUna, false
+	c.output()
+}
+
+// finish closes the connection for err, with mu held.
+func (c *TCPConn) finish(err error) {
+	if c.state == tcpClosed {
+		return
+	}
+	c.state = tcpClosed
+	if c.err == nil {
+		c.err = err
+	}
+	c.stopTimer()
+	c.tun.mu.Lock()
+	if c.tun.tcp[c.id] == c {
+		delete(c.tun.tcp, c.id)
+	}
+	c.tun.mu.Unlock()
+	c.broadcast()
+}
+
+func (c *TCPConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.readClosed {
+			return 0, c.opError("read", net.ErrClosed)
+		}
+		if c.rcv.len() > 0 {
+			n := copy(p, c.rcv.bytes())
+			c.rcv.discard(n)
+			// Tell the peer once the window opened by a segment or more
+			if !c.rcvFin && c.state != tcpClosed && c.rcvWindow()-c.rcvWndSent >= c.mss {
+				c.send(c.sndNxt, 0, nil)
+			}
+			return n, nil
+		}
+		if c.rcvFin {
+			return 0, io.EOF
+		}
+		if c.state == tcpClosed {
+			if c.err == nil {
+				return 0, io.EOF
+			}
+			return 0, c.opError("read", c.err)
+		}
+		if err := c.wait(c.readDeadline); err != nil {
+			return 0, c.opError("read", err)
+		}
+	}
+}
+
+func (c *TCPConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for len(p) > 0 {
+		switch {
+		case c.writeClosed:
+			return n, c.opError("write", syscall.EPIPE)
+		case c.state == tcpClosed:
+			err := c.err
+			if err == nil {
+				err = syscall.EPIPE
+			}
+			return n, c.opError("write", err)
+		}
+		room := c.sndBufSize - c.snd.len()
+		if room == 0 {
+			if err := c.wait(c.writeDeadline); err != nil {
+				return n, c.opError("write", err)
+			}
+			continue
+		}
+		k := min(room, len(p))
+		c.snd.push(p[:k])
+		p, n = p[k:], n+k
+		c.output()
+	}
+	return n, nil
+}
+
+// CloseWrite sends a FIN after what was written.
+func (c *TCPConn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.shutdownWrite()
+	return nil
+}
+
+// CloseRead drops what is received from now on.
+func (c *TCPConn) CloseRead() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readClosed = true
+	c.rcv.reset()
+	c.broadcast()
+	return nil
+}
+
+func (c *TCPConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readClosed = true
+	c.rcv.reset()
+	c.shutdownWrite()
+	if c.state == tcpFinWait2 {
+		c.armTimer(tcpFinTimeout)
+	}
+	c.broadcast()
+	return nil
+}
+
+func (c *TCPConn) shutdownWrite() {
+	if c.writeClosed {
+		return
+	}
+	c.writeClosed = true
+	switch c.state {
+	case tcpSynSent:
+		c.finish(net.ErrClosed)
+		return
+	case tcpEstablished:
+		c.state = tcpFinWait1
+	case tcpCloseWait:
+		c.state = tcpLastAck
+	default:
+		return
+	}
+	c.finPending = true
+	c.output()
+}
+
+func (c *TCPConn) LocalAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(c.id.local)
+}
+
+func (c *TCPConn) RemoteAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(c.id.remote)
+}
+
+func (c *TCPConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+}
+
+// seqLess reports whether sequence number a comes before b.
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
@@ -0,0 +1,367 @@
+//go:build netstack_lite
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	protoICMPv4 = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+var (
+	liteLocal4 = netip.MustParseAddr("10.0.0.1")
+	liteLocal6 = netip.MustParseAddr("fd00::1")
+)
+
+// liteStack is the lite stack, with the test on the other end of its
+// tunnel.
+type liteStack struct {
+	t    *testing.T
+	tun  *netTun
+	tnet *Net
+}
+
+func newLiteStack(t *testing.T) *liteStack {
+	t.Helper()
+	_, tnet, err := CreateNetTUN([]netip.Addr{liteLocal4, liteLocal6}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &liteStack{t: t, tun: (*netTun)(tnet), tnet: tnet}
+	t.Cleanup(func() { s.tun.Close() })
+	return s
+}
+
+// onesSum adds b to sum as 16 bit words, RFC 1071.
+func onesSum(sum uint32, b []byte) uint32 {
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(binary.BigEndian.Uint16(b))
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}
+
+// pseudoSum is the sum of the pseudo header of a segment of n bytes.
+func pseudoSum(proto uint8, src, dst netip.Addr, n int) uint32 {
+	sum := onesSum(0, src.AsSlice())
+	sum = onesSum(sum, dst.AsSlice())
+	return sum + uint32(proto) + uint32(n)
+}
+
+// setChecksums fills in the checksums of packet, computed over the fields
+// independently of the stack.
+func setChecksums(packet []byte) {
+	src, dst, proto, payload := parseIP(packet)
+	if src.Is4() {
+		binary.BigEndian.PutUint16(packet[10:], 0)
+		binary.BigEndian.PutUint16(packet[10:], ^fold(onesSum(0, packet[:header.IPv4MinimumSize])))
+	}
+	var field int
+	var sum uint32
+	switch proto {
+	case protoTCP:
+		field, sum = 16, pseudoSum(proto, src, dst, len(payload))
+	case protoUDP:
+		field, sum = 6, pseudoSum(proto, src, dst, len(payload))
+	case protoICMPv4:
+		field = 2
+	case protoICMPv6:
+		field, sum = 2, pseudoSum(proto, src, dst, len(payload))
+	}
+	binary.BigEndian.PutUint16(payload[field:], 0)
+	binary.BigEndian.PutUint16(payload[field:], ^fold(onesSum(sum, payload)))
+}
+
+// parseIP splits a packet without options or extension headers.
+func parseIP(packet []byte) (src, dst netip.Addr, proto uint8, payload []byte) {
+	if packet[0]>>4 == 4 {
+		src, _ = netip.AddrFromSlice(packet[12:16])
+		dst, _ = netip.AddrFromSlice(packet[16:20])
+		return src, dst, packet[9], packet[header.IPv4MinimumSize:binary.BigEndian.Uint16(packet[2:])]
+	}
+	src, _ = netip.AddrFromSlice(packet[8:24])
+	dst, _ = netip.AddrFromSlice(packet[24:40])
+	return src, dst, packet[6], packet[header.IPv6MinimumSize : header.IPv6MinimumSize+int(binary.BigEndian.Uint16(packet[4:]))]
+}
+
+// read returns the next packet the stack sends, checking its checksums.
+func (s *liteStack) read() (src, dst netip.Addr, proto uint8, payload []byte) {
+	s.t.Helper()
+	var packet []byte
+	select {
+	case packet = <-s.tun.incomingPacket:
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("timed out waiting for a packet from the stack")
+	}
+
+	src, dst, proto, payload = parseIP(packet)
+	if src.Is4() && fold(onesSum(0, packet[:header.IPv4MinimumSize])) != 0xffff {
+		s.t.Fatalf("bad ipv4 header checksum in %x", packet)
+	}
+	sum := onesSum(0, payload)
+	if proto != protoICMPv4 {
+		sum += pseudoSum(proto, src, dst, len(payload))
+	}
+	if proto == protoUDP && binary.BigEndian.Uint16(payload[6:]) == 0 {
+		s.t.Fatalf("udp checksum left out in %x", packet)
+	}
+	if fold(sum) != 0xffff {
+		s.t.Fatalf("bad protocol %d checksum in %x", proto, packet)
+	}
+	return src, dst, proto, payload
+}
+
+// write sends a packet from src to dst with payload, the transport header
+// of which has its checksum filled in.
+func (s *liteStack) write(src, dst netip.Addr, proto uint8, payload []byte) {
+	s.t.Helper()
+	var packet []byte
+	if src.Is4() {
+		packet = make([]byte, header.IPv4MinimumSize+len(payload))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+		packet[8], packet[9] = 64, proto
+		copy(packet[12:], src.AsSlice())
+		copy(packet[16:], dst.AsSlice())
+		copy(packet[header.IPv4MinimumSize:], payload)
+	} else {
+		packet = make([]byte, header.IPv6MinimumSize+len(payload))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(payload)))
+		packet[6], packet[7] = proto, 64
+		copy(packet[8:], src.AsSlice())
+		copy(packet[24:], dst.AsSlice())
+		copy(packet[header.IPv6MinimumSize:], payload)
+	}
+	setChecksums(packet)
+	if _, err := s.tun.Write([][]byte{packet}, 0); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+type tcpSegment struct {
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	flags            header.TCPFlags
+	window           uint16
+	options, data    []byte
+}
+
+func (s *liteStack) readTCP() tcpSegment {
+	s.t.Helper()
+	_, _, proto, seg := s.read()
+	if proto != protoTCP {
+		s.t.Fatalf("got protocol %d, want tcp", proto)
+	}
+	h := header.TCP(seg)
+	off := int(h.DataOffset())
+	return tcpSegment{
+		srcPort: h.SourcePort(), dstPort: h.DestinationPort(),
+		seq: h.SequenceNumber(), ack: h.AckNumber(),
+		flags: h.Flags(), window: h.WindowSize(),
+		options: seg[header.TCPMinimumSize:off], data: seg[off:],
+	}
+}
+
+func (s *liteStack) writeTCP(src, dst netip.Addr, seg tcpSegment) {
+	s.t.Helper()
+	b := make([]byte, header.TCPMinimumSize+len(seg.data))
+	header.TCP(b).Encode(&header.TCPFields{
+		SrcPort: seg.srcPort, DstPort: seg.dstPort,
+		SeqNum: seg.seq, AckNum: seg.ack,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      seg.flags, WindowSize: seg.window,
+	})
+	copy(b[header.TCPMinimumSize:], seg.data)
+	s.write(src, dst, protoTCP, b)
+}
+
+func TestLiteTCPHandshake(t *testing.T) {
+	for _, remote := range []netip.AddrPort{
+		netip.MustParseAddrPort("10.0.0.2:443"),
+		netip.MustParseAddrPort("[fd00::2]:443"),
+	} {
+		t.Run(remote.Addr().String(), func(t *testing.T) {
+			s := newLiteStack(t)
+			local := liteLocal4
+			if remote.Addr().Is6() {
+				local = liteLocal6
+			}
+
+			type dialed struct {
+				c   *TCPConn
+				err error
+			}
+			dialc := make(chan dialed, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				c, err := s.tnet.DialContextTCPAddrPort(ctx, remote)
+				dialc <- dialed{c, err}
+			}()
+
+			syn := s.readTCP()
+			if syn.flags != header.TCPFlagSyn || syn.dstPort != remote.Port() {
+				t.Fatalf("got %v to port %d, want a SYN to %d", syn.flags, syn.dstPort, remote.Port())
+			}
+			wantMSS := 1420 - ipHeaderSize(local) - header.TCPMinimumSize
+			if len(syn.options) < 4 || syn.options[0] != header.TCPOptionMSS || int(binary.BigEndian.Uint16(syn.options[2:])) != wantMSS {
+				t.Fatalf("SYN options %x, want an mss of %d", syn.options, wantMSS)
+			}
+
+			const peerISS = 1000
+			s.writeTCP(remote.Addr(), local, tcpSegment{
+				srcPort: remote.Port(), dstPort: syn.srcPort,
+				seq: peerISS, ack: syn.seq + 1,
+				flags: header.TCPFlagSyn | header.TCPFlagAck, window: 65535,
+			})
+			ack := s.readTCP()
+			if ack.flags != header.TCPFlagAck || ack.seq != syn.seq+1 || ack.ack != peerISS+1 {
+				t.Fatalf("got %v seq %d ack %d, want the ACK of the SYN-ACK", ack.flags, ack.seq, ack.ack)
+			}
+
+			d := <-dialc
+			if d.err != nil {
+				t.Fatal(d.err)
+			}
+			c := d.c
+			defer c.Close()
+			if got := c.LocalAddr().String(); got != netip.AddrPortFrom(local, syn.srcPort).String() {
+				t.Fatalf("local address %s, want %s", got, netip.AddrPortFrom(local, syn.srcPort))
+			}
+
+			if _, err := c.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			data := s.readTCP()
+			if data.seq != syn.seq+1 || !bytes.Equal(data.data, []byte("hello")) {
+				t.Fatalf("got %q at seq %d, want hello at %d", data.data, data.seq, syn.seq+1)
+			}
+
+			s.writeTCP(remote.Addr(), local, tcpSegment{
+				srcPort: remote.Port(), dstPort: syn.srcPort,
+				seq: peerISS + 1, ack: syn.seq + 1 + 5,
+				flags: header.TCPFlagAck | header.TCPFlagPsh, window: 65535,
+				data: []byte("world"),
+			})
+			buf := make([]byte, 16)
+			_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := c.Read(buf)
+			if err != nil || string(buf[:n]) != "world" {
+				t.Fatalf("read %q, %v, want world", buf[:n], err)
+			}
+		})
+	}
+}
+
+func TestLiteTCPReset(t *testing.T) {
+	s := newLiteStack(t)
+	remote := netip.MustParseAddr("10.0.0.2")
+
+	// A SYN to no connection is refused
+	s.writeTCP(remote, liteLocal4, tcpSegment{
+		srcPort: 40000, dstPort: 80,
+		seq: 5000, flags: header.TCPFlagSyn, window: 65535,
+	})
+	rst := s.readTCP()
+	if rst.flags != header.TCPFlagRst|header.TCPFlagAck || rst.ack != 5001 || rst.srcPort != 80 || rst.dstPort != 40000 {
+		t.Fatalf("got %v ack %d from %d to %d, want a RST acknowledging the SYN", rst.flags, rst.ack, rst.srcPort, rst.dstPort)
+	}
+}
+
+func TestLiteUDPRoundTrip(t *testing.T) {
+	for _, remote := range []netip.AddrPort{
+		netip.MustParseAddrPort("10.0.0.2:53"),
+		netip.MustParseAddrPort("[fd00::2]:53"),
+	} {
+		t.Run(remote.Addr().String(), func(t *testing.T) {
+			s := newLiteStack(t)
+			c, err := s.tnet.DialUDPAddrPort(netip.AddrPort{}, remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if _, err := c.Write([]byte("query")); err != nil {
+				t.Fatal(err)
+			}
+			src, dst, proto, seg := s.read()
+			h := header.UDP(seg)
+			if proto != protoUDP || dst != remote.Addr() || h.DestinationPort() != remote.Port() || string(h.Payload()) != "query" {
+				t.Fatalf("got protocol %d to %s:%d carrying %q, want the query", proto, dst, h.DestinationPort(), h.Payload())
+			}
+
+			reply := func(from netip.AddrPort, payload string) {
+				b := make([]byte, header.UDPMinimumSize+len(payload))
+				header.UDP(b).Encode(&header.UDPFields{
+					SrcPort: from.Port(), DstPort: h.SourcePort(),
+					Length: uint16(len(b)),
+				})
+				copy(b[header.UDPMinimumSize:], payload)
+				s.write(from.Addr(), src, protoUDP, b)
+			}
+			// Connected sockets only take what their peer sends
+			reply(netip.AddrPortFrom(remote.Addr(), 5353), "spoofed")
+			reply(remote, "answer")
+
+			buf := make([]byte, 64)
+			_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := c.Read(buf)
+			if err != nil || string(buf[:n]) != "answer" {
+				t.Fatalf("read %q, %v, want answer", buf[:n], err)
+			}
+		})
+	}
+}
+
+func TestLiteEchoReply(t *testing.T) {
+	for _, tt := range []struct {
+		remote, local netip.Addr
+		proto         uint8
+		request       uint8
+		reply         uint8
+	}{
+		{netip.MustParseAddr("10.0.0.2"), liteLocal4, protoICMPv4, uint8(header.ICMPv4Echo), uint8(header.ICMPv4EchoReply)},
+		{netip.MustParseAddr("fd00::2"), liteLocal6, protoICMPv6, uint8(header.ICMPv6EchoRequest), uint8(header.ICMPv6EchoReply)},
+	} {
+		t.Run(tt.remote.String(), func(t *testing.T) {
+			s := newLiteStack(t)
+			request := []byte{tt.request, 0, 0, 0, 0x12, 0x34, 0, 1, 'p', 'i', 'n', 'g'}
+			s.write(tt.remote, tt.local, tt.proto, request)
+
+			src, dst, proto, msg := s.read()
+			if proto != tt.proto || src != tt.local || dst != tt.remote || msg[0] != tt.reply {
+				t.Fatalf("got protocol %d type %d from %s to %s, want an echo reply", proto, msg[0], src, dst)
+			}
+			if !bytes.Equal(msg[4:], request[4:]) {
+				t.Fatalf("reply carries %x, want %x", msg[4:], request[4:])
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+//go:build netstack_lite
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"syscall"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// UDPConn is a UDP socket of the lite stack.
+type UDPConn struct {
+	datagrams
+	tun           *netTun
+	local, remote netip.AddrPort
+}
+
+func (tnet *Net) DialUDPAddrPort(laddr, raddr netip.AddrPort) (*UDPConn, error) {
+	tun := (*netTun)(tnet)
+	if tun.isClosed() {
+		return nil, net.ErrClosed
+	}
+	laddr = netip.AddrPortFrom(laddr.Addr().Unmap(), laddr.Port())
+	raddr = netip.AddrPortFrom(raddr.Addr().Unmap(), raddr.Port())
+	if boundAddr(laddr.Addr()) && !slices.Contains(tun.addrs, laddr.Addr()) {
+		return nil, syscall.EADDRNOTAVAIL
+	}
+
+	c := &UDPConn{tun: tun, remote: raddr}
+	tun.mu.Lock()
+	defer tun.mu.Unlock()
+	port := laddr.Port()
+	if port == 0 {
+		var err error
+		port, err = ephemeralPort(func(port uint16) bool { return tun.udp[port] != nil })
+		if err != nil {
+			return nil, err
+		}
+	} else if tun.udp[port] != nil {
+		return nil, syscall.EADDRINUSE
+	}
+	c.local = netip.AddrPortFrom(laddr.Addr(), port)
+	tun.udp[port] = c
+	return c, nil
+}
+
+func (tnet *Net) ListenUDPAddrPort(laddr netip.AddrPort) (*UDPConn, error) {
+	return tnet.DialUDPAddrPort(laddr, netip.AddrPort{})
+}
+
+func (tnet *Net) DialUDP(laddr, raddr *net.UDPAddr) (*UDPConn, error) {
+	var la, ra netip.AddrPort
+	if laddr != nil {
+		la = laddr.AddrPort()
+	}
+	if raddr != nil {
+		ra = raddr.AddrPort()
+	}
+	return tnet.DialUDPAddrPort(la, ra)
+}
+
+func (tnet *Net) ListenUDP(laddr *net.UDPAddr) (*UDPConn, error) {
+	return tnet.DialUDP(laddr, nil)
+}
+
+// accepts reports whether a datagram from "from" to dst is for c.
+func (c *UDPConn) accepts(from netip.AddrPort, dst netip.Addr) bool {
+	if boundAddr(c.local.Addr()) && c.local.Addr() != dst {
+		return false
+	}
+	return !c.remote.IsValid() || c.remote == from
+}
+
+func (c *UDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, from, err := c.pop(p)
+	if err != nil {
+		return 0, nil, c.opError("read", err)
+	}
+	return n, net.UDPAddrFromAddrPort(from), nil
+}
+
+func (c *UDPConn) Read(p []byte) (int, error) {
+	n, _, err := c.ReadFrom(p)
+	return n, err
+}
+
+func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, c.opError("write", fmt.Errorf("wrong net.Addr type %T", addr))
+	}
+	to := ua.AddrPort()
+	return c.writeTo(p, netip.AddrPortFrom(to.Addr().Unmap(), to.Port()))
+}
+
+func (c *UDPConn) Write(p []byte) (int, error) {
+	if !c.remote.IsValid() {
+		return 0, c.opError("write", syscall.EDESTADDRREQ)
+	}
+	return c.writeTo(p, c.remote)
+}
+
+func (c *UDPConn) writeTo(p []byte, to netip.AddrPort) (int, error) {
+	if !to.Addr().IsValid() {
+		return 0, c.opError("write", syscall.EDESTADDRREQ)
+	}
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return 0, c.opError("write", net.ErrClosed)
+	}
+
+	src := c.local.Addr()
+	if !boundAddr(src) {
+		var err error
+		if src, err = c.tun.localAddr(to.Addr()); err != nil {
+			return 0, c.opError("write", err)
+		}
+	} else if src.Is4() != to.Addr().Is4() {
+		return 0, c.opError("write", syscall.EAFNOSUPPORT)
+	}
+	// Datagrams are not fragmented
+	if ipHeaderSize(src)+header.UDPMinimumSize+len(p) > c.tun.mtu {
+		return 0, c.opError("write", syscall.EMSGSIZE)
+	}
+
+	packet, seg := c.tun.ipPacket(src, to.Addr(), header.UDPProtocolNumber, header.UDPMinimumSize+len(p))
+	h := header.UDP(seg)
+	h.Encode(&header.UDPFields{
+		SrcPort: c.local.Port(),
+		DstPort: to.Port(),
+		Length:  uint16(len(seg)),
+	})
+	copy(seg[header.UDPMinimumSize:], p)
+	xsum := transportChecksum(header.UDPProtocolNumber, src, to.Addr(), seg)
+	if xsum == 0 {
+		xsum = 0xffff
+	}
+	h.SetChecksum(xsum)
+	c.tun.inject(packet)
+	return len(p), nil
+}
+
+func (c *UDPConn) Close() error {
+	if !c.shut() {
+		return nil
+	}
+	c.tun.mu.Lock()
+	defer c.tun.mu.Unlock()
+	if c.tun.udp[c.local.Port()] == c {
+		delete(c.tun.udp, c.local.Port())
+	}
+	return nil
+}
+
+func (c *UDPConn) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.local)
+}
+
+func (c *UDPConn) RemoteAddr() net.Addr {
+	if !c.remote.IsValid() {
+		return nil
+	}
+	return net.UDPAddrFromAddrPort(c.remote)
+}
+
+func (c *UDPConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+}
+
+// PingConn is a ping socket of the lite stack, sending echo requests with
+// its own identifier and receiving the replies to them.
+type PingConn struct {
+	datagrams
+	tun          *netTun
+	laddr, raddr PingAddr
+	ident        uint16
+}
+
+func (tnet *Net) DialPingAddr(laddr, raddr netip.Addr) (*PingConn, error) {
+	if !laddr.IsValid() && !raddr.IsValid() {
+		return nil, errors.New("ping dial: invalid address")
+	}
+	tun := (*netTun)(tnet)
+	if tun.isClosed() {
+		return nil, net.ErrClosed
+	}
+	laddr, raddr = laddr.Unmap(), raddr.Unmap()
+	v6 := laddr.Is6() || raddr.Is6()
+	if !laddr.IsValid() {
+		if v6 {
+			laddr = netip.IPv6Unspecified()
+		} else {
+			laddr = netip.IPv4Unspecified()
+		}
+	} else if boundAddr(laddr) && !slices.Contains(tun.addrs, laddr) {
+		return nil, fmt.Errorf("ping bind: %w", syscall.EADDRNOTAVAIL)
+	}
+
+	pc := &PingConn{tun: tun, laddr: PingAddr{laddr}, raddr: PingAddr{raddr}}
+	tun.mu.Lock()
+	defer tun.mu.Unlock()
+	ident, err := ephemeralPort(func(id uint16) bool { return tun.icmp[id] != nil })
+	if err != nil {
+		return nil, fmt.Errorf("ping socket: %w", err)
+	}
+	pc.ident = ident
+	tun.icmp[ident] = pc
+	return pc, nil
+}
+
+func (tnet *Net) ListenPingAddr(laddr netip.Addr) (*PingConn, error) {
+	return tnet.DialPingAddr(laddr, netip.Addr{})
+}
+
+func (tnet *Net) DialPing(laddr, raddr *PingAddr) (*PingConn, error) {
+	var la, ra netip.Addr
+	if laddr != nil {
+		la = laddr.addr
+	}
+	if raddr != nil {
+		ra = raddr.addr
+	}
+	return tnet.DialPingAddr(la, ra)
+}
+
+func (tnet *Net) ListenPing(laddr *PingAddr) (*PingConn, error) {
+	var la netip.Addr
+	if laddr != nil {
+		la = laddr.addr
+	}
+	return tnet.ListenPingAddr(la)
+}
+
+// accepts reports whether an echo reply from src to dst is for pc.
+func (pc *PingConn) accepts(src, dst netip.Addr) bool {
+	if pc.laddr.addr.Is4() != src.Is4() || (boundAddr(pc.laddr.addr) && pc.laddr.addr != dst) {
+		return false
+	}
+	return !pc.raddr.addr.IsValid() || pc.raddr.addr == src
+}
+
+func (pc *PingConn) LocalAddr() net.Addr {
+	return pc.laddr
+}
+
+func (pc *PingConn) RemoteAddr() net.Addr {
+	return pc.raddr
+}
+
+func (pc *PingConn) Close() error {
+	if !pc.shut() {
+		return nil
+	}
+	pc.tun.mu.Lock()
+	defer pc.tun.mu.Unlock()
+	if pc.tun.icmp[pc.ident] == pc {
+		delete(pc.tun.icmp, pc.ident)
+	}
+	return nil
+}
+
+func (pc *PingConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	var na netip.Addr
+	switch v := addr.(type) {
+	case *PingAddr:
+		na = v.addr
+	case *net.IPAddr:
+		na, _ = netip.AddrFromSlice(v.IP)
+	default:
+		return 0, fmt.Errorf("ping write: wrong net.Addr type")
+	}
+	na = na.Unmap()
+	if !((na.Is4() && pc.laddr.addr.Is4()) || (na.Is6() && pc.laddr.addr.Is6())) {
+		return 0, fmt.Errorf("ping write: mismatched protocols")
+	}
+	echo := uint8(header.ICMPv4Echo)
+	if na.Is6() {
+		echo = uint8(header.ICMPv6EchoRequest)
+	}
+	if len(p) < header.ICMPv4MinimumSize || p[0] != echo {
+		return 0, fmt.Errorf("ping write: not an echo request")
+	}
+	pc.mu.Lock()
+	closed := pc.closed
+	pc.mu.Unlock()
+	if closed {
+		return 0, fmt.Errorf("ping write: %w", net.ErrClosed)
+	}
+
+	src := pc.laddr.addr
+	if !boundAddr(src) {
+		if src, err = pc.tun.localAddr(na); err != nil {
+			return 0, fmt.Errorf("ping write: %w", err)
+		}
+	}
+	if ipHeaderSize(src)+len(p) > pc.tun.mtu {
+		return 0, fmt.Errorf("ping write: %w", syscall.EMSGSIZE)
+	}
+
+	if src.Is4() {
+		packet, body := pc.tun.ipPacket(src, na, header.ICMPv4ProtocolNumber, len(p))
+		msg := header.ICMPv4(body)
+		copy(msg, p)
+		msg.SetIdent(pc.ident)
+		msg.SetChecksum(header.ICMPv4Checksum(msg, 0))
+		pc.tun.inject(packet)
+	} else {
+		packet, body := pc.tun.ipPacket(src, na, header.ICMPv6ProtocolNumber, len(p))
+		msg := header.ICMPv6(body)
+		copy(msg, p)
+		msg.SetIdent(pc.ident)
+		msg.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+			Header: msg,
+			Src:    tcpip.AddrFrom16(src.As16()),
+			Dst:    tcpip.AddrFrom16(na.As16()),
+		}))
+		pc.tun.inject(packet)
+	}
+	return len(p), nil
+}
+
+func (pc *PingConn) Write(p []byte) (n int, err error) {
+	return pc.WriteTo(p, &pc.raddr)
+}
+
+func (pc *PingConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, from, err := pc.pop(p)
+	if err != nil {
+		return 0, nil, fmt.Errorf("ping read: %w", err)
+	}
+	return n, &PingAddr{from.Addr()}, nil
+}
+
+func (pc *PingConn) Read(p []byte) (n int, err error) {
+	n, _, err = pc.ReadFrom(p)
+	return
+}
+
+// boundAddr reports whether a socket bound to addr is bound to a single
+// address, rather than to none or to all of them.
+func boundAddr(addr netip.Addr) bool {
+	return addr.IsValid() && !addr.IsUnspecified()
+}
+
+// ipHeaderSize is the size of the IP headers the stack sends from src.
+func ipHeaderSize(src netip.Addr) int {
+	if src.Is4() {
+		return header.IPv4MinimumSize
+	}
+	return header.IPv6MinimumSize
+}
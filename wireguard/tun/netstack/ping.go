@@ -0,0 +1,312 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	// pingTimeout is how long a forwarded ping waits for its reply
+	pingTimeout = 5 * time.Second
+	// maxForwardedPings bounds the forwarded pings waiting for a reply,
+	// more are dropped
+	maxForwardedPings = 64
+	// pingReplyTTL is the ttl, or hop limit, of the replies to forwarded
+	// pings
+	pingReplyTTL = 64
+)
+
+// ForwardPings makes the stack answer pings the tunnel delivers for hosts
+// other than its own addresses, by pinging them from this host and passing
+// their replies back. Pings to its own addresses are answered by the stack
+// either way.
+//
+// The stack counts as a hop, so pings are forwarded with their ttl less one
+// and those that run out of it are answered as expired by the stack itself.
+// The errors routers answer forwarded pings with, such as their ttl running
+// out further on, are passed back too, so icmp traceroute and mtr show the
+// hops of the path. They are only seen through raw icmp sockets, which are
+// used if permitted, and unprivileged ones otherwise.
+func (tnet *Net) ForwardPings() {
+	(*netTun)(tnet).forwardPings.Store(true)
+}
+
+// pingRequest is an echo request forwarded for a peer.
+type pingRequest struct {
+	src, dst netip.Addr
+	id, seq  uint16
+	ttl      int
+	data     []byte
+	// quote is the start of the request as the peer sent it, for the
+	// errors about it
+	quote []byte
+}
+
+// forwardPing pings the destination of packet from this host if it is an
+// echo request for another host, reporting whether it was taken.
+func (tun *netTun) forwardPing(packet []byte) bool {
+	var req pingRequest
+	var echo []byte
+	switch packet[0] >> 4 {
+	case 4:
+		ip := header.IPv4(packet)
+		if !ip.IsValid(len(packet)) || ip.TransportProtocol() != header.ICMPv4ProtocolNumber || ip.More() || ip.FragmentOffset() != 0 {
+			return false
+		}
+		echo = ip.Payload()
+		if len(echo) < header.ICMPv4MinimumSize || header.ICMPv4(echo).Type() != header.ICMPv4Echo {
+			return false
+		}
+		req.src, req.dst = netip.AddrFrom4(ip.SourceAddress().As4()), netip.AddrFrom4(ip.DestinationAddress().As4())
+		req.ttl = int(ip.TTL())
+	case 6:
+		ip := header.IPv6(packet)
+		if !ip.IsValid(len(packet)) || ip.TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return false
+		}
+		echo = ip.Payload()
+		if len(echo) < header.ICMPv6MinimumSize || header.ICMPv6(echo).Type() != header.ICMPv6EchoRequest {
+			return false
+		}
+		req.src, req.dst = netip.AddrFrom16(ip.SourceAddress().As16()), netip.AddrFrom16(ip.DestinationAddress().As16())
+		req.ttl = int(ip.HopLimit())
+	default:
+		return false
+	}
+	if !req.dst.IsGlobalUnicast() || slices.Contains(tun.addrs, req.dst) {
+		return false
+	}
+
+	// Errors quote the ip header and the first 8 bytes after it
+	req.quote = slices.Clone(packet[:len(packet)-len(echo)+header.ICMPv4MinimumSize])
+	if req.ttl <= 1 {
+		tun.expired(req)
+		return true
+	}
+
+	select {
+	case tun.pings <- struct{}{}:
+	default:
+		// Too many in flight, the request is dropped
+		return true
+	}
+	// Both echo headers have the identifier and sequence number at the
+	// same place
+	h := header.ICMPv4(echo)
+	req.id, req.seq, req.data = h.Ident(), h.Sequence(), slices.Clone(h.Payload())
+	go tun.ping(req)
+	return true
+}
+
+// expired answers req as out of ttl at the stack, from its own address.
+func (tun *netTun) expired(req pingRequest) {
+	for _, addr := range tun.addrs {
+		if addr.Is4() != req.src.Is4() {
+			continue
+		}
+		typ := uint8(header.ICMPv4TimeExceeded)
+		if req.src.Is6() {
+			typ = uint8(header.ICMPv6TimeExceeded)
+		}
+		tun.injectICMP(req.src, addr, typ, 0, append(make([]byte, 4), req.quote...))
+		return
+	}
+}
+
+// ping sends req from this host, and passes the echo reply, or the error
+// answered by a router on the way, back to its source.
+func (tun *netTun) ping(req pingRequest) {
+	defer func() { <-tun.pings }()
+
+	var c *icmp.PacketConn
+	var err error
+	var to net.Addr
+	var request icmp.Type
+	var proto int
+	unprivileged := false
+	if req.dst.Is4() {
+		request, proto = ipv4.ICMPTypeEcho, 1
+		if c, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0"); err != nil {
+			c, err = icmp.ListenPacket("udp4", "0.0.0.0")
+			unprivileged = true
+		}
+	} else {
+		request, proto = ipv6.ICMPTypeEchoRequest, 58
+		if c, err = icmp.ListenPacket("ip6:ipv6-icmp", "::"); err != nil {
+			c, err = icmp.ListenPacket("udp6", "::")
+			unprivileged = true
+		}
+	}
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	if unprivileged {
+		to = &net.UDPAddr{IP: req.dst.AsSlice()}
+	} else {
+		to = &net.IPAddr{IP: req.dst.AsSlice()}
+	}
+	// The stack was a hop
+	if req.dst.Is4() {
+		_ = c.IPv4PacketConn().SetTTL(req.ttl - 1)
+	} else {
+		_ = c.IPv6PacketConn().SetHopLimit(req.ttl - 1)
+	}
+
+	msg := icmp.Message{Type: request, Body: &icmp.Echo{ID: int(req.id), Seq: int(req.seq), Data: req.data}}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return
+	}
+	if _, err := c.WriteTo(b, to); err != nil {
+		return
+	}
+
+	_ = c.SetReadDeadline(time.Now().Add(pingTimeout))
+	buf := make([]byte, tun.mtu+header.IPv6MinimumSize)
+	for {
+		n, from, err := c.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		fromAddr, ok := addrOf(from)
+		if !ok {
+			continue
+		}
+
+		switch body := reply.Body.(type) {
+		case *icmp.Echo:
+			// Unprivileged sockets get the replies to their own requests
+			// only, with the identifier replaced by the system
+			if body.Seq != int(req.seq) || (!unprivileged && body.ID != int(req.id)) || fromAddr != req.dst {
+				continue
+			}
+			typ := uint8(header.ICMPv4EchoReply)
+			if req.dst.Is6() {
+				typ = uint8(header.ICMPv6EchoReply)
+			}
+			rest := binary.BigEndian.AppendUint16(nil, req.id)
+			rest = binary.BigEndian.AppendUint16(rest, req.seq)
+			tun.injectICMP(req.src, req.dst, typ, 0, append(rest, body.Data...))
+			return
+		case *icmp.TimeExceeded:
+			if !quotesRequest(body.Data, req, unprivileged) {
+				continue
+			}
+		case *icmp.DstUnreach:
+			if !quotesRequest(body.Data, req, unprivileged) {
+				continue
+			}
+		default:
+			continue
+		}
+		// Errors are passed back with their type and code, quoting the
+		// request as the peer sent it
+		tun.injectICMP(req.src, fromAddr, uint8(buf[0]), buf[1], append(make([]byte, 4), req.quote...))
+		return
+	}
+}
+
+// quotesRequest reports whether the start of a packet quoted by an icmp
+// error is req as sent from this host.
+func quotesRequest(quote []byte, req pingRequest, unprivileged bool) bool {
+	var echo []byte
+	if req.dst.Is4() {
+		ip := header.IPv4(quote)
+		if len(quote) < header.IPv4MinimumSize || int(ip.HeaderLength()) > len(quote) ||
+			ip.TransportProtocol() != header.ICMPv4ProtocolNumber || ip.DestinationAddress() != tcpip.AddrFrom4(req.dst.As4()) {
+			return false
+		}
+		echo = quote[ip.HeaderLength():]
+		if len(echo) < header.ICMPv4MinimumSize || header.ICMPv4(echo).Type() != header.ICMPv4Echo {
+			return false
+		}
+	} else {
+		ip := header.IPv6(quote)
+		if len(quote) < header.IPv6MinimumSize || ip.TransportProtocol() != header.ICMPv6ProtocolNumber ||
+			ip.DestinationAddress() != tcpip.AddrFrom16(req.dst.As16()) {
+			return false
+		}
+		echo = quote[header.IPv6MinimumSize:]
+		if len(echo) < header.ICMPv6MinimumSize || header.ICMPv6(echo).Type() != header.ICMPv6EchoRequest {
+			return false
+		}
+	}
+	h := header.ICMPv4(echo)
+	return h.Sequence() == req.seq && (unprivileged || h.Ident() == req.id)
+}
+
+// addrOf returns the address of a peer of an icmp socket.
+func addrOf(from net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch from := from.(type) {
+	case *net.UDPAddr:
+		ip = from.IP
+	case *net.IPAddr:
+		ip = from.IP
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	return addr.Unmap(), ok
+}
+
+// injectICMP passes an icmp message from "from" to dst out the tunnel, rest
+// being what follows its type, code and checksum.
+func (tun *netTun) injectICMP(dst, from netip.Addr, typ, code uint8, rest []byte) {
+	var packet []byte
+	if from.Is4() {
+		packet = make([]byte, header.IPv4MinimumSize+4+len(rest))
+		ip := header.IPv4(packet)
+		ip.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(packet)),
+			TTL:         pingReplyTTL,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     tcpip.AddrFrom4(from.As4()),
+			DstAddr:     tcpip.AddrFrom4(dst.As4()),
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		msg := header.ICMPv4(ip.Payload())
+		msg.SetType(header.ICMPv4Type(typ))
+		msg.SetCode(header.ICMPv4Code(code))
+		copy(msg[4:], rest)
+		msg.SetChecksum(header.ICMPv4Checksum(msg, 0))
+	} else {
+		packet = make([]byte, header.IPv6MinimumSize+4+len(rest))
+		ip := header.IPv6(packet)
+		ip.Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(len(packet) - header.IPv6MinimumSize),
+			TransportProtocol: header.ICMPv6ProtocolNumber,
+			HopLimit:          pingReplyTTL,
+			SrcAddr:           tcpip.AddrFrom16(from.As16()),
+			DstAddr:           tcpip.AddrFrom16(dst.As16()),
+		})
+		msg := header.ICMPv6(ip.Payload())
+		msg.SetType(header.ICMPv6Type(typ))
+		msg.SetCode(header.ICMPv6Code(code))
+		copy(msg[4:], rest)
+		msg.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+			Header: msg,
+			Src:    ip.SourceAddress(),
+			Dst:    ip.DestinationAddress(),
+		}))
+	}
+
+	tun.inject(packet)
+}
@@ -0,0 +1,73 @@
+//go:build !netstack_lite
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"fmt"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// CongestionControls lists the valid TCPTuning.CongestionControl values.
+var CongestionControls = []string{"reno", "cubic"}
+
+// apply sets t as the TCP options of s, with the buffers capped to
+// maxBuffer unless zero.
+func (t TCPTuning) apply(s *stack.Stack, maxBuffer int) error {
+	sack := tcpip.TCPSACKEnabled(!t.NoSACK)
+	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &sack); err != nil {
+		return fmt.Errorf("could not set TCP SACK: %v", err)
+	}
+
+	if t.CongestionControl != "" {
+		cc := tcpip.CongestionControlOption(t.CongestionControl)
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &cc); err != nil {
+			return fmt.Errorf("could not set TCP congestion control %s: %v", t.CongestionControl, err)
+		}
+	}
+
+	if t.AutoTune {
+		moderate := tcpip.TCPModerateReceiveBufferOption(true)
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &moderate); err != nil {
+			return fmt.Errorf("could not enable TCP receive buffer auto tuning: %v", err)
+		}
+	}
+
+	rcv := tcpip.TCPReceiveBufferSizeRangeOption{Min: tcp.MinBufferSize, Default: tcp.DefaultReceiveBufferSize, Max: tcp.MaxBufferSize}
+	snd := tcpip.TCPSendBufferSizeRangeOption{Min: tcp.MinBufferSize, Default: tcp.DefaultSendBufferSize, Max: tcp.MaxBufferSize}
+	if t.MaxBufferSize > 0 {
+		rcv.Max, snd.Max = t.MaxBufferSize, t.MaxBufferSize
+	}
+	if maxBuffer > 0 {
+		rcv.Max, snd.Max = min(rcv.Max, maxBuffer), min(snd.Max, maxBuffer)
+	}
+	if t.NoWindowScaling {
+		// The window scale offered follows the receive buffer, or its
+		// maximum when auto tuning
+		rcv.Max = min(rcv.Max, maxUnscaledWindow)
+	}
+	if t.ReceiveBufferSize > 0 {
+		rcv.Default = t.ReceiveBufferSize
+	}
+	if t.SendBufferSize > 0 {
+		snd.Default = t.SendBufferSize
+	}
+	rcv.Max, snd.Max = max(rcv.Max, rcv.Min), max(snd.Max, snd.Min)
+	rcv.Default = min(max(rcv.Default, rcv.Min), rcv.Max)
+	snd.Default = min(max(snd.Default, snd.Min), snd.Max)
+
+	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &rcv); err != nil {
+		return fmt.Errorf("could not set TCP receive buffer size: %v", err)
+	}
+	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &snd); err != nil {
+		return fmt.Errorf("could not set TCP send buffer size: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+// maxUnscaledWindow is the largest receive window without window scaling.
+const maxUnscaledWindow = 1<<16 - 1
+
+// TCPTuning adjusts the TCP of stacks. The zero value keeps the gVisor
+// defaults, but for SACK, which is enabled. The lite stack takes the buffer
+// sizes only.
+type TCPTuning struct {
+	// CongestionControl is one of CongestionControls, empty for reno
+	CongestionControl string
+	// ReceiveBufferSize and SendBufferSize are the per connection buffers
+	// to start with, zero for 1MiB
+	ReceiveBufferSize int
+	SendBufferSize    int
+	// MaxBufferSize is what the buffers may grow to, zero for 4MiB
+	MaxBufferSize int
+	// NoSACK disables selective acknowledgements
+	NoSACK bool
+	// NoWindowScaling keeps the receive window within 64KiB, unscaled
+	NoWindowScaling bool
+	// AutoTune grows the receive buffers of connections with their
+	// throughput, up to MaxBufferSize, and scales their windows for it
+	AutoTune bool
+}
+
+// TCP tunes the stacks created afterwards. TCPMaxBufferSize caps the
+// buffers beyond it.
+var TCP TCPTuning
+
+// TCPMaxBufferSize caps the per connection TCP send and receive buffers of
+// stacks created afterwards, whatever TCP sets. Zero leaves them uncapped.
+var TCPMaxBufferSize int
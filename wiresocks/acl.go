@@ -0,0 +1,170 @@
+package wiresocks
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// SourceRule lets connections from Prefix in to the inbound bound at
+// Listener, or to every inbound if Listener is not valid.
+type SourceRule struct {
+	Listener netip.AddrPort
+	Prefix   netip.Prefix
+}
+
+func (r SourceRule) String() string {
+	if !r.Listener.IsValid() {
+		return r.Prefix.String()
+	}
+	return r.Listener.String() + "=" + r.Prefix.String()
+}
+
+// ParseSourceRule parses a rule as CIDR for every inbound, or as
+// ADDR:PORT=CIDR for the one bound at ADDR:PORT. A single address may be
+// given for the CIDR.
+func ParseSourceRule(s string) (SourceRule, error) {
+	var r SourceRule
+	listener, source, ok := strings.Cut(s, "=")
+	if !ok {
+		source = listener
+	} else {
+		var err error
+		if r.Listener, err = netip.ParseAddrPort(listener); err != nil {
+			return r, fmt.Errorf("invalid source rule %q: invalid listener %q", s, listener)
+		}
+	}
+
+	if addr, err := netip.ParseAddr(source); err == nil {
+		r.Prefix = netip.PrefixFrom(addr, addr.BitLen())
+		return r, nil
+	}
+	p, err := netip.ParsePrefix(source)
+	if err != nil {
+		return r, fmt.Errorf("invalid source rule %q: want a CIDR or address, not %q", s, source)
+	}
+	r.Prefix = p.Masked()
+	return r, nil
+}
+
+// SourceACLStats counts the connections to an inbound with source rules.
+type SourceACLStats struct {
+	Listener string `json:"listener"`
+	Accepted uint64 `json:"accepted"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// SourceACL lets connections in to inbounds only from the sources the rules
+// for them allow, and from loopback. Inbounds no rule is for, and unix
+// sockets, let everyone in.
+type SourceACL struct {
+	rules []SourceRule
+
+	mu     sync.Mutex
+	counts map[string]*aclCounts
+}
+
+type aclCounts struct {
+	accepted, rejected atomic.Uint64
+}
+
+// NewSourceACL returns a SourceACL of rules.
+func NewSourceACL(rules []SourceRule) *SourceACL {
+	return &SourceACL{rules: rules, counts: make(map[string]*aclCounts)}
+}
+
+// WithSourceACL lets connections in only from the sources acl allows.
+func WithSourceACL(acl *SourceACL) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.acl = acl
+	}
+}
+
+// Stats returns the connection counts of the inbounds with rules, ordered
+// by address.
+func (a *SourceACL) Stats() []SourceACLStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	res := make([]SourceACLStats, 0, len(a.counts))
+	for listener, c := range a.counts {
+		res = append(res, SourceACLStats{
+			Listener: listener,
+			Accepted: c.accepted.Load(),
+			Rejected: c.rejected.Load(),
+		})
+	}
+	slices.SortFunc(res, func(a, b SourceACLStats) int { return strings.Compare(a.Listener, b.Listener) })
+	return res
+}
+
+// wrap returns ln, closing the connections it accepts from sources the
+// rules for it don't allow.
+func (a *SourceACL) wrap(l *slog.Logger, ln net.Listener) net.Listener {
+	addr, ok := ln.Addr().(*net.TCPAddr)
+	if !ok {
+		return ln
+	}
+	local := addr.AddrPort()
+
+	var prefixes []netip.Prefix
+	for _, r := range a.rules {
+		if !r.Listener.IsValid() || (r.Listener.Addr().Unmap() == local.Addr().Unmap() && r.Listener.Port() == local.Port()) {
+			prefixes = append(prefixes, r.Prefix)
+		}
+	}
+	if len(prefixes) == 0 {
+		return ln
+	}
+
+	c := &aclCounts{}
+	a.mu.Lock()
+	a.counts[local.String()] = c
+	a.mu.Unlock()
+	return &aclListener{Listener: ln, logger: l, prefixes: prefixes, counts: c}
+}
+
+type aclListener struct {
+	net.Listener
+	logger   *slog.Logger
+	prefixes []netip.Prefix
+	counts   *aclCounts
+}
+
+func (ln *aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if ln.allowed(conn.RemoteAddr()) {
+			ln.counts.accepted.Add(1)
+			return conn, nil
+		}
+		ln.counts.rejected.Add(1)
+		ln.logger.Debug("rejected connection from disallowed source", "source", conn.RemoteAddr(), "listener", ln.Addr())
+		_ = conn.Close()
+	}
+}
+
+func (ln *aclListener) allowed(remote net.Addr) bool {
+	addr, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip := addr.AddrPort().Addr().Unmap()
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, p := range ln.prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
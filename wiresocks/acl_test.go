@@ -0,0 +1,256 @@
+package wiresocks
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+)
+
+func TestParseSourceRule(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    SourceRule
+		wantErr bool
+	}{
+		{in: "10.1.2.3/8", want: SourceRule{Prefix: netip.MustParsePrefix("10.0.0.0/8")}},
+		{in: "192.168.1.5", want: SourceRule{Prefix: netip.MustParsePrefix("192.168.1.5/32")}},
+		{in: "fd00::/8", want: SourceRule{Prefix: netip.MustParsePrefix("fd00::/8")}},
+		{in: "0.0.0.0:8086=10.0.0.0/8", want: SourceRule{Listener: netip.MustParseAddrPort("0.0.0.0:8086"), Prefix: netip.MustParsePrefix("10.0.0.0/8")}},
+		{in: "[::]:8086=fd00::1", want: SourceRule{Listener: netip.MustParseAddrPort("[::]:8086"), Prefix: netip.MustParsePrefix("fd00::1/128")}},
+		{in: "", wantErr: true},
+		{in: "10.0.0.0/33", wantErr: true},
+		{in: "8086=10.0.0.0/8", wantErr: true},
+		{in: "0.0.0.0:8086=", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSourceRule(tt.in)
+		if (err != nil) != tt.wantErr || (err == nil && got != tt.want) {
+			t.Errorf("ParseSourceRule(%q) = %v, %v, want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// sourceConn is a connection from source.
+type sourceConn struct {
+	net.Conn
+	source net.Addr
+}
+
+func (c sourceConn) RemoteAddr() net.Addr { return c.source }
+
+// sourceListener accepts a connection from each of sources in turn,
+// counting those closed.
+type sourceListener struct {
+	addr    net.Addr
+	sources []string
+	closed  int
+}
+
+func (ln *sourceListener) Accept() (net.Conn, error) {
+	if len(ln.sources) == 0 {
+		return nil, net.ErrClosed
+	}
+	source := net.TCPAddrFromAddrPort(netip.MustParseAddrPort(ln.sources[0]))
+	ln.sources = ln.sources[1:]
+	c, peer := net.Pipe()
+	peer.Close()
+	return &closeConn{sourceConn: sourceConn{Conn: c, source: source}, closed: &ln.closed}, nil
+}
+
+func (ln *sourceListener) Close() error   { return nil }
+func (ln *sourceListener) Addr() net.Addr { return ln.addr }
+
+// closeConn counts being closed in closed.
+type closeConn struct {
+	sourceConn
+	closed *int
+}
+
+func (c *closeConn) Close() error {
+	*c.closed++
+	return c.sourceConn.Close()
+}
+
+func TestSourceACL(t *testing.T) {
+	var rules []SourceRule
+	for _, s := range []string{"10.0.0.0/8", "0.0.0.0:8086=192.168.1.0/24", "[::]:8086=fd00::/8"} {
+		r, err := ParseSourceRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+	acl := NewSourceACL(rules)
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		listener string
+		sources  []string
+		// accepted are the sources let in
+		accepted []string
+	}{{
+		// Only the rule for every inbound applies, and loopback is let in
+		listener: "0.0.0.0:1080",
+		sources:  []string{"10.1.2.3:5000", "192.168.1.7:5000", "127.0.0.1:5000", "[::1]:5000", "203.0.113.1:5000"},
+		accepted: []string{"10.1.2.3:5000", "127.0.0.1:5000", "[::1]:5000"},
+	}, {
+		// Rules for the listener add to the rule for every inbound, which
+		// matches v4 sources mapped to v6
+		listener: "0.0.0.0:8086",
+		sources:  []string{"192.168.1.7:5000", "192.168.2.7:5000", "[::ffff:10.0.0.1]:5000", "203.0.113.1:5000"},
+		accepted: []string{"192.168.1.7:5000", "10.0.0.1:5000"},
+	}, {
+		listener: "[::]:8086",
+		sources:  []string{"[fd00::7]:5000", "[fe80::7]:5000", "192.168.1.7:5000"},
+		accepted: []string{"[fd00::7]:5000"},
+	}}
+	for _, tt := range tests {
+		inner := &sourceListener{addr: net.TCPAddrFromAddrPort(netip.MustParseAddrPort(tt.listener)), sources: tt.sources}
+		ln := acl.wrap(l, inner)
+
+		var accepted []string
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				break
+			}
+			accepted = append(accepted, c.RemoteAddr().String())
+		}
+		if !slices.Equal(accepted, tt.accepted) {
+			t.Errorf("%s let in %v, want %v", tt.listener, accepted, tt.accepted)
+		}
+		if want := len(tt.sources) - len(tt.accepted); inner.closed != want {
+			t.Errorf("%s closed %d connections, want %d", tt.listener, inner.closed, want)
+		}
+	}
+
+	// Listeners no rule is for, like unix sockets, let everyone in
+	noRules := NewSourceACL(rules[1:])
+	inner := &sourceListener{addr: net.TCPAddrFromAddrPort(netip.MustParseAddrPort("0.0.0.0:1080"))}
+	if ln := noRules.wrap(l, inner); ln != net.Listener(inner) {
+		t.Error("wrapped a listener no rule is for")
+	}
+	unix := &sourceListener{addr: &net.UnixAddr{Name: "/tmp/warp.sock", Net: "unix"}}
+	if ln := acl.wrap(l, unix); ln != net.Listener(unix) {
+		t.Error("wrapped a unix socket")
+	}
+
+	want := []SourceACLStats{
+		{Listener: "0.0.0.0:1080", Accepted: 3, Rejected: 2},
+		{Listener: "0.0.0.0:8086", Accepted: 2, Rejected: 2},
+		{Listener: "[::]:8086", Accepted: 1, Rejected: 2},
+	}
+	if got := acl.Stats(); !slices.Equal(got, want) {
+		t.Errorf("stats %+v, want %+v", got, want)
+	}
+}
+
+func TestSourceACLClientOnlyUDP(t *testing.T) {
+	// An echo server in the tunnel, which the stack reaches locally
+	local := netip.MustParseAddr("10.0.0.1")
+	_, tnet, err := netstack.CreateNetTUN([]netip.Addr{local}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo, err := tnet.ListenUDPAddrPort(netip.AddrPortFrom(local, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	echoed := make(chan string, 8)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echoed <- string(buf[:n])
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	acl := NewSourceACL([]SourceRule{{Prefix: netip.MustParsePrefix("10.0.0.0/8")}})
+	vt := newVirtualTun(ctx, l, tnet, WithSourceACL(acl))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	vt.serve(l, acl.wrap(l, ln))
+
+	// Associate from loopback, which the rules let in
+	ctrl, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	_ = ctrl.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ctrl.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(ctrl, reply[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctrl.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(ctrl, reply); err != nil || reply[1] != 0 || reply[3] != 1 {
+		t.Fatalf("associate replied %v, %v", reply, err)
+	}
+	relay := net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.AddrFrom4([4]byte(reply[4:8])), binary.BigEndian.Uint16(reply[8:])))
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// Another host, which could send on the association if it knew the
+	// port, for the rules kept it out
+	stranger, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Skip("no second loopback address:", err)
+	}
+	defer stranger.Close()
+
+	packet := func(payload string) []byte {
+		return append([]byte{0, 0, 0, 1, 10, 0, 0, 1, 0, 7}, payload...)
+	}
+	for _, payload := range []string{"first", "second"} {
+		if _, err := stranger.WriteTo(packet("stranger "+payload), relay); err != nil {
+			t.Fatal(err)
+		}
+		// Sent after the stranger's, so it arrives after it
+		time.Sleep(20 * time.Millisecond)
+		if _, err := client.WriteTo(packet(payload), relay); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-echoed:
+			if got != payload {
+				t.Fatalf("relayed %q from the stranger", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s packet of the client not relayed", payload)
+		}
+
+		_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1500)
+		n, err := client.Read(buf)
+		if err != nil || n < 10 || string(buf[10:n]) != payload {
+			t.Fatalf("client got %q, %v, want the echo of %q", buf[:n], err, payload)
+		}
+	}
+}
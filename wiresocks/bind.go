@@ -0,0 +1,85 @@
+package wiresocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/bepass-org/warp-plus/upgrade"
+)
+
+// unixPrefix marks binds that are unix socket paths.
+const unixPrefix = "unix:"
+
+// ParseBind parses an address the proxy is served on, ADDR:PORT or
+// unix:PATH for a unix socket, returning its network and address.
+func ParseBind(s string) (network, address string, err error) {
+	if path, ok := strings.CutPrefix(s, unixPrefix); ok {
+		if path == "" {
+			return "", "", errors.New("missing unix socket path")
+		}
+		return "unix", path, nil
+	}
+	if _, err := netip.ParseAddrPort(s); err != nil {
+		return "", "", fmt.Errorf("invalid bind %q: want ADDR:PORT or unix:PATH", s)
+	}
+	return "tcp", s, nil
+}
+
+// WithExtraBinds also serves the proxy on binds, as parsed by ParseBind,
+// creating unix sockets with mode.
+func WithExtraBinds(binds []string, mode os.FileMode) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.extraBinds = binds
+		vt.socketMode = mode
+	}
+}
+
+// listenBind listens on bind, as parsed by ParseBind. A unix socket left
+// behind by a process that is gone is replaced, and made with mode.
+func listenBind(bind string, mode os.FileMode) (net.Listener, error) {
+	network, address, err := ParseBind(bind)
+	if err != nil {
+		return nil, err
+	}
+	if network != "unix" {
+		return upgrade.Listen(network, address)
+	}
+
+	ln, err := upgrade.Listen(network, address)
+	if errors.Is(err, syscall.EADDRINUSE) && staleSocket(address) {
+		if err := os.Remove(address); err != nil {
+			return nil, err
+		}
+		ln, err = upgrade.Listen(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Abstract sockets have no file
+	if !strings.HasPrefix(address, "@") {
+		if err := os.Chmod(address, mode); err != nil {
+			_ = ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// staleSocket reports whether nothing accepts connections on the unix
+// socket at path.
+func staleSocket(path string) bool {
+	if fi, err := os.Stat(path); err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return true
+	}
+	_ = conn.Close()
+	return false
+}
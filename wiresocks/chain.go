@@ -0,0 +1,238 @@
+package wiresocks
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/trojan"
+	"github.com/bepass-org/warp-plus/proxy/pkg/vless"
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+	"github.com/noql-net/certpool"
+)
+
+const (
+	chainCheckTarget  = "1.1.1.1:80"
+	chainCheckTimeout = 10 * time.Second
+)
+
+// ChainHop is a user controlled VLESS or Trojan server that connections
+// enter after leaving the tunnel, so they exit from the server's address.
+type ChainHop struct {
+	// Protocol is vless or trojan
+	Protocol string
+	// Server is the host:port of the server
+	Server string
+	// TLS wraps the connection to the server in TLS, always set for trojan
+	TLS bool
+	// ServerName is the TLS server name, defaults to the server host
+	ServerName string
+	// Insecure skips verifying the server certificate
+	Insecure bool
+
+	id       vless.UUID
+	password string
+	// down is set while the hop fails its health checks and the tunnel
+	// doesn't, taking it out of use
+	down atomic.Bool
+}
+
+// ParseChainHop parses a share link of the form
+// vless://id@host:port?security=tls&sni=name or
+// trojan://password@host:port?sni=name. allowInsecure=1 skips certificate
+// verification.
+func ParseChainHop(link string) (*ChainHop, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.Host == "" || u.Port() == "" {
+		return nil, fmt.Errorf("invalid chain link: %s", u.Redacted())
+	}
+
+	q := u.Query()
+	h := &ChainHop{
+		Protocol:   u.Scheme,
+		Server:     u.Host,
+		ServerName: q.Get("sni"),
+		Insecure:   q.Get("allowInsecure") == "1" || q.Get("allowInsecure") == "true",
+	}
+	if h.ServerName == "" {
+		h.ServerName = u.Hostname()
+	}
+
+	switch u.Scheme {
+	case "vless":
+		if h.id, err = vless.ParseUUID(u.User.Username()); err != nil {
+			return nil, err
+		}
+		h.TLS = q.Get("security") == "tls"
+	case "trojan":
+		h.password = u.User.Username()
+		h.TLS = true
+	default:
+		return nil, fmt.Errorf("unsupported chain protocol: %s", u.Scheme)
+	}
+
+	return h, nil
+}
+
+// String returns the hop without its credentials.
+func (h *ChainHop) String() string {
+	return h.Protocol + "://" + h.Server
+}
+
+// CarriesUDP reports whether the hop can carry UDP, which trojan can't.
+func (h *ChainHop) CarriesUDP() bool {
+	return h.Protocol == "vless"
+}
+
+// carries reports whether connections over network go through the hop,
+// which is out of use while down. Those that don't leave the tunnel
+// directly.
+func (h *ChainHop) carries(network string) bool {
+	if h.down.Load() {
+		return false
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return true
+	}
+	return h.CarriesUDP()
+}
+
+// Dial connects to destination through the tunnel and then the hop.
+func (h *ChainHop) Dial(ctx context.Context, tnet *netstack.Net, network, destination string) (net.Conn, error) {
+	conn, err := tnet.DialContext(ctx, "tcp", h.Server)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.TLS {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         h.ServerName,
+			RootCAs:            certpool.Roots(),
+			InsecureSkipVerify: h.Insecure,
+		})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	var c net.Conn
+	switch h.Protocol {
+	case "vless":
+		c, err = vless.ClientConn(conn, h.id, network, destination)
+	case "trojan":
+		c, err = trojan.ClientConn(conn, h.password, network, destination)
+	default:
+		err = fmt.Errorf("unsupported chain protocol: %s", h.Protocol)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// WithChain sends proxied connections through hop after the tunnel.
+func WithChain(hop *ChainHop) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.chain = hop
+	}
+}
+
+// MonitorChain checks every interval that both the tunnel and the hop after
+// it pass traffic, logging whenever a hop changes state. While the tunnel
+// passes traffic and the hop doesn't, the hop is taken out of use and
+// connections leave the tunnel directly.
+func MonitorChain(ctx context.Context, l *slog.Logger, tnet *netstack.Net, hop *ChainHop, interval time.Duration) {
+	l = l.With("subsystem", "chain")
+
+	hops := []struct {
+		name string
+		dial func(ctx context.Context) (net.Conn, error)
+		err  error
+	}{
+		{name: "warp", dial: func(ctx context.Context) (net.Conn, error) {
+			return tnet.DialContext(ctx, "tcp", chainCheckTarget)
+		}},
+		{name: hop.String(), dial: func(ctx context.Context) (net.Conn, error) {
+			return hop.Dial(ctx, tnet, "tcp", chainCheckTarget)
+		}},
+	}
+	// Start out unknown so the first result is always logged
+	for i := range hops {
+		hops[i].err = errors.New("unknown")
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		for i := range hops {
+			err := checkHop(ctx, hops[i].dial)
+			switch {
+			case err == nil && hops[i].err != nil:
+				l.Info("chain hop healthy", "hop", hops[i].name)
+			case err != nil && (hops[i].err == nil || hops[i].err.Error() != err.Error()):
+				l.Warn("chain hop unhealthy", "hop", hops[i].name, "error", err)
+			}
+			hops[i].err = err
+		}
+		if hops[0].err == nil && (hops[1].err != nil) != hop.down.Load() {
+			hop.down.Store(hops[1].err != nil)
+			if hops[1].err != nil {
+				l.Warn("chain hop out of use, connections leave the tunnel directly until it recovers", "hop", hop)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// checkHop makes a plain HTTP request to the check target over the
+// connection dial returns.
+func checkHop(ctx context.Context, dial func(ctx context.Context) (net.Conn, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, chainCheckTimeout)
+	defer cancel()
+
+	conn, err := dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	host, _, _ := net.SplitHostPort(chainCheckTarget)
+	if _, err := conn.Write([]byte("HEAD /cdn-cgi/trace HTTP/1.1\r\nHost: " + host + "\r\nConnection: close\r\n\r\n")); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return errors.New("unexpected status: " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package wiresocks
+
+import "testing"
+
+func TestChainHopCarries(t *testing.T) {
+	tests := []struct {
+		link     string
+		tcp, udp bool
+	}{
+		{"vless://b831381d-6324-4d53-ad4f-8cda48b30811@example.com:443?security=tls", true, true},
+		{"trojan://password@example.com:443", true, false},
+	}
+	for _, tt := range tests {
+		h, err := ParseChainHop(tt.link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := h.carries("tcp"); got != tt.tcp {
+			t.Errorf("%s carries tcp: got %v, want %v", h, got, tt.tcp)
+		}
+		if got := h.carries("udp"); got != tt.udp {
+			t.Errorf("%s carries udp: got %v, want %v", h, got, tt.udp)
+		}
+
+		// Nothing goes through a hop that is down
+		h.down.Store(true)
+		if h.carries("tcp") || h.carries("udp") {
+			t.Errorf("%s carries connections while down", h)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/bepass-org/warp-plus/wireguard/conn"
 	"github.com/go-ini/ini"
 )
 
@@ -28,6 +29,40 @@ type InterfaceConfig struct {
 	Addresses  []netip.Addr
 	DNS        []netip.Addr
 	MTU        int
+	// ListenPort is the port the device listens on, random if zero.
+	ListenPort uint16
+	// CipherSuite selects a non-standard wireguard cipher suite, both ends
+	// must be configured with the same suite.
+	CipherSuite string
+	// ReorderDepth is the number of out of order packets held back on
+	// receive, zero disables resequencing.
+	ReorderDepth int
+	// Shaping pads and paces sent packets after a shaping profile of the
+	// device, peers need no configuration.
+	Shaping string
+	// DecoyInterval is how long in seconds the tunnel goes idle before a
+	// few dummy packets are sent, zero sends none.
+	DecoyInterval int
+	// InitFragments and InitJunk frame handshake initiations for a relay
+	// restoring them, see device.SetInitiationFraming.
+	InitFragments int
+	InitJunk      int
+	// InitMimic makes the first datagram of initiations look like another
+	// protocol, see device.SetInitiationMimicry.
+	InitMimic string
+	// UnknownIndexRecovery handshakes with peers sending on a session the
+	// device doesn't know, see device.SetUnknownIndexRecovery.
+	UnknownIndexRecovery bool
+	// PresharedMAC1 keys handshake macs by the preshared keys of the peers
+	// too, see device.SetPresharedMAC1.
+	PresharedMAC1 bool
+	// KnockKey is the hex knock key, see device.SetKnockKey, empty for
+	// none.
+	KnockKey string
+	// FEC is the DATA:PARITY ratio of forward error correction added to
+	// the datagrams sent, see conn.NewFECBind, empty for none. Peers must
+	// use the same ratio.
+	FEC string
 }
 
 type Configuration struct {
@@ -102,6 +137,89 @@ func ParseInterface(cfg *ini.File) (InterfaceConfig, error) {
 		device.MTU = value
 	}
 
+	if sectionKey, err := iface.GetKey("ListenPort"); err == nil {
+		value, err := strconv.ParseUint(sectionKey.String(), 10, 16)
+		if err != nil {
+			return InterfaceConfig{}, err
+		}
+		device.ListenPort = uint16(value)
+	}
+
+	if sectionKey, err := iface.GetKey("CipherSuite"); err == nil {
+		device.CipherSuite = sectionKey.String()
+	}
+
+	if sectionKey, err := iface.GetKey("ReorderDepth"); err == nil {
+		value, err := sectionKey.Int()
+		if err != nil {
+			return InterfaceConfig{}, err
+		}
+		device.ReorderDepth = value
+	}
+
+	if sectionKey, err := iface.GetKey("Shaping"); err == nil {
+		device.Shaping = sectionKey.String()
+	}
+
+	if sectionKey, err := iface.GetKey("DecoyInterval"); err == nil {
+		value, err := sectionKey.Int()
+		if err != nil {
+			return InterfaceConfig{}, err
+		}
+		device.DecoyInterval = value
+	}
+
+	if sectionKey, err := iface.GetKey("InitFragments"); err == nil {
+		value, err := sectionKey.Int()
+		if err != nil {
+			return InterfaceConfig{}, err
+		}
+		device.InitFragments = value
+	}
+
+	if sectionKey, err := iface.GetKey("InitJunk"); err == nil {
+		value, err := sectionKey.Int()
+		if err != nil {
+			return InterfaceConfig{}, err
+		}
+		device.InitJunk = value
+	}
+
+	if sectionKey, err := iface.GetKey("InitMimic"); err == nil {
+		device.InitMimic = sectionKey.String()
+	}
+
+	if sectionKey, err := iface.GetKey("UnknownIndexRecovery"); err == nil {
+		value, err := sectionKey.Bool()
+		if err != nil {
+			return InterfaceConfig{}, err
+		}
+		device.UnknownIndexRecovery = value
+	}
+
+	if sectionKey, err := iface.GetKey("PresharedMAC1"); err == nil {
+		value, err := sectionKey.Bool()
+		if err != nil {
+			return InterfaceConfig{}, err
+		}
+		device.PresharedMAC1 = value
+	}
+
+	if sectionKey, err := iface.GetKey("KnockKey"); err == nil {
+		value, err := EncodeBase64ToHex(sectionKey.String())
+		if err != nil {
+			return InterfaceConfig{}, err
+		}
+		device.KnockKey = value
+	}
+
+	if sectionKey, err := iface.GetKey("FEC"); err == nil {
+		if _, _, err := conn.ParseFEC(sectionKey.String()); err != nil {
+			return InterfaceConfig{}, err
+		}
+		device.FEC = sectionKey.String()
+	}
+
 	return device, nil
 }
 
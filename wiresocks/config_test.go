@@ -16,6 +16,8 @@ DNS = 8.8.8.8
 Address = 172.16.0.2/24
 Address = 2606:4700:110:8cc0:1ad3:9155:6742:ea8d/128
 MTU = 1500
+ListenPort = 51820
+FEC = 4:1
 [Peer]
 PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=
 AllowedIPs = 0.0.0.0/0
@@ -50,8 +52,10 @@ func TestParseInterface(t *testing.T) {
 			netip.MustParseAddr("172.16.0.2"),
 			netip.MustParseAddr("2606:4700:110:8cc0:1ad3:9155:6742:ea8d"),
 		},
-		DNS: []netip.Addr{netip.MustParseAddr("8.8.8.8")},
-		MTU: 1500,
+		DNS:        []netip.Addr{netip.MustParseAddr("8.8.8.8")},
+		MTU:        1500,
+		ListenPort: 51820,
+		FEC:        "4:1",
 	}
 	qt.Assert(t, device, qt.CmpEquals(cmpopts.EquateComparable(netip.Addr{})), want)
 	t.Logf("%+v", device)
@@ -0,0 +1,126 @@
+package wiresocks
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Flow is a snapshot of an active proxied connection.
+type Flow struct {
+	ID            uint64    `json:"id"`
+	Source        string    `json:"source"`
+	Destination   string    `json:"destination"`
+	Protocol      string    `json:"protocol"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	Started       time.Time `json:"started"`
+}
+
+type trackedFlow struct {
+	Flow
+	sent  atomic.Int64
+	recv  atomic.Int64
+	close func()
+}
+
+// ConnTracker keeps track of active proxied connections so they can be
+// listed and terminated while running.
+type ConnTracker struct {
+	mu     sync.Mutex
+	nextID uint64
+	flows  map[uint64]*trackedFlow
+}
+
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{flows: make(map[uint64]*trackedFlow)}
+}
+
+func (t *ConnTracker) add(src, dst, protocol string, close func()) *trackedFlow {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextID++
+	f := &trackedFlow{
+		Flow: Flow{
+			ID:          t.nextID,
+			Source:      src,
+			Destination: dst,
+			Protocol:    protocol,
+			Started:     time.Now(),
+		},
+		close: close,
+	}
+	t.flows[f.ID] = f
+	return f
+}
+
+func (t *ConnTracker) remove(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.flows, id)
+}
+
+// Flows returns the currently active connections ordered by id.
+func (t *ConnTracker) Flows() []Flow {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res := make([]Flow, 0, len(t.flows))
+	for _, f := range t.flows {
+		flow := f.Flow
+		flow.BytesSent = f.sent.Load()
+		flow.BytesReceived = f.recv.Load()
+		res = append(res, flow)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// Kill closes the connection with the given id and reports whether it
+// existed.
+func (t *ConnTracker) Kill(id uint64) bool {
+	t.mu.Lock()
+	f, ok := t.flows[id]
+	t.mu.Unlock()
+
+	if ok {
+		f.close()
+	}
+	return ok
+}
+
+// countConn counts the bytes written to the wrapped connection.
+type countConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// flowConn counts the bytes read from and written to the wrapped
+// connection, and drops its flow from the tracker once closed.
+type flowConn struct {
+	countConn
+	recv   *atomic.Int64
+	remove func()
+	once   sync.Once
+}
+
+func (c *flowConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.recv.Add(int64(n))
+	return n, err
+}
+
+func (c *flowConn) Close() error {
+	c.once.Do(c.remove)
+	return c.Conn.Close()
+}
@@ -0,0 +1,117 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+)
+
+// Failover switches the tunnel connections are dialed through between a
+// primary tunnel and a standby one. Connections through the tunnel switched
+// away from are closed, so clients reconnect through the other one right
+// away instead of waiting for them to time out.
+type Failover struct {
+	mu sync.Mutex
+	// nets holds the primary and the standby tunnel
+	nets   [2]*netstack.Net
+	active int
+	conns  [2]map[*failoverConn]struct{}
+}
+
+func NewFailover(primary *netstack.Net) *Failover {
+	return &Failover{
+		nets:  [2]*netstack.Net{primary},
+		conns: [2]map[*failoverConn]struct{}{{}, {}},
+	}
+}
+
+// SetStandby sets the tunnel switched to on failure.
+func (f *Failover) SetStandby(tnet *netstack.Net) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nets[1] = tnet
+}
+
+// OnStandby reports whether connections are dialed through the standby
+// tunnel.
+func (f *Failover) OnStandby() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.active == 1
+}
+
+// Switch moves to the other tunnel, closing the connections through the
+// current one. It reports false if there is no standby tunnel yet.
+func (f *Failover) Switch() bool {
+	f.mu.Lock()
+	if f.nets[1] == nil {
+		f.mu.Unlock()
+		return false
+	}
+	old := f.conns[f.active]
+	f.conns[f.active] = make(map[*failoverConn]struct{})
+	f.active = 1 - f.active
+	f.mu.Unlock()
+
+	for c := range old {
+		_ = c.Conn.Close()
+	}
+	return true
+}
+
+// DialContext connects through the tunnel in use.
+func (f *Failover) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f.dial(func(tnet *netstack.Net) (net.Conn, error) {
+		return tnet.DialContext(ctx, network, address)
+	})
+}
+
+// dial connects with dial through the tunnel in use and tracks the
+// connection until it is closed.
+func (f *Failover) dial(dial func(tnet *netstack.Net) (net.Conn, error)) (net.Conn, error) {
+	f.mu.Lock()
+	i, tnet := f.active, f.nets[f.active]
+	f.mu.Unlock()
+
+	conn, err := dial(tnet)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.active != i {
+		_ = conn.Close()
+		return nil, errors.New("tunnel failed over while connecting")
+	}
+	c := &failoverConn{Conn: conn, f: f, i: i}
+	f.conns[i][c] = struct{}{}
+	return c, nil
+}
+
+type failoverConn struct {
+	net.Conn
+	f *Failover
+	i int
+}
+
+func (c *failoverConn) Close() error {
+	c.f.mu.Lock()
+	delete(c.f.conns[c.i], c)
+	c.f.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// WithFailover dials connections through the tunnel f is using instead of
+// the one the proxy was started on.
+func WithFailover(f *Failover) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.failover = f
+	}
+}
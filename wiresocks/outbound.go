@@ -0,0 +1,154 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// Outbound tags every process has, next to the tunnels.
+const (
+	OutboundDirect = "direct"
+	OutboundBlock  = "block"
+)
+
+// DialFunc connects to address over network.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Outbounds maps tags such as warp, gool or psiphon:DE to the tunnels
+// connections can leave through. Tunnels register themselves as they come
+// up and unregister once down, so rules may reference one that isn't up
+// yet or failed.
+type Outbounds struct {
+	mu      sync.RWMutex
+	dialers map[string]*outbound
+}
+
+// outbound is a registration of a dialer, told apart from a later one of
+// the same tag by its pointer.
+type outbound struct {
+	dial DialFunc
+}
+
+func NewOutbounds() *Outbounds {
+	var d net.Dialer
+	return &Outbounds{
+		dialers: map[string]*outbound{
+			OutboundDirect: {dial: d.DialContext},
+			OutboundBlock: {dial: func(_ context.Context, _, address string) (net.Conn, error) {
+				return nil, fmt.Errorf("connection to %s blocked by routing rule", address)
+			}},
+		},
+	}
+}
+
+// Register makes dial the outbound for tag until unregister is called,
+// replacing any previous one, as of a tunnel brought up again. The direct
+// and block outbounds can't be replaced.
+func (o *Outbounds) Register(tag string, dial DialFunc) (unregister func(), err error) {
+	if tag == OutboundDirect || tag == OutboundBlock {
+		return nil, fmt.Errorf("outbound tag %q is reserved", tag)
+	}
+
+	ob := &outbound{dial: dial}
+	o.mu.Lock()
+	o.dialers[tag] = ob
+	o.mu.Unlock()
+
+	return func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		// Leave a registration that replaced this one alone
+		if o.dialers[tag] == ob {
+			delete(o.dialers, tag)
+		}
+	}, nil
+}
+
+// Dial connects through the outbound registered for tag.
+func (o *Outbounds) Dial(ctx context.Context, tag, network, address string) (net.Conn, error) {
+	o.mu.RLock()
+	ob, ok := o.dialers[tag]
+	o.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("outbound %q is not up", tag)
+	}
+	return ob.dial(ctx, network, address)
+}
+
+// RouteRule sends connections to a domain and its subdomains, or to
+// addresses in a prefix, through an outbound. Domains aren't resolved to
+// match prefixes, so a prefix only matches connections made to an address.
+type RouteRule struct {
+	Domain   string
+	Prefix   netip.Prefix
+	Outbound string
+}
+
+// ParseRouteRule parses a rule given as MATCH=TAG, where MATCH is a domain
+// or a CIDR.
+func ParseRouteRule(s string) (RouteRule, error) {
+	match, tag, ok := strings.Cut(s, "=")
+	if !ok || match == "" || tag == "" {
+		return RouteRule{}, fmt.Errorf("invalid route %q: want MATCH=TAG", s)
+	}
+
+	r := RouteRule{Outbound: tag}
+	if prefix, err := netip.ParsePrefix(match); err == nil {
+		r.Prefix = prefix.Masked()
+	} else if strings.ContainsAny(match, "/:") {
+		return RouteRule{}, fmt.Errorf("invalid route match %q", match)
+	} else {
+		r.Domain = strings.ToLower(strings.Trim(match, "."))
+	}
+	return r, nil
+}
+
+func (r RouteRule) String() string {
+	if r.Domain != "" {
+		return r.Domain + "=" + r.Outbound
+	}
+	return r.Prefix.String() + "=" + r.Outbound
+}
+
+func (r RouteRule) match(domain string, addr netip.Addr) bool {
+	if r.Domain != "" {
+		return domain != "" && (domain == r.Domain || strings.HasSuffix(domain, "."+r.Domain))
+	}
+	return addr.IsValid() && r.Prefix.Contains(addr.Unmap())
+}
+
+// routeTable holds the routing rules of a proxy.
+type routeTable struct {
+	rules     []RouteRule
+	outbounds *Outbounds
+}
+
+// WithRoutes sends connections matching one of rules through its outbound
+// instead of the tunnel; the first matching rule wins. Domains of
+// connections made to a raw IP are sniffed as for direct domains.
+func WithRoutes(rules []RouteRule, outbounds *Outbounds) ProxyOption {
+	return func(vt *VirtualTun) {
+		if len(rules) == 0 {
+			return
+		}
+		if outbounds == nil {
+			vt.Logger.Error("ignoring routing rules without outbounds")
+			return
+		}
+		vt.routes = &routeTable{rules: rules, outbounds: outbounds}
+	}
+}
+
+// lookup returns the outbound of the first rule matching domain or addr.
+func (t *routeTable) lookup(domain string, addr netip.Addr) (string, bool) {
+	for _, r := range t.rules {
+		if r.match(domain, addr) {
+			return r.Outbound, true
+		}
+	}
+	return "", false
+}
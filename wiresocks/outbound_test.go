@@ -0,0 +1,98 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestParseRouteRule(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    RouteRule
+		wantErr bool
+	}{
+		{in: "Example.COM.=gool", want: RouteRule{Domain: "example.com", Outbound: "gool"}},
+		{in: "10.1.2.3/8=direct", want: RouteRule{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Outbound: "direct"}},
+		{in: "2001:db8::1/32=psiphon:DE", want: RouteRule{Prefix: netip.MustParsePrefix("2001:db8::/32"), Outbound: "psiphon:DE"}},
+		{in: "example.com", wantErr: true},
+		{in: "=warp", wantErr: true},
+		{in: "example.com=", wantErr: true},
+		{in: "10.0.0.0/33=warp", wantErr: true},
+		{in: "example.com:443=warp", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRouteRule(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseRouteRule(%q) = %v, %v, want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestRouteLookup(t *testing.T) {
+	table := &routeTable{rules: []RouteRule{
+		{Domain: "example.com", Outbound: "gool"},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Outbound: "direct"},
+		{Prefix: netip.MustParsePrefix("0.0.0.0/0"), Outbound: "block"},
+	}}
+	tests := []struct {
+		domain string
+		addr   string
+		want   string
+	}{
+		{domain: "www.example.com", want: "gool"},
+		{domain: "example.com", addr: "10.0.0.1", want: "gool"},
+		{domain: "notexample.com"},
+		{addr: "10.0.0.1", want: "direct"},
+		{addr: "::ffff:10.0.0.1", want: "direct"},
+		{addr: "192.0.2.1", want: "block"},
+		// Domains aren't resolved to match prefixes
+		{domain: "internal.test"},
+	}
+	for _, tt := range tests {
+		var addr netip.Addr
+		if tt.addr != "" {
+			addr = netip.MustParseAddr(tt.addr)
+		}
+		got, ok := table.lookup(tt.domain, addr)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("lookup(%q, %q) = %q, %v, want %q", tt.domain, tt.addr, got, ok, tt.want)
+		}
+	}
+}
+
+func TestOutboundsRegister(t *testing.T) {
+	o := NewOutbounds()
+	dialer := func(err error) DialFunc {
+		return func(context.Context, string, string) (net.Conn, error) { return nil, err }
+	}
+	errOld, errNew := errors.New("old"), errors.New("new")
+
+	for _, tag := range []string{OutboundDirect, OutboundBlock} {
+		if _, err := o.Register(tag, dialer(errOld)); err == nil {
+			t.Fatalf("registered the reserved tag %s", tag)
+		}
+	}
+
+	unregisterOld, err := o.Register("warp", dialer(errOld))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A tunnel brought up again replaces the old one, which unregistering
+	// late must leave alone
+	unregisterNew, err := o.Register("warp", dialer(errNew))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unregisterOld()
+	if _, err := o.Dial(context.Background(), "warp", "tcp", "192.0.2.1:80"); err != errNew {
+		t.Fatalf("got %v, want the new outbound", err)
+	}
+
+	unregisterNew()
+	if _, err := o.Dial(context.Background(), "warp", "tcp", "192.0.2.1:80"); err == nil || err == errNew {
+		t.Fatalf("got %v, want the outbound to be down", err)
+	}
+}
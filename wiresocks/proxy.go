@@ -2,21 +2,30 @@ package wiresocks
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/bepass-org/warp-plus/proxy/pkg/mixed"
 	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+	"github.com/bepass-org/warp-plus/upgrade"
 	"github.com/bepass-org/warp-plus/wireguard/device"
 	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
 	"github.com/things-go/go-socks5/bufferpool"
 )
 
+const defaultBufferSize = 256 * 1024
+
 // VirtualTun stores a reference to netstack network and DNS configuration
 type VirtualTun struct {
 	Tnet   *netstack.Net
@@ -24,45 +33,208 @@ type VirtualTun struct {
 	Dev    *device.Device
 	Ctx    context.Context
 	pool   bufferpool.BufPool
+	// direct lists domain suffixes that bypass the tunnel
+	direct []string
+	// conns records active connections, if set
+	conns *ConnTracker
+	// bufferSize is the size of the buffers used to relay connections
+	bufferSize int
+	// tlsConfig wraps the listener in TLS, if set
+	tlsConfig *tls.Config
+	// remoteResolve re-resolves sniffed domains inside the tunnel
+	remoteResolve bool
+	// sniffPorts are the ports connections to literal IPs are sniffed on
+	sniffPorts []uint16
+	// chain is the hop connections enter after the tunnel, if set
+	chain *ChainHop
+	// tor routes matching domains through tor, if set
+	tor *torRoute
+	// routes sends matching connections through other outbounds, if set
+	routes *routeTable
+	// failover picks the tunnel connections are dialed through, if set
+	failover *Failover
+	// nat maps the flows of UDP associations to sockets in the tunnel
+	nat *UDPNAT
+	// stun is how STUN and TURN are handled, allowed if empty
+	stun STUNPolicy
+	// extraBinds are served on next to the bind address, with unix
+	// sockets made with socketMode
+	extraBinds []string
+	socketMode os.FileMode
+	// acl lets connections in by their source, if set
+	acl *SourceACL
+	// panicHook is passed the panics of the goroutines of the proxy, if set
+	panicHook func(any)
+}
+
+type ProxyOption func(*VirtualTun)
+
+// WithDirectDomains routes connections to the given domains and their
+// subdomains around the tunnel. Connections made to a raw IP are matched
+// using the TLS SNI or HTTP Host the client sends.
+func WithDirectDomains(domains []string) ProxyOption {
+	return func(vt *VirtualTun) {
+		for _, d := range domains {
+			vt.direct = append(vt.direct, strings.ToLower(strings.TrimPrefix(d, ".")))
+		}
+	}
+}
+
+// WithConnTracker records proxied connections in t.
+func WithConnTracker(t *ConnTracker) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.conns = t
+	}
+}
+
+// WithBufferSize sets the size of each of the two relay buffers used per
+// connection. Non-positive sizes keep the default.
+func WithBufferSize(size int) ProxyOption {
+	return func(vt *VirtualTun) {
+		if size > 0 {
+			vt.bufferSize = size
+		}
+	}
+}
+
+// WithTLS serves the proxy over TLS using config.
+func WithTLS(config *tls.Config) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.tlsConfig = config
+	}
+}
+
+// WithRemoteResolve makes connections to literal IPs that carry a TLS SNI or
+// HTTP Host go to that domain as resolved inside the tunnel, so clients
+// that resolved it locally don't leak the lookup or end up at a poisoned
+// address.
+func WithRemoteResolve() ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.remoteResolve = true
+	}
+}
+
+// WithSniffPorts sniffs connections to literal IPs for a TLS SNI or HTTP
+// Host only on ports, instead of DefaultSniffPorts.
+func WithSniffPorts(ports []uint16) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.sniffPorts = ports
+	}
+}
+
+// WithUDPNAT relays the flows of UDP associations through n instead of a
+// NAT table with the default limits.
+func WithUDPNAT(n *UDPNAT) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.nat = n
+	}
+}
+
+// WithPanicHook passes the value of a panic on any goroutine of the proxy
+// to hook before it crashes the process.
+func WithPanicHook(hook func(any)) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.panicHook = hook
+	}
 }
 
 // StartProxy spawns a socks5 server.
-func StartProxy(ctx context.Context, l *slog.Logger, tnet *netstack.Net, bindAddress netip.AddrPort) (netip.AddrPort, error) {
-	ln, err := net.Listen("tcp", bindAddress.String())
+func StartProxy(ctx context.Context, l *slog.Logger, tnet *netstack.Net, bindAddress netip.AddrPort, options ...ProxyOption) (netip.AddrPort, error) {
+	ln, err := upgrade.Listen("tcp", bindAddress.String())
 	if err != nil {
 		return netip.AddrPort{}, err // Return error if binding was unsuccessful
 	}
 
-	vt := VirtualTun{
-		Tnet:   tnet,
-		Logger: l.With("subsystem", "vtun"),
-		Dev:    nil,
-		Ctx:    ctx,
-		pool:   bufferpool.NewPool(256 * 1024),
+	vt := newVirtualTun(ctx, l, tnet, options...)
+	addr := ln.Addr().(*net.TCPAddr).AddrPort()
+
+	lns := []net.Listener{ln}
+	for _, bind := range vt.extraBinds {
+		extra, err := listenBind(bind, vt.socketMode)
+		if err != nil {
+			for _, ln := range lns {
+				_ = ln.Close()
+			}
+			return netip.AddrPort{}, fmt.Errorf("failed to listen on %s: %w", bind, err)
+		}
+		lns = append(lns, extra)
 	}
 
-	proxy := mixed.NewProxy(
+	for _, ln := range lns {
+		if vt.acl != nil {
+			ln = vt.acl.wrap(vt.Logger, ln)
+		}
+		vt.serve(l, ln)
+	}
+	go func() {
+		<-vt.Ctx.Done()
+		for _, ln := range lns {
+			_ = ln.Close()
+		}
+		vt.Stop()
+	}()
+
+	return addr, nil
+}
+
+// serve serves the proxy on ln.
+func (vt *VirtualTun) serve(l *slog.Logger, ln net.Listener) {
+	if vt.tlsConfig != nil {
+		ln = tls.NewListener(ln, vt.tlsConfig)
+	}
+
+	options := []mixed.Option{
 		mixed.WithListener(ln),
 		mixed.WithLogger(l),
-		mixed.WithContext(ctx),
+		mixed.WithContext(vt.Ctx),
 		mixed.WithUserHandler(func(request *statute.ProxyRequest) error {
 			return vt.generalHandler(request)
 		}),
-	)
+	}
+	// Whoever the allowlist keeps out could otherwise still send on the
+	// associations of those it lets in
+	if vt.acl != nil {
+		options = append(options, mixed.WithClientOnlyUDP())
+	}
+	if vt.panicHook != nil {
+		options = append(options, mixed.WithPanicHook(vt.panicHook))
+	}
+	proxy := mixed.NewProxy(options...)
 	go func() {
+		defer vt.recoverPanic()
 		_ = proxy.ListenAndServe()
 	}()
-	go func() {
-		<-vt.Ctx.Done()
-		vt.Stop()
-	}()
+}
+
+func newVirtualTun(ctx context.Context, l *slog.Logger, tnet *netstack.Net, options ...ProxyOption) *VirtualTun {
+	vt := &VirtualTun{
+		Tnet:       tnet,
+		Logger:     l.With("subsystem", "vtun"),
+		Dev:        nil,
+		Ctx:        ctx,
+		bufferSize: defaultBufferSize,
+		sniffPorts: DefaultSniffPorts,
+	}
+
+	for _, option := range options {
+		option(vt)
+	}
+	vt.pool = bufferpool.NewPool(vt.bufferSize)
+	if vt.nat == nil {
+		vt.nat = NewUDPNAT(0, DefaultUDPTimeouts)
+	}
 
-	return ln.Addr().(*net.TCPAddr).AddrPort(), nil
+	return vt
 }
 
 func (vt *VirtualTun) generalHandler(req *statute.ProxyRequest) error {
+	defer vt.recoverPanic()
+
 	vt.Logger.Debug("handling connection", "protocol", req.Network, "destination", req.Destination)
-	conn, err := vt.Tnet.Dial(req.Network, req.Destination)
+	if pc, ok := req.Conn.(statute.PacketConn); ok {
+		return vt.relayUDP(pc)
+	}
+	conn, err := vt.dial(req)
 	if err != nil {
 		return err
 	}
@@ -76,10 +248,23 @@ func (vt *VirtualTun) generalHandler(req *statute.ProxyRequest) error {
 	// Close the connections when this function exits
 	defer conn.Close()
 	defer req.Conn.Close()
+
+	if vt.conns != nil {
+		upstream, client := conn, req.Conn
+		f := vt.conns.add(client.RemoteAddr().String(), req.Destination, req.Network, func() {
+			_ = upstream.Close()
+			_ = client.Close()
+		})
+		defer vt.conns.remove(f.ID)
+
+		conn = &countConn{Conn: conn, n: &f.sent}
+		req.Conn = &countConn{Conn: req.Conn, n: &f.recv}
+	}
 	// Channel to notify when copy operation is done
 	done := make(chan error, 1)
 	// Copy data from req.Conn to conn
 	go func() {
+		defer vt.recoverPanic()
 		buf1 := vt.pool.Get()
 		defer vt.pool.Put(buf1)
 		_, err := copyConnTimeout(conn, req.Conn, buf1[:cap(buf1)], timeout)
@@ -91,6 +276,7 @@ func (vt *VirtualTun) generalHandler(req *statute.ProxyRequest) error {
 	}()
 	// Copy data from conn to req.Conn
 	go func() {
+		defer vt.recoverPanic()
 		buf2 := vt.pool.Get()
 		defer vt.pool.Put(buf2)
 		_, err := copyConnTimeout(req.Conn, conn, buf2[:cap(buf2)], timeout)
@@ -107,6 +293,163 @@ func (vt *VirtualTun) generalHandler(req *statute.ProxyRequest) error {
 	return nil
 }
 
+// relayUDP relays the packets of a UDP association through the NAT table,
+// with a flow for each target the client sends to, until the association
+// ends.
+func (vt *VirtualTun) relayUDP(pc statute.PacketConn) error {
+	association := vt.nat.association()
+	defer vt.nat.closeAssociation(association)
+	defer pc.Close()
+
+	buf := vt.pool.Get()
+	defer vt.pool.Put(buf)
+	for {
+		n, target, err := pc.ReadPacket(buf[:cap(buf)])
+		if err != nil {
+			return nil
+		}
+		if vt.stun == STUNBlock && isSTUN(buf[:n]) {
+			vt.Logger.Debug("dropping stun packet", "destination", target)
+			continue
+		}
+
+		f, err := vt.nat.flow(association, target, buf[:n], func() (net.Conn, error) {
+			return vt.dialUDPFlow(pc, target)
+		}, func(b []byte) {
+			if _, err := pc.WritePacket(b, target); err != nil {
+				vt.Logger.Debug("failed to relay udp reply", "destination", target, "error", err)
+			}
+		})
+		if err != nil {
+			vt.Logger.Warn("failed to open udp flow", "destination", target, "error", err)
+			continue
+		}
+		if _, err := f.conn.Write(buf[:n]); err != nil {
+			vt.Logger.Debug("failed to relay udp packet", "destination", target, "error", err)
+		}
+	}
+}
+
+// dialUDPFlow opens the tunnel socket of a flow of pc to target,
+// recording it in the connection tracker if set.
+func (vt *VirtualTun) dialUDPFlow(pc statute.PacketConn, target string) (net.Conn, error) {
+	vt.Logger.Debug("opening udp flow", "destination", target)
+	conn, err := vt.dialTunnel("udp", target)
+	if err != nil || vt.conns == nil {
+		return conn, err
+	}
+	f := vt.conns.add(pc.RemoteAddr().String(), target, "udp", func() {
+		_ = conn.Close()
+	})
+	return &flowConn{
+		countConn: countConn{Conn: conn, n: &f.sent},
+		recv:      &f.recv,
+		remove:    func() { vt.conns.remove(f.ID) },
+	}, nil
+}
+
+// dial connects to the request destination through the tunnel, or directly
+// when the destination domain matches a direct routing rule.
+func (vt *VirtualTun) dial(req *statute.ProxyRequest) (net.Conn, error) {
+	if req.Network == "tcp" && isTURNPort(req.DestPort) {
+		switch vt.stun {
+		case STUNBlock:
+			return nil, fmt.Errorf("stun connection to %s blocked by policy", req.Destination)
+		case STUNTunnel:
+			return vt.dialTunnel(req.Network, req.Destination)
+		}
+	}
+
+	if req.Network != "tcp" || (len(vt.direct) == 0 && !vt.remoteResolve && vt.tor == nil && vt.routes == nil) {
+		return vt.dialTunnel(req.Network, req.Destination)
+	}
+
+	domain := strings.ToLower(req.DestHost)
+	literal := false
+	addr, err := netip.ParseAddr(domain)
+	if err == nil {
+		literal = true
+		domain = vt.sniff(req)
+	}
+
+	if vt.routes != nil {
+		if tag, ok := vt.routes.lookup(domain, addr); ok {
+			vt.Logger.Debug("routing connection through outbound", "outbound", tag, "domain", domain, "destination", req.Destination)
+			return vt.routes.outbounds.Dial(vt.Ctx, tag, req.Network, req.Destination)
+		}
+	}
+
+	if domain != "" && vt.tor != nil && vt.tor.match(domain) {
+		vt.Logger.Debug("routing connection through tor", "domain", domain, "destination", req.Destination)
+		return vt.tor.dial(vt.Ctx, req.Network, domain, req.DestPort)
+	}
+
+	if domain != "" && vt.matchDirect(domain) {
+		vt.Logger.Debug("routing connection directly", "domain", domain, "destination", req.Destination)
+		var d net.Dialer
+		return d.DialContext(vt.Ctx, req.Network, req.Destination)
+	}
+
+	if literal && domain != "" && vt.remoteResolve {
+		vt.Logger.Debug("resolving sniffed domain in tunnel", "domain", domain, "destination", req.Destination)
+		return vt.dialTunnel(req.Network, net.JoinHostPort(domain, strconv.Itoa(int(req.DestPort))))
+	}
+
+	return vt.dialTunnel(req.Network, req.Destination)
+}
+
+// sniff returns the domain the client of req sends in a TLS SNI or HTTP
+// Host, replacing req.Conn with one replaying what was read, if the port it
+// connects to is sniffed on.
+func (vt *VirtualTun) sniff(req *statute.ProxyRequest) string {
+	if !slices.Contains(vt.sniffPorts, uint16(req.DestPort)) {
+		return ""
+	}
+	domain, conn := sniffDomain(req.Conn)
+	req.Conn = conn
+	return domain
+}
+
+// dialTunnel connects through the tunnel, and the chained hop if any and it
+// carries network.
+func (vt *VirtualTun) dialTunnel(network, address string) (net.Conn, error) {
+	if vt.failover != nil {
+		return vt.failover.dial(func(tnet *netstack.Net) (net.Conn, error) {
+			return vt.dialThrough(tnet, network, address)
+		})
+	}
+	return vt.dialThrough(vt.Tnet, network, address)
+}
+
+func (vt *VirtualTun) dialThrough(tnet *netstack.Net, network, address string) (net.Conn, error) {
+	if vt.chain != nil && vt.chain.carries(network) {
+		return vt.chain.Dial(vt.Ctx, tnet, network, address)
+	}
+	return tnet.Dial(network, address)
+}
+
+// recoverPanic passes a panic to the panic hook and panics again. It must
+// be deferred directly.
+func (vt *VirtualTun) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if vt.panicHook != nil {
+		vt.panicHook(r)
+	}
+	panic(r)
+}
+
+func (vt *VirtualTun) matchDirect(domain string) bool {
+	for _, d := range vt.direct {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
 func (vt *VirtualTun) Stop() {
 	if vt.Dev != nil {
 		if err := vt.Dev.Down(); err != nil {
@@ -0,0 +1,37 @@
+package wiresocks
+
+import "encoding/binary"
+
+// quicMaxCIDLen is the longest connection ID of QUIC versions 1 and 2,
+// RFC 9000 17.2.
+const quicMaxCIDLen = 20
+
+// quicLongHeader parses the QUIC long header b starts with, returning the
+// destination and source connection IDs. Version negotiation packets,
+// which have no version, are not taken as QUIC.
+func quicLongHeader(b []byte) (dcid, scid []byte, ok bool) {
+	// Header form and fixed bit, RFC 8999 5.1 and RFC 9000 17.2
+	if len(b) < 7 || b[0]&0xc0 != 0xc0 || binary.BigEndian.Uint32(b[1:5]) == 0 {
+		return nil, nil, false
+	}
+	dlen := int(b[5])
+	if dlen > quicMaxCIDLen || len(b) < 7+dlen {
+		return nil, nil, false
+	}
+	dcid = b[6 : 6+dlen]
+	slen := int(b[6+dlen])
+	if slen > quicMaxCIDLen || len(b) < 7+dlen+slen {
+		return nil, nil, false
+	}
+	return dcid, b[7+dlen : 7+dlen+slen], true
+}
+
+// quicShortHeaderCID returns the destination connection ID of the QUIC
+// short header b starts with, given its length, which the header does
+// not carry.
+func quicShortHeaderCID(b []byte, n int) ([]byte, bool) {
+	if len(b) < 1+n || b[0]&0xc0 != 0x40 {
+		return nil, false
+	}
+	return b[1 : 1+n], true
+}
@@ -0,0 +1,132 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/device"
+)
+
+// relayIdleTimeout is how long a client of the relay may go silent before
+// its upstream socket is closed.
+const relayIdleTimeout = 3 * time.Minute
+
+// relayClient is a client of the relay with its own upstream socket, so
+// the endpoint tells clients apart by port.
+type relayClient struct {
+	upstream    *net.UDPConn
+	reassembler device.InitiationReassembler
+	lastSeen    time.Time
+}
+
+// RunInitiationRelay forwards wireguard traffic from clients on listen to
+// upstream and back until ctx is done, restoring the handshake initiations
+// clients framed with initiation fragments or junk. Everything else is
+// forwarded as is.
+func RunInitiationRelay(ctx context.Context, l *slog.Logger, listen, upstream string) error {
+	upstreamAddr, err := net.ResolveUDPAddr("udp", upstream)
+	if err != nil {
+		return err
+	}
+	listenAddr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", listenAddr)
+	if err != nil {
+		return err
+	}
+	l.Info("relaying", "listen", conn.LocalAddr(), "upstream", upstreamAddr)
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	var mu sync.Mutex
+	clients := make(map[netip.AddrPort]*relayClient)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range clients {
+			_ = c.upstream.Close()
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(relayIdleTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			mu.Lock()
+			for addr, c := range clients {
+				if time.Since(c.lastSeen) > relayIdleTimeout {
+					_ = c.upstream.Close()
+					delete(clients, addr)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	buf := make([]byte, device.MaxMessageSize)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			continue
+		}
+
+		mu.Lock()
+		c, ok := clients[from]
+		if !ok {
+			up, err := net.DialUDP("udp", nil, upstreamAddr)
+			if err != nil {
+				mu.Unlock()
+				l.Warn("failed to connect upstream", "client", from, "error", err)
+				continue
+			}
+			c = &relayClient{upstream: up}
+			clients[from] = c
+			l.Debug("new client", "client", from)
+			go relayBack(conn, up, from)
+		}
+		c.lastSeen = time.Now()
+		msg, ok := c.reassembler.Restore(buf[:n])
+		mu.Unlock()
+
+		if ok {
+			_, _ = c.upstream.Write(msg)
+		}
+	}
+}
+
+// relayBack forwards what upstream sends to the client at to until upstream
+// is closed.
+func relayBack(conn, upstream *net.UDPConn, to netip.AddrPort) {
+	buf := make([]byte, device.MaxMessageSize)
+	for {
+		n, err := upstream.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		_, _ = conn.WriteToUDPAddrPort(buf[:n], to)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"net/netip"
 	"time"
 
 	"github.com/bepass-org/warp-plus/ipscanner"
@@ -16,13 +17,20 @@ type ScanOptions struct {
 	MaxRTT     time.Duration
 	PrivateKey string
 	PublicKey  string
+	// QueueSize limits how many scanned endpoints are kept, zero keeps the
+	// scanner default.
+	QueueSize int
+	// Prefixes are the ranges scanned, empty scans the warp prefixes
+	Prefixes []netip.Prefix
+	// Scored, if set, receives every endpoint the scan kept, best first
+	Scored func([]ipscanner.IPInfo)
 }
 
 func RunScan(ctx context.Context, l *slog.Logger, opts ScanOptions) (result []ipscanner.IPInfo, err error) {
 	ctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
 	defer cancel()
 
-	scanner := ipscanner.NewScanner(
+	scannerOpts := []ipscanner.Option{
 		ipscanner.WithLogger(l.With(slog.String("subsystem", "scanner"))),
 		ipscanner.WithWarpPing(),
 		ipscanner.WithWarpPrivateKey(opts.PrivateKey),
@@ -30,8 +38,16 @@ func RunScan(ctx context.Context, l *slog.Logger, opts ScanOptions) (result []ip
 		ipscanner.WithUseIPv4(opts.V4),
 		ipscanner.WithUseIPv6(opts.V6),
 		ipscanner.WithMaxDesirableRTT(opts.MaxRTT),
-		ipscanner.WithCidrList(warp.WarpPrefixes()),
-	)
+	}
+	if len(opts.Prefixes) > 0 {
+		scannerOpts = append(scannerOpts, ipscanner.WithCidrList(opts.Prefixes))
+	} else {
+		scannerOpts = append(scannerOpts, ipscanner.WithCidrList(warp.WarpPrefixes()))
+	}
+	if opts.QueueSize > 0 {
+		scannerOpts = append(scannerOpts, ipscanner.WithIPQueueSize(opts.QueueSize))
+	}
+	scanner := ipscanner.NewScanner(scannerOpts...)
 
 	scanner.Run(ctx)
 
@@ -41,6 +57,9 @@ func RunScan(ctx context.Context, l *slog.Logger, opts ScanOptions) (result []ip
 	for {
 		ipList := scanner.GetAvailableIPs()
 		if len(ipList) > 1 {
+			if opts.Scored != nil {
+				opts.Scored(ipList)
+			}
 			for i := 0; i < 2; i++ {
 				result = append(result, ipList[i])
 			}
@@ -0,0 +1,52 @@
+package wiresocks
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/shadowsocks"
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+	"github.com/bepass-org/warp-plus/upgrade"
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+)
+
+// StartShadowsocks spawns a shadowsocks AEAD server whose connections are
+// dialed through the tunnel like those of the socks proxy.
+func StartShadowsocks(ctx context.Context, l *slog.Logger, tnet *netstack.Net, bindAddress netip.AddrPort, method, password string, options ...ProxyOption) (netip.AddrPort, error) {
+	c, err := shadowsocks.NewCipher(method, password)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	ln, err := upgrade.Listen("tcp", bindAddress.String())
+	if err != nil {
+		return netip.AddrPort{}, err // Return error if binding was unsuccessful
+	}
+
+	vt := newVirtualTun(ctx, l, tnet, options...)
+	if vt.acl != nil {
+		ln = vt.acl.wrap(vt.Logger, ln)
+	}
+
+	server := shadowsocks.NewServer(
+		c,
+		shadowsocks.WithListener(ln),
+		shadowsocks.WithLogger(l.With("subsystem", "shadowsocks")),
+		shadowsocks.WithContext(ctx),
+		shadowsocks.WithConnectHandle(func(request *statute.ProxyRequest) error {
+			return vt.generalHandler(request)
+		}),
+	)
+	go func() {
+		defer vt.recoverPanic()
+		_ = server.ListenAndServe()
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+
+	return ln.Addr().(*net.TCPAddr).AddrPort(), nil
+}
@@ -0,0 +1,183 @@
+package wiresocks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sniffTimeout = 300 * time.Millisecond
+	sniffSize    = 2048
+)
+
+// DefaultSniffPorts are the ports connections to literal IPs are sniffed
+// on, those of HTTP and TLS where the client speaks first. Sniffing a
+// protocol where the server speaks first, such as SSH or SMTP, would hold
+// every connection back until the sniff times out.
+var DefaultSniffPorts = []uint16{80, 443, 8080, 8443}
+
+// ParseSniffPorts parses a comma separated list of ports to sniff on.
+func ParseSniffPorts(s string) ([]uint16, error) {
+	var ports []uint16
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		port, err := strconv.ParseUint(f, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid sniff port %q", f)
+		}
+		ports = append(ports, uint16(port))
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no sniff ports in %q", s)
+	}
+	return ports, nil
+}
+
+// sniffConn replays the bytes read while sniffing before reading from the
+// underlying connection.
+type sniffConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *sniffConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// sniffDomain peeks at the first bytes the client sends and tries to find
+// the destination domain in a TLS ClientHello or an HTTP request. It returns
+// a connection that replays the sniffed bytes.
+func sniffDomain(conn net.Conn) (string, net.Conn) {
+	buf := make([]byte, sniffSize)
+	if err := conn.SetReadDeadline(time.Now().Add(sniffTimeout)); err != nil {
+		return "", conn
+	}
+	n, _ := conn.Read(buf)
+	_ = conn.SetReadDeadline(time.Time{})
+	if n == 0 {
+		return "", conn
+	}
+
+	buf = buf[:n]
+	wrapped := &sniffConn{Conn: conn, prefix: buf}
+
+	if domain := parseSNI(buf); domain != "" {
+		return domain, wrapped
+	}
+	return parseHTTPHost(buf), wrapped
+}
+
+// parseSNI extracts the server_name extension from a TLS ClientHello.
+func parseSNI(b []byte) string {
+	// record header: type(1) version(2) length(2)
+	if len(b) < 5 || b[0] != 0x16 {
+		return ""
+	}
+	b = b[5:]
+
+	// handshake header: type(1) length(3), client hello is type 1
+	if len(b) < 4 || b[0] != 0x01 {
+		return ""
+	}
+	b = b[4:]
+
+	// client version(2) random(32)
+	if len(b) < 34 {
+		return ""
+	}
+	b = b[34:]
+
+	// session id
+	b, ok := skipVector(b, 1)
+	if !ok {
+		return ""
+	}
+	// cipher suites
+	b, ok = skipVector(b, 2)
+	if !ok {
+		return ""
+	}
+	// compression methods
+	b, ok = skipVector(b, 1)
+	if !ok {
+		return ""
+	}
+
+	if len(b) < 2 {
+		return ""
+	}
+	exts := b[2:]
+	if l := int(binary.BigEndian.Uint16(b)); l < len(exts) {
+		exts = exts[:l]
+	}
+
+	for len(exts) >= 4 {
+		typ := binary.BigEndian.Uint16(exts)
+		l := int(binary.BigEndian.Uint16(exts[2:]))
+		exts = exts[4:]
+		if l > len(exts) {
+			return ""
+		}
+		data := exts[:l]
+		exts = exts[l:]
+
+		if typ != 0x0000 {
+			continue
+		}
+
+		// server_name_list length(2), name_type(1), host_name length(2)
+		if len(data) < 5 || data[2] != 0x00 {
+			return ""
+		}
+		nl := int(binary.BigEndian.Uint16(data[3:]))
+		if 5+nl > len(data) {
+			return ""
+		}
+		return strings.ToLower(string(data[5 : 5+nl]))
+	}
+	return ""
+}
+
+// skipVector skips a length-prefixed TLS vector whose length field is n
+// bytes long.
+func skipVector(b []byte, n int) ([]byte, bool) {
+	if len(b) < n {
+		return nil, false
+	}
+	var l int
+	for i := 0; i < n; i++ {
+		l = l<<8 | int(b[i])
+	}
+	if len(b) < n+l {
+		return nil, false
+	}
+	return b[n+l:], true
+}
+
+// parseHTTPHost extracts the Host header from a plain HTTP request.
+func parseHTTPHost(b []byte) string {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return ""
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
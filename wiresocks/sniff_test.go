@@ -0,0 +1,181 @@
+package wiresocks
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// clientHello returns the ClientHello a TLS client sends for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		client.Close()
+	}()
+
+	buf := make([]byte, 4096)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestParseSNI(t *testing.T) {
+	hello := clientHello(t, "Www.Example.com")
+	if got := parseSNI(hello); got != "www.example.com" {
+		t.Fatalf("parseSNI = %q, want www.example.com", got)
+	}
+
+	// No server_name without a name, and nothing from a hello cut short
+	// before its extensions
+	if got := parseSNI(clientHello(t, "")); got != "" {
+		t.Errorf("parseSNI of a hello without a name = %q", got)
+	}
+	for _, n := range []int{0, 5, 9, 43} {
+		if got := parseSNI(hello[:n]); got != "" {
+			t.Errorf("parseSNI of %d bytes = %q, want none", n, got)
+		}
+	}
+	if got := parseSNI([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")); got != "" {
+		t.Errorf("parseSNI of http = %q, want none", got)
+	}
+}
+
+func TestParseHTTPHost(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"GET / HTTP/1.1\r\nHost: Example.com\r\n\r\n", "example.com"},
+		{"POST /upload HTTP/1.1\r\nHost: example.com:8080\r\nContent-Length: 3\r\n\r\nabc", "example.com"},
+		{"GET http://example.org/ HTTP/1.1\r\nHost: example.org\r\n\r\n", "example.org"},
+		{"GET / HTTP/1.1\r\n", ""},
+		{"\x16\x03\x01\x00\x05hello", ""},
+	}
+	for _, tt := range tests {
+		if got := parseHTTPHost([]byte(tt.in)); got != tt.want {
+			t.Errorf("parseHTTPHost(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSniffDomain(t *testing.T) {
+	hello := clientHello(t, "example.com")
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		_, _ = client.Write(hello)
+		_, _ = client.Write([]byte("more"))
+	}()
+
+	domain, conn := sniffDomain(server)
+	if domain != "example.com" {
+		t.Fatalf("sniffed %q, want example.com", domain)
+	}
+	// What was sniffed is read again, followed by the rest
+	got := make([]byte, len(hello)+4)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(hello)+"more" {
+		t.Fatal("sniffed bytes not replayed")
+	}
+
+	// Clients waiting for the server to speak first aren't held up for long
+	silent, peer := net.Pipe()
+	defer peer.Close()
+	start := time.Now()
+	if domain, conn := sniffDomain(silent); domain != "" || conn != silent {
+		t.Fatalf("sniffed %q from a silent client", domain)
+	}
+	if d := time.Since(start); d > 5*sniffTimeout {
+		t.Fatalf("sniffing a silent client took %v", d)
+	}
+}
+
+func TestDialSniffedDirect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	// Without a tunnel, only a direct dial can reach the listener
+	vt := newVirtualTun(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), nil, WithDirectDomains([]string{".Example.com"}), WithSniffPorts([]uint16{uint16(port)}))
+
+	hello := clientHello(t, "www.example.com")
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() { _, _ = client.Write(hello) }()
+
+	conn, err := vt.dial(&statute.ProxyRequest{
+		Conn:        server,
+		Network:     "tcp",
+		Destination: net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+		DestHost:    "127.0.0.1",
+		DestPort:    int32(port),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if !vt.matchDirect("example.com") || !vt.matchDirect("www.example.com") || vt.matchDirect("notexample.com") {
+		t.Fatal("direct domains match other than the domain and its subdomains")
+	}
+}
+
+func TestParseSniffPorts(t *testing.T) {
+	ports, err := ParseSniffPorts("443, 8443,")
+	if err != nil || !slices.Equal(ports, []uint16{443, 8443}) {
+		t.Fatalf("got %v, %v, want [443 8443]", ports, err)
+	}
+	for _, s := range []string{"", ",", "0", "65536", "https"} {
+		if _, err := ParseSniffPorts(s); err == nil {
+			t.Errorf("parsed invalid ports %q", s)
+		}
+	}
+}
+
+func TestSniffPorts(t *testing.T) {
+	vt := newVirtualTun(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+
+	hello := clientHello(t, "example.com")
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() { _, _ = client.Write(hello) }()
+	req := &statute.ProxyRequest{Conn: server, DestPort: 443}
+	if domain := vt.sniff(req); domain != "example.com" {
+		t.Fatalf("sniffed %q on 443, want example.com", domain)
+	}
+
+	// Clients of a protocol where the server speaks first send nothing, and
+	// aren't held up waiting for them to
+	silent, peer := net.Pipe()
+	defer peer.Close()
+	req = &statute.ProxyRequest{Conn: silent, DestPort: 22}
+	start := time.Now()
+	if domain := vt.sniff(req); domain != "" || req.Conn != silent {
+		t.Fatalf("sniffed %q on 22", domain)
+	}
+	if d := time.Since(start); d >= sniffTimeout {
+		t.Fatalf("took %v on a port not sniffed", d)
+	}
+
+	vt = newVirtualTun(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), nil, WithSniffPorts([]uint16{22}))
+	if !slices.Contains(vt.sniffPorts, 22) || slices.Contains(vt.sniffPorts, 443) {
+		t.Fatalf("sniffing on %v, want only 22", vt.sniffPorts)
+	}
+}
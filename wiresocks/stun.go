@@ -0,0 +1,48 @@
+package wiresocks
+
+import "encoding/binary"
+
+// STUNPolicy is how the proxy handles STUN and TURN, which browsers use
+// for WebRTC to find the addresses they can be reached at.
+type STUNPolicy string
+
+const (
+	// STUNAllow handles STUN and TURN like other traffic.
+	STUNAllow STUNPolicy = "allow"
+	// STUNBlock drops STUN and TURN, so calls only work through relays
+	// reached some other way.
+	STUNBlock STUNPolicy = "block"
+	// STUNTunnel sends STUN and TURN through the tunnel even where routing
+	// rules send other traffic to the same place around it, so the address
+	// found is the one of the tunnel.
+	STUNTunnel STUNPolicy = "tunnel"
+)
+
+// STUNPolicies are the valid STUN policies, the default first.
+var STUNPolicies = []string{string(STUNAllow), string(STUNBlock), string(STUNTunnel)}
+
+// stunMagicCookie is in every STUN message since RFC 5389.
+const stunMagicCookie = 0x2112a442
+
+// WithSTUNPolicy handles STUN and TURN according to policy.
+func WithSTUNPolicy(policy STUNPolicy) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.stun = policy
+	}
+}
+
+// isSTUN reports whether b is a STUN message, RFC 8489 5.
+func isSTUN(b []byte) bool {
+	if len(b) < 20 || b[0]&0xc0 != 0 || binary.BigEndian.Uint32(b[4:8]) != stunMagicCookie {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	return length%4 == 0 && 20+length <= len(b)
+}
+
+// isTURNPort reports whether port is the one of STUN and TURN over TCP, or
+// over TLS, RFC 8489 9 and RFC 8656 4. Connections to it are taken to be
+// STUN or TURN without looking at them, which TLS wouldn't allow anyway.
+func isTURNPort(port int32) bool {
+	return port == 3478 || port == 5349
+}
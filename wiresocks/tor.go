@@ -0,0 +1,53 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// torRoute sends matching connections to a Tor SOCKS port.
+type torRoute struct {
+	dialer  proxy.ContextDialer
+	domains []string
+}
+
+// WithTor routes .onion addresses and the given domains, with their
+// subdomains, through the Tor SOCKS proxy at socks instead of the tunnel.
+func WithTor(socks netip.AddrPort, domains []string) ProxyOption {
+	return func(vt *VirtualTun) {
+		d, err := proxy.SOCKS5("tcp", socks.String(), nil, proxy.Direct)
+		if err != nil {
+			vt.Logger.Error("failed to set up tor outbound", "error", err)
+			return
+		}
+
+		route := &torRoute{dialer: d.(proxy.ContextDialer), domains: []string{"onion"}}
+		for _, domain := range domains {
+			route.domains = append(route.domains, strings.ToLower(strings.TrimPrefix(domain, ".")))
+		}
+		vt.tor = route
+	}
+}
+
+func (r *torRoute) match(domain string) bool {
+	for _, d := range r.domains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *torRoute) dial(ctx context.Context, network, domain string, port int32) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("tor does not carry %s", network)
+	}
+	// Hand tor the name, never a locally resolved address
+	return r.dialer.DialContext(ctx, network, net.JoinHostPort(domain, strconv.Itoa(int(port))))
+}
@@ -0,0 +1,368 @@
+package wiresocks
+
+import (
+	"container/list"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMaxUDPFlows bounds the UDP flows kept open
+	DefaultMaxUDPFlows = 1024
+	// udpBufferSize is the size of the buffer each flow reads replies
+	// into, which fits DNS answers and QUIC packets with room to spare
+	udpBufferSize = 16 << 10
+	// maxQUICCIDs bounds the server connection IDs kept per QUIC flow
+	maxQUICCIDs = 4
+)
+
+// UDPTimeouts are the idle timeouts of UDP flows.
+type UDPTimeouts struct {
+	// Default applies to flows none of the others apply to
+	Default time.Duration
+	// QUIC applies to flows recognized as QUIC, on any port
+	QUIC time.Duration
+	// Ports applies to flows to these ports, QUIC or not
+	Ports map[uint16]time.Duration
+}
+
+// DefaultUDPTimeouts keep flows for 5m, RFC 4787 4.3, but DNS lookups only
+// for their answer, and QUIC, which keeps its connections alive by itself,
+// for 1m.
+var DefaultUDPTimeouts = UDPTimeouts{
+	Default: 5 * time.Minute,
+	QUIC:    time.Minute,
+	Ports:   map[uint16]time.Duration{53: 10 * time.Second},
+}
+
+// Clone returns a copy of t that doesn't share its ports.
+func (t UDPTimeouts) Clone() UDPTimeouts {
+	t.Ports = maps.Clone(t.Ports)
+	if t.Ports == nil {
+		t.Ports = make(map[uint16]time.Duration)
+	}
+	return t
+}
+
+// UDPNATStats counts the flows of a UDPNAT.
+type UDPNATStats struct {
+	Active int `json:"active"`
+	// QUIC counts the active flows recognized as QUIC
+	QUIC int `json:"quic"`
+	// Created counts the flows opened, and Failed those whose socket in
+	// the tunnel could not be opened
+	Created uint64 `json:"created"`
+	Failed  uint64 `json:"failed"`
+	// Expired counts the flows closed for being idle, and Evicted those
+	// closed to make room for new ones
+	Expired uint64 `json:"expired"`
+	Evicted uint64 `json:"evicted"`
+	// Migrated counts the QUIC flows a new association took over
+	Migrated uint64 `json:"migrated"`
+}
+
+// UDPNAT maps the UDP flows of proxy clients, each a client association
+// and a target, to sockets in the tunnel. Flows are closed once idle for
+// their timeout, and the least recently used are closed to make room once
+// the table is full.
+//
+// Flows are recognized as QUIC by their long headers, which also carry
+// the connection IDs the server picked. A new association sending packets
+// with one of those takes the flow over, so a QUIC connection whose client
+// port changed keeps its socket, and the path the server knows, instead of
+// showing up at the server from another one.
+type UDPNAT struct {
+	timeouts UDPTimeouts
+	maxFlows int
+
+	mu    sync.Mutex
+	flows map[udpFlowKey]*list.Element
+	// lru holds the flows, most recently used first
+	lru list.List
+	// cids finds QUIC flows by target and server connection ID, the
+	// lengths of which short headers leave out and are kept in cidLens
+	cids    map[quicCIDKey]*udpFlow
+	cidLens []int
+
+	nextAssociation                             atomic.Uint64
+	created, failed, expired, evicted, migrated atomic.Uint64
+}
+
+type udpFlowKey struct {
+	association uint64
+	target      string
+}
+
+type quicCIDKey struct {
+	target string
+	cid    string
+}
+
+// udpFlow is a flow of a UDPNAT, with its socket in the tunnel. All but
+// conn are guarded by the mutex of the UDPNAT.
+type udpFlow struct {
+	key      udpFlowKey
+	conn     net.Conn
+	timeout  time.Duration
+	lastUsed time.Time
+	// reply passes replies to the association of the flow
+	reply func([]byte)
+	// quic is set once the flow is recognized as QUIC, with the server
+	// connection IDs seen on it in cids, oldest first
+	quic bool
+	cids []string
+}
+
+// NewUDPNAT returns a UDP NAT table of at most maxFlows flows, closing
+// idle flows after timeouts. Non-positive values keep the defaults.
+func NewUDPNAT(maxFlows int, timeouts UDPTimeouts) *UDPNAT {
+	if maxFlows <= 0 {
+		maxFlows = DefaultMaxUDPFlows
+	}
+	if timeouts.Default <= 0 {
+		timeouts.Default = DefaultUDPTimeouts.Default
+	}
+	if timeouts.QUIC <= 0 {
+		timeouts.QUIC = DefaultUDPTimeouts.QUIC
+	}
+	return &UDPNAT{
+		timeouts: timeouts,
+		maxFlows: maxFlows,
+		flows:    make(map[udpFlowKey]*list.Element),
+		cids:     make(map[quicCIDKey]*udpFlow),
+	}
+}
+
+// Stats returns the flow counts of n.
+func (n *UDPNAT) Stats() UDPNATStats {
+	n.mu.Lock()
+	s := UDPNATStats{Active: n.lru.Len()}
+	for e := n.lru.Front(); e != nil; e = e.Next() {
+		if e.Value.(*udpFlow).quic {
+			s.QUIC++
+		}
+	}
+	n.mu.Unlock()
+
+	s.Created = n.created.Load()
+	s.Failed = n.failed.Load()
+	s.Expired = n.expired.Load()
+	s.Evicted = n.evicted.Load()
+	s.Migrated = n.migrated.Load()
+	return s
+}
+
+// timeoutFor returns the idle timeout of flows to target.
+func (n *UDPNAT) timeoutFor(target string, quic bool) time.Duration {
+	if _, port, err := net.SplitHostPort(target); err == nil {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if t, ok := n.timeouts.Ports[uint16(p)]; err == nil && ok && t > 0 {
+			return t
+		}
+	}
+	if quic {
+		return n.timeouts.QUIC
+	}
+	return n.timeouts.Default
+}
+
+// association returns a new association id, flows of which are told
+// apart from those of others to the same target.
+func (n *UDPNAT) association() uint64 {
+	return n.nextAssociation.Add(1)
+}
+
+// flow returns the flow of association to target that packet, sent by
+// the client, goes out on. A new flow takes over the QUIC flow of another
+// association whose connection ID packet carries, or else opens a socket
+// with dial. Replies to the flow are passed to reply.
+func (n *UDPNAT) flow(association uint64, target string, packet []byte, dial func() (net.Conn, error), reply func([]byte)) (*udpFlow, error) {
+	key := udpFlowKey{association, target}
+	n.mu.Lock()
+	if e, ok := n.flows[key]; ok {
+		f := e.Value.(*udpFlow)
+		n.touch(e)
+		n.sniffLocked(f, packet, false)
+		n.mu.Unlock()
+		return f, nil
+	}
+	if f := n.migrateLocked(key, packet, reply); f != nil {
+		n.mu.Unlock()
+		n.migrated.Add(1)
+		return f, nil
+	}
+	n.mu.Unlock()
+
+	conn, err := dial()
+	if err != nil {
+		n.failed.Add(1)
+		return nil, err
+	}
+	f := &udpFlow{
+		key:      key,
+		conn:     conn,
+		timeout:  n.timeoutFor(target, false),
+		lastUsed: time.Now(),
+		reply:    reply,
+	}
+
+	n.mu.Lock()
+	for n.lru.Len() >= n.maxFlows {
+		n.removeLocked(n.lru.Back().Value.(*udpFlow))
+		n.evicted.Add(1)
+	}
+	n.flows[key] = n.lru.PushFront(f)
+	n.sniffLocked(f, packet, false)
+	n.mu.Unlock()
+	n.created.Add(1)
+
+	go n.serve(f)
+	return f, nil
+}
+
+// migrateLocked moves the QUIC flow to the target of key that packet
+// carries a server connection ID of over to the association of key, with
+// mu held. It returns nil if there is no such flow.
+func (n *UDPNAT) migrateLocked(key udpFlowKey, packet []byte, reply func([]byte)) *udpFlow {
+	var candidates [][]byte
+	if dcid, _, ok := quicLongHeader(packet); ok {
+		candidates = append(candidates, dcid)
+	}
+	for _, l := range n.cidLens {
+		if cid, ok := quicShortHeaderCID(packet, l); ok {
+			candidates = append(candidates, cid)
+		}
+	}
+
+	for _, cid := range candidates {
+		f, ok := n.cids[quicCIDKey{key.target, string(cid)}]
+		if !ok || f.key.association == key.association {
+			continue
+		}
+		e := n.flows[f.key]
+		delete(n.flows, f.key)
+		f.key = key
+		f.reply = reply
+		n.flows[key] = e
+		n.touch(e)
+		return f
+	}
+	return nil
+}
+
+// sniffLocked recognizes f as QUIC by packet, remembering the connection
+// ID the server picked if it is from the server, with mu held.
+func (n *UDPNAT) sniffLocked(f *udpFlow, packet []byte, fromServer bool) {
+	_, scid, ok := quicLongHeader(packet)
+	if !ok {
+		return
+	}
+	if !f.quic {
+		f.quic = true
+		f.timeout = n.timeoutFor(f.key.target, true)
+	}
+	if !fromServer || len(scid) == 0 || slices.Contains(f.cids, string(scid)) {
+		return
+	}
+
+	if len(f.cids) == maxQUICCIDs {
+		n.forgetLocked(f, f.cids[0])
+		f.cids = f.cids[1:]
+	}
+	f.cids = append(f.cids, string(scid))
+	n.cids[quicCIDKey{f.key.target, string(scid)}] = f
+	if !slices.Contains(n.cidLens, len(scid)) {
+		n.cidLens = append(n.cidLens, len(scid))
+	}
+}
+
+// forgetLocked drops the connection ID cid of f, with mu held.
+func (n *UDPNAT) forgetLocked(f *udpFlow, cid string) {
+	key := quicCIDKey{f.key.target, cid}
+	if n.cids[key] == f {
+		delete(n.cids, key)
+	}
+}
+
+func (n *UDPNAT) touch(e *list.Element) {
+	e.Value.(*udpFlow).lastUsed = time.Now()
+	n.lru.MoveToFront(e)
+}
+
+// serve passes the replies to f to its association until f is closed,
+// closing it once idle for its timeout.
+func (n *UDPNAT) serve(f *udpFlow) {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n.mu.Lock()
+		deadline := f.lastUsed.Add(f.timeout)
+		n.mu.Unlock()
+		_ = f.conn.SetReadDeadline(deadline)
+
+		nr, err := f.conn.Read(buf)
+		if err == nil {
+			n.mu.Lock()
+			if e, ok := n.flows[f.key]; ok && e.Value == f {
+				n.touch(e)
+			}
+			n.sniffLocked(f, buf[:nr], true)
+			reply := f.reply
+			n.mu.Unlock()
+			reply(buf[:nr])
+			continue
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			n.mu.Lock()
+			idle := time.Since(f.lastUsed) >= f.timeout
+			if idle && n.removeLocked(f) {
+				n.expired.Add(1)
+			}
+			n.mu.Unlock()
+			if !idle {
+				continue
+			}
+			return
+		}
+		// Closed, or failed for good
+		n.remove(f)
+		return
+	}
+}
+
+// remove closes f.
+func (n *UDPNAT) remove(f *udpFlow) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.removeLocked(f)
+}
+
+// removeLocked closes f, with mu held, reporting whether it was open.
+func (n *UDPNAT) removeLocked(f *udpFlow) bool {
+	e, ok := n.flows[f.key]
+	if !ok || e.Value != f {
+		return false
+	}
+	delete(n.flows, f.key)
+	n.lru.Remove(e)
+	for _, cid := range f.cids {
+		n.forgetLocked(f, cid)
+	}
+	_ = f.conn.Close()
+	return true
+}
+
+// closeAssociation closes the flows of association.
+func (n *UDPNAT) closeAssociation(association uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for key, e := range n.flows {
+		if key.association == association {
+			n.removeLocked(e.Value.(*udpFlow))
+		}
+	}
+}
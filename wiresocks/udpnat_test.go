@@ -0,0 +1,196 @@
+package wiresocks
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// natFlow opens the flow of association to target on n with packet,
+// returning the end of the socket in the tunnel the test plays the server
+// on. Replies are passed to reply if set.
+func natFlow(t *testing.T, n *UDPNAT, association uint64, target string, packet []byte, reply func([]byte)) (*udpFlow, net.Conn) {
+	t.Helper()
+	var server net.Conn
+	if reply == nil {
+		reply = func([]byte) {}
+	}
+	f, err := n.flow(association, target, packet, func() (net.Conn, error) {
+		c, s := net.Pipe()
+		server = s
+		return c, nil
+	}, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server != nil {
+		t.Cleanup(func() { server.Close() })
+	}
+	return f, server
+}
+
+// hasFlow reports whether the flow of association to target is open.
+func hasFlow(n *UDPNAT, association uint64, target string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.flows[udpFlowKey{association, target}]
+	return ok
+}
+
+// closed reports whether the other end of server was closed.
+func closed(server net.Conn) bool {
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := server.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+func TestUDPNATEvictsLeastRecentlyUsed(t *testing.T) {
+	n := NewUDPNAT(2, DefaultUDPTimeouts)
+	a := n.association()
+
+	_, first := natFlow(t, n, a, "10.0.0.1:1000", []byte("a"), nil)
+	_, second := natFlow(t, n, a, "10.0.0.2:1000", []byte("b"), nil)
+	// Sending on the first flow leaves the second least recently used
+	if _, again := natFlow(t, n, a, "10.0.0.1:1000", []byte("a"), nil); again != nil {
+		t.Fatal("opened a second socket for a flow")
+	}
+	_, third := natFlow(t, n, a, "10.0.0.3:1000", []byte("c"), nil)
+
+	if !closed(second) {
+		t.Fatal("least recently used flow not evicted")
+	}
+	for _, target := range []string{"10.0.0.1:1000", "10.0.0.3:1000"} {
+		if !hasFlow(n, a, target) {
+			t.Errorf("flow to %s evicted", target)
+		}
+	}
+	if s := n.Stats(); s.Active != 2 || s.Created != 3 || s.Evicted != 1 {
+		t.Fatalf("stats %+v, want 2 active of 3 created, 1 evicted", s)
+	}
+
+	// Flows of an association are closed with it
+	n.closeAssociation(a)
+	if !closed(first) || !closed(third) || n.Stats().Active != 0 {
+		t.Fatal("flows left open with their association")
+	}
+}
+
+func TestUDPNATTimeouts(t *testing.T) {
+	n := NewUDPNAT(0, UDPTimeouts{
+		Default: 5 * time.Minute,
+		QUIC:    time.Minute,
+		Ports:   map[uint16]time.Duration{53: 10 * time.Second, 443: 2 * time.Minute},
+	})
+	tests := []struct {
+		target string
+		quic   bool
+		want   time.Duration
+	}{
+		{"1.1.1.1:53", false, 10 * time.Second},
+		{"[2606:4700::1111]:53", false, 10 * time.Second},
+		// The timeout of the port applies to QUIC to it too
+		{"1.1.1.1:443", true, 2 * time.Minute},
+		{"1.1.1.1:8443", true, time.Minute},
+		{"1.1.1.1:27015", false, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := n.timeoutFor(tt.target, tt.quic); got != tt.want {
+			t.Errorf("timeout of %s (quic %v) is %v, want %v", tt.target, tt.quic, got, tt.want)
+		}
+	}
+
+	// Only the flow to the port with a short timeout is closed while idle
+	n = NewUDPNAT(0, UDPTimeouts{Default: time.Hour, Ports: map[uint16]time.Duration{53: 50 * time.Millisecond}})
+	a := n.association()
+	_, dns := natFlow(t, n, a, "10.0.0.1:53", []byte("query"), nil)
+	natFlow(t, n, a, "10.0.0.1:27015", []byte("game"), nil)
+
+	if !closed(dns) {
+		t.Fatal("idle flow to port 53 not closed")
+	}
+	if !hasFlow(n, a, "10.0.0.1:27015") {
+		t.Fatal("flow with the default timeout closed")
+	}
+	// The flow is counted once closed
+	deadline := time.Now().Add(time.Second)
+	for n.Stats().Expired == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if s := n.Stats(); s.Active != 1 || s.Expired != 1 {
+		t.Fatalf("stats %+v, want 1 active, 1 expired", s)
+	}
+}
+
+// quicLong returns a QUIC long header packet from dcid to scid.
+func quicLong(dcid, scid string) []byte {
+	b := append([]byte{0xc0, 0, 0, 0, 1, byte(len(dcid))}, dcid...)
+	b = append(b, byte(len(scid)))
+	return append(append(b, scid...), "payload"...)
+}
+
+// quicShort returns a QUIC short header packet to dcid.
+func quicShort(dcid string) []byte {
+	return append(append([]byte{0x40}, dcid...), "payload"...)
+}
+
+func TestUDPNATMigratesQUIC(t *testing.T) {
+	n := NewUDPNAT(0, DefaultUDPTimeouts)
+	const target = "10.0.0.1:443"
+	old, migrated := n.association(), n.association()
+
+	replies := make(chan uint64, 4)
+	replyTo := func(association uint64) func([]byte) {
+		return func([]byte) { replies <- association }
+	}
+	f, server := natFlow(t, n, old, target, quicLong("initial1", "client01"), replyTo(old))
+	n.mu.Lock()
+	quic, timeout := f.quic, f.timeout
+	n.mu.Unlock()
+	if !quic || timeout != DefaultUDPTimeouts.QUIC {
+		t.Fatalf("flow recognized as quic %v with timeout %v", quic, timeout)
+	}
+
+	// The server picks its connection ID in its reply
+	if _, err := server.Write(quicLong("client01", "server01")); err != nil {
+		t.Fatal(err)
+	}
+	if a := <-replies; a != old {
+		t.Fatalf("reply passed to association %d, want %d", a, old)
+	}
+
+	// Packets to other targets, or with other connection IDs, don't take
+	// the flow over
+	if _, s := natFlow(t, n, migrated, "10.0.0.2:443", quicShort("server01"), nil); s == nil {
+		t.Fatal("took over a flow to another target")
+	}
+	if _, s := natFlow(t, n, migrated, target, quicShort("server02"), nil); s == nil {
+		t.Fatal("took over a flow with another connection id")
+	}
+	n.closeAssociation(migrated)
+
+	// The client port changed, and the connection goes on from a new
+	// association
+	got, s := natFlow(t, n, migrated, target, quicShort("server01"), replyTo(migrated))
+	if s != nil || got != f {
+		t.Fatal("opened a new flow for a migrated connection")
+	}
+	if _, err := server.Write(quicShort("client01")); err != nil {
+		t.Fatal(err)
+	}
+	if a := <-replies; a != migrated {
+		t.Fatalf("reply passed to association %d, want %d", a, migrated)
+	}
+	if hasFlow(n, old, target) || !hasFlow(n, migrated, target) {
+		t.Fatal("flow not moved to the new association")
+	}
+	if s := n.Stats(); s.Migrated != 1 || s.QUIC != 1 {
+		t.Fatalf("stats %+v, want 1 quic flow migrated", s)
+	}
+
+	// Closing the old association leaves the flow alone
+	n.closeAssociation(old)
+	if !hasFlow(n, migrated, target) {
+		t.Fatal("migrated flow closed with its old association")
+	}
+}
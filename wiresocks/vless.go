@@ -0,0 +1,62 @@
+package wiresocks
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/netip"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+	"github.com/bepass-org/warp-plus/proxy/pkg/vless"
+	"github.com/bepass-org/warp-plus/upgrade"
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+)
+
+// StartVLESS spawns a VLESS server for the given user ids whose connections
+// are dialed through the tunnel like those of the socks proxy. WithTLS
+// serves it over TLS, as most clients expect.
+func StartVLESS(ctx context.Context, l *slog.Logger, tnet *netstack.Net, bindAddress netip.AddrPort, ids []string, options ...ProxyOption) (netip.AddrPort, error) {
+	users := make([]vless.UUID, 0, len(ids))
+	for _, id := range ids {
+		u, err := vless.ParseUUID(id)
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		users = append(users, u)
+	}
+
+	ln, err := upgrade.Listen("tcp", bindAddress.String())
+	if err != nil {
+		return netip.AddrPort{}, err // Return error if binding was unsuccessful
+	}
+	addr := ln.Addr().(*net.TCPAddr).AddrPort()
+
+	vt := newVirtualTun(ctx, l, tnet, options...)
+	if vt.acl != nil {
+		ln = vt.acl.wrap(vt.Logger, ln)
+	}
+	if vt.tlsConfig != nil {
+		ln = tls.NewListener(ln, vt.tlsConfig)
+	}
+
+	server := vless.NewServer(
+		users,
+		vless.WithListener(ln),
+		vless.WithLogger(l.With("subsystem", "vless")),
+		vless.WithContext(ctx),
+		vless.WithConnectHandle(func(request *statute.ProxyRequest) error {
+			return vt.generalHandler(request)
+		}),
+	)
+	go func() {
+		defer vt.recoverPanic()
+		_ = server.ListenAndServe()
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+
+	return addr, nil
+}